@@ -255,13 +255,15 @@ async function siteDNSConfigGet(siteID) {
   return await commonApplianceGet(siteID, 'network/dns');
 }
 
-// Load the list of VAPs from the server.
+// Load the list of VAPs from the server, along with the number of clients
+// connected to each.
 async function siteVAPsGet(siteID) {
-  const vapNames = await commonApplianceGet(siteID, 'network/vap');
-  debug('vapNames', vapNames);
+  const vapList = await commonApplianceGet(siteID, 'network/vap');
+  debug('vapList', vapList);
   const vapMap = {};
-  for (const n of vapNames) {
-    vapMap[n] = commonApplianceGet(siteID, `network/vap/${n}`);
+  for (const v of vapList) {
+    vapMap[v.name] = commonApplianceGet(siteID, `network/vap/${v.name}`)
+      .then((vap) => Object.assign({}, vap, {clients: v.clients}));
   }
   const res = await Promise.props(vapMap);
   debug('vap result is', res);
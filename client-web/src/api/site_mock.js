@@ -276,7 +276,11 @@ const mockVAPInfo = {
     'rings': ['standard', 'core'],
   },
 };
-const mockVAPNames = Object.keys(mockVAPInfo);
+const mockVAPList = [
+  {'name': 'eap', 'clients': 4},
+  {'name': 'guest', 'clients': 1},
+  {'name': 'psk', 'clients': 3},
+];
 
 const mockWan = {
   'currentAddress': '10.1.4.38/26',
@@ -522,7 +526,7 @@ function mockAxios(normalAxios, mode) {
     .onGet(/\/api\/sites\/.+\/nodes/).reply(200, mockNodes)
     .onPost(/\/api\/sites\/.+\/enroll_guest$/).reply(200, mockEnrollGuest)
     .onGet(/\/api\/sites\/.+\/network\/dns$/).reply(200, mockDNSConfig)
-    .onGet(/\/api\/sites\/.+\/network\/vap$/).reply(200, mockVAPNames)
+    .onGet(/\/api\/sites\/.+\/network\/vap$/).reply(200, mockVAPList)
     .onGet(/\/api\/sites\/.+\/network\/vap\.*/).reply(vapGetHandler)
     .onGet(/\/api\/sites\/.+\/network\/wan$/).reply(200, mockWan)
     .onGet(/\/api\/sites\/.+\/network\/wg$/).reply(200, mockWG)
@@ -211,6 +211,7 @@ export default {
           vpn: 'Remote access to this site using VPN software',
         },
         networks: 'Networks',
+        clients: 'No clients | 1 client | {count} clients',
       },
       network_vap: {
         title: 'Network Details',
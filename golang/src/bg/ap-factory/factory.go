@@ -147,6 +147,7 @@ var (
 	targetPlatform   *platformStorage
 	retrieveURL      string
 	clearOverlay     bool
+	sliceWorkers     int
 )
 
 func getMainDevice() string {
@@ -233,64 +234,6 @@ func repartitionSfdisk() {
 	log.Printf("partprobe %s\n", result)
 }
 
-func writeSlice(sl slice, imd string) {
-	devinfo, err := os.Stat(sl.device)
-	if err != nil {
-		log.Fatalf("stat %s from %s failed: %s\n", sl.device, sl.src, err)
-	}
-
-	dev, err := os.OpenFile(sl.device, os.O_WRONLY, devinfo.Mode())
-	if err != nil {
-		log.Fatalf("open %s failed: %s\n", sl.device, err)
-	}
-	defer dev.Close()
-
-	off, err := dev.Seek(sl.offset, io.SeekStart)
-	if err != nil {
-		log.Fatalf("seek to %d on %s failed: %s\n", sl.offset, sl.device, err)
-	}
-	if off != sl.offset {
-		log.Fatalf("seek to %d on %s arrived at %d\n", sl.offset, sl.device, off)
-	}
-
-	path := fmt.Sprintf("%s/%s", imd, sl.src)
-	inf, err := os.OpenFile(path, os.O_RDONLY, 0x0)
-	if err != nil {
-		log.Fatalf("open %s failed: %s\n", path, err)
-	}
-
-	if dryRun {
-		log.Printf("dry-run: skipping %s write\n", sl.src)
-		return
-	}
-
-	wt, err := io.Copy(dev, inf)
-
-	if err != nil {
-		log.Printf("%s writeto failed: %s\n", sl.src, err)
-	} else {
-		log.Printf("%s wrote %d bytes\n", sl.src, wt)
-	}
-
-	if sl.maxSize > -1 && wt > sl.maxSize {
-		log.Printf("WARNING: wrote %d bytes, exceeding %d maximum to %s\n", wt, sl.maxSize, sl.src)
-	}
-}
-
-func writeSlices(imd string, side int) {
-	for sn := range targetPlatform.slices {
-		s := targetPlatform.slices[sn]
-
-		if s.src != "" && (s.side == noSide || s.side == side) {
-			if kernelOnly && s.src != "KERNEL" {
-				log.Printf("kernel-only: skipping %s\n", s.src)
-			} else {
-				writeSlice(s, imd)
-			}
-		}
-	}
-}
-
 func uBootEnvRead(vbl string) (string, error) {
 	// This invocation can fail, if the environment variable is not
 	// defined.
@@ -1425,6 +1368,8 @@ func main() {
 		"additional, topologically-ordered packages to install")
 	installCmd.Flags().StringVarP(&installSide, "side", "s", "other",
 		"target install 'side' ['a', 'b', 'same', 'other']")
+	installCmd.Flags().IntVarP(&sliceWorkers, "jobs", "j", 2,
+		"maximum number of devices written concurrently")
 	rootCmd.AddCommand(installCmd)
 
 	hardenCmd := &cobra.Command{
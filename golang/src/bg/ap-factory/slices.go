@@ -0,0 +1,320 @@
+//
+// Copyright 2020 Brightgate Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+//
+
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often, in percent of the image, progress is reported while writing
+const progressStep = 10
+
+// namedSlice is a slice selected for writing, along with the name by which it
+// is known in the platform's slice table.
+type namedSlice struct {
+	name string
+	slice
+}
+
+// sliceGroup is a set of slices which target the same device.  The slices in a
+// group are written one after another; separate groups may be written
+// concurrently.
+type sliceGroup struct {
+	device string
+	slices []namedSlice
+}
+
+// sliceDevice is the subset of a block device's operations needed to write a
+// slice and read it back.
+type sliceDevice interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+}
+
+// sliceIO hides the files and devices involved in writing slices, so that the
+// mechanics of writing them can be exercised without real devices.
+type sliceIO interface {
+	// openImage opens a source image, returning it and its size
+	openImage(path string) (io.ReadCloser, int64, error)
+	// openDevice opens a device for both writing and reading
+	openDevice(path string) (sliceDevice, error)
+}
+
+type osSliceIO struct{}
+
+func (osSliceIO) openImage(path string) (io.ReadCloser, int64, error) {
+	inf, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := inf.Stat()
+	if err != nil {
+		inf.Close()
+		return nil, 0, err
+	}
+	return inf, info.Size(), nil
+}
+
+func (osSliceIO) openDevice(path string) (sliceDevice, error) {
+	return os.OpenFile(path, os.O_RDWR, 0)
+}
+
+// planSlices selects the slices to be written for the given side, and groups
+// them by target device.  The groups, and the slices within them, are sorted so
+// that the plan is the same from one run to the next.
+func planSlices(slices map[string]slice, side int, kernelOnly bool) []sliceGroup {
+	names := make([]string, 0, len(slices))
+	for sn := range slices {
+		names = append(names, sn)
+	}
+	sort.Strings(names)
+
+	byDevice := make(map[string]*sliceGroup)
+	devices := make([]string, 0)
+	for _, sn := range names {
+		s := slices[sn]
+		if s.src == "" || (s.side != noSide && s.side != side) {
+			continue
+		}
+		if kernelOnly && s.src != "KERNEL" {
+			log.Printf("kernel-only: skipping %s\n", s.src)
+			continue
+		}
+
+		g, ok := byDevice[s.device]
+		if !ok {
+			g = &sliceGroup{device: s.device}
+			byDevice[s.device] = g
+			devices = append(devices, s.device)
+		}
+		g.slices = append(g.slices, namedSlice{sn, s})
+	}
+	sort.Strings(devices)
+
+	groups := make([]sliceGroup, 0, len(devices))
+	for _, dev := range devices {
+		g := byDevice[dev]
+		sort.SliceStable(g.slices, func(i, j int) bool {
+			return g.slices[i].offset < g.slices[j].offset
+		})
+		groups = append(groups, *g)
+	}
+	return groups
+}
+
+// describePlan returns a description of the writes to be made, one line per
+// group of slices.
+func describePlan(groups []sliceGroup, workers int) []string {
+	lines := make([]string, 0, len(groups)+1)
+	lines = append(lines, fmt.Sprintf("%d device group(s), up to %d written concurrently",
+		len(groups), workers))
+	for i, g := range groups {
+		names := make([]string, len(g.slices))
+		for j, s := range g.slices {
+			names[j] = fmt.Sprintf("%s (%s @ %#x)", s.name, s.src, s.offset)
+		}
+		lines = append(lines, fmt.Sprintf("group %d: %s: %s", i, g.device,
+			strings.Join(names, ", ")))
+	}
+	return lines
+}
+
+// progressWriter writes to a device at successive offsets, hashing the bytes
+// which the device accepts and periodically reporting progress.
+type progressWriter struct {
+	name     string
+	dev      io.WriterAt
+	offset   int64
+	size     int64
+	written  int64
+	hash     hash.Hash
+	start    time.Time
+	reported int64
+	logf     func(string, ...interface{})
+}
+
+func rate(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) / 1e6 / elapsed.Seconds()
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.dev.WriteAt(p, w.offset+w.written)
+	w.hash.Write(p[:n])
+	w.written += int64(n)
+
+	if w.size > 0 {
+		pct := w.written * 100 / w.size
+		if pct/progressStep > w.reported/progressStep {
+			w.reported = pct
+			w.logf("%s: %d%% (%.1f MB/s)\n", w.name, pct,
+				rate(w.written, time.Since(w.start)))
+		}
+	}
+	return n, err
+}
+
+type sliceWriter struct {
+	io      sliceIO
+	imd     string
+	workers int
+	logf    func(string, ...interface{})
+}
+
+// writeSlice copies a slice's image to its device, hashing the data as it is
+// written, and then reads back the region written to make sure the device
+// holds what we sent it.
+func (w *sliceWriter) writeSlice(s namedSlice) error {
+	path := filepath.Join(w.imd, s.src)
+	img, size, err := w.io.openImage(path)
+	if err != nil {
+		return fmt.Errorf("%s: open %s failed: %v", s.name, path, err)
+	}
+	defer img.Close()
+
+	if s.maxSize > -1 && size > s.maxSize {
+		w.logf("WARNING: %s is %d bytes, exceeding %d maximum for %s\n",
+			s.src, size, s.maxSize, s.name)
+	}
+
+	dev, err := w.io.openDevice(s.device)
+	if err != nil {
+		return fmt.Errorf("%s: open %s failed: %v", s.name, s.device, err)
+	}
+	defer dev.Close()
+
+	pw := &progressWriter{
+		name:   s.name,
+		dev:    dev,
+		offset: s.offset,
+		size:   size,
+		hash:   sha256.New(),
+		start:  time.Now(),
+		logf:   w.logf,
+	}
+	wt, err := io.Copy(pw, img)
+	if err != nil {
+		return fmt.Errorf("%s: write to %s failed after %d bytes: %v",
+			s.name, s.device, wt, err)
+	}
+	if wt != size {
+		return fmt.Errorf("%s: wrote %d bytes to %s, expected %d",
+			s.name, wt, s.device, size)
+	}
+	elapsed := time.Since(pw.start)
+
+	if syncer, ok := dev.(interface{ Sync() error }); ok {
+		if err = syncer.Sync(); err != nil {
+			return fmt.Errorf("%s: sync %s failed: %v", s.name,
+				s.device, err)
+		}
+	}
+
+	readHash := sha256.New()
+	rd, err := io.Copy(readHash, io.NewSectionReader(dev, s.offset, wt))
+	if err != nil {
+		return fmt.Errorf("%s: read back from %s failed after %d bytes: %v",
+			s.name, s.device, rd, err)
+	}
+	if rd != wt {
+		return fmt.Errorf("%s: read back %d of %d bytes from %s",
+			s.name, rd, wt, s.device)
+	}
+	if !bytes.Equal(pw.hash.Sum(nil), readHash.Sum(nil)) {
+		return fmt.Errorf("%s: verification of %s at %#x failed: "+
+			"wrote %x, read back %x", s.name, s.device, s.offset,
+			pw.hash.Sum(nil), readHash.Sum(nil))
+	}
+
+	w.logf("%s: wrote and verified %d bytes to %s (%.1f MB/s)\n",
+		s.name, wt, s.device, rate(wt, elapsed))
+	return nil
+}
+
+// writeGroups writes each group of slices, running up to w.workers groups at
+// once.  A failure stops the rest of its group, but not the other groups.  The
+// errors from all of the failed groups are returned together.
+func (w *sliceWriter) writeGroups(groups []sliceGroup) error {
+	workers := w.workers
+	if workers < 1 {
+		workers = 1
+	}
+	sem := make(chan struct{}, workers)
+	errs := make([]error, len(groups))
+
+	var wg sync.WaitGroup
+	for i, g := range groups {
+		wg.Add(1)
+		go func(i int, g sliceGroup) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			for _, s := range g.slices {
+				if err := w.writeSlice(s); err != nil {
+					errs[i] = err
+					return
+				}
+			}
+		}(i, g)
+	}
+	wg.Wait()
+
+	msgs := make([]string, 0)
+	for _, err := range errs {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) > 0 {
+		return fmt.Errorf("slice write failed: %s",
+			strings.Join(msgs, "; "))
+	}
+	return nil
+}
+
+func writeSlices(imd string, side int) {
+	groups := planSlices(targetPlatform.slices, side, kernelOnly)
+	for _, line := range describePlan(groups, sliceWorkers) {
+		if dryRun {
+			log.Printf("dry-run: %s\n", line)
+		} else {
+			log.Printf("%s\n", line)
+		}
+	}
+	if dryRun {
+		log.Printf("dry-run: skipping slice writes\n")
+		return
+	}
+
+	w := &sliceWriter{
+		io:      osSliceIO{},
+		imd:     imd,
+		workers: sliceWorkers,
+		logf:    log.Printf,
+	}
+	if err := w.writeGroups(groups); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+}
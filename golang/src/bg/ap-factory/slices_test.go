@@ -0,0 +1,259 @@
+//
+// Copyright 2020 Brightgate Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+//
+
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memDevice is an in-memory device.  If shortWrite is set, writes which would
+// cross that offset stop short of it, without reporting an error.  If corrupt
+// is set, the byte at that offset is flipped whenever it is read.
+type memDevice struct {
+	io *memSliceIO
+
+	sync.Mutex
+	data       []byte
+	shortWrite int64
+	corrupt    int64
+}
+
+func (d *memDevice) WriteAt(p []byte, off int64) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	n := len(p)
+	if d.shortWrite > 0 && off+int64(n) > d.shortWrite {
+		n = int(d.shortWrite - off)
+		if n < 0 {
+			n = 0
+		}
+	}
+	if end := off + int64(n); end > int64(len(d.data)) {
+		d.data = append(d.data, make([]byte, end-int64(len(d.data)))...)
+	}
+	copy(d.data[off:], p[:n])
+	return n, nil
+}
+
+func (d *memDevice) ReadAt(p []byte, off int64) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if off >= int64(len(d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d.data[off:])
+	if d.corrupt > 0 && d.corrupt >= off && d.corrupt < off+int64(n) {
+		p[d.corrupt-off] ^= 0xff
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *memDevice) Close() error {
+	d.io.release()
+	return nil
+}
+
+// memSliceIO serves images and devices from memory, and keeps track of how
+// many devices are open at once.
+type memSliceIO struct {
+	images  map[string][]byte
+	devices map[string]*memDevice
+
+	sync.Mutex
+	open    int
+	maxOpen int
+}
+
+func newMemSliceIO() *memSliceIO {
+	return &memSliceIO{
+		images:  make(map[string][]byte),
+		devices: make(map[string]*memDevice),
+	}
+}
+
+func (m *memSliceIO) addDevice(name string) *memDevice {
+	d := &memDevice{io: m}
+	m.devices[name] = d
+	return d
+}
+
+func (m *memSliceIO) release() {
+	m.Lock()
+	m.open--
+	m.Unlock()
+}
+
+func (m *memSliceIO) openImage(path string) (io.ReadCloser, int64, error) {
+	data, ok := m.images[filepath.Base(path)]
+	if !ok {
+		return nil, 0, fmt.Errorf("no such image")
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func (m *memSliceIO) openDevice(path string) (sliceDevice, error) {
+	d, ok := m.devices[path]
+	if !ok {
+		return nil, fmt.Errorf("no such device")
+	}
+
+	m.Lock()
+	m.open++
+	if m.open > m.maxOpen {
+		m.maxOpen = m.open
+	}
+	m.Unlock()
+
+	// Give the other workers a chance to overlap with this one
+	time.Sleep(10 * time.Millisecond)
+	return d, nil
+}
+
+func randomImage(size int) []byte {
+	data := make([]byte, size)
+	rand.Read(data)
+	return data
+}
+
+func newTestWriter(m *memSliceIO, workers int) *sliceWriter {
+	return &sliceWriter{
+		io:      m,
+		imd:     "/images",
+		workers: workers,
+		logf:    func(string, ...interface{}) {},
+	}
+}
+
+func TestPlanSlices(t *testing.T) {
+	assert := require.New(t)
+
+	names := func(groups []sliceGroup) [][]string {
+		rval := make([][]string, len(groups))
+		for i, g := range groups {
+			for _, s := range g.slices {
+				rval[i] = append(rval[i], s.name)
+			}
+		}
+		return rval
+	}
+
+	// The kernel and U-Boot share the raw device, so must be written in
+	// turn; the root filesystem has its own partition.
+	groups := planSlices(mt7623slices, sideA, false)
+	assert.Len(groups, 2)
+	assert.Equal(mt7623MainStorage, groups[0].device)
+	assert.Equal(mt7623RootfsDevice, groups[1].device)
+	assert.Equal([][]string{{"UBOOT", "KERNEL"}, {"ROOTFS"}}, names(groups))
+
+	groups = planSlices(mt7623slices, sideB, false)
+	assert.Equal([][]string{{"UBOOT", "KERNELX"}, {"ROOTFSX"}}, names(groups))
+
+	groups = planSlices(mt7623slices, sideA, true)
+	assert.Equal([][]string{{"KERNEL"}}, names(groups))
+
+	plan := describePlan(planSlices(mt7623slices, sideA, false), 2)
+	assert.Equal([]string{
+		"2 device group(s), up to 2 written concurrently",
+		"group 0: /dev/mmcblk0: UBOOT (UBOOT @ 0x40000), KERNEL (KERNEL @ 0x140000)",
+		"group 1: /dev/mmcblk0p1: ROOTFS (SQUASHFS @ 0x0)",
+	}, plan)
+}
+
+func TestWriteGroups(t *testing.T) {
+	assert := require.New(t)
+
+	m := newMemSliceIO()
+	m.images["UBOOT"] = randomImage(1000)
+	m.images["KERNEL"] = randomImage(100000)
+	m.images["SQUASHFS"] = randomImage(300000)
+	raw := m.addDevice(mt7623MainStorage)
+	root := m.addDevice(mt7623RootfsDevice)
+
+	groups := planSlices(mt7623slices, sideA, false)
+	err := newTestWriter(m, 2).writeGroups(groups)
+	assert.NoError(err)
+	assert.Equal(2, m.maxOpen)
+	assert.Zero(m.open)
+
+	assert.Equal(m.images["UBOOT"],
+		raw.data[mt7623UBootOffset:mt7623UBootOffset+1000])
+	assert.Equal(m.images["KERNEL"],
+		raw.data[mt7623KernelOffset:mt7623KernelOffset+100000])
+	assert.Equal(m.images["SQUASHFS"], root.data)
+
+	// With a single worker, only one device is in use at a time
+	m.maxOpen = 0
+	err = newTestWriter(m, 1).writeGroups(groups)
+	assert.NoError(err)
+	assert.Equal(1, m.maxOpen)
+}
+
+func TestWriteSliceShortWrite(t *testing.T) {
+	assert := require.New(t)
+
+	m := newMemSliceIO()
+	m.images["UBOOT"] = randomImage(1000)
+	m.images["KERNEL"] = randomImage(100000)
+	m.images["SQUASHFS"] = randomImage(300000)
+	m.addDevice(mt7623MainStorage)
+	root := m.addDevice(mt7623RootfsDevice)
+	root.shortWrite = 150000
+
+	groups := planSlices(mt7623slices, sideA, false)
+	err := newTestWriter(m, 2).writeGroups(groups)
+	assert.Error(err)
+	assert.Contains(err.Error(), "ROOTFS: write to /dev/mmcblk0p1 failed")
+	assert.Contains(err.Error(), io.ErrShortWrite.Error())
+	assert.NotContains(err.Error(), "KERNEL")
+}
+
+func TestWriteSliceVerifyMismatch(t *testing.T) {
+	assert := require.New(t)
+
+	m := newMemSliceIO()
+	m.images["UBOOT"] = randomImage(1000)
+	m.images["KERNEL"] = randomImage(100000)
+	m.images["SQUASHFS"] = randomImage(300000)
+	raw := m.addDevice(mt7623MainStorage)
+	m.addDevice(mt7623RootfsDevice)
+
+	// Corrupt the U-Boot image as it's read back.  The kernel follows it
+	// on the same device, so shouldn't be written at all.
+	raw.corrupt = mt7623UBootOffset + 500
+
+	groups := planSlices(mt7623slices, sideA, false)
+	err := newTestWriter(m, 2).writeGroups(groups)
+	assert.Error(err)
+	assert.Contains(err.Error(), "UBOOT: verification of /dev/mmcblk0 at 0x40000 failed")
+	assert.NotContains(err.Error(), "ROOTFS")
+	assert.Less(len(raw.data), mt7623KernelOffset)
+
+	// Missing images are reported by slice, too
+	delete(m.images, "SQUASHFS")
+	raw.corrupt = 0
+	err = newTestWriter(m, 2).writeGroups(groups)
+	assert.Error(err)
+	assert.Contains(err.Error(), "ROOTFS: open /images/SQUASHFS failed")
+}
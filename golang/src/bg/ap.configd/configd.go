@@ -115,6 +115,7 @@ var updateCheckTable = []struct {
 	{regexp.MustCompile(`^@/network/wan/static.*`), checkWan},
 	{regexp.MustCompile(`^@/site_index$`), checkSubnet},
 	{regexp.MustCompile(`^@/dns/cnames/`), checkCname},
+	{regexp.MustCompile(`^@/dns/custom/`), checkCustomDNS},
 }
 
 var updateHandlers = []struct {
@@ -317,50 +318,58 @@ func updateNotify(records []*updateRecord) {
 	}
 }
 
-func eventHandler(event []byte) {
+// Translate an entity event into the property updates it implies for the
+// client.
+func entityUpdates(entity *base_msg.EventNetEntity) []*updateRecord {
 	var vap, ring string
 
-	entity := &base_msg.EventNetEntity{}
-	proto.Unmarshal(event, entity)
-
-	if entity.MacAddress == nil {
-		slog.Warnf("Received a NET.ENTITY event with no MAC: %v",
-			entity)
-		return
-	}
 	hwaddr := network.Uint64ToHWAddr(*entity.MacAddress).String()
 	path := "@/clients/" + hwaddr + "/"
 	client, _ := propTree.GetNode(path)
 	updates := make([]*updateRecord, 0)
 	active := "unknown"
 
-	// We start by assuming that a client is wired, but any subsequent
-	// wireless event will overrule that assumption.
-	wireless := "false"
-	if w, _ := propTree.GetNode(path + "connection/wireless"); w != nil {
-		wireless = w.Value
+	// Whichever component observes the client on the network tells us how
+	// it is connected: hostapd events carry a VAP, and events for clients
+	// seen on a wired port are flagged as such.  Other events (e.g., from
+	// DHCP) can't tell, so they leave the existing setting alone.  The
+	// property is only written when it changes, so it is recorded once for
+	// each client rather than on every event.
+	var wireless string
+	if entity.VirtualAP != nil {
+		wireless = "true"
+	} else if entity.GetWired() {
+		wireless = "false"
+	}
+	if wireless != "" {
+		w, _ := propTree.GetNode(path + "connection/wireless")
+		if w == nil || w.Value != wireless {
+			updates = append(updates,
+				updateChange(path+"connection/wireless",
+					&wireless, nil))
+		}
 	}
 
 	if entity.Ring != nil {
 		ring = *entity.Ring
 	}
-	if entity.VirtualAP != nil {
-		wireless = "true"
-		vap = *entity.VirtualAP
-
-		if *entity.Disconnect {
+	if entity.VirtualAP != nil || entity.GetWired() {
+		if entity.GetDisconnect() {
 			active = "false"
 		} else {
 			active = "true"
 		}
 		updates = append(updates,
-			updateChange(path+"connection/node", entity.Node, nil),
+			updateChange(path+"connection/node", entity.Node, nil))
+	}
+	if entity.VirtualAP != nil {
+		vap = *entity.VirtualAP
+		updates = append(updates,
 			updateChange(path+"connection/band", entity.Band, nil),
 			updateChange(path+"connection/vap", &vap, nil))
 	}
 	updates = append(updates,
-		updateChange(path+"connection/active", &active, nil),
-		updateChange(path+"connection/wireless", &wireless, nil))
+		updateChange(path+"connection/active", &active, nil))
 
 	if entity.Username != nil {
 		updates = append(updates,
@@ -380,6 +389,19 @@ func eventHandler(event []byte) {
 		updates = append(updates,
 			updateChange(path+"ipv4_observed", &ipv4, nil))
 	}
+	return updates
+}
+
+func eventHandler(event []byte) {
+	entity := &base_msg.EventNetEntity{}
+	proto.Unmarshal(event, entity)
+
+	if entity.MacAddress == nil {
+		slog.Warnf("Received a NET.ENTITY event with no MAC: %v",
+			entity)
+		return
+	}
+	updates := entityUpdates(entity)
 
 	propTree.ChangesetInit()
 	failed := false
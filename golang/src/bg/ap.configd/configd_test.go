@@ -33,15 +33,20 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"strings"
 	"testing"
 
 	"bg/ap_common/aputil"
 	"bg/ap_common/broker"
+	"bg/base_msg"
 	"bg/common/cfgapi"
 	"bg/common/cfgmsg"
 	"bg/common/cfgtree"
+	"bg/common/network"
+
+	"github.com/golang/protobuf/proto"
 )
 
 var (
@@ -1248,6 +1253,91 @@ func TestRingSubnets(t *testing.T) {
 	}
 }
 
+// Count the updates to a client's connection/wireless property triggered by
+// an entity event, and then apply the event.
+func sendEntity(t *testing.T, entity *base_msg.EventNetEntity) int {
+	var cnt int
+
+	for _, u := range entityUpdates(entity) {
+		if strings.HasSuffix(u.path, "/connection/wireless") {
+			cnt++
+		}
+	}
+
+	event, err := proto.Marshal(entity)
+	if err != nil {
+		t.Fatalf("failed to marshal entity: %v", err)
+	}
+	eventHandler(event)
+	return cnt
+}
+
+func TestEntityWireless(t *testing.T) {
+	const mac = "02:00:00:00:00:01"
+	const prop = "@/clients/" + mac + "/connection/"
+
+	hwaddr, _ := net.ParseMAC(mac)
+	entity := func() *base_msg.EventNetEntity {
+		return &base_msg.EventNetEntity{
+			Timestamp:  aputil.NowToProtobuf(),
+			Sender:     proto.String("test"),
+			MacAddress: proto.Uint64(network.HWAddrToUint64(hwaddr)),
+			Node:       proto.String("node0"),
+			Disconnect: proto.Bool(false),
+		}
+	}
+	dhcp := entity()
+	dhcp.Ipv4Address = proto.Uint32(0xc0a80305)
+	station := entity()
+	station.VirtualAP = proto.String("psk")
+	station.Band = proto.String("5GHz")
+	wired := entity()
+	wired.Wired = proto.Bool(true)
+	gone := entity()
+	gone.Wired = proto.Bool(true)
+	gone.Disconnect = proto.Bool(true)
+
+	// DHCP can't tell how a client is connected, so it doesn't guess
+	testTreeInit(t)
+	if n := sendEntity(t, dhcp); n != 0 {
+		t.Errorf("DHCP event wrote wireless %d times", n)
+	}
+	fetchSubtree(t, prop+"wireless", false)
+
+	// The first event from hostapd records the client as wireless, and
+	// later events leave it alone.
+	cnt := sendEntity(t, station)
+	cnt += sendEntity(t, station)
+	cnt += sendEntity(t, dhcp)
+	if cnt != 1 {
+		t.Errorf("wireless client: wireless written %d times", cnt)
+	}
+	checkOneProp(t, prop+"wireless", "true", true)
+	checkOneProp(t, prop+"band", "5GHz", true)
+	checkOneProp(t, prop+"vap", "psk", true)
+
+	// Likewise for a client seen on a wired port, which doesn't pick up
+	// any of the wireless attributes.
+	testTreeInit(t)
+	cnt = sendEntity(t, wired)
+	cnt += sendEntity(t, gone)
+	cnt += sendEntity(t, wired)
+	if cnt != 1 {
+		t.Errorf("wired client: wireless written %d times", cnt)
+	}
+	checkOneProp(t, prop+"wireless", "false", true)
+	checkOneProp(t, prop+"active", "true", true)
+	checkOneProp(t, prop+"node", "node0", true)
+	fetchSubtree(t, prop+"band", false)
+	fetchSubtree(t, prop+"vap", false)
+
+	// A client which moves from a wired port to a radio is updated
+	if n := sendEntity(t, station); n != 1 {
+		t.Errorf("moved client: wireless written %d times", n)
+	}
+	checkOneProp(t, prop+"wireless", "true", true)
+}
+
 func TestMain(m *testing.M) {
 	var err error
 	slog = aputil.NewLogger(pname)
@@ -55,6 +55,12 @@ func dnsNameInuse(ignore *cfgtree.PNode, hostname string) bool {
 		}
 	}
 
+	for name, record := range propTree.GetChildren("@/dns/custom") {
+		if record != ignore && strings.EqualFold(name, hostname) {
+			return true
+		}
+	}
+
 	return false
 }
 
@@ -118,6 +124,31 @@ func checkCname(prop, hostname string) error {
 	return err
 }
 
+// Validate the name of a custom DNS A record.  The address has already been
+// checked by the type validation.
+func checkCustomDNS(prop, addr string) error {
+	var err error
+
+	// The validation code and the regexp that got us here should guarantee
+	// that the structure of the path is @/dns/custom/<hostname>
+	path := strings.Split(prop, "/")
+	if len(path) != 4 {
+		err = fmt.Errorf("invalid property path: %s", prop)
+	} else {
+		// Replacing the address of an existing entry is allowed
+		node, _ := propTree.GetNode(prop)
+		name := path[3]
+
+		if !network.ValidDNSLabel(name) {
+			err = fmt.Errorf("invalid hostname: %s", name)
+		} else if dnsNameInuse(node, name) {
+			err = fmt.Errorf("duplicate hostname")
+		}
+	}
+
+	return err
+}
+
 // Build the set of per-ring subnets that would result from this property change
 func proposedSubnets(prop, val string) (map[string]*net.IPNet, error) {
 	const basePath = "@/network/base_address"
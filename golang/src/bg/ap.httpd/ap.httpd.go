@@ -271,7 +271,7 @@ func main() {
 	go apcfg.HealthMonitor(config, mcpd)
 	aputil.ReportInit(slog, pname)
 
-	rings = config.GetRings()
+	rings = config.GetRingsLegacy()
 	if rings == nil {
 		mcpd.SetState(mcp.BROKEN)
 		slog.Fatalf("can't get ring configuration")
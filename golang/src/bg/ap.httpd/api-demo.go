@@ -17,6 +17,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"sort"
 	"time"
 
 	"bg/common/cfgapi"
@@ -141,7 +142,7 @@ func demoRingsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	var resp daRings = make(map[string]daRing)
-	for ringName, ring := range config.GetRings() {
+	for ringName, ring := range config.GetRingsLegacy() {
 		resp[ringName] = daRing{
 			VirtualAPs:    ring.VirtualAPs,
 			Subnet:        ring.Subnet,
@@ -161,7 +162,7 @@ func demoDevicesHandler(w http.ResponseWriter, r *http.Request) {
 	clientsRaw := config.GetClients()
 	devices := make([]*daDevice, 0)
 
-	allRings := config.GetRings()
+	allRings := config.GetRingsLegacy()
 	for mac, client := range clientsRaw {
 		scans := config.GetClientScans(mac)
 		vulns := config.GetVulnerabilities(mac)
@@ -302,22 +303,35 @@ func demoDeviceMetricsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func demoDNSInfoGetHandler(w http.ResponseWriter, r *http.Request) {
-	dns := config.GetDNSInfo()
+	dns := config.GetDNSInfoLegacy()
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(&dns); err != nil {
 		panic(err)
 	}
 }
 
+type demoVAPSummary struct {
+	Name    string `json:"name"`
+	Clients int    `json:"clients"`
+}
+
 func demoVAPGetHandler(w http.ResponseWriter, r *http.Request) {
-	vapNames := make([]string, 0)
-	vaps := config.GetVirtualAPs()
-	for vapName := range vaps {
-		vapNames = append(vapNames, vapName)
+	counts, err := config.GetVAPClientCounts()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	vaps := make([]demoVAPSummary, 0, len(counts))
+	for vapName, clients := range counts {
+		vaps = append(vaps, demoVAPSummary{vapName, clients})
 	}
+	sort.Slice(vaps, func(i, j int) bool {
+		return vaps[i].Name < vaps[j].Name
+	})
 
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(&vapNames); err != nil {
+	if err := json.NewEncoder(w).Encode(&vaps); err != nil {
 		panic(err)
 	}
 }
@@ -389,7 +403,7 @@ func demoVAPNamePostHandler(w http.ResponseWriter, r *http.Request) {
 // Implements GET /api/site/:uuid/network/wan, returning information about the
 // WAN link
 func demoWanGetHandler(w http.ResponseWriter, r *http.Request) {
-	wan := config.GetWanInfo()
+	wan := config.GetWanInfoLegacy()
 	if wan == nil {
 		wan = &cfgapi.WanInfo{}
 	}
@@ -232,11 +232,11 @@ func daemonInit() error {
 	config.HandleChange(`^@/policy/site/network/forward/.*/tgt$`, forwardUpdated)
 	config.HandleDelExp(`^@/policy/site/network/forward/.*/tgt$`, forwardDeleted)
 
-	rings = config.GetRings()
+	rings = config.GetRingsLegacy()
 	clients = config.GetClients()
 
 	discoverDevices()
-	wanInit(config.GetWanInfo())
+	wanInit(config.GetWanInfoLegacy())
 
 	// All wired devices that haven't yet been assigned to a ring will be
 	// put into "standard" by default
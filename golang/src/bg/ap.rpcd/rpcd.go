@@ -225,30 +225,27 @@ func testNetException(ctx context.Context, tclient cloud_rpc.EventClient) error
 	return publishEvent(ctx, tclient, "exception", exc)
 }
 
-func healthConfig(prop, val string) {
-	path := "@/metrics/health/" + nodeUUID + "/" + prop
-	err := config.CreateProp(path, val, nil)
-	if err != nil {
-		slog.Warnf("setting %s to %s: %v", path, val, err)
-	}
-}
-
 func healthLoop(ctx context.Context, tclient cloud_rpc.EventClient,
 	wg *sync.WaitGroup, doneChan chan bool) {
 
 	var done bool
 
-	healthConfig("boot_time", nodeBootTime.Format(time.RFC3339))
+	health := cfgapi.NodeHealth{
+		BootTime: &nodeBootTime,
+		Role:     "gateway",
+	}
 	if aputil.IsSatelliteMode() {
-		healthConfig("role", "satellite")
-	} else {
-		healthConfig("role", "gateway")
+		health.Role = "satellite"
 	}
 
 	ticker := time.NewTicker(time.Second * 5)
 	defer ticker.Stop()
 	for !done {
-		healthConfig("alive", time.Now().Format(time.RFC3339))
+		now := time.Now()
+		health.Alive = &now
+		if err := config.ReportNodeHealth(nodeUUID, &health); err != nil {
+			slog.Warnf("reporting node health: %v", err)
+		}
 		select {
 		case done = <-doneChan:
 		case <-ticker.C:
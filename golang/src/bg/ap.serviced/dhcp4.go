@@ -918,7 +918,7 @@ func (h *ringHandler) recoverLeases() {
 func initHandlers() {
 	// Iterate over the known rings.  For each one, create a DHCP handler to
 	// manage its subnet.
-	rings := config.GetRings()
+	rings := config.GetRingsLegacy()
 	for name := range rings {
 		h := newHandler(name, rings)
 		h.recoverLeases()
@@ -1153,7 +1153,7 @@ func initNetwork() {
 		setSearchDomain(tmp)
 	}
 
-	rings := config.GetRings()
+	rings := config.GetRingsLegacy()
 	if rings == nil {
 		slog.Fatalf("Can't retrieve ring information")
 	} else {
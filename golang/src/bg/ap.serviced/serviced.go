@@ -292,7 +292,7 @@ func main() {
 
 	clients = config.GetClients()
 	getVPNClients()
-	rings = config.GetRings()
+	rings = config.GetRingsLegacy()
 
 	brokerd.Handle(base_def.TOPIC_UPDATE, eventHandler)
 	initInterfaces()
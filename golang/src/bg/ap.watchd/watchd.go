@@ -419,7 +419,7 @@ func main() {
 	brokerd.Handle(base_def.TOPIC_UPDATE, netEventHandler)
 	brokerd.Handle(base_def.TOPIC_ENTITY, entityEventHandler)
 
-	rings = config.GetRings()
+	rings = config.GetRingsLegacy()
 	getGateways()
 	getLeases()
 	getVPNClients()
@@ -0,0 +1,316 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"bg/common/cfgapi"
+)
+
+const (
+	authStatsProp = "@/metrics/wifi"
+
+	// The failure-rate window is divided into this many buckets, which
+	// age out one at a time.
+	authWindowBuckets = 10
+)
+
+type authCounter int
+
+const (
+	authAssoc authCounter = iota
+	authEAPSuccess
+	authEAPFailure
+	authPSKMismatch
+	authRetransmitLoop
+	numAuthCounters
+)
+
+// The property names under which each counter is published
+var authCounterNames = [numAuthCounters]string{
+	"assoc",
+	"eap_success",
+	"eap_failure",
+	"psk_mismatch",
+	"retransmit_loops",
+}
+
+type authCounters [numAuthCounters]uint64
+
+type authBucket struct {
+	start    time.Time
+	attempts int
+	failures int
+}
+
+type vapAuthStats struct {
+	totals authCounters
+	rings  map[string]*authCounters
+	dirty  bool
+
+	window  []authBucket // oldest first
+	alarmed bool         // is the failure rate currently too high?
+}
+
+// authAlarm describes a VAP whose authentication failure rate has exceeded the
+// configured threshold.
+type authAlarm struct {
+	vap      string
+	attempts int
+	failures int
+	window   time.Duration
+}
+
+// authStats tallies association and authentication outcomes for each VAP, and
+// for each ring within a VAP.  The tallies are periodically published to
+// @/metrics/wifi/<vap>/<counter> and @/metrics/wifi/<vap>/rings/<ring>/<counter>.
+// The counters only ever increase: on startup, the published values are
+// reloaded and used as the base for new events, so they survive restarts of
+// both hostapd and ap.wifid.
+//
+// Each VAP also tracks its failure rate over a sliding window, raising an alarm
+// when the rate first exceeds the configured threshold.
+type authStats struct {
+	vaps map[string]*vapAuthStats
+
+	sync.Mutex
+}
+
+var wifiAuthStats = newAuthStats()
+
+func newAuthStats() *authStats {
+	return &authStats{
+		vaps: make(map[string]*vapAuthStats),
+	}
+}
+
+// Fetch the stats for a VAP, allocating them if needed.  Must be called with
+// the stats locked.
+func (s *authStats) vap(name string) *vapAuthStats {
+	v := s.vaps[name]
+	if v == nil {
+		v = &vapAuthStats{
+			rings: make(map[string]*authCounters),
+		}
+		s.vaps[name] = v
+	}
+	return v
+}
+
+func (v *vapAuthStats) ring(name string) *authCounters {
+	r := v.rings[name]
+	if r == nil {
+		r = &authCounters{}
+		v.rings[name] = r
+	}
+	return r
+}
+
+// Add an attempt to the sliding window, discarding any buckets which have aged
+// out.  Returns the totals over the window.
+func (v *vapAuthStats) windowAdd(now time.Time, failure bool) (int, int) {
+	var attempts, failures int
+
+	window := *authFailWindow
+	width := window / authWindowBuckets
+	if width <= 0 {
+		width = 1
+	}
+
+	cutoff := now.Add(-window)
+	expired := 0
+	for _, b := range v.window {
+		if b.start.Add(width).After(cutoff) {
+			break
+		}
+		expired++
+	}
+	v.window = v.window[expired:]
+
+	start := now.Truncate(width)
+	if n := len(v.window); n == 0 || v.window[n-1].start.Before(start) {
+		v.window = append(v.window, authBucket{start: start})
+	}
+	b := &v.window[len(v.window)-1]
+	b.attempts++
+	if failure {
+		b.failures++
+	}
+
+	for _, b := range v.window {
+		attempts += b.attempts
+		failures += b.failures
+	}
+	return attempts, failures
+}
+
+// Record a single event for a client of the given VAP and ring.  The ring may
+// be empty if the client hasn't been assigned to one.  If the event pushes the
+// VAP's failure rate over the alarm threshold, an alarm is returned.
+func (s *authStats) record(vap, ring string, counter authCounter,
+	now time.Time) *authAlarm {
+
+	s.Lock()
+	defer s.Unlock()
+
+	v := s.vap(vap)
+	v.totals[counter]++
+	if ring != "" {
+		v.ring(ring)[counter]++
+	}
+	v.dirty = true
+
+	// Every attempt ends in either an association or a failure.  An EAP
+	// success is followed by an association, so it isn't counted
+	// separately.
+	var failure bool
+	switch counter {
+	case authAssoc:
+	case authEAPFailure, authPSKMismatch, authRetransmitLoop:
+		failure = true
+	default:
+		return nil
+	}
+
+	attempts, failures := v.windowAdd(now, failure)
+	pct := *authFailPercent
+	over := attempts >= *authFailMinAttempts && failures*100 > attempts*pct
+	if !over {
+		v.alarmed = false
+		return nil
+	}
+	if v.alarmed {
+		return nil
+	}
+
+	v.alarmed = true
+	return &authAlarm{
+		vap:      vap,
+		attempts: attempts,
+		failures: failures,
+		window:   *authFailWindow,
+	}
+}
+
+func authCounterProps(props map[string]string, prefix string,
+	counters *authCounters) {
+
+	for i, name := range authCounterNames {
+		props[prefix+"/"+name] = strconv.FormatUint(counters[i], 10)
+	}
+}
+
+// Build the set of properties needed to publish the counters which have
+// changed since the last flush.  Also returns the names of the VAPs included.
+func (s *authStats) flushProps() (map[string]string, []string) {
+	props := make(map[string]string)
+	names := make([]string, 0)
+
+	s.Lock()
+	for name, v := range s.vaps {
+		if !v.dirty {
+			continue
+		}
+		prefix := authStatsProp + "/" + name
+		authCounterProps(props, prefix, &v.totals)
+		for ring, r := range v.rings {
+			authCounterProps(props, prefix+"/rings/"+ring, r)
+		}
+		v.dirty = false
+		names = append(names, name)
+	}
+	s.Unlock()
+
+	return props, names
+}
+
+// Publish the changed counters to the config tree.  If that fails, they will
+// be retried on the next flush.
+func (s *authStats) flush() {
+	props, names := s.flushProps()
+	if len(props) == 0 || config == nil {
+		return
+	}
+
+	if err := config.CreateProps(props, nil); err != nil {
+		slog.Warnf("publishing wifi auth counters: %v", err)
+		s.Lock()
+		for _, name := range names {
+			s.vaps[name].dirty = true
+		}
+		s.Unlock()
+	}
+}
+
+func loadAuthCounters(counters *authCounters, node *cfgapi.PropertyNode) {
+	for i, name := range authCounterNames {
+		prop, ok := node.Children[name]
+		if !ok {
+			continue
+		}
+		val, err := strconv.ParseUint(prop.Value, 10, 64)
+		if err != nil {
+			slog.Warnf("bad %s counter %q: %v", name, prop.Value, err)
+			continue
+		}
+		counters[i] = val
+	}
+}
+
+// Reload the counters published by a previous instance of ap.wifid, to use as
+// the base for new events.
+func (s *authStats) load() {
+	props, err := config.GetProps(authStatsProp)
+	if err != nil {
+		if err != cfgapi.ErrNoProp {
+			slog.Warnf("fetching %s: %v", authStatsProp, err)
+		}
+		return
+	}
+
+	s.Lock()
+	for name, node := range props.Children {
+		// The retransmit state shares this subtree
+		if name == path.Base(retransmitStateProp) {
+			continue
+		}
+
+		v := s.vap(name)
+		loadAuthCounters(&v.totals, node)
+		if rings, ok := node.Children["rings"]; ok {
+			for ring, rnode := range rings.Children {
+				loadAuthCounters(v.ring(ring), rnode)
+			}
+		}
+	}
+	s.Unlock()
+}
+
+// Periodically publish the auth counters, until told to exit
+func authStatsLoop(wg *sync.WaitGroup, doneChan chan bool) {
+	defer wg.Done()
+
+	t := time.NewTicker(*authStatsFlush)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-doneChan:
+			wifiAuthStats.flush()
+			return
+		case <-t.C:
+			wifiAuthStats.flush()
+		}
+	}
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func setupAuthStatsTest(t *testing.T, window time.Duration, pct, min int) *authStats {
+	slog = zaptest.NewLogger(t).Sugar()
+	config = cfgapi.NewHandle(mockcfg.NewMockExecEmptyTree())
+
+	oldWindow, oldPct, oldMin := *authFailWindow, *authFailPercent,
+		*authFailMinAttempts
+	*authFailWindow = window
+	*authFailPercent = pct
+	*authFailMinAttempts = min
+	t.Cleanup(func() {
+		*authFailWindow = oldWindow
+		*authFailPercent = oldPct
+		*authFailMinAttempts = oldMin
+	})
+
+	return newAuthStats()
+}
+
+func getCounter(t *testing.T, prop string) string {
+	val, err := config.GetProp(authStatsProp + "/" + prop)
+	require.NoError(t, err, prop)
+	return val
+}
+
+func TestAuthCounters(t *testing.T) {
+	assert := require.New(t)
+	s := setupAuthStatsTest(t, time.Hour, 50, 1000)
+	now := time.Now()
+
+	s.record("eap", "standard", authEAPSuccess, now)
+	s.record("eap", "standard", authAssoc, now)
+	s.record("eap", "devices", authEAPFailure, now)
+	s.record("eap", "", authEAPFailure, now)
+	s.record("eap", "standard", authRetransmitLoop, now)
+	s.record("psk", "core", authPSKMismatch, now)
+	s.record("psk", "core", authAssoc, now)
+	s.record("psk", "core", authAssoc, now)
+
+	eap := s.vaps["eap"]
+	assert.Equal(authCounters{1, 1, 2, 0, 1}, eap.totals)
+	assert.Equal(authCounters{1, 1, 0, 0, 1}, *eap.rings["standard"])
+	assert.Equal(authCounters{0, 0, 1, 0, 0}, *eap.rings["devices"])
+	assert.Len(eap.rings, 2)
+	assert.Equal(authCounters{2, 0, 0, 1, 0}, s.vaps["psk"].totals)
+
+	s.flush()
+	assert.Equal("2", getCounter(t, "eap/eap_failure"))
+	assert.Equal("1", getCounter(t, "eap/retransmit_loops"))
+	assert.Equal("0", getCounter(t, "eap/psk_mismatch"))
+	assert.Equal("1", getCounter(t, "eap/rings/devices/eap_failure"))
+	assert.Equal("2", getCounter(t, "psk/assoc"))
+	assert.Equal("1", getCounter(t, "psk/rings/core/psk_mismatch"))
+
+	// Only VAPs with new events are published again
+	props, names := s.flushProps()
+	assert.Empty(props)
+	assert.Empty(names)
+	s.record("psk", "core", authAssoc, now)
+	props, names = s.flushProps()
+	assert.Equal([]string{"psk"}, names)
+	assert.Equal("3", props[authStatsProp+"/psk/assoc"])
+	assert.NotContains(props, authStatsProp+"/eap/assoc")
+}
+
+func TestAuthCountersPersist(t *testing.T) {
+	assert := require.New(t)
+	s := setupAuthStatsTest(t, time.Hour, 50, 1000)
+	now := time.Now()
+
+	// The retransmit state lives alongside the counters
+	m := newRetransmitMap()
+	m.markBroken(m.get(testMac(1)))
+
+	for i := 0; i < 5; i++ {
+		s.record("eap", "standard", authAssoc, now)
+	}
+	s.record("eap", "standard", authEAPFailure, now)
+	s.flush()
+
+	// Simulate a restart of ap.wifid: the counters pick up where the old
+	// ones left off.
+	s2 := newAuthStats()
+	s2.load()
+	assert.NotContains(s2.vaps, "retransmit_state")
+	assert.Equal(uint64(5), s2.vaps["eap"].totals[authAssoc])
+	assert.Equal(uint64(5), s2.vaps["eap"].rings["standard"][authAssoc])
+
+	s2.record("eap", "standard", authAssoc, now)
+	s2.record("eap", "guest", authAssoc, now)
+	s2.flush()
+	assert.Equal("7", getCounter(t, "eap/assoc"))
+	assert.Equal("6", getCounter(t, "eap/rings/standard/assoc"))
+	assert.Equal("1", getCounter(t, "eap/rings/guest/assoc"))
+	assert.Equal("1", getCounter(t, "eap/eap_failure"))
+
+	// Junk in the tree doesn't prevent the rest from loading
+	assert.NoError(config.CreateProp(authStatsProp+"/eap/eap_success",
+		"bogus", nil))
+	s3 := newAuthStats()
+	s3.load()
+	assert.Equal(uint64(7), s3.vaps["eap"].totals[authAssoc])
+	assert.Equal(uint64(0), s3.vaps["eap"].totals[authEAPSuccess])
+}
+
+func TestAuthFailureAlarm(t *testing.T) {
+	assert := require.New(t)
+	window := 10 * time.Minute
+	s := setupAuthStatsTest(t, window, 50, 4)
+	now := time.Now().Truncate(time.Minute)
+
+	// Too few attempts to judge
+	for i := 0; i < 3; i++ {
+		assert.Nil(s.record("eap", "", authEAPFailure, now))
+	}
+
+	// Crossing the threshold raises a single alarm
+	alarm := s.record("eap", "", authPSKMismatch, now)
+	assert.NotNil(alarm)
+	assert.Equal("eap", alarm.vap)
+	assert.Equal(4, alarm.attempts)
+	assert.Equal(4, alarm.failures)
+	assert.Equal(window, alarm.window)
+	assert.Nil(s.record("eap", "", authRetransmitLoop, now))
+
+	// Other VAPs are judged separately
+	for i := 0; i < 4; i++ {
+		assert.Nil(s.record("psk", "", authAssoc, now))
+	}
+
+	// EAP successes aren't attempts in their own right
+	for i := 0; i < 10; i++ {
+		assert.Nil(s.record("eap", "", authEAPSuccess, now))
+	}
+	assert.Equal(5, s.vaps["eap"].window[0].attempts)
+
+	// Successful associations bring the rate back down, rearming the
+	// alarm.  5 failures out of 10 attempts is not over the threshold.
+	for i := 0; i < 5; i++ {
+		assert.Nil(s.record("eap", "", authAssoc, now))
+	}
+	assert.False(s.vaps["eap"].alarmed)
+	assert.NotNil(s.record("eap", "", authEAPFailure, now))
+
+	// Once the window has passed, the old failures no longer count
+	later := now.Add(window + time.Minute)
+	assert.Nil(s.record("eap", "", authAssoc, later))
+	assert.False(s.vaps["eap"].alarmed)
+	assert.Len(s.vaps["eap"].window, 1)
+	for i := 0; i < 2; i++ {
+		assert.Nil(s.record("eap", "", authEAPFailure, later))
+	}
+	assert.NotNil(s.record("eap", "", authEAPFailure, later))
+
+	// Failures age out of the window a bucket at a time
+	s = setupAuthStatsTest(t, window, 50, 4)
+	for i := 0; i < 3; i++ {
+		s.record("eap", "", authEAPFailure, now)
+	}
+	for i := 0; i < 3; i++ {
+		s.record("eap", "", authAssoc, now.Add(5*time.Minute))
+	}
+	assert.Nil(s.record("eap", "", authAssoc, now.Add(9*time.Minute)))
+	assert.Len(s.vaps["eap"].window, 3)
+	assert.Nil(s.record("eap", "", authEAPFailure,
+		now.Add(11*time.Minute)))
+	assert.Len(s.vaps["eap"].window, 3)
+	assert.Equal(5, s.vaps["eap"].window[0].attempts+
+		s.vaps["eap"].window[1].attempts+s.vaps["eap"].window[2].attempts)
+}
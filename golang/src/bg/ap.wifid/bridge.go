@@ -13,11 +13,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
 	"bg/ap_common/netctl"
 	"bg/base_def"
+	"bg/base_msg"
 )
 
 func addNicToBridge(bridge, nic string) error {
@@ -47,17 +49,107 @@ func removeNicFromBridge(bridge, nic string) error {
 	return nil
 }
 
+// Each entry in a bridge's forwarding database, as exported in
+// /sys/class/net/<bridge>/brforward, is a struct __fdb_entry:
+//
+//	mac_addr[6], port_no, is_local, ageing_timer_value (u32),
+//	port_hi, pad0, unused (u16)
+const fdbEntrySize = 16
+
+// Parse a bridge's forwarding database, returning the remote MAC addresses
+// learned on any of the given ports.
+func parseFDB(data []byte, ports map[int]bool) map[string]bool {
+	macs := make(map[string]bool)
+	for len(data) >= fdbEntrySize {
+		entry := data[:fdbEntrySize]
+		data = data[fdbEntrySize:]
+
+		port := int(entry[12])<<8 | int(entry[6])
+		if entry[7] == 0 && ports[port] {
+			macs[net.HardwareAddr(entry[:6]).String()] = true
+		}
+	}
+	return macs
+}
+
+// Return the MAC addresses of the clients the bridge has seen on its wired
+// ports.
+func bridgeWiredClients(bridge string) (map[string]bool, error) {
+	dir := "/sys/class/net/" + bridge
+	ifaces, err := ioutil.ReadDir(dir + "/brif")
+	if err != nil {
+		return nil, err
+	}
+
+	ports := make(map[int]bool)
+	for _, iface := range ifaces {
+		name := iface.Name()
+		if plat.NicIsWireless(name) {
+			continue
+		}
+		b, err := ioutil.ReadFile(dir + "/brif/" + name + "/port_no")
+		if err != nil {
+			continue
+		}
+		s := strings.TrimSpace(string(b))
+		if port, err := strconv.ParseInt(s, 0, 32); err == nil {
+			ports[int(port)] = true
+		}
+	}
+
+	data, err := ioutil.ReadFile(dir + "/brforward")
+	if err != nil {
+		return nil, err
+	}
+	return parseFDB(data, ports), nil
+}
+
+// wiredTracker remembers which wired clients we have reported, so that we only
+// publish an entity event when a client appears or disappears.
+type wiredTracker struct {
+	present map[string]bool
+}
+
+func newWiredTracker() *wiredTracker {
+	return &wiredTracker{present: make(map[string]bool)}
+}
+
+// Compare the currently visible wired clients against those we saw last time,
+// returning connect events for the new arrivals and disconnect events for
+// those which have aged out of the bridge.
+func (w *wiredTracker) update(seen map[string]bool) []*base_msg.EventNetEntity {
+	events := make([]*base_msg.EventNetEntity, 0)
+	for mac := range seen {
+		if !w.present[mac] {
+			events = append(events, wiredNetEntity(mac, false))
+		}
+	}
+	for mac := range w.present {
+		if !seen[mac] {
+			events = append(events, wiredNetEntity(mac, true))
+		}
+	}
+	w.present = seen
+	return events
+}
+
 // If hostapd authorizes a client that isn't assigned to a VLAN, it gets
 // connected to the physical wifi device rather than a virtual interface.
 // Connect those physical devices to the UNENROLLED bridge once hostapd is
 // running.  We don't have a good way to determine when hostapd has gotten far
 // enough for this operation to succeed, so we just keep trying.
+//
+// The same bridge carries the node's wired ports, so while hostapd is running
+// we also watch it for wired clients coming and going.  Those are reported
+// with their own entity events, just as hostapd's station events are for
+// wireless clients.
 func rebuildUnenrolled(devs []*physDevice, interrupt chan bool) {
 	bridge := rings[base_def.RING_UNENROLLED].Bridge
+	wired := newWiredTracker()
 
 	t := time.NewTicker(time.Second)
 	defer t.Stop()
-	for len(devs) > 0 {
+	for {
 		select {
 		case <-interrupt:
 			return
@@ -76,6 +168,14 @@ func rebuildUnenrolled(devs []*physDevice, interrupt chan bool) {
 			}
 		}
 		devs = bad
+
+		if seen, err := bridgeWiredClients(bridge); err != nil {
+			slog.Debugf("checking %s for wired clients: %v", bridge, err)
+		} else {
+			for _, entity := range wired.update(seen) {
+				publishNetEntity(entity)
+			}
+		}
 	}
 }
 
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"bg/ap_common/broker"
+	"bg/base_msg"
+	"bg/common/network"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func setupEntityTest(t *testing.T) {
+	slog = zaptest.NewLogger(t).Sugar()
+	brokerd = &broker.Broker{Name: "ap.wifid"}
+	nodeID = "001-201901BB-000001"
+}
+
+func entityMac(entity *base_msg.EventNetEntity) string {
+	return network.Uint64ToHWAddr(entity.GetMacAddress()).String()
+}
+
+// Build a single __fdb_entry
+func fdbEntry(mac string, port int, local bool) []byte {
+	hwaddr, _ := net.ParseMAC(mac)
+	entry := make([]byte, fdbEntrySize)
+	copy(entry, hwaddr)
+	entry[6] = byte(port & 0xff)
+	if local {
+		entry[7] = 1
+	}
+	entry[12] = byte(port >> 8)
+	return entry
+}
+
+func TestParseFDB(t *testing.T) {
+	assert := require.New(t)
+
+	var data []byte
+	data = append(data, fdbEntry("02:00:00:00:00:01", 1, false)...)
+	data = append(data, fdbEntry("02:00:00:00:00:02", 2, false)...)
+	data = append(data, fdbEntry("02:00:00:00:00:03", 0x101, false)...)
+	data = append(data, fdbEntry("02:00:00:00:00:04", 1, true)...)
+	data = append(data, fdbEntry("02:00:00:00:00:05", 1, false)[:8]...)
+
+	// Only remote addresses on the wired ports are reported, and a
+	// truncated trailing entry is ignored.
+	macs := parseFDB(data, map[int]bool{1: true, 0x101: true})
+	assert.Equal(map[string]bool{
+		"02:00:00:00:00:01": true,
+		"02:00:00:00:00:03": true,
+	}, macs)
+
+	assert.Empty(parseFDB(data, map[int]bool{}))
+	assert.Empty(parseFDB(nil, map[int]bool{1: true}))
+}
+
+func TestWiredTracker(t *testing.T) {
+	assert := require.New(t)
+	setupEntityTest(t)
+
+	mac1 := "02:00:00:00:00:01"
+	mac2 := "02:00:00:00:00:02"
+	w := newWiredTracker()
+
+	events := w.update(map[string]bool{mac1: true})
+	assert.Len(events, 1)
+	e := events[0]
+	assert.Equal(mac1, entityMac(e))
+	assert.True(e.GetWired())
+	assert.False(e.GetDisconnect())
+	assert.Equal(nodeID, e.GetNode())
+	assert.Equal("ap.wifid", e.GetSender())
+
+	// Wired clients carry none of the wireless attributes
+	assert.Nil(e.Band)
+	assert.Nil(e.VirtualAP)
+	assert.Nil(e.WifiSignature)
+	assert.Nil(e.Username)
+
+	// Clients which are still present aren't reported again
+	events = w.update(map[string]bool{mac1: true, mac2: true})
+	assert.Len(events, 1)
+	assert.Equal(mac2, entityMac(events[0]))
+	assert.False(events[0].GetDisconnect())
+
+	events = w.update(map[string]bool{mac1: true, mac2: true})
+	assert.Empty(events)
+
+	// Clients which age out of the bridge are reported as disconnected
+	events = w.update(map[string]bool{mac2: true})
+	assert.Len(events, 1)
+	assert.Equal(mac1, entityMac(events[0]))
+	assert.True(events[0].GetWired())
+	assert.True(events[0].GetDisconnect())
+
+	events = w.update(map[string]bool{})
+	assert.Len(events, 1)
+	assert.Equal(mac2, entityMac(events[0]))
+	assert.True(events[0].GetDisconnect())
+}
+
+func TestWirelessNetEntity(t *testing.T) {
+	assert := require.New(t)
+	setupEntityTest(t)
+
+	mac := "02:00:00:00:00:01"
+	vap := "psk"
+	band := "5GHz"
+	user := "alice"
+
+	e := wirelessNetEntity(mac, &user, &vap, &band, nil, false)
+	assert.Equal(mac, entityMac(e))
+	assert.Equal(vap, e.GetVirtualAP())
+	assert.Equal(band, e.GetBand())
+	assert.Equal(user, e.GetUsername())
+	assert.Equal(nodeID, e.GetNode())
+	assert.False(e.GetDisconnect())
+	assert.Nil(e.Wired)
+	assert.Nil(e.WifiSignature)
+
+	// Unknown attributes are omitted, not filled with placeholders
+	e = wirelessNetEntity(mac, nil, &vap, nil, nil, true)
+	assert.Nil(e.Band)
+	assert.Nil(e.Username)
+	assert.True(e.GetDisconnect())
+}
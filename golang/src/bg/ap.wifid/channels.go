@@ -11,8 +11,6 @@ package main
 
 import (
 	"fmt"
-	"os/exec"
-	"regexp"
 	"sort"
 	"strings"
 	"sync"
@@ -242,7 +240,7 @@ func apMonitorLoop(wg *sync.WaitGroup, doneChan chan bool) {
 
 		if time.Now().After(nextChanEval) {
 			wifiEvaluate = true
-			hostapd.reset()
+			hostapd.reset("channel evaluation")
 		}
 
 		// If the frequency setting has been changed, reset our timer to
@@ -442,7 +440,7 @@ func setState(d *physDevice) {
 
 	c := w.configChannel
 	if c != 0 {
-		if !legalChannels[c] {
+		if !legalChannels[c] || !permittedChannel(c) {
 			w.state = wifi.DevIllegalChan
 		} else if b != "" && !bandChannels[b][c] {
 			w.state = wifi.DevBadChan
@@ -452,6 +450,16 @@ func setState(d *physDevice) {
 	}
 }
 
+// Is the channel permitted in the current regulatory domain?
+func permittedChannel(channel int) bool {
+	for _, band := range bands {
+		if bandChannels[band][channel] {
+			return true
+		}
+	}
+	return false
+}
+
 func selectWifiChannels(devices []*physDevice) []*physDevice {
 	nextChanEval = time.Now().Add(*chanEvalFreq)
 	good := make([]*physDevice, 0)
@@ -542,7 +550,41 @@ func selectWifiDevices(oldList []*physDevice) []*physDevice {
 	return newList
 }
 
-func makeValidChannelMaps() {
+// Returns the set of 20MHz channels permitted by a regulatory domain.  Domains
+// we have no rules for are limited to the channels of the world domain.
+func regChannels(domain string) map[int]bool {
+	rules, ok := wifi.RegDomains[domain]
+	if !ok {
+		rules = wifi.RegDomains[wifi.WorldRegDomain]
+	}
+
+	allowed := make(map[int]bool)
+	for _, rule := range rules {
+		step := wifi.RegChannelStep(rule.Band)
+		for c := rule.First; c <= rule.Last; c += step {
+			allowed[c] = true
+		}
+	}
+	return allowed
+}
+
+// Returns the 20MHz channels occupied by a channel of the given width, as
+// identified by the channel number we hand to hostapd.
+func occupiedChannels(channel, width int) []int {
+	switch {
+	case width == 40 && nModePrimaryAbove[channel]:
+		return []int{channel, channel + 4}
+	case width == 40 && nModePrimaryBelow[channel]:
+		return []int{channel - 4, channel}
+	case width == 80:
+		return wifi.ExpandChannels(channel, 0, width)
+	}
+	return []int{channel}
+}
+
+// Build the channel maps used for channel selection, limited to the channels
+// permitted in the given regulatory domain.
+func makeValidChannelMaps(domain string) {
 	widths := map[int][]int{
 		20: append(
 			wificaps.ChannelLists["loBand20MHz"],
@@ -551,63 +593,70 @@ func makeValidChannelMaps() {
 		80: wificaps.ChannelLists["hiBand80MHz"],
 	}
 
+	// The 2.4GHz band is crowded, so the use of 40MHz bonded channels is
+	// discouraged.  Thus, the following lists only include channels in the
+	// 5GHz band.
+	above := []int{36, 44, 52, 60, 100, 108, 116, 124, 132, 140, 149, 157}
+	below := []int{40, 48, 56, 64, 104, 112, 120, 128, 136, 144, 153, 161}
+
+	nModePrimaryAbove = make(map[int]bool)
+	for _, c := range above {
+		nModePrimaryAbove[c] = true
+	}
+
+	nModePrimaryBelow = make(map[int]bool)
+	for _, c := range below {
+		nModePrimaryBelow[c] = true
+	}
+
 	// Convert the arrays of channels into channel- and width-indexed maps,
-	// for easier lookup.
+	// for easier lookup.  A channel may exist without being permitted in
+	// this domain, so legalChannels isn't filtered.
+	allowed := regChannels(domain)
 	legalChannels = make(map[int]bool)
 	bandChannels = make(map[string]map[int]bool)
 	for _, band := range bands {
 		bandChannels[band] = make(map[int]bool)
 		for _, channel := range wifi.Channels[band] {
-			bandChannels[band][channel] = true
 			legalChannels[channel] = true
+			if allowed[channel] {
+				bandChannels[band][channel] = true
+			}
 		}
 	}
 
+	// A wide channel is only usable if the domain permits all of the
+	// 20MHz channels it spans.
 	channelWidths = make(map[int]map[int]bool)
 	for width, list := range widths {
 		channelWidths[width] = make(map[int]bool)
 		for _, channel := range list {
-			channelWidths[width][channel] = true
+			ok := true
+			for _, c := range occupiedChannels(channel, width) {
+				ok = ok && allowed[c]
+			}
+			if ok {
+				channelWidths[width][channel] = true
+			}
 		}
 	}
-
-	// The 2.4GHz band is crowded, so the use of 40MHz bonded channels is
-	// discouraged.  Thus, the following lists only include channels in the
-	// 5GHz band.
-	above := []int{36, 44, 52, 60, 100, 108, 116, 124, 132, 140, 149, 157}
-	below := []int{40, 48, 56, 64, 104, 112, 120, 128, 136, 144, 153, 161}
-
-	nModePrimaryAbove = make(map[int]bool)
-	for _, c := range above {
-		nModePrimaryAbove[c] = true
-	}
-
-	nModePrimaryBelow = make(map[int]bool)
-	for _, c := range below {
-		nModePrimaryBelow[c] = true
-	}
 }
 
 func globalWifiInit(props *cfgapi.PropertyNode) error {
-	locationRE := regexp.MustCompile(`^[A-Z][A-Z]$`)
-
-	makeValidChannelMaps()
+	var err error
 
-	wconf.domain = "US"
-	if x, ok := props.Children["regdomain"]; ok {
-		t := []byte(strings.ToUpper(x.Value))
-		if !locationRE.Match(t) {
-			slog.Warnf("Illegal @/network/regdomain: %s", x.Value)
-		} else {
-			wconf.domain = x.Value
-		}
+	if regSupport, err = wificaps.GetRegSupport(); err != nil {
+		slog.Warnf("Couldn't determine supported regulatory domains: %v",
+			err)
 	}
 
+	configured, _ := props.GetChildString("regdomain")
+	wconf.domain = initialRegDomain(configured)
+	makeValidChannelMaps(wconf.domain)
+
 	slog.Infof("Setting regulatory domain to %s", wconf.domain)
-	cmd := exec.Command(plat.IwCmd, "reg", "set", wconf.domain)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		slog.Warnf("Failed to set domain: %v%s\n", err, out)
+	if err = setKernelRegDomain(wconf.domain); err != nil {
+		slog.Warnf("Failed to set domain: %v", err)
 	}
 
 	wconf.radiusSecret, _ = props.GetChildString("radius_auth_secret")
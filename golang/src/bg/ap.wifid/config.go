@@ -24,6 +24,14 @@ func configNetworkRadiusSecretChanged(path []string, val string, expires *time.T
 	wifidStop("surprising change to network/radius_auth_secret")
 }
 
+func configRegDomainChanged(path []string, val string, expires *time.Time) {
+	applyRegDomain(val)
+}
+
+func configRegDomainDeleted(path []string) {
+	applyRegDomain("")
+}
+
 func configNicChanged(path []string, val string, expires *time.Time) {
 	var eval bool
 
@@ -67,7 +75,7 @@ func configNicChanged(path []string, val string, expires *time.Time) {
 
 	if eval {
 		wifiEvaluate = true
-		hostapd.reset()
+		hostapd.reset(path[3] + " " + path[4] + " changed")
 	}
 }
 
@@ -114,7 +122,7 @@ func configClientChanged(path []string, val string, expires *time.Time) {
 		}
 
 		if reload {
-			hostapd.reload()
+			hostapd.reload("client " + path[2] + " changed")
 			hostapd.disassociate(hwaddr)
 			if val == base_def.RING_QUARANTINE {
 				publiclog.SendLogDeviceQuarantine(brokerd, hwaddr)
@@ -172,7 +180,7 @@ func configRingChanged(path []string, val string, expires *time.Time) {
 			r.VirtualAPs = newList
 			slog.Infof("Changing VAP for ring %s from %v to %v",
 				ring, oldList, newList)
-			hostapd.reset()
+			hostapd.reset("ring " + ring + " VAPs changed")
 		}
 	}
 }
@@ -209,7 +217,7 @@ func configNetworkChanged(path []string, val string, expires *time.Time) {
 
 	if reload {
 		wifiEvaluate = true
-		hostapd.reload()
+		hostapd.reload(strings.Join(path[1:], "/") + " changed")
 	}
 }
 
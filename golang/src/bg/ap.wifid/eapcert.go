@@ -0,0 +1,235 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bg/ap_common/aputil"
+	"bg/base_def"
+	"bg/base_msg"
+	"bg/common/cfgapi"
+	"bg/common/network"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// When a client authenticates with a certificate, using EAP-TLS or another
+// TLS-based method, we record the certificate's expiration in
+// @/clients/<mac>/connection/eap_cert_expiry.  A client whose certificate
+// expires simply stops connecting, so we periodically look for certificates
+// which are about to expire and raise an exception for each, giving the admin
+// a chance to renew them first.  Clients using passwords never get the
+// property.
+const eapCertExpiryProp = "eap_cert_expiry"
+
+var (
+	// hostapd reports each certificate in the peer's chain, from the leaf
+	// (depth 0) up, with the DER-encoded certificate in hex:
+	//   CTRL-EVENT-EAP-PEER-CERT <mac> depth=0 subject='/CN=alice' cert=3082...
+	// The subject may contain anything, so it is removed before looking
+	// for the other fields.
+	peerCertSubjectRE = regexp.MustCompile(`subject='[^']*'`)
+	peerCertFieldRE   = regexp.MustCompile(`(?:^|\s)(depth|cert)=(\S+)`)
+)
+
+// Parse the detail of a CTRL-EVENT-EAP-PEER-CERT message, returning the depth
+// of the certificate in the peer's chain and its expiration time.
+func parsePeerCert(detail string) (int, time.Time, error) {
+	var depth int
+	var der []byte
+	var err error
+
+	detail = peerCertSubjectRE.ReplaceAllString(detail, "")
+	haveDepth := false
+	for _, m := range peerCertFieldRE.FindAllStringSubmatch(detail, -1) {
+		switch m[1] {
+		case "depth":
+			if depth, err = strconv.Atoi(m[2]); err != nil {
+				return 0, time.Time{}, fmt.Errorf("bad depth: %s", m[2])
+			}
+			haveDepth = true
+		case "cert":
+			if der, err = hex.DecodeString(m[2]); err != nil {
+				return 0, time.Time{}, fmt.Errorf("bad cert: %v", err)
+			}
+		}
+	}
+	if !haveDepth {
+		return 0, time.Time{}, fmt.Errorf("missing depth")
+	}
+	if der == nil {
+		return 0, time.Time{}, fmt.Errorf("missing cert")
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("bad cert: %v", err)
+	}
+	return depth, cert.NotAfter, nil
+}
+
+// Note the expiration of the certificate a client is authenticating with.  It
+// is recorded if the authentication succeeds.
+func (c *hostapdConn) eapPeerCert(sta, detail string) {
+	sta = strings.ToLower(sta)
+	depth, notAfter, err := parsePeerCert(detail)
+	if err != nil {
+		slog.Warnf("%v bad peer certificate from %s: %v", c, sta, err)
+	} else if depth == 0 {
+		c.peerCerts[sta] = notAfter
+	}
+}
+
+// Record the expiration of the certificate a client authenticated with.  If it
+// didn't use one, remove any expiration recorded when it last did.
+func (c *hostapdConn) recordCertExpiry(sta string) {
+	sta = strings.ToLower(sta)
+	prop := "@/clients/" + sta + "/connection/" + eapCertExpiryProp
+
+	notAfter, ok := c.peerCerts[sta]
+	delete(c.peerCerts, sta)
+	go func() {
+		var err error
+
+		if ok {
+			val := notAfter.UTC().Format(time.RFC3339)
+			err = config.CreateProp(prop, val, nil)
+		} else if err = config.DeleteProp(prop); err == cfgapi.ErrNoProp {
+			err = nil
+		}
+		if err != nil {
+			slog.Warnf("failed to update %s: %v", prop, err)
+		}
+	}()
+}
+
+// certExpiryWarning describes a client whose EAP certificate is about to expire
+type certExpiryWarning struct {
+	mac      string
+	username string
+	vap      string
+	expires  time.Time
+}
+
+// certExpiryCheck tracks the clients we have warned about, so that each
+// certificate is only warned about once.
+type certExpiryCheck struct {
+	warned map[string]time.Time // mac -> expiration we warned about
+}
+
+func newCertExpiryCheck() *certExpiryCheck {
+	return &certExpiryCheck{
+		warned: make(map[string]time.Time),
+	}
+}
+
+// Find the clients connected to this node whose certificates expire within
+// the lead time, and which we haven't yet warned about, in mac order.  A
+// client which connects to another node is warned about by that node.
+func (x *certExpiryCheck) check(hdl *cfgapi.Handle, now time.Time,
+	lead time.Duration) []certExpiryWarning {
+
+	warnings := make([]certExpiryWarning, 0)
+	expiring := make(map[string]bool)
+	for mac, client := range hdl.GetClients() {
+		exp := client.CertExpiry
+		if exp == nil || client.ConnNode != nodeID ||
+			exp.Sub(now) > lead {
+			continue
+		}
+
+		expiring[mac] = true
+		if w, ok := x.warned[mac]; ok && w.Equal(*exp) {
+			continue
+		}
+		x.warned[mac] = *exp
+		warnings = append(warnings, certExpiryWarning{
+			mac:      mac,
+			username: client.Username,
+			vap:      client.ConnVAP,
+			expires:  *exp,
+		})
+	}
+
+	// Forget clients which have renewed their certificates, or gone
+	for mac := range x.warned {
+		if !expiring[mac] {
+			delete(x.warned, mac)
+		}
+	}
+
+	sort.Slice(warnings, func(i, j int) bool {
+		return warnings[i].mac < warnings[j].mac
+	})
+	return warnings
+}
+
+func sendCertExpiryException(w certExpiryWarning, now time.Time) {
+	reason := base_msg.EventNetException_EAP_CERT_EXPIRING
+	verb := "expires"
+	if !w.expires.After(now) {
+		verb = "expired"
+	}
+	msg := fmt.Sprintf("EAP certificate of %s (user %s) %s %s", w.mac,
+		w.username, verb, w.expires.UTC().Format(time.RFC3339))
+
+	slog.Warnf("%s", msg)
+	hwaddr, _ := net.ParseMAC(w.mac)
+	entity := &base_msg.EventNetException{
+		Timestamp:  aputil.NowToProtobuf(),
+		Sender:     proto.String(brokerd.Name),
+		Debug:      proto.String("-"),
+		Reason:     &reason,
+		Message:    proto.String(msg),
+		MacAddress: proto.Uint64(network.HWAddrToUint64(hwaddr)),
+	}
+	if w.vap != "" {
+		entity.VirtualAP = proto.String(w.vap)
+	}
+	if w.username != "" {
+		entity.Username = proto.String(w.username)
+	}
+
+	err := brokerd.Publish(entity, base_def.TOPIC_EXCEPTION)
+	if err != nil {
+		slog.Warnf("couldn't publish %s: %v", base_def.TOPIC_EXCEPTION, err)
+	}
+}
+
+// Periodically look for expiring EAP certificates, until told to exit
+func certExpiryLoop(wg *sync.WaitGroup, doneChan chan bool) {
+	defer wg.Done()
+
+	t := time.NewTicker(*eapCertCheckFreq)
+	defer t.Stop()
+
+	x := newCertExpiryCheck()
+	for {
+		select {
+		case <-doneChan:
+			return
+		case <-t.C:
+			now := time.Now()
+			for _, w := range x.check(config, now, *eapCertLead) {
+				sendCertExpiryException(w, now)
+			}
+		}
+	}
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The chain presented by a client authenticating with EAP-TLS, as reported on
+// hostapd's control interface: the device CA, then the client's own
+// certificate, which expires 2020-09-01T12:00:00Z.
+const (
+	peerCertCA = "308201bc30820161a003020102020101300a06082a8648ce3d0403023045310b" +
+		"300906035504061302555331153013060355040a130c4578616d706c6520436f" +
+		"7270311f301d060355040313164578616d706c6520436f727020446576696365" +
+		"204341301e170d3139303130313030303030305a170d32393031303130303030" +
+		"30305a3045310b300906035504061302555331153013060355040a130c457861" +
+		"6d706c6520436f7270311f301d060355040313164578616d706c6520436f7270" +
+		"204465766963652043413059301306072a8648ce3d020106082a8648ce3d0301" +
+		"07034200042773c383b3bfce3f129e196569a6d8ec7f9bcd2a5f00b6e8943f8b" +
+		"6d2fc1409bc836fb2adbe96bf609dcb77bffde64a6fd8ab7dda85c2822cd40ae" +
+		"ac6880cf2ca3423040300e0603551d0f0101ff040403020204300f0603551d13" +
+		"0101ff040530030101ff301d0603551d0e04160414fa1454f97e963b109f33ff" +
+		"c3da8da8af778674f4300a06082a8648ce3d0403020349003046022100c212a7" +
+		"5851286fedb3d2fa9b2ae38c827e1f8a4d0b925a16ab41bfae6bcc9d88022100" +
+		"fdbed29f4f4afe08ce6fbdf4227f251a3edd2cedca3ad88228f15d8335a0e96e"
+
+	peerCertClient = "308201a030820147a00302010202021234300a06082a8648ce3d040302304531" +
+		"0b300906035504061302555331153013060355040a130c4578616d706c652043" +
+		"6f7270311f301d060355040313164578616d706c6520436f7270204465766963" +
+		"65204341301e170d3230303330313030303030305a170d323030393031313230" +
+		"3030305a3034310b300906035504061302555331153013060355040a130c4578" +
+		"616d706c6520436f7270310e300c06035504031305616c696365305930130607" +
+		"2a8648ce3d020106082a8648ce3d03010703420004219d6f0759ef44914f2288" +
+		"34580883de4858b71f1bd8c6b80a4480f5f39aa8ff9ddba5bfd512ecbaefcbbd" +
+		"56c77fda57754a4be1a3f6dc9dd96a3fc26d791dfca338303630130603551d25" +
+		"040c300a06082b06010505070302301f0603551d23041830168014fa1454f97e" +
+		"963b109f33ffc3da8da8af778674f4300a06082a8648ce3d0403020347003044" +
+		"02202447f301e5c82c1683645a170682b99388dc56be77f8b4732e219ef601c2" +
+		"4d7c022025bab8ef339f7580779da876fe92bb520ceee514ee4ba1124874b7e0" +
+		"e559402e"
+
+	peerCertMsgs = "CTRL-EVENT-EAP-PEER-CERT b8:27:eb:9f:d8:e0 depth=1 " +
+		"subject='/C=US/O=Example Corp/CN=Example Corp Device CA' " +
+		"hash=c327e4976cedce585620ea4fab7acc3e672ec87f463ce0cb2cf47e86b39b51ab " +
+		"cert=" + peerCertCA + "\n" +
+		"CTRL-EVENT-EAP-PEER-CERT b8:27:eb:9f:d8:e0 depth=0 " +
+		"subject='/C=US/O=Example Corp/CN=alice' " +
+		"hash=eaee2f673852b0698ae40f77f97540f064115780f653bd7d7c391341f911d4cf " +
+		"cert=" + peerCertClient
+)
+
+var peerCertExpiry = time.Date(2020, 9, 1, 12, 0, 0, 0, time.UTC)
+
+func setupCertTest(t *testing.T) *hostapdConn {
+	setupEntityTest(t)
+	config = cfgapi.NewHandle(mockcfg.NewMockExecEmptyTree())
+	return &hostapdConn{
+		vapName:   "eap",
+		wifiBand:  "5GHz",
+		stations:  make(map[string]*stationInfo),
+		peerCerts: make(map[string]time.Time),
+	}
+}
+
+// Wait for the asynchronous update of a client's certificate expiration
+func waitCertExpiry(t *testing.T, mac, exp string) {
+	prop := "@/clients/" + mac + "/connection/" + eapCertExpiryProp
+	require.Eventually(t, func() bool {
+		val, err := config.GetProp(prop)
+		if exp == "" {
+			return err == cfgapi.ErrNoProp
+		}
+		return err == nil && val == exp
+	}, time.Second, 10*time.Millisecond, "%s != %q", prop, exp)
+}
+
+func TestParsePeerCert(t *testing.T) {
+	assert := require.New(t)
+
+	msgs := strings.Split(peerCertMsgs, "\n")
+	detail := strings.SplitN(msgs[0], " ", 3)[2]
+	depth, notAfter, err := parsePeerCert(detail)
+	assert.NoError(err)
+	assert.Equal(1, depth)
+	assert.Equal(time.Date(2029, 1, 1, 0, 0, 0, 0, time.UTC), notAfter)
+
+	detail = strings.SplitN(msgs[1], " ", 3)[2]
+	depth, notAfter, err = parsePeerCert(detail)
+	assert.NoError(err)
+	assert.Equal(0, depth)
+	assert.Equal(peerCertExpiry, notAfter)
+
+	// The subject can't be mistaken for the other fields
+	depth, notAfter, err = parsePeerCert("depth=0 subject='/CN=depth=3 " +
+		"cert=00' cert=" + peerCertClient)
+	assert.NoError(err)
+	assert.Equal(0, depth)
+	assert.Equal(peerCertExpiry, notAfter)
+
+	bad := []string{
+		"",
+		"depth=0 subject='/CN=alice' hash=abcd",
+		"subject='/CN=alice' cert=" + peerCertClient,
+		"depth=x cert=" + peerCertClient,
+		"depth=0 cert=30820xyz",
+		"depth=0 cert=" + peerCertClient[:200],
+	}
+	for _, b := range bad {
+		_, _, err = parsePeerCert(b)
+		assert.Error(err, b)
+	}
+}
+
+func TestEAPCertExpiry(t *testing.T) {
+	assert := require.New(t)
+	c := setupCertTest(t)
+	mac := "b8:27:eb:9f:d8:e0"
+
+	// A successful EAP-TLS authentication records the expiration of the
+	// client's certificate, not that of its CA.
+	for _, msg := range strings.Split(peerCertMsgs, "\n") {
+		c.handleStatus(msg)
+	}
+	assert.Equal(map[string]time.Time{mac: peerCertExpiry}, c.peerCerts)
+	c.handleStatus("CTRL-EVENT-EAP-SUCCESS2 " + mac + " alice")
+	assert.Empty(c.peerCerts)
+	waitCertExpiry(t, mac, "2020-09-01T12:00:00Z")
+
+	client := config.GetClient(mac)
+	assert.NotNil(client)
+	assert.Equal(peerCertExpiry, client.CertExpiry.UTC())
+
+	// A failed authentication records nothing
+	other := "b8:27:eb:9f:d8:e1"
+	c.handleStatus(strings.Replace(peerCertMsgs, mac, other, -1))
+	c.handleStatus("CTRL-EVENT-EAP-FAILURE2 " + other + " bob")
+	assert.Empty(c.peerCerts)
+
+	// A client which switches to a password forgets its certificate
+	c.handleStatus("CTRL-EVENT-EAP-SUCCESS2 " + mac + " alice")
+	waitCertExpiry(t, mac, "")
+
+	// ... as does one which never had one
+	c.handleStatus("CTRL-EVENT-EAP-SUCCESS2 " + other + " bob")
+	waitCertExpiry(t, other, "")
+}
+
+func TestCertExpiryCheck(t *testing.T) {
+	assert := require.New(t)
+	setupCertTest(t)
+
+	clientProps := map[string]string{
+		"b8:27:eb:00:00:01": "2020-06-20T00:00:00Z", // in 10 days
+		"b8:27:eb:00:00:02": "2020-07-20T00:00:00Z", // in 40 days
+		"b8:27:eb:00:00:03": "2020-06-01T00:00:00Z", // expired
+		"b8:27:eb:00:00:04": "",                     // no certificate
+		"b8:27:eb:00:00:05": "2020-06-11T00:00:00Z", // on another node
+	}
+	for mac, exp := range clientProps {
+		conn := "@/clients/" + mac + "/connection/"
+		node := nodeID
+		if strings.HasSuffix(mac, "05") {
+			node = "001-201901BB-000002"
+		}
+		assert.NoError(config.CreateProp(conn+"node", node, nil))
+		assert.NoError(config.CreateProp(conn+"username",
+			"user"+mac[len(mac)-1:], nil))
+		assert.NoError(config.CreateProp(conn+"vap", "eap", nil))
+		if exp != "" {
+			assert.NoError(config.CreateProp(conn+eapCertExpiryProp,
+				exp, nil))
+		}
+	}
+
+	now := time.Date(2020, 6, 10, 0, 0, 0, 0, time.UTC)
+	lead := 14 * 24 * time.Hour
+	x := newCertExpiryCheck()
+	assert.Equal([]certExpiryWarning{
+		{
+			mac:      "b8:27:eb:00:00:01",
+			username: "user1",
+			vap:      "eap",
+			expires:  time.Date(2020, 6, 20, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			mac:      "b8:27:eb:00:00:03",
+			username: "user3",
+			vap:      "eap",
+			expires:  time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}, utcWarnings(x.check(config, now, lead)))
+
+	// Each certificate is only warned about once
+	now = now.Add(24 * time.Hour)
+	assert.Empty(x.check(config, now, lead))
+
+	// ... until its expiration comes within the lead time
+	now = time.Date(2020, 7, 7, 0, 0, 0, 0, time.UTC)
+	warnings := utcWarnings(x.check(config, now, lead))
+	assert.Len(warnings, 1)
+	assert.Equal("b8:27:eb:00:00:02", warnings[0].mac)
+
+	// A renewed certificate which then nears expiration is warned about
+	// again
+	assert.NoError(config.CreateProp("@/clients/b8:27:eb:00:00:01/"+
+		"connection/"+eapCertExpiryProp, "2020-07-10T00:00:00Z", nil))
+	warnings = utcWarnings(x.check(config, now, lead))
+	assert.Len(warnings, 1)
+	assert.Equal("b8:27:eb:00:00:01", warnings[0].mac)
+	assert.Equal(time.Date(2020, 7, 10, 0, 0, 0, 0, time.UTC),
+		warnings[0].expires)
+	assert.Empty(x.check(config, now, lead))
+}
+
+// Normalize the time zones of the expirations, for comparison
+func utcWarnings(warnings []certExpiryWarning) []certExpiryWarning {
+	for i := range warnings {
+		warnings[i].expires = warnings[i].expires.UTC()
+	}
+	return warnings
+}
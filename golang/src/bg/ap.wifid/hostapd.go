@@ -94,19 +94,6 @@ type hostapdCmd struct {
 	sent   time.Time
 }
 
-type retransmitState struct {
-	count     int       // how many RETRANSMIT events have we seen?
-	broken    bool      // has this client exceeded its hard limit?
-	restarted bool      // has hostapd been reset during RETRANSMIT loop?
-	first     time.Time // time of the first RETRANSMIT event
-	last      time.Time // time of the most recent RETRANSMIT event
-}
-
-var (
-	clientRetransmits    = make(map[string]*retransmitState)
-	clientRetransmitsMtx sync.Mutex
-)
-
 // hostapd has a separate control socket for each of the network interfaces it
 // manages.  For each socket, we can have a single in-flight command and any
 // number of queued commands.
@@ -124,8 +111,9 @@ type hostapdConn struct {
 	liveCmd     *hostapdCmd   // the in-flight hostapd command
 	pendingCmds []*hostapdCmd // all queued commands
 
-	inStatus bool // currently collecting per-station status
-	stations map[string]*stationInfo
+	inStatus  bool // currently collecting per-station status
+	stations  map[string]*stationInfo
+	peerCerts map[string]time.Time // cert expirations awaiting EAP success
 
 	sync.Mutex
 }
@@ -240,38 +228,52 @@ func (c *hostapdConn) handleResult(result string) {
 	}
 }
 
-func sendNetEntity(mac string, username, vapName, bandName, sig *string, disconnect bool) {
-	band := "?"
-	if bandName != nil {
-		band = *bandName
+// Construct an entity event for a client seen on this node.  Fields we know
+// nothing about are left unset, so that consumers don't mistake a placeholder
+// for a real band or VAP.
+func newNetEntity(mac string, disconnect bool) *base_msg.EventNetEntity {
+	hwaddr, _ := net.ParseMAC(mac)
+	return &base_msg.EventNetEntity{
+		Timestamp:  aputil.NowToProtobuf(),
+		Sender:     proto.String(brokerd.Name),
+		Debug:      proto.String("-"),
+		Node:       proto.String(nodeID),
+		Disconnect: proto.Bool(disconnect),
+		MacAddress: proto.Uint64(network.HWAddrToUint64(hwaddr)),
 	}
+}
+
+// Construct an entity event for a client associated with one of our VAPs
+func wirelessNetEntity(mac string, username, vapName, bandName, sig *string,
+	disconnect bool) *base_msg.EventNetEntity {
+
+	entity := newNetEntity(mac, disconnect)
+	entity.Username = username
+	entity.VirtualAP = vapName
+	entity.Band = bandName
+	entity.WifiSignature = sig
+	return entity
+}
+
+// Construct an entity event for a client seen on one of our wired ports
+func wiredNetEntity(mac string, disconnect bool) *base_msg.EventNetEntity {
+	entity := newNetEntity(mac, disconnect)
+	entity.Wired = proto.Bool(true)
+	return entity
+}
+
+func publishNetEntity(entity *base_msg.EventNetEntity) {
 	action := "connect"
-	if disconnect {
+	if entity.GetDisconnect() {
 		action = "disconnect"
 	}
-	user := "?"
-	if username != nil {
-		user = *username
-	}
-	vap := "?"
-	if vapName != nil {
-		vap = *vapName
-	}
-
-	slog.Debugf("NetEntity(%s, user: %s vap: %s, band: %s, %s)", mac, user,
-		vap, band, action)
-	hwaddr, _ := net.ParseMAC(mac)
-	entity := &base_msg.EventNetEntity{
-		Timestamp:     aputil.NowToProtobuf(),
-		Sender:        proto.String(brokerd.Name),
-		Debug:         proto.String("-"),
-		Username:      username,
-		VirtualAP:     vapName,
-		WifiSignature: sig,
-		Node:          &nodeID,
-		Disconnect:    &disconnect,
-		MacAddress:    proto.Uint64(network.HWAddrToUint64(hwaddr)),
-		Band:          bandName,
+	mac := network.Uint64ToHWAddr(entity.GetMacAddress())
+	if entity.GetWired() {
+		slog.Debugf("NetEntity(%s, wired, %s)", mac, action)
+	} else {
+		slog.Debugf("NetEntity(%s, user: %s vap: %s, band: %s, %s)",
+			mac, entity.GetUsername(), entity.GetVirtualAP(),
+			entity.GetBand(), action)
 	}
 
 	err := brokerd.Publish(entity, base_def.TOPIC_ENTITY)
@@ -280,6 +282,11 @@ func sendNetEntity(mac string, username, vapName, bandName, sig *string, disconn
 	}
 }
 
+func sendNetEntity(mac string, username, vapName, bandName, sig *string, disconnect bool) {
+	publishNetEntity(wirelessNetEntity(mac, username, vapName, bandName,
+		sig, disconnect))
+}
+
 func sendNetException(mac, username string, vapName *string,
 	reason *base_msg.EventNetException_Reason) {
 
@@ -309,6 +316,29 @@ func sendNetException(mac, username string, vapName *string,
 	}
 }
 
+// Report a VAP whose authentication failure rate has crossed the alarm
+// threshold, so the cloud can alert on systemic problems.
+func sendAuthFailureAlarm(alarm *authAlarm) {
+	reason := base_msg.EventNetException_AUTH_FAILURE_RATE
+	msg := fmt.Sprintf("%d of %d authentication attempts failed in %v",
+		alarm.failures, alarm.attempts, alarm.window)
+
+	slog.Warnf("%s: %s", alarm.vap, msg)
+	entity := &base_msg.EventNetException{
+		Timestamp: aputil.NowToProtobuf(),
+		Sender:    proto.String(brokerd.Name),
+		Debug:     proto.String("-"),
+		VirtualAP: proto.String(alarm.vap),
+		Reason:    &reason,
+		Message:   proto.String(msg),
+	}
+
+	err := brokerd.Publish(entity, base_def.TOPIC_EXCEPTION)
+	if err != nil {
+		slog.Warnf("couldn't publish %s: %v", base_def.TOPIC_EXCEPTION, err)
+	}
+}
+
 var signalRE = regexp.MustCompile(`signal=(\S+)\s`)
 
 // Fetch a single station's status from hostapd.  Return the signal strength.
@@ -366,11 +396,28 @@ func (c *hostapdConn) getSignature(sta string) {
 	} else if info, ok := c.stations[sta]; ok {
 		if info.signature != sig {
 			info.signature = sig
-			sendNetEntity(sta, nil, &c.vapName, nil, &sig, false)
+			sendNetEntity(sta, nil, &c.vapName, &c.wifiBand, &sig, false)
 		}
 	}
 }
 
+// Tally an association or authentication event for this VAP, and for the ring
+// the client belongs to.
+func (c *hostapdConn) countAuthEvent(sta string, counter authCounter) {
+	var ring string
+
+	clientsMtx.Lock()
+	if client, ok := clients[strings.ToLower(sta)]; ok {
+		ring = client.Ring
+	}
+	clientsMtx.Unlock()
+
+	alarm := wifiAuthStats.record(c.vapName, ring, counter, time.Now())
+	if alarm != nil {
+		sendAuthFailureAlarm(alarm)
+	}
+}
+
 func (c *hostapdConn) stationPresent(sta string, newConnection bool) {
 	sta = strings.ToLower(sta)
 	slog.Infof("%v stationPresent(%s) new: %v", c, sta, newConnection)
@@ -397,6 +444,7 @@ func (c *hostapdConn) stationPresent(sta string, newConnection bool) {
 func (c *hostapdConn) stationGone(sta string) {
 	slog.Infof("%v stationGone(%s)", c, sta)
 	delete(c.stations, sta)
+	delete(c.peerCerts, strings.ToLower(sta))
 	sendNetEntity(sta, nil, &c.vapName, &c.wifiBand, nil, true)
 }
 
@@ -404,21 +452,14 @@ func (c *hostapdConn) stationRetransmit(sta string) {
 	reason := base_msg.EventNetException_CLIENT_RETRANSMIT
 
 	slog.Infof("%v stationRetransmit(%s)", c, sta)
+	c.countAuthEvent(sta, authRetransmitLoop)
 	sendNetException(sta, "", &c.vapName, &reason)
 }
 
 func (c *hostapdConn) eapSuccess(sta, username string) {
 	var user *string
 
-	clientRetransmitsMtx.Lock()
-	if state, ok := clientRetransmits[sta]; ok {
-		delete(clientRetransmits, sta)
-		if state.count != 0 {
-			slog.Infof("%s connected after %d retransmits", sta,
-				state.count)
-		}
-	}
-	clientRetransmitsMtx.Unlock()
+	clientRetransmits.clear(sta)
 
 	if len(username) > 0 {
 		user = &username
@@ -426,6 +467,7 @@ func (c *hostapdConn) eapSuccess(sta, username string) {
 
 	slog.Infof("%v eapSuccess(%s) user=%s", c, sta, username)
 
+	c.recordCertExpiry(sta)
 	sendNetEntity(sta, user, &c.vapName, &c.wifiBand, nil, false)
 	publiclog.SendLogLoginEAPSuccess(brokerd, sta, username)
 }
@@ -451,44 +493,6 @@ func (c *hostapdConn) disassociate(sta string) {
 	c.command("DISASSOCIATE " + sta)
 }
 
-// Fetch the retransmit state for a specific client.  If that client has no
-// state yet, allocate a state struct and insert it into the map
-func getClientRetransmit(mac string) *retransmitState {
-	now := time.Now()
-	expired := now.Add(-1 * *retransmitTimeout)
-
-	clientRetransmitsMtx.Lock()
-	defer clientRetransmitsMtx.Unlock()
-
-	// While we're scanning the map, clean up any counts that have aged out
-	for x, state := range clientRetransmits {
-		if !state.broken && state.last.Before(expired) {
-			slog.Debugf("%s is clear.  %d since %s",
-				x, state.count, state.first.Format(time.RFC3339))
-			delete(clientRetransmits, x)
-		}
-	}
-
-	state := clientRetransmits[mac]
-	if state == nil {
-		state = &retransmitState{first: now}
-		clientRetransmits[mac] = state
-	}
-	state.last = now
-
-	return state
-}
-
-// Set the 'restarted' bit for all clients in the retransmit map
-func markClientRetransmit() {
-	clientRetransmitsMtx.Lock()
-	defer clientRetransmitsMtx.Unlock()
-
-	for _, state := range clientRetransmits {
-		state.restarted = true
-	}
-}
-
 // There is currently a bug on the OpenWRT boards where a client will fail to
 // authenticate with EAP despite having valid credentials.  We can see this
 // happening in the log as hostapd repeatedly issues RETRANSMIT messages.  The
@@ -499,13 +503,13 @@ func markClientRetransmit() {
 // a way that simply timing out and retrying the connection doesn't.  If that
 // isn't sufficient, restarting hostapd always seems to be.
 func (c *hostapdConn) eapRetransmit(mac string) {
-	state := getClientRetransmit(mac)
+	state := clientRetransmits.get(mac)
 	state.count++
 
 	if state.broken {
 		return
 	} else if state.count >= *retransmitHardLimit {
-		state.broken = true
+		clientRetransmits.markBroken(state)
 		if state.count == *retransmitHardLimit {
 			c.stationRetransmit(mac)
 		}
@@ -520,8 +524,8 @@ func (c *hostapdConn) eapRetransmit(mac string) {
 			// restarting hostapd again on their behalf.  In
 			// particular, we don't want to restart hostapd every 2
 			// minutes trying to fix one permanently broken client.
-			markClientRetransmit()
-			c.hostapd.reset()
+			clientRetransmits.markRestarted()
+			c.hostapd.reset("excessive retransmits")
 
 		}
 
@@ -543,10 +547,12 @@ func (c *hostapdConn) handleStatus(status string) {
 		//    CTRL-EVENT-EAP-SUCCESS2 b8:27:eb:9f:d8:e0 [username] (success)
 		//    CTRL-EVENT-EAP-FAILURE2 b8:27:eb:9f:d8:e0 [username] (bad password)
 		//    CTRL-EVENT-EAP-RETRANSMIT b8:27:eb:9f:d8:e0 (possibly T268)
+		//    CTRL-EVENT-EAP-PEER-CERT b8:27:eb:9f:d8:e0 [cert] (EAP-TLS)
 		msgs = "(AP-STA-CONNECTED|AP-STA-DISCONNECTED|" +
 			"AP-STA-POLL-OK|AP-STA-POSSIBLE-PSK-MISMATCH|" +
 			"CTRL-EVENT-EAP-SUCCESS2|CTRL-EVENT-EAP-FAILURE2|" +
-			"CTRL-EVENT-EAP-RETRANSMIT|CTRL-EVENT-EAP-RETRANSMIT2)"
+			"CTRL-EVENT-EAP-RETRANSMIT|CTRL-EVENT-EAP-RETRANSMIT2|" +
+			"CTRL-EVENT-EAP-PEER-CERT)"
 		macOctet = "[[:xdigit:]][[:xdigit:]]"
 		macAddr  = "(" + macOctet + ":" + macOctet + ":" +
 			macOctet + ":" + macOctet + ":" + macOctet + ":" +
@@ -567,17 +573,26 @@ func (c *hostapdConn) handleStatus(status string) {
 
 		switch msg {
 		case "AP-STA-CONNECTED":
+			c.countAuthEvent(mac, authAssoc)
 			c.stationPresent(mac, true)
 		case "AP-STA-POLL-OK":
 			c.stationPresent(mac, false)
 		case "AP-STA-DISCONNECTED":
 			c.stationGone(mac)
 		case "CTRL-EVENT-EAP-SUCCESS2":
+			c.countAuthEvent(mac, authEAPSuccess)
 			c.eapSuccess(mac, username)
-		case "AP-STA-POSSIBLE-PSK-MISMATCH", "CTRL-EVENT-EAP-FAILURE2":
+		case "AP-STA-POSSIBLE-PSK-MISMATCH":
+			c.countAuthEvent(mac, authPSKMismatch)
+			c.stationBadPassword(mac, username)
+		case "CTRL-EVENT-EAP-FAILURE2":
+			delete(c.peerCerts, strings.ToLower(mac))
+			c.countAuthEvent(mac, authEAPFailure)
 			c.stationBadPassword(mac, username)
 		case "CTRL-EVENT-EAP-RETRANSMIT", "CTRL-EVENT-EAP-RETRANSMIT2":
 			c.eapRetransmit(mac)
+		case "CTRL-EVENT-EAP-PEER-CERT":
+			c.eapPeerCert(mac, username)
 		}
 	}
 }
@@ -648,7 +663,7 @@ func (c *hostapdConn) run(wg *sync.WaitGroup) {
 			if delta > float64(*hostapdLatency) {
 				slog.Warnf("hostapd blocked for %1.2f seconds",
 					delta)
-				c.hostapd.reset()
+				c.hostapd.reset("hostapd blocked")
 				break
 			}
 		}
@@ -870,44 +885,53 @@ func getDevConfig(d *physDevice) *devConfig {
 //
 // Get network settings from configd and use them to initialize the AP
 //
-func getVAPConfig(name string, d *physDevice, idx int) *vapConfig {
-	var bssid, eapComment, pskComment, passphrase, radiusServer string
-	var logical *physDevice
-
-	vap := virtualAPs[name]
+// Determine whether a VAP is configured well enough to be hosted.
+func vapUsable(name string, vap *cfgapi.VirtualAP) bool {
 	if vap.Disabled {
 		slog.Infof("VAP %s: disabled", name)
-		return nil
+		return false
 	}
 
 	if len(vap.Rings) == 0 {
 		slog.Infof("VAP %s: no assigned rings", name)
-		return nil
-	}
-
-	ssid := vap.SSID
-	if vap.Tag5GHz && d.wifi.activeBand == wifi.HiBand {
-		ssid += "-5ghz"
+		return false
 	}
 
 	switch vap.KeyMgmt {
 	case "wpa-psk":
-		eapComment = "#"
-		passphrase = vap.Passphrase
-		if passphrase == "" {
+		if vap.Passphrase == "" {
 			slog.Errorf("VAP %s: missing WPA-PSK passphrase", name)
-			return nil
+			return false
 		}
 	case "wpa-eap":
-		pskComment = "#"
 		if wconf.radiusSecret == "" {
 			slog.Errorf("radius secret undefined")
-			return nil
+			return false
 		}
 	default:
 		slog.Errorf("VAP %s: unsupported key management: %s", name,
 			vap.KeyMgmt)
-		return nil
+		return false
+	}
+
+	return true
+}
+
+func getVAPConfig(name string, d *physDevice, idx int) *vapConfig {
+	var bssid, eapComment, pskComment, passphrase, radiusServer string
+	var logical *physDevice
+
+	vap := virtualAPs[name]
+	ssid := vap.SSID
+	if vap.Tag5GHz && d.wifi.activeBand == wifi.HiBand {
+		ssid += "-5ghz"
+	}
+
+	if vap.KeyMgmt == "wpa-psk" {
+		eapComment = "#"
+		passphrase = vap.Passphrase
+	} else {
+		pskComment = "#"
 	}
 
 	if satellite {
@@ -1045,10 +1069,6 @@ func (h *hostapdHdl) generateHostAPDConf() {
 	devices := make([]*physDevice, 0)
 	allVaps := make([]*vapConfig, 0)
 
-	// build an alphabetical list of vap names, so the order of VAPs in the
-	// config file is deterministic
-	vaps := aputil.SortStringKeys(virtualAPs)
-
 	devTemplate, err := template.ParseFiles(devfile)
 	if err != nil {
 		slog.Errorf("Unable to parse %s: %v", devfile, err)
@@ -1061,6 +1081,20 @@ func (h *hostapdHdl) generateHostAPDConf() {
 	}
 
 	unenrolledVap := rings[base_def.RING_UNENROLLED].VirtualAPs[0]
+
+	// When a radio can't host every VAP, the priorities determine which
+	// ones it gets.
+	candidates := make([]vapCandidate, 0)
+	for _, name := range aputil.SortStringKeys(virtualAPs) {
+		vap := virtualAPs[name]
+		if vapUsable(name, vap) {
+			candidates = append(candidates, vapCandidate{
+				name:     name,
+				priority: vapPriority(name, vap, unenrolledVap),
+			})
+		}
+	}
+
 	for _, d := range h.devices {
 		confName := confdir + "/" + "hostapd.conf." + d.name
 		cf, _ := os.Create(confName)
@@ -1072,28 +1106,24 @@ func (h *hostapdHdl) generateHostAPDConf() {
 			continue
 		}
 
-		max := d.wifi.cap.Interfaces
+		hosted, omitted := assignVAPSlots(candidates,
+			d.wifi.cap.Interfaces)
+		noteVAPSlots(d, hosted, omitted)
+
 		idx := 0
-		for _, name := range vaps {
-			if idx == max {
-				slog.Warnf("%s can only support %d of %d SSIDs",
-					d.hwaddr, max, len(virtualAPs))
-				break
+		for _, name := range hosted {
+			vap := getVAPConfig(name, d, idx)
+			if err = generateVlanConf(vap); err == nil {
+				err = vapTemplate.Execute(cf, vap)
 			}
-			if vap := getVAPConfig(name, d, idx); vap != nil {
-				if err = generateVlanConf(vap); err == nil {
-					err = vapTemplate.Execute(cf, vap)
-				}
-				if err == nil {
-					allVaps = append(allVaps, vap)
-					idx++
-				} else {
-					slog.Warnf("%v", err)
-				}
-				if name == unenrolledVap {
-					unenrolled = append(unenrolled,
-						vap.logical)
-				}
+			if err == nil {
+				allVaps = append(allVaps, vap)
+				idx++
+			} else {
+				slog.Warnf("%v", err)
+			}
+			if name == unenrolledVap {
+				unenrolled = append(unenrolled, vap.logical)
 			}
 		}
 
@@ -1144,6 +1174,7 @@ func (h *hostapdHdl) newConn(vap *vapConfig) *hostapdConn {
 		device:      vap.physical,
 		pendingCmds: make([]*hostapdCmd, 0),
 		stations:    make(map[string]*stationInfo),
+		peerCerts:   make(map[string]time.Time),
 	}
 	slog.Debugf("%v: %s -> %s", &newConn, remoteName, localName)
 	os.Remove(newConn.name)
@@ -1187,6 +1218,7 @@ func (h *hostapdHdl) start() {
 		h.done <- fmt.Errorf("failed to launch: %v", err)
 		return
 	}
+	restartApplied()
 
 	var wg sync.WaitGroup
 	for _, c := range h.conns {
@@ -1234,22 +1266,28 @@ func (h *hostapdHdl) start() {
 	h.done <- nil
 }
 
-func (h *hostapdHdl) reload() {
-	if h != nil {
-		slog.Infof("Reloading hostapd")
-		virtualAPs = config.GetVirtualAPs()
-		h.generateConfigFiles()
-		h.process.Signal(plat.ReloadSignal)
+func (h *hostapdHdl) reload(reason string) {
+	if h == nil {
+		deferRestart(reason)
+		return
 	}
+
+	slog.Infof("Reloading hostapd: %s", reason)
+	virtualAPs = config.GetVirtualAPs()
+	h.generateConfigFiles()
+	h.process.Signal(plat.ReloadSignal)
 }
 
-func (h *hostapdHdl) reset() {
-	if h != nil {
-		slog.Infof("Resetting hostapd")
-		virtualAPs = config.GetVirtualAPs()
-		h.generateConfigFiles()
-		h.process.Signal(plat.ResetSignal)
+func (h *hostapdHdl) reset(reason string) {
+	if h == nil {
+		deferRestart(reason)
+		return
 	}
+
+	slog.Infof("Resetting hostapd: %s", reason)
+	virtualAPs = config.GetVirtualAPs()
+	h.generateConfigFiles()
+	h.process.Signal(plat.ResetSignal)
 }
 
 func (h *hostapdHdl) halt() {
@@ -248,7 +248,7 @@ func radiusUserChange(name, password string) {
 	radiusConfig.Unlock()
 
 	if reset {
-		hostapd.reload()
+		hostapd.reload("radius user changed")
 		hostapd.deauthUser(name)
 	}
 }
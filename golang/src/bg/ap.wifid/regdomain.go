@@ -0,0 +1,167 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"bg/ap_common/aputil"
+	"bg/ap_common/wificaps"
+	"bg/base_def"
+	"bg/base_msg"
+	"bg/common/wifi"
+
+	"github.com/golang/protobuf/proto"
+)
+
+var regDomainRE = regexp.MustCompile(`^[A-Z][A-Z]$`)
+
+// The regulatory domains the wireless hardware will accept, or nil if we
+// couldn't determine them.
+var regSupport *wificaps.RegSupport
+
+// Tell the kernel which regulatory domain to apply.  A variable, so the tests
+// can avoid running iw.
+var setKernelRegDomain = func(domain string) error {
+	cmd := exec.Command(plat.IwCmd, "reg", "set", domain)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("iw reg set %s failed: %v %s", domain, err,
+			strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// validateRegDomain returns an error if the radios can't be operated under the
+// given regulatory domain.  Well-formed domains we have no channel rules for
+// are accepted, and limited to the channels of the world domain.
+func validateRegDomain(domain string) error {
+	if !regDomainRE.MatchString(domain) {
+		return fmt.Errorf("illegal regulatory domain '%s'", domain)
+	}
+	if regSupport != nil {
+		if err := regSupport.Supports(domain); err != nil {
+			return fmt.Errorf("regulatory domain %s not supported: %v",
+				domain, err)
+		}
+	}
+	return nil
+}
+
+// Choose the regulatory domain to use at startup.  If the configured domain is
+// unusable, we fall back to the default, or to the domain the firmware insists
+// on if the default is unusable too.
+func initialRegDomain(configured string) string {
+	domain := wifi.DefaultRegDomain
+	if configured != "" {
+		c := strings.ToUpper(configured)
+		if err := validateRegDomain(c); err != nil {
+			slog.Warnf("Ignoring @/network/regdomain: %v", err)
+			sendRegDomainException(c, err)
+		} else {
+			domain = c
+		}
+	}
+
+	if err := validateRegDomain(domain); err != nil && regSupport != nil {
+		if fixed := regSupport.Fixed(); fixed != "" {
+			slog.Warnf("%v - using %s", err, fixed)
+			domain = fixed
+		}
+	}
+	return domain
+}
+
+// Report a regulatory domain we were asked to use, but can't.
+func sendRegDomainException(domain string, err error) {
+	reason := base_msg.EventNetException_REGDOMAIN_UNSUPPORTED
+	msg := fmt.Sprintf("can't apply regulatory domain %s: %v", domain, err)
+
+	entity := &base_msg.EventNetException{
+		Timestamp: aputil.NowToProtobuf(),
+		Sender:    proto.String(brokerd.Name),
+		Debug:     proto.String("-"),
+		Reason:    &reason,
+		Message:   proto.String(msg),
+	}
+
+	err = brokerd.Publish(entity, base_def.TOPIC_EXCEPTION)
+	if err != nil {
+		slog.Warnf("couldn't publish %s: %v", base_def.TOPIC_EXCEPTION, err)
+	}
+}
+
+// Re-check the channels in use against the current domain, and choose new ones
+// for any radios whose channels are no longer permitted.  This must happen
+// before hostapd is restarted, so we never render a config with an illegal
+// channel.
+func revalidateChannels() {
+	for _, d := range wirelessNics {
+		if d.pseudo {
+			continue
+		}
+		setState(d)
+
+		w := d.wifi
+		if w.activeBand == "" || w.activeChannel == 0 {
+			continue
+		}
+		if bandChannels[w.activeBand][w.activeChannel] &&
+			channelWidths[w.activeWidth][w.activeChannel] {
+			continue
+		}
+
+		slog.Infof("%s: channel %d (width %d) not permitted in %s",
+			d.name, w.activeChannel, w.activeWidth, wconf.domain)
+		if err := selectWifiChannel(d, w.activeBand); err != nil {
+			slog.Warnf("%s: %v", d.name, err)
+			w.activeBand = ""
+			w.activeChannel = 0
+			w.activeWidth = 0
+			wifiDeviceToConfig(d)
+		}
+	}
+}
+
+// applyRegDomain switches to a new regulatory domain.  If the radios can't be
+// operated under it, the change is rejected and reported as an exception, and
+// hostapd is left alone.  Otherwise, the channels are re-selected as needed and
+// hostapd is restarted with the new domain.
+func applyRegDomain(val string) error {
+	domain := strings.ToUpper(val)
+	if domain == "" {
+		domain = wifi.DefaultRegDomain
+	}
+	if domain == wconf.domain {
+		return nil
+	}
+
+	err := validateRegDomain(domain)
+	if err == nil {
+		err = setKernelRegDomain(domain)
+	}
+	if err != nil {
+		slog.Warnf("Rejecting @/network/regdomain change: %v", err)
+		sendRegDomainException(domain, err)
+		return err
+	}
+
+	slog.Infof("Changing regulatory domain from %s to %s", wconf.domain,
+		domain)
+	wconf.domain = domain
+	makeValidChannelMaps(domain)
+	revalidateChannels()
+
+	wifiEvaluate = true
+	hostapd.reset("regdomain changed to " + domain)
+	return nil
+}
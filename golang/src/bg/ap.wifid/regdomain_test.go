@@ -0,0 +1,254 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"bg/ap_common/platform"
+	"bg/ap_common/wificaps"
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+	"bg/common/wifi"
+
+	"github.com/stretchr/testify/require"
+)
+
+const regGetFixedJP = `global
+country US: DFS-FCC
+	(2402 - 2472 @ 40), (N/A, 30), (N/A)
+
+phy#0 (self-managed)
+country JP: DFS-UNSET
+	(2402 - 2482 @ 40), (6, 20), (N/A)
+`
+
+// Set up the globals used when changing regulatory domains, starting in the
+// default domain.  Returns the list of domains handed to the kernel.
+func setupRegDomainTest(t *testing.T) *[]string {
+	setupEntityTest(t)
+	config = cfgapi.NewHandle(mockcfg.NewMockExecEmptyTree())
+	plat = &platform.Platform{
+		NicID: func(name, mac string) string { return name },
+	}
+	hostapd = nil
+	regSupport = nil
+	wirelessNics = make(map[string]*physDevice)
+
+	wconf.domain = wifi.DefaultRegDomain
+	makeValidChannelMaps(wconf.domain)
+
+	set := make([]string, 0)
+	oldSet := setKernelRegDomain
+	setKernelRegDomain = func(domain string) error {
+		set = append(set, domain)
+		return nil
+	}
+	t.Cleanup(func() {
+		setKernelRegDomain = oldSet
+		restartApplied()
+	})
+	return &set
+}
+
+func pendingRestartReason(t *testing.T) string {
+	restarts, err := config.GetPendingRestarts()
+	require.NoError(t, err)
+	return restarts[hostapdService].Reason
+}
+
+func TestRegDomainValidation(t *testing.T) {
+	assert := require.New(t)
+	set := setupRegDomainTest(t)
+
+	// Without any information from the hardware, any well-formed domain
+	// is acceptable.
+	assert.NoError(validateRegDomain("GB"))
+	assert.NoError(validateRegDomain("FR"))
+	assert.Error(validateRegDomain("gb"))
+	assert.Error(validateRegDomain("G1"))
+	assert.Error(validateRegDomain(wifi.WorldRegDomain))
+	assert.Error(validateRegDomain(""))
+
+	assert.Equal("GB", initialRegDomain("gb"))
+	assert.Equal(wifi.DefaultRegDomain, initialRegDomain(""))
+	assert.Equal(wifi.DefaultRegDomain, initialRegDomain("bogus"))
+
+	// With radio firmware fixed to JP, nothing else will do
+	regSupport = wificaps.ParseRegGet(regGetFixedJP)
+	assert.NoError(validateRegDomain("JP"))
+	assert.EqualError(validateRegDomain("US"), "regulatory domain US "+
+		"not supported: phy#0 firmware is fixed to JP")
+	assert.Equal("JP", initialRegDomain(""))
+	assert.Equal("JP", initialRegDomain("DE"))
+
+	// An unsupported domain is rejected without touching the kernel or
+	// hostapd.
+	err := applyRegDomain("de")
+	assert.Error(err)
+	assert.Equal(wifi.DefaultRegDomain, wconf.domain)
+	assert.Empty(*set)
+	pending, err := config.HasPendingChanges()
+	assert.NoError(err)
+	assert.False(pending)
+
+	// As is one the kernel won't accept
+	setKernelRegDomain = func(domain string) error {
+		return fmt.Errorf("iw reg set %s failed", domain)
+	}
+	assert.Error(applyRegDomain("jp"))
+	assert.Equal(wifi.DefaultRegDomain, wconf.domain)
+	pending, err = config.HasPendingChanges()
+	assert.NoError(err)
+	assert.False(pending)
+
+	// A supported domain is applied, and hostapd restarted
+	setKernelRegDomain = func(domain string) error {
+		*set = append(*set, domain)
+		return nil
+	}
+	assert.NoError(applyRegDomain("jp"))
+	assert.Equal("JP", wconf.domain)
+	assert.Equal([]string{"JP"}, *set)
+	assert.Equal("regdomain changed to JP", pendingRestartReason(t))
+
+	// Setting the same domain again is a no-op
+	restartApplied()
+	assert.NoError(applyRegDomain("JP"))
+	assert.Equal([]string{"JP"}, *set)
+	pending, err = config.HasPendingChanges()
+	assert.NoError(err)
+	assert.False(pending)
+
+	// Deleting the property reverts to the default domain, which the
+	// firmware won't allow.
+	assert.Error(applyRegDomain(""))
+	assert.Equal("JP", wconf.domain)
+}
+
+func TestRegDomainChannelMaps(t *testing.T) {
+	assert := require.New(t)
+
+	makeValidChannelMaps("US")
+	for _, band := range bands {
+		for _, c := range wifi.Channels[band] {
+			assert.True(bandChannels[band][c], "US %d", c)
+		}
+	}
+	assert.True(channelWidths[80][149])
+	assert.True(channelWidths[40][161])
+
+	// GB permits neither the upper 5GHz channels nor 144
+	makeValidChannelMaps("GB")
+	assert.True(legalChannels[149])
+	assert.False(bandChannels[wifi.HiBand][149])
+	assert.False(bandChannels[wifi.HiBand][144])
+	assert.True(bandChannels[wifi.HiBand][140])
+	assert.True(channelWidths[80][100])
+	assert.False(channelWidths[80][132])
+	assert.False(channelWidths[80][149])
+	assert.True(channelWidths[40][136])  // 132+136
+	assert.False(channelWidths[40][140]) // 140+144
+	assert.True(channelWidths[20][140])
+
+	// CA has a hole at 120-128
+	makeValidChannelMaps("CA")
+	assert.True(bandChannels[wifi.HiBand][116])
+	assert.False(bandChannels[wifi.HiBand][120])
+	assert.False(channelWidths[80][116])
+	assert.True(channelWidths[40][112])  // 108+112
+	assert.False(channelWidths[40][116]) // 116+120
+	assert.True(channelWidths[80][132])
+
+	// Countries we have no rules for get the world domain's channels
+	makeValidChannelMaps("FR")
+	assert.True(bandChannels[wifi.LoBand][11])
+	assert.True(bandChannels[wifi.HiBand][48])
+	assert.False(bandChannels[wifi.HiBand][52])
+	assert.True(channelWidths[80][36])
+	assert.False(channelWidths[80][52])
+}
+
+func mkRegTestRadio(name, band string, channel, width, cfgChannel int) *physDevice {
+	caps := &wificaps.WifiCapabilities{
+		SupportVLANs:   true,
+		Interfaces:     4,
+		Channels:       make(map[int]bool),
+		WifiBands:      map[string]bool{band: true},
+		WifiModes:      map[string]bool{"n": true},
+		HTCapabilities: map[int]bool{wificaps.HTCAP_HT20_40: true},
+	}
+	if band == wifi.HiBand {
+		caps.WifiModes["ac"] = true
+	}
+	for _, c := range wifi.Channels[band] {
+		caps.Channels[c] = true
+	}
+
+	return &physDevice{
+		name:   name,
+		hwaddr: "02:00:00:00:00:01",
+		wifi: &wifiInfo{
+			state:         wifi.DevOK,
+			configChannel: cfgChannel,
+			activeBand:    band,
+			activeChannel: channel,
+			activeWidth:   width,
+			cap:           caps,
+		},
+	}
+}
+
+func TestRegDomainReselect(t *testing.T) {
+	assert := require.New(t)
+	set := setupRegDomainTest(t)
+
+	wide := mkRegTestRadio("wlan0", wifi.HiBand, 149, 80, 0)
+	lo := mkRegTestRadio("wlan1", wifi.LoBand, 6, 20, 0)
+	pinned := mkRegTestRadio("wlan2", wifi.HiBand, 153, 40, 153)
+	ok := mkRegTestRadio("wlan3", wifi.HiBand, 36, 80, 0)
+	wirelessNics = map[string]*physDevice{
+		"wlan0": wide,
+		"wlan1": lo,
+		"wlan2": pinned,
+		"wlan3": ok,
+	}
+
+	assert.NoError(applyRegDomain("GB"))
+	assert.Equal([]string{"GB"}, *set)
+
+	// The automatically chosen channel which became illegal was replaced
+	// with a legal one of the same width.
+	w := wide.wifi
+	assert.Equal(wifi.DevOK, w.state)
+	assert.Equal(wifi.HiBand, w.activeBand)
+	assert.NotEqual(149, w.activeChannel)
+	assert.Equal(80, w.activeWidth)
+	assert.True(bandChannels[wifi.HiBand][w.activeChannel])
+	assert.True(channelWidths[80][w.activeChannel])
+	for _, c := range occupiedChannels(w.activeChannel, w.activeWidth) {
+		assert.True(regChannels("GB")[c], "channel %d", c)
+	}
+
+	// Channels which are still legal are left alone
+	assert.Equal(6, lo.wifi.activeChannel)
+	assert.Equal(36, ok.wifi.activeChannel)
+	assert.Equal(80, ok.wifi.activeWidth)
+
+	// A configured channel which became illegal takes the radio out of
+	// service, rather than being rendered.
+	w = pinned.wifi
+	assert.Equal(wifi.DevIllegalChan, w.state)
+	assert.Equal("", w.activeBand)
+	assert.Equal(0, w.activeChannel)
+
+	assert.Equal("regdomain changed to GB", pendingRestartReason(t))
+}
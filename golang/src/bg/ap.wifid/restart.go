@@ -0,0 +1,58 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"sync"
+)
+
+// The service name under which we record deferred hostapd restarts in
+// @/status/pending_restart
+const hostapdService = "hostapd"
+
+// Tracks whether we have told the config tree that hostapd needs to be
+// restarted.  We only record the first reason, so the property's modification
+// time reflects how long the change has been waiting.
+var pendingRestart struct {
+	sync.Mutex
+	reason string
+}
+
+// A change needs hostapd to be restarted or reloaded, but it isn't running.
+// The change will be picked up the next time it is launched; until then,
+// record that the change is pending.
+func deferRestart(reason string) {
+	pendingRestart.Lock()
+	defer pendingRestart.Unlock()
+
+	if pendingRestart.reason != "" {
+		return
+	}
+	slog.Infof("hostapd not running - deferring restart for %s", reason)
+	if err := config.SetPendingRestart(hostapdService, reason); err != nil {
+		slog.Warnf("failed to record pending restart: %v", err)
+		return
+	}
+	pendingRestart.reason = reason
+}
+
+// hostapd has been launched with the current configuration, so any deferred
+// changes have now been applied.  We clear the property even if we didn't set
+// it, in case it was left behind by an earlier instance of ap.wifid.
+func restartApplied() {
+	pendingRestart.Lock()
+	defer pendingRestart.Unlock()
+
+	if err := config.ClearPendingRestart(hostapdService); err != nil {
+		slog.Warnf("failed to clear pending restart: %v", err)
+		return
+	}
+	pendingRestart.reason = ""
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"testing"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestDeferredRestart(t *testing.T) {
+	assert := require.New(t)
+	slog = zaptest.NewLogger(t).Sugar()
+	config = cfgapi.NewHandle(mockcfg.NewMockExecEmptyTree())
+	prop := cfgapi.PendingRestartPath + "/" + hostapdService
+
+	// A stale marker left by an earlier ap.wifid is cleared when hostapd
+	// is launched.
+	assert.NoError(config.CreateProp(prop, "stale", nil))
+	restartApplied()
+	pending, err := config.HasPendingChanges()
+	assert.NoError(err)
+	assert.False(pending)
+
+	// With hostapd down, changes are deferred.  Only the first reason is
+	// recorded.
+	var h *hostapdHdl
+	h.reset("wlan0 cfg_channel changed")
+	h.reload("radius user changed")
+	restarts, err := config.GetPendingRestarts()
+	assert.NoError(err)
+	assert.Len(restarts, 1)
+	assert.Equal("wlan0 cfg_channel changed", restarts[hostapdService].Reason)
+	since := restarts[hostapdService].Since
+
+	h.reset("ring standard VAPs changed")
+	restarts, err = config.GetPendingRestarts()
+	assert.NoError(err)
+	assert.Equal("wlan0 cfg_channel changed", restarts[hostapdService].Reason)
+	assert.Equal(since, restarts[hostapdService].Since)
+
+	// Launching hostapd applies the change
+	restartApplied()
+	pending, err = config.HasPendingChanges()
+	assert.NoError(err)
+	assert.False(pending)
+
+	// A later deferral is recorded afresh
+	h.reload("client ring changed")
+	restarts, err = config.GetPendingRestarts()
+	assert.NoError(err)
+	assert.Equal("client ring changed", restarts[hostapdService].Reason)
+	restartApplied()
+	_, err = config.GetProp(prop)
+	assert.Equal(cfgapi.ErrNoProp, err)
+}
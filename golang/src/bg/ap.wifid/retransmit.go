@@ -0,0 +1,321 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+
+	"bg/common/cfgapi"
+)
+
+const retransmitStateProp = "@/metrics/wifi/retransmit_state"
+
+type retransmitState struct {
+	mac       string
+	count     int       // how many RETRANSMIT events have we seen?
+	broken    bool      // has this client exceeded its hard limit?
+	restarted bool      // has hostapd been reset during RETRANSMIT loop?
+	first     time.Time // time of the first RETRANSMIT event
+	last      time.Time // time of the most recent RETRANSMIT event
+	persisted time.Time // time the broken/restarted markers were saved
+
+	elem *list.Element // this client's position in the LRU list
+}
+
+// retransmitMap tracks the clients we have seen RETRANSMIT events for.  The
+// number of clients tracked is bounded: when the map is full, the least
+// recently seen client is evicted to make room for a new one.  Clients which
+// have been marked broken are never evicted before their state times out, so a
+// flood of new (possibly spoofed) clients can't make us forget them.
+//
+// The broken and restarted markers are persisted to the config tree, with
+// expiration times matching the retransmit timeout, so that a restarted
+// ap.wifid doesn't restart hostapd again on behalf of the same client.
+type retransmitMap struct {
+	states map[string]*retransmitState
+	lru    *list.List // least recently seen client at the front
+
+	sync.Mutex
+}
+
+var clientRetransmits = newRetransmitMap()
+
+func newRetransmitMap() *retransmitMap {
+	return &retransmitMap{
+		states: make(map[string]*retransmitState),
+		lru:    list.New(),
+	}
+}
+
+func retransmitProp(mac string) string {
+	return retransmitStateProp + "/" + mac
+}
+
+// Has this client gone long enough without a RETRANSMIT event that we should
+// forget about it?
+func (s *retransmitState) expired(now time.Time) bool {
+	return s.last.Before(now.Add(-1 * *retransmitTimeout))
+}
+
+// Build the property ops needed to save this client's markers to the config
+// tree.  Must be called with the map locked.
+func (s *retransmitState) saveOps(now time.Time) []cfgapi.PropertyOp {
+	if !s.broken && !s.restarted {
+		return nil
+	}
+
+	expires := s.last.Add(*retransmitTimeout)
+	ops := []cfgapi.PropertyOp{
+		{Op: cfgapi.PropDelete, Name: retransmitProp(s.mac)},
+	}
+	if s.broken {
+		ops = append(ops, cfgapi.PropertyOp{
+			Op:      cfgapi.PropCreate,
+			Name:    retransmitProp(s.mac) + "/broken",
+			Value:   "true",
+			Expires: &expires,
+		})
+	}
+	if s.restarted {
+		ops = append(ops, cfgapi.PropertyOp{
+			Op:      cfgapi.PropCreate,
+			Name:    retransmitProp(s.mac) + "/restarted",
+			Value:   "true",
+			Expires: &expires,
+		})
+	}
+	s.persisted = now
+	return ops
+}
+
+// Remove a client from the map, returning the property ops needed to remove
+// its saved markers.  Must be called with the map locked.
+func (m *retransmitMap) remove(s *retransmitState) []cfgapi.PropertyOp {
+	var ops []cfgapi.PropertyOp
+
+	delete(m.states, s.mac)
+	if s.elem != nil {
+		m.lru.Remove(s.elem)
+		s.elem = nil
+	}
+	if !s.persisted.IsZero() {
+		ops = append(ops, cfgapi.PropertyOp{
+			Op:   cfgapi.PropDelete,
+			Name: retransmitProp(s.mac),
+		})
+	}
+	return ops
+}
+
+// Find the least recently seen client that may be evicted to make room for a
+// new one.  Must be called with the map locked.
+func (m *retransmitMap) victim() *retransmitState {
+	for e := m.lru.Front(); e != nil; e = e.Next() {
+		if s := e.Value.(*retransmitState); !s.broken {
+			return s
+		}
+	}
+	return nil
+}
+
+// Apply a set of property ops to the config tree.  Failures are logged, but
+// are otherwise harmless: the worst case is that a restarted ap.wifid forgets
+// about a broken client.
+func (m *retransmitMap) save(ops []cfgapi.PropertyOp) {
+	if len(ops) == 0 || config == nil {
+		return
+	}
+
+	// The deletes may target properties which have already expired
+	for _, op := range ops {
+		op := op
+		_, err := config.Execute(nil, []cfgapi.PropertyOp{op}).Wait(nil)
+		if err != nil && !(op.Op == cfgapi.PropDelete &&
+			(err == cfgapi.ErrNoProp || err == cfgapi.ErrExpired)) {
+			slog.Warnf("saving retransmit state %v: %v", op, err)
+		}
+	}
+}
+
+// Fetch the retransmit state for a specific client.  If that client has no
+// state yet, allocate a state struct and insert it into the map.  If the map
+// is full of broken clients, the returned state isn't tracked.
+func (m *retransmitMap) get(mac string) *retransmitState {
+	var ops []cfgapi.PropertyOp
+
+	now := time.Now()
+	m.Lock()
+
+	// Clean up any clients that have aged out.  The LRU list is ordered by
+	// the time of each client's last RETRANSMIT, so they're all at the
+	// front.
+	for e := m.lru.Front(); e != nil; e = m.lru.Front() {
+		state := e.Value.(*retransmitState)
+		if !state.expired(now) {
+			break
+		}
+		slog.Debugf("%s is clear.  %d since %s", state.mac,
+			state.count, state.first.Format(time.RFC3339))
+		ops = append(ops, m.remove(state)...)
+	}
+
+	state := m.states[mac]
+	if state == nil {
+		if len(m.states) >= *retransmitMaxClients {
+			if victim := m.victim(); victim != nil {
+				slog.Debugf("evicting %s to make room for %s",
+					victim.mac, mac)
+				ops = append(ops, m.remove(victim)...)
+			}
+		}
+
+		state = &retransmitState{mac: mac, first: now}
+		if len(m.states) < *retransmitMaxClients {
+			m.states[mac] = state
+			state.elem = m.lru.PushBack(state)
+		} else {
+			slog.Debugf("retransmit map full - not tracking %s", mac)
+		}
+	} else if state.elem != nil {
+		m.lru.MoveToBack(state.elem)
+	}
+	state.last = now
+
+	// Keep the saved markers from expiring while the client is still
+	// active.
+	if !state.persisted.IsZero() &&
+		now.Sub(state.persisted) > *retransmitTimeout/2 {
+		ops = append(ops, state.saveOps(now)...)
+	}
+	m.Unlock()
+
+	m.save(ops)
+	return state
+}
+
+// Mark a client as having exceeded its hard limit
+func (m *retransmitMap) markBroken(state *retransmitState) {
+	m.Lock()
+	state.broken = true
+	ops := state.saveOps(time.Now())
+	m.Unlock()
+
+	m.save(ops)
+}
+
+// Set the 'restarted' bit for all clients in the retransmit map
+func (m *retransmitMap) markRestarted() {
+	var ops []cfgapi.PropertyOp
+
+	now := time.Now()
+	m.Lock()
+	for _, state := range m.states {
+		state.restarted = true
+		ops = append(ops, state.saveOps(now)...)
+	}
+	m.Unlock()
+
+	m.save(ops)
+}
+
+// A client has successfully connected, so we can forget about it
+func (m *retransmitMap) clear(mac string) {
+	var ops []cfgapi.PropertyOp
+
+	m.Lock()
+	if state, ok := m.states[mac]; ok {
+		ops = m.remove(state)
+		if state.count != 0 {
+			slog.Infof("%s connected after %d retransmits", mac,
+				state.count)
+		}
+	}
+	m.Unlock()
+
+	m.save(ops)
+}
+
+// Reload the broken and restarted markers saved by a previous instance of
+// ap.wifid, and clean up any that have expired.
+func (m *retransmitMap) load() {
+	var ops []cfgapi.PropertyOp
+
+	props, err := config.GetProps(retransmitStateProp)
+	if err != nil {
+		if err != cfgapi.ErrNoProp {
+			slog.Warnf("fetching %s: %v", retransmitStateProp, err)
+		}
+		return
+	}
+
+	now := time.Now()
+	m.Lock()
+	for mac, node := range props.Children {
+		var expires *time.Time
+
+		state := &retransmitState{mac: mac}
+		for name, marker := range node.Children {
+			if marker.Expires == nil || !marker.Expires.After(now) {
+				continue
+			}
+			if expires == nil || marker.Expires.After(*expires) {
+				expires = marker.Expires
+			}
+			switch name {
+			case "broken":
+				state.broken = true
+			case "restarted":
+				state.restarted = true
+			}
+		}
+
+		if expires == nil || (!state.broken && !state.restarted) {
+			slog.Debugf("removing expired retransmit state for %s",
+				mac)
+			ops = append(ops, cfgapi.PropertyOp{
+				Op:   cfgapi.PropDelete,
+				Name: retransmitProp(mac),
+			})
+			continue
+		}
+
+		if old := m.states[mac]; old != nil {
+			m.remove(old)
+		}
+		state.last = expires.Add(-1 * *retransmitTimeout)
+		state.first = state.last
+		state.persisted = now
+		if state.broken {
+			state.count = *retransmitHardLimit
+		}
+		slog.Infof("restored retransmit state for %s: broken=%v "+
+			"restarted=%v", mac, state.broken, state.restarted)
+		m.states[mac] = state
+	}
+
+	// Rebuild the LRU list in order of last activity
+	m.lru.Init()
+	ordered := make([]*retransmitState, 0, len(m.states))
+	for _, state := range m.states {
+		ordered = append(ordered, state)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		return ordered[i].last.Before(ordered[j].last)
+	})
+	for _, state := range ordered {
+		state.elem = m.lru.PushBack(state)
+	}
+	m.Unlock()
+
+	m.save(ops)
+}
@@ -0,0 +1,169 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func setupRetransmitTest(t *testing.T, max int) *retransmitMap {
+	slog = zaptest.NewLogger(t).Sugar()
+	config = cfgapi.NewHandle(mockcfg.NewMockExecEmptyTree())
+
+	oldMax := *retransmitMaxClients
+	*retransmitMaxClients = max
+	t.Cleanup(func() { *retransmitMaxClients = oldMax })
+
+	return newRetransmitMap()
+}
+
+func testMac(i int) string {
+	return fmt.Sprintf("02:00:00:%02x:%02x:%02x",
+		(i>>16)&0xff, (i>>8)&0xff, i&0xff)
+}
+
+func TestRetransmitEviction(t *testing.T) {
+	assert := require.New(t)
+	m := setupRetransmitTest(t, 3)
+
+	m.get(testMac(0))
+	m.get(testMac(1))
+	m.get(testMac(2))
+
+	// Touching mac 0 makes mac 1 the least recently seen
+	m.get(testMac(0))
+	m.get(testMac(3))
+	assert.Len(m.states, 3)
+	assert.Contains(m.states, testMac(0))
+	assert.NotContains(m.states, testMac(1))
+	assert.Contains(m.states, testMac(2))
+	assert.Contains(m.states, testMac(3))
+	assert.Equal(3, m.lru.Len())
+
+	// Broken clients are skipped over
+	m.markBroken(m.states[testMac(2)])
+	m.get(testMac(4))
+	assert.Contains(m.states, testMac(2))
+	assert.NotContains(m.states, testMac(0))
+
+	// A client that connects is removed, along with its saved state
+	m.clear(testMac(2))
+	assert.NotContains(m.states, testMac(2))
+	assert.Equal(2, m.lru.Len())
+	_, err := config.GetProps(retransmitProp(testMac(2)))
+	assert.Error(err)
+}
+
+func TestRetransmitStorm(t *testing.T) {
+	assert := require.New(t)
+	m := setupRetransmitTest(t, 64)
+
+	broken := []string{testMac(100000), testMac(100001)}
+	for _, mac := range broken {
+		m.markBroken(m.get(mac))
+	}
+
+	for i := 0; i < 5000; i++ {
+		state := m.get(testMac(i))
+		state.count++
+		assert.LessOrEqual(len(m.states), 64)
+		assert.Equal(len(m.states), m.lru.Len())
+	}
+
+	for _, mac := range broken {
+		assert.Contains(m.states, mac)
+		assert.True(m.states[mac].broken)
+	}
+	assert.Contains(m.states, testMac(4999))
+
+	// Once the map is entirely full of broken clients, new clients are
+	// handed state which isn't tracked.
+	m = setupRetransmitTest(t, 2)
+	for _, mac := range broken {
+		m.markBroken(m.get(mac))
+	}
+	state := m.get(testMac(0))
+	assert.NotNil(state)
+	assert.Nil(state.elem)
+	assert.Len(m.states, 2)
+	assert.NotContains(m.states, testMac(0))
+}
+
+func TestRetransmitPersist(t *testing.T) {
+	assert := require.New(t)
+	m := setupRetransmitTest(t, 16)
+
+	a, b, c := testMac(1), testMac(2), testMac(3)
+	m.markBroken(m.get(a))
+	m.markRestarted()
+	m.get(b)
+	m.get(c)
+	m.markBroken(m.states[c])
+
+	props, err := config.GetProps(retransmitStateProp)
+	assert.NoError(err)
+	assert.Len(props.Children, 2)
+	for _, node := range props.Children {
+		for _, marker := range node.Children {
+			assert.NotNil(marker.Expires)
+			assert.Equal("true", marker.Value)
+		}
+	}
+
+	// Simulate a restart of ap.wifid
+	m2 := newRetransmitMap()
+	m2.load()
+	assert.Len(m2.states, 2)
+	assert.Equal(2, m2.lru.Len())
+	assert.True(m2.states[a].broken)
+	assert.True(m2.states[a].restarted)
+	assert.True(m2.states[c].broken)
+	assert.False(m2.states[c].restarted)
+	assert.NotContains(m2.states, b)
+	assert.WithinDuration(m.states[a].last, m2.states[a].last, time.Second)
+
+	// A reloaded broken client stays broken
+	state := m2.get(c)
+	state.count++
+	assert.True(state.broken)
+	assert.Greater(state.count, *retransmitHardLimit)
+}
+
+func TestRetransmitLoadExpired(t *testing.T) {
+	assert := require.New(t)
+	m := setupRetransmitTest(t, 16)
+
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Minute)
+	stale, fresh := testMac(1), testMac(2)
+	assert.NoError(config.CreateProp(retransmitProp(stale)+"/broken",
+		"true", &past))
+	assert.NoError(config.CreateProp(retransmitProp(fresh)+"/restarted",
+		"true", &future))
+
+	m.load()
+	assert.NotContains(m.states, stale)
+	assert.Contains(m.states, fresh)
+	assert.True(m.states[fresh].restarted)
+	assert.False(m.states[fresh].broken)
+
+	_, err := config.GetProps(retransmitProp(stale))
+	assert.Error(err)
+	_, err = config.GetProps(retransmitProp(fresh))
+	assert.NoError(err)
+}
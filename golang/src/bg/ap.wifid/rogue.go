@@ -0,0 +1,292 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bg/ap_common/apscan"
+	"bg/ap_common/aputil"
+	"bg/base_def"
+	"bg/base_msg"
+	"bg/common/cfgapi"
+	"bg/common/network"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// A rogue AP is one outside of our fleet which is broadcasting one of our
+// SSIDs, whether to confuse our clients or to lure them into connecting to it.
+// We periodically scan for them, and record each in
+// @/metrics/wifi/rogue_aps/<bssid>.  The properties expire once a rogue has
+// been quiet for a while, so an AP which is reported again after that is
+// treated as new.
+const (
+	rogueAPProp      = "@/metrics/wifi/rogue_aps"
+	offChannelScanOK = "@/network/wifi_offchannel_scan"
+)
+
+// rogueAP describes a sighting of a rogue AP, and the VAP whose SSID it is
+// broadcasting.
+type rogueAP struct {
+	bssid     string
+	ssid      string
+	vap       string
+	channel   int
+	signal    int
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// Build a map of the SSIDs broadcast by our VAPs, to the VAPs broadcasting
+// them.  A VAP tagging its 5GHz SSID is broadcasting both forms.
+func ourSSIDs(vaps map[string]*cfgapi.VirtualAP) map[string]string {
+	ssids := make(map[string]string)
+	for name, vap := range vaps {
+		if vap.SSID == "" || vap.Disabled {
+			continue
+		}
+		ssids[vap.SSID] = name
+		if vap.Tag5GHz {
+			ssids[vap.SSID+"-5ghz"] = name
+		}
+	}
+	return ssids
+}
+
+// Build the set of BSSIDs our fleet may be using.  Each wireless NIC hosts
+// its first BSS on its own address, and hostapd generates the addresses of
+// the others by replacing the final bits of that address.
+func fleetBSSIDs(nodes []cfgapi.NodeInfo) map[string]bool {
+	bssids := make(map[string]bool)
+	for _, node := range nodes {
+		for _, nic := range node.Nics {
+			if nic.Kind != "wireless" || nic.MacAddr == "" {
+				continue
+			}
+			mac := strings.ToLower(nic.MacAddr)
+			bssids[mac] = true
+			for i := 0; i < base_def.MAX_SSIDS; i++ {
+				if m, err := network.MacUpdateLastOctet(mac,
+					uint64(i)); err == nil {
+					bssids[m] = true
+				}
+			}
+		}
+	}
+	return bssids
+}
+
+// Pick out the rogue APs from the results of a scan: those broadcasting one
+// of our SSIDs from a BSSID outside of our fleet.  The rogues are returned in
+// BSSID order, with their first and last sightings set to when the scan last
+// saw them.
+func findRogueAPs(aps []*apscan.ScannedAP, ssids map[string]string,
+	fleet map[string]bool, now time.Time) []*rogueAP {
+
+	rogues := make(map[string]*rogueAP)
+	for _, ap := range aps {
+		bssid := strings.ToLower(ap.Mac)
+		vap, ours := ssids[ap.SSID]
+		if !ours || bssid == "" || fleet[bssid] {
+			continue
+		}
+
+		// A BSS may be reported by more than one radio; keep the
+		// strongest sighting.
+		if r := rogues[bssid]; r != nil && r.signal >= ap.Strength {
+			continue
+		}
+		seen := now.Add(-1 * ap.LastSeen)
+		rogues[bssid] = &rogueAP{
+			bssid:     bssid,
+			ssid:      ap.SSID,
+			vap:       vap,
+			channel:   ap.Channel,
+			signal:    ap.Strength,
+			firstSeen: seen,
+			lastSeen:  seen,
+		}
+	}
+
+	rval := make([]*rogueAP, 0, len(rogues))
+	for _, r := range rogues {
+		rval = append(rval, r)
+	}
+	sort.Slice(rval, func(i, j int) bool {
+		return rval[i].bssid < rval[j].bssid
+	})
+	return rval
+}
+
+// Build the property ops needed to record a rogue AP.  If we already knew of
+// it, its first sighting is carried over from the recorded one.  The
+// properties expire after the quiet period.
+func (r *rogueAP) saveOps(known *cfgapi.PropertyNode,
+	quiet time.Duration) []cfgapi.PropertyOp {
+
+	if known != nil {
+		if t, _ := known.GetChildTime("first_seen"); t != nil {
+			r.firstSeen = *t
+		}
+	}
+
+	base := rogueAPProp + "/" + r.bssid + "/"
+	expires := r.lastSeen.Add(quiet)
+	vals := map[string]string{
+		"ssid":       r.ssid,
+		"channel":    strconv.Itoa(r.channel),
+		"signal":     strconv.Itoa(r.signal),
+		"first_seen": r.firstSeen.UTC().Format(time.RFC3339),
+		"last_seen":  r.lastSeen.UTC().Format(time.RFC3339),
+	}
+	ops := make([]cfgapi.PropertyOp, 0)
+	for _, name := range []string{"ssid", "channel", "signal",
+		"first_seen", "last_seen"} {
+
+		ops = append(ops, cfgapi.PropertyOp{
+			Op:      cfgapi.PropCreate,
+			Name:    base + name,
+			Value:   vals[name],
+			Expires: &expires,
+		})
+	}
+	return ops
+}
+
+func sendRogueAPException(r *rogueAP) {
+	reason := base_msg.EventNetException_ROGUE_AP
+	msg := fmt.Sprintf("rogue AP %s broadcasting SSID %q on channel %d "+
+		"(%d dBm)", r.bssid, r.ssid, r.channel, r.signal)
+
+	slog.Warnf("%s", msg)
+	hwaddr, _ := net.ParseMAC(r.bssid)
+	entity := &base_msg.EventNetException{
+		Timestamp:  aputil.NowToProtobuf(),
+		Sender:     proto.String(brokerd.Name),
+		Debug:      proto.String("-"),
+		VirtualAP:  proto.String(r.vap),
+		Reason:     &reason,
+		Message:    proto.String(msg),
+		MacAddress: proto.Uint64(network.HWAddrToUint64(hwaddr)),
+	}
+
+	err := brokerd.Publish(entity, base_def.TOPIC_EXCEPTION)
+	if err != nil {
+		slog.Warnf("couldn't publish %s: %v", base_def.TOPIC_EXCEPTION, err)
+	}
+}
+
+// Choose the radios to scan with.  Radios which aren't hosting any VAPs can
+// always scan; the others can only do so if off-channel scanning is enabled,
+// since it briefly takes them away from their clients.
+func rogueScanRadios(offChannel bool) ([]string, []string) {
+	idle := make([]string, 0)
+	busy := make([]string, 0)
+	for _, d := range wirelessNics {
+		if d.pseudo || d.disabled {
+			continue
+		}
+		if d.wifi.activeBand == "" {
+			idle = append(idle, d.name)
+		} else if offChannel {
+			busy = append(busy, d.name)
+		}
+	}
+	return idle, busy
+}
+
+// Scan for rogue APs, record them, and raise an exception for each one we
+// didn't already know of.
+func rogueAPScan() {
+	offChannel, _ := config.GetPropBool(offChannelScanOK)
+	idle, busy := rogueScanRadios(offChannel)
+	if len(idle) == 0 && len(busy) == 0 {
+		slog.Debugf("no radio available to scan for rogue APs")
+		return
+	}
+
+	aps := make([]*apscan.ScannedAP, 0)
+	for _, dev := range idle {
+		aps = append(aps, apscan.ScanIface(dev)...)
+	}
+	for _, dev := range busy {
+		aps = append(aps, apscan.ScanIfaceOffChannel(dev)...)
+	}
+
+	nodes, err := config.GetNodes()
+	if err != nil {
+		slog.Warnf("can't determine our fleet's BSSIDs: %v", err)
+		return
+	}
+	rogues := findRogueAPs(aps, ourSSIDs(config.GetVirtualAPs()),
+		fleetBSSIDs(nodes), time.Now())
+	if len(rogues) == 0 {
+		return
+	}
+
+	known, err := config.GetProps(rogueAPProp)
+	if err != nil && err != cfgapi.ErrNoProp {
+		slog.Warnf("fetching %s: %v", rogueAPProp, err)
+		return
+	}
+
+	ops := make([]cfgapi.PropertyOp, 0)
+	fresh := make([]*rogueAP, 0)
+	for _, r := range rogues {
+		var node *cfgapi.PropertyNode
+		if known != nil {
+			node = known.Children[r.bssid]
+		}
+		if node == nil {
+			fresh = append(fresh, r)
+		}
+		ops = append(ops, r.saveOps(node, *rogueAPQuiet)...)
+	}
+	if _, err = config.Execute(nil, ops).Wait(nil); err != nil {
+		slog.Warnf("recording rogue APs: %v", err)
+	}
+	for _, r := range fresh {
+		sendRogueAPException(r)
+	}
+}
+
+// Periodically scan for rogue APs, until told to exit
+func rogueAPLoop(wg *sync.WaitGroup, doneChan chan bool) {
+	defer wg.Done()
+
+	freq := *rogueScanFreq
+	t := time.NewTicker(freq)
+	defer func() { t.Stop() }()
+
+	for {
+		select {
+		case <-doneChan:
+			return
+		case <-t.C:
+		}
+
+		rogueAPScan()
+
+		// If the frequency setting has been changed, reset our timer to
+		// the new value.
+		if freq != *rogueScanFreq {
+			freq = *rogueScanFreq
+			t.Stop()
+			t = time.NewTicker(freq)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"bg/ap_common/apscan"
+	"bg/common/cfgapi"
+
+	"github.com/stretchr/testify/require"
+)
+
+// A scan from a site whose gateway and satellite are both broadcasting our
+// SSIDs, with some neighbors, and a spoofer.
+const rogueTestScan = `BSS 02:1f:d0:00:10:00(on wlan1)
+	last seen: 20 ms ago
+	signal: -31.00 dBm
+	SSID: HomeNet
+	HT operation:
+		 * primary channel: 6
+BSS 02:1f:d0:00:10:01(on wlan1)
+	last seen: 20 ms ago
+	signal: -31.00 dBm
+	SSID: HomeNet-eap
+	HT operation:
+		 * primary channel: 6
+BSS 02:1f:d0:00:20:00(on wlan1)
+	last seen: 400 ms ago
+	signal: -58.00 dBm
+	SSID: HomeNet-5ghz
+	HT operation:
+		 * primary channel: 36
+BSS 98:1e:19:20:79:df(on wlan1)
+	last seen: 360 ms ago
+	signal: -84.00 dBm
+	SSID: MySpectrumWiFid8-5G
+	HT operation:
+		 * primary channel: 149
+BSS 70:3a:cb:11:22:33(on wlan1)
+	last seen: 0 ms ago
+	signal: -71.00 dBm
+	SSID:
+	HT operation:
+		 * primary channel: 1
+BSS 02:1f:d0:00:10:04(on wlan1)
+	last seen: 2000 ms ago
+	signal: -66.00 dBm
+	SSID: HomeNet
+	HT operation:
+		 * primary channel: 11
+BSS 00:11:22:33:44:55(on wlan1)
+	last seen: 1000 ms ago
+	signal: -47.00 dBm
+	SSID: HomeNet-eap
+	HT operation:
+		 * primary channel: 1
+BSS 06:aa:bb:cc:dd:ee(on wlan1)
+	last seen: 100 ms ago
+	signal: -80.00 dBm
+	SSID: Guests
+	HT operation:
+		 * primary channel: 44
+`
+
+var rogueTestVAPs = map[string]*cfgapi.VirtualAP{
+	"psk":   {SSID: "HomeNet", Tag5GHz: true},
+	"eap":   {SSID: "HomeNet-eap"},
+	"guest": {SSID: "Guests", Disabled: true},
+}
+
+var rogueTestNodes = []cfgapi.NodeInfo{
+	{
+		ID: "gateway",
+		Nics: []cfgapi.NicInfo{
+			{Kind: "wired", MacAddr: "b8:27:eb:00:00:01"},
+			{Kind: "wireless", MacAddr: "02:1F:D0:00:10:00"},
+		},
+	},
+	{
+		ID: "satellite",
+		Nics: []cfgapi.NicInfo{
+			{Kind: "wireless", MacAddr: "02:1f:d0:00:20:00"},
+		},
+	},
+}
+
+func TestOurSSIDs(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Equal(map[string]string{
+		"HomeNet":      "psk",
+		"HomeNet-5ghz": "psk",
+		"HomeNet-eap":  "eap",
+	}, ourSSIDs(rogueTestVAPs))
+	assert.Empty(ourSSIDs(nil))
+}
+
+func TestFleetBSSIDs(t *testing.T) {
+	assert := require.New(t)
+
+	fleet := fleetBSSIDs(rogueTestNodes)
+	for _, bssid := range []string{
+		"02:1f:d0:00:10:00", "02:1f:d0:00:10:01",
+		"02:1f:d0:00:10:02", "02:1f:d0:00:10:03",
+		"02:1f:d0:00:20:00", "02:1f:d0:00:20:03",
+	} {
+		assert.True(fleet[bssid], bssid)
+	}
+	assert.False(fleet["02:1f:d0:00:10:04"])
+	assert.False(fleet["b8:27:eb:00:00:01"])
+}
+
+func TestFindRogueAPs(t *testing.T) {
+	assert := require.New(t)
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	aps := apscan.ParseIwOutput(rogueTestScan)
+	assert.Len(aps, 8)
+
+	rogues := findRogueAPs(aps, ourSSIDs(rogueTestVAPs),
+		fleetBSSIDs(rogueTestNodes), now)
+	assert.Equal([]*rogueAP{
+		{
+			bssid:     "00:11:22:33:44:55",
+			ssid:      "HomeNet-eap",
+			vap:       "eap",
+			channel:   1,
+			signal:    -47,
+			firstSeen: now.Add(-time.Second),
+			lastSeen:  now.Add(-time.Second),
+		},
+		{
+			bssid:     "02:1f:d0:00:10:04",
+			ssid:      "HomeNet",
+			vap:       "psk",
+			channel:   11,
+			signal:    -66,
+			firstSeen: now.Add(-2 * time.Second),
+			lastSeen:  now.Add(-2 * time.Second),
+		},
+	}, rogues)
+
+	// Only our own APs and benign neighbors
+	rogues = findRogueAPs(aps[:5], ourSSIDs(rogueTestVAPs),
+		fleetBSSIDs(rogueTestNodes), now)
+	assert.Empty(rogues)
+
+	// Without knowing our fleet, our own APs look like rogues
+	rogues = findRogueAPs(aps, ourSSIDs(rogueTestVAPs), nil, now)
+	assert.Len(rogues, 5)
+
+	// The same rogue seen by two radios is reported once, at its
+	// strongest
+	weaker := *aps[6]
+	weaker.Strength = -90
+	aps = append([]*apscan.ScannedAP{&weaker}, aps...)
+	rogues = findRogueAPs(aps, ourSSIDs(rogueTestVAPs),
+		fleetBSSIDs(rogueTestNodes), now)
+	assert.Len(rogues, 2)
+	assert.Equal(-47, rogues[0].signal)
+}
+
+func TestRogueAPSaveOps(t *testing.T) {
+	assert := require.New(t)
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	r := &rogueAP{
+		bssid:     "00:11:22:33:44:55",
+		ssid:      "HomeNet",
+		vap:       "psk",
+		channel:   6,
+		signal:    -47,
+		firstSeen: now,
+		lastSeen:  now,
+	}
+	ops := r.saveOps(nil, time.Hour)
+	assert.Len(ops, 5)
+	vals := make(map[string]string)
+	for _, op := range ops {
+		assert.Equal(cfgapi.PropCreate, op.Op)
+		assert.Equal(now.Add(time.Hour), *op.Expires)
+		vals[op.Name] = op.Value
+	}
+	base := rogueAPProp + "/00:11:22:33:44:55/"
+	assert.Equal(map[string]string{
+		base + "ssid":       "HomeNet",
+		base + "channel":    "6",
+		base + "signal":     "-47",
+		base + "first_seen": "2020-06-01T12:00:00Z",
+		base + "last_seen":  "2020-06-01T12:00:00Z",
+	}, vals)
+
+	// A rogue we already knew of keeps its first sighting
+	known := &cfgapi.PropertyNode{Children: cfgapi.ChildMap{
+		"first_seen": &cfgapi.PropertyNode{Value: "2020-05-30T08:00:00Z"},
+	}}
+	for _, op := range r.saveOps(known, time.Hour) {
+		if op.Name == base+"first_seen" {
+			assert.Equal("2020-05-30T08:00:00Z", op.Value)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"bg/ap_common/aputil"
+	"bg/base_def"
+	"bg/base_msg"
+	"bg/common/cfgapi"
+	"bg/common/network"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Default priorities for VAPs without an explicit @/network/vap/<name>/priority.
+// When a radio can't host every VAP, the higher priorities are kept.
+const (
+	vapPriorityGuest      = 100
+	vapPriorityEAP        = 200
+	vapPriorityPSK        = 300
+	vapPriorityUnenrolled = 400
+)
+
+type vapCandidate struct {
+	name     string
+	priority int
+}
+
+// The VAPs hosted on each radio by the most recent config generation, indexed
+// by nic ID.  Used to notice when a VAP gets pushed off a radio.
+var (
+	hostedVAPs    = make(map[string]map[string]bool)
+	hostedVAPLock sync.Mutex
+)
+
+// Determine the priority of a VAP when competing for a radio's BSS slots.  An
+// explicitly configured priority wins; otherwise the onboarding VAP comes
+// first, followed by PSK, EAP, and guest VAPs.
+func vapPriority(name string, vap *cfgapi.VirtualAP, unenrolled string) int {
+	switch {
+	case vap.Priority != 0:
+		return vap.Priority
+	case name == unenrolled:
+		return vapPriorityUnenrolled
+	case vap.DefaultRing == base_def.RING_GUEST:
+		return vapPriorityGuest
+	case vap.KeyMgmt == "wpa-psk":
+		return vapPriorityPSK
+	default:
+		return vapPriorityEAP
+	}
+}
+
+// assignVAPSlots chooses which of the candidate VAPs will be hosted on a radio
+// with the given number of BSS slots.  Candidates are ranked by priority, with
+// ties broken by name, so the outcome doesn't depend on the order in which
+// they're presented.  The hosted VAPs are returned in alphabetical order, so
+// the generated config (and the BSSID each VAP is assigned) doesn't change
+// when their priorities do.  The omitted VAPs are returned highest priority
+// first.
+func assignVAPSlots(candidates []vapCandidate, slots int) ([]string, []string) {
+	ranked := make([]vapCandidate, len(candidates))
+	copy(ranked, candidates)
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].priority != ranked[j].priority {
+			return ranked[i].priority > ranked[j].priority
+		}
+		return ranked[i].name < ranked[j].name
+	})
+
+	if slots < 0 {
+		slots = 0
+	}
+	if slots > len(ranked) {
+		slots = len(ranked)
+	}
+
+	hosted := make([]string, 0)
+	for _, c := range ranked[:slots] {
+		hosted = append(hosted, c.name)
+	}
+	sort.Strings(hosted)
+
+	omitted := make([]string, 0)
+	for _, c := range ranked[slots:] {
+		omitted = append(omitted, c.name)
+	}
+
+	return hosted, omitted
+}
+
+// Report a VAP which was hosted on a radio, but which no longer fits.
+func sendVAPCapacityException(d *physDevice, vap string, slots int) {
+	reason := base_msg.EventNetException_VAP_CAPACITY
+	msg := fmt.Sprintf("%s can only support %d SSIDs; dropped %s",
+		d.name, slots, vap)
+
+	slog.Warnf("%s", msg)
+	hwaddr, _ := net.ParseMAC(d.hwaddr)
+	entity := &base_msg.EventNetException{
+		Timestamp:  aputil.NowToProtobuf(),
+		Sender:     proto.String(brokerd.Name),
+		Debug:      proto.String("-"),
+		VirtualAP:  proto.String(vap),
+		Reason:     &reason,
+		Message:    proto.String(msg),
+		MacAddress: proto.Uint64(network.HWAddrToUint64(hwaddr)),
+	}
+
+	err := brokerd.Publish(entity, base_def.TOPIC_EXCEPTION)
+	if err != nil {
+		slog.Warnf("couldn't publish %s: %v", base_def.TOPIC_EXCEPTION, err)
+	}
+}
+
+// Record the outcome of a radio's slot assignment.  The omitted VAPs are
+// published to @/metrics/nodes/<node>/wifi/<nic>/omitted_vaps, and an exception
+// is raised for each one which was hosted on the radio last time around.
+func noteVAPSlots(d *physDevice, hosted, omitted []string) {
+	nicID := plat.NicID(d.name, d.hwaddr)
+	slots := d.wifi.cap.Interfaces
+
+	hostedVAPLock.Lock()
+	prior := hostedVAPs[nicID]
+	now := make(map[string]bool)
+	for _, name := range hosted {
+		now[name] = true
+	}
+	hostedVAPs[nicID] = now
+	hostedVAPLock.Unlock()
+
+	for _, name := range omitted {
+		if prior[name] {
+			sendVAPCapacityException(d, name, slots)
+		}
+	}
+
+	if config == nil {
+		return
+	}
+
+	prop := "@/metrics/nodes/" + nodeID + "/wifi/" + nicID + "/omitted_vaps"
+	if len(omitted) > 0 {
+		slog.Warnf("%s can only support %d of %d SSIDs; omitting %s",
+			d.hwaddr, slots, len(hosted)+len(omitted), list(omitted))
+		err := config.CreateProp(prop, list(omitted), nil)
+		if err != nil {
+			slog.Warnf("publishing %s: %v", prop, err)
+		}
+	} else {
+		err := config.DeleteProp(prop)
+		if err != nil && err != cfgapi.ErrNoProp {
+			slog.Warnf("clearing %s: %v", prop, err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"bg/base_def"
+	"bg/common/cfgapi"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The VAPs from the default config, with their default priorities
+var defaultCandidates = []vapCandidate{
+	{"eap", vapPriorityEAP},
+	{"guest", vapPriorityGuest},
+	{"psk", vapPriorityUnenrolled},
+}
+
+func TestVAPPriority(t *testing.T) {
+	assert := require.New(t)
+
+	psk := &cfgapi.VirtualAP{KeyMgmt: "wpa-psk", DefaultRing: "devices"}
+	eap := &cfgapi.VirtualAP{KeyMgmt: "wpa-eap", DefaultRing: "standard"}
+	guest := &cfgapi.VirtualAP{KeyMgmt: "wpa-psk",
+		DefaultRing: base_def.RING_GUEST}
+
+	assert.Equal(vapPriorityUnenrolled, vapPriority("psk", psk, "psk"))
+	assert.Equal(vapPriorityPSK, vapPriority("psk", psk, "other"))
+	assert.Equal(vapPriorityEAP, vapPriority("eap", eap, "psk"))
+	assert.Equal(vapPriorityGuest, vapPriority("guest", guest, "psk"))
+
+	// An explicit priority overrides the default tiers
+	guest.Priority = 1000
+	assert.Equal(1000, vapPriority("guest", guest, "psk"))
+	psk.Priority = 5
+	assert.Equal(5, vapPriority("psk", psk, "psk"))
+}
+
+func TestAssignVAPSlots(t *testing.T) {
+	testCases := []struct {
+		name       string
+		candidates []vapCandidate
+		slots      int
+		hosted     []string
+		omitted    []string
+	}{
+		{
+			name:       "default-1",
+			candidates: defaultCandidates,
+			slots:      1,
+			hosted:     []string{"psk"},
+			omitted:    []string{"eap", "guest"},
+		},
+		{
+			name:       "default-2",
+			candidates: defaultCandidates,
+			slots:      2,
+			hosted:     []string{"eap", "psk"},
+			omitted:    []string{"guest"},
+		},
+		{
+			name:       "default-4",
+			candidates: defaultCandidates,
+			slots:      4,
+			hosted:     []string{"eap", "guest", "psk"},
+			omitted:    []string{},
+		},
+		{
+			// A new VAP whose name sorts first doesn't displace
+			// the production networks.
+			name: "new-vap-1",
+			candidates: append([]vapCandidate{
+				{"aaa-test", vapPriorityPSK},
+			}, defaultCandidates...),
+			slots:   1,
+			hosted:  []string{"psk"},
+			omitted: []string{"aaa-test", "eap", "guest"},
+		},
+		{
+			name: "new-vap-2",
+			candidates: append([]vapCandidate{
+				{"aaa-test", vapPriorityPSK},
+			}, defaultCandidates...),
+			slots:   2,
+			hosted:  []string{"aaa-test", "psk"},
+			omitted: []string{"eap", "guest"},
+		},
+		{
+			name: "boosted-guest-2",
+			candidates: []vapCandidate{
+				{"eap", vapPriorityEAP},
+				{"guest", 1000},
+				{"psk", vapPriorityUnenrolled},
+			},
+			slots:   2,
+			hosted:  []string{"guest", "psk"},
+			omitted: []string{"eap"},
+		},
+		{
+			// Ties are broken by name, regardless of the order
+			// in which the candidates are presented.
+			name: "ties-1",
+			candidates: []vapCandidate{
+				{"zeta", 10},
+				{"beta", 10},
+				{"alpha", 10},
+			},
+			slots:   1,
+			hosted:  []string{"alpha"},
+			omitted: []string{"beta", "zeta"},
+		},
+		{
+			name: "ties-2",
+			candidates: []vapCandidate{
+				{"zeta", 10},
+				{"beta", 10},
+				{"alpha", 10},
+				{"top", 20},
+			},
+			slots:   2,
+			hosted:  []string{"alpha", "top"},
+			omitted: []string{"beta", "zeta"},
+		},
+		{
+			name: "ties-4",
+			candidates: []vapCandidate{
+				{"d", 10},
+				{"c", 20},
+				{"b", 10},
+				{"a", 5},
+				{"e", 10},
+			},
+			slots:   4,
+			hosted:  []string{"b", "c", "d", "e"},
+			omitted: []string{"a"},
+		},
+		{
+			name:       "none",
+			candidates: []vapCandidate{},
+			slots:      2,
+			hosted:     []string{},
+			omitted:    []string{},
+		},
+		{
+			name:       "no-slots",
+			candidates: defaultCandidates,
+			slots:      0,
+			hosted:     []string{},
+			omitted:    []string{"psk", "eap", "guest"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert := require.New(t)
+			orig := fmt.Sprint(tc.candidates)
+
+			hosted, omitted := assignVAPSlots(tc.candidates,
+				tc.slots)
+			assert.Equal(tc.hosted, hosted)
+			assert.Equal(tc.omitted, omitted)
+
+			// The caller's slice is left untouched
+			assert.Equal(orig, fmt.Sprint(tc.candidates))
+		})
+	}
+}
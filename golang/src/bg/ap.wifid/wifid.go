@@ -50,6 +50,23 @@ var (
 	retransmitHardLimit = apcfg.Int("retransmit_hard", 6, true, nil)
 	retransmitTimeout   = apcfg.Duration("retransmit_timeout",
 		5*time.Minute, true, nil)
+	retransmitMaxClients = apcfg.Int("retransmit_max_clients", 1024,
+		true, nil)
+	authStatsFlush = apcfg.Duration("auth_stats_flush", time.Minute,
+		true, nil)
+	authFailWindow = apcfg.Duration("auth_fail_window", 15*time.Minute,
+		true, nil)
+	authFailPercent     = apcfg.Int("auth_fail_percent", 50, true, nil)
+	authFailMinAttempts = apcfg.Int("auth_fail_min_attempts", 10,
+		true, nil)
+	eapCertCheckFreq = apcfg.Duration("eap_cert_check_freq", time.Hour,
+		true, nil)
+	eapCertLead = apcfg.Duration("eap_cert_lead", 14*24*time.Hour,
+		true, nil)
+	rogueScanFreq = apcfg.Duration("rogue_scan_freq", time.Hour,
+		true, nil)
+	rogueAPQuiet = apcfg.Duration("rogue_ap_quiet", 24*time.Hour,
+		true, nil)
 	apScanFreq   = apcfg.Duration("ap_scan_freq", 7*time.Hour, true, nil)
 	apStale      = apcfg.Duration("ap_stale", 10*time.Minute, true, nil)
 	chanEvalFreq = apcfg.Duration("chan_eval_freq", 12*time.Hour, true, nil)
@@ -110,7 +127,7 @@ func slice(list string) []string {
 
 func hostapdReset(name, val string) error {
 	if hostapd != nil {
-		hostapd.reset()
+		hostapd.reset(name + " changed")
 	}
 	return nil
 }
@@ -192,6 +209,7 @@ func wifiDeviceToConfig(d *physDevice) {
 	newVals["active_channel"] = strconv.Itoa(d.wifi.activeChannel)
 	newVals["active_width"] = strconv.Itoa(d.wifi.activeWidth)
 	newVals["state"] = d.wifi.state
+	newVals["max_ssids"] = strconv.Itoa(d.wifi.cap.Interfaces)
 
 	base := "@/nodes/" + nodeID + "/nics/" + plat.NicID(d.name, d.hwaddr)
 	for prop, val := range newVals {
@@ -308,10 +326,14 @@ func daemonInit() error {
 	config.HandleChange(`^@/users/.*`, configUserChanged)
 	config.HandleDelExp(`^@/users/.*`, configUserDeleted)
 	config.HandleChange(`^@/network/radius_auth_secret`, configNetworkRadiusSecretChanged)
+	config.HandleChange(`^@/network/regdomain$`, configRegDomainChanged)
+	config.HandleDelete(`^@/network/regdomain$`, configRegDomainDeleted)
 	config.HandleChange(`^@/certs/.*/state`, configCertStateChange)
 
-	rings = config.GetRings()
+	rings = config.GetRingsLegacy()
 	clients = config.GetClients()
+	clientRetransmits.load()
+	wifiAuthStats.load()
 
 	props, err := config.GetProps("@/network")
 	if err != nil {
@@ -401,6 +423,9 @@ func main() {
 
 	go apMonitorLoop(&cleanup.wg, addDoneChan())
 	go hostapdLoop(&cleanup.wg, addDoneChan())
+	go authStatsLoop(&cleanup.wg, addDoneChan())
+	go certExpiryLoop(&cleanup.wg, addDoneChan())
+	go rogueAPLoop(&cleanup.wg, addDoneChan())
 
 	go http.ListenAndServe(base_def.WIFID_DIAG_PORT, nil)
 
@@ -40,7 +40,8 @@ var (
 	commandID = int64(0)
 )
 
-// APConfig is an opaque type representing a connection to ap.configd
+// APConfig is an opaque type representing a connection to ap.configd.  The
+// mutex protects the registered handlers and the health monitor's channel.
 type APConfig struct {
 	comm   *comms.APComm
 	name   string
@@ -196,7 +197,9 @@ func NewConfigd(b *broker.Broker, name string,
 func (c *APConfig) sendOp(query *cfgmsg.ConfigQuery) (string, error) {
 	var rval string
 
-	query.Sender = c.sender
+	if query.Sender == "" {
+		query.Sender = c.sender
+	}
 	query.CmdID = atomic.AddInt64(&commandID, 1)
 	msg, err := proto.Marshal(query)
 	if err != nil {
@@ -205,8 +208,11 @@ func (c *APConfig) sendOp(query *cfgmsg.ConfigQuery) (string, error) {
 
 	reply, err := c.comm.ReqRepl(msg)
 
-	if c.errChan != nil {
-		(*c.errChan) <- err
+	c.Lock()
+	errChan := c.errChan
+	c.Unlock()
+	if errChan != nil {
+		(*errChan) <- err
 	}
 
 	if err == nil && len(reply) > 0 {
@@ -252,6 +258,7 @@ func (c *APConfig) ExecuteAt(ctx context.Context, ops []cfgapi.PropertyOp,
 			rval.err = err
 		} else {
 			query.Level = int32(level)
+			query.Sender = cfgapi.OriginFromContext(ctx)
 			rval.rval, rval.err = c.sendOp(query)
 		}
 	}
@@ -33,6 +33,15 @@ type delexpMatch struct {
 	handler func([]string)
 }
 
+// handlers returns the handlers registered so far.  The handler slices are
+// only ever appended to, so the caller may iterate over them without holding
+// the lock, while other goroutines register new handlers.
+func (c *APConfig) handlers() ([]changeMatch, []delexpMatch, []delexpMatch) {
+	c.Lock()
+	defer c.Unlock()
+	return c.changeHandlers, c.deleteHandlers, c.expireHandlers
+}
+
 // Opaque type representing a connection to ap.configd
 func (c *APConfig) configEvent(raw []byte) {
 	event := &base_msg.EventConfig{}
@@ -47,6 +56,7 @@ func (c *APConfig) configEvent(raw []byte) {
 	property := *event.Property
 	path := strings.Split(property[2:], "/")
 
+	changeHandlers, deleteHandlers, expireHandlers := c.handlers()
 	if etype == base_msg.EventConfig_CHANGE {
 		var value string
 
@@ -54,19 +64,19 @@ func (c *APConfig) configEvent(raw []byte) {
 			value = *event.NewValue
 		}
 		expires := aputil.ProtobufToTime(event.Expires)
-		for _, m := range c.changeHandlers {
+		for _, m := range changeHandlers {
 			if m.match.MatchString(property) {
 				m.handler(path, value, expires)
 			}
 		}
 	} else if etype == base_msg.EventConfig_DELETE {
-		for _, m := range c.deleteHandlers {
+		for _, m := range deleteHandlers {
 			if m.match.MatchString(property) {
 				m.handler(path)
 			}
 		}
 	} else if etype == base_msg.EventConfig_EXPIRE {
-		for _, m := range c.expireHandlers {
+		for _, m := range expireHandlers {
 			if m.match.MatchString(property) {
 				m.handler(path)
 			}
@@ -74,6 +84,8 @@ func (c *APConfig) configEvent(raw []byte) {
 	}
 }
 
+// handleCommon compiles the path, and subscribes to config events if we haven't
+// already.  It must be called with the lock held.
 func (c *APConfig) handleCommon(path string) (re *regexp.Regexp, err error) {
 	if c.broker == nil {
 		err = fmt.Errorf("cannot subscribe to events without a broker")
@@ -92,6 +104,10 @@ func (c *APConfig) handleCommon(path string) (re *regexp.Regexp, err error) {
 // HandleChange registers a callback function for property change events
 func (c *APConfig) HandleChange(path string, handler func([]string, string,
 	*time.Time)) error {
+
+	c.Lock()
+	defer c.Unlock()
+
 	re, err := c.handleCommon(path)
 	if err == nil {
 		match := changeMatch{
@@ -105,6 +121,9 @@ func (c *APConfig) HandleChange(path string, handler func([]string, string,
 
 // HandleDelete registers a callback function for property delete events
 func (c *APConfig) HandleDelete(path string, handler func([]string)) error {
+	c.Lock()
+	defer c.Unlock()
+
 	re, err := c.handleCommon(path)
 	if err == nil {
 		match := delexpMatch{
@@ -118,6 +137,9 @@ func (c *APConfig) HandleDelete(path string, handler func([]string)) error {
 
 // HandleExpire registers a callback function for property expiration events
 func (c *APConfig) HandleExpire(path string, handler func([]string)) error {
+	c.Lock()
+	defer c.Unlock()
+
 	re, err := c.handleCommon(path)
 	if err == nil {
 		match := delexpMatch{
@@ -139,7 +139,9 @@ func parseOneBSS(data string) *ScannedAP {
 	return &ap
 }
 
-func parseIwOutput(data string) []*ScannedAP {
+// ParseIwOutput parses the output of 'iw dev <iface> scan', returning a
+// ScannedAP for each BSS it describes.
+func ParseIwOutput(data string) []*ScannedAP {
 	// Split the output from the 'iw dev <iface> scan' into per-BSS stanzas
 	all := make([]string, 0)
 
@@ -164,24 +166,36 @@ func parseIwOutput(data string) []*ScannedAP {
 	return aps
 }
 
-// ScanIface will use the provided interface to scan for nearby APs.  It returns
-// a slice of ScannedAP structs containing per-AP information about each it
-// found.
-func ScanIface(iface string) []*ScannedAP {
+func scanIface(iface string, args ...string) []*ScannedAP {
 	var aps []*ScannedAP
 
 	if plat == nil {
 		plat = platform.NewPlatform()
 	}
 
-	cmd := exec.Command(plat.IwCmd, "dev", iface, "scan")
+	args = append([]string{"dev", iface, "scan"}, args...)
+	cmd := exec.Command(plat.IwCmd, args...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		err = fmt.Errorf("failed to scan %s: %s", iface, string(out))
 	} else {
-		aps = parseIwOutput(string(out))
+		aps = ParseIwOutput(string(out))
 	}
 
 	return aps
 }
 
+// ScanIface will use the provided interface to scan for nearby APs.  It returns
+// a slice of ScannedAP structs containing per-AP information about each it
+// found.
+func ScanIface(iface string) []*ScannedAP {
+	return scanIface(iface)
+}
+
+// ScanIfaceOffChannel is like ScanIface, but will scan even if the interface
+// is hosting an AP.  The radio briefly leaves its channel to do so, which may
+// disrupt its clients.
+func ScanIfaceOffChannel(iface string) []*ScannedAP {
+	return scanIface(iface, "ap-force")
+}
+
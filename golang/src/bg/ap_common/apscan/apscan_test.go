@@ -0,0 +1,96 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package apscan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Trimmed output of 'iw dev wlan1 scan'
+const testScan = `BSS 98:1e:19:20:79:df(on wlan1)
+	last seen: 360 ms ago
+	TSF: 1419453245786 usec (16d, 10:17:33)
+	freq: 5745
+	beacon interval: 100 TUs
+	capability: ESS Privacy SpectrumMgmt (0x0111)
+	signal: -84.00 dBm
+	SSID: MySpectrumWiFid8-5G
+	Supported rates: 6.0* 9.0 12.0* 18.0 24.0* 36.0 48.0 54.0
+	HT capabilities:
+		Capabilities: 0x9ef
+	HT operation:
+		 * primary channel: 149
+		 * secondary channel offset: above
+		 * STA channel width: any
+	VHT capabilities:
+		VHT Capabilities (0x0f8b69b2):
+	VHT operation:
+		 * channel width: 1 (80 MHz)
+		 * center freq segment 1: 155
+BSS 00:11:22:33:44:55(on wlan1)
+	last seen: 1020 ms ago
+	freq: 2437
+	signal: -47.00 dBm
+	SSID: HomeNet
+	HT capabilities:
+		Capabilities: 0x1ad
+	HT operation:
+		 * primary channel: 6
+		 * secondary channel offset: no secondary
+BSS 70:3a:cb:11:22:33(on wlan1) -- associated
+	last seen: 0 ms ago
+	freq: 2412
+	signal: -71.50 dBm
+	SSID:
+	DS Parameter set: channel 1
+	HT operation:
+		 * primary channel: 1
+		 * secondary channel offset: below
+`
+
+func TestParseIwOutput(t *testing.T) {
+	assert := require.New(t)
+
+	aps := ParseIwOutput(testScan)
+	assert.Len(aps, 3)
+
+	assert.Equal(&ScannedAP{
+		Mac:       "98:1e:19:20:79:df",
+		SSID:      "MySpectrumWiFid8-5G",
+		Mode:      "ac",
+		Channel:   149,
+		Width:     80,
+		Strength:  -84,
+		LastSeen:  360 * time.Millisecond,
+		Secondary: 0,
+	}, aps[0])
+
+	assert.Equal(&ScannedAP{
+		Mac:      "00:11:22:33:44:55",
+		SSID:     "HomeNet",
+		Mode:     "b/g/n",
+		Channel:  6,
+		Width:    20,
+		Strength: -47,
+		LastSeen: 1020 * time.Millisecond,
+	}, aps[1])
+
+	// A hidden SSID
+	assert.Equal("70:3a:cb:11:22:33", aps[2].Mac)
+	assert.Equal("", aps[2].SSID)
+	assert.Equal(1, aps[2].Channel)
+	assert.Equal(40, aps[2].Width)
+	assert.Equal(-71, aps[2].Strength)
+
+	assert.Empty(ParseIwOutput(""))
+}
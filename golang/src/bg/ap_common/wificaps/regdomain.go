@@ -0,0 +1,109 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package wificaps
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+
+	"bg/ap_common/platform"
+	"bg/common/wifi"
+)
+
+// RegSupport describes the regulatory domains a system's wireless hardware
+// will accept.  Most radios let the kernel apply whichever domain it is told
+// to, but some have their domain fixed by the firmware ("self-managed"), and
+// will refuse to operate under any other.
+type RegSupport struct {
+	Global      string            // domain currently applied by the kernel
+	SelfManaged map[string]string // phy -> domain fixed by its firmware
+}
+
+var (
+	regPhyRE     = regexp.MustCompile(`^(phy#\d+)(\s+\(self-managed\))?`)
+	regCountryRE = regexp.MustCompile(`^country ([0-9A-Z]{2}):`)
+)
+
+// Firmware which hasn't been programmed for a particular country reports one
+// of these, and will follow the kernel's lead.
+func unsetRegDomain(domain string) bool {
+	return domain == "" || domain == wifi.WorldRegDomain || domain == "99"
+}
+
+// ParseRegGet extracts the domain in effect, and those fixed by any
+// self-managed radios, from the output of 'iw reg get'.
+func ParseRegGet(out string) *RegSupport {
+	r := &RegSupport{
+		SelfManaged: make(map[string]string),
+	}
+
+	phy := ""
+	managed := false
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "global" {
+			phy, managed = "", false
+		} else if m := regPhyRE.FindStringSubmatch(line); m != nil {
+			phy, managed = m[1], m[2] != ""
+		} else if m := regCountryRE.FindStringSubmatch(line); m != nil {
+			if phy == "" {
+				r.Global = m[1]
+			} else if managed {
+				r.SelfManaged[phy] = m[1]
+			}
+		}
+	}
+
+	return r
+}
+
+// Supports returns an error if any of the radios is unable to operate under
+// the given regulatory domain.
+func (r *RegSupport) Supports(domain string) error {
+	phys := make([]string, 0)
+	for phy := range r.SelfManaged {
+		phys = append(phys, phy)
+	}
+	sort.Strings(phys)
+
+	for _, phy := range phys {
+		fixed := r.SelfManaged[phy]
+		if !unsetRegDomain(fixed) && fixed != domain {
+			return fmt.Errorf("%s firmware is fixed to %s", phy, fixed)
+		}
+	}
+	return nil
+}
+
+// Fixed returns the domain imposed by the firmware of the self-managed radios,
+// or "" if there is none.
+func (r *RegSupport) Fixed() string {
+	for _, fixed := range r.SelfManaged {
+		if !unsetRegDomain(fixed) {
+			return fixed
+		}
+	}
+	return ""
+}
+
+// GetRegSupport queries the kernel for the regulatory domains in effect on the
+// system's wireless hardware.
+func GetRegSupport() (*RegSupport, error) {
+	plat := platform.NewPlatform()
+	out, err := exec.Command(plat.IwCmd, "reg", "get").Output()
+	if err != nil {
+		return nil, fmt.Errorf("iw reg get failed: %v", err)
+	}
+
+	return ParseRegGet(string(out)), nil
+}
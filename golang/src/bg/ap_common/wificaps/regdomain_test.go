@@ -0,0 +1,76 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package wificaps
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const regGetKernel = `global
+country US: DFS-FCC
+	(2402 - 2472 @ 40), (N/A, 30), (N/A)
+	(5170 - 5250 @ 80), (N/A, 23), (N/A), AUTO-BW
+	(5250 - 5330 @ 80), (N/A, 23), (0 ms), DFS, AUTO-BW
+
+`
+
+const regGetSelfManaged = `global
+country US: DFS-FCC
+	(2402 - 2472 @ 40), (N/A, 30), (N/A)
+
+phy#1
+country US: DFS-FCC
+	(2402 - 2472 @ 40), (N/A, 30), (N/A)
+
+phy#0 (self-managed)
+country JP: DFS-UNSET
+	(2402 - 2482 @ 40), (6, 20), (N/A), NO-HT40MINUS
+	(5170 - 5250 @ 80), (6, 20), (N/A), NO-OUTDOOR
+`
+
+const regGetUnprogrammed = `global
+country 00: DFS-UNSET
+	(2402 - 2472 @ 40), (6, 20), (N/A)
+
+phy#0 (self-managed)
+country 99: DFS-UNSET
+	(2402 - 2472 @ 40), (6, 20), (N/A)
+`
+
+func TestRegSupport(t *testing.T) {
+	assert := require.New(t)
+
+	r := ParseRegGet(regGetKernel)
+	assert.Equal("US", r.Global)
+	assert.Empty(r.SelfManaged)
+	assert.Equal("", r.Fixed())
+	assert.NoError(r.Supports("US"))
+	assert.NoError(r.Supports("GB"))
+
+	// Only phy#0 manages its own domain
+	r = ParseRegGet(regGetSelfManaged)
+	assert.Equal("US", r.Global)
+	assert.Equal(map[string]string{"phy#0": "JP"}, r.SelfManaged)
+	assert.Equal("JP", r.Fixed())
+	assert.NoError(r.Supports("JP"))
+	assert.EqualError(r.Supports("US"), "phy#0 firmware is fixed to JP")
+
+	// Firmware which hasn't been programmed follows the kernel
+	r = ParseRegGet(regGetUnprogrammed)
+	assert.Equal("00", r.Global)
+	assert.Equal("", r.Fixed())
+	assert.NoError(r.Supports("DE"))
+
+	r = ParseRegGet("")
+	assert.Equal("", r.Global)
+	assert.NoError(r.Supports("US"))
+}
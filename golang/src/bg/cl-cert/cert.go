@@ -25,6 +25,7 @@ import (
 
 	"bg/cl_common/clcfg"
 	"bg/cl_common/daemonutils"
+	"bg/cl_common/joblease"
 	"bg/cl_common/pgutils"
 	"bg/cloud_models/appliancedb"
 	"bg/common/cfgapi"
@@ -612,6 +613,8 @@ func postCert(cert *appliancedb.ServerCert, u uuid.UUID, domain string) error {
 			"site-uuid", u, "domain", domain, "error", err)
 	}
 	defer hdl.Close()
+	// This handle has no business touching anything but the certificates
+	hdl.Use(cfgapi.AllowPaths("@/certs"))
 	prop := fmt.Sprintf("@/certs/%s/state", fingerprint)
 	// We don't create the origin node here too because a) only the cloud
 	// sets the state to available, and b) it would make the code on the
@@ -716,21 +719,64 @@ func unlock(lockPath string) {
 	}
 }
 
+// The job lease keeps cl-cert from running concurrently on different hosts.
+// It is renewed while we run, so the TTL only matters if we die holding it.
+const (
+	certJobName = "cl-cert"
+	certJobTTL  = 5 * time.Minute
+)
+
+// lockJob acquires the cl-cert job lease, returning a function which releases
+// it.  If the database can neither grant nor refuse the lease, e.g., because
+// its schema predates job leases, we fall back to the lockfile, which at least
+// keeps another cl-cert on this host from running.
+func lockJob(ctx context.Context, db appliancedb.DataStore,
+	lockPath string) (func(), error) {
+
+	lease, err := joblease.Acquire(ctx, db, certJobName, certJobTTL, slog)
+	if err == nil {
+		return func() {
+			err := lease.Release(context.Background())
+			if err != nil {
+				slog.Warnw("Failed to release job lease",
+					"error", err)
+			}
+		}, nil
+	}
+	if heldErr, ok := err.(appliancedb.JobLeaseHeldError); ok {
+		return nil, zaperr.Errorw("cl-cert is already running",
+			"holder", heldErr.Holder, "expires", heldErr.ExpiresAt)
+	}
+
+	slog.Warnw("Failed to acquire job lease; using local lock",
+		"error", err)
+	if err = lock(lockPath); err != nil {
+		return nil, err
+	}
+	return func() { unlock(lockPath) }, nil
+}
+
 // setupWriteOps does all the boilerplate setup for when we want to interact
 // with the ACME server and write to the database.
 func setupWriteOps() (func(), *legoHandle, *lego.Config, appliancedb.DataStore) {
 	// Reprocess the environment, looking for more than just the DB vars
 	processEnv(false)
 
-	lockPath := "/tmp/cl-cert.lock"
-	if err := lock(lockPath); err != nil {
+	applianceDB, err := makeApplianceDB(environ.PostgresConnection)
+	if err != nil {
+		slog.Fatalw("failed to connect to DB", "error", err)
+	}
+
+	unlock, err := lockJob(context.Background(), applianceDB,
+		"/tmp/cl-cert.lock")
+	if err != nil {
 		slog.Fatalw("Failed to lock for cl-cert processing",
 			"error", err)
 	}
 
 	lh, config, err := legoSetup()
 	if err != nil {
-		unlock(lockPath)
+		unlock()
 		slog.Fatalw("Failed to setup lego", "error", err)
 	}
 
@@ -740,24 +786,18 @@ func setupWriteOps() (func(), *legoHandle, *lego.Config, appliancedb.DataStore)
 	}
 	hdl, err := getConfigClientHandle(uuid.Nil.String())
 	if err != nil {
-		unlock(lockPath)
+		unlock()
 		slog.Fatalw("failed to make config client", "error", err)
 	}
 	err = hdl.Ping(context.Background())
 	hdl.Close()
 	if err != nil {
-		unlock(lockPath)
+		unlock()
 		slog.Fatalw("failed to ping config client", "error", err)
 	}
 	slog.Info(checkMark + "Can connect to cl.configd")
 
-	applianceDB, err := makeApplianceDB(environ.PostgresConnection)
-	if err != nil {
-		unlock(lockPath)
-		slog.Fatalw("failed to connect to DB", "error", err)
-	}
-
-	return func() { unlock(lockPath) }, lh, config, applianceDB
+	return unlock, lh, config, applianceDB
 }
 
 func certDelete(cmd *cobra.Command, args []string) error {
@@ -813,8 +853,8 @@ func certDelete(cmd *cobra.Command, args []string) error {
 
 func certRenew(cmd *cobra.Command, args []string) error {
 	unlock, lh, config, applianceDB := setupWriteOps()
-	defer unlock()
 	defer applianceDB.Close()
+	defer unlock()
 
 	u, err := uuid.FromString(args[0])
 	if err != nil {
@@ -848,8 +888,8 @@ func certRenew(cmd *cobra.Command, args []string) error {
 func run(cmd *cobra.Command, args []string) error {
 	// XXX It'd be nice if we could do without the configd connection
 	unlock, lh, config, applianceDB := setupWriteOps()
-	defer unlock()
 	defer applianceDB.Close()
+	defer unlock()
 
 	// Get certs for any domains that seem to be missing them.
 	err := getMissingCerts(context.Background(), lh, applianceDB)
@@ -1202,6 +1242,18 @@ func main() {
 	}
 	rootCmd.AddCommand(statusCmd)
 
+	domainsCmd := &cobra.Command{
+		Use:     "domains [flags]",
+		Aliases: []string{"dom"},
+		Short:   "List domains, claimed or not, with their certificate state",
+		Args:    cobra.NoArgs,
+		RunE:    listDomains,
+	}
+	domainsCmd.Flags().Int("offset", 0, "skip this many domains")
+	domainsCmd.Flags().IntP("limit", "n", 100, "list at most this many domains")
+	domainsCmd.Flags().Bool("json", false, "emit JSON instead of a table")
+	rootCmd.AddCommand(domainsCmd)
+
 	extractCmd := &cobra.Command{
 		Use:     "extract [flags] fingerprint",
 		Aliases: []string{"cat"},
@@ -17,9 +17,11 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"math/big"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -225,6 +227,64 @@ func testPing(t *testing.T, ds appliancedb.DataStore, logger *zap.Logger, slogge
 	assert.NoError(err)
 }
 
+// unreachableDB can neither grant nor refuse job leases
+type unreachableDB struct {
+	appliancedb.DataStore
+}
+
+func (db unreachableDB) AcquireJobLease(ctx context.Context, job, holder string,
+	ttl time.Duration) (*appliancedb.JobLease, error) {
+
+	return nil, fmt.Errorf("connection refused")
+}
+
+func testLockJob(t *testing.T, ds appliancedb.DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "cl-cert_test.")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	lockPath := filepath.Join(dir, "cl-cert.lock")
+
+	// The lease is taken in the database, not with the lockfile
+	unlock, err := lockJob(ctx, ds, lockPath)
+	assert.NoError(err)
+	_, err = os.Lstat(lockPath)
+	assert.True(os.IsNotExist(err))
+	status, err := ds.JobLeaseStatus(ctx)
+	assert.NoError(err)
+	assert.Len(status, 1)
+	assert.Equal(certJobName, status[0].JobName)
+
+	// Another host can't run while we hold it
+	_, err = ds.AcquireJobLease(ctx, certJobName, "otherhost:1", time.Minute)
+	assert.IsType(appliancedb.JobLeaseHeldError{}, err)
+
+	unlock()
+	status, err = ds.JobLeaseStatus(ctx)
+	assert.NoError(err)
+	assert.Len(status, 0)
+
+	// And we can't run while another host holds it
+	_, err = ds.AcquireJobLease(ctx, certJobName, "otherhost:1", time.Minute)
+	assert.NoError(err)
+	_, err = lockJob(ctx, ds, lockPath)
+	assert.Error(err)
+	assert.NoError(ds.ReleaseJobLease(ctx, certJobName, "otherhost:1"))
+
+	// Without the database, fall back to the lockfile
+	unlock, err = lockJob(ctx, unreachableDB{ds}, lockPath)
+	assert.NoError(err)
+	_, err = os.Lstat(lockPath)
+	assert.NoError(err)
+	_, err = lockJob(ctx, unreachableDB{ds}, lockPath)
+	assert.Error(err)
+	unlock()
+	_, err = os.Lstat(lockPath)
+	assert.True(os.IsNotExist(err))
+}
+
 // errorBasedObtainer returns an obtainer that returns a cert or an error based
 // on the input maps of siteids to errors.
 func errorBasedObtainer(args ...interface{}) func(certificate.ObtainRequest) (*legoCert, error) {
@@ -699,6 +759,7 @@ func TestCertificateProcessing(t *testing.T) {
 		{"testRefillPool", testRefillPool},
 		{"testNewCertRateLimit", testNewCertRateLimit},
 		{"testCertRenewal", testCertRenewal},
+		{"testLockJob", testLockJob},
 	}
 
 	for _, tc := range testCases {
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"bg/cloud_models/appliancedb"
+
+	"github.com/spf13/cobra"
+	"github.com/tatsushid/go-prettytable"
+)
+
+// domainJSON is the form in which a domain's status is emitted with --json.
+// uuid.NullUUID doesn't marshal usefully, so the site UUID is flattened to a
+// string, omitted for unclaimed domains.
+type domainJSON struct {
+	Domain         string     `json:"domain"`
+	Jurisdiction   string     `json:"jurisdiction"`
+	SiteID         int32      `json:"siteid"`
+	Claimed        bool       `json:"claimed"`
+	SiteUUID       string     `json:"siteUUID,omitempty"`
+	HasCert        bool       `json:"hasCert"`
+	CertExpiration *time.Time `json:"certExpiration,omitempty"`
+	FailCount      int        `json:"failCount"`
+}
+
+// Describe the state of a domain's certificates
+func certState(d appliancedb.DomainStatus) string {
+	if d.HasCert {
+		return "valid"
+	} else if d.CertExpiration.Valid {
+		return "expired"
+	}
+	return "none"
+}
+
+func printDomains(w io.Writer, domains []appliancedb.DomainStatus, asJSON bool) error {
+	if asJSON {
+		out := make([]domainJSON, len(domains))
+		for i, d := range domains {
+			out[i] = domainJSON{
+				Domain:       d.Domain,
+				Jurisdiction: d.Jurisdiction,
+				SiteID:       d.SiteID,
+				Claimed:      d.Claimed,
+				HasCert:      d.HasCert,
+				FailCount:    d.FailCount,
+			}
+			if d.SiteUUID.Valid {
+				out[i].SiteUUID = d.SiteUUID.UUID.String()
+			}
+			if d.CertExpiration.Valid {
+				exp := d.CertExpiration.Time
+				out[i].CertExpiration = &exp
+			}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	}
+
+	table, _ := prettytable.NewTable(
+		prettytable.Column{Header: "Domain"},
+		prettytable.Column{Header: "Jurisdiction"},
+		prettytable.Column{Header: "SiteID", AlignRight: true},
+		prettytable.Column{Header: "Site UUID"},
+		prettytable.Column{Header: "Cert"},
+		prettytable.Column{Header: "Expiration"},
+		prettytable.Column{Header: "Failures", AlignRight: true},
+	)
+	table.Separator = " "
+
+	for _, d := range domains {
+		site := "unclaimed"
+		if d.Claimed {
+			site = d.SiteUUID.UUID.String()
+		}
+		var exp string
+		if d.CertExpiration.Valid {
+			exp = d.CertExpiration.Time.In(time.Local).
+				Round(time.Second).String()
+		}
+		table.AddRow(d.Domain, d.Jurisdiction, d.SiteID, site,
+			certState(d), exp, d.FailCount)
+	}
+	_, err := w.Write(table.Bytes())
+	return err
+}
+
+func listDomains(cmd *cobra.Command, args []string) error {
+	offset, _ := cmd.Flags().GetInt("offset")
+	limit, _ := cmd.Flags().GetInt("limit")
+	asJSON, _ := cmd.Flags().GetBool("json")
+	if offset < 0 || limit < 1 {
+		return fmt.Errorf("offset must be non-negative and limit positive")
+	}
+
+	db, err := makeApplianceDB(environ.PostgresConnection)
+	if err != nil {
+		slog.Fatalw("failed to connect to DB", "error", err)
+	}
+	defer db.Close()
+
+	domains, err := db.AllDomains(context.Background(), offset, limit)
+	if err != nil {
+		return err
+	}
+
+	if len(domains) == 0 && !asJSON {
+		slog.Warn("No domains found")
+		return nil
+	}
+	return printDomains(os.Stdout, domains, asJSON)
+}
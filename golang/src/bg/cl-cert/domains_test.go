@@ -0,0 +1,124 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"bg/cloud_models/appliancedb"
+
+	"github.com/guregu/null"
+	"github.com/satori/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func mkDomainStatus() []appliancedb.DomainStatus {
+	site := uuid.Must(uuid.FromString(site1Str))
+	exp := time.Date(2020, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	return []appliancedb.DomainStatus{
+		{
+			DecomposedDomain: appliancedb.DecomposedDomain{
+				Domain: "12777.brightgate.net", SiteID: 0},
+			Claimed:        true,
+			SiteUUID:       uuid.NullUUID{UUID: site, Valid: true},
+			HasCert:        true,
+			CertExpiration: null.TimeFrom(exp),
+		},
+		{
+			DecomposedDomain: appliancedb.DecomposedDomain{
+				Domain: "62984.brightgate.net", SiteID: 1},
+			CertExpiration: null.TimeFrom(exp.AddDate(0, -6, 0)),
+			FailCount:      3,
+		},
+		{
+			DecomposedDomain: appliancedb.DecomposedDomain{
+				Domain: "7321.uk.brightgate.net", SiteID: 5,
+				Jurisdiction: "uk"},
+			FailCount: 1,
+		},
+	}
+}
+
+func TestPrintDomainsTable(t *testing.T) {
+	assert := require.New(t)
+	domains := mkDomainStatus()
+
+	var buf bytes.Buffer
+	assert.NoError(printDomains(&buf, domains, false))
+	t.Logf("output:\n%s", buf.String())
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(lines, 1+len(domains))
+	assert.Equal([]string{"Domain", "Jurisdiction", "SiteID", "Site",
+		"UUID", "Cert", "Expiration", "Failures"},
+		strings.Fields(lines[0]))
+
+	// Claimed, with a valid cert
+	fields := strings.Fields(lines[1])
+	assert.Equal("12777.brightgate.net", fields[0])
+	assert.Equal(site1Str, fields[2])
+	assert.Equal("valid", fields[3])
+	assert.Contains(lines[1], domains[0].CertExpiration.Time.
+		In(time.Local).Round(time.Second).String())
+	assert.Equal("0", fields[len(fields)-1])
+
+	// Unclaimed, with only an expired cert
+	fields = strings.Fields(lines[2])
+	assert.Equal("62984.brightgate.net", fields[0])
+	assert.Equal("unclaimed", fields[2])
+	assert.Equal("expired", fields[3])
+	assert.Equal("3", fields[len(fields)-1])
+
+	// Unclaimed and certless; the jurisdiction appears
+	fields = strings.Fields(lines[3])
+	assert.Equal([]string{"7321.uk.brightgate.net", "uk", "5",
+		"unclaimed", "none", "1"}, fields)
+}
+
+func TestPrintDomainsJSON(t *testing.T) {
+	assert := require.New(t)
+	domains := mkDomainStatus()
+
+	var buf bytes.Buffer
+	assert.NoError(printDomains(&buf, domains, true))
+	t.Logf("output:\n%s", buf.String())
+
+	var out []map[string]interface{}
+	assert.NoError(json.Unmarshal(buf.Bytes(), &out))
+	assert.Len(out, len(domains))
+
+	assert.Equal("12777.brightgate.net", out[0]["domain"])
+	assert.Equal(true, out[0]["claimed"])
+	assert.Equal(site1Str, out[0]["siteUUID"])
+	assert.Equal(true, out[0]["hasCert"])
+	assert.Equal("2020-09-01T12:00:00Z", out[0]["certExpiration"])
+	assert.Equal(float64(0), out[0]["failCount"])
+
+	// Unclaimed domains have no site, and certless ones no expiration
+	assert.Equal(false, out[1]["claimed"])
+	assert.NotContains(out[1], "siteUUID")
+	assert.Equal(false, out[1]["hasCert"])
+	assert.Contains(out[1], "certExpiration")
+	assert.Equal(float64(3), out[1]["failCount"])
+
+	assert.Equal("uk", out[2]["jurisdiction"])
+	assert.Equal(float64(5), out[2]["siteid"])
+	assert.NotContains(out[2], "certExpiration")
+
+	// An empty list is still valid JSON
+	buf.Reset()
+	assert.NoError(printDomains(&buf, []appliancedb.DomainStatus{}, true))
+	assert.JSONEq("[]", buf.String())
+}
@@ -0,0 +1,312 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"bg/cloud_models/appliancedb"
+
+	"github.com/satori/uuid"
+	"github.com/spf13/cobra"
+	"github.com/tatsushid/go-prettytable"
+)
+
+// Roles held through a "support" relationship are conferred only by an
+// active support grant, and only while impersonating; see cl.httpd.
+const supportRelationship = "support"
+
+// siteAccess collects what the registry holds about an account's path to a
+// site.  roles come from AccountOrgRolesByAccount, the query behind the
+// cloud's authorization checks, so the verdict we derive from them matches
+// what cl.httpd would decide.  grants are the account's roles as stored,
+// which we need to explain roles the limit roles filter out.
+type siteAccess struct {
+	account      *appliancedb.Account
+	site         *appliancedb.CustomerSite
+	roles        []appliancedb.AccountOrgRoles
+	grants       []appliancedb.AccountOrgRole
+	supportGrant *appliancedb.SupportGrant
+}
+
+// filteredRoles returns the roles granted through the relationship described
+// by aor which are absent from its effective roles.
+func filteredRoles(aor appliancedb.AccountOrgRoles,
+	grants []appliancedb.AccountOrgRole) []string {
+	effective := make(map[string]bool)
+	for _, r := range aor.Roles {
+		effective[r] = true
+	}
+
+	filtered := make([]string, 0)
+	for _, g := range grants {
+		if g.TargetOrganizationUUID == aor.TargetOrganizationUUID &&
+			g.Relationship == aor.Relationship && !effective[g.Role] {
+			filtered = append(filtered, g.Role)
+		}
+	}
+	return filtered
+}
+
+func fmtRoles(roles []string) string {
+	return "[" + strings.Join(roles, " ") + "]"
+}
+
+// verdict explains whether the account can reach the site and, if it can't,
+// which link in the chain account -> relationship -> role -> limit roles is
+// missing for each way it might have reached the site's organization.
+func (a *siteAccess) verdict() string {
+	tgt := a.site.OrganizationUUID
+
+	var granted, support, denied []string
+	related := make(map[string]bool)
+	for _, aor := range a.roles {
+		if aor.TargetOrganizationUUID != tgt {
+			continue
+		}
+		related[aor.Relationship] = true
+
+		if aor.Relationship == supportRelationship {
+			if a.supportGrant != nil {
+				support = append(support, fmt.Sprintf(
+					"roles %s through the %s relationship "+
+						"to organization %s, under support "+
+						"grant %s (%s, expires %s)",
+					fmtRoles(aor.LimitRoles),
+					aor.Relationship, tgt,
+					a.supportGrant.UUID,
+					a.supportGrant.Scope,
+					a.supportGrant.ExpiresAt.Format(
+						time.RFC3339)))
+			} else {
+				denied = append(denied, fmt.Sprintf(
+					"the %s relationship to organization "+
+						"%s confers roles only under an "+
+						"active support grant, and there "+
+						"is none", aor.Relationship, tgt))
+			}
+			continue
+		}
+
+		if len(aor.Roles) > 0 {
+			granted = append(granted, fmt.Sprintf(
+				"roles %s through the %s relationship to "+
+					"organization %s", fmtRoles(aor.Roles),
+				aor.Relationship, tgt))
+		} else if f := filteredRoles(aor, a.grants); len(f) > 0 {
+			denied = append(denied, fmt.Sprintf(
+				"roles %s granted through the %s relationship "+
+					"to organization %s are not among its "+
+					"limit roles %s", fmtRoles(f),
+				aor.Relationship, tgt,
+				fmtRoles(aor.LimitRoles)))
+		} else {
+			denied = append(denied, fmt.Sprintf(
+				"the %s relationship to organization %s gives "+
+					"the account no roles", aor.Relationship,
+				tgt))
+		}
+	}
+
+	// A relationship without limit roles confers nothing, so the
+	// resolution query omits it; only the grants show that it exists.
+	var unlimited []string
+	unlimitedRoles := make(map[string][]string)
+	for _, g := range a.grants {
+		if g.TargetOrganizationUUID != tgt || related[g.Relationship] {
+			continue
+		}
+		if unlimitedRoles[g.Relationship] == nil {
+			unlimited = append(unlimited, g.Relationship)
+		}
+		unlimitedRoles[g.Relationship] = append(
+			unlimitedRoles[g.Relationship], g.Role)
+	}
+	for _, rel := range unlimited {
+		denied = append(denied, fmt.Sprintf(
+			"roles %s granted through the %s relationship to "+
+				"organization %s are filtered out, as it has "+
+				"no limit roles", fmtRoles(unlimitedRoles[rel]),
+			rel, tgt))
+	}
+
+	if len(granted) > 0 {
+		return "access granted: " + strings.Join(granted, "; ")
+	}
+	if len(support) > 0 {
+		return "access granted only in a support session: " +
+			strings.Join(support, "; ")
+	}
+	if len(denied) == 0 {
+		denied = append(denied, fmt.Sprintf(
+			"no relationship from organization %s to organization "+
+				"%s, which owns site %s",
+			a.account.OrganizationUUID, tgt, a.site.UUID))
+	}
+	return "access denied: " + strings.Join(denied, "; ")
+}
+
+// lookupAccount finds an account by UUID or, failing that, by email address.
+// As email addresses are only unique within an organization, every
+// organization is searched, and an address used in more than one is refused.
+func lookupAccount(ctx context.Context, db appliancedb.DataStore,
+	acct string) (*appliancedb.Account, error) {
+	if u, err := uuid.FromString(acct); err == nil {
+		return db.AccountByUUID(ctx, u)
+	}
+
+	orgs, err := db.AllOrganizations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var found []*appliancedb.Account
+	for _, org := range orgs {
+		a, err := db.AccountByEmail(ctx, org.UUID, acct)
+		if _, ok := err.(appliancedb.NotFoundError); ok {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		found = append(found, a)
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("no account with UUID or email %q", acct)
+	case 1:
+		return found[0], nil
+	}
+	uuids := make([]string, 0, len(found))
+	for _, a := range found {
+		uuids = append(uuids, a.UUID.String())
+	}
+	return nil, fmt.Errorf("%q is the email of several accounts; use one "+
+		"of %s", acct, strings.Join(uuids, ", "))
+}
+
+func orgName(ctx context.Context, db appliancedb.DataStore,
+	org uuid.UUID) string {
+	o, err := db.OrganizationByUUID(ctx, org)
+	if err != nil {
+		return "?"
+	}
+	return o.Name
+}
+
+func accessAccount(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	siteStr, _ := cmd.Flags().GetString("site")
+
+	db, _, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	access := &siteAccess{}
+	if siteStr != "" {
+		siteUUID, err := uuid.FromString(siteStr)
+		if err != nil {
+			return fmt.Errorf("bad site UUID %q: %v", siteStr, err)
+		}
+		if access.site, err = db.CustomerSiteByUUID(ctx, siteUUID); err != nil {
+			return err
+		}
+	}
+
+	if access.account, err = lookupAccount(ctx, db, args[0]); err != nil {
+		return err
+	}
+	acct := access.account
+	access.roles, err = db.AccountOrgRolesByAccount(ctx, acct.UUID)
+	if err != nil {
+		return err
+	}
+	access.grants, err = db.AccountOrgRoleGrantsByAccount(ctx, acct.UUID)
+	if err != nil {
+		return err
+	}
+
+	table, _ := prettytable.NewTable(
+		prettytable.Column{Header: "KEY"},
+		prettytable.Column{Header: "VALUE"},
+	)
+	table.Separator = "  "
+	table.AddRow("Account.UUID", acct.UUID)
+	table.AddRow("Account.Email", acct.Email)
+	table.AddRow("Organization.UUID", acct.OrganizationUUID)
+	table.AddRow("Organization.Name", orgName(ctx, db, acct.OrganizationUUID))
+	table.Print()
+	fmt.Println()
+
+	table, _ = prettytable.NewTable(
+		prettytable.Column{Header: "TargetOrganization"},
+		prettytable.Column{Header: "Name"},
+		prettytable.Column{Header: "Relationship"},
+		prettytable.Column{Header: "LimitRoles"},
+		prettytable.Column{Header: "Roles"},
+		prettytable.Column{Header: "FilteredRoles"},
+	)
+	table.Separator = "  "
+	targets := make([]uuid.UUID, 0)
+	seen := make(map[uuid.UUID]bool)
+	for _, aor := range access.roles {
+		tgt := aor.TargetOrganizationUUID
+		table.AddRow(tgt, orgName(ctx, db, tgt), aor.Relationship,
+			strings.Join(aor.LimitRoles, ","),
+			strings.Join(aor.Roles, ","),
+			strings.Join(filteredRoles(aor, access.grants), ","))
+		if !seen[tgt] {
+			seen[tgt] = true
+			targets = append(targets, tgt)
+		}
+	}
+	table.Print()
+	fmt.Println()
+
+	table, _ = prettytable.NewTable(
+		prettytable.Column{Header: "TargetOrganization"},
+		prettytable.Column{Header: "Site"},
+		prettytable.Column{Header: "Name"},
+	)
+	table.Separator = "  "
+	for _, tgt := range targets {
+		sites, err := db.CustomerSitesByOrganization(ctx, tgt)
+		if err != nil {
+			return err
+		}
+		for _, s := range sites {
+			table.AddRow(tgt, s.UUID, s.Name)
+		}
+	}
+	table.Print()
+
+	if access.site == nil {
+		return nil
+	}
+	for _, aor := range access.roles {
+		if aor.TargetOrganizationUUID == access.site.OrganizationUUID &&
+			aor.Relationship == supportRelationship {
+			g, err := db.ActiveSupportGrant(ctx,
+				access.site.OrganizationUUID)
+			if _, ok := err.(appliancedb.NotFoundError); !ok && err != nil {
+				return err
+			}
+			access.supportGrant = g
+			break
+		}
+	}
+	fmt.Printf("\nSite %s (%s): %s\n", access.site.UUID, access.site.Name,
+		access.verdict())
+	return nil
+}
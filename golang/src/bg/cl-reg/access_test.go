@@ -0,0 +1,226 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"bg/cloud_models/appliancedb"
+
+	"github.com/satori/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// An MSP organization managing a customer organization, along the lines of
+// the fixtures in appliancedb.
+var (
+	testMSPOrg  = uuid.Must(uuid.FromString("30000000-3000-3000-3000-100000000001"))
+	testCustOrg = uuid.Must(uuid.FromString("30000000-3000-3000-3000-000000000001"))
+
+	testMSPAccount = appliancedb.Account{
+		UUID:             uuid.Must(uuid.FromString("50000000-5000-5000-5000-100000000001")),
+		Email:            "manager@msp.net",
+		OrganizationUUID: testMSPOrg,
+	}
+	testCustSite = appliancedb.CustomerSite{
+		UUID:             uuid.Must(uuid.FromString("10000000-1000-1000-1000-000000000001")),
+		OrganizationUUID: testCustOrg,
+		Name:             "site1",
+	}
+
+	allLimitRoles = []string{"admin", "user"}
+)
+
+// mspRoles returns the resolved roles of testMSPAccount for a relationship
+func mspRoles(tgt uuid.UUID, rel string, limit, roles []string) appliancedb.AccountOrgRoles {
+	return appliancedb.AccountOrgRoles{
+		AccountUUID:            testMSPAccount.UUID,
+		OrganizationUUID:       testMSPOrg,
+		TargetOrganizationUUID: tgt,
+		Relationship:           rel,
+		LimitRoles:             limit,
+		Roles:                  roles,
+	}
+}
+
+// mspGrant returns a role of testMSPAccount as it is stored
+func mspGrant(tgt uuid.UUID, rel, role string) appliancedb.AccountOrgRole {
+	return appliancedb.AccountOrgRole{
+		AccountUUID:            testMSPAccount.UUID,
+		OrganizationUUID:       testMSPOrg,
+		TargetOrganizationUUID: tgt,
+		Relationship:           rel,
+		Role:                   role,
+	}
+}
+
+func TestSiteAccessVerdict(t *testing.T) {
+	self := mspRoles(testMSPOrg, "self", allLimitRoles, []string{"admin"})
+	selfGrant := mspGrant(testMSPOrg, "self", "admin")
+	grant := &appliancedb.SupportGrant{
+		UUID:             uuid.Must(uuid.FromString("70000000-7000-7000-7000-000000000001")),
+		OrganizationUUID: testCustOrg,
+		Scope:            "read-only",
+		ExpiresAt:        time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+
+	testCases := []struct {
+		desc         string
+		roles        []appliancedb.AccountOrgRoles
+		grants       []appliancedb.AccountOrgRole
+		supportGrant *appliancedb.SupportGrant
+		exp          string
+	}{
+		{
+			desc: "msp admin",
+			roles: []appliancedb.AccountOrgRoles{self,
+				mspRoles(testCustOrg, "msp", allLimitRoles,
+					[]string{"admin", "user"})},
+			grants: []appliancedb.AccountOrgRole{selfGrant,
+				mspGrant(testCustOrg, "msp", "admin"),
+				mspGrant(testCustOrg, "msp", "user")},
+			exp: "access granted: roles [admin user] through the " +
+				"msp relationship to organization " +
+				"30000000-3000-3000-3000-000000000001",
+		},
+		{
+			desc:   "no relationship",
+			roles:  []appliancedb.AccountOrgRoles{self},
+			grants: []appliancedb.AccountOrgRole{selfGrant},
+			exp: "access denied: no relationship from organization " +
+				"30000000-3000-3000-3000-100000000001 to " +
+				"organization 30000000-3000-3000-3000-000000000001, " +
+				"which owns site 10000000-1000-1000-1000-000000000001",
+		},
+		{
+			desc: "relationship but no role",
+			roles: []appliancedb.AccountOrgRoles{self,
+				mspRoles(testCustOrg, "msp", allLimitRoles,
+					[]string{})},
+			grants: []appliancedb.AccountOrgRole{selfGrant},
+			exp: "access denied: the msp relationship to " +
+				"organization 30000000-3000-3000-3000-000000000001 " +
+				"gives the account no roles",
+		},
+		{
+			desc: "role filtered by limit roles",
+			roles: []appliancedb.AccountOrgRoles{self,
+				mspRoles(testCustOrg, "msp", []string{"user"},
+					[]string{})},
+			grants: []appliancedb.AccountOrgRole{selfGrant,
+				mspGrant(testCustOrg, "msp", "admin")},
+			exp: "access denied: roles [admin] granted through the " +
+				"msp relationship to organization " +
+				"30000000-3000-3000-3000-000000000001 are not " +
+				"among its limit roles [user]",
+		},
+		{
+			desc:  "relationship without limit roles",
+			roles: []appliancedb.AccountOrgRoles{self},
+			grants: []appliancedb.AccountOrgRole{selfGrant,
+				mspGrant(testCustOrg, "msp", "admin"),
+				mspGrant(testCustOrg, "msp", "user")},
+			exp: "access denied: roles [admin user] granted through " +
+				"the msp relationship to organization " +
+				"30000000-3000-3000-3000-000000000001 are " +
+				"filtered out, as it has no limit roles",
+		},
+		{
+			desc: "support without a grant",
+			roles: []appliancedb.AccountOrgRoles{self,
+				mspRoles(testCustOrg, "support", allLimitRoles,
+					[]string{})},
+			grants: []appliancedb.AccountOrgRole{selfGrant},
+			exp: "access denied: the support relationship to " +
+				"organization 30000000-3000-3000-3000-000000000001 " +
+				"confers roles only under an active support " +
+				"grant, and there is none",
+		},
+		{
+			desc: "support with a grant",
+			roles: []appliancedb.AccountOrgRoles{self,
+				mspRoles(testCustOrg, "support", allLimitRoles,
+					[]string{})},
+			grants:       []appliancedb.AccountOrgRole{selfGrant},
+			supportGrant: grant,
+			exp: "access granted only in a support session: roles " +
+				"[admin user] through the support relationship " +
+				"to organization 30000000-3000-3000-3000-000000000001, " +
+				"under support grant " +
+				"70000000-7000-7000-7000-000000000001 (read-only, " +
+				"expires 2020-06-01T12:00:00Z)",
+		},
+		{
+			desc: "msp role and support",
+			roles: []appliancedb.AccountOrgRoles{self,
+				mspRoles(testCustOrg, "msp", allLimitRoles,
+					[]string{"user"}),
+				mspRoles(testCustOrg, "support", allLimitRoles,
+					[]string{})},
+			grants: []appliancedb.AccountOrgRole{selfGrant,
+				mspGrant(testCustOrg, "msp", "user")},
+			exp: "access granted: roles [user] through the msp " +
+				"relationship to organization " +
+				"30000000-3000-3000-3000-000000000001",
+		},
+		{
+			desc: "every link missing",
+			roles: []appliancedb.AccountOrgRoles{self,
+				mspRoles(testCustOrg, "msp", []string{"user"},
+					[]string{}),
+				mspRoles(testCustOrg, "support", allLimitRoles,
+					[]string{})},
+			grants: []appliancedb.AccountOrgRole{selfGrant,
+				mspGrant(testCustOrg, "msp", "admin")},
+			exp: "access denied: roles [admin] granted through the " +
+				"msp relationship to organization " +
+				"30000000-3000-3000-3000-000000000001 are not " +
+				"among its limit roles [user]; the support " +
+				"relationship to organization " +
+				"30000000-3000-3000-3000-000000000001 confers " +
+				"roles only under an active support grant, and " +
+				"there is none",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			a := &siteAccess{
+				account:      &testMSPAccount,
+				site:         &testCustSite,
+				roles:        tc.roles,
+				grants:       tc.grants,
+				supportGrant: tc.supportGrant,
+			}
+			require.Equal(t, tc.exp, a.verdict())
+		})
+	}
+}
+
+func TestFilteredRoles(t *testing.T) {
+	assert := require.New(t)
+
+	grants := []appliancedb.AccountOrgRole{
+		mspGrant(testMSPOrg, "self", "user"),
+		mspGrant(testCustOrg, "msp", "admin"),
+		mspGrant(testCustOrg, "msp", "user"),
+		mspGrant(testCustOrg, "support", "admin"),
+	}
+	aor := mspRoles(testCustOrg, "msp", []string{"user"}, []string{"user"})
+	assert.Equal([]string{"admin"}, filteredRoles(aor, grants))
+
+	aor = mspRoles(testCustOrg, "msp", allLimitRoles,
+		[]string{"admin", "user"})
+	assert.Empty(filteredRoles(aor, grants))
+
+	aor = mspRoles(testMSPOrg, "self", allLimitRoles, []string{"user"})
+	assert.Empty(filteredRoles(aor, grants))
+}
@@ -93,6 +93,7 @@ func infoAccount(cmd *cobra.Command, args []string) error {
 	table.AddRow("UUID", ai.Account.UUID)
 	table.AddRow("Email", ai.Account.Email)
 	table.AddRow("Phone", ai.Account.PhoneNumber)
+	table.AddRow("Locale", ai.Account.Locale)
 	table.AddRow("Organization.UUID", ai.Organization.UUID)
 	table.AddRow("Organization.Name", ai.Organization.Name)
 	table.AddRow("Person.UUID", ai.Person.UUID)
@@ -108,6 +109,35 @@ func infoAccount(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+func updateAccount(cmd *cobra.Command, args []string) error {
+	acctUUID, err := uuid.FromString(args[0])
+	if err != nil {
+		return err
+	}
+	if !cmd.Flags().Changed("locale") {
+		return fmt.Errorf("Must specify a field to update")
+	}
+	locale, _ := cmd.Flags().GetString("locale")
+
+	ctx := context.Background()
+	db, _, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	acct, err := db.AccountByUUID(ctx, acctUUID)
+	if err != nil {
+		return err
+	}
+	acct.Locale = locale
+	if err = db.UpdateAccount(ctx, acct); err != nil {
+		return err
+	}
+	fmt.Printf("Updated account %s: locale %s\n", acct.UUID, acct.Locale)
+	return nil
+}
+
 func delAccount(cmd *cobra.Command, args []string) error {
 	if environ.ConfigdConnection == "" {
 		return fmt.Errorf("Must set B10E_CLREG_CLCONFIGD_CONNECTION")
@@ -137,6 +167,58 @@ func deprovisionAccount(cmd *cobra.Command, args []string) error {
 	return registry.AccountDeprovision(ctx, db, getConfig, acctUUID)
 }
 
+func normalizeAccounts(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	db, _, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	report, err := db.NormalizeExistingAccounts(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Normalized %d values:\n", len(report.Changed))
+	if len(report.Changed) > 0 {
+		table, _ := prettytable.NewTable(
+			prettytable.Column{Header: "Table"},
+			prettytable.Column{Header: "UUID"},
+			prettytable.Column{Header: "Field"},
+			prettytable.Column{Header: "Old"},
+			prettytable.Column{Header: "New"},
+		)
+		for _, row := range report.Changed {
+			table.AddRow(row.Table, row.UUID, row.Field,
+				fmt.Sprintf("%q", row.Old), row.New)
+		}
+		printPrefixedTable(table, "  ")
+	}
+
+	if len(report.Unparseable) > 0 {
+		fmt.Printf("Could not normalize %d values; fix these by hand:\n",
+			len(report.Unparseable))
+		table, _ := prettytable.NewTable(
+			prettytable.Column{Header: "Table"},
+			prettytable.Column{Header: "UUID"},
+			prettytable.Column{Header: "Field"},
+			prettytable.Column{Header: "Value"},
+			prettytable.Column{Header: "Problem"},
+		)
+		for _, row := range report.Unparseable {
+			reason := row.Err.Error()
+			if verr, ok := row.Err.(appliancedb.ValidationError); ok {
+				reason = verr.Reason
+			}
+			table.AddRow(row.Table, row.UUID, row.Field,
+				fmt.Sprintf("%q", row.Old), reason)
+		}
+		printPrefixedTable(table, "  ")
+	}
+	return nil
+}
+
 func listAccountRoles(cmd *cobra.Command, args []string) error {
 	acctUUID := uuid.Must(uuid.FromString(args[0]))
 	ctx := context.Background()
@@ -369,6 +451,18 @@ func accountMain(rootCmd *cobra.Command) {
 	infoAccountCmd.Flags().StringP("input", "i", "", "registry data JSON file")
 	accountCmd.AddCommand(infoAccountCmd)
 
+	updateAccountCmd := &cobra.Command{
+		Use:   "update --locale <locale> <account-uuid>",
+		Args:  cobra.ExactArgs(1),
+		Short: "Update an account in the registry",
+		RunE:  updateAccount,
+	}
+	updateAccountCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	updateAccountCmd.Flags().String("locale", "",
+		fmt.Sprintf("locale for notifications; one of %s",
+			strings.Join(appliancedb.SupportedLocales, ", ")))
+	accountCmd.AddCommand(updateAccountCmd)
+
 	deprovisionAccountCmd := &cobra.Command{
 		Use:   "deprovision <account-uuid>",
 		Args:  cobra.ExactArgs(1),
@@ -398,6 +492,25 @@ func accountMain(rootCmd *cobra.Command) {
 	syncAccountCmd.Flags().BoolP("all", "a", false, "sync accounts for all orgs to all sites")
 	accountCmd.AddCommand(syncAccountCmd)
 
+	normalizeAccountCmd := &cobra.Command{
+		Use:   "normalize",
+		Args:  cobra.NoArgs,
+		Short: "Normalize the email addresses and phone numbers of existing accounts",
+		RunE:  normalizeAccounts,
+	}
+	normalizeAccountCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	accountCmd.AddCommand(normalizeAccountCmd)
+
+	accessAccountCmd := &cobra.Command{
+		Use:   "access [--site site-uuid] <account-uuid|email>",
+		Args:  cobra.ExactArgs(1),
+		Short: "Show the organizations and sites an account can reach, and why",
+		RunE:  accessAccount,
+	}
+	accessAccountCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	accessAccountCmd.Flags().StringP("site", "s", "", "explain the account's access to this site")
+	accountCmd.AddCommand(accessAccountCmd)
+
 	roleAccountCmd := &cobra.Command{
 		Use:   "role <subcmd> [flags] [args]",
 		Args:  cobra.NoArgs,
@@ -15,6 +15,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 
 	"bg/cl_common/registry"
 	"bg/cloud_models/appliancedb"
@@ -27,6 +28,7 @@ import (
 
 func listAppliances(cmd *cobra.Command, args []string) error {
 	appID, _ := cmd.Flags().GetString("name")
+	lifecycle, _ := cmd.Flags().GetString("lifecycle")
 	orgs, _ := cmd.Flags().GetStringSlice("org")
 	sites, _ := cmd.Flags().GetStringSlice("site")
 
@@ -99,7 +101,8 @@ func listAppliances(cmd *cobra.Command, args []string) error {
 		if (reg.Project == "" || reg.Project == app.GCPProject) &&
 			(reg.Region == "" || reg.Region == app.GCPRegion) &&
 			(reg.Registry == "" || reg.Registry == app.ApplianceReg) &&
-			(appID == "" || appID == app.ApplianceRegID) {
+			(appID == "" || appID == app.ApplianceRegID) &&
+			(lifecycle == "" || lifecycle == app.LifecycleState) {
 			matchingApps = append(matchingApps, app)
 		}
 	}
@@ -108,6 +111,11 @@ func listAppliances(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
+	noteCounts, err := db.ApplianceNoteCounts(ctx)
+	if err != nil {
+		return err
+	}
+
 	table, _ := prettytable.NewTable(
 		prettytable.Column{Header: "UUID"},
 		prettytable.Column{Header: "Site"},
@@ -115,13 +123,16 @@ func listAppliances(cmd *cobra.Command, args []string) error {
 		prettytable.Column{Header: "Region"},
 		prettytable.Column{Header: "Registry"},
 		prettytable.Column{Header: "Appliance Name"},
+		prettytable.Column{Header: "Lifecycle"},
+		prettytable.Column{Header: "Notes", AlignRight: true},
 	)
 	table.Separator = "  "
 
 	for _, app := range matchingApps {
 		table.AddRow(app.ApplianceUUID, app.SiteUUID,
 			app.GCPProject, app.GCPRegion,
-			app.ApplianceReg, app.ApplianceRegID)
+			app.ApplianceReg, app.ApplianceRegID,
+			app.LifecycleState, noteCounts[app.ApplianceUUID])
 	}
 	table.Print()
 	return nil
@@ -257,6 +268,7 @@ func setApp(cmd *cobra.Command, args []string) error {
 	defer db.Close()
 
 	siteUUID, _ := cmd.Flags().GetString("site-uuid")
+	lifecycle, _ := cmd.Flags().GetString("lifecycle")
 
 	var siteUU *uuid.UUID
 	if siteUUID != "" {
@@ -270,6 +282,16 @@ func setApp(cmd *cobra.Command, args []string) error {
 
 	uu := args[0]
 	appUUID := uuid.Must(uuid.FromString(uu))
+
+	// The lifecycle state is changed on its own, bumping the version, so
+	// do that before fetching the appliance for the rest of the update.
+	if lifecycle != "" {
+		err = db.SetApplianceLifecycle(ctx, appUUID, lifecycle)
+		if err != nil {
+			return err
+		}
+	}
+
 	app, err := db.ApplianceIDByUUID(ctx, appUUID)
 	if err != nil {
 		return err
@@ -286,6 +308,59 @@ func setApp(cmd *cobra.Command, args []string) error {
 	return err
 }
 
+// The number of notes shown by 'app show'
+const showAppNotes = 5
+
+func showApp(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	appUUID, err := uuid.FromString(args[0])
+	if err != nil {
+		return err
+	}
+
+	db, _, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	app, err := db.ApplianceIDByUUID(ctx, appUUID)
+	if err != nil {
+		return err
+	}
+	notes, err := db.ListNotes(ctx,
+		appliancedb.ApplianceNoteSubject(appUUID), false)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Appliance %s\n", app.ApplianceUUID)
+	fmt.Printf("  Name:       %s\n", app.ApplianceRegID)
+	fmt.Printf("  Site:       %s\n", app.SiteUUID)
+	fmt.Printf("  Project:    %s\n", app.GCPProject)
+	fmt.Printf("  Region:     %s\n", app.GCPRegion)
+	fmt.Printf("  Registry:   %s\n", app.ApplianceReg)
+	fmt.Printf("  HW Serial:  %s\n", app.SystemReprHWSerial.String)
+	fmt.Printf("  MAC:        %s\n", app.SystemReprMAC.String)
+	fmt.Printf("  Lifecycle:  %s\n", app.LifecycleState)
+	fmt.Printf("  Updated:    %s (version %d)\n",
+		app.UpdatedAt.In(time.Local).Format(timeLayout), app.Version)
+
+	if len(notes) == 0 {
+		fmt.Printf("\nNo notes.\n")
+		return nil
+	}
+	if len(notes) > showAppNotes {
+		fmt.Printf("\nNotes (%d most recent of %d):\n", showAppNotes,
+			len(notes))
+		notes = notes[:showAppNotes]
+	} else {
+		fmt.Printf("\nNotes:\n")
+	}
+	printNotes(notes, "  ")
+	return nil
+}
+
 func appMain(rootCmd *cobra.Command) {
 	appCmd := &cobra.Command{
 		Use:   "app <subcmd> [flags] [args]",
@@ -323,6 +398,7 @@ func appMain(rootCmd *cobra.Command) {
 	listAppCmd.Flags().StringP("region", "R", "", "GCP region")
 	listAppCmd.Flags().StringP("registry", "r", "", "appliance registry")
 	listAppCmd.Flags().StringP("name", "n", "", "appliance name")
+	listAppCmd.Flags().StringP("lifecycle", "l", "", "only list appliances in this lifecycle state (active, rma-requested, retired)")
 	listAppCmd.Flags().StringP("input", "i", "", "registry data JSON file")
 	listAppCmd.Flags().StringSliceP("org", "o", []string{}, "list appliances belonging to these orgs")
 	listAppCmd.Flags().StringSliceP("site", "s", []string{}, "list appliances at these sites")
@@ -336,6 +412,37 @@ func appMain(rootCmd *cobra.Command) {
 	}
 	setAppCmd.Flags().StringP("input", "i", "", "registry data JSON file")
 	setAppCmd.Flags().StringP("site-uuid", "s", "", "site UUID")
+	setAppCmd.Flags().StringP("lifecycle", "l", "", "lifecycle state (active, rma-requested, retired)")
 	appCmd.AddCommand(setAppCmd)
+
+	showAppCmd := &cobra.Command{
+		Use:   "show [flags] <uuid>",
+		Args:  cobra.ExactArgs(1),
+		Short: "Show an appliance and its most recent notes",
+		RunE:  showApp,
+	}
+	showAppCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	appCmd.AddCommand(showAppCmd)
+
+	preregAppCmd := &cobra.Command{
+		Use:   "preregister [flags] --manifest <file>",
+		Args:  cobra.NoArgs,
+		Short: "Create appliances at the null site from a manufacturing manifest of serial numbers and MAC addresses",
+		RunE:  preregApps,
+	}
+	preregAppCmd.Flags().StringP("manifest", "m", "", "CSV manifest of (serial, MAC[, notes]) rows")
+	preregAppCmd.Flags().StringP("org", "o", "", "UUID of the organization the appliances are destined for")
+	preregAppCmd.Flags().BoolP("dry-run", "n", false, "check the manifest without creating anything")
+	preregAppCmd.Flags().String("results", "", "results file (default <manifest>.results.json)")
+	preregAppCmd.Flags().StringP("directory", "d", "", "output directory for cloud secrets")
+	preregAppCmd.Flags().BoolP("no-escrow", "", false, "don't escrow the private keys in Vault")
+	preregAppCmd.Flags().StringP("author", "a", "", "author of the appliance notes")
+	preregAppCmd.Flags().StringP("project", "p", "", "GCP project")
+	preregAppCmd.Flags().StringP("region", "R", "", "GCP region")
+	preregAppCmd.Flags().StringP("registry", "r", "", "appliance registry")
+	preregAppCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	appCmd.AddCommand(preregAppCmd)
+
+	appCmd.AddCommand(noteCmd("appliance", appliancedb.ApplianceNoteSubject))
 }
 
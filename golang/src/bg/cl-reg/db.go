@@ -0,0 +1,263 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"bg/cloud_models/appliancedb"
+
+	"github.com/spf13/cobra"
+	"github.com/tatsushid/go-prettytable"
+)
+
+// Format a size in bytes using binary units
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+func newHealthTable(cols ...prettytable.Column) *prettytable.Table {
+	table, _ := prettytable.NewTable(cols...)
+	table.Separator = "  "
+	return table
+}
+
+func printHealth(r *appliancedb.DatabaseHealthReport, top int) {
+	fmt.Printf("Database health at %s: %s\n",
+		r.GeneratedAt.In(time.Local).Format(timeLayout), r.Severity())
+
+	// The largest tables and indexes are always listed, along with any
+	// others which have a problem.
+	fmt.Printf("\nTables:\n")
+	table := newHealthTable(
+		prettytable.Column{Header: "Table"},
+		prettytable.Column{Header: "Total", AlignRight: true},
+		prettytable.Column{Header: "Indexes", AlignRight: true},
+		prettytable.Column{Header: "Live", AlignRight: true},
+		prettytable.Column{Header: "Dead", AlignRight: true},
+		prettytable.Column{Header: "Dead%", AlignRight: true},
+		prettytable.Column{Header: "LastVacuum"},
+		prettytable.Column{Header: "Severity"},
+	)
+	for i, t := range r.Tables {
+		if i >= top && t.Severity == appliancedb.HealthOK {
+			continue
+		}
+		vacuum := "-"
+		if t.LastVacuum.Valid {
+			vacuum = t.LastVacuum.Time.In(time.Local).Format(timeLayout)
+		}
+		table.AddRow(t.Table, formatBytes(t.TotalBytes),
+			formatBytes(t.IndexBytes), t.LiveTuples, t.DeadTuples,
+			fmt.Sprintf("%.1f", 100*t.DeadRatio), vacuum, t.Severity)
+	}
+	table.Print()
+
+	fmt.Printf("\nIndexes:\n")
+	table = newHealthTable(
+		prettytable.Column{Header: "Index"},
+		prettytable.Column{Header: "Table"},
+		prettytable.Column{Header: "Size", AlignRight: true},
+		prettytable.Column{Header: "Scans", AlignRight: true},
+		prettytable.Column{Header: "Severity"},
+	)
+	for i, x := range r.Indexes {
+		if i >= top && x.Severity == appliancedb.HealthOK {
+			continue
+		}
+		table.AddRow(x.Index, x.Table, formatBytes(x.Bytes), x.Scans,
+			x.Severity)
+	}
+	table.Print()
+
+	fmt.Printf("\nSequences:\n")
+	table = newHealthTable(
+		prettytable.Column{Header: "Sequence"},
+		prettytable.Column{Header: "OwnedBy"},
+		prettytable.Column{Header: "LastValue", AlignRight: true},
+		prettytable.Column{Header: "MaxValue", AlignRight: true},
+		prettytable.Column{Header: "Used%", AlignRight: true},
+		prettytable.Column{Header: "Severity"},
+	)
+	for _, s := range r.Sequences {
+		last := "-"
+		if s.LastValue.Valid {
+			last = fmt.Sprintf("%d", s.LastValue.Int64)
+		}
+		table.AddRow(s.Sequence, s.OwnedBy.ValueOrZero(), last, s.MaxValue,
+			fmt.Sprintf("%.2f", 100*s.UsedRatio), s.Severity)
+	}
+	table.Print()
+
+	fmt.Printf("\nMissing indexes:\n")
+	if len(r.MissingIndexes) == 0 {
+		fmt.Printf("  none\n")
+	} else {
+		table = newHealthTable(
+			prettytable.Column{Header: "Index"},
+			prettytable.Column{Header: "Table"},
+			prettytable.Column{Header: "Columns"},
+			prettytable.Column{Header: "Needed for"},
+			prettytable.Column{Header: "Severity"},
+		)
+		for _, m := range r.MissingIndexes {
+			table.AddRow(m.Name, m.Table, strings.Join(m.Columns, ", "),
+				m.Reason, m.Severity)
+		}
+		table.Print()
+	}
+
+	fmt.Printf("\nLong-running transactions:\n")
+	if len(r.LongTransactions) == 0 {
+		fmt.Printf("  none\n")
+	} else {
+		table = newHealthTable(
+			prettytable.Column{Header: "PID", AlignRight: true},
+			prettytable.Column{Header: "User"},
+			prettytable.Column{Header: "Application"},
+			prettytable.Column{Header: "State"},
+			prettytable.Column{Header: "Age"},
+			prettytable.Column{Header: "Severity"},
+			prettytable.Column{Header: "Query"},
+		)
+		for _, l := range r.LongTransactions {
+			age := time.Duration(l.AgeSeconds) * time.Second
+			table.AddRow(l.PID, l.User.ValueOrZero(), l.Application,
+				l.State.ValueOrZero(), age, l.Severity, l.Query)
+		}
+		table.Print()
+	}
+}
+
+func dbHealth(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	format, _ := cmd.Flags().GetString("format")
+	if format != "table" && format != "json" {
+		return fmt.Errorf("unknown format '%s'", format)
+	}
+	top, _ := cmd.Flags().GetInt("top")
+
+	db, _, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	r, err := db.DatabaseHealth(ctx)
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Severity string `json:"severity"`
+			*appliancedb.DatabaseHealthReport
+		}{r.Severity(), r})
+	}
+	printHealth(r, top)
+	return nil
+}
+
+func dbBootstrap(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	verify, _ := cmd.Flags().GetBool("verify")
+
+	db, _, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var findings []appliancedb.BootstrapFinding
+	if verify {
+		findings, err = db.VerifyBootstrap(ctx)
+	} else {
+		findings, err = db.Bootstrap(ctx,
+			appliancedb.BootstrapOpts{DryRun: dryRun})
+	}
+	for _, f := range findings {
+		fmt.Printf("%s\n", f)
+	}
+	if err != nil {
+		return err
+	}
+
+	if verify && len(findings) > 0 {
+		return fmt.Errorf("%d problems with the seed data", len(findings))
+	} else if len(findings) == 0 {
+		fmt.Printf("Seed data is intact\n")
+	}
+	return nil
+}
+
+func dbMain(rootCmd *cobra.Command) {
+	dbCmd := &cobra.Command{
+		Use:   "db <subcmd> [flags] [args]",
+		Short: "Examine and maintain the registry database itself",
+		Args:  cobra.NoArgs,
+	}
+	rootCmd.AddCommand(dbCmd)
+
+	healthCmd := &cobra.Command{
+		Use:   "health [flags]",
+		Args:  cobra.NoArgs,
+		Short: "Report on the health of the registry database",
+		Long: "Report on the health of the registry database: the size " +
+			"and bloat of its tables and indexes, sequences " +
+			"approaching their limits, missing indexes, and " +
+			"long-running transactions.  Each finding is rated ok, " +
+			"warning, or critical.",
+		RunE: dbHealth,
+	}
+	healthCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	healthCmd.Flags().StringP("format", "f", "table",
+		"output format (table|json)")
+	healthCmd.Flags().Int("top", 20,
+		"number of the largest tables and indexes to list")
+	dbCmd.AddCommand(healthCmd)
+
+	bootstrapCmd := &cobra.Command{
+		Use:   "bootstrap [flags]",
+		Args:  cobra.NoArgs,
+		Short: "Create the seed data a new registry needs",
+		Long: "Create any of the seed data which every registry needs " +
+			"that is missing: the sentinel organization and site, " +
+			"the relationship and role limits, and so on.  Existing " +
+			"seed data is verified rather than recreated, so it is " +
+			"safe to run repeatedly; if any sentinel has been " +
+			"altered, nothing is changed.",
+		RunE: dbBootstrap,
+	}
+	bootstrapCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	bootstrapCmd.Flags().BoolP("dry-run", "n", false,
+		"report the seed data which would be created")
+	bootstrapCmd.Flags().Bool("verify", false,
+		"only check the seed data, and fail if any is missing or altered")
+	dbCmd.AddCommand(bootstrapCmd)
+}
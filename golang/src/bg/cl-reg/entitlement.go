@@ -0,0 +1,261 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"bg/cloud_models/appliancedb"
+
+	"github.com/satori/uuid"
+	"github.com/spf13/cobra"
+	"github.com/tatsushid/go-prettytable"
+)
+
+const contractDateFormat = "2006-01-02"
+
+// Parse a number of days, given either as a bare number or with a 'd' suffix
+func parseDays(s string) (int, error) {
+	days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+	if err != nil || days < 0 {
+		return 0, fmt.Errorf("bad number of days '%s'", s)
+	}
+	return days, nil
+}
+
+func printCompliance(c *appliancedb.EntitlementCompliance) {
+	table, _ := prettytable.NewTable(
+		prettytable.Column{Header: "KEY"},
+		prettytable.Column{Header: "VALUE"},
+	)
+	table.Separator = "  "
+
+	table.AddRow("Organization.UUID", c.OrganizationUUID)
+	table.AddRow("Organization.Name", c.OrganizationName)
+	table.AddRow("Status", c.Status())
+	if ent := c.Entitlements; ent != nil {
+		table.AddRow("SupportTier", ent.SupportTier)
+		table.AddRow("Appliances", fmt.Sprintf("%d of %d",
+			c.Appliances, ent.ContractedAppliances))
+		table.AddRow("Accounts", fmt.Sprintf("%d of %d",
+			c.Accounts, ent.ContractedAccounts))
+		table.AddRow("ContractStart",
+			ent.ContractStart.Format(contractDateFormat))
+		table.AddRow("ContractEnd",
+			ent.ContractEnd.Format(contractDateFormat))
+		table.AddRow("DaysUntilRenewal", c.DaysUntilRenewal)
+		table.AddRow("Notes", ent.Notes)
+		table.AddRow("UpdatedAt",
+			ent.UpdatedAt.In(time.Local).Format(timeLayout))
+	} else {
+		table.AddRow("Appliances", c.Appliances)
+		table.AddRow("Accounts", c.Accounts)
+	}
+	table.Print()
+}
+
+func showEntitlements(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	orgUUID, err := uuid.FromString(args[0])
+	if err != nil {
+		return err
+	}
+
+	db, _, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	c, err := db.EntitlementCompliance(ctx, orgUUID)
+	if err != nil {
+		return err
+	}
+	printCompliance(c)
+	return nil
+}
+
+func setEntitlements(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	orgUUID, err := uuid.FromString(args[0])
+	if err != nil {
+		return err
+	}
+
+	db, _, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Start from the existing terms, if there are any, so that only the
+	// flags given are changed.
+	ent, err := db.OrgEntitlementsByOrganization(ctx, orgUUID)
+	if _, ok := err.(appliancedb.NotFoundError); ok {
+		if !cmd.Flags().Changed("start") || !cmd.Flags().Changed("end") {
+			return fmt.Errorf("--start and --end are required " +
+				"for a new contract")
+		}
+		ent = &appliancedb.OrgEntitlements{
+			OrganizationUUID: orgUUID,
+			SupportTier:      appliancedb.SupportTierNone,
+		}
+	} else if err != nil {
+		return err
+	}
+
+	flags := cmd.Flags()
+	if flags.Changed("tier") {
+		ent.SupportTier, _ = flags.GetString("tier")
+	}
+	if flags.Changed("appliances") {
+		ent.ContractedAppliances, _ = flags.GetInt("appliances")
+	}
+	if flags.Changed("accounts") {
+		ent.ContractedAccounts, _ = flags.GetInt("accounts")
+	}
+	if flags.Changed("notes") {
+		ent.Notes, _ = flags.GetString("notes")
+	}
+	for flag, date := range map[string]*time.Time{
+		"start": &ent.ContractStart,
+		"end":   &ent.ContractEnd,
+	} {
+		if !flags.Changed(flag) {
+			continue
+		}
+		s, _ := flags.GetString(flag)
+		if *date, err = time.Parse(contractDateFormat, s); err != nil {
+			return fmt.Errorf("bad --%s date '%s': %v", flag, s, err)
+		}
+	}
+
+	if err = db.UpsertOrgEntitlements(ctx, ent); err != nil {
+		return err
+	}
+	c, err := db.EntitlementCompliance(ctx, orgUUID)
+	if err != nil {
+		return err
+	}
+	printCompliance(c)
+	return nil
+}
+
+func reportEntitlements(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	var filter appliancedb.EntitlementFilter
+	if cmd.Flags().Changed("expiring-within") {
+		s, _ := cmd.Flags().GetString("expiring-within")
+		days, err := parseDays(s)
+		if err != nil {
+			return err
+		}
+		filter.ExpiringWithin = &days
+	}
+	filter.OverContract, _ = cmd.Flags().GetBool("over-contract")
+
+	db, _, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	all, err := db.AllEntitlementCompliance(ctx)
+	if err != nil {
+		return err
+	}
+
+	table, _ := prettytable.NewTable(
+		prettytable.Column{Header: "UUID"},
+		prettytable.Column{Header: "Name"},
+		prettytable.Column{Header: "Status"},
+		prettytable.Column{Header: "Tier"},
+		prettytable.Column{Header: "Appliances", AlignRight: true},
+		prettytable.Column{Header: "Accounts", AlignRight: true},
+		prettytable.Column{Header: "ContractEnd"},
+		prettytable.Column{Header: "Days", AlignRight: true},
+	)
+	table.Separator = "  "
+
+	for _, c := range filter.Apply(all) {
+		ent := c.Entitlements
+		if ent == nil {
+			table.AddRow(c.OrganizationUUID, c.OrganizationName,
+				c.Status(), "-", c.Appliances, c.Accounts, "-", "-")
+			continue
+		}
+		table.AddRow(c.OrganizationUUID, c.OrganizationName,
+			c.Status(), ent.SupportTier,
+			fmt.Sprintf("%d/%d", c.Appliances, ent.ContractedAppliances),
+			fmt.Sprintf("%d/%d", c.Accounts, ent.ContractedAccounts),
+			ent.ContractEnd.Format(contractDateFormat),
+			c.DaysUntilRenewal)
+	}
+	table.Print()
+	return nil
+}
+
+// Build the 'entitlements' subcommand for organizations
+func entitlementCmd() *cobra.Command {
+	parentCmd := &cobra.Command{
+		Use:   "entitlements <subcmd> [flags] [args]",
+		Short: "Administer organizations' contractual entitlements",
+		Args:  cobra.NoArgs,
+	}
+
+	showCmd := &cobra.Command{
+		Use:   "show [flags] <org uuid>",
+		Args:  cobra.ExactArgs(1),
+		Short: "Show an organization's entitlements and its usage of them",
+		RunE:  showEntitlements,
+	}
+	showCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	parentCmd.AddCommand(showCmd)
+
+	setCmd := &cobra.Command{
+		Use:   "set [flags] <org uuid>",
+		Args:  cobra.ExactArgs(1),
+		Short: "Create or change an organization's entitlements",
+		RunE:  setEntitlements,
+	}
+	setCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	setCmd.Flags().StringP("tier", "t", "",
+		"support tier (none|basic|standard|premium)")
+	setCmd.Flags().Int("appliances", 0, "contracted appliance count")
+	setCmd.Flags().Int("accounts", 0, "contracted account count")
+	setCmd.Flags().StringP("start", "s", "", "contract start (YYYY-MM-DD)")
+	setCmd.Flags().StringP("end", "e", "", "contract end (YYYY-MM-DD)")
+	setCmd.Flags().StringP("notes", "n", "", "free-form notes")
+	parentCmd.AddCommand(setCmd)
+
+	reportCmd := &cobra.Command{
+		Use:   "report [flags]",
+		Args:  cobra.NoArgs,
+		Short: "Report on entitlements across all organizations",
+		Long: "Report on entitlements across all organizations.  " +
+			"With --expiring-within or --over-contract, only " +
+			"organizations matching either criterion are listed, " +
+			"along with any organizations which have no contract.",
+		RunE: reportEntitlements,
+	}
+	reportCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	reportCmd.Flags().StringP("expiring-within", "w", "",
+		"list contracts up for renewal within this many days (e.g. 60d)")
+	reportCmd.Flags().Bool("over-contract", false,
+		"list organizations using more than they are contracted for")
+	parentCmd.AddCommand(reportCmd)
+
+	return parentCmd
+}
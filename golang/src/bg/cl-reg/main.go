@@ -15,6 +15,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/user"
 
 	"github.com/spf13/cobra"
 	"github.com/tomazk/envcfg"
@@ -34,6 +35,8 @@ var environ struct {
 	ConfigdConnection  string `envcfg:"B10E_CLREG_CLCONFIGD_CONNECTION"`
 	DisableTLS         bool   `envcfg:"B10E_CLREG_DISABLE_TLS"`
 	AccountSecret      string `envcfg:"B10E_CLREG_ACCOUNT_SECRET"`
+	PhoneRegion        string `envcfg:"B10E_CLREG_PHONE_REGION"`
+	Actor              string `envcfg:"B10E_CLREG_ACTOR"`
 }
 
 type requiredUsage struct {
@@ -87,6 +90,24 @@ func first(opts ...string) string {
 	return ""
 }
 
+// Determine who is running the command, for attribution of changes to the
+// registry.  The named flag takes precedence, followed by $B10E_CLREG_ACTOR,
+// the user who invoked sudo, and finally the current user.
+func getActor(cmd *cobra.Command, flag string) (string, error) {
+	actor, _ := cmd.Flags().GetString(flag)
+	actor = first(actor, environ.Actor, os.Getenv("SUDO_USER"))
+	if actor != "" {
+		return actor, nil
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("couldn't determine user; use --%s: %v",
+			flag, err)
+	}
+	return u.Username, nil
+}
+
 func assembleRegistry(cmd *cobra.Command) (appliancedb.DataStore, *registry.ApplianceRegistry, error) {
 	var reg registry.ApplianceRegistry
 	project, _ := cmd.Flags().GetString("project")
@@ -122,6 +143,9 @@ func assembleRegistry(cmd *cobra.Command) (appliancedb.DataStore, *registry.Appl
 	if err != nil {
 		return nil, nil, err
 	}
+	if environ.PhoneRegion != "" {
+		db.AccountSetPhoneRegion(environ.PhoneRegion)
+	}
 	return db, &reg, nil
 }
 
@@ -134,8 +158,10 @@ func main() {
 	accountMain(rootCmd)
 	appMain(rootCmd)
 	cqMain(rootCmd)
+	dbMain(rootCmd)
 	oauth2Main(rootCmd)
 	orgMain(rootCmd)
+	releaseMain(rootCmd)
 	siteMain(rootCmd)
 	deviceIDMain(rootCmd)
 
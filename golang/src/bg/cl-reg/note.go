@@ -0,0 +1,176 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"bg/cloud_models/appliancedb"
+
+	"github.com/guregu/null"
+	"github.com/satori/uuid"
+	"github.com/spf13/cobra"
+)
+
+type noteSubjectFunc func(uuid.UUID) appliancedb.NoteSubject
+
+func printNotes(notes []appliancedb.Note, indent string) {
+	for _, note := range notes {
+		hdr := fmt.Sprintf("%sNote %d  %s  %s", indent, note.ID,
+			note.CreatedAt.In(time.Local).Format(timeLayout),
+			note.Author)
+		if note.TicketRef.Valid {
+			hdr += fmt.Sprintf("  [%s]", note.TicketRef.String)
+		}
+		if note.DeletedAt.Valid {
+			hdr += fmt.Sprintf("  (deleted %s by %s)",
+				note.DeletedAt.Time.In(time.Local).Format(timeLayout),
+				note.DeletedBy.String)
+		}
+		fmt.Println(hdr)
+		for _, line := range strings.Split(note.Text, "\n") {
+			fmt.Printf("%s    %s\n", indent, line)
+		}
+	}
+}
+
+func addNote(subject noteSubjectFunc) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		ctx := context.Background()
+		u, err := uuid.FromString(args[0])
+		if err != nil {
+			return err
+		}
+		ticket, _ := cmd.Flags().GetString("ticket")
+		author, err := getActor(cmd, "author")
+		if err != nil {
+			return err
+		}
+
+		db, _, err := assembleRegistry(cmd)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		note := &appliancedb.Note{
+			NoteSubject: subject(u),
+			Author:      author,
+			Text:        strings.Join(args[1:], " "),
+			TicketRef:   null.NewString(ticket, ticket != ""),
+		}
+		if err = db.AddNote(ctx, note); err != nil {
+			return err
+		}
+		fmt.Printf("Added note %d to %s\n", note.ID, note.NoteSubject)
+		return nil
+	}
+}
+
+func listNotes(subject noteSubjectFunc) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		ctx := context.Background()
+		u, err := uuid.FromString(args[0])
+		if err != nil {
+			return err
+		}
+		all, _ := cmd.Flags().GetBool("all")
+
+		db, _, err := assembleRegistry(cmd)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		notes, err := db.ListNotes(ctx, subject(u), all)
+		if err != nil {
+			return err
+		}
+		printNotes(notes, "")
+		return nil
+	}
+}
+
+func deleteNote(subject noteSubjectFunc) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		ctx := context.Background()
+		u, err := uuid.FromString(args[0])
+		if err != nil {
+			return err
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad note ID '%s': %v", args[1], err)
+		}
+		author, err := getActor(cmd, "author")
+		if err != nil {
+			return err
+		}
+
+		db, _, err := assembleRegistry(cmd)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		if err = db.DeleteNote(ctx, subject(u), id, author); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted note %d from %s\n", id, subject(u))
+		return nil
+	}
+}
+
+// Build the 'note' subcommand for appliances or sites
+func noteCmd(noun string, subject noteSubjectFunc) *cobra.Command {
+	parentCmd := &cobra.Command{
+		Use:   "note <subcmd> [flags] [args]",
+		Short: fmt.Sprintf("Administer support notes about %ss", noun),
+		Args:  cobra.NoArgs,
+	}
+
+	addNoteCmd := &cobra.Command{
+		Use:   fmt.Sprintf("add [flags] <%s-uuid> <text>...", noun),
+		Args:  cobra.MinimumNArgs(2),
+		Short: fmt.Sprintf("Add a note about a %s", noun),
+		RunE:  addNote(subject),
+	}
+	addNoteCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	addNoteCmd.Flags().StringP("author", "a", "", "who is writing the note (default: current user)")
+	addNoteCmd.Flags().StringP("ticket", "t", "", "related ticket in an external support system")
+	parentCmd.AddCommand(addNoteCmd)
+
+	listNoteCmd := &cobra.Command{
+		Use:     fmt.Sprintf("list [flags] <%s-uuid>", noun),
+		Args:    cobra.ExactArgs(1),
+		Short:   fmt.Sprintf("List the notes about a %s, newest first", noun),
+		Aliases: []string{"ls"},
+		RunE:    listNotes(subject),
+	}
+	listNoteCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	listNoteCmd.Flags().BoolP("all", "A", false, "include deleted notes")
+	parentCmd.AddCommand(listNoteCmd)
+
+	deleteNoteCmd := &cobra.Command{
+		Use:   fmt.Sprintf("rm [flags] <%s-uuid> <note-id>", noun),
+		Args:  cobra.ExactArgs(2),
+		Short: fmt.Sprintf("Delete a note about a %s", noun),
+		RunE:  deleteNote(subject),
+	}
+	deleteNoteCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	deleteNoteCmd.Flags().StringP("author", "a", "", "who is deleting the note (default: current user)")
+	parentCmd.AddCommand(deleteNoteCmd)
+
+	return parentCmd
+}
@@ -21,6 +21,34 @@ import (
 	"github.com/tatsushid/go-prettytable"
 )
 
+// Maximum number of affected accounts to list when reporting a rule's impact
+const ruleImpactSample = 10
+
+func checkRuleType(ruleType appliancedb.OAuth2OrgRuleType) error {
+	if ruleType != appliancedb.RuleTypeTenant &&
+		ruleType != appliancedb.RuleTypeDomain &&
+		ruleType != appliancedb.RuleTypeEmail {
+		return fmt.Errorf("Invalid rule type %q; use 'tenant', 'domain', or 'email'", ruleType)
+	}
+	return nil
+}
+
+func printRuleImpact(rule *appliancedb.OAuth2OrganizationRule,
+	accts []appliancedb.Account) {
+
+	fmt.Printf("OAuth2OrgRule: provider=%q, ruleType=%q ruleValue=%q org=%q\n",
+		rule.Provider, rule.RuleType, rule.RuleValue, rule.OrganizationUUID)
+	fmt.Printf("%d account(s) rely on this rule to map them to the organization\n",
+		len(accts))
+	for i, acct := range accts {
+		if i == ruleImpactSample {
+			fmt.Printf("    ... and %d more\n", len(accts)-i)
+			break
+		}
+		fmt.Printf("    %s\n", acct.Email)
+	}
+}
+
 func newOAuth2OrgRule(cmd *cobra.Command, args []string) error {
 	provider := args[0]
 	ruleType := appliancedb.OAuth2OrgRuleType(args[1])
@@ -28,10 +56,8 @@ func newOAuth2OrgRule(cmd *cobra.Command, args []string) error {
 	organization := args[3]
 	orgUU := uuid.Must(uuid.FromString(organization))
 
-	if ruleType != appliancedb.RuleTypeTenant &&
-		ruleType != appliancedb.RuleTypeDomain &&
-		ruleType != appliancedb.RuleTypeEmail {
-		return fmt.Errorf("Invalid rule type %q; use 'tenant', 'domain', or 'email'", ruleType)
+	if err := checkRuleType(ruleType); err != nil {
+		return err
 	}
 
 	db, _, err := assembleRegistry(cmd)
@@ -55,10 +81,8 @@ func delOAuth2OrgRule(cmd *cobra.Command, args []string) error {
 	ruleType := appliancedb.OAuth2OrgRuleType(args[1])
 	ruleValue := args[2]
 
-	if ruleType != appliancedb.RuleTypeTenant &&
-		ruleType != appliancedb.RuleTypeDomain &&
-		ruleType != appliancedb.RuleTypeEmail {
-		return fmt.Errorf("Invalid rule type %q; use 'tenant', 'domain', or 'email'", ruleType)
+	if err := checkRuleType(ruleType); err != nil {
+		return err
 	}
 
 	db, _, err := assembleRegistry(cmd)
@@ -67,7 +91,21 @@ func delOAuth2OrgRule(cmd *cobra.Command, args []string) error {
 	}
 	defer db.Close()
 
-	rule, err := registry.DeleteOAuth2OrganizationRule(context.Background(), db, provider,
+	ctx := context.Background()
+	force, _ := cmd.Flags().GetBool("force")
+	rule, accts, err := registry.OAuth2OrganizationRuleImpact(ctx, db, provider,
+		ruleType, ruleValue)
+	if err != nil {
+		return err
+	}
+	if len(accts) > 0 {
+		printRuleImpact(rule, accts)
+		if !force {
+			return fmt.Errorf("rule is in use; use --force to delete it anyway")
+		}
+	}
+
+	rule, err = registry.DeleteOAuth2OrganizationRule(ctx, db, provider,
 		ruleType, ruleValue)
 	if err != nil {
 		return err
@@ -77,6 +115,30 @@ func delOAuth2OrgRule(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+func impactOAuth2OrgRule(cmd *cobra.Command, args []string) error {
+	provider := args[0]
+	ruleType := appliancedb.OAuth2OrgRuleType(args[1])
+	ruleValue := args[2]
+
+	if err := checkRuleType(ruleType); err != nil {
+		return err
+	}
+
+	db, _, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rule, accts, err := registry.OAuth2OrganizationRuleImpact(context.Background(),
+		db, provider, ruleType, ruleValue)
+	if err != nil {
+		return err
+	}
+	printRuleImpact(rule, accts)
+	return nil
+}
+
 func listOAuth2OrgRules(cmd *cobra.Command, args []string) error {
 	db, _, err := assembleRegistry(cmd)
 	if err != nil {
@@ -138,6 +200,16 @@ func oauth2Main(rootCmd *cobra.Command) {
 		RunE:  delOAuth2OrgRule,
 	}
 	delOAuth2OrgRuleCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	delOAuth2OrgRuleCmd.Flags().BoolP("force", "f", false, "delete even if accounts rely on the rule")
 	oauth2OrgRuleCmd.AddCommand(delOAuth2OrgRuleCmd)
+
+	impactOAuth2OrgRuleCmd := &cobra.Command{
+		Use:   "impact [flags] <provider> [tenant|domain|email] <value>",
+		Args:  cobra.ExactArgs(3),
+		Short: "List accounts which rely on an OAuth2OrgRule",
+		RunE:  impactOAuth2OrgRule,
+	}
+	impactOAuth2OrgRuleCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	oauth2OrgRuleCmd.AddCommand(impactOAuth2OrgRuleCmd)
 }
 
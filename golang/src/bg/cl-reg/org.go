@@ -12,6 +12,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"bg/cl_common/registry"
 	"bg/cloud_models/appliancedb"
@@ -181,6 +182,64 @@ func listOrgRel(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+const usageDateFormat = "2006-01-02"
+
+func orgUsage(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	orgUUID, err := uuid.FromString(args[0])
+	if err != nil {
+		return err
+	}
+
+	// By default, report on the last 30 days, including today
+	to := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+	if toStr, _ := cmd.Flags().GetString("to"); toStr != "" {
+		if to, err = time.Parse(usageDateFormat, toStr); err != nil {
+			return err
+		}
+	}
+	from := to.AddDate(0, 0, -30)
+	if fromStr, _ := cmd.Flags().GetString("from"); fromStr != "" {
+		if from, err = time.Parse(usageDateFormat, fromStr); err != nil {
+			return err
+		}
+	}
+	if !from.Before(to) {
+		return fmt.Errorf("--from must precede --to")
+	}
+
+	db, _, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	report, err := db.UsageReport(ctx, orgUUID, from, to)
+	if err != nil {
+		return err
+	}
+
+	table, _ := prettytable.NewTable(
+		prettytable.Column{Header: "Day"},
+		prettytable.Column{Header: "Class"},
+		prettytable.Column{Header: "Requests", AlignRight: true},
+		prettytable.Column{Header: "Bytes", AlignRight: true},
+	)
+	table.Separator = "  "
+
+	var count, bytes int64
+	for _, row := range report {
+		table.AddRow(row.Day.UTC().Format(usageDateFormat),
+			row.EndpointClass, row.Count, row.Bytes)
+		count += row.Count
+		bytes += row.Bytes
+	}
+	table.AddRow("total", "", count, bytes)
+	table.Print()
+	return nil
+}
+
 func orgMain(rootCmd *cobra.Command) {
 	orgCmd := &cobra.Command{
 		Use:   "org <subcmd> [flags] [args]",
@@ -217,6 +276,19 @@ func orgMain(rootCmd *cobra.Command) {
 	setOrgCmd.Flags().StringP("name", "n", "", "set organization name")
 	orgCmd.AddCommand(setOrgCmd)
 
+	usageOrgCmd := &cobra.Command{
+		Use:   "usage [flags] <uuid>",
+		Args:  cobra.ExactArgs(1),
+		Short: "Report organization API usage by day",
+		RunE:  orgUsage,
+	}
+	usageOrgCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	usageOrgCmd.Flags().StringP("from", "f", "", "first day of report (YYYY-MM-DD, UTC)")
+	usageOrgCmd.Flags().StringP("to", "t", "", "day after last day of report (YYYY-MM-DD, UTC)")
+	orgCmd.AddCommand(usageOrgCmd)
+
+	orgCmd.AddCommand(entitlementCmd())
+
 	orgRelCmd := &cobra.Command{
 		Use:   "relationship <subcmd> [flags] [args]",
 		Short: "List, add and remove org/org relationships",
@@ -225,7 +297,7 @@ func orgMain(rootCmd *cobra.Command) {
 	orgCmd.AddCommand(orgRelCmd)
 
 	newOrgRelCmd := &cobra.Command{
-		Use:   "new [flags] <org uuid> <target org uuid> self|msp",
+		Use:   "new [flags] <org uuid> <target org uuid> self|msp|support",
 		Args:  cobra.ExactArgs(3),
 		Short: "Create an org and add it to the registry",
 		RunE:  newOrgRel,
@@ -0,0 +1,371 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"bg/cl_common/registry"
+	"bg/cloud_models/appliancedb"
+	"bg/common/mfg"
+
+	"github.com/guregu/null"
+	"github.com/pkg/errors"
+	"github.com/satori/uuid"
+	"github.com/spf13/cobra"
+)
+
+// A row of a manufacturing manifest: an appliance's serial number and
+// representative MAC address, and optionally some notes about it.  Row is the
+// row's number in the manifest, counting from 1 as a spreadsheet does, for
+// reporting.
+type manifestRow struct {
+	Row    int
+	Serial string
+	MAC    string
+	Notes  string
+}
+
+// Read a manufacturing manifest, a CSV file of (serial, MAC, notes) rows.  The
+// notes column is optional, and a leading header row is skipped.
+func readManifest(r io.Reader) ([]manifestRow, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	rows := make([]manifestRow, 0)
+	for n := 1; ; n++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if n == 1 && strings.Contains(strings.ToLower(rec[0]), "serial") {
+			continue
+		}
+		if len(rec) < 2 || len(rec) > 3 {
+			return nil, fmt.Errorf("row %d: expected 2 or 3 fields, "+
+				"found %d", n, len(rec))
+		}
+		row := manifestRow{
+			Row:    n,
+			Serial: strings.TrimSpace(rec[0]),
+			MAC:    strings.TrimSpace(rec[1]),
+		}
+		if len(rec) == 3 {
+			row.Notes = strings.TrimSpace(rec[2])
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// The outcomes of pre-registering a manifest row
+const (
+	preregCreated     = "created"
+	preregWouldCreate = "would-create"
+	preregDuplicate   = "skipped-duplicate"
+	preregFailed      = "failed"
+)
+
+type preregResult struct {
+	Row       int        `json:"row"`
+	Serial    string     `json:"serial"`
+	MAC       string     `json:"mac"`
+	Status    string     `json:"status"`
+	Appliance *uuid.UUID `json:"applianceUUID,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+func (r *preregResult) String() string {
+	s := fmt.Sprintf("row %d: %s %s: %s", r.Row, r.Serial, r.MAC,
+		r.Status)
+	if r.Appliance != nil {
+		s += " " + r.Appliance.String()
+	}
+	if r.Error != "" {
+		s += ": " + r.Error
+	}
+	return s
+}
+
+type preregSummary struct {
+	Created    int `json:"created"`
+	Duplicates int `json:"skippedDuplicate"`
+	Failed     int `json:"failed"`
+}
+
+// Creates the appliance record for a validated manifest row; the MAC address
+// has been normalized.
+type preregCreateFunc func(context.Context, manifestRow) (uuid.UUID, error)
+
+// Pre-register the appliances in a manifest, reporting the result of each row
+// to out as it goes.  Rows with an invalid serial number or MAC address fail,
+// and rows whose serial number or MAC address appeared on an earlier row, or
+// whose serial number is already registered, are skipped.  A failure to create
+// a row's appliance doesn't stop the others from being created.  In a dry run,
+// the rows are checked, but nothing is created.
+func preregister(ctx context.Context, db appliancedb.DataStore,
+	rows []manifestRow, create preregCreateFunc, dryRun bool,
+	out io.Writer) ([]preregResult, preregSummary) {
+
+	var summary preregSummary
+	results := make([]preregResult, 0, len(rows))
+	serials := make(map[string]int)
+	macs := make(map[string]int)
+
+	for _, row := range rows {
+		r := preregResult{
+			Row:    row.Row,
+			Serial: row.Serial,
+			MAC:    row.MAC,
+		}
+
+		mac, macErr := net.ParseMAC(row.MAC)
+		if macErr == nil {
+			r.MAC = mac.String()
+			row.MAC = r.MAC
+		}
+
+		if !mfg.ValidExtSerial(row.Serial) {
+			r.Status = preregFailed
+			r.Error = "invalid serial number"
+		} else if macErr != nil {
+			r.Status = preregFailed
+			r.Error = "invalid MAC address"
+		} else if n, ok := serials[row.Serial]; ok {
+			r.Status = preregDuplicate
+			r.Error = fmt.Sprintf("serial number duplicates row %d", n)
+		} else if n, ok := macs[row.MAC]; ok {
+			r.Status = preregDuplicate
+			r.Error = fmt.Sprintf("MAC address duplicates row %d", n)
+		}
+		if r.Status == "" {
+			serials[row.Serial] = row.Row
+			macs[row.MAC] = row.Row
+
+			app, err := db.ApplianceIDByHWSerial(ctx, row.Serial)
+			if err == nil {
+				r.Status = preregDuplicate
+				r.Appliance = &app.ApplianceUUID
+				r.Error = "serial number already registered"
+			} else if _, ok := err.(appliancedb.NotFoundError); !ok {
+				r.Status = preregFailed
+				r.Error = err.Error()
+			}
+		}
+		if r.Status == "" {
+			if dryRun {
+				r.Status = preregWouldCreate
+			} else if u, err := create(ctx, row); err != nil {
+				r.Status = preregFailed
+				r.Error = err.Error()
+			} else {
+				r.Status = preregCreated
+				r.Appliance = &u
+			}
+		}
+
+		switch r.Status {
+		case preregCreated, preregWouldCreate:
+			summary.Created++
+		case preregDuplicate:
+			summary.Duplicates++
+		default:
+			summary.Failed++
+		}
+		fmt.Fprintln(out, r.String())
+		results = append(results, r)
+	}
+
+	return results, summary
+}
+
+// Build a preregCreateFunc which creates appliances at the null site.  If an
+// IoT registry is configured, the appliances are added to it, and their
+// secrets are escrowed or written to outdir, as with 'app new'; otherwise only
+// the database records are created.  In either case, the appliance is named
+// for its serial number, and a note records where it came from.
+func preregCreator(db appliancedb.DataStore, reg *registry.ApplianceRegistry,
+	manifest string, org *appliancedb.Organization, author, outdir string,
+	noEscrow bool) preregCreateFunc {
+
+	useRegistry := reg.Project != "" && reg.Region != "" && reg.Registry != ""
+
+	return func(ctx context.Context, row manifestRow) (uuid.UUID, error) {
+		var appUU uuid.UUID
+
+		if useRegistry {
+			var jout []byte
+			var err error
+			appUU, _, _, jout, _, err = registry.NewAppliance(ctx,
+				db, uuid.Nil, appliancedb.NullSiteUUID,
+				reg.Project, reg.Region, reg.Registry,
+				row.Serial, row.Serial, row.MAC,
+				os.Getenv("B10E_CLREG_VAULT_PUBKEY_PATH"),
+				os.Getenv("B10E_CLREG_VAULT_PUBKEY_COMPONENT"),
+				noEscrow)
+			if jout == nil {
+				return uuid.Nil, err
+			}
+			if outdir != "" {
+				path := filepath.Join(outdir,
+					row.Serial+".cloud.secret.json")
+				if ioerr := ioutil.WriteFile(path, jout,
+					0600); ioerr != nil && err == nil {
+					err = ioerr
+				}
+			}
+			if err != nil {
+				return uuid.Nil, errors.Wrapf(err,
+					"appliance %s created, but saving its "+
+						"secret failed", appUU)
+			}
+		} else {
+			appUU = uuid.NewV4()
+			err := db.InsertApplianceID(ctx, &appliancedb.ApplianceID{
+				ApplianceUUID:      appUU,
+				SiteUUID:           appliancedb.NullSiteUUID,
+				ApplianceRegID:     row.Serial,
+				SystemReprHWSerial: null.StringFrom(row.Serial),
+				SystemReprMAC:      null.StringFrom(row.MAC),
+			})
+			if err != nil {
+				return uuid.Nil, err
+			}
+		}
+
+		text := "Pre-registered from manufacturing manifest " +
+			filepath.Base(manifest)
+		if org != nil {
+			text += fmt.Sprintf(" for organization %q (%s)",
+				org.Name, org.UUID)
+		}
+		if row.Notes != "" {
+			text += "\n" + row.Notes
+		}
+		err := db.AddNote(ctx, &appliancedb.Note{
+			NoteSubject: appliancedb.ApplianceNoteSubject(appUU),
+			Author:      author,
+			Text:        text,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "row %d: failed to add note to "+
+				"appliance %s: %v\n", row.Row, appUU, err)
+		}
+		return appUU, nil
+	}
+}
+
+func preregApps(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	manifest, _ := cmd.Flags().GetString("manifest")
+	orgUUID, _ := cmd.Flags().GetString("org")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	resultsPath, _ := cmd.Flags().GetString("results")
+	outdir, _ := cmd.Flags().GetString("directory")
+	noEscrow, _ := cmd.Flags().GetBool("no-escrow")
+
+	if manifest == "" {
+		return requiredUsage{
+			cmd:         cmd,
+			msg:         "Missing manifest",
+			explanation: "The --manifest flag must be set.\n",
+		}
+	}
+	if noEscrow && outdir == "" {
+		return requiredUsage{
+			cmd:         cmd,
+			msg:         "Invalid flag combination",
+			explanation: "The --no-escrow flag requires --directory.\n",
+		}
+	}
+	if resultsPath == "" {
+		resultsPath = manifest + ".results.json"
+	}
+	author, err := getActor(cmd, "author")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(manifest)
+	if err != nil {
+		return err
+	}
+	rows, err := readManifest(f)
+	f.Close()
+	if err != nil {
+		return errors.Wrapf(err, "reading %s", manifest)
+	}
+
+	db, reg, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var org *appliancedb.Organization
+	if orgUUID != "" {
+		u, err := uuid.FromString(orgUUID)
+		if err != nil {
+			return err
+		}
+		if org, err = db.OrganizationByUUID(ctx, u); err != nil {
+			return err
+		}
+	}
+	if outdir != "" && !dryRun {
+		if err = os.MkdirAll(outdir, 0700); err != nil {
+			return err
+		}
+	}
+
+	create := preregCreator(db, reg, manifest, org, author, outdir,
+		noEscrow)
+	results, summary := preregister(ctx, db, rows, create, dryRun,
+		os.Stdout)
+
+	verb := "Created"
+	if dryRun {
+		verb = "Would create"
+	}
+	fmt.Printf("%s %d, skipped %d duplicate, %d failed\n", verb,
+		summary.Created, summary.Duplicates, summary.Failed)
+
+	jout, err := json.MarshalIndent(struct {
+		Manifest string         `json:"manifest"`
+		DryRun   bool           `json:"dryRun"`
+		Summary  preregSummary  `json:"summary"`
+		Results  []preregResult `json:"results"`
+	}{manifest, dryRun, summary, results}, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(resultsPath, jout, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Results written to %s\n", resultsPath)
+
+	if summary.Failed > 0 {
+		return fmt.Errorf("%d rows failed", summary.Failed)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"bg/cloud_models/appliancedb"
+	"bg/cloud_models/appliancedb/mocks"
+
+	"github.com/satori/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+const testManifest = `Serial Number,MAC Address,Notes
+001-201901BB-000001,00:40:54:00:00:01,
+001-201901BB-000002,00-40-54-00-00-02,"rework, then passed"
+001-201901BB-000003,00:40:54:00:00:03
+`
+
+func TestReadManifest(t *testing.T) {
+	assert := require.New(t)
+
+	rows, err := readManifest(strings.NewReader(testManifest))
+	assert.NoError(err)
+	assert.Equal([]manifestRow{
+		{Row: 2, Serial: "001-201901BB-000001", MAC: "00:40:54:00:00:01"},
+		{Row: 3, Serial: "001-201901BB-000002", MAC: "00-40-54-00-00-02",
+			Notes: "rework, then passed"},
+		{Row: 4, Serial: "001-201901BB-000003", MAC: "00:40:54:00:00:03"},
+	}, rows)
+
+	// No header
+	rows, err = readManifest(strings.NewReader(
+		"001-201901BB-000001,00:40:54:00:00:01\n"))
+	assert.NoError(err)
+	assert.Len(rows, 1)
+	assert.Equal(1, rows[0].Row)
+
+	_, err = readManifest(strings.NewReader(
+		"001-201901BB-000001,00:40:54:00:00:01\n001-201901BB-000002\n"))
+	assert.Error(err)
+	assert.Contains(err.Error(), "row 2")
+}
+
+var existingApp = appliancedb.ApplianceID{
+	ApplianceUUID: uuid.Must(uuid.FromString("00000000-1111-2222-3333-000000000001")),
+	SiteUUID:      appliancedb.NullSiteUUID,
+}
+
+// A DataStore in which only the given serial numbers are registered
+func preregMock(registered ...string) *mocks.DataStore {
+	dMock := &mocks.DataStore{}
+	for _, sn := range registered {
+		dMock.On("ApplianceIDByHWSerial", mock.Anything, sn).
+			Return(&existingApp, nil)
+	}
+	dMock.On("ApplianceIDByHWSerial", mock.Anything, mock.Anything).
+		Return(nil, appliancedb.NotFoundError{})
+	return dMock
+}
+
+// A preregCreateFunc which records the rows it is asked to create, and fails
+// for the given serial numbers.
+type testCreator struct {
+	created []manifestRow
+	failFor map[string]bool
+}
+
+func (c *testCreator) create(ctx context.Context,
+	row manifestRow) (uuid.UUID, error) {
+
+	if c.failFor[row.Serial] {
+		return uuid.Nil, errors.New("registry unavailable")
+	}
+	c.created = append(c.created, row)
+	return uuid.NewV4(), nil
+}
+
+func TestPreregisterDuplicates(t *testing.T) {
+	assert := require.New(t)
+
+	rows := []manifestRow{
+		{Row: 1, Serial: "001-201901BB-000001", MAC: "00:40:54:00:00:01"},
+		{Row: 2, Serial: "001-201901BB-000001", MAC: "00:40:54:00:00:02"},
+		{Row: 3, Serial: "001-201901BB-000003", MAC: "00-40-54-00-00-01"},
+		{Row: 4, Serial: "001-201901BB-000004", MAC: "00:40:54:00:00:04"},
+		{Row: 5, Serial: "001-201901BB-000005", MAC: "00:40:54:00:00:05"},
+		{Row: 6, Serial: "nonesuch", MAC: "00:40:54:00:00:06"},
+		{Row: 7, Serial: "001-201901BB-000007", MAC: "00:40:54:00:00"},
+	}
+	dMock := preregMock("001-201901BB-000004")
+	creator := &testCreator{}
+	var out bytes.Buffer
+
+	results, summary := preregister(context.Background(), dMock, rows,
+		creator.create, false, &out)
+	assert.Equal(preregSummary{Created: 2, Duplicates: 3, Failed: 2},
+		summary)
+
+	statuses := make([]string, 0)
+	for _, r := range results {
+		statuses = append(statuses, r.Status)
+	}
+	assert.Equal([]string{
+		preregCreated,
+		preregDuplicate, // serial number repeated in the manifest
+		preregDuplicate, // MAC address repeated, in another form
+		preregDuplicate, // already registered
+		preregCreated,
+		preregFailed,
+		preregFailed,
+	}, statuses)
+	assert.Contains(results[1].Error, "row 1")
+	assert.Contains(results[2].Error, "row 1")
+	assert.Equal(existingApp.ApplianceUUID, *results[3].Appliance)
+	assert.Len(creator.created, 2)
+
+	// Every row is reported
+	assert.Len(strings.Split(strings.TrimSpace(out.String()), "\n"), 7)
+}
+
+func TestPreregisterPartialFailure(t *testing.T) {
+	assert := require.New(t)
+
+	rows, err := readManifest(strings.NewReader(testManifest))
+	assert.NoError(err)
+	dMock := preregMock()
+	creator := &testCreator{
+		failFor: map[string]bool{"001-201901BB-000002": true},
+	}
+	var out bytes.Buffer
+
+	// The failure doesn't stop the rows after it, or hide those before
+	results, summary := preregister(context.Background(), dMock, rows,
+		creator.create, false, &out)
+	assert.Equal(preregSummary{Created: 2, Failed: 1}, summary)
+	assert.Len(creator.created, 2)
+	assert.Equal("001-201901BB-000003", creator.created[1].Serial)
+
+	assert.Equal(preregCreated, results[0].Status)
+	assert.NotNil(results[0].Appliance)
+	assert.Equal(preregFailed, results[1].Status)
+	assert.Nil(results[1].Appliance)
+	assert.Equal("registry unavailable", results[1].Error)
+	assert.Equal(preregCreated, results[2].Status)
+	assert.Contains(out.String(), "row 3: 001-201901BB-000002 "+
+		"00:40:54:00:00:02: failed: registry unavailable")
+}
+
+func TestPreregisterDryRun(t *testing.T) {
+	assert := require.New(t)
+
+	rows, err := readManifest(strings.NewReader(testManifest))
+	assert.NoError(err)
+	rows = append(rows, manifestRow{
+		Row:    5,
+		Serial: "001-201901BB-000003",
+		MAC:    "00:40:54:00:00:05",
+	})
+	dMock := preregMock("001-201901BB-000001")
+	creator := &testCreator{}
+	var out bytes.Buffer
+
+	results, summary := preregister(context.Background(), dMock, rows,
+		creator.create, true, &out)
+	assert.Equal(preregSummary{Created: 2, Duplicates: 2}, summary)
+	assert.Equal(preregDuplicate, results[0].Status)
+	assert.Equal(preregWouldCreate, results[1].Status)
+	assert.Nil(results[1].Appliance)
+	assert.Equal(preregWouldCreate, results[2].Status)
+	assert.Equal(preregDuplicate, results[3].Status)
+
+	// Nothing was written: the only calls made were lookups
+	assert.Empty(creator.created)
+	for _, call := range dMock.Calls {
+		assert.Equal("ApplianceIDByHWSerial", call.Method)
+	}
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"bg/cloud_models/appliancedb"
+
+	"github.com/satori/uuid"
+	"github.com/spf13/cobra"
+	"github.com/tatsushid/go-prettytable"
+)
+
+func deployRelease(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	relUU, err := uuid.FromString(args[0])
+	if err != nil {
+		return err
+	}
+	sites := make([]uuid.UUID, 0, len(args)-2)
+	for _, arg := range args[2:] {
+		u, err := uuid.FromString(arg)
+		if err != nil {
+			return fmt.Errorf("bad site UUID '%s': %v", arg, err)
+		}
+		sites = append(sites, u)
+	}
+
+	db, _, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	dep, err := db.CreateDeployment(ctx, relUU, args[1], sites)
+	if oe, ok := err.(appliancedb.DeploymentOverlapError); ok {
+		if len(oe.Sites) == 0 {
+			return err
+		}
+		fmt.Printf("Sites already in an active deployment on channel '%s':\n",
+			oe.Channel)
+		busy := make([]string, 0, len(oe.Sites))
+		for site, depUU := range oe.Sites {
+			busy = append(busy, fmt.Sprintf("    %s  (deployment %s)",
+				site, depUU))
+		}
+		sort.Strings(busy)
+		for _, line := range busy {
+			fmt.Println(line)
+		}
+		return fmt.Errorf("deployment not created")
+	} else if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created deployment %s of release %s to %d sites on "+
+		"channel '%s'\n", dep.UUID, dep.ReleaseUUID, len(sites), dep.Channel)
+	return nil
+}
+
+func deploymentStatus(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	depUU, err := uuid.FromString(args[0])
+	if err != nil {
+		return err
+	}
+	window, _ := cmd.Flags().GetDuration("window")
+
+	db, _, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	summary, err := db.DeploymentStatus(ctx, depUU, window)
+	if err != nil {
+		return err
+	}
+
+	dep := summary.Deployment
+	fmt.Printf("Deployment %s (%s)\n", dep.UUID, dep.Name)
+	fmt.Printf("    Release: %s\n", dep.ReleaseUUID)
+	fmt.Printf("    Channel: %s\n", dep.Channel)
+	fmt.Printf("    Created: %s\n",
+		dep.CreatedAt.In(time.Local).Format(timeLayout))
+	fmt.Printf("    Targets: %d\n\n", summary.Targets)
+
+	table, _ := prettytable.NewTable(
+		prettytable.Column{Header: "Status"},
+		prettytable.Column{Header: "Sites", AlignRight: true},
+	)
+	table.Separator = "  "
+	for _, status := range []string{
+		appliancedb.DeploymentSuccess,
+		appliancedb.DeploymentFailed,
+		appliancedb.DeploymentRolledBack,
+		appliancedb.DeploymentPending,
+	} {
+		table.AddRow(status, summary.Counts[status])
+	}
+	table.Print()
+
+	if len(summary.Laggards) > 0 {
+		fmt.Printf("\nSites not reporting within %s:\n", window)
+		for _, site := range summary.Laggards {
+			fmt.Printf("    %s\n", site)
+		}
+	}
+	return nil
+}
+
+func releaseMain(rootCmd *cobra.Command) {
+	releaseCmd := &cobra.Command{
+		Use:   "release <subcmd> [flags] [args]",
+		Short: "Administer release deployments in the registry",
+		Args:  cobra.NoArgs,
+	}
+	rootCmd.AddCommand(releaseCmd)
+
+	deployCmd := &cobra.Command{
+		Use:   "deploy [flags] <release-uuid> <name> <site-uuid>...",
+		Args:  cobra.MinimumNArgs(3),
+		Short: "Start deploying a release to a set of sites",
+		RunE:  deployRelease,
+	}
+	deployCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	releaseCmd.AddCommand(deployCmd)
+
+	statusCmd := &cobra.Command{
+		Use:   "status [flags] <deployment-uuid>",
+		Args:  cobra.ExactArgs(1),
+		Short: "Summarize the results reported for a deployment",
+		RunE:  deploymentStatus,
+	}
+	statusCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	statusCmd.Flags().DurationP("window", "w", 24*time.Hour,
+		"how long sites have to report before they are considered late")
+	releaseCmd.AddCommand(statusCmd)
+}
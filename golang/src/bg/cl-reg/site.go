@@ -12,11 +12,17 @@ package main
 import (
 	"bg/cl_common/registry"
 	"bg/cloud_models/appliancedb"
+	"bg/common/cfgapi"
+	"bg/common/cfgmsg"
 	"context"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/pkg/errors"
@@ -152,15 +158,27 @@ func listSites(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	noteCounts, err := db.SiteNoteCounts(ctx)
+	if err != nil {
+		return err
+	}
+
 	table, _ := prettytable.NewTable(
 		prettytable.Column{Header: "UUID"},
 		prettytable.Column{Header: "OrganizationUUID"},
 		prettytable.Column{Header: "Name"},
+		prettytable.Column{Header: "Notes", AlignRight: true},
+		prettytable.Column{Header: "Archived"},
 	)
 	table.Separator = "  "
 
 	for _, site := range sites {
-		table.AddRow(site.UUID, site.OrganizationUUID, site.Name)
+		archived := ""
+		if site.Archived() {
+			archived = site.ArchivedAt.Time.Format("2006-01-02")
+		}
+		table.AddRow(site.UUID, site.OrganizationUUID, site.Name,
+			noteCounts[site.UUID], archived)
 	}
 	table.Print()
 	return nil
@@ -198,6 +216,410 @@ func setSite(cmd *cobra.Command, args []string) error {
 	return err
 }
 
+// archiveSite implements 'site archive' and 'site unarchive'
+func archiveSite(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	siteUUID, err := uuid.FromString(args[0])
+	if err != nil {
+		return err
+	}
+
+	db, _, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	verb := "Archived"
+	if cmd.Name() == "unarchive" {
+		verb = "Unarchived"
+		err = db.UnarchiveCustomerSite(ctx, siteUUID)
+	} else {
+		err = db.ArchiveCustomerSite(ctx, siteUUID)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s site %s\n", verb, siteUUID)
+	return nil
+}
+
+func createCheckpoint(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	siteUUID, err := uuid.FromString(args[0])
+	if err != nil {
+		return err
+	}
+	name := args[1]
+
+	actor, err := getActor(cmd, "actor")
+	if err != nil {
+		return err
+	}
+
+	db, _, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	cp, err := db.CreateCheckpoint(ctx, siteUUID, name, actor)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created checkpoint %d: name='%s' site=%s last-command=%s\n",
+		cp.ID, cp.Name, cp.SiteUUID, checkpointLastCommand(cp))
+	return nil
+}
+
+func checkpointLastCommand(cp *appliancedb.SiteConfigCheckpoint) string {
+	if !cp.LastCommandID.Valid {
+		return "-"
+	}
+	return strconv.FormatInt(cp.LastCommandID.Int64, 10)
+}
+
+func listCheckpoints(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	siteUUID, err := uuid.FromString(args[0])
+	if err != nil {
+		return err
+	}
+
+	db, _, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	cps, err := db.ListCheckpoints(ctx, siteUUID)
+	if err != nil {
+		return err
+	}
+
+	table, _ := prettytable.NewTable(
+		prettytable.Column{Header: "ID", AlignRight: true},
+		prettytable.Column{Header: "Name"},
+		prettytable.Column{Header: "Created"},
+		prettytable.Column{Header: "Created By"},
+		prettytable.Column{Header: "Last Command", AlignRight: true},
+		prettytable.Column{Header: "Root Hash"},
+	)
+	table.Separator = "  "
+
+	for _, cp := range cps {
+		table.AddRow(cp.ID, cp.Name,
+			cp.CreatedAt.In(time.Local).Format(timeLayout),
+			cp.CreatedBy, checkpointLastCommand(&cp),
+			hex.EncodeToString(cp.RootHash))
+	}
+	table.Print()
+	return nil
+}
+
+func showCheckpoint(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	siteUUID, err := uuid.FromString(args[0])
+	if err != nil {
+		return err
+	}
+	id, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad checkpoint ID '%s': %v", args[1], err)
+	}
+	output, _ := cmd.Flags().GetString("output")
+
+	db, _, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	plan, err := db.RollbackPlan(ctx, siteUUID, id)
+	if err != nil {
+		return err
+	}
+	cp := plan.Checkpoint
+
+	fmt.Printf("Checkpoint %d: %s\n", cp.ID, cp.Name)
+	fmt.Printf("  Site:         %s\n", cp.SiteUUID)
+	fmt.Printf("  Created:      %s\n",
+		cp.CreatedAt.In(time.Local).Format(timeLayout))
+	fmt.Printf("  Created By:   %s\n", cp.CreatedBy)
+	fmt.Printf("  Root Hash:    %s\n", hex.EncodeToString(cp.RootHash))
+	fmt.Printf("  Config Size:  %d\n", len(cp.Config))
+	fmt.Printf("  Last Command: %s\n", checkpointLastCommand(cp))
+
+	if len(plan.Completed) == 0 {
+		fmt.Printf("\nNo commands have completed since the checkpoint.\n")
+	} else {
+		fmt.Printf("\nRestoring the checkpoint would undo these commands:\n")
+		table, _ := prettytable.NewTable(
+			prettytable.Column{Header: "ID", AlignRight: true},
+			prettytable.Column{Header: "Completed"},
+			prettytable.Column{Header: "Query Length", AlignRight: true},
+		)
+		table.Separator = "  "
+		for _, c := range plan.Completed {
+			table.AddRow(c.ID,
+				c.DoneTime.Time.In(time.Local).Format(timeLayout),
+				len(c.Query))
+		}
+		printPrefixedTable(table, "  ")
+	}
+
+	if output != "" {
+		if err = ioutil.WriteFile(output, cp.Config, 0600); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote checkpointed config to %s\n", output)
+	}
+	return nil
+}
+
+// fetchLiveTree asks the appliance for its full config tree, by way of the
+// command queue, and waits for the response.
+func fetchLiveTree(ctx context.Context, db appliancedb.DataStore,
+	siteUUID uuid.UUID, timeout time.Duration) ([]byte, error) {
+
+	q, err := cfgapi.PropOpsToQuery([]cfgapi.PropertyOp{
+		{Op: cfgapi.PropGet, Name: "@/"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	jsonQuery, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	cmd := &appliancedb.SiteCommand{
+		EnqueuedTime: time.Now(),
+		Query:        jsonQuery,
+	}
+	if err = db.CommandSubmit(ctx, siteUUID, cmd); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+		c, err := db.CommandSearch(ctx, siteUUID, cmd.ID)
+		if err != nil {
+			return nil, err
+		}
+		if c.State == "CNCL" || (c.State == "DONE" && len(c.Response) == 0) {
+			return nil, fmt.Errorf("command %d was canceled", cmd.ID)
+		} else if c.State != "DONE" {
+			continue
+		}
+
+		var resp cfgmsg.ConfigResponse
+		if err = json.Unmarshal(c.Response, &resp); err != nil {
+			return nil, err
+		}
+		tree, err := cfgapi.ParseConfigResponse(&resp)
+		if err != nil {
+			return nil, fmt.Errorf("appliance failed to send its tree: %v", err)
+		}
+		return []byte(tree), nil
+	}
+
+	_, _, _ = db.CommandCancel(ctx, siteUUID, cmd.ID)
+	return nil, fmt.Errorf("appliance didn't respond to command %d within %v",
+		cmd.ID, timeout)
+}
+
+func verifyConfig(cmd *cobra.Command, args []string) error {
+	if environ.ConfigdConnection == "" {
+		return fmt.Errorf("Must set B10E_CLREG_CLCONFIGD_CONNECTION")
+	}
+
+	ctx := context.Background()
+	siteUUID, err := uuid.FromString(args[0])
+	if err != nil {
+		return err
+	}
+	snapshot, _ := cmd.Flags().GetString("snapshot")
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	verbose, _ := cmd.Flags().GetBool("verbose")
+
+	cfg, err := getConfig(siteUUID.String())
+	if err != nil {
+		return err
+	}
+	defer cfg.Close()
+
+	// The cloud's copy has to be retrieved first: cl.configd refreshes its
+	// cache with the response to any GET of @/, so once the appliance has
+	// answered ours, the two would always appear to be in sync.
+	cloud, err := cfg.GetProps("@/")
+	if err != nil {
+		return fmt.Errorf("retrieving cloud tree: %v", err)
+	}
+
+	var live []byte
+	if snapshot != "" {
+		live, err = ioutil.ReadFile(snapshot)
+	} else {
+		db, _, rerr := assembleRegistry(cmd)
+		if rerr != nil {
+			return rerr
+		}
+		defer db.Close()
+		live, err = fetchLiveTree(ctx, db, siteUUID, timeout)
+	}
+	if err != nil {
+		return err
+	}
+	appliance, err := cfgapi.DecodeTree(live, cfgapi.DefaultTreeLimits)
+	if err != nil {
+		return fmt.Errorf("decoding appliance tree: %v", err)
+	}
+
+	diffs := cfgapi.DiffTrees(cloud, appliance)
+	meaningful := cfgapi.MeaningfulDiffs(diffs)
+	if meaningful > 0 || (verbose && len(diffs) > 0) {
+		fmt.Printf("Differences (- cloud only, + appliance only, ~ changed):\n")
+		for _, d := range diffs {
+			if verbose || !d.Volatile {
+				fmt.Printf("  %s\n", d)
+			}
+		}
+		fmt.Printf("\n")
+	}
+
+	switch {
+	case len(diffs) == 0:
+		fmt.Printf("Site %s: in sync\n", siteUUID)
+	case meaningful == 0:
+		fmt.Printf("Site %s: in sync; %d volatile differences only\n",
+			siteUUID, len(diffs))
+	default:
+		fmt.Printf("Site %s: %d meaningful differences, %d volatile\n",
+			siteUUID, meaningful, len(diffs)-meaningful)
+		return fmt.Errorf("cloud and appliance config trees have diverged")
+	}
+	return nil
+}
+
+func createIntegrationToken(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	siteUUID, err := uuid.FromString(args[0])
+	if err != nil {
+		return err
+	}
+	scopes, _ := cmd.Flags().GetStringSlice("scope")
+	duration, _ := cmd.Flags().GetDuration("duration")
+
+	actor, err := getActor(cmd, "actor")
+	if err != nil {
+		return err
+	}
+
+	db, _, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	now := time.Now()
+	tok := &appliancedb.SiteIntegrationToken{
+		SiteUUID:  siteUUID,
+		Name:      args[1],
+		Scopes:    scopes,
+		CreatedBy: actor,
+		CreatedAt: now,
+		ExpiresAt: now.Add(duration),
+	}
+	secret, err := db.CreateSiteIntegrationToken(ctx, tok)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created integration token %s: name='%s' site=%s "+
+		"scopes=%s expires=%s\n", tok.UUID, tok.Name, tok.SiteUUID,
+		strings.Join(tok.Scopes, ","),
+		tok.ExpiresAt.In(time.Local).Format(timeLayout))
+	fmt.Printf("\nThe token is shown only this once; it can't be "+
+		"recovered later:\n\n    %s\n\n", secret)
+	return nil
+}
+
+func listIntegrationTokens(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	siteUUID, err := uuid.FromString(args[0])
+	if err != nil {
+		return err
+	}
+
+	db, _, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	toks, err := db.SiteIntegrationTokensBySite(ctx, siteUUID)
+	if err != nil {
+		return err
+	}
+
+	table, _ := prettytable.NewTable(
+		prettytable.Column{Header: "UUID"},
+		prettytable.Column{Header: "Name"},
+		prettytable.Column{Header: "Scopes"},
+		prettytable.Column{Header: "Created By"},
+		prettytable.Column{Header: "Created"},
+		prettytable.Column{Header: "Expires"},
+		prettytable.Column{Header: "Last Used"},
+		prettytable.Column{Header: "Status"},
+	)
+	table.Separator = "  "
+
+	now := time.Now()
+	for _, tok := range toks {
+		lastUsed := "-"
+		if tok.LastUsed.Valid {
+			lastUsed = tok.LastUsed.Time.In(time.Local).Format(timeLayout)
+		}
+		status := "active"
+		if tok.RevokedAt.Valid {
+			status = "revoked"
+		} else if !tok.Active(now) {
+			status = "expired"
+		}
+		table.AddRow(tok.UUID, tok.Name, strings.Join(tok.Scopes, ","),
+			tok.CreatedBy,
+			tok.CreatedAt.In(time.Local).Format(timeLayout),
+			tok.ExpiresAt.In(time.Local).Format(timeLayout),
+			lastUsed, status)
+	}
+	table.Print()
+	return nil
+}
+
+func revokeIntegrationToken(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	siteUUID, err := uuid.FromString(args[0])
+	if err != nil {
+		return err
+	}
+	tokUUID, err := uuid.FromString(args[1])
+	if err != nil {
+		return err
+	}
+
+	db, _, err := assembleRegistry(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err = db.RevokeSiteIntegrationToken(ctx, siteUUID, tokUUID); err != nil {
+		return err
+	}
+	fmt.Printf("Revoked integration token %s\n", tokUUID)
+	return nil
+}
+
 func siteMain(rootCmd *cobra.Command) {
 	siteCmd := &cobra.Command{
 		Use:   "site <subcmd> [flags] [args]",
@@ -236,5 +658,114 @@ func siteMain(rootCmd *cobra.Command) {
 	setSiteCmd.Flags().StringP("name", "n", "", "set site name")
 	setSiteCmd.Flags().StringP("org-uuid", "", "", "set site's organization uuid")
 	siteCmd.AddCommand(setSiteCmd)
-}
 
+	archiveSiteCmd := &cobra.Command{
+		Use:   "archive [flags] <uuid>",
+		Args:  cobra.ExactArgs(1),
+		Short: "Archive a site, leaving it out of health reporting and refusing it commands",
+		RunE:  archiveSite,
+	}
+	archiveSiteCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	siteCmd.AddCommand(archiveSiteCmd)
+
+	unarchiveSiteCmd := &cobra.Command{
+		Use:   "unarchive [flags] <uuid>",
+		Args:  cobra.ExactArgs(1),
+		Short: "Return an archived site to normal operation",
+		RunE:  archiveSite,
+	}
+	unarchiveSiteCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	siteCmd.AddCommand(unarchiveSiteCmd)
+
+	checkpointCmd := &cobra.Command{
+		Use:   "checkpoint <subcmd> [flags] [args]",
+		Short: "Administer site configuration checkpoints",
+		Args:  cobra.NoArgs,
+	}
+	siteCmd.AddCommand(checkpointCmd)
+
+	createCheckpointCmd := &cobra.Command{
+		Use:   "create [flags] <site-uuid> <name>",
+		Args:  cobra.ExactArgs(2),
+		Short: "Checkpoint a site's current configuration",
+		RunE:  createCheckpoint,
+	}
+	createCheckpointCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	createCheckpointCmd.Flags().StringP("actor", "a", "", "who is creating the checkpoint (default: current user)")
+	checkpointCmd.AddCommand(createCheckpointCmd)
+
+	listCheckpointCmd := &cobra.Command{
+		Use:   "list [flags] <site-uuid>",
+		Args:  cobra.ExactArgs(1),
+		Short: "List a site's configuration checkpoints",
+		RunE:  listCheckpoints,
+	}
+	listCheckpointCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	checkpointCmd.AddCommand(listCheckpointCmd)
+
+	showCheckpointCmd := &cobra.Command{
+		Use:   "show [flags] <site-uuid> <checkpoint-id>",
+		Args:  cobra.ExactArgs(2),
+		Short: "Show a checkpoint and the commands restoring it would undo",
+		RunE:  showCheckpoint,
+	}
+	showCheckpointCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	showCheckpointCmd.Flags().StringP("output", "o", "", "write the checkpointed config to this file")
+	checkpointCmd.AddCommand(showCheckpointCmd)
+
+	verifyConfigCmd := &cobra.Command{
+		Use:   "verify-config [flags] <site-uuid>",
+		Args:  cobra.ExactArgs(1),
+		Short: "Compare a site's cloud-cached config tree with the appliance's",
+		RunE:  verifyConfig,
+	}
+	verifyConfigCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	verifyConfigCmd.Flags().StringP("snapshot", "s", "", "compare against this saved appliance tree (e.g. from 'cq get -v'), rather than asking the appliance")
+	verifyConfigCmd.Flags().DurationP("timeout", "t", 30*time.Second,
+		"how long to wait for the appliance to send its tree")
+	verifyConfigCmd.Flags().BoolP("verbose", "v", false, "list volatile differences too")
+	siteCmd.AddCommand(verifyConfigCmd)
+
+	tokenCmd := &cobra.Command{
+		Use:   "integration-token <subcmd> [flags] [args]",
+		Short: "Administer tokens with which external systems export site data",
+		Args:  cobra.NoArgs,
+	}
+	siteCmd.AddCommand(tokenCmd)
+
+	createTokenCmd := &cobra.Command{
+		Use:   "create [flags] <site-uuid> <name>",
+		Args:  cobra.ExactArgs(2),
+		Short: "Create an integration token; it is displayed only once",
+		RunE:  createIntegrationToken,
+	}
+	createTokenCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	createTokenCmd.Flags().StringP("actor", "a", "", "who is creating the token (default: current user)")
+	createTokenCmd.Flags().StringSliceP("scope", "s",
+		[]string{appliancedb.IntegrationScopeEvents},
+		"data the token may export ("+
+			strings.Join(appliancedb.IntegrationScopes, "|")+")")
+	createTokenCmd.Flags().DurationP("duration", "d", 90*24*time.Hour,
+		"how long the token remains valid")
+	tokenCmd.AddCommand(createTokenCmd)
+
+	listTokenCmd := &cobra.Command{
+		Use:   "list [flags] <site-uuid>",
+		Args:  cobra.ExactArgs(1),
+		Short: "List a site's integration tokens",
+		RunE:  listIntegrationTokens,
+	}
+	listTokenCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	tokenCmd.AddCommand(listTokenCmd)
+
+	revokeTokenCmd := &cobra.Command{
+		Use:   "revoke [flags] <site-uuid> <token-uuid>",
+		Args:  cobra.ExactArgs(2),
+		Short: "Revoke an integration token",
+		RunE:  revokeIntegrationToken,
+	}
+	revokeTokenCmd.Flags().StringP("input", "i", "", "registry data JSON file")
+	tokenCmd.AddCommand(revokeTokenCmd)
+
+	siteCmd.AddCommand(noteCmd("site", appliancedb.SiteNoteSubject))
+}
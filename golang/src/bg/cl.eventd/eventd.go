@@ -34,6 +34,7 @@ import (
 	"bg/base_def"
 	"bg/cl_common/daemonutils"
 	"bg/cl_common/deviceinfo"
+	"bg/cl_common/push"
 	"bg/cloud_models/appliancedb"
 	"bg/cloud_rpc"
 
@@ -62,6 +63,7 @@ type Cfg struct {
 	PostgresConnection string `envcfg:"B10E_CLEVENTD_POSTGRES_CONNECTION"`
 	PubsubProject      string `envcfg:"B10E_CLEVENTD_PUBSUB_PROJECT"`
 	PubsubTopic        string `envcfg:"B10E_CLEVENTD_PUBSUB_TOPIC"`
+	PushEnabled        bool   `envcfg:"B10E_CLEVENTD_PUSH_ENABLED"`
 }
 
 const (
@@ -75,8 +77,13 @@ var (
 	slog *zap.SugaredLogger
 
 	getStorageClient func(context.Context) (*storage.Client, error) = getRealStorageClient
+
+	// Push notification dispatcher; nil if push notifications are disabled
+	pusher *push.Dispatcher
 )
 
+const pushPruneInterval = 24 * time.Hour
+
 const gcsBaseURL = "gs://"
 
 func getRealStorageClient(ctx context.Context) (*storage.Client, error) {
@@ -195,6 +202,76 @@ func exceptionMessage(ctx context.Context, applianceDB appliancedb.DataStore,
 	if err != nil {
 		slog.Errorw("Failed net exception insert", "error", err)
 	}
+
+	if pusher != nil {
+		notifyException(ctx, applianceDB, siteUUID, exc)
+	}
+}
+
+// Name of the notification template used for client exceptions
+const netExceptionTemplate = "net-exception"
+
+// notifyException sends a push notification about a client exception to the
+// accounts belonging to the organization which owns the site, each in the
+// account's own language.
+func notifyException(ctx context.Context, applianceDB appliancedb.DataStore,
+	siteUUID uuid.UUID, exc *cloud_rpc.NetException) {
+
+	slog := slog.With("site_uuid", siteUUID)
+
+	site, err := applianceDB.CustomerSiteByUUID(ctx, siteUUID)
+	if err != nil {
+		slog.Errorw("failed to look up site for notification", "error", err)
+		return
+	}
+	accounts, err := applianceDB.AccountsByOrganization(ctx,
+		site.OrganizationUUID)
+	if err != nil {
+		slog.Errorw("failed to look up accounts for notification",
+			"error", err)
+		return
+	}
+
+	message := exc.GetMessage()
+	if message == "" {
+		message = exc.GetReason()
+	}
+	vars := map[string]string{
+		"site":    site.Name,
+		"message": message,
+	}
+	data := map[string]string{
+		"site_uuid": siteUUID.String(),
+		"reason":    exc.GetReason(),
+	}
+	res, err := pusher.DispatchTemplate(ctx, accounts, netExceptionTemplate,
+		vars, data)
+	if err != nil {
+		slog.Errorw("failed to dispatch push notifications", "error", err)
+	}
+	slog.Infow("dispatched push notifications", "sent", res.Sent,
+		"disabled", res.Disabled, "failed", res.Failed)
+}
+
+// pushPruneLoop periodically deletes stale push tokens, until the context is
+// canceled
+func pushPruneLoop(ctx context.Context) {
+	ticker := time.NewTicker(pushPruneInterval)
+	defer ticker.Stop()
+	for {
+		n, err := pusher.Prune(ctx)
+		if err != nil {
+			slog.Errorw("failed to prune push tokens", "error", err)
+		} else if n > 0 {
+			slog.Infof("pruned %d stale push tokens", n)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
 func upgradeMessage(ctx context.Context, applianceDB appliancedb.DataStore,
@@ -436,6 +513,13 @@ func main() {
 		stores: []deviceinfo.Store{cloudStore},
 	}
 
+	if environ.PushEnabled {
+		pusher = push.NewDispatcher(applianceDB,
+			push.DefaultProviders(slog), slog)
+		go pushPruneLoop(ctx)
+		slog.Infof(checkMark + "Push notifications enabled")
+	}
+
 	pubsubClient, err := pubsub.NewClient(ctx, environ.PubsubProject)
 	if err != nil {
 		slog.Fatalf("failed to make client: %v", err)
@@ -889,6 +889,74 @@ func (a *accountHandler) deleteAccountWGSiteMac(c echo.Context) error {
 	return nil
 }
 
+type apiPushToken struct {
+	Platform   string `json:"platform"`
+	Token      string `json:"token"`
+	AppVersion string `json:"appVersion"`
+}
+
+// bindPushToken extracts the push token from the request, and associates it
+// with the session's account
+func bindPushToken(c echo.Context) (*appliancedb.PushToken, error) {
+	accountUUID, ok := c.Get("account_uuid").(uuid.UUID)
+	if !ok || accountUUID == uuid.Nil {
+		return nil, newHTTPError(http.StatusUnauthorized)
+	}
+
+	var req apiPushToken
+	if err := c.Bind(&req); err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, err)
+	}
+	if req.Platform != appliancedb.PushPlatformIOS &&
+		req.Platform != appliancedb.PushPlatformAndroid {
+		return nil, newHTTPError(http.StatusBadRequest,
+			"unknown platform")
+	}
+	if req.Token == "" {
+		return nil, newHTTPError(http.StatusBadRequest, "missing token")
+	}
+
+	tok := &appliancedb.PushToken{
+		AccountUUID: accountUUID,
+		Platform:    req.Platform,
+		Token:       req.Token,
+		AppVersion:  req.AppVersion,
+	}
+	return tok, nil
+}
+
+// postAccountPushToken implements POST /api/account/push-tokens, which the
+// mobile app uses to register its push token for the session's account.
+// Registering a token which is already registered just refreshes it.
+func (a *accountHandler) postAccountPushToken(c echo.Context) error {
+	ctx := c.Request().Context()
+	tok, err := bindPushToken(c)
+	if err != nil {
+		return err
+	}
+	if err = a.db.RegisterPushToken(ctx, tok); err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// deleteAccountPushToken implements DELETE /api/account/push-tokens, which
+// stops push notifications being sent to the token.
+func (a *accountHandler) deleteAccountPushToken(c echo.Context) error {
+	ctx := c.Request().Context()
+	tok, err := bindPushToken(c)
+	if err != nil {
+		return err
+	}
+	err = a.db.DisablePushToken(ctx, tok)
+	if _, ok := err.(appliancedb.NotFoundError); ok {
+		return newHTTPError(http.StatusNotFound)
+	} else if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
 // newAccountAPIHandler creates an accountHandler for the given DataStore and session
 // Store, and routes the handler into the echo instance.
 func newAccountHandler(r *echo.Echo, db appliancedb.DataStore,
@@ -905,6 +973,8 @@ func newAccountHandler(r *echo.Echo, db appliancedb.DataStore,
 	user := h.mkAccountMiddleware([]string{"admin", "user"})
 
 	acct.GET("/passwordgen", h.getAccountPasswordGen)
+	acct.POST("/push-tokens", h.postAccountPushToken)
+	acct.DELETE("/push-tokens", h.deleteAccountPushToken)
 	acct.DELETE("/:acct_uuid", h.deleteAccount, admin)
 	acct.GET("/:acct_uuid/avatar", h.getAccountAvatar, user)
 	acct.GET("/:acct_uuid/selfprovision", h.getAccountSelfProvision, user)
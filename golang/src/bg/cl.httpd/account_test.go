@@ -354,6 +354,63 @@ func TestAccountsRoles(t *testing.T) {
 	}
 }
 
+func TestAccountsPushTokens(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	isToken := func(token string) interface{} {
+		return mock.MatchedBy(func(tok *appliancedb.PushToken) bool {
+			return tok.AccountUUID == mockAccount.UUID &&
+				tok.Platform == appliancedb.PushPlatformIOS &&
+				tok.Token == token
+		})
+	}
+	dMock := &mocks.DataStore{}
+	dMock.On("RegisterPushToken", mock.Anything, isToken("tok1")).Return(nil).Twice()
+	dMock.On("DisablePushToken", mock.Anything, isToken("tok1")).Return(nil).Once()
+	dMock.On("DisablePushToken", mock.Anything, isToken("tok2")).Return(
+		appliancedb.NotFoundError{}).Once()
+	defer dMock.AssertExpectations(t)
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newAccountHandler(e, dMock, mw, ss, nil, getMockClientHandle)
+
+	do := func(method, body string) int {
+		req, rec := setupReqRec(&mockAccount, method,
+			"/api/account/push-tokens", strings.NewReader(body), ss)
+		req.Header.Add("Content-Type", "application/json")
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Registering the same token twice is fine
+	tok1 := `{"platform": "ios", "token": "tok1", "appVersion": "1.0"}`
+	assert.Equal(http.StatusOK, do(echo.POST, tok1))
+	assert.Equal(http.StatusOK, do(echo.POST, tok1))
+
+	// Bad requests don't make it to the database
+	assert.Equal(http.StatusBadRequest,
+		do(echo.POST, `{"platform": "palm", "token": "tok1"}`))
+	assert.Equal(http.StatusBadRequest,
+		do(echo.POST, `{"platform": "android", "token": ""}`))
+
+	assert.Equal(http.StatusOK, do(echo.DELETE, tok1))
+	assert.Equal(http.StatusNotFound,
+		do(echo.DELETE, `{"platform": "ios", "token": "tok2"}`))
+
+	// Tokens can only be managed by a logged in account
+	req := httptest.NewRequest(echo.POST, "/api/account/push-tokens",
+		strings.NewReader(tok1))
+	req.Header.Add("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+}
+
 func TestAccountsAvatar(t *testing.T) {
 	assert := require.New(t)
 	// Mock DB
@@ -234,13 +234,25 @@ func (a *authHandler) getAuth(c echo.Context) error {
 	return c.HTML(http.StatusOK, html)
 }
 
-// getProvider implements /auth/:provider, which starts the oauth flow.
+// getProvider implements /auth/:provider, which starts the oauth flow.  An
+// invitation token may be passed as the 'invite' parameter; if the user has
+// no account yet, they accept the invitation when they complete the flow.
 func (a *authHandler) getProvider(c echo.Context) error {
 	// Transfer the provider name to the Go context.  Done so that
 	// gothic can determine the provider name later.  This is done
 	// by our override of gothic.GetProviderName, getProviderName.
 	// Yes, this is annoying and complicated.
 	providerToGoContext(c)
+	if token := c.QueryParam("invite"); token != "" {
+		session, err := a.sessionStore.Get(c.Request(), sessionCookieName)
+		if err != nil && session == nil {
+			return newHTTPError(http.StatusInternalServerError, err)
+		}
+		session.Values["invite_token"] = token
+		if err = session.Save(c.Request(), c.Response()); err != nil {
+			return newHTTPError(http.StatusInternalServerError, err)
+		}
+	}
 	// try to get the user without re-authenticating
 	user, err := gothic.CompleteUserAuth(c.Response(), c.Request())
 	if err != nil {
@@ -315,16 +327,9 @@ func (e useridError) Unwrap() error {
 	return e.WrappedError
 }
 
-// findOrganization does three tests against the incoming user, looking
-// at the OAuth2Organization Rules.
-//
-// 1. If we can extract a tenant ID for the user, see if there is an matching
-// provider/tenant in the rules table.  This is by far the best and most secure
-// method, and what we expect to use in production most of the time.
-// 2. If email address is present, extract the domain name and see if there is
-// a matching provider/domain in the rules table.
-// 3. If email address is present, see if there is a matching email address
-// in the rules table.
+// findOrganization tests the incoming user against the OAuth2Organization
+// Rules, as described in appliancedb.MatchOAuth2OrganizationRule.  If we can
+// extract a tenant ID for the user, it is preferred to the email address.
 func (a *authHandler) findOrganization(ctx context.Context, c echo.Context,
 	user goth.User) (uuid.UUID, error) {
 
@@ -343,33 +348,17 @@ func (a *authHandler) findOrganization(ctx context.Context, c echo.Context,
 		}
 	}
 
-	if tenant != "" {
-		rule, err := a.db.OAuth2OrganizationRuleTest(ctx,
-			user.Provider, appliancedb.RuleTypeTenant, tenant)
-		if err == nil {
-			return rule.OrganizationUUID, nil
-		}
-	}
-
-	// Next see if there is a domain level rule for the user
-	_, domainPart, err := splitEmail(user.Email)
-	if err == nil && domainPart != "" {
-		rule, err := a.db.OAuth2OrganizationRuleTest(ctx,
-			user.Provider, appliancedb.RuleTypeDomain, domainPart)
-		if err == nil {
-			return rule.OrganizationUUID, nil
-		}
+	lookup := func(provider string, ruleType appliancedb.OAuth2OrgRuleType,
+		ruleValue string) (*appliancedb.OAuth2OrganizationRule, error) {
+		return a.db.OAuth2OrganizationRuleTest(ctx, provider, ruleType, ruleValue)
 	}
-
-	// Finally, see if there is an email address level rule for the user
-	if user.Email != "" {
-		rule, err := a.db.OAuth2OrganizationRuleTest(ctx,
-			user.Provider, appliancedb.RuleTypeEmail, user.Email)
-		if err == nil {
-			return rule.OrganizationUUID, nil
-		}
+	rule, err := appliancedb.MatchOAuth2OrganizationRule(user.Provider,
+		tenant, user.Email, lookup)
+	if err == nil {
+		return rule.OrganizationUUID, nil
 	}
 
+	_, domainPart, _ := splitEmail(user.Email)
 	c.Logger().Warnf("findOrganization: No rules matched provider=%q tenant=%q domain=%q email=%q",
 		user.Provider, tenant, domainPart, user.Email)
 	return uuid.Nil, useridError{reasonNoOauthRuleMatch, user.Email, user.Provider, tenant, nil}
@@ -591,9 +580,16 @@ func (a *authHandler) updateAccountPhone(c echo.Context, user goth.User, li *app
 	if phoneNumber == li.Account.PhoneNumber {
 		return nil
 	}
+	oldNumber := li.Account.PhoneNumber
 	li.Account.PhoneNumber = phoneNumber
 	err = a.db.UpdateAccount(ctx, &li.Account)
-	if err != nil {
+	if _, ok := err.(appliancedb.ValidationError); ok {
+		// The provider's number is unusable; keep the one we have.
+		c.Logger().Infof("Ignoring phone number for %s|%s: %s",
+			user.Provider, user.UserID, err)
+		li.Account.PhoneNumber = oldNumber
+		return nil
+	} else if err != nil {
 		return errors.Wrapf(err, "Failed to update account for %s|%s", user.Provider, user.UserID)
 	}
 	return nil
@@ -713,6 +709,63 @@ func (a *authHandler) mkNewAccount(c echo.Context, user goth.User) (*appliancedb
 		context.TODO(), user.Provider, user.UserID)
 }
 
+// mkInvitedAccount creates an account for a user who has no account yet,
+// but who has been invited to join an organization.  The invitation decides
+// the account's organization and role, in place of the OAuth2 organization
+// rules.  If the invitation can't be accepted, the rules are used instead.
+func (a *authHandler) mkInvitedAccount(c echo.Context, user goth.User,
+	token string) (*appliancedb.LoginInfo, error) {
+
+	ctx := c.Request().Context()
+
+	person := &appliancedb.Person{
+		UUID:         uuid.NewV4(),
+		Name:         user.Name,
+		PrimaryEmail: user.Email,
+	}
+
+	account := &appliancedb.Account{
+		UUID:        uuid.NewV4(),
+		Email:       user.Email,
+		PhoneNumber: "",       // loaded in post-login phase
+		AvatarHash:  []byte{}, // loaded in post-login phase
+		PersonUUID:  person.UUID,
+	}
+
+	oauth2ID := &appliancedb.OAuth2Identity{
+		Subject:  user.UserID,
+		Provider: user.Provider,
+	}
+
+	inv, err := a.db.CreateInvitedAccount(ctx, token, person, account,
+		oauth2ID)
+	if _, ok := err.(appliancedb.NotFoundError); ok {
+		c.Logger().Warnf("Invitation for '%s' <%s> (%s|%s) can't be "+
+			"accepted: %s", user.Name, user.Email, user.Provider,
+			user.UserID, err)
+		return a.mkNewAccount(c, user)
+	} else if err != nil {
+		return nil, err
+	}
+	c.Logger().Infof("Created new account for '%s' <%s> (%s|%s) from "+
+		"invitation %s to %s", user.Name, user.Email, user.Provider,
+		user.UserID, inv.UUID, inv.OrganizationUUID)
+
+	return a.db.LoginInfoByProviderAndSubject(ctx, user.Provider,
+		user.UserID)
+}
+
+// inviteToken returns the invitation token, if any, with which the user began
+// logging in
+func (a *authHandler) inviteToken(c echo.Context) string {
+	session, _ := a.sessionStore.Get(c.Request(), sessionCookieName)
+	if session == nil {
+		return ""
+	}
+	token, _ := session.Values["invite_token"].(string)
+	return token
+}
+
 func (a *authHandler) getLoginInfo(c echo.Context, user goth.User) (*appliancedb.LoginInfo, error) {
 	// See if we can find an organization for this user.
 	var err error
@@ -735,7 +788,11 @@ func (a *authHandler) getLoginInfo(c echo.Context, user goth.User) (*appliancedb
 	loginInfo, err := a.db.LoginInfoByProviderAndSubject(
 		ctx, user.Provider, user.UserID)
 	if _, ok := err.(appliancedb.NotFoundError); ok {
-		loginInfo, err = a.mkNewAccount(c, user)
+		if token := a.inviteToken(c); token != "" {
+			loginInfo, err = a.mkInvitedAccount(c, user, token)
+		} else {
+			loginInfo, err = a.mkNewAccount(c, user)
+		}
 	}
 	if err != nil {
 		return loginInfo, err
@@ -859,6 +916,7 @@ func (a *authHandler) getProviderCallback(c echo.Context) error {
 	session.Values["account_uuid"] = loginInfo.Account.UUID.String()
 	session.Values["organization_uuid"] = loginInfo.Account.OrganizationUUID.String()
 	session.Values["primary_org_roles"] = loginInfo.PrimaryOrgRoles
+	delete(session.Values, "invite_token")
 
 	if err = session.Save(c.Request(), c.Response()); err != nil {
 		return newHTTPError(http.StatusInternalServerError, err)
@@ -1000,7 +1058,9 @@ func newSessionMiddleware(sessionStore sessions.Store) *sessionMiddleware {
 }
 
 // Process checks that the user has a valid login session, and places the
-// account_uuid into the echo context for use in subsequent handlers.
+// account_uuid into the echo context for use in subsequent handlers.  If the
+// session is a support session, the organization being supported is placed
+// there as support_org_uuid.
 func (sm *sessionMiddleware) Process(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		session, err := sm.sessionStore.Get(c.Request(), sessionCookieName)
@@ -1016,6 +1076,11 @@ func (sm *sessionMiddleware) Process(next echo.HandlerFunc) echo.HandlerFunc {
 			return newHTTPError(http.StatusUnauthorized)
 		}
 		c.Set("account_uuid", accountUUID)
+		if so, ok := session.Values["support_org_uuid"].(string); ok {
+			if supportOrg, err := uuid.FromString(so); err == nil {
+				c.Set("support_org_uuid", supportOrg)
+			}
+		}
 		return next(c)
 	}
 }
@@ -32,6 +32,7 @@ type checkResponse struct {
 	ApplianceDBStatus string   `json:"applianceDBStatus"`
 	SessionDBStatus   string   `json:"sessionDBStatus"`
 	ConfigdStatus     string   `json:"configdStatus"`
+	ConfigdLatencyMs  float64  `json:"configdLatencyMs"`
 	EnvironProblems   []string `json:"environProblems"`
 }
 
@@ -115,8 +116,10 @@ func (h *checkHandler) getCheckProduction(c echo.Context) error {
 	} else {
 		ctx, cancel := context.WithTimeout(c.Request().Context(), time.Duration(time.Second)*3)
 		defer cancel()
-		err = hdl.Ping(ctx)
+		var rtt time.Duration
+		rtt, err = hdl.PingTimed(ctx)
 		hdl.Close()
+		r.ConfigdLatencyMs = float64(rtt) / float64(time.Millisecond)
 		if err != nil {
 			c.Logger().Errorf("configd ping failed: %v", err)
 			r.ConfigdStatus = err.Error()
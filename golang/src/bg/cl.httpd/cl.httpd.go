@@ -32,6 +32,7 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -109,6 +110,15 @@ type Cfg struct {
 	ApplianceDB       string `envcfg:"B10E_CLHTTPD_POSTGRES_APPLIANCEDB"`
 	ConfigdConnection string `envcfg:"B10E_CLHTTPD_CLCONFIGD_CONNECTION"`
 	AvatarBucket      string `envcfg:"B10E_CLHTTPD_AVATAR_BUCKET"`
+	// Region used to interpret account phone numbers lacking a country code
+	PhoneRegion string `envcfg:"B10E_CLHTTPD_PHONE_REGION"`
+	// If non-zero, cache hot registry lookups (sites and organizations by
+	// UUID, etc.) for this many seconds; this bounds how long a change made
+	// by another process may go unseen.
+	DBCacheTTL int `envcfg:"B10E_CLHTTPD_DB_CACHE_TTL"`
+	// Comma separated CIDR blocks of the load balancers in front of us;
+	// X-Forwarded-For is only believed in requests which come from them.
+	TrustedProxies string `envcfg:"B10E_CLHTTPD_TRUSTED_PROXIES"`
 	// Whether to Disable TLS for outbound connections to cl.configd
 	ConfigdDisableTLS bool   `envcfg:"B10E_CLHTTPD_CLCONFIGD_DISABLE_TLS"`
 	AppPath           string `enccfg:"B10E_CLHTTPD_APP"`
@@ -118,6 +128,7 @@ type kvSecrets struct {
 	SessionSecret       string `envcfg:"B10E_CLHTTPD_SESSION_SECRET" vault:"session/secret"`
 	SessionBlockSecret  string `envcfg:"B10E_CLHTTPD_SESSION_BLOCK_SECRET" vault:"session/block_secret"`
 	AccountSecret       string `envcfg:"B10E_CLHTTPD_ACCOUNT_SECRET" vault:"account/secret"`
+	GuestPhoneSecret    string `envcfg:"B10E_CLHTTPD_GUEST_PHONE_SECRET" vault:"guest/phone_secret"`
 	GoogleKey           string `envcfg:"B10E_CLHTTPD_GOOGLE_KEY" vault:"google/key"`
 	GoogleSecret        string `envcfg:"B10E_CLHTTPD_GOOGLE_SECRET" vault:"google/secret"`
 	Auth0Key            string `envcfg:"B10E_CLHTTPD_AUTH0_KEY" vault:"auth0/key"`
@@ -147,6 +158,7 @@ var (
 	lbName           string
 	useVaultForDB    bool
 	useVaultForKV    bool
+	trustedProxies   []*net.IPNet
 )
 
 func gracefulShutdown(e *echo.Echo) {
@@ -277,11 +289,13 @@ type routerState struct {
 	sessionStore    *pgstore.PGStore
 	sessCleanupDone chan<- struct{}
 	sessCleanupQuit <-chan struct{}
+	usage           *usageMeter
 	echo            *echo.Echo
 	logger          *zap.SugaredLogger
 }
 
 func (rs *routerState) Fini(ctx context.Context) {
+	rs.usage.Stop()
 	rs.applianceDB.Close()
 	rs.sessionStore.StopCleanup(rs.sessCleanupDone, rs.sessCleanupQuit)
 	rs.sessionStore.Close()
@@ -366,6 +380,13 @@ func (rs *routerState) mkApplianceDB(vaultClient *vault.Client, notifier *daemon
 	}
 	log.Infof(checkMark + "Pinged Appliance DB")
 
+	if environ.DBCacheTTL > 0 {
+		ttl := time.Duration(environ.DBCacheTTL) * time.Second
+		rs.applianceDB = appliancedb.NewCachedDataStore(rs.applianceDB,
+			appliancedb.CacheOptions{TTL: ttl})
+		log.Infof(checkMark+"Caching Appliance DB lookups for %v", ttl)
+	}
+
 	// Setup Account Secrets
 	if secrets.AccountSecret == "" {
 		log.Fatalf("Must specify B10E_CLHTTPD_ACCOUNT_SECRET")
@@ -376,12 +397,28 @@ func (rs *routerState) mkApplianceDB(vaultClient *vault.Client, notifier *daemon
 	}
 	rs.applianceDB.AccountSecretsSetPassphrase(accountSecret)
 	log.Infof(checkMark + "Appliance Secrets")
+
+	// Setup the key for hashing guest phone numbers
+	if secrets.GuestPhoneSecret == "" {
+		log.Fatalf("Must specify B10E_CLHTTPD_GUEST_PHONE_SECRET")
+	}
+	guestPhoneSecret, err := hex.DecodeString(secrets.GuestPhoneSecret)
+	if err != nil || len(guestPhoneSecret) != 32 {
+		log.Fatalf("Failed to decode B10E_CLHTTPD_GUEST_PHONE_SECRET; should be hex encoded and 32 bytes long %d", len(guestPhoneSecret))
+	}
+	rs.applianceDB.GuestEnrollSetPhoneKey(guestPhoneSecret)
+	log.Infof(checkMark + "Guest Phone Secret")
+
+	if environ.PhoneRegion != "" {
+		rs.applianceDB.AccountSetPhoneRegion(environ.PhoneRegion)
+	}
 }
 
 func mkEchoZapLogger(zlog *zap.Logger) echo.MiddlewareFunc {
 	// Mostly the default fields, but we skip time, which is already emitted
 	// by zap, and id, which is always empty.  We add the GCLB cookie, which
-	// is how the load-balancing works.
+	// is how the load-balancing works.  Invitation tokens are kept out of
+	// the logged URI.
 	m := []echozap.Field{
 		echozap.CookieField("GCLB"),
 		echozap.CoreField("remote_ip"),
@@ -396,7 +433,7 @@ func mkEchoZapLogger(zlog *zap.Logger) echo.MiddlewareFunc {
 		echozap.CoreField("bytes_in"),
 		echozap.CoreField("bytes_out"),
 	}
-	return echozap.Logger(zlog, m)
+	return echozap.RedactingLogger(zlog, m, redactInviteToken)
 }
 
 func mkRouterHTTPS(log *zap.Logger, vaultClient *vault.Client, notifier *daemonutils.FanOut) *routerState {
@@ -423,6 +460,8 @@ func mkRouterHTTPS(log *zap.Logger, vaultClient *vault.Client, notifier *daemonu
 	state.logger = slog
 	state.mkSessionStore(vaultClient, notifier)
 	state.mkApplianceDB(vaultClient, notifier)
+	state.usage = newUsageMeter(state.applianceDB, slog.Named("usage"),
+		usageFlushInterval)
 
 	// Configd setup
 	enableConfigdTLS = !environ.ConfigdDisableTLS && !environ.Developer
@@ -455,6 +494,7 @@ func mkRouterHTTPS(log *zap.Logger, vaultClient *vault.Client, notifier *daemonu
 	r.Use(middleware.Recover())
 	r.Use(session.Middleware(state.sessionStore))
 	r.Use(middleware.Gzip())
+	r.Use(state.usage.Middleware)
 	r.Static("/.well-known", wellKnownPath)
 	cwp := filepath.Join(appPath, "client-web")
 	r.Static("/client-web", cwp)
@@ -511,6 +551,13 @@ func mkRouterHTTPS(log *zap.Logger, vaultClient *vault.Client, notifier *daemonu
 	_ = newAccountHandler(r, state.applianceDB, wares, state.sessionStore, avBucket, getConfigClientHandle)
 	_ = newOrgHandler(r, state.applianceDB, wares, state.sessionStore)
 	_ = newAccessHandler(r, state.applianceDB, state.sessionStore)
+	_ = newIntegrationHandler(r, state.applianceDB, getConfigClientHandle)
+
+	trustedProxies, err = parseTrustedProxies(environ.TrustedProxies)
+	if err != nil {
+		slog.Fatalf("bad B10E_CLHTTPD_TRUSTED_PROXIES: %v", err)
+	}
+	_ = newDiagHandler(r)
 
 	// Setup /check endpoints
 	_ = newCheckHandler(&state, getConfigClientHandle)
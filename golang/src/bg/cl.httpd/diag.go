@@ -0,0 +1,426 @@
+//
+// Copyright 2020 Brightgate Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+//
+
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bg/common/cfgapi"
+
+	"github.com/labstack/echo"
+	"golang.org/x/time/rate"
+)
+
+// The echo endpoint is unauthenticated, so each source may only make a few
+// requests in a burst, and then one a second.  The overall limit bounds the
+// load from sources we can't tell apart, and how many we'll keep track of.
+const (
+	echoSourceRate   = rate.Limit(1)
+	echoSourceBurst  = 5
+	echoOverallRate  = rate.Limit(100)
+	echoOverallBurst = 200
+	echoSourceIdle   = 10 * time.Minute
+	echoMaxSources   = 10000
+)
+
+// A connectivity check is requested by setting diagConnRequestProp to a
+// request ID (the time of the request).  The appliance's diag agent runs its
+// checks, and reports the results under diagConnResultsProp:
+//
+//   request               the ID of the request being answered
+//   completed             when the checks finished
+//   clock_skew_ms         appliance clock minus the echo endpoint's
+//   checks/<name>/ok      "true" or "false"
+//   checks/<name>/detail  a description of what was found
+//
+// Results are reported through @/metrics, whose cloud copy is only refreshed
+// while it is being read, so the appliance is allowed a generous time to
+// respond.
+const (
+	diagConnRequestProp = "@/diag/connectivity/request"
+	diagConnResultsProp = "@/metrics/diag/connectivity"
+	diagConnTimeout     = 2 * time.Minute
+	diagConnResultsTTL  = 10 * time.Minute
+)
+
+// States of a site's connectivity check
+const (
+	diagPending  = "pending"
+	diagComplete = "complete"
+	diagTimeout  = "timeout"
+)
+
+// sourceLimiter rate limits requests by their source address.
+type sourceLimiter struct {
+	perSource  rate.Limit
+	burst      int
+	idle       time.Duration
+	maxSources int
+	overall    *rate.Limiter
+
+	sync.Mutex
+	sources map[string]*sourceLimit
+	swept   time.Time
+}
+
+type sourceLimit struct {
+	*rate.Limiter
+	lastSeen time.Time
+}
+
+func newSourceLimiter(perSource rate.Limit, burst int, overall rate.Limit,
+	overallBurst int) *sourceLimiter {
+
+	return &sourceLimiter{
+		perSource:  perSource,
+		burst:      burst,
+		idle:       echoSourceIdle,
+		maxSources: echoMaxSources,
+		overall:    rate.NewLimiter(overall, overallBurst),
+		sources:    make(map[string]*sourceLimit),
+	}
+}
+
+// allow reports whether a request from the given source may proceed at the
+// given time.  While the limiter is tracking as many sources as it is willing
+// to, requests from new sources are refused.
+func (l *sourceLimiter) allow(source string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	// Sources we haven't heard from in a while would have a full bucket
+	// anyway, so needn't be remembered.
+	if now.Sub(l.swept) > l.idle {
+		for s, sl := range l.sources {
+			if now.Sub(sl.lastSeen) > l.idle {
+				delete(l.sources, s)
+			}
+		}
+		l.swept = now
+	}
+
+	sl := l.sources[source]
+	if sl == nil {
+		// A new source is only remembered if the request is allowed
+		// overall, so that a flood of them can't crowd out the rest.
+		if len(l.sources) >= l.maxSources ||
+			!l.overall.AllowN(now, 1) {
+			return false
+		}
+		sl = &sourceLimit{Limiter: rate.NewLimiter(l.perSource, l.burst)}
+		sl.lastSeen = now
+		l.sources[source] = sl
+		return sl.AllowN(now, 1)
+	}
+	sl.lastSeen = now
+
+	return sl.AllowN(now, 1) && l.overall.AllowN(now, 1)
+}
+
+// Middleware refuses requests from sources which have exceeded their limit
+func (l *sourceLimiter) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !l.allow(clientIP(c.Request()), time.Now()) {
+			c.Response().Header().Set("Retry-After", "1")
+			return newHTTPError(http.StatusTooManyRequests)
+		}
+		return next(c)
+	}
+}
+
+// parseTrustedProxies parses a comma separated list of the CIDR blocks from
+// which our load balancers connect.
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, cidr := range strings.Split(list, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, ipnet := range trustedProxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client which made the request.  Unlike
+// echo's RealIP(), X-Forwarded-For is only believed when the request came
+// through one of our trusted proxies, and then only as far back as the nearest
+// hop which isn't one; anything before that could have been made up by the
+// client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+func tlsVersionName(version uint16) string {
+	if name, ok := tlsVersionNames[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+type diagEchoResponse struct {
+	SourceIP   string    `json:"sourceIP"`
+	Proto      string    `json:"proto"`
+	TLSVersion string    `json:"tlsVersion,omitempty"`
+	TLSCipher  string    `json:"tlsCipher,omitempty"`
+	ServerTime time.Time `json:"serverTime"`
+}
+
+// getDiagEcho implements GET /api/diag/echo, which describes the caller's
+// connection as we see it, so that problems such as TLS interception can be
+// spotted.  It needs no authentication, so the request itself is never
+// reflected, and nothing is stored on the client.
+func getDiagEcho(c echo.Context) error {
+	r := c.Request()
+	resp := diagEchoResponse{
+		SourceIP:   clientIP(r),
+		Proto:      r.Proto,
+		ServerTime: time.Now().UTC(),
+	}
+	if r.TLS != nil {
+		resp.TLSVersion = tlsVersionName(r.TLS.Version)
+		resp.TLSCipher = tls.CipherSuiteName(r.TLS.CipherSuite)
+	}
+
+	hdr := c.Response().Header()
+	hdr.Del("Set-Cookie")
+	hdr.Set("Cache-Control", "no-store")
+	return c.JSON(http.StatusOK, &resp)
+}
+
+// newDiagHandler routes the unauthenticated diagnostic endpoints into the echo
+// instance.
+func newDiagHandler(r *echo.Echo) *sourceLimiter {
+	limiter := newSourceLimiter(echoSourceRate, echoSourceBurst,
+		echoOverallRate, echoOverallBurst)
+	r.GET("/api/diag/echo", getDiagEcho, limiter.Middleware)
+	return limiter
+}
+
+// diagTriggers remembers when this server last requested a connectivity check
+// from each site.  Until the appliance has acknowledged a request, it isn't
+// visible in the cloud's copy of the tree, and clients polling for the results
+// mustn't cause it to be requested over and over.
+type diagTriggers struct {
+	sync.Mutex
+	sites map[string]time.Time
+}
+
+func newDiagTriggers() *diagTriggers {
+	return &diagTriggers{
+		sites: make(map[string]time.Time),
+	}
+}
+
+func (d *diagTriggers) get(site string) time.Time {
+	d.Lock()
+	defer d.Unlock()
+	return d.sites[site]
+}
+
+func (d *diagTriggers) set(site string, when time.Time) {
+	d.Lock()
+	defer d.Unlock()
+
+	for s, t := range d.sites {
+		if when.Sub(t) > diagConnResultsTTL {
+			delete(d.sites, s)
+		}
+	}
+	d.sites[site] = when
+}
+
+// connectivityState determines where a site's connectivity check stands, given
+// when a check was last requested, and which request the latest results
+// answered and when they were completed.  A zero time means there is no such
+// request or result.  trigger is set if a new check should be requested.
+func connectivityState(requested, answered, completed,
+	now time.Time) (state string, trigger bool) {
+
+	switch {
+	case !answered.IsZero() && !answered.Before(requested):
+		if now.Sub(completed) > diagConnResultsTTL {
+			return diagPending, true
+		}
+		return diagComplete, false
+	case requested.IsZero():
+		return diagPending, true
+	case now.Sub(requested) < diagConnTimeout:
+		return diagPending, false
+	default:
+		return diagTimeout, true
+	}
+}
+
+type diagCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+type diagConnectivityResponse struct {
+	State       string               `json:"state"`
+	Requested   *time.Time           `json:"requested,omitempty"`
+	Completed   *time.Time           `json:"completed,omitempty"`
+	ClockSkewMs *int64               `json:"clockSkewMs,omitempty"`
+	Checks      map[string]diagCheck `json:"checks,omitempty"`
+}
+
+func childTime(node *cfgapi.PropertyNode, name string) time.Time {
+	var t time.Time
+
+	if child := node.Children[name]; child != nil {
+		t, _ = time.Parse(time.RFC3339Nano, child.Value)
+	}
+	return t
+}
+
+// getDiagConnectivity implements GET /api/sites/:uuid/diag/connectivity.  It
+// requests a connectivity check from the site's appliance if there isn't one
+// under way or recently completed, and returns the results once they arrive.
+// While the check is pending, 202 is returned; the client should poll until
+// the state becomes complete, or timeout if the appliance didn't respond (in
+// which case, another check has been requested).  Requesting a check changes
+// the appliance's config, so under a read-only support grant only existing
+// results can be fetched, and 403 is returned when a new check is needed.
+func (a *siteHandler) getDiagConnectivity(c echo.Context) error {
+	site := c.Param("uuid")
+	hdl, err := a.getClientHandle(site)
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	requested := a.diag.get(site)
+	prop, err := hdl.GetProp(diagConnRequestProp)
+	if err == nil {
+		if t, err := time.Parse(time.RFC3339Nano, prop); err == nil &&
+			t.After(requested) {
+			requested = t
+		}
+	} else if !cfgapi.IsConfigAbsent(err) {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+
+	results, err := hdl.GetProps(diagConnResultsProp)
+	if cfgapi.IsConfigAbsent(err) {
+		results = &cfgapi.PropertyNode{}
+	} else if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+	answered := childTime(results, "request")
+	completed := childTime(results, "completed")
+
+	now := time.Now()
+	state, trigger := connectivityState(requested, answered, completed, now)
+	if trigger && readOnlyImpersonated(c) {
+		return newHTTPError(http.StatusForbidden,
+			"support grant is read-only")
+	}
+	if trigger {
+		// Only the submission of the request is waited for; the
+		// appliance may take a while to pick it up.
+		expires := now.Add(diagConnResultsTTL)
+		ops := []cfgapi.PropertyOp{
+			{
+				Op:      cfgapi.PropCreate,
+				Name:    diagConnRequestProp,
+				Value:   now.UTC().Format(time.RFC3339Nano),
+				Expires: &expires,
+			},
+		}
+		ctx := c.Request().Context()
+		_, err = hdl.Execute(ctx, ops).Status(ctx)
+		if err != nil && err != cfgapi.ErrQueued &&
+			err != cfgapi.ErrInProgress {
+			return newHTTPError(configErrorStatus(err), err)
+		}
+		a.diag.set(site, now)
+		requested = now
+	}
+
+	resp := diagConnectivityResponse{
+		State:     state,
+		Requested: &requested,
+	}
+	if state == diagPending {
+		return c.JSON(http.StatusAccepted, &resp)
+	} else if state == diagTimeout {
+		return c.JSON(http.StatusOK, &resp)
+	}
+
+	resp.Completed = &completed
+	if skew := results.Children["clock_skew_ms"]; skew != nil {
+		if ms, err := strconv.ParseInt(skew.Value, 10, 64); err == nil {
+			resp.ClockSkewMs = &ms
+		}
+	}
+	resp.Checks = make(map[string]diagCheck)
+	if checks := results.Children["checks"]; checks != nil {
+		for name, check := range checks.Children {
+			var dc diagCheck
+			if ok := check.Children["ok"]; ok != nil {
+				dc.OK = ok.Value == "true"
+			}
+			if detail := check.Children["detail"]; detail != nil {
+				dc.Detail = detail.Value
+			}
+			resp.Checks[name] = dc
+		}
+	}
+	return c.JSON(http.StatusOK, &resp)
+}
@@ -0,0 +1,285 @@
+//
+// Copyright 2020 Brightgate Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+//
+
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"bg/cloud_models/appliancedb/mocks"
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagEcho(t *testing.T) {
+	assert := require.New(t)
+
+	e := echo.New()
+	_ = newDiagHandler(e)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(echo.GET, "/api/diag/echo", nil)
+	req.RemoteAddr = "198.51.100.7:40000"
+	req.TLS = &tls.ConnectionState{
+		Version:     tls.VersionTLS12,
+		CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	}
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Empty(rec.Header().Get("Set-Cookie"))
+	assert.Equal("no-store", rec.Header().Get("Cache-Control"))
+
+	var resp diagEchoResponse
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal("198.51.100.7", resp.SourceIP)
+	assert.Equal("HTTP/1.1", resp.Proto)
+	assert.Equal("TLS 1.2", resp.TLSVersion)
+	assert.Equal("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", resp.TLSCipher)
+	assert.WithinDuration(time.Now(), resp.ServerTime, time.Minute)
+
+	// Once a source has used up its burst, it is turned away
+	for i := 1; i < echoSourceBurst; i++ {
+		rec = httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusTooManyRequests, rec.Code)
+	assert.Equal("1", rec.Header().Get("Retry-After"))
+}
+
+func TestDiagEchoForwarded(t *testing.T) {
+	assert := require.New(t)
+
+	e := echo.New()
+	_ = newDiagHandler(e)
+
+	// Without a trusted proxy, X-Forwarded-For is neither echoed nor lets
+	// one client pass itself off as many.
+	get := func(i int) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.GET, "/api/diag/echo", nil)
+		req.RemoteAddr = "198.51.100.8:40000"
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("10.0.%d.%d",
+			i/256, i%256))
+		req.Header.Set("X-Real-IP", fmt.Sprintf("10.1.%d.%d",
+			i/256, i%256))
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	for i := 0; i < echoSourceBurst; i++ {
+		rec := get(i)
+		assert.Equal(http.StatusOK, rec.Code)
+
+		var resp diagEchoResponse
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &resp))
+		assert.Equal("198.51.100.8", resp.SourceIP)
+	}
+	rec := get(echoSourceBurst)
+	assert.Equal(http.StatusTooManyRequests, rec.Code)
+}
+
+func TestClientIP(t *testing.T) {
+	assert := require.New(t)
+
+	var err error
+	trustedProxies, err = parseTrustedProxies("130.211.0.0/22, 35.191.0.0/16")
+	assert.NoError(err)
+	defer func() { trustedProxies = nil }()
+
+	testCases := []struct {
+		remote string
+		xff    string
+		ip     string
+	}{
+		{"198.51.100.7:40000", "", "198.51.100.7"},
+		{"198.51.100.7:40000", "203.0.113.1", "198.51.100.7"},
+		{"130.211.0.1:40000", "", "130.211.0.1"},
+		{"130.211.0.1:40000", "203.0.113.1", "203.0.113.1"},
+		{"130.211.0.1:40000", "192.0.2.1, 203.0.113.1", "203.0.113.1"},
+		{"130.211.0.1:40000", "203.0.113.1, 35.191.0.1", "203.0.113.1"},
+		{"130.211.0.1:40000", "junk, 35.191.0.1", "35.191.0.1"},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(echo.GET, "/api/diag/echo", nil)
+		req.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		assert.Equal(tc.ip, clientIP(req), "%s via %s", tc.xff, tc.remote)
+	}
+
+	_, err = parseTrustedProxies("35.191.0.0/16,bogus")
+	assert.Error(err)
+}
+
+func TestSourceLimiter(t *testing.T) {
+	assert := require.New(t)
+
+	l := newSourceLimiter(1, 2, 10, 3)
+	l.maxSources = 2
+	now := time.Now()
+
+	// Each source has its own burst, but all share the overall one
+	assert.True(l.allow("a", now))
+	assert.True(l.allow("a", now))
+	assert.False(l.allow("a", now))
+	assert.True(l.allow("b", now))
+	assert.False(l.allow("b", now))
+
+	// No more sources are tracked until the others go idle
+	assert.False(l.allow("c", now))
+	now = now.Add(time.Second)
+	assert.True(l.allow("a", now))
+	assert.False(l.allow("c", now))
+
+	now = now.Add(echoSourceIdle + time.Second)
+	assert.True(l.allow("c", now))
+	assert.Len(l.sources, 1)
+
+	// New sources aren't remembered once the overall limit is reached
+	l = newSourceLimiter(1, 2, 1, 2)
+	assert.True(l.allow("a", now))
+	assert.True(l.allow("b", now))
+	assert.False(l.allow("c", now))
+	assert.False(l.allow("d", now))
+	assert.Len(l.sources, 2)
+}
+
+func TestConnectivityState(t *testing.T) {
+	now := time.Now()
+	ago := func(d time.Duration) time.Time {
+		return now.Add(-d)
+	}
+	var never time.Time
+
+	testCases := []struct {
+		name      string
+		requested time.Time
+		answered  time.Time
+		completed time.Time
+		state     string
+		trigger   bool
+	}{
+		{"first", never, never, never, diagPending, true},
+		{"waiting", ago(time.Minute), never, never, diagPending, false},
+		{"stale results", ago(time.Minute), ago(time.Hour),
+			ago(time.Hour), diagPending, false},
+		{"answered", ago(time.Minute), ago(time.Minute),
+			ago(time.Second), diagComplete, false},
+		{"answered elsewhere", never, ago(time.Minute),
+			ago(time.Second), diagComplete, false},
+		{"timed out", ago(diagConnTimeout + time.Second), never, never,
+			diagTimeout, true},
+		{"expired", ago(time.Hour), ago(time.Hour),
+			ago(diagConnResultsTTL + time.Second), diagPending, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state, trigger := connectivityState(tc.requested,
+				tc.answered, tc.completed, now)
+			require.Equal(t, tc.state, state)
+			require.Equal(t, tc.trigger, trigger)
+		})
+	}
+}
+
+func TestDiagConnectivity(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	defer dMock.AssertExpectations(t)
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(me), nil
+	}
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	url := fmt.Sprintf("/api/sites/%s/diag/connectivity", m0.UUID)
+	hdl := cfgapi.NewHandle(me)
+
+	// The first poll requests a check
+	req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusAccepted, rec.Code)
+	var resp diagConnectivityResponse
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(diagPending, resp.State)
+	requestID, err := hdl.GetProp(diagConnRequestProp)
+	assert.NoError(err)
+
+	// Later polls wait for the same one
+	req, rec = setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusAccepted, rec.Code)
+	again, err := hdl.GetProp(diagConnRequestProp)
+	assert.NoError(err)
+	assert.Equal(requestID, again)
+
+	// The appliance answers
+	completed := time.Now().UTC().Format(time.RFC3339)
+	err = hdl.CreateProps(map[string]string{
+		diagConnResultsProp + "/request":               requestID,
+		diagConnResultsProp + "/completed":             completed,
+		diagConnResultsProp + "/clock_skew_ms":         "-40",
+		diagConnResultsProp + "/checks/dns/ok":         "true",
+		diagConnResultsProp + "/checks/dns/detail":     "resolved 3 of 3 names",
+		diagConnResultsProp + "/checks/echo/ok":        "false",
+		diagConnResultsProp + "/checks/echo/detail":    "TLS certificate not issued by expected CA",
+		diagConnResultsProp + "/checks/webhook/ok":     "true",
+		diagConnResultsProp + "/checks/webhook/detail": "",
+	}, nil)
+	assert.NoError(err)
+
+	req, rec = setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	t.Logf("return body: %s", rec.Body.String())
+	resp = diagConnectivityResponse{}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(diagComplete, resp.State)
+	assert.NotNil(resp.ClockSkewMs)
+	assert.Equal(int64(-40), *resp.ClockSkewMs)
+	assert.Equal(map[string]diagCheck{
+		"dns":     {OK: true, Detail: "resolved 3 of 3 names"},
+		"echo":    {OK: false, Detail: "TLS certificate not issued by expected CA"},
+		"webhook": {OK: true},
+	}, resp.Checks)
+
+	// Results stay put until they are stale
+	again, err = hdl.GetProp(diagConnRequestProp)
+	assert.NoError(err)
+	assert.Equal(requestID, again)
+}
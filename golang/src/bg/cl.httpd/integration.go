@@ -0,0 +1,203 @@
+//
+// Copyright 2020 Brightgate Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+//
+
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bg/cloud_models/appliancedb"
+	"bg/common/cfgapi"
+	"bg/common/network"
+
+	"github.com/labstack/echo"
+	"github.com/satori/uuid"
+)
+
+// External systems, such as a customer's SIEM, export a site's data using a
+// site integration token rather than a user session.  Such a token is bound to
+// a single site and a set of read-only export scopes, and is accepted only on
+// the routes registered here; the session-authenticated routes never look at
+// it, so it can't be used to reach a site's configuration, or any other site.
+type integrationHandler struct {
+	db              appliancedb.DataStore
+	getClientHandle getClientHandleFunc
+}
+
+// Page sizes for GET /api/sites/:uuid/export/events
+const (
+	exportEventsDefault = 100
+	exportEventsMax     = 1000
+)
+
+type apiExportEvent struct {
+	ID         int64           `json:"id"`
+	Timestamp  time.Time       `json:"timestamp"`
+	Reason     string          `json:"reason,omitempty"`
+	MacAddress string          `json:"macAddress,omitempty"`
+	Exception  json.RawMessage `json:"exception"`
+}
+
+type apiExportEvents struct {
+	Events []apiExportEvent `json:"events"`
+	// Pass as 'after' to fetch the next page; unchanged if there were
+	// no new events.
+	NextAfter int64 `json:"nextAfter"`
+}
+
+// bearerToken returns the token from a request's "Authorization: Bearer"
+// header, or "" if there is none.
+func bearerToken(c echo.Context) string {
+	h := strings.SplitN(c.Request().Header.Get("Authorization"), " ", 2)
+	if len(h) == 2 && strings.EqualFold(h[0], "bearer") {
+		return strings.TrimSpace(h[1])
+	}
+	return ""
+}
+
+// mkIntegrationMiddleware manufactures a middleware which protects an export
+// route; only integration tokens which are bound to the requested site and
+// which carry the given scope can pass through.  The middleware adds the token
+// to the echo context as "integration_token".
+func (h *integrationHandler) mkIntegrationMiddleware(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ctx := c.Request().Context()
+			token := bearerToken(c)
+			if token == "" {
+				return newHTTPError(http.StatusUnauthorized,
+					"need token")
+			}
+
+			tok, err := h.db.ValidateSiteIntegrationToken(ctx, token)
+			if _, ok := err.(appliancedb.NotFoundError); ok {
+				c.Logger().Debugf("Unauthorized: %s: %v",
+					c.Path(), err)
+				return newHTTPError(http.StatusUnauthorized)
+			} else if err != nil {
+				return newHTTPError(http.StatusInternalServerError)
+			}
+
+			siteUUID, err := uuid.FromString(c.Param("uuid"))
+			if err != nil || !uuid.Equal(siteUUID, tok.SiteUUID) ||
+				!tok.HasScope(scope) {
+				c.Logger().Debugf("Forbidden: %s site=%s, token=%v",
+					c.Path(), c.Param("uuid"), tok.UUID)
+				return newHTTPError(http.StatusForbidden)
+			}
+
+			c.Set("integration_token", tok)
+			return next(c)
+		}
+	}
+}
+
+// getExportEvents implements GET /api/sites/:uuid/export/events, returning
+// the site's exceptions which follow the one identified by the 'after'
+// parameter, oldest first.
+func (h *integrationHandler) getExportEvents(c echo.Context) error {
+	var err error
+
+	after := int64(0)
+	if s := c.QueryParam("after"); s != "" {
+		if after, err = strconv.ParseInt(s, 10, 64); err != nil || after < 0 {
+			return newHTTPError(http.StatusBadRequest, "bad after")
+		}
+	}
+	limit := exportEventsDefault
+	if s := c.QueryParam("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return newHTTPError(http.StatusBadRequest, "bad limit")
+		}
+		if limit > exportEventsMax {
+			limit = exportEventsMax
+		}
+	}
+
+	tok := c.Get("integration_token").(*appliancedb.SiteIntegrationToken)
+	recs, err := h.db.SiteNetExceptionsBySite(c.Request().Context(),
+		tok.SiteUUID, after, limit)
+	if err != nil {
+		return newHTTPError(http.StatusInternalServerError)
+	}
+
+	resp := apiExportEvents{
+		Events:    make([]apiExportEvent, 0, len(recs)),
+		NextAfter: after,
+	}
+	for _, r := range recs {
+		ev := apiExportEvent{
+			ID:        r.ID,
+			Timestamp: r.Timestamp,
+			Reason:    r.Reason.ValueOrZero(),
+			Exception: json.RawMessage(r.Exception),
+		}
+		if r.MacAddr.Valid {
+			ev.MacAddress = network.Uint64ToMac(uint64(r.MacAddr.Int64))
+		}
+		resp.Events = append(resp.Events, ev)
+		resp.NextAfter = r.ID
+	}
+	return c.JSON(http.StatusOK, &resp)
+}
+
+// getExportInventory implements GET /api/sites/:uuid/export/inventory,
+// returning the site's devices in mac order.  Scan and vulnerability details
+// are not included.
+func (h *integrationHandler) getExportInventory(c echo.Context) error {
+	tok := c.Get("integration_token").(*appliancedb.SiteIntegrationToken)
+	hdl, err := h.getClientHandle(tok.SiteUUID.String())
+	if err != nil {
+		return newHTTPError(http.StatusInternalServerError)
+	}
+	defer hdl.Close()
+
+	allRings, err := hdl.GetRings()
+	if err != nil && !cfgapi.IsConfigAbsent(err) {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+
+	clients := hdl.GetClients()
+	macs := make([]string, 0, len(clients))
+	for mac := range clients {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+
+	devices := make([]*apiDevice, 0, len(macs))
+	for _, mac := range macs {
+		client := clients[mac]
+		metrics := hdl.GetClientMetrics(mac)
+		allowedRings := hdl.GetClientRings(client, allRings)
+		d := buildDeviceResponse(c, hdl, mac, client, allowedRings,
+			nil, nil, metrics)
+		devices = append(devices, d)
+	}
+	return c.JSON(http.StatusOK, devices)
+}
+
+// newIntegrationHandler creates an integrationHandler instance for the given
+// DataStore, and routes the handler into the echo instance.
+func newIntegrationHandler(r *echo.Echo, db appliancedb.DataStore, getClientHandle getClientHandleFunc) *integrationHandler {
+	h := &integrationHandler{db, getClientHandle}
+
+	events := h.mkIntegrationMiddleware(appliancedb.IntegrationScopeEvents)
+	inventory := h.mkIntegrationMiddleware(
+		appliancedb.IntegrationScopeInventory)
+
+	exp := r.Group("/api/sites/:uuid/export")
+	exp.GET("/events", h.getExportEvents, events)
+	exp.GET("/inventory", h.getExportInventory, inventory)
+	return h
+}
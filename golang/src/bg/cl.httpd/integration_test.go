@@ -0,0 +1,228 @@
+//
+// Copyright 2020 Brightgate Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+//
+
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/guregu/null"
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+	"github.com/satori/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"bg/cloud_models/appliancedb"
+	"bg/cloud_models/appliancedb/mocks"
+)
+
+// integrationState stands in for the site_integration_tokens table
+type integrationState struct {
+	sync.Mutex
+	tokens map[string]*appliancedb.SiteIntegrationToken
+}
+
+func (s *integrationState) add(token string, site uuid.UUID, scopes ...string) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	s.tokens[token] = &appliancedb.SiteIntegrationToken{
+		UUID:      uuid.NewV4(),
+		SiteUUID:  site,
+		Name:      token,
+		Scopes:    pq.StringArray(scopes),
+		CreatedBy: "tester",
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+	}
+}
+
+func (s *integrationState) revoke(token string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.tokens, token)
+}
+
+func (s *integrationState) validate(_ context.Context, token string) *appliancedb.SiteIntegrationToken {
+	s.Lock()
+	defer s.Unlock()
+	return s.tokens[token]
+}
+
+func (s *integrationState) validateErr(_ context.Context, token string) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.tokens[token] == nil {
+		return appliancedb.NotFoundError{}
+	}
+	return nil
+}
+
+func setupIntegrationTest(t *testing.T) (*echo.Echo, *mocks.DataStore, sessions.Store, *integrationState) {
+	state := &integrationState{
+		tokens: make(map[string]*appliancedb.SiteIntegrationToken),
+	}
+
+	dMock := &mocks.DataStore{}
+	dMock.On("ValidateSiteIntegrationToken", mock.Anything, mock.Anything).Return(
+		state.validate, state.validateErr)
+
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getMockClientHandle, nil)
+	_ = newIntegrationHandler(e, dMock, getMockClientHandle)
+	return e, dMock, ss, state
+}
+
+// tokenRequest makes a GET request presenting the given token, and returns the
+// response
+func tokenRequest(e *echo.Echo, token, url string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(echo.GET, url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIntegrationExportEvents(t *testing.T) {
+	assert := require.New(t)
+	e, dMock, _, state := setupIntegrationTest(t)
+
+	site := mockSites[0].UUID
+	exc := `{"reason":"BAD_RING","details":["wrong ring"]}`
+	dMock.On("SiteNetExceptionsBySite", mock.Anything, site, int64(0),
+		exportEventsDefault).Return(
+		[]appliancedb.SiteNetExceptionRecord{
+			{
+				ID:        7,
+				SiteUUID:  site,
+				Timestamp: time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC),
+				Reason:    null.StringFrom("BAD_RING"),
+				MacAddr:   null.IntFrom(0x0011223344),
+				Exception: exc,
+			},
+		}, nil)
+	dMock.On("SiteNetExceptionsBySite", mock.Anything, site, int64(7),
+		10).Return([]appliancedb.SiteNetExceptionRecord{}, nil)
+
+	state.add("siem", site, appliancedb.IntegrationScopeEvents)
+	url := fmt.Sprintf("/api/sites/%s/export/events", site)
+	rec := tokenRequest(e, "siem", url)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.JSONEq(fmt.Sprintf(`{
+		"events": [{
+			"id": 7,
+			"timestamp": "2020-06-01T12:00:00Z",
+			"reason": "BAD_RING",
+			"macAddress": "00:00:11:22:33:44",
+			"exception": %s
+		}],
+		"nextAfter": 7
+	}`, exc), rec.Body.String())
+
+	// No more events yet
+	rec = tokenRequest(e, "siem", url+"?after=7&limit=10")
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.JSONEq(`{"events": [], "nextAfter": 7}`, rec.Body.String())
+
+	for _, q := range []string{"?after=x", "?after=-1", "?limit=0"} {
+		rec = tokenRequest(e, "siem", url+q)
+		assert.Equal(http.StatusBadRequest, rec.Code, q)
+	}
+
+	// Revocation takes effect immediately
+	state.revoke("siem")
+	rec = tokenRequest(e, "siem", url)
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+}
+
+func TestIntegrationExportInventory(t *testing.T) {
+	assert := require.New(t)
+	e, _, _, state := setupIntegrationTest(t)
+
+	site := mockSites[0].UUID
+	state.add("cmdb", site, appliancedb.IntegrationScopeInventory)
+	rec := tokenRequest(e, "cmdb",
+		fmt.Sprintf("/api/sites/%s/export/inventory", site))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var devices []map[string]interface{}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &devices))
+	assert.NotEmpty(devices)
+	for _, d := range devices {
+		assert.NotEmpty(d["hwAddr"])
+		assert.NotContains(d, "scans")
+		assert.NotContains(d, "vulnerabilities")
+	}
+}
+
+func TestIntegrationTokenScope(t *testing.T) {
+	assert := require.New(t)
+	e, _, ss, state := setupIntegrationTest(t)
+
+	site := mockSites[0].UUID
+	other := mockSites[1].UUID
+	state.add("siem", site, appliancedb.IntegrationScopeEvents)
+
+	// Missing and unknown tokens are refused
+	eventsURL := fmt.Sprintf("/api/sites/%s/export/events", site)
+	for _, tok := range []string{"", "bogus"} {
+		rec := tokenRequest(e, tok, eventsURL)
+		assert.Equal(http.StatusUnauthorized, rec.Code, tok)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(echo.GET, eventsURL, nil)
+	req.Header.Set("Authorization", "Basic siem")
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+
+	// The token is bound to its site and scopes
+	rec = tokenRequest(e, "siem",
+		fmt.Sprintf("/api/sites/%s/export/events", other))
+	assert.Equal(http.StatusForbidden, rec.Code)
+	rec = tokenRequest(e, "siem", "/api/sites/invalid/export/events")
+	assert.Equal(http.StatusForbidden, rec.Code)
+	rec = tokenRequest(e, "siem",
+		fmt.Sprintf("/api/sites/%s/export/inventory", site))
+	assert.Equal(http.StatusForbidden, rec.Code)
+
+	// ... and is never accepted in place of a session, even on read-only
+	// routes
+	urls := []string{
+		"/api/sites",
+		fmt.Sprintf("/api/sites/%s", site),
+		fmt.Sprintf("/api/sites/%s/config", site),
+		fmt.Sprintf("/api/sites/%s/devices", site),
+		fmt.Sprintf("/api/sites/%s/devices", other),
+	}
+	for _, url := range urls {
+		rec = tokenRequest(e, "siem", url)
+		assert.Equal(http.StatusUnauthorized, rec.Code, url)
+	}
+
+	// A session is not accepted on the export routes
+	req, rec = setupReqRec(&mockAccount, echo.GET, eventsURL, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+}
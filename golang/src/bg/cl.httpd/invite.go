@@ -0,0 +1,180 @@
+//
+// Copyright 2020 Brightgate Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+//
+
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"bg/cloud_models/appliancedb"
+
+	"github.com/labstack/echo"
+	"github.com/satori/uuid"
+)
+
+// defaultInviteDuration is how long an invitation may be accepted, unless the
+// admin creating it asks otherwise
+const defaultInviteDuration = 7 * 24 * time.Hour
+
+type apiInviteRequest struct {
+	Email    string `json:"email"`
+	Role     string `json:"role"`
+	Duration string `json:"duration"`
+}
+
+type apiInviteAccept struct {
+	Token string `json:"token"`
+}
+
+// apiInviteCreated carries the token with which a new invitation is accepted.
+// It is only available when the invitation is created.
+type apiInviteCreated struct {
+	Invite *appliancedb.AccountInvite `json:"invite"`
+	Token  string                     `json:"token"`
+}
+
+// getInvites implements GET /api/org/:org_uuid/invites, returning the
+// organization's pending invitations, oldest first.
+func (o *orgHandler) getInvites(c echo.Context) error {
+	orgUUID, err := uuid.FromString(c.Param("org_uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+
+	invs, err := o.db.PendingInvitesByOrg(c.Request().Context(), orgUUID)
+	if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+	if invs == nil {
+		invs = make([]appliancedb.AccountInvite, 0)
+	}
+	return c.JSON(http.StatusOK, invs)
+}
+
+// postInvite implements POST /api/org/:org_uuid/invites, inviting the holder
+// of an email address to join the organization with a role.  The invitation
+// may be accepted for the requested duration, or defaultInviteDuration.  Any
+// pending invitation for the address is replaced.
+func (o *orgHandler) postInvite(c echo.Context) error {
+	orgUUID, err := uuid.FromString(c.Param("org_uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	// Support staff can't invite people into the organization
+	if impersonated(c) {
+		return newHTTPError(http.StatusForbidden)
+	}
+
+	var input apiInviteRequest
+	if err := c.Bind(&input); err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	d := defaultInviteDuration
+	if input.Duration != "" {
+		d, err = time.ParseDuration(input.Duration)
+		if err != nil {
+			return newHTTPError(http.StatusBadRequest, "bad duration")
+		}
+	}
+
+	now := time.Now()
+	inv := &appliancedb.AccountInvite{
+		OrganizationUUID: orgUUID,
+		Email:            input.Email,
+		Role:             input.Role,
+		CreatedAt:        now,
+		ExpiresAt:        now.Add(d),
+	}
+	token, err := o.db.CreateInvite(c.Request().Context(), inv)
+	if verr, ok := err.(appliancedb.ValidationError); ok {
+		return newHTTPError(http.StatusBadRequest, verr.Error())
+	} else if _, ok := err.(appliancedb.ForeignKeyError); ok {
+		return newHTTPError(http.StatusBadRequest, "unknown role")
+	} else if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+	return c.JSON(http.StatusOK, &apiInviteCreated{
+		Invite: inv,
+		Token:  token,
+	})
+}
+
+// postInviteAccept implements POST /api/invites/accept, which takes the
+// invitation's token in the body, and POST /api/invites/:token/accept.  The
+// former is preferred: a token in the URL is more likely to be recorded along
+// the way, though it is redacted from our own logs.  The invitee must first
+// log in; their account is then granted the invited role in the organization.
+// An invitee with no account instead accepts the invitation by logging in with
+// the token (see authHandler.getProvider).  The token is the invitee's only
+// credential, so the account's email address needn't match the one invited.
+// 404 is returned if the token is unknown, or its invitation has expired or
+// already been accepted; 403 is returned if the account belongs to another
+// organization.
+func (o *orgHandler) postInviteAccept(c echo.Context) error {
+	accountUUID, ok := c.Get("account_uuid").(uuid.UUID)
+	if !ok || accountUUID == uuid.Nil {
+		return newHTTPError(http.StatusUnauthorized)
+	}
+
+	token := c.Param("token")
+	if token == "" {
+		var input apiInviteAccept
+		if err := c.Bind(&input); err != nil {
+			return newHTTPError(http.StatusBadRequest)
+		}
+		token = input.Token
+	}
+	if token == "" {
+		return newHTTPError(http.StatusBadRequest, "token is required")
+	}
+
+	inv, err := o.db.AcceptInvite(c.Request().Context(), token, accountUUID)
+	if _, ok := err.(appliancedb.NotFoundError); ok {
+		return newHTTPError(http.StatusNotFound)
+	} else if merr, ok := err.(appliancedb.InviteOrgMismatchError); ok {
+		return newHTTPError(http.StatusForbidden, merr.Error())
+	} else if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+	return c.JSON(http.StatusOK, inv)
+}
+
+// redactInviteToken returns the request's URI with any invitation token in it,
+// in the path of POST /api/invites/:token/accept (or anything resembling it)
+// or the 'invite' parameter of /auth/:provider, replaced, so that the URI can
+// be logged.
+func redactInviteToken(req *http.Request) string {
+	const redacted = "REDACTED"
+
+	path := req.URL.EscapedPath()
+	query := req.URL.RawQuery
+	changed := false
+	parts := strings.Split(path, "/")
+	if len(parts) > 3 && parts[1] == "api" && parts[2] == "invites" &&
+		parts[3] != "accept" {
+		parts[3] = redacted
+		path = strings.Join(parts, "/")
+		changed = true
+	}
+	q := req.URL.Query()
+	if _, ok := q["invite"]; ok {
+		q.Set("invite", redacted)
+		query = q.Encode()
+		changed = true
+	}
+	if !changed {
+		return req.RequestURI
+	}
+	if query != "" {
+		path += "?" + query
+	}
+	return path
+}
@@ -0,0 +1,300 @@
+//
+// Copyright 2020 Brightgate Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+//
+
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/guregu/null"
+	"github.com/labstack/echo"
+	"github.com/markbates/goth"
+	"github.com/satori/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"bg/cloud_models/appliancedb"
+	"bg/cloud_models/appliancedb/mocks"
+)
+
+// An account in the organization which has just logged in for the first
+// time, and has no roles yet
+var mockInviteeAccount = appliancedb.Account{
+	UUID:             uuid.Must(uuid.FromString("20000000-0000-0000-0000-000000000004")),
+	Email:            "invitee@example.com",
+	OrganizationUUID: orgUUID,
+	PersonUUID:       personUUID,
+}
+
+// An account which belongs to no organization but its own
+var mockOutsiderAccount = appliancedb.Account{
+	UUID:             uuid.Must(uuid.FromString("20000000-0000-0000-0000-000000000005")),
+	Email:            "outsider@example.com",
+	OrganizationUUID: uuid.Must(uuid.FromString("10000000-0000-0000-0000-000000000005")),
+	PersonUUID:       personUUID,
+}
+
+func TestInvites(t *testing.T) {
+	assert := require.New(t)
+
+	const token = "good-token"
+	const expiredToken = "expired-token"
+	var created *appliancedb.AccountInvite
+	var pending []appliancedb.AccountInvite
+
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, mockAccount.UUID, mock.Anything).Return(mockAccountOrgRoles, nil)
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, mockUserAccount.UUID, mock.Anything).Return(mockUserAccountOrgRoles, nil)
+	dMock.On("CreateInvite", mock.Anything, mock.Anything).Run(
+		func(args mock.Arguments) {
+			created = args.Get(1).(*appliancedb.AccountInvite)
+			created.UUID = uuid.NewV4()
+			pending = append(pending, *created)
+		}).Return(token, nil).Once()
+	dMock.On("PendingInvitesByOrg", mock.Anything, orgUUID).Return(
+		func(context.Context, uuid.UUID) []appliancedb.AccountInvite {
+			return pending
+		}, nil)
+	dMock.On("AcceptInvite", mock.Anything, token, mockOutsiderAccount.UUID).Return(
+		nil, appliancedb.InviteOrgMismatchError{
+			AccountUUID:         mockOutsiderAccount.UUID,
+			AccountOrganization: mockOutsiderAccount.OrganizationUUID,
+			InviteOrganization:  orgUUID,
+		})
+	dMock.On("AcceptInvite", mock.Anything, token, mockInviteeAccount.UUID).Return(
+		func(_ context.Context, _ string, acct uuid.UUID) *appliancedb.AccountInvite {
+			inv := *created
+			inv.AcceptedAt = null.TimeFrom(time.Now())
+			inv.AcceptedAccountUUID = uuid.NullUUID{UUID: acct, Valid: true}
+			pending = nil
+			return &inv
+		}, nil).Once()
+	dMock.On("AcceptInvite", mock.Anything, mock.Anything, mock.Anything).Return(
+		nil, appliancedb.NotFoundError{})
+	defer dMock.AssertExpectations(t)
+
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newOrgHandler(e, dMock, mw, ss)
+
+	invitesURL := fmt.Sprintf("/api/org/%s/invites", orgUUID)
+	post := func(acct *appliancedb.Account, url, body string) (int, []byte) {
+		req, rec := setupReqRec(acct, echo.POST, url,
+			strings.NewReader(body), ss)
+		req.Header.Set("Content-Type", "application/json")
+		e.ServeHTTP(rec, req)
+		t.Logf("return body: %s", rec.Body.String())
+		return rec.Code, rec.Body.Bytes()
+	}
+	list := func() []appliancedb.AccountInvite {
+		req, rec := setupReqRec(&mockAccount, echo.GET, invitesURL, nil, ss)
+		e.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		var invs []appliancedb.AccountInvite
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &invs))
+		return invs
+	}
+
+	body := `{"email": "invitee@example.com", "role": "user"}`
+
+	// Only admins can invite people, or see who has been invited
+	code, _ := post(&mockUserAccount, invitesURL, body)
+	assert.Equal(http.StatusUnauthorized, code)
+	req, rec := setupReqRec(&mockUserAccount, echo.GET, invitesURL, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+	assert.Empty(list())
+
+	code, _ = post(&mockAccount, invitesURL,
+		`{"email": "invitee@example.com", "role": "user", "duration": "soon"}`)
+	assert.Equal(http.StatusBadRequest, code)
+
+	// Create, with the default duration
+	before := time.Now()
+	code, resp := post(&mockAccount, invitesURL, body)
+	assert.Equal(http.StatusOK, code)
+	var inviteResp apiInviteCreated
+	assert.NoError(json.Unmarshal(resp, &inviteResp))
+	assert.Equal(token, inviteResp.Token)
+	assert.Equal(created.UUID, inviteResp.Invite.UUID)
+	assert.Equal(orgUUID, created.OrganizationUUID)
+	assert.Equal("invitee@example.com", created.Email)
+	assert.Equal("user", created.Role)
+	assert.Equal(defaultInviteDuration, created.ExpiresAt.Sub(created.CreatedAt))
+	assert.False(created.CreatedAt.Before(before))
+
+	invs := list()
+	assert.Len(invs, 1)
+	assert.Equal(created.UUID, invs[0].UUID)
+
+	// Accepting requires a login session
+	acceptURL := fmt.Sprintf("/api/invites/%s/accept", token)
+	req = httptest.NewRequest(echo.POST, acceptURL, nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+
+	// Accounts in other organizations are refused, and the invitation
+	// remains pending
+	code, _ = post(&mockOutsiderAccount, acceptURL, "")
+	assert.Equal(http.StatusForbidden, code)
+	assert.Len(list(), 1)
+
+	// Accept, with the token in the body
+	code, _ = post(&mockInviteeAccount, "/api/invites/accept", `{}`)
+	assert.Equal(http.StatusBadRequest, code)
+	code, resp = post(&mockInviteeAccount, "/api/invites/accept",
+		fmt.Sprintf(`{"token": %q}`, token))
+	assert.Equal(http.StatusOK, code)
+	var accepted appliancedb.AccountInvite
+	assert.NoError(json.Unmarshal(resp, &accepted))
+	assert.Equal(created.UUID, accepted.UUID)
+	assert.Equal(mockInviteeAccount.UUID, accepted.AcceptedAccountUUID.UUID)
+	assert.Empty(list())
+
+	// The token can't be reused, and expired tokens are refused
+	code, _ = post(&mockInviteeAccount, acceptURL, "")
+	assert.Equal(http.StatusNotFound, code)
+	code, _ = post(&mockInviteeAccount,
+		fmt.Sprintf("/api/invites/%s/accept", expiredToken), "")
+	assert.Equal(http.StatusNotFound, code)
+	dMock.AssertCalled(t, "AcceptInvite", mock.Anything, expiredToken,
+		mockInviteeAccount.UUID)
+}
+
+func TestInviteNewAccount(t *testing.T) {
+	assert := require.New(t)
+
+	const token = "good-token"
+	const staleToken = "stale-token"
+	user := goth.User{
+		Provider: "auth0",
+		UserID:   "invitee",
+		Name:     "Invitee",
+		Email:    mockInviteeAccount.Email,
+	}
+	var created *appliancedb.Account
+
+	dMock := &mocks.DataStore{}
+	dMock.On("LoginInfoByProviderAndSubject", mock.Anything, user.Provider, user.UserID).Return(
+		nil, appliancedb.NotFoundError{}).Once()
+	dMock.On("CreateInvitedAccount", mock.Anything, token, mock.Anything, mock.Anything, mock.Anything).Run(
+		func(args mock.Arguments) {
+			person := args.Get(2).(*appliancedb.Person)
+			created = args.Get(3).(*appliancedb.Account)
+			id := args.Get(4).(*appliancedb.OAuth2Identity)
+			assert.Equal(user.Email, person.PrimaryEmail)
+			assert.Equal(person.UUID, created.PersonUUID)
+			assert.Equal(user.Email, created.Email)
+			assert.Equal(user.Provider, id.Provider)
+			assert.Equal(user.UserID, id.Subject)
+			created.OrganizationUUID = orgUUID
+			id.AccountUUID = created.UUID
+		}).Return(&appliancedb.AccountInvite{
+		OrganizationUUID: orgUUID,
+		Role:             "user",
+	}, nil).Once()
+	dMock.On("LoginInfoByProviderAndSubject", mock.Anything, user.Provider, user.UserID).Return(
+		func(context.Context, string, string) *appliancedb.LoginInfo {
+			return &appliancedb.LoginInfo{
+				Account:         *created,
+				PrimaryOrgRoles: []string{"user"},
+			}
+		}, nil).Once()
+	defer dMock.AssertExpectations(t)
+
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	e := echo.New()
+	a := &authHandler{sessionStore: ss, db: dMock}
+	e.GET("/auth/:provider", a.getProvider)
+
+	// The token presented when the invitee begins logging in is carried
+	// through the login flow in their session.
+	login := func(token string) echo.Context {
+		req := httptest.NewRequest(echo.GET, "/auth/none?invite="+token, nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		req = httptest.NewRequest(echo.GET, "/auth/none/callback", nil)
+		for _, cookie := range rec.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		return e.NewContext(req, httptest.NewRecorder())
+	}
+
+	// An invitee with no account gets one in the invited organization,
+	// and can log in with it, even though no rule matches them.
+	li, err := a.getLoginInfo(login(token), user)
+	assert.NoError(err)
+	assert.Equal(created.UUID, li.Account.UUID)
+	assert.Equal(orgUUID, li.Account.OrganizationUUID)
+	assert.Equal([]string{"user"}, li.PrimaryOrgRoles)
+
+	// If the invitation can't be accepted, the rules decide as usual
+	dMock.On("LoginInfoByProviderAndSubject", mock.Anything, user.Provider, user.UserID).Return(
+		nil, appliancedb.NotFoundError{}).Once()
+	dMock.On("CreateInvitedAccount", mock.Anything, staleToken, mock.Anything, mock.Anything, mock.Anything).Return(
+		nil, appliancedb.NotFoundError{}).Once()
+	dMock.On("OAuth2OrganizationRuleTest", mock.Anything, user.Provider, mock.Anything, mock.Anything).Return(
+		nil, appliancedb.NotFoundError{})
+	_, err = a.getLoginInfo(login(staleToken), user)
+	uerr, ok := err.(useridError)
+	assert.True(ok, "%v", err)
+	assert.Equal(reasonNoOauthRuleMatch, uerr.Reason)
+}
+
+func TestInviteTokenNotLogged(t *testing.T) {
+	assert := require.New(t)
+
+	const token = "secret-token"
+	core, logs := observer.New(zap.InfoLevel)
+	e := echo.New()
+	e.Use(mkEchoZapLogger(zap.New(core)))
+	e.POST("/api/invites/:token/accept", func(c echo.Context) error {
+		assert.Equal(token, c.Param("token"))
+		return c.NoContent(http.StatusNotFound)
+	})
+	e.GET("/auth/:provider", func(c echo.Context) error {
+		assert.Equal(token, c.QueryParam("invite"))
+		return c.NoContent(http.StatusOK)
+	})
+
+	reqs := []*http.Request{
+		httptest.NewRequest(echo.POST, "/api/invites/"+token+"/accept", nil),
+		httptest.NewRequest(echo.GET, "/auth/google?invite="+token+"&x=1", nil),
+	}
+	for _, req := range reqs {
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	entries := logs.All()
+	assert.Len(entries, len(reqs))
+	for _, entry := range entries {
+		uri, _ := entry.ContextMap()["uri"].(string)
+		t.Logf("logged %s: %s", entry.Message, uri)
+		assert.NotContains(entry.Message, token)
+		assert.NotContains(uri, token)
+		assert.Contains(uri, "REDACTED")
+	}
+	uri, _ := entries[1].ContextMap()["uri"].(string)
+	assert.Contains(uri, "x=1")
+}
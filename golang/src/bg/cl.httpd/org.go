@@ -11,6 +11,7 @@ package main
 
 import (
 	"net/http"
+	"time"
 
 	"bg/cloud_models/appliancedb"
 
@@ -94,14 +95,54 @@ func (o *orgHandler) getOrgAccounts(c echo.Context) error {
 	return c.JSON(http.StatusOK, accounts)
 }
 
+// getOrgUsage implements GET /api/org/:org_uuid/usage, returning the
+// organization's API usage summed by day and endpoint class.  The optional
+// 'from' and 'to' parameters (RFC3339) bound the report; by default it covers
+// the last 30 days.
+func (o *orgHandler) getOrgUsage(c echo.Context) error {
+	orgUUID, err := uuid.FromString(c.Param("org_uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+
+	to := time.Now()
+	if toStr := c.QueryParam("to"); toStr != "" {
+		to, err = time.Parse(time.RFC3339, toStr)
+		if err != nil {
+			return newHTTPError(http.StatusBadRequest, "bad 'to' time")
+		}
+	}
+	from := to.AddDate(0, 0, -30)
+	if fromStr := c.QueryParam("from"); fromStr != "" {
+		from, err = time.Parse(time.RFC3339, fromStr)
+		if err != nil {
+			return newHTTPError(http.StatusBadRequest, "bad 'from' time")
+		}
+	}
+	if !from.Before(to) {
+		return newHTTPError(http.StatusBadRequest,
+			"'from' must precede 'to'")
+	}
+
+	ctx := c.Request().Context()
+	report, err := o.db.UsageReport(ctx, orgUUID, from, to)
+	if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+	if report == nil {
+		report = make([]appliancedb.UsageReportRow, 0)
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
 // mkOrgMiddleware manufactures a middleware which protects a route; only
 // users with one or more of the allowedRoles can pass through the checks; the
 // middleware adds "matched_roles" to the echo context, indicating which of the
-// allowed_roles the user actually has.
+// allowed_roles the user actually has.  Requests made in a support session are
+// authorized by the organization's support grant; see effectiveRoles.
 func (o *orgHandler) mkOrgMiddleware(allowedRoles []string) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			ctx := c.Request().Context()
 			accountUUID, ok := c.Get("account_uuid").(uuid.UUID)
 			if !ok || accountUUID == uuid.Nil {
 				return newHTTPError(http.StatusUnauthorized)
@@ -111,27 +152,21 @@ func (o *orgHandler) mkOrgMiddleware(allowedRoles []string) echo.MiddlewareFunc
 			if err != nil {
 				return newHTTPError(http.StatusBadRequest)
 			}
-			aoRoles, err := o.db.AccountOrgRolesByAccountTarget(ctx,
-				accountUUID, orgUUID)
+			matches, grant, err := effectiveRoles(c, o.db,
+				accountUUID, orgUUID, allowedRoles)
 			if err != nil {
 				return newHTTPError(http.StatusInternalServerError)
 			}
-			matches := make(matchedRoles)
-			for _, aor := range aoRoles {
-				for _, r := range aor.Roles {
-					for _, rr := range allowedRoles {
-						if r == rr {
-							matches[r] = true
-						}
-					}
-				}
-			}
 			if len(matches) > 0 {
 				c.Set("matched_roles", matches)
+				if grant != nil {
+					return serveSupport(c, o.db, grant,
+						accountUUID, next)
+				}
 				return next(c)
 			}
-			c.Logger().Debugf("Unauthorized: %s org=%v, acc=%v, ur=%v, ar=%v",
-				c.Path(), orgUUID, accountUUID, aoRoles, allowedRoles)
+			c.Logger().Debugf("Unauthorized: %s org=%v, acc=%v, ar=%v",
+				c.Path(), orgUUID, accountUUID, allowedRoles)
 			return newHTTPError(http.StatusUnauthorized)
 		}
 	}
@@ -142,12 +177,24 @@ func (o *orgHandler) mkOrgMiddleware(allowedRoles []string) echo.MiddlewareFunc
 func newOrgHandler(r *echo.Echo, db appliancedb.DataStore, middlewares []echo.MiddlewareFunc, sessionStore sessions.Store) *orgHandler {
 	h := &orgHandler{db, sessionStore}
 	r.GET("/api/org", h.getOrgs, middlewares...)
+	r.POST("/api/invites/accept", h.postInviteAccept, middlewares...)
+	r.POST("/api/invites/:token/accept", h.postInviteAccept, middlewares...)
 
 	user := h.mkOrgMiddleware([]string{"admin", "user"})
+	admin := h.mkOrgMiddleware([]string{"admin"})
 
 	org := r.Group("/api/org/:org_uuid")
 	org.Use(middlewares...)
 	org.GET("/accounts", h.getOrgAccounts, user)
+	org.GET("/usage", h.getOrgUsage, admin)
+	org.GET("/support-audit", h.getSupportAudit, admin)
+	org.GET("/support-grant", h.getSupportGrants, admin)
+	org.POST("/support-grant", h.postSupportGrant, admin)
+	org.DELETE("/support-grant/:grant_uuid", h.deleteSupportGrant, admin)
+	org.GET("/invites", h.getInvites, admin)
+	org.POST("/invites", h.postInvite, admin)
+	org.POST("/support-session", h.postSupportSession)
+	org.DELETE("/support-session", h.deleteSupportSession)
 	return h
 }
 
@@ -11,17 +11,27 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	"bg/base_def"
 	"bg/cloud_models/appliancedb"
 	"bg/common/cfgapi"
 	"bg/common/mfg"
 	"bg/common/network"
 	"bg/common/wgsite"
+	"bg/common/wifi"
 
 	"github.com/labstack/echo"
 	"github.com/pkg/errors"
@@ -68,22 +78,64 @@ func executePropChange(c echo.Context, hdl *cfgapi.Handle, ops []cfgapi.Property
 			c.Logger().Warnf("request %v did not finish before timeout: %v", ops, err)
 			return c.NoContent(http.StatusAccepted)
 		}
+		if err == cfgapi.ErrNotEqual {
+			return newHTTPError(http.StatusConflict,
+				"modified concurrently; reload and try again")
+		}
 		c.Logger().Errorf("request %v failed: %v", ops, err)
 		return newHTTPError(http.StatusInternalServerError, "Execution failed on appliance")
 	}
 	return nil
 }
 
+// Entity tags let the UI detect that something it is editing has been changed
+// by someone else since it was fetched.  The tag is returned in the ETag header
+// of a GET, and sent back in the If-Match header of the corresponding POST;
+// if the object has changed in the meantime, the POST fails with 409 Conflict.
+// Requests without If-Match are not checked.
+
+// versionETag returns the entity tag for a versioned registry record
+func versionETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// jsonETag returns an entity tag for an object in the config tree, computed
+// from the values which make up its representation.
+func jsonETag(v interface{}) string {
+	b, _ := json.Marshal(v)
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// ifMatch reports whether the request's If-Match header, if any, matches the
+// current entity tag of the object being modified.  The header may list
+// several tags, any of which may match.
+func ifMatch(c echo.Context, etag string) bool {
+	hdr := strings.TrimSpace(c.Request().Header.Get("If-Match"))
+	if hdr == "" {
+		return true
+	}
+	for _, tag := range strings.Split(hdr, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
 type siteHandler struct {
 	db              appliancedb.DataStore
 	getClientHandle getClientHandleFunc
 	twilio          *gotwilio.Twilio
+	diag            *diagTriggers
 }
 
 type siteResponse struct {
 	UUID             uuid.UUID `json:"UUID"`
 	Name             string    `json:"name"`
 	OrganizationUUID uuid.UUID `json:"organizationUUID"`
+	Archived         bool      `json:"archived"`
 }
 
 // getSites implements /api/sites, which presents a filtered list of
@@ -100,6 +152,21 @@ func (a *siteHandler) getSites(c echo.Context) error {
 		c.Logger().Errorf("Failed to get Sites by Account: %+v", err)
 		return newHTTPError(http.StatusInternalServerError, err)
 	}
+	// A support session also sees the supported organization's sites, for
+	// as long as the organization's support grant is active.
+	if supportOrg, ok := c.Get("support_org_uuid").(uuid.UUID); ok {
+		_, err = a.db.ActiveSupportGrant(ctx, supportOrg)
+		if err == nil {
+			orgSites, err := a.db.CustomerSitesByOrganization(ctx,
+				supportOrg)
+			if err != nil {
+				return newHTTPError(http.StatusInternalServerError, err)
+			}
+			sites = append(sites, orgSites...)
+		} else if _, ok := err.(appliancedb.NotFoundError); !ok {
+			return newHTTPError(http.StatusInternalServerError, err)
+		}
+	}
 
 	apiSites := make([]siteResponse, len(sites))
 	for i, site := range sites {
@@ -110,6 +177,7 @@ func (a *siteHandler) getSites(c echo.Context) error {
 			UUID:             site.UUID,
 			Name:             site.Name,
 			OrganizationUUID: site.OrganizationUUID,
+			Archived:         site.Archived(),
 		}
 	}
 	return c.JSON(http.StatusOK, &apiSites)
@@ -150,7 +218,68 @@ func (a *siteHandler) getSitesUUID(c echo.Context) error {
 		UUID:             site.UUID,
 		Name:             site.Name,
 		OrganizationUUID: site.OrganizationUUID,
+		Archived:         site.Archived(),
+	}
+	c.Response().Header().Set("ETag", versionETag(site.Version))
+	return c.JSON(http.StatusOK, resp)
+}
+
+type apiPostSite struct {
+	Name string `json:"name"`
+}
+
+// postSitesUUID implements POST /api/sites/:uuid, to rename a site.  The
+// expected version of the site may be given in the If-Match header; if the
+// site has been changed since then, 409 is returned.
+func (a *siteHandler) postSitesUUID(c echo.Context) error {
+	ctx := c.Request().Context()
+	u, err := uuid.FromString(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+
+	var input apiPostSite
+	if err := c.Bind(&input); err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	name := strings.TrimSpace(input.Name)
+	if name == "" {
+		return newHTTPError(http.StatusBadRequest, "name is required")
+	}
+
+	site, err := a.db.CustomerSiteByUUID(ctx, u)
+	if err != nil {
+		if _, ok := err.(appliancedb.NotFoundError); ok {
+			return newHTTPError(http.StatusNotFound, "No such site")
+		}
+		return newHTTPError(http.StatusInternalServerError)
+	}
+	// The stored version is checked again by the update, in case the site
+	// changes in the meantime.
+	if !ifMatch(c, versionETag(site.Version)) {
+		return newHTTPError(http.StatusConflict,
+			"site modified concurrently; reload and try again")
+	}
+	site.Name = name
+
+	err = a.db.UpdateCustomerSite(ctx, site)
+	if _, ok := err.(appliancedb.ConflictError); ok {
+		return newHTTPError(http.StatusConflict,
+			"site modified concurrently; reload and try again")
+	} else if _, ok := err.(appliancedb.NotFoundError); ok {
+		return newHTTPError(http.StatusNotFound, "No such site")
+	} else if err != nil {
+		c.Logger().Errorf("Failed to update site %v: %+v", u, err)
+		return newHTTPError(http.StatusInternalServerError)
+	}
+
+	resp := siteResponse{
+		UUID:             site.UUID,
+		Name:             site.Name,
+		OrganizationUUID: site.OrganizationUUID,
+		Archived:         site.Archived(),
 	}
+	c.Response().Header().Set("ETag", versionETag(site.Version))
 	return c.JSON(http.StatusOK, resp)
 }
 
@@ -188,6 +317,107 @@ func (a *siteHandler) getConfigTree(c echo.Context) error {
 	return c.JSON(http.StatusOK, pnode)
 }
 
+// Config properties holding secrets, whose values are withheld from config
+// searches.  These use the same pattern syntax as the searches themselves.
+var secretConfigProps = []string{
+	"@/network/vap/*/passphrase",
+	"@/network/radius_auth_secret",
+	"@/network/vpn/server/*/escrowed_key",
+	"@/network/vpn/client/*/wg/client_private",
+	"@/users/*/user_password",
+	"@/users/*/user_md4_password",
+	"@/httpd/cookie_aes_key",
+	"@/httpd/cookie_hmac_key",
+	"@/cloud/service/cloud_user_key",
+	"@/cloud/service/tunnel_user_key",
+}
+
+func secretConfigProp(prop string) bool {
+	for _, pattern := range secretConfigProps {
+		if ok, _ := path.Match(pattern, prop); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type apiConfigMatch struct {
+	Path     string `json:"path"`
+	Value    string `json:"value"`
+	Redacted bool   `json:"redacted"`
+}
+
+// getConfigSearch implements GET /api/sites/:uuid/config/search?pattern=,
+// returning the leaf properties matching a glob pattern such as
+// @/network/vap/*/ssid, sorted by path.  The values of secrets are redacted.
+func (a *siteHandler) getConfigSearch(c echo.Context) error {
+	pattern := c.QueryParam("pattern")
+	if !strings.HasPrefix(pattern, "@/") {
+		return newHTTPError(http.StatusBadRequest,
+			"pattern must start with @/")
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return newHTTPError(http.StatusBadRequest, err)
+	}
+
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	props, err := hdl.FindProps(pattern)
+	if err != nil && !cfgapi.IsConfigAbsent(err) {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+
+	resp := make([]apiConfigMatch, 0)
+	for prop, val := range props {
+		m := apiConfigMatch{Path: prop, Value: val}
+		if secretConfigProp(prop) {
+			m.Value = ""
+			m.Redacted = true
+		}
+		resp = append(resp, m)
+	}
+	sort.Slice(resp, func(i, j int) bool {
+		return resp[i].Path < resp[j].Path
+	})
+	return c.JSON(http.StatusOK, resp)
+}
+
+type apiConfigHash struct {
+	Root string `json:"root"`
+	Hash string `json:"hash"`
+}
+
+// getConfigHash implements GET /api/sites/:uuid/config/hash?root=, returning
+// a hash of the contents of the config tree, or of the subtree at root.
+// Clients may poll it cheaply, and refetch the config only when it changes.
+func (a *siteHandler) getConfigHash(c echo.Context) error {
+	root := c.QueryParam("root")
+	if root == "" {
+		root = "@/"
+	} else if !strings.HasPrefix(root, "@/") {
+		return newHTTPError(http.StatusBadRequest,
+			"root must start with @/")
+	}
+
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	hash, err := hdl.TreeHash(root)
+	if err == cfgapi.ErrNoProp {
+		return newHTTPError(http.StatusNotFound)
+	} else if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+	return c.JSON(http.StatusOK, &apiConfigHash{Root: root, Hash: hash})
+}
+
 // getFeatures implements GET /api/sites/:uuid/features
 func (a *siteHandler) getFeatures(c echo.Context) error {
 	hdl, err := a.getClientHandle(c.Param("uuid"))
@@ -349,25 +579,188 @@ func buildDeviceResponse(c echo.Context, hdl *cfgapi.Handle,
 	return &d
 }
 
+// Page sizes for GET /api/sites/:uuid/devices, when the caller asks for
+// pagination.
+const (
+	devicePageDefault = 100
+	devicePageMax     = 1000
+)
+
+// deviceQuery holds the filtering and pagination parameters accepted by GET
+// /api/sites/:uuid/devices.
+type deviceQuery struct {
+	ring     string
+	active   *bool
+	wireless *bool
+	text     string // lower case
+
+	paginate bool
+	limit    int
+	after    string // devices are returned in mac order, following this
+}
+
+// apiDevicePage is returned in place of a bare list of devices when the
+// caller asks for pagination.
+type apiDevicePage struct {
+	Devices    []*apiDevice `json:"devices"`
+	TotalCount int          `json:"totalCount"` // matching devices, on all pages
+	NextCursor string       `json:"nextCursor,omitempty"`
+}
+
+// Device cursors are opaque to callers; they hold the mac address of the last
+// device on the previous page.
+func encodeDeviceCursor(mac string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(mac))
+}
+
+func decodeDeviceCursor(cursor string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		_, err = net.ParseMAC(string(b))
+	}
+	if err != nil {
+		return "", fmt.Errorf("bad cursor '%s'", cursor)
+	}
+	return string(b), nil
+}
+
+func parseBoolParam(c echo.Context, name string) (*bool, error) {
+	s := c.QueryParam(name)
+	if s == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s '%s'", name, s)
+	}
+	return &b, nil
+}
+
+func parseDeviceQuery(c echo.Context) (*deviceQuery, error) {
+	var err error
+
+	q := &deviceQuery{
+		ring:  c.QueryParam("ring"),
+		text:  strings.ToLower(c.QueryParam("q")),
+		limit: devicePageDefault,
+	}
+	if q.active, err = parseBoolParam(c, "active"); err != nil {
+		return nil, err
+	}
+	if q.wireless, err = parseBoolParam(c, "wireless"); err != nil {
+		return nil, err
+	}
+
+	if s := c.QueryParam("limit"); s != "" {
+		q.paginate = true
+		if q.limit, err = strconv.Atoi(s); err != nil || q.limit <= 0 {
+			return nil, fmt.Errorf("bad limit '%s'", s)
+		}
+		if q.limit > devicePageMax {
+			q.limit = devicePageMax
+		}
+	}
+	if s := c.QueryParam("cursor"); s != "" {
+		q.paginate = true
+		if q.after, err = decodeDeviceCursor(s); err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+func (q *deviceQuery) match(mac string, client *cfgapi.ClientInfo) bool {
+	if q.ring != "" && client.Ring != q.ring {
+		return false
+	}
+	if q.active != nil && client.IsActive() != *q.active {
+		return false
+	}
+	if q.wireless != nil && client.Wireless != *q.wireless {
+		return false
+	}
+	if q.text != "" {
+		found := false
+		for _, s := range []string{
+			client.DisplayName(), client.DHCPName, mac,
+		} {
+			found = found || strings.Contains(strings.ToLower(s), q.text)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
 // getDevices implements /api/sites/:uuid/devices
+//
+// The devices may be filtered by ring, by active=true|false, by
+// wireless=true|false, and by a q= string found in the display name, DHCP
+// name, or mac address.  If the caller supplies a limit= or cursor=, a single
+// page of devices is returned in an apiDevicePage; otherwise all matching
+// devices are returned as a bare list.
 func (a *siteHandler) getDevices(c echo.Context) error {
+	query, err := parseDeviceQuery(c)
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, err.Error())
+	}
+
 	hdl, err := a.getClientHandle(c.Param("uuid"))
 	if err != nil {
 		return newHTTPError(http.StatusBadRequest)
 	}
 	defer hdl.Close()
 
-	allRings := hdl.GetRings()
-	response := make([]*apiDevice, 0)
-	for mac, client := range hdl.GetClients() {
+	allRings, err := hdl.GetRings()
+	if err != nil && !cfgapi.IsConfigAbsent(err) {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+
+	clients := hdl.GetClients()
+	macs := make([]string, 0)
+	for mac, client := range clients {
+		if query.match(mac, client) {
+			macs = append(macs, mac)
+		}
+	}
+	sort.Strings(macs)
+
+	total := len(macs)
+	var next string
+	if query.paginate {
+		first := sort.Search(len(macs), func(i int) bool {
+			return macs[i] > query.after
+		})
+		macs = macs[first:]
+		if len(macs) > query.limit {
+			macs = macs[:query.limit]
+			next = encodeDeviceCursor(macs[len(macs)-1])
+		}
+	}
+
+	// Only now, with the set of devices settled, do we gather the more
+	// expensive per-device information.
+	devices := make([]*apiDevice, 0, len(macs))
+	for _, mac := range macs {
+		client := clients[mac]
 		scans := hdl.GetClientScans(mac)
 		vulns := hdl.GetVulnerabilities(mac)
 		metrics := hdl.GetClientMetrics(mac)
 		allowedRings := hdl.GetClientRings(client, allRings)
 		d := buildDeviceResponse(c, hdl, mac, client, allowedRings, scans, vulns, metrics)
-		response = append(response, d)
+		devices = append(devices, d)
 	}
-	return c.JSON(http.StatusOK, response)
+
+	if !query.paginate {
+		return c.JSON(http.StatusOK, devices)
+	}
+	return c.JSON(http.StatusOK, &apiDevicePage{
+		Devices:    devices,
+		TotalCount: total,
+		NextCursor: next,
+	})
 }
 
 // getDeviceMetrics implements /api/sites/:uuid/devices/:deviceid/metrics
@@ -472,6 +865,12 @@ type siteEnrollGuestResponse struct {
 	SMSError     string `json:"smsError"`
 }
 
+// invalidNumberCode reports whether a Twilio error code indicates that the
+// destination phone number was invalid.
+func invalidNumberCode(code int) bool {
+	return code >= 21210 && code <= 21217
+}
+
 // sendOneSMS is a utility helper for the Enroll handler.
 func (a *siteHandler) sendOneSMS(from, to, message string) (*siteEnrollGuestResponse, error) {
 	var response *siteEnrollGuestResponse
@@ -481,7 +880,7 @@ func (a *siteHandler) sendOneSMS(from, to, message string) (*siteEnrollGuestResp
 	}
 	if exception != nil {
 		rstr := "Twilio failed sending SMS."
-		if exception.Code >= 21210 && exception.Code <= 21217 {
+		if invalidNumberCode(int(exception.Code)) {
 			rstr = "Invalid Phone Number"
 		}
 		response = &siteEnrollGuestResponse{false, int(exception.Code), rstr}
@@ -530,12 +929,39 @@ func (a *siteHandler) postEnrollGuest(c echo.Context) error {
 		return newHTTPError(http.StatusBadRequest, "missing phoneNumber")
 	}
 
+	siteUU, err := uuid.FromString(siteUUID)
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, "bad site uuid")
+	}
+	attempt := appliancedb.GuestEnrollAttempt{
+		AccountUUID: uuid.NullUUID{UUID: accountUUID, Valid: true},
+		SiteUUID:    siteUU,
+		Timestamp:   time.Now(),
+	}
+	// Record the outcome of the enrollment, successful or not, so that
+	// abuse can be spotted.  A failure to record doesn't fail the request.
+	// Only normalized numbers are hashed, so that each number has a single
+	// hash; input which can't be parsed is recorded with an empty hash.
+	record := func(number, result string) {
+		attempt.PhoneHash = []byte{}
+		if number != "" {
+			attempt.PhoneHash = a.db.HashGuestPhoneNumber(number)
+		}
+		attempt.Result = result
+		ctx := c.Request().Context()
+		if err := a.db.RecordGuestEnrollAttempt(ctx, attempt); err != nil {
+			c.Logger().Warnf("Enroll Guest Handler: failed to record attempt: %v", err)
+		}
+	}
+
 	// XXX need to solve phone region eventually
 	to, err := libphonenumber.Parse(gr.PhoneNumber, "US")
 	if err != nil {
+		record("", appliancedb.GuestEnrollInvalidNumber)
 		return c.JSON(http.StatusOK, &siteEnrollGuestResponse{false, 0, "Invalid Phone Number"})
 	}
 	formattedTo := libphonenumber.Format(to, libphonenumber.INTERNATIONAL)
+	e164To := libphonenumber.Format(to, libphonenumber.E164)
 	from := "+16507694283"
 	c.Logger().Infof("Guest Enroll Handler: from='%v' formattedTo='%v'\n", from, formattedTo)
 
@@ -551,6 +977,7 @@ func (a *siteHandler) postEnrollGuest(c echo.Context) error {
 		response, err = a.sendOneSMS(from, formattedTo, message)
 		if err != nil {
 			c.Logger().Warnf("Enroll Guest Handler: twilio err='%v'\n", err)
+			record(e164To, appliancedb.GuestEnrollSendError)
 			return newHTTPError(http.StatusInternalServerError, "Twilio Error")
 		}
 		// if not sent then give up sending more
@@ -558,16 +985,90 @@ func (a *siteHandler) postEnrollGuest(c echo.Context) error {
 			break
 		}
 	}
+	if response.SMSDelivered {
+		record(e164To, appliancedb.GuestEnrollSent)
+	} else if invalidNumberCode(response.SMSErrorCode) {
+		record(e164To, appliancedb.GuestEnrollInvalidNumber)
+	} else {
+		record(e164To, appliancedb.GuestEnrollUndelivered)
+	}
 	return c.JSON(http.StatusOK, response)
 }
 
+type apiGuestEnrollAttempt struct {
+	Timestamp   time.Time  `json:"timestamp"`
+	AccountUUID *uuid.UUID `json:"accountUUID"`
+	PhoneID     string     `json:"phoneID"`
+	Result      string     `json:"result"`
+}
+
+// The number of bytes of a phone number's keyed hash reported as its phone ID
+const guestPhoneIDLen = 8
+
+// getGuestEnrollAttempts implements GET /api/sites/:uuid/guests/attempts,
+// returning the log of guest enrollment attempts at the site.  Phone numbers
+// aren't reported; instead, each attempt carries an opaque phone ID, a
+// truncation of the number's keyed hash, which is the same for attempts
+// against the same number.  The phone ID is empty if the number couldn't be
+// parsed.  The optional 'since' parameter (RFC3339) limits the results to
+// recent attempts; it defaults to the last day.
+func (a *siteHandler) getGuestEnrollAttempts(c echo.Context) error {
+	siteUUID, err := uuid.FromString(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, "bad site uuid")
+	}
+
+	since := time.Now().Add(-24 * time.Hour)
+	if sinceStr := c.QueryParam("since"); sinceStr != "" {
+		since, err = time.Parse(time.RFC3339, sinceStr)
+		if err != nil {
+			return newHTTPError(http.StatusBadRequest, "bad 'since' time")
+		}
+	}
+
+	ctx := c.Request().Context()
+	attempts, err := a.db.GuestEnrollAttemptsBySite(ctx, siteUUID, since)
+	if err != nil {
+		return newHTTPError(http.StatusInternalServerError)
+	}
+
+	resp := make([]apiGuestEnrollAttempt, len(attempts))
+	for i, attempt := range attempts {
+		phoneID := attempt.PhoneHash
+		if len(phoneID) > guestPhoneIDLen {
+			phoneID = phoneID[:guestPhoneIDLen]
+		}
+		resp[i] = apiGuestEnrollAttempt{
+			Timestamp: attempt.Timestamp,
+			PhoneID:   hex.EncodeToString(phoneID),
+			Result:    attempt.Result,
+		}
+		if attempt.AccountUUID.Valid {
+			acct := attempt.AccountUUID.UUID
+			resp[i].AccountUUID = &acct
+		}
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
 type siteHealth struct {
-	HeartbeatProblem bool `json:"heartbeatProblem"`
-	ConfigProblem    bool `json:"configProblem"`
+	Archived         bool    `json:"archived"`
+	HeartbeatProblem bool    `json:"heartbeatProblem"`
+	ConfigProblem    bool    `json:"configProblem"`
+	ConfigLatencyMs  float64 `json:"configLatencyMs"`
+	PendingChanges   bool    `json:"pendingChanges"`
 }
 
-// getHealth implements /api/sites/:uuid/health
+// How long getHealth waits for the site's config plane to answer a ping
+var healthPingTimeout = 5 * time.Second
+
+// getHealth implements /api/sites/:uuid/health.  An archived site is expected
+// to be offline, so its health isn't evaluated, and no problems are reported.
 func (a *siteHandler) getHealth(c echo.Context) error {
+	if archived, _ := c.Get("site_archived").(bool); archived {
+		return c.JSON(http.StatusOK, siteHealth{Archived: true})
+	}
+
 	hdl, err := a.getClientHandle(c.Param("uuid"))
 	if err != nil {
 		return newHTTPError(http.StatusBadRequest)
@@ -593,14 +1094,44 @@ func (a *siteHandler) getHealth(c echo.Context) error {
 	}
 
 	siteNullUUID := uuid.NullUUID{UUID: siteUUID, Valid: true}
-	cmds, err := a.db.CommandAuditHealth(ctx, siteNullUUID, time.Now().Add(-1*(time.Minute*3)))
+	cmds, err := a.db.CommandAuditHealth(ctx, siteNullUUID, time.Now().Add(-1*(time.Minute*3)), false)
 	if err == nil && len(cmds) > 0 {
 		response.ConfigProblem = true
 	}
 
+	// A ping which times out, or fails outright, is a config problem; we
+	// report how long we waited either way.
+	pingCtx, cancel := context.WithTimeout(ctx, healthPingTimeout)
+	rtt, err := hdl.PingTimed(pingCtx)
+	cancel()
+	response.ConfigLatencyMs = float64(rtt) / float64(time.Millisecond)
+	if err != nil {
+		c.Logger().Warnf("Failed to ping config for %v: %v", siteUUID, err)
+		response.ConfigProblem = true
+	}
+
+	// Changes the appliance has accepted, but is holding until a service
+	// restarts.
+	pending, err := hdl.HasPendingChanges()
+	if err != nil {
+		c.Logger().Warnf("Failed to get pending restarts for %v: %v", siteUUID, err)
+	} else {
+		response.PendingChanges = pending
+	}
+
 	return c.JSON(http.StatusOK, response)
 }
 
+// configErrorStatus returns the HTTP status to report when a site's
+// configuration couldn't be retrieved: the problem lies upstream of us, so we
+// report a gateway timeout or a bad gateway.
+func configErrorStatus(err error) int {
+	if cfgapi.IsConfigTimeout(err) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
 // getNetworkDNS implements GET /api/sites/:uuid/network/dns, returning DNS
 // configuration information for the site.
 func (a *siteHandler) getNetworkDNS(c echo.Context) error {
@@ -609,11 +1140,123 @@ func (a *siteHandler) getNetworkDNS(c echo.Context) error {
 		return newHTTPError(http.StatusBadRequest)
 	}
 	defer hdl.Close()
-	dns := hdl.GetDNSInfo()
-	return c.JSON(http.StatusOK, &dns)
+
+	dns, err := hdl.GetDNSInfo()
+	if cfgapi.IsConfigAbsent(err) {
+		dns = &cfgapi.DNSInfo{Servers: make([]string, 0)}
+	} else if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+	return c.JSON(http.StatusOK, dns)
+}
+
+// getNetworkDNSEntries implements GET /api/sites/:uuid/network/dns/entries,
+// returning the site's custom DNS entries.
+func (a *siteHandler) getNetworkDNSEntries(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	entries, err := hdl.GetCustomDNSEntries()
+	if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+	return c.JSON(http.StatusOK, entries)
+}
+
+type apiDNSEntry struct {
+	Name     string `json:"name"`
+	Address  string `json:"address"`
+	External bool   `json:"external"`
+}
+
+// addrInRing tests whether an address falls within one of the site's ring
+// subnets.
+func addrInRing(rings cfgapi.RingMap, ip net.IP) bool {
+	for _, ring := range rings {
+		_, subnet, err := net.ParseCIDR(ring.Subnet)
+		if err == nil && subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// postNetworkDNSEntries implements POST /api/sites/:uuid/network/dns/entries,
+// adding or replacing a custom DNS entry.  Unless the entry is marked as
+// external, its address must be within one of the site's rings.
+func (a *siteHandler) postNetworkDNSEntries(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	var input apiDNSEntry
+	if err := c.Bind(&input); err != nil {
+		return newHTTPError(http.StatusBadRequest, "bad dns entry")
+	}
+	name := strings.ToLower(input.Name)
+	if !network.ValidDNSLabel(name) {
+		return newHTTPError(http.StatusBadRequest, "invalid name")
+	}
+	ip := net.ParseIP(input.Address).To4()
+	if ip == nil {
+		return newHTTPError(http.StatusBadRequest, "invalid IPv4 address")
+	}
+	if !input.External {
+		rings, err := hdl.GetRings()
+		if err != nil {
+			return newHTTPError(configErrorStatus(err), err)
+		}
+		if !addrInRing(rings, ip) {
+			return newHTTPError(http.StatusBadRequest,
+				"address is not within any ring")
+		}
+	}
+	if hdl.DNSNameInUse(name) {
+		return newHTTPError(http.StatusBadRequest, "name already in use")
+	}
+
+	ops := cfgapi.CustomDNSEntryOps(cfgapi.CustomDNSEntry{
+		Name:    name,
+		Address: ip.String(),
+	})
+	return executePropChange(c, hdl, ops)
+}
+
+// deleteNetworkDNSEntry implements DELETE
+// /api/sites/:uuid/network/dns/entries/:name, removing a custom DNS entry.
+func (a *siteHandler) deleteNetworkDNSEntry(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	entries, err := hdl.GetCustomDNSEntries()
+	if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+	name := strings.ToLower(c.Param("name"))
+	for _, entry := range entries {
+		if entry.Name == name {
+			ops := cfgapi.DeleteCustomDNSEntryOps(name)
+			return executePropChange(c, hdl, ops)
+		}
+	}
+	return newHTTPError(http.StatusNotFound)
+}
+
+type apiVAPSummary struct {
+	Name    string `json:"name"`
+	Clients int    `json:"clients"`
 }
 
-// getNetworkVAP implements GET /api/sites/:uuid/network/vap, returning the list of VAPs
+// getNetworkVAP implements GET /api/sites/:uuid/network/vap, returning the list
+// of VAPs, along with the number of clients connected to each.
 func (a *siteHandler) getNetworkVAP(c echo.Context) error {
 	hdl, err := a.getClientHandle(c.Param("uuid"))
 	if err != nil {
@@ -621,12 +1264,22 @@ func (a *siteHandler) getNetworkVAP(c echo.Context) error {
 	}
 	defer hdl.Close()
 
-	vapNames := make([]string, 0)
-	vaps := hdl.GetVirtualAPs()
-	for vapName := range vaps {
-		vapNames = append(vapNames, vapName)
+	counts, err := hdl.GetVAPClientCounts()
+	if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+
+	vaps := make([]apiVAPSummary, 0, len(counts))
+	for vapName, clients := range counts {
+		vaps = append(vaps, apiVAPSummary{
+			Name:    vapName,
+			Clients: clients,
+		})
 	}
-	return c.JSON(http.StatusOK, &vapNames)
+	sort.Slice(vaps, func(i, j int) bool {
+		return vaps[i].Name < vaps[j].Name
+	})
+	return c.JSON(http.StatusOK, &vaps)
 }
 
 // getNetworkVAPName implements GET /api/sites/:uuid/network/vap/:name,
@@ -696,20 +1349,495 @@ func (a *siteHandler) postNetworkVAPName(c echo.Context) error {
 	return executePropChange(c, hdl, ops)
 }
 
-// getNetworkWan implements GET /api/sites/:uuid/network/wan
-// returning information about the Wan link
-func (a *siteHandler) getNetworkWan(c echo.Context) error {
+// getNetworkVAPPortal implements GET
+// /api/sites/:uuid/network/vap/:name/portal, returning the captive portal
+// configuration for a VAP.
+func (a *siteHandler) getNetworkVAPPortal(c echo.Context) error {
 	hdl, err := a.getClientHandle(c.Param("uuid"))
 	if err != nil {
 		return newHTTPError(http.StatusBadRequest)
 	}
 	defer hdl.Close()
 
-	wan := hdl.GetWanInfo()
-	if wan == nil {
-		wan = &cfgapi.WanInfo{}
+	portal, err := hdl.GetCaptivePortal(c.Param("vapname"))
+	if err == cfgapi.ErrNoProp {
+		return newHTTPError(http.StatusNotFound)
+	} else if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
 	}
-	return c.JSON(http.StatusOK, wan)
+	return c.JSON(http.StatusOK, portal)
+}
+
+type apiVAPPortalUpdate struct {
+	Enabled   *bool   `json:"enabled"`
+	SplashURL *string `json:"splashURL"`
+}
+
+// validSplashURL tests whether a captive portal splash page URL is something
+// we can redirect clients to: an absolute http or https URL.
+func validSplashURL(splash string) bool {
+	u, err := url.Parse(splash)
+	if err != nil {
+		return false
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	return u.Host != ""
+}
+
+// postNetworkVAPPortal implements POST
+// /api/sites/:uuid/network/vap/:name/portal, allowing updates to the captive
+// portal configuration for a VAP.  Setting the splash URL to "" removes it.
+func (a *siteHandler) postNetworkVAPPortal(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	var input, empty apiVAPPortalUpdate
+	if err := c.Bind(&input); err != nil {
+		return newHTTPError(http.StatusBadRequest, "bad portal")
+	}
+	if input == empty {
+		return newHTTPError(http.StatusBadRequest, "must specify a field to modify")
+	}
+
+	vapName := c.Param("vapname")
+	portal, err := hdl.GetCaptivePortal(vapName)
+	if err == cfgapi.ErrNoProp {
+		return newHTTPError(http.StatusNotFound)
+	} else if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+
+	splash := portal.SplashURL
+	if input.SplashURL != nil {
+		splash = *input.SplashURL
+		if splash != "" && !validSplashURL(splash) {
+			return newHTTPError(http.StatusBadRequest,
+				"splash URL must be an absolute http or https URL")
+		}
+	}
+	enabled := portal.Enabled
+	if input.Enabled != nil {
+		enabled = *input.Enabled
+	}
+	if enabled && splash == "" {
+		return newHTTPError(http.StatusBadRequest,
+			"splash URL required to enable the portal")
+	}
+
+	path := fmt.Sprintf("@/network/vap/%s/portal", vapName)
+	ops := []cfgapi.PropertyOp{
+		{
+			Op:   cfgapi.PropTest,
+			Name: fmt.Sprintf("@/network/vap/%s", vapName),
+		},
+		{
+			Op:    cfgapi.PropCreate,
+			Name:  path + "/enabled",
+			Value: fmt.Sprintf("%t", enabled),
+		},
+	}
+	if splash != "" {
+		ops = append(ops, cfgapi.PropertyOp{
+			Op:    cfgapi.PropCreate,
+			Name:  path + "/splash_url",
+			Value: splash,
+		})
+	} else if portal.SplashURL != "" {
+		ops = append(ops, cfgapi.PropertyOp{
+			Op:   cfgapi.PropDelete,
+			Name: path + "/splash_url",
+		})
+	}
+	return executePropChange(c, hdl, ops)
+}
+
+// getNetworkVAPQuota implements GET /api/sites/:uuid/network/vap/:name/quota,
+// returning the usage quota for a VAP.
+func (a *siteHandler) getNetworkVAPQuota(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	quota, err := hdl.GetGuestQuota(c.Param("vapname"))
+	if err == cfgapi.ErrNoProp {
+		return newHTTPError(http.StatusNotFound)
+	} else if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+	return c.JSON(http.StatusOK, quota)
+}
+
+// The limits are signed so that negative values can be detected and rejected,
+// rather than failing to bind.
+type apiVAPQuotaUpdate struct {
+	DailyBytes *int64 `json:"dailyBytes"`
+	MaxClients *int   `json:"maxClients"`
+}
+
+// maxQuotaClients is the largest number of clients which may associate with a
+// single BSS; 802.11 association IDs are limited to 1-2007.
+const maxQuotaClients = 2007
+
+// postNetworkVAPQuota implements POST
+// /api/sites/:uuid/network/vap/:name/quota, allowing updates to the usage
+// quota for a VAP.  Setting a limit to 0 removes it.
+func (a *siteHandler) postNetworkVAPQuota(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	var input, empty apiVAPQuotaUpdate
+	if err := c.Bind(&input); err != nil {
+		return newHTTPError(http.StatusBadRequest, "bad quota")
+	}
+	if input == empty {
+		return newHTTPError(http.StatusBadRequest, "must specify a field to modify")
+	}
+	if input.DailyBytes != nil && *input.DailyBytes < 0 {
+		return newHTTPError(http.StatusBadRequest,
+			"dailyBytes must not be negative")
+	}
+	if input.MaxClients != nil &&
+		(*input.MaxClients < 0 || *input.MaxClients > maxQuotaClients) {
+		return newHTTPError(http.StatusBadRequest, fmt.Sprintf(
+			"maxClients must be between 0 and %d", maxQuotaClients))
+	}
+
+	vapName := c.Param("vapname")
+	quota, err := hdl.GetGuestQuota(vapName)
+	if err == cfgapi.ErrNoProp {
+		return newHTTPError(http.StatusNotFound)
+	} else if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+
+	if input.DailyBytes != nil {
+		quota.DailyBytes = uint64(*input.DailyBytes)
+	}
+	if input.MaxClients != nil {
+		quota.MaxClients = *input.MaxClients
+	}
+	return executePropChange(c, hdl, cfgapi.GuestQuotaOps(vapName, quota))
+}
+
+// getPolicyUpdate implements GET /api/sites/:uuid/policy/update, returning
+// the site's auto-update policy.
+func (a *siteHandler) getPolicyUpdate(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	policy, err := hdl.GetUpdatePolicy()
+	if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+	return c.JSON(http.StatusOK, policy)
+}
+
+type apiUpdatePolicyUpdate struct {
+	Auto        *bool   `json:"auto"`
+	Channel     *string `json:"channel"`
+	WindowStart *string `json:"windowStart"`
+	WindowEnd   *string `json:"windowEnd"`
+}
+
+// postPolicyUpdate implements POST /api/sites/:uuid/policy/update, allowing
+// updates to the site's auto-update policy.  Fields which are omitted are left
+// alone; setting both ends of the maintenance window to "" removes it.
+func (a *siteHandler) postPolicyUpdate(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	var input, empty apiUpdatePolicyUpdate
+	if err := c.Bind(&input); err != nil {
+		return newHTTPError(http.StatusBadRequest, "bad update policy")
+	}
+	if input == empty {
+		return newHTTPError(http.StatusBadRequest, "must specify a field to modify")
+	}
+
+	policy, err := hdl.GetUpdatePolicy()
+	if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+	if input.Auto != nil {
+		policy.Auto = *input.Auto
+	}
+	if input.Channel != nil {
+		policy.Channel = *input.Channel
+	}
+	if input.WindowStart != nil {
+		policy.WindowStart = *input.WindowStart
+	}
+	if input.WindowEnd != nil {
+		policy.WindowEnd = *input.WindowEnd
+	}
+	if err = policy.Validate(); err != nil {
+		return newHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return executePropChange(c, hdl, cfgapi.UpdatePolicyOps(policy))
+}
+
+// getPolicyAlerts implements GET /api/sites/:uuid/policy/alerts, returning
+// the site's alert policy: which events result in notifications, and how they
+// are delivered.
+func (a *siteHandler) getPolicyAlerts(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	config, err := hdl.GetAlertConfig()
+	if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+	return c.JSON(http.StatusOK, config)
+}
+
+type apiAlertRuleUpdate struct {
+	Notify    *bool `json:"notify"`
+	Threshold *int  `json:"threshold"`
+}
+
+type apiAlertPolicyUpdate struct {
+	Events   map[string]apiAlertRuleUpdate `json:"events"`
+	Channels *[]string                     `json:"channels"`
+}
+
+// postPolicyAlerts implements POST /api/sites/:uuid/policy/alerts, allowing
+// updates to the site's alert policy.  Event types and rule fields which are
+// omitted are left alone, as are the channels if they are omitted.
+func (a *siteHandler) postPolicyAlerts(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	var input apiAlertPolicyUpdate
+	if err := c.Bind(&input); err != nil {
+		return newHTTPError(http.StatusBadRequest, "bad alert policy")
+	}
+	if len(input.Events) == 0 && input.Channels == nil {
+		return newHTTPError(http.StatusBadRequest, "must specify a field to modify")
+	}
+
+	config, err := hdl.GetAlertConfig()
+	if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+	for event, update := range input.Events {
+		rule := config.Events[event]
+		if update.Notify != nil {
+			rule.Notify = *update.Notify
+		}
+		if update.Threshold != nil {
+			rule.Threshold = *update.Threshold
+		}
+		config.Events[event] = rule
+	}
+	if input.Channels != nil {
+		config.Channels = *input.Channels
+	}
+	if err = config.Validate(); err != nil {
+		return newHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return executePropChange(c, hdl, cfgapi.AlertConfigOps(config))
+}
+
+// getNetworkSecuritySummary implements GET
+// /api/sites/:uuid/network/security-summary, returning the security type of
+// each VAP, with open networks flagged.  Passphrases and other secrets are
+// never included.
+func (a *siteHandler) getNetworkSecuritySummary(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	summary, err := hdl.GetNetworkSecuritySummary()
+	if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+	return c.JSON(http.StatusOK, summary)
+}
+
+// apiTrustedCA describes a trusted CA certificate, without the certificate
+// itself.
+type apiTrustedCA struct {
+	Name        string    `json:"name"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	NotBefore   time.Time `json:"notBefore"`
+	NotAfter    time.Time `json:"notAfter"`
+	Fingerprint string    `json:"fingerprint"`
+}
+
+// getTrustedCAs implements GET /api/sites/:uuid/security/trusted-cas,
+// returning the custom CA certificates trusted by the site's appliances.
+func (a *siteHandler) getTrustedCAs(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	cas, err := hdl.GetTrustedCAs()
+	if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+
+	resp := make([]apiTrustedCA, len(cas))
+	for i, ca := range cas {
+		resp[i] = apiTrustedCA{
+			Name:        ca.Name,
+			Subject:     ca.Subject,
+			Issuer:      ca.Issuer,
+			NotBefore:   ca.NotBefore,
+			NotAfter:    ca.NotAfter,
+			Fingerprint: ca.Fingerprint,
+		}
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+type apiTrustedCAAdd struct {
+	Name string `json:"name"`
+	PEM  string `json:"pem"`
+}
+
+// postTrustedCA implements POST /api/sites/:uuid/security/trusted-cas, adding
+// a PEM-encoded CA certificate to those trusted by the site, or replacing the
+// one with the same name.
+func (a *siteHandler) postTrustedCA(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	var input apiTrustedCAAdd
+	if err := c.Bind(&input); err != nil {
+		return newHTTPError(http.StatusBadRequest, "bad trusted CA")
+	}
+	ca, err := cfgapi.ParseTrustedCA(input.Name, input.PEM)
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return executePropChange(c, hdl, cfgapi.TrustedCAOps(ca))
+}
+
+// deleteTrustedCA implements DELETE
+// /api/sites/:uuid/security/trusted-cas/:name, removing a trusted CA
+// certificate.
+func (a *siteHandler) deleteTrustedCA(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	cas, err := hdl.GetTrustedCAs()
+	if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+	name := c.Param("name")
+	for _, ca := range cas {
+		if ca.Name == name {
+			ops := cfgapi.DeleteTrustedCAOps(name)
+			return executePropChange(c, hdl, ops)
+		}
+	}
+	return newHTTPError(http.StatusNotFound)
+}
+
+// getNetworkWan implements GET /api/sites/:uuid/network/wan
+// returning information about the Wan link
+func (a *siteHandler) getNetworkWan(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	wan, err := hdl.GetWanInfo()
+	if cfgapi.IsConfigAbsent(err) {
+		wan = &cfgapi.WanInfo{}
+	} else if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+	return c.JSON(http.StatusOK, wan)
+}
+
+// getNetworkWanUplinks implements GET /api/sites/:uuid/network/wan/uplinks,
+// returning the site's WAN uplinks, most preferred first, and which of them is
+// active.  A site without failover has no uplinks.
+func (a *siteHandler) getNetworkWanUplinks(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	uplinks, err := hdl.GetWanUplinks()
+	if cfgapi.IsConfigAbsent(err) {
+		uplinks = make([]cfgapi.WanUplink, 0)
+	} else if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+	return c.JSON(http.StatusOK, uplinks)
+}
+
+// apiRegulatory describes the regulatory domain a site operates in, and the
+// channels it may use in each band.
+type apiRegulatory struct {
+	CountryCode string              `json:"countryCode"`
+	LoBand      []cfgapi.RegChannel `json:"loBand"`
+	HiBand      []cfgapi.RegChannel `json:"hiBand"`
+}
+
+// getNetworkRegulatory implements GET /api/sites/:uuid/network/regulatory,
+// returning the site's regulatory domain and its legal channels
+func (a *siteHandler) getNetworkRegulatory(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	info, err := hdl.GetRegulatoryInfo()
+	if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+
+	resp := apiRegulatory{
+		CountryCode: info.CountryCode,
+		LoBand:      info.Channels[wifi.LoBand],
+		HiBand:      info.Channels[wifi.HiBand],
+	}
+	if resp.LoBand == nil {
+		resp.LoBand = make([]cfgapi.RegChannel, 0)
+	}
+	if resp.HiBand == nil {
+		resp.HiBand = make([]cfgapi.RegChannel, 0)
+	}
+	return c.JSON(http.StatusOK, &resp)
 }
 
 // getNetworkWG implements GET /api/sites/:uuid/network/wg
@@ -778,6 +1906,12 @@ type apiNodeNic struct {
 	Ring       string           `json:"ring"`
 	Silkscreen string           `json:"silkscreen"`
 	WifiInfo   *cfgapi.WifiInfo `json:"wifiInfo,omitempty"`
+
+	// Set when the radio isn't running with its configured settings
+	ConfigDrift *cfgapi.WifiDrift `json:"configDrift,omitempty"`
+
+	// Omitted when no MTU is configured and the kernel's default is used
+	MTU int `json:"mtu,omitempty"`
 }
 
 type apiNodeInfo struct {
@@ -790,6 +1924,7 @@ type apiNodeInfo struct {
 	Nics         []apiNodeNic `json:"nics"`
 	SerialNumber string       `json:"serialNumber"` // registry SN
 	HWModel      string       `json:"hwModel"`
+	ETag         string       `json:"etag"` // for If-Match in postNode
 }
 
 func (a *siteHandler) lookupApplianceByNodeID(ctx context.Context, nodeID string) *appliancedb.ApplianceID {
@@ -864,6 +1999,14 @@ func (a *siteHandler) getNodes(c echo.Context) error {
 	if err != nil {
 		return newHTTPError(http.StatusInternalServerError, err)
 	}
+	drift, err := hdl.GetWifiConfigDrift()
+	if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+	mtus, err := hdl.GetInterfaceMTUs()
+	if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
 	for _, node := range nodes {
 		ni := apiNodeInfo{
 			ID:       node.ID,
@@ -872,6 +2015,7 @@ func (a *siteHandler) getNodes(c echo.Context) error {
 			BootTime: node.BootTime,
 			Alive:    node.Alive,
 			Addr:     node.Addr,
+			ETag:     jsonETag(node.Name),
 		}
 
 		applianceID := a.lookupApplianceByNodeID(ctx, node.ID)
@@ -918,14 +2062,19 @@ func (a *siteHandler) getNodes(c echo.Context) error {
 					kind = kind + ":lan"
 				}
 			}
-			ni.Nics = append(ni.Nics, apiNodeNic{
+			nic := apiNodeNic{
 				Name:       nicInfo.Name,
 				MacAddr:    nicInfo.MacAddr,
 				Kind:       kind,
 				Ring:       nicInfo.Ring,
 				Silkscreen: nicInfoToSilkscreen(&nicInfo, &node),
 				WifiInfo:   nicInfo.WifiInfo,
-			})
+			}
+			if d, ok := drift[node.ID+"/"+nicInfo.ID]; ok {
+				nic.ConfigDrift = &d
+			}
+			nic.MTU = mtus[node.ID+"/"+nicInfo.ID]
+			ni.Nics = append(ni.Nics, nic)
 		}
 		result = append(result, ni)
 	}
@@ -938,7 +2087,8 @@ type apiPostNode struct {
 
 // postNode implements POST /api/sites/:uuid/nodes/:nodeID
 // to adjust per-node settings; presently only setting the name is
-// supported.
+// supported.  If the request carries an If-Match header, it must match the
+// node's etag as reported by getNodes, or 409 is returned.
 func (a *siteHandler) postNode(c echo.Context) error {
 	hdl, err := a.getClientHandle(c.Param("uuid"))
 	if err != nil {
@@ -947,6 +2097,7 @@ func (a *siteHandler) postNode(c echo.Context) error {
 	defer hdl.Close()
 
 	nodeID := c.Param("nodeid")
+	nameProp := fmt.Sprintf("@/nodes/%s/name", nodeID)
 
 	var input apiPostNode
 	if err := c.Bind(&input); err != nil {
@@ -958,12 +2109,31 @@ func (a *siteHandler) postNode(c echo.Context) error {
 			Op:   cfgapi.PropTest,
 			Name: fmt.Sprintf("@/nodes/%s", nodeID),
 		},
-		{
-			Op:    cfgapi.PropCreate,
-			Name:  fmt.Sprintf("@/nodes/%s/name", nodeID),
-			Value: input.Name,
-		},
 	}
+	if c.Request().Header.Get("If-Match") != "" {
+		name, err := hdl.GetProp(nameProp)
+		if err != nil && !cfgapi.IsConfigAbsent(err) {
+			return newHTTPError(configErrorStatus(err), err)
+		}
+		if !ifMatch(c, jsonETag(name)) {
+			return newHTTPError(http.StatusConflict,
+				"node modified concurrently; reload and try again")
+		}
+		// Make sure the name doesn't change between our check and
+		// the update.
+		if err == nil {
+			ops = append(ops, cfgapi.PropertyOp{
+				Op:    cfgapi.PropTestEq,
+				Name:  nameProp,
+				Value: name,
+			})
+		}
+	}
+	ops = append(ops, cfgapi.PropertyOp{
+		Op:    cfgapi.PropCreate,
+		Name:  nameProp,
+		Value: input.Name,
+	})
 	return executePropChange(c, hdl, ops)
 }
 
@@ -1053,6 +2223,208 @@ func (a *siteHandler) postNodePort(c echo.Context) error {
 	return executePropChange(c, hdl, ops)
 }
 
+type apiPostNodePortMTU struct {
+	MTU int `json:"mtu"`
+}
+
+// postNodePortMTU implements
+// POST /api/sites/:uuid/nodes/:nodeID/ports/:portID/mtu, setting the MTU of a
+// wired port.
+func (a *siteHandler) postNodePortMTU(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	nodeID := c.Param("nodeid")
+	portID := c.Param("portid")
+	var input apiPostNodePortMTU
+	if err := c.Bind(&input); err != nil {
+		return newHTTPError(http.StatusBadRequest, "input binding")
+	}
+	if err := cfgapi.ValidInterfaceMTU(input.MTU); err != nil {
+		return newHTTPError(http.StatusBadRequest, err.Error())
+	}
+	nic, err := hdl.GetNic(nodeID, portID)
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, "nic")
+	}
+	if nic.Kind != "wired" {
+		return newHTTPError(http.StatusBadRequest, "mtu, wired")
+	}
+
+	return executePropChange(c, hdl,
+		cfgapi.InterfaceMTUOps(nodeID, portID, input.MTU))
+}
+
+const (
+	// When a channel's utilization hasn't been measured, each neighboring
+	// access point is assumed to occupy this percentage of its airtime.
+	neighborAirtime = 10.0
+
+	// In the 2.4GHz band, 20MHz channels closer than this overlap.
+	loBandOverlap = 5
+)
+
+// apiChannelCandidate explains how a channel was rated when recommending a
+// channel.  Neighbors counts the access points seen on or overlapping the
+// channel.  Busy is only known for the channel the node is currently using.
+// Score is the estimated percentage of the channel's airtime already in use;
+// lower is better.
+type apiChannelCandidate struct {
+	Channel   int      `json:"channel"`
+	Neighbors int      `json:"neighbors"`
+	Busy      *float64 `json:"busy,omitempty"`
+	Score     float64  `json:"score"`
+}
+
+// apiBandRecommendation is the recommended channel for one band, along with
+// the ratings of all of the candidates considered.  Current is 0 if the node
+// isn't operating in the band.
+type apiBandRecommendation struct {
+	Current     int                   `json:"current"`
+	Recommended int                   `json:"recommended"`
+	Candidates  []apiChannelCandidate `json:"candidates"`
+}
+
+type apiChannelRecommendation struct {
+	LoBand *apiBandRecommendation `json:"loBand,omitempty"`
+	HiBand *apiBandRecommendation `json:"hiBand,omitempty"`
+}
+
+// rateChannels scores each of the candidate channels in a band, and picks the
+// least congested.  Ties favor the current channel, to avoid needless
+// disruption, and then the lowest channel.
+func rateChannels(band string, candidates []int, current int,
+	survey []cfgapi.SurveyChannel, util *cfgapi.ChannelUtil) *apiBandRecommendation {
+
+	rec := &apiBandRecommendation{
+		Current:    current,
+		Candidates: make([]apiChannelCandidate, 0),
+	}
+	best := -1
+	for _, ch := range candidates {
+		cand := apiChannelCandidate{Channel: ch}
+		for _, s := range survey {
+			dist := s.Channel - ch
+			if dist < 0 {
+				dist = -dist
+			}
+			if dist == 0 || (band == wifi.LoBand && dist < loBandOverlap) {
+				cand.Neighbors += s.Neighbors
+			}
+		}
+		cand.Score = neighborAirtime * float64(cand.Neighbors)
+		if ch == current && util != nil {
+			busy := util.Busy
+			cand.Busy = &busy
+			if busy > cand.Score {
+				cand.Score = busy
+			}
+		}
+		if best < 0 || cand.Score < rec.Candidates[best].Score ||
+			(cand.Score == rec.Candidates[best].Score && ch == current) {
+			best = len(rec.Candidates)
+		}
+		rec.Candidates = append(rec.Candidates, cand)
+	}
+	if best >= 0 {
+		rec.Recommended = rec.Candidates[best].Channel
+	}
+	return rec
+}
+
+// getNodeChannelRecommend implements
+// GET /api/sites/:uuid/nodes/:nodeid/channel/recommend, recommending the
+// least congested channel in each band the node's radios support.  Channels
+// are rated using the node's most recent wifi survey and the measured
+// utilization of the channels it is using.  DFS channels aren't recommended,
+// since radar detection may force the node off of them.
+func (a *siteHandler) getNodeChannelRecommend(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	nodeID := c.Param("nodeid")
+	nodes, err := hdl.GetNodes()
+	if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+	var node *cfgapi.NodeInfo
+	for i := range nodes {
+		if nodes[i].ID == nodeID {
+			node = &nodes[i]
+			break
+		}
+	}
+	if node == nil {
+		return newHTTPError(http.StatusNotFound)
+	}
+
+	reg, err := hdl.GetRegulatoryInfo()
+	if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+	survey, err := hdl.GetWifiSurvey(nodeID)
+	if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+	utils, err := hdl.GetChannelUtilization(nodeID)
+	if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+
+	// Gather the channels supported by any of the node's radios, and the
+	// channel currently in use in each band.
+	supported := map[string]map[int]bool{
+		wifi.LoBand: make(map[int]bool),
+		wifi.HiBand: make(map[int]bool),
+	}
+	current := make(map[string]int)
+	for _, nic := range node.Nics {
+		w := nic.WifiInfo
+		if w == nil {
+			continue
+		}
+		for _, ch := range w.ValidLoChannels {
+			supported[wifi.LoBand][ch] = true
+		}
+		for _, ch := range w.ValidHiChannels {
+			supported[wifi.HiBand][ch] = true
+		}
+		if w.ActiveBand != "" && w.ActiveChannel != 0 {
+			current[w.ActiveBand] = w.ActiveChannel
+		}
+	}
+
+	recommend := func(band string) *apiBandRecommendation {
+		candidates := make([]int, 0)
+		for _, rc := range reg.Channels[band] {
+			if supported[band][rc.Channel] && !rc.DFS {
+				candidates = append(candidates, rc.Channel)
+			}
+		}
+		if len(candidates) == 0 {
+			return nil
+		}
+		var util *cfgapi.ChannelUtil
+		if u, ok := utils[band]; ok {
+			util = &u
+		}
+		return rateChannels(band, candidates, current[band],
+			survey[band], util)
+	}
+
+	resp := apiChannelRecommendation{
+		LoBand: recommend(wifi.LoBand),
+		HiBand: recommend(wifi.HiBand),
+	}
+	return c.JSON(http.StatusOK, &resp)
+}
+
 // apiUserInfo describes a user.  It is similar to cfgapi.UserInfo but with
 // fields customized for partial updates and password setting.
 type apiUserInfo struct {
@@ -1127,10 +2499,24 @@ func (a *siteHandler) getUserByUUID(c echo.Context) error {
 	}
 
 	cu := newAPIUserInfo(userInfo)
+	c.Response().Header().Set("ETag", userETag(userInfo))
 	return c.JSON(http.StatusOK, &cu)
 }
 
-// postUserByUUID implements POST /api/sites/:uuid/users/:useruuid
+// userETag returns the entity tag for a user, which changes whenever any of
+// the user's attributes, including the password, is changed.
+func userETag(ui *cfgapi.UserInfo) string {
+	return jsonETag([]interface{}{
+		ui.UID, ui.UUID, ui.Role, ui.DisplayName, ui.Email,
+		ui.TelephoneNumber, ui.Password, ui.MD4Password,
+		ui.SelfProvisioning,
+	})
+}
+
+// postUserByUUID implements POST /api/sites/:uuid/users/:useruuid.  When
+// updating an existing user, the request may carry an If-Match header with the
+// etag returned by getUserByUUID; if the user has changed since then, 409 is
+// returned.
 func (a *siteHandler) postUserByUUID(c echo.Context) error {
 	var au apiUserInfo
 	if err := c.Bind(&au); err != nil {
@@ -1162,6 +2548,10 @@ func (a *siteHandler) postUserByUUID(c echo.Context) error {
 		if err != nil {
 			return newHTTPError(http.StatusBadRequest, "invalid or unknown user")
 		}
+		if !ifMatch(c, userETag(ui)) {
+			return newHTTPError(http.StatusConflict,
+				"user modified concurrently; reload and try again")
+		}
 	}
 	// propagate daUser to UserInfo
 	if au.DisplayName != nil {
@@ -1188,7 +2578,11 @@ func (a *siteHandler) postUserByUUID(c echo.Context) error {
 		return newHTTPError(http.StatusBadRequest, "failed to save user")
 	}
 	_, err = cmdHdl.Wait(c.Request().Context())
-	if err != nil {
+	if err == cfgapi.ErrNotEqual {
+		// The user was deleted and replaced while we were working
+		return newHTTPError(http.StatusConflict,
+			"user modified concurrently; reload and try again")
+	} else if err != nil {
 		c.Logger().Errorf("failed update for user '%s': %v\n", au.UID, err)
 		return newHTTPError(http.StatusBadRequest, "failed to save user")
 	}
@@ -1200,6 +2594,7 @@ func (a *siteHandler) postUserByUUID(c echo.Context) error {
 	}
 
 	cu := newAPIUserInfo(ui)
+	c.Response().Header().Set("ETag", userETag(ui))
 	return c.JSON(http.StatusOK, &cu)
 }
 
@@ -1245,8 +2640,13 @@ func (a *siteHandler) getRings(c echo.Context) error {
 	}
 	defer hdl.Close()
 
+	rings, err := hdl.GetRings()
+	if err != nil && !cfgapi.IsConfigAbsent(err) {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+
 	var resp apiRings = make(map[string]apiRing)
-	for ringName, ring := range hdl.GetRings() {
+	for ringName, ring := range rings {
 		resp[ringName] = apiRing{
 			VirtualAPs:    ring.VirtualAPs,
 			Subnet:        ring.Subnet,
@@ -1256,10 +2656,200 @@ func (a *siteHandler) getRings(c echo.Context) error {
 	return c.JSON(http.StatusOK, resp)
 }
 
+// Bounds on the lease duration an admin may choose for a ring, in minutes
+const (
+	minRingLease = 5
+	maxRingLease = 30 * 24 * 60
+)
+
+type apiRingUpdate struct {
+	LeaseDuration *int      `json:"leaseDuration"`
+	VirtualAPs    *[]string `json:"vaps"`
+}
+
+// postRing implements POST /api/sites/:uuid/rings/:ring, changing the ring's
+// lease duration and the virtual APs it is offered on.  Fields which are
+// omitted are left unchanged.  The system rings may not be changed.
+func (a *siteHandler) postRing(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	ringName := c.Param("ring")
+	if !cfgapi.ValidRings[ringName] || cfgapi.SystemRings[ringName] {
+		return newHTTPError(http.StatusBadRequest, "bad ring")
+	}
+
+	var input apiRingUpdate
+	if err := c.Bind(&input); err != nil {
+		return newHTTPError(http.StatusBadRequest, "bad ring update")
+	}
+	if input.LeaseDuration == nil && input.VirtualAPs == nil {
+		return newHTTPError(http.StatusBadRequest, "empty ring update")
+	}
+
+	if d := input.LeaseDuration; d != nil &&
+		(*d < minRingLease || *d > maxRingLease) {
+		return newHTTPError(http.StatusBadRequest, fmt.Sprintf(
+			"leaseDuration must be between %d and %d minutes",
+			minRingLease, maxRingLease))
+	}
+
+	update := &cfgapi.RingConfigUpdate{LeaseDuration: input.LeaseDuration}
+	if input.VirtualAPs != nil {
+		vaps := hdl.GetVirtualAPs()
+		update.VirtualAPs = make([]string, 0)
+		seen := make(map[string]bool)
+		for _, vap := range *input.VirtualAPs {
+			if _, ok := vaps[vap]; !ok {
+				return newHTTPError(http.StatusBadRequest,
+					"no such vap: "+vap)
+			}
+			if seen[vap] {
+				return newHTTPError(http.StatusBadRequest,
+					"vap listed twice: "+vap)
+			}
+			seen[vap] = true
+			update.VirtualAPs = append(update.VirtualAPs, vap)
+		}
+	}
+
+	rings, err := hdl.GetRings()
+	if err != nil && !cfgapi.IsConfigAbsent(err) {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+	if _, ok := rings[ringName]; !ok {
+		return newHTTPError(http.StatusNotFound)
+	}
+
+	ops, err := cfgapi.RingConfigOps(ringName, update)
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, err)
+	}
+	// If the change is still queued, the 202 has already been sent
+	err = executePropChange(c, hdl, ops)
+	if err != nil || c.Response().Committed {
+		return err
+	}
+
+	rings, err = hdl.GetRings()
+	if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+	ring, ok := rings[ringName]
+	if !ok {
+		return newHTTPError(http.StatusNotFound)
+	}
+	return c.JSON(http.StatusOK, apiRing{
+		VirtualAPs:    ring.VirtualAPs,
+		Subnet:        ring.Subnet,
+		LeaseDuration: ring.LeaseDuration,
+	})
+}
+
+// getPendingActions implements GET /api/sites/:uuid/pending, returning the
+// actions (reboots, upgrades, etc.) the site's appliance has scheduled but not
+// yet carried out, soonest first.
+func (a *siteHandler) getPendingActions(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	actions, err := hdl.GetPendingActions()
+	if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+	return c.JSON(http.StatusOK, actions)
+}
+
+// getQuarantine implements GET /api/sites/:uuid/quarantine, returning the
+// devices which have been cut off from the network, either by being placed in
+// the quarantine ring or by the firewall.
+func (a *siteHandler) getQuarantine(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	list, err := hdl.GetQuarantinedClients()
+	if err != nil {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+type apiQuarantineRelease struct {
+	Ring string `json:"ring"`
+}
+
+// postQuarantineRelease implements POST
+// /api/sites/:uuid/quarantine/:deviceid, releasing a device from the
+// quarantine ring into the ring given in the request.  Firewall blocks expire
+// on their own, and are left alone.
+func (a *siteHandler) postQuarantineRelease(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	var input apiQuarantineRelease
+	if err := c.Bind(&input); err != nil {
+		return newHTTPError(http.StatusBadRequest, "bad release")
+	}
+	if input.Ring == "" {
+		return newHTTPError(http.StatusBadRequest, "must specify a ring")
+	}
+	if !cfgapi.ValidRings[input.Ring] || cfgapi.SystemRings[input.Ring] ||
+		input.Ring == base_def.RING_QUARANTINE {
+		return newHTTPError(http.StatusBadRequest, "bad ring")
+	}
+	rings, err := hdl.GetRings()
+	if err != nil && !cfgapi.IsConfigAbsent(err) {
+		return newHTTPError(configErrorStatus(err), err)
+	}
+	if _, ok := rings[input.Ring]; !ok {
+		return newHTTPError(http.StatusBadRequest,
+			"ring not configured at this site")
+	}
+
+	deviceID := c.Param("deviceid")
+	client := hdl.GetClient(deviceID)
+	if client == nil {
+		return newHTTPError(http.StatusNotFound)
+	}
+	if client.Ring != base_def.RING_QUARANTINE {
+		return newHTTPError(http.StatusConflict, "device not quarantined")
+	}
+
+	// The test catches a device which was released or re-ringed since
+	// we looked at it.
+	path := fmt.Sprintf("@/clients/%s/ring", deviceID)
+	ops := []cfgapi.PropertyOp{
+		{
+			Op:    cfgapi.PropTestEq,
+			Name:  path,
+			Value: base_def.RING_QUARANTINE,
+		},
+		{
+			Op:    cfgapi.PropCreate,
+			Name:  path,
+			Value: input.Ring,
+		},
+	}
+	return executePropChange(c, hdl, ops)
+}
+
 // mkSiteMiddleware manufactures a middleware which protects a route; only
 // users with one or more of the allowedRoles can pass through the checks; the
 // middleware adds "matched_roles" to the echo context, indicating which of the
-// allowed_roles the user actually has.
+// allowed_roles the user actually has.  Requests made in a support session are
+// authorized by the organization's support grant; see effectiveRoles.
 func (a *siteHandler) mkSiteMiddleware(allowedRoles []string) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
@@ -1282,27 +2872,23 @@ func (a *siteHandler) mkSiteMiddleware(allowedRoles []string) echo.MiddlewareFun
 				}
 				return newHTTPError(http.StatusInternalServerError)
 			}
-			aoRoles, err := a.db.AccountOrgRolesByAccountTarget(ctx,
-				accountUUID, site.OrganizationUUID)
+			matches, grant, err := effectiveRoles(c, a.db,
+				accountUUID, site.OrganizationUUID, allowedRoles)
 			if err != nil {
 				return newHTTPError(http.StatusInternalServerError)
 			}
-			matches := make(matchedRoles)
-			for _, aor := range aoRoles {
-				for _, r := range aor.Roles {
-					for _, rr := range allowedRoles {
-						if r == rr {
-							matches[r] = true
-						}
-					}
-				}
-			}
 			if len(matches) > 0 {
 				c.Set("matched_roles", matches)
+				c.Set("site_org_uuid", site.OrganizationUUID)
+				c.Set("site_archived", site.Archived())
+				if grant != nil {
+					return serveSupport(c, a.db, grant,
+						accountUUID, next)
+				}
 				return next(c)
 			}
-			c.Logger().Debugf("Unauthorized: %s site=%v, acc=%v, ur=%v, ar=%v",
-				c.Path(), siteUUID, accountUUID, aoRoles, allowedRoles)
+			c.Logger().Debugf("Unauthorized: %s site=%v, acc=%v, ar=%v",
+				c.Path(), siteUUID, accountUUID, allowedRoles)
 			return newHTTPError(http.StatusUnauthorized)
 		}
 	}
@@ -1311,7 +2897,7 @@ func (a *siteHandler) mkSiteMiddleware(allowedRoles []string) echo.MiddlewareFun
 // newSiteHandler creates a siteHandler instance for the given DataStore and
 // session Store, and routes the handler into the echo instance.
 func newSiteHandler(r *echo.Echo, db appliancedb.DataStore, middlewares []echo.MiddlewareFunc, getClientHandle getClientHandleFunc, twilio *gotwilio.Twilio) *siteHandler {
-	h := &siteHandler{db, getClientHandle, twilio}
+	h := &siteHandler{db, getClientHandle, twilio, newDiagTriggers()}
 	r.GET("/api/sites", h.getSites, middlewares...)
 
 	mw := middlewares
@@ -1320,30 +2906,58 @@ func newSiteHandler(r *echo.Echo, db appliancedb.DataStore, middlewares []echo.M
 
 	siteU := r.Group("/api/sites/:uuid", mw...)
 	siteU.GET("", h.getSitesUUID, user)
+	siteU.POST("", h.postSitesUUID, admin)
 	siteU.GET("/config", h.getConfig, admin)
+	siteU.GET("/config/hash", h.getConfigHash, admin)
+	siteU.GET("/config/search", h.getConfigSearch, admin)
 	siteU.POST("/config", h.postConfig, admin)
 	siteU.GET("/configtree", h.getConfigTree, admin)
 	siteU.GET("/devices", h.getDevices, admin)
 	siteU.POST("/devices/:deviceid", h.postDevice, admin)
 	siteU.GET("/devices/:deviceid/metrics", h.getDeviceMetrics, admin)
+	siteU.GET("/diag/connectivity", h.getDiagConnectivity, admin)
 	siteU.POST("/enroll_guest", h.postEnrollGuest, user)
 	siteU.GET("/features", h.getFeatures, user)
+	siteU.GET("/guests/attempts", h.getGuestEnrollAttempts, admin)
 	siteU.GET("/health", h.getHealth, user)
 	siteU.GET("/network/vap", h.getNetworkVAP, user)
 	siteU.GET("/network/dns", h.getNetworkDNS, user)
+	siteU.GET("/network/dns/entries", h.getNetworkDNSEntries, admin)
+	siteU.POST("/network/dns/entries", h.postNetworkDNSEntries, admin)
+	siteU.DELETE("/network/dns/entries/:name", h.deleteNetworkDNSEntry, admin)
 	siteU.GET("/network/vap/:vapname", h.getNetworkVAPName, user)
 	siteU.POST("/network/vap/:vapname", h.postNetworkVAPName, admin)
+	siteU.GET("/network/vap/:vapname/portal", h.getNetworkVAPPortal, admin)
+	siteU.POST("/network/vap/:vapname/portal", h.postNetworkVAPPortal, admin)
+	siteU.GET("/network/vap/:vapname/quota", h.getNetworkVAPQuota, admin)
+	siteU.POST("/network/vap/:vapname/quota", h.postNetworkVAPQuota, admin)
+	siteU.GET("/network/regulatory", h.getNetworkRegulatory, admin)
+	siteU.GET("/network/security-summary", h.getNetworkSecuritySummary, admin)
 	siteU.GET("/network/wan", h.getNetworkWan, admin)
+	siteU.GET("/network/wan/uplinks", h.getNetworkWanUplinks, admin)
 	siteU.GET("/network/wg", h.getNetworkWG, user)
 	siteU.POST("/network/wg", h.postNetworkWG, admin)
 	siteU.GET("/nodes", h.getNodes, admin)
 	siteU.POST("/nodes/:nodeid", h.postNode, admin)
 	siteU.POST("/nodes/:nodeid/ports/:portid", h.postNodePort, admin)
+	siteU.POST("/nodes/:nodeid/ports/:portid/mtu", h.postNodePortMTU, admin)
+	siteU.GET("/nodes/:nodeid/channel/recommend", h.getNodeChannelRecommend, admin)
+	siteU.GET("/pending", h.getPendingActions, admin)
+	siteU.GET("/policy/update", h.getPolicyUpdate, admin)
+	siteU.POST("/policy/update", h.postPolicyUpdate, admin)
+	siteU.GET("/policy/alerts", h.getPolicyAlerts, admin)
+	siteU.POST("/policy/alerts", h.postPolicyAlerts, admin)
+	siteU.GET("/quarantine", h.getQuarantine, admin)
+	siteU.POST("/quarantine/:deviceid", h.postQuarantineRelease, admin)
+	siteU.GET("/security/trusted-cas", h.getTrustedCAs, admin)
+	siteU.POST("/security/trusted-cas", h.postTrustedCA, admin)
+	siteU.DELETE("/security/trusted-cas/:name", h.deleteTrustedCA, admin)
 	siteU.GET("/users", h.getUsers, admin)
 	siteU.GET("/users/:useruuid", h.getUserByUUID, admin)
 	siteU.POST("/users/:useruuid", h.postUserByUUID, admin)
 	siteU.DELETE("/users/:useruuid", h.deleteUserByUUID, admin)
 	siteU.GET("/rings", h.getRings, admin)
+	siteU.POST("/rings/:ring", h.postRing, admin)
 	return h
 }
 
@@ -10,22 +10,38 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"bg/common/cfgapi"
 	"bg/common/mockcfg"
+	"bg/common/wifi"
 
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
+	"github.com/guregu/null"
 	"github.com/labstack/echo"
 	"github.com/satori/uuid"
+	"github.com/sfreiberg/gotwilio"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 
@@ -150,8 +166,10 @@ func TestSites(t *testing.T) {
 	// Mock DB
 	m0 := mockSites[0]
 	m1 := mockSites[1]
+	m1.ArchivedAt = null.TimeFrom(time.Now())
 	dMock := &mocks.DataStore{}
-	dMock.On("CustomerSitesByAccount", mock.Anything, mock.Anything).Return(mockSites, nil)
+	dMock.On("CustomerSitesByAccount", mock.Anything, mock.Anything).Return(
+		[]appliancedb.CustomerSite{m0, m1}, nil)
 	defer dMock.AssertExpectations(t)
 
 	// Setup Echo
@@ -173,11 +191,13 @@ func TestSites(t *testing.T) {
 	{
 		"UUID": "%s",
 		"name": "%s",
-		"organizationUUID": "%s"
+		"organizationUUID": "%s",
+		"archived": false
 	},{
 		"UUID": "%s",
 		"name": "%s",
-		"organizationUUID": "%s"
+		"organizationUUID": "%s",
+		"archived": true
 	}]`, m0.UUID, m0.Name, mockOrg.UUID.String(),
 		m1.UUID, m1.Name, mockOrg.UUID.String())
 	t.Logf("return body: %s", rec.Body.String())
@@ -243,6 +263,262 @@ func TestSitesUUID(t *testing.T) {
 	}
 }
 
+func TestSiteRenameConflict(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB; each lookup returns a fresh copy of the stored site, or of
+	// the previous version of it if it is being changed concurrently.
+	stored := mockSites[0]
+	stored.Version = 3
+	var previous *appliancedb.CustomerSite
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, stored.UUID).Return(
+		func(context.Context, uuid.UUID) *appliancedb.CustomerSite {
+			site := stored
+			if previous != nil {
+				site = *previous
+			}
+			return &site
+		}, nil)
+	dMock.On("UpdateCustomerSite", mock.Anything, mock.MatchedBy(
+		func(site *appliancedb.CustomerSite) bool {
+			return site.Version == stored.Version
+		})).Run(func(args mock.Arguments) {
+		site := args.Get(1).(*appliancedb.CustomerSite)
+		site.Version++
+		stored = *site
+	}).Return(nil)
+	dMock.On("UpdateCustomerSite", mock.Anything, mock.Anything).Return(
+		func(ctx context.Context, site *appliancedb.CustomerSite) error {
+			return appliancedb.ConflictError{
+				Table:    "customer_site",
+				Key:      site.UUID.String(),
+				Expected: site.Version,
+				Actual:   stored.Version,
+			}
+		})
+	defer dMock.AssertExpectations(t)
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getMockClientHandle, nil)
+
+	url := fmt.Sprintf("/api/sites/%s", stored.UUID)
+	post := func(name, ifMatch string) *httptest.ResponseRecorder {
+		body := strings.NewReader(fmt.Sprintf(`{"name": %q}`, name))
+		req, rec := setupReqRec(&mockAccount, echo.POST, url, body, ss)
+		req.Header.Add("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Add("If-Match", ifMatch)
+		}
+		e.ServeHTTP(rec, req)
+		t.Logf("return body: %s", rec.Body.String())
+		return rec
+	}
+
+	// The version is reported as the site's ETag
+	req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	etag := rec.Header().Get("ETag")
+	assert.Equal(`"3"`, etag)
+
+	rec = post("renamed", etag)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal(`"4"`, rec.Header().Get("ETag"))
+	assert.Equal("renamed", stored.Name)
+	var resp siteResponse
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal("renamed", resp.Name)
+
+	// A second edit based on the original version is rejected
+	rec = post("clobbered", etag)
+	assert.Equal(http.StatusConflict, rec.Code)
+	assert.Equal("renamed", stored.Name)
+
+	// Requests without If-Match aren't checked
+	rec = post("unchecked", "")
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("unchecked", stored.Name)
+	rec = post("star", "*")
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal(int64(6), stored.Version)
+
+	// Any of several tags may match
+	rec = post("listed", `"5", W/"6"`)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("listed", stored.Name)
+	assert.Equal(http.StatusConflict, post("unlisted", `"5", "6"`).Code)
+	assert.Equal(http.StatusConflict, post("bogus", `"three"`).Code)
+	assert.Equal(http.StatusBadRequest, post("  ", `"7"`).Code)
+
+	// A change made between the lookup and the update is still caught
+	prev := stored
+	prev.Version--
+	previous = &prev
+	assert.Equal(http.StatusConflict, post("raced", `"6"`).Code)
+	assert.Equal("listed", stored.Name)
+}
+
+func TestNodeConflict(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	defer dMock.AssertExpectations(t)
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	var interceptors []cfgapi.Interceptor
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		hdl := cfgapi.NewHandle(me)
+		hdl.Use(interceptors...)
+		return hdl, nil
+	}
+
+	node := "devnode0"
+	nameProp := "@/nodes/" + node + "/name"
+	assert.NoError(cfgapi.NewHandle(me).CreateProp(nameProp, "old", nil))
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	getETag := func() string {
+		url := fmt.Sprintf("/api/sites/%s/nodes", m0.UUID)
+		req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+		e.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		var nodes []apiNodeInfo
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &nodes))
+		assert.Len(nodes, 1)
+		return nodes[0].ETag
+	}
+	post := func(name, ifMatch string) int {
+		url := fmt.Sprintf("/api/sites/%s/nodes/%s", m0.UUID, node)
+		body := strings.NewReader(fmt.Sprintf(`{"name": %q}`, name))
+		req, rec := setupReqRec(&mockAccount, echo.POST, url, body, ss)
+		req.Header.Add("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Add("If-Match", ifMatch)
+		}
+		e.ServeHTTP(rec, req)
+		t.Logf("return body: %s", rec.Body.String())
+		return rec.Code
+	}
+
+	etag := getETag()
+	assert.Equal(http.StatusOK, post("new", etag))
+	assert.NoError(me.PropEq(nameProp, "new"))
+	assert.NotEqual(etag, getETag())
+
+	// The old etag is now stale
+	assert.Equal(http.StatusConflict, post("stale", etag))
+	assert.NoError(me.PropEq(nameProp, "new"))
+
+	// Requests without If-Match aren't checked
+	assert.Equal(http.StatusOK, post("newer", ""))
+	assert.NoError(me.PropEq(nameProp, "newer"))
+
+	// A rename which sneaks in between the check and the update is
+	// caught by the update itself.
+	etag = getETag()
+	interceptors = []cfgapi.Interceptor{
+		func(ctx context.Context, ops []cfgapi.PropertyOp,
+			next cfgapi.ExecFunc) cfgapi.CmdHdl {
+
+			for _, op := range ops {
+				if op.Op == cfgapi.PropCreate && op.Name == nameProp {
+					err := cfgapi.NewHandle(me).SetProp(nameProp,
+						"sneaky", nil)
+					assert.NoError(err)
+				}
+			}
+			return next(ctx, ops)
+		},
+	}
+	assert.Equal(http.StatusConflict, post("mine", etag))
+	assert.NoError(me.PropEq(nameProp, "sneaky"))
+}
+
+func TestUserConflict(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	defer dMock.AssertExpectations(t)
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(me), nil
+	}
+
+	userUUID := uuid.Must(uuid.FromString("40000000-0000-0000-0000-000000000000"))
+	err := cfgapi.NewHandle(me).CreateProps(map[string]string{
+		"@/users/alice/uid":              "alice",
+		"@/users/alice/uuid":             userUUID.String(),
+		"@/users/alice/email":            "alice@example.com",
+		"@/users/alice/telephone_number": "+1 650-555-1212",
+	}, nil)
+	assert.NoError(err)
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	url := fmt.Sprintf("/api/sites/%s/users/%s", m0.UUID, userUUID)
+	post := func(displayName, ifMatch string) *httptest.ResponseRecorder {
+		body := strings.NewReader(fmt.Sprintf(
+			`{"UID": "alice", "DisplayName": %q}`, displayName))
+		req, rec := setupReqRec(&mockAccount, echo.POST, url, body, ss)
+		req.Header.Add("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Add("If-Match", ifMatch)
+		}
+		e.ServeHTTP(rec, req)
+		t.Logf("return body: %s", rec.Body.String())
+		return rec
+	}
+
+	req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	etag := rec.Header().Get("ETag")
+	assert.NotEmpty(etag)
+
+	rec = post("Alice", etag)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.NoError(me.PropEq("@/users/alice/display_name", "Alice"))
+	newETag := rec.Header().Get("ETag")
+	assert.NotEqual(etag, newETag)
+
+	// An edit based on the original fetch is rejected
+	rec = post("Mallory", etag)
+	assert.Equal(http.StatusConflict, rec.Code)
+	assert.NoError(me.PropEq("@/users/alice/display_name", "Alice"))
+
+	rec = post("Alice Smith", newETag)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.NoError(me.PropEq("@/users/alice/display_name", "Alice Smith"))
+}
+
 func TestSiteUnauthorized(t *testing.T) {
 	assert := require.New(t)
 	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
@@ -269,3 +545,1999 @@ func TestSiteUnauthorized(t *testing.T) {
 	}
 }
 
+func TestNetworkVAP(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	defer dMock.AssertExpectations(t)
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(me), nil
+	}
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	url := fmt.Sprintf("/api/sites/%s/network/vap", m0.UUID)
+
+	// No clients at all
+	req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	t.Logf("return body: %s", rec.Body.String())
+	assert.JSONEq(`[
+		{"name": "eap", "clients": 0},
+		{"name": "guest", "clients": 0},
+		{"name": "psk", "clients": 0}
+	]`, rec.Body.String())
+
+	// Only active wireless clients are counted
+	err := cfgapi.NewHandle(me).CreateProps(map[string]string{
+		"@/clients/00:00:00:00:00:01/connection/vap":      "psk",
+		"@/clients/00:00:00:00:00:01/connection/wireless": "true",
+		"@/clients/00:00:00:00:00:01/connection/active":   "true",
+		"@/clients/00:00:00:00:00:02/connection/vap":      "psk",
+		"@/clients/00:00:00:00:00:02/connection/wireless": "true",
+		"@/clients/00:00:00:00:00:02/connection/active":   "true",
+		"@/clients/00:00:00:00:00:03/connection/vap":      "eap",
+		"@/clients/00:00:00:00:00:03/connection/wireless": "true",
+		"@/clients/00:00:00:00:00:03/connection/active":   "true",
+		"@/clients/00:00:00:00:00:04/connection/vap":      "psk",
+		"@/clients/00:00:00:00:00:04/connection/wireless": "true",
+		"@/clients/00:00:00:00:00:04/connection/active":   "false",
+		"@/clients/00:00:00:00:00:05/connection/wireless": "false",
+		"@/clients/00:00:00:00:00:05/connection/active":   "true",
+	}, nil)
+	assert.NoError(err)
+
+	req, rec = setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	t.Logf("return body: %s", rec.Body.String())
+	assert.JSONEq(`[
+		{"name": "eap", "clients": 1},
+		{"name": "guest", "clients": 0},
+		{"name": "psk", "clients": 2}
+	]`, rec.Body.String())
+}
+
+func TestNetworkVAPPortal(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	defer dMock.AssertExpectations(t)
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(me), nil
+	}
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	url := fmt.Sprintf("/api/sites/%s/network/vap/guest/portal", m0.UUID)
+	propStem := "@/network/vap/guest/portal"
+
+	// Read: no portal has been configured
+	req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	t.Logf("return body: %s", rec.Body.String())
+	assert.JSONEq(`{"enabled": false, "splashURL": ""}`, rec.Body.String())
+
+	// Update: enable the portal with a splash page
+	body := strings.NewReader(`{"enabled": true, "splashURL": "https://example.com/welcome"}`)
+	req, rec = setupReqRec(&mockAccount, echo.POST, url, body, ss)
+	req.Header.Add("Content-Type", "application/json")
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.NoError(me.PropEq(propStem+"/enabled", "true"))
+	assert.NoError(me.PropEq(propStem+"/splash_url", "https://example.com/welcome"))
+
+	req, rec = setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.JSONEq(`{"enabled": true, "splashURL": "https://example.com/welcome"}`,
+		rec.Body.String())
+
+	// Invalid splash URLs are rejected, and leave the config untouched
+	badURLs := []string{
+		"example.com/welcome",
+		"ftp://example.com/welcome",
+		"https:///welcome",
+		"javascript:alert(1)",
+	}
+	for _, bad := range badURLs {
+		t.Logf("testing splash URL %q", bad)
+		body = strings.NewReader(fmt.Sprintf(`{"splashURL": %q}`, bad))
+		req, rec = setupReqRec(&mockAccount, echo.POST, url, body, ss)
+		req.Header.Add("Content-Type", "application/json")
+		e.ServeHTTP(rec, req)
+		assert.Equal(http.StatusBadRequest, rec.Code)
+	}
+	assert.NoError(me.PropEq(propStem+"/splash_url", "https://example.com/welcome"))
+
+	// The portal can't be left enabled without a splash page
+	body = strings.NewReader(`{"splashURL": ""}`)
+	req, rec = setupReqRec(&mockAccount, echo.POST, url, body, ss)
+	req.Header.Add("Content-Type", "application/json")
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusBadRequest, rec.Code)
+
+	// Unknown VAPs are reported as such
+	url = fmt.Sprintf("/api/sites/%s/network/vap/nosuchvap/portal", m0.UUID)
+	req, rec = setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusNotFound, rec.Code)
+}
+
+func TestNetworkVAPQuota(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	defer dMock.AssertExpectations(t)
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(me), nil
+	}
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	url := fmt.Sprintf("/api/sites/%s/network/vap/guest/quota", m0.UUID)
+	propStem := "@/network/vap/guest/quota"
+
+	// Read: no quota has been configured
+	req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	t.Logf("return body: %s", rec.Body.String())
+	assert.JSONEq(`{"dailyBytes": 0, "maxClients": 0}`, rec.Body.String())
+
+	// Update: set both limits
+	body := strings.NewReader(`{"dailyBytes": 1073741824, "maxClients": 20}`)
+	req, rec = setupReqRec(&mockAccount, echo.POST, url, body, ss)
+	req.Header.Add("Content-Type", "application/json")
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.NoError(me.PropEq(propStem+"/daily_bytes", "1073741824"))
+	assert.NoError(me.PropEq(propStem+"/max_clients", "20"))
+
+	// Update: change one limit, leaving the other alone
+	body = strings.NewReader(`{"maxClients": 0}`)
+	req, rec = setupReqRec(&mockAccount, echo.POST, url, body, ss)
+	req.Header.Add("Content-Type", "application/json")
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+
+	req, rec = setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.JSONEq(`{"dailyBytes": 1073741824, "maxClients": 0}`,
+		rec.Body.String())
+
+	// Invalid limits are rejected, and leave the config untouched
+	badBodies := []string{
+		`{}`,
+		`{"dailyBytes": -1}`,
+		`{"dailyBytes": "lots"}`,
+		`{"dailyBytes": 1.5}`,
+		`{"maxClients": -1}`,
+		`{"maxClients": 2008}`,
+		`{"maxClients": 10, "dailyBytes": -5}`,
+	}
+	for _, bad := range badBodies {
+		t.Logf("testing quota %s", bad)
+		body = strings.NewReader(bad)
+		req, rec = setupReqRec(&mockAccount, echo.POST, url, body, ss)
+		req.Header.Add("Content-Type", "application/json")
+		e.ServeHTTP(rec, req)
+		assert.Equal(http.StatusBadRequest, rec.Code)
+	}
+	assert.NoError(me.PropEq(propStem+"/daily_bytes", "1073741824"))
+	assert.NoError(me.PropEq(propStem+"/max_clients", "0"))
+
+	// Unknown VAPs are reported as such
+	url = fmt.Sprintf("/api/sites/%s/network/vap/nosuchvap/quota", m0.UUID)
+	req, rec = setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusNotFound, rec.Code)
+
+	body = strings.NewReader(`{"maxClients": 5}`)
+	req, rec = setupReqRec(&mockAccount, echo.POST, url, body, ss)
+	req.Header.Add("Content-Type", "application/json")
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusNotFound, rec.Code)
+}
+
+func TestPolicyUpdate(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	defer dMock.AssertExpectations(t)
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(me), nil
+	}
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	url := fmt.Sprintf("/api/sites/%s/policy/update", m0.UUID)
+	propStem := cfgapi.UpdatePolicyPath
+
+	// Read: no policy has been configured
+	req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	t.Logf("return body: %s", rec.Body.String())
+	assert.JSONEq(`{"auto": false, "channel": "stable", "windowStart": "",
+		"windowEnd": ""}`, rec.Body.String())
+
+	// Update: turn on auto-update in an overnight window
+	body := strings.NewReader(`{"auto": true, "windowStart": "23:30",
+		"windowEnd": "03:00"}`)
+	req, rec = setupReqRec(&mockAccount, echo.POST, url, body, ss)
+	req.Header.Add("Content-Type", "application/json")
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.NoError(me.PropEq(propStem+"/auto", "true"))
+	assert.NoError(me.PropEq(propStem+"/channel", "stable"))
+	assert.NoError(me.PropEq(propStem+"/window/start", "23:30"))
+	assert.NoError(me.PropEq(propStem+"/window/end", "03:00"))
+
+	// Update: change the channel, leaving the rest alone
+	body = strings.NewReader(`{"channel": "beta"}`)
+	req, rec = setupReqRec(&mockAccount, echo.POST, url, body, ss)
+	req.Header.Add("Content-Type", "application/json")
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+
+	req, rec = setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.JSONEq(`{"auto": true, "channel": "beta", "windowStart": "23:30",
+		"windowEnd": "03:00"}`, rec.Body.String())
+
+	// Invalid policies are rejected, and leave the config untouched
+	badBodies := []string{
+		`{}`,
+		`{"auto": "yes"}`,
+		`{"channel": "nightly"}`,
+		`{"channel": ""}`,
+		`{"windowStart": ""}`,
+		`{"windowEnd": "3am"}`,
+		`{"windowStart": "24:00"}`,
+		`{"windowStart": "03:00"}`,
+		`{"channel": "stable", "windowEnd": "noon"}`,
+	}
+	for _, bad := range badBodies {
+		t.Logf("testing policy %s", bad)
+		body = strings.NewReader(bad)
+		req, rec = setupReqRec(&mockAccount, echo.POST, url, body, ss)
+		req.Header.Add("Content-Type", "application/json")
+		e.ServeHTTP(rec, req)
+		assert.Equal(http.StatusBadRequest, rec.Code)
+	}
+	assert.NoError(me.PropEq(propStem+"/channel", "beta"))
+	assert.NoError(me.PropEq(propStem+"/window/start", "23:30"))
+	assert.NoError(me.PropEq(propStem+"/window/end", "03:00"))
+
+	// Removing the window
+	body = strings.NewReader(`{"windowStart": "", "windowEnd": ""}`)
+	req, rec = setupReqRec(&mockAccount, echo.POST, url, body, ss)
+	req.Header.Add("Content-Type", "application/json")
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.NoError(me.PropEq(propStem+"/window/start", ""))
+	assert.NoError(me.PropEq(propStem+"/window/end", ""))
+}
+
+func TestPolicyAlerts(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	defer dMock.AssertExpectations(t)
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(me), nil
+	}
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	url := fmt.Sprintf("/api/sites/%s/policy/alerts", m0.UUID)
+	propStem := cfgapi.AlertPolicyPath + "/events/"
+
+	get := func() *cfgapi.AlertConfig {
+		req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+		e.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		t.Logf("return body: %s", rec.Body.String())
+		var config cfgapi.AlertConfig
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &config))
+		return &config
+	}
+	post := func(body string) int {
+		req, rec := setupReqRec(&mockAccount, echo.POST, url,
+			strings.NewReader(body), ss)
+		req.Header.Add("Content-Type", "application/json")
+		e.ServeHTTP(rec, req)
+		t.Logf("return body: %s", rec.Body.String())
+		return rec.Code
+	}
+
+	// Read: no policy has been configured, so nothing notifies
+	config := get()
+	assert.Len(config.Events, len(cfgapi.AlertEventTypes))
+	for event, rule := range config.Events {
+		assert.False(rule.Notify, event)
+	}
+	assert.Empty(config.Channels)
+
+	// Update: turn on a couple of alerts, and choose channels
+	code := post(`{"events": {"rogue_ap": {"notify": true},
+		"bad_password": {"notify": true, "threshold": 5}},
+		"channels": ["email", "push"]}`)
+	assert.Equal(http.StatusOK, code)
+	assert.NoError(me.PropEq(propStem+"rogue_ap/notify", "true"))
+	assert.NoError(me.PropEq(propStem+"bad_password/threshold", "5"))
+	assert.NoError(me.PropEq(cfgapi.AlertPolicyPath+"/channels",
+		"email,push"))
+
+	// Update: change a threshold, leaving the rest alone
+	code = post(`{"events": {"bad_password": {"threshold": 10}}}`)
+	assert.Equal(http.StatusOK, code)
+	config = get()
+	assert.Equal(cfgapi.AlertRule{Notify: true, Threshold: 10},
+		config.Events[cfgapi.AlertBadPassword])
+	assert.Equal(cfgapi.AlertRule{Notify: true},
+		config.Events[cfgapi.AlertRogueAP])
+	assert.Equal(cfgapi.AlertRule{}, config.Events[cfgapi.AlertNewDevice])
+	assert.Equal([]string{"email", "push"}, config.Channels)
+
+	// Invalid policies are rejected, and leave the config untouched
+	badBodies := []string{
+		`{}`,
+		`{"events": {}}`,
+		`{"events": {"reactor_meltdown": {"notify": true}}}`,
+		`{"events": {"rogue_ap": {"threshold": -1}}}`,
+		`{"events": {"rogue_ap": {"threshold": 1001}}}`,
+		`{"events": {"rogue_ap": {"notify": "yes"}}}`,
+		`{"channels": ["fax"]}`,
+		`{"channels": ["sms", "sms"]}`,
+	}
+	for _, bad := range badBodies {
+		t.Logf("testing policy %s", bad)
+		assert.Equal(http.StatusBadRequest, post(bad))
+	}
+	assert.NoError(me.PropEq(propStem+"rogue_ap/threshold", "0"))
+	assert.NoError(me.PropEq(propStem+"bad_password/threshold", "10"))
+	assert.NoError(me.PropEq(cfgapi.AlertPolicyPath+"/channels",
+		"email,push"))
+
+	// Removing all of the channels
+	assert.Equal(http.StatusOK, post(`{"channels": []}`))
+	assert.Empty(get().Channels)
+}
+
+func TestNetworkSecuritySummary(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	defer dMock.AssertExpectations(t)
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(me), nil
+	}
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	url := fmt.Sprintf("/api/sites/%s/network/security-summary", m0.UUID)
+
+	// Add an open network alongside the defaults
+	hdl := cfgapi.NewHandle(me)
+	err := hdl.CreateProps(map[string]string{
+		"@/network/vap/lobby/ssid":         "lobby",
+		"@/network/vap/lobby/default_ring": "guest",
+	}, nil)
+	assert.NoError(err)
+
+	req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	t.Logf("return body: %s", rec.Body.String())
+	assert.NotContains(rec.Body.String(), "sosecretive")
+	assert.NotContains(rec.Body.String(), "passphrase")
+
+	var summary []cfgapi.NetworkSecurity
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &summary))
+	assert.Len(summary, 4)
+	for _, ns := range summary {
+		switch ns.VAP {
+		case "lobby":
+			assert.Equal(cfgapi.SecurityOpen, ns.Security)
+			assert.True(ns.Open)
+		case "eap":
+			assert.Equal(cfgapi.SecurityEAP, ns.Security)
+			assert.False(ns.Open)
+		default:
+			assert.Equal(cfgapi.SecurityPSK, ns.Security)
+			assert.True(ns.Configured)
+			assert.False(ns.Open)
+		}
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	defer dMock.AssertExpectations(t)
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(me), nil
+	}
+	err := cfgapi.NewHandle(me).CreateProps(map[string]string{
+		"@/clients/00:11:22:33:44:55/ring": "quarantine",
+		"@/clients/66:77:88:99:aa:bb/ring": "quarantine",
+		"@/clients/cc:dd:ee:ff:00:11/ring": "standard",
+	}, nil)
+	assert.NoError(err)
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	url := fmt.Sprintf("/api/sites/%s/quarantine", m0.UUID)
+	release := func(mac, body string) int {
+		req, rec := setupReqRec(&mockAccount, echo.POST, url+"/"+mac,
+			strings.NewReader(body), ss)
+		req.Header.Add("Content-Type", "application/json")
+		e.ServeHTTP(rec, req)
+		t.Logf("return body: %s", rec.Body.String())
+		return rec.Code
+	}
+	list := func() []string {
+		var quarantined []cfgapi.QuarantineInfo
+		req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+		e.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &quarantined))
+
+		macs := make([]string, 0)
+		for _, q := range quarantined {
+			assert.Equal("quarantined", q.Reason)
+			macs = append(macs, q.MAC)
+		}
+		return macs
+	}
+
+	assert.Equal([]string{"00:11:22:33:44:55", "66:77:88:99:aa:bb"}, list())
+
+	// Release one device into the standard ring
+	assert.Equal(http.StatusOK,
+		release("00:11:22:33:44:55", `{"ring": "standard"}`))
+	assert.NoError(me.PropEq("@/clients/00:11:22:33:44:55/ring", "standard"))
+	assert.Equal([]string{"66:77:88:99:aa:bb"}, list())
+
+	// Bad target rings are rejected, and leave the device quarantined
+	for _, body := range []string{
+		`{}`,
+		`{"ring": ""}`,
+		`{"ring": 5}`,
+		`{"ring": "nosuchring"}`,
+		`{"ring": "quarantine"}`,
+		`{"ring": "internal"}`,
+		`{"ring": "wan"}`,
+	} {
+		t.Logf("testing release %s", body)
+		assert.Equal(http.StatusBadRequest,
+			release("66:77:88:99:aa:bb", body))
+	}
+	assert.NoError(me.PropEq("@/clients/66:77:88:99:aa:bb/ring", "quarantine"))
+
+	// Devices which aren't quarantined can't be released
+	assert.Equal(http.StatusConflict,
+		release("00:11:22:33:44:55", `{"ring": "devices"}`))
+	assert.Equal(http.StatusConflict,
+		release("cc:dd:ee:ff:00:11", `{"ring": "devices"}`))
+	assert.NoError(me.PropEq("@/clients/cc:dd:ee:ff:00:11/ring", "standard"))
+	assert.Equal(http.StatusNotFound,
+		release("00:00:00:00:00:99", `{"ring": "devices"}`))
+}
+
+func TestPostRing(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	defer dMock.AssertExpectations(t)
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(me), nil
+	}
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	url := fmt.Sprintf("/api/sites/%s/rings/", m0.UUID)
+	post := func(ring, body string) (int, []byte) {
+		req, rec := setupReqRec(&mockAccount, echo.POST, url+ring,
+			strings.NewReader(body), ss)
+		req.Header.Add("Content-Type", "application/json")
+		e.ServeHTTP(rec, req)
+		t.Logf("return body: %s", rec.Body.String())
+		return rec.Code, rec.Body.Bytes()
+	}
+
+	// Change both, and get back the new view of the ring
+	var ring apiRing
+	code, body := post("standard",
+		`{"leaseDuration": 120, "vaps": ["eap", "psk"]}`)
+	assert.Equal(http.StatusOK, code)
+	assert.NoError(json.Unmarshal(body, &ring))
+	assert.Equal(120, ring.LeaseDuration)
+	assert.Equal([]string{"eap", "psk"}, ring.VirtualAPs)
+	assert.NotEmpty(ring.Subnet)
+	assert.NoError(me.PropEq("@/rings/standard/lease_duration", "120"))
+	assert.NoError(me.PropEq("@/rings/standard/vap", "eap,psk"))
+
+	// Omitted fields are left alone; VAPs not listed are removed
+	code, _ = post("standard", `{"vaps": ["psk"]}`)
+	assert.Equal(http.StatusOK, code)
+	assert.NoError(me.PropEq("@/rings/standard/lease_duration", "120"))
+	assert.NoError(me.PropEq("@/rings/standard/vap", "psk"))
+	code, _ = post("standard", `{"vaps": []}`)
+	assert.Equal(http.StatusOK, code)
+	assert.NoError(me.PropEq("@/rings/standard/vap", ""))
+	code, _ = post("standard", `{"leaseDuration": 5}`)
+	assert.Equal(http.StatusOK, code)
+	assert.NoError(me.PropEq("@/rings/standard/lease_duration", "5"))
+
+	// Bad updates are rejected, and change nothing
+	for _, body := range []string{
+		`{}`,
+		`{"leaseDuration": "long"}`,
+		`{"leaseDuration": 4}`,
+		`{"leaseDuration": 43201}`,
+		`{"vaps": ["nosuchvap"]}`,
+		`{"vaps": ["psk", "psk"]}`,
+		`{"leaseDuration": 60, "vaps": ["psk", "nosuchvap"]}`,
+	} {
+		t.Logf("testing update %s", body)
+		code, _ = post("core", body)
+		assert.Equal(http.StatusBadRequest, code)
+	}
+	assert.NoError(me.PropEq("@/rings/core/lease_duration", "1440"))
+	assert.NoError(me.PropEq("@/rings/core/vap", "eap"))
+
+	// Bad rings, and rings which may not be changed
+	for _, ringName := range []string{"nosuchring", "internal", "vpn"} {
+		code, _ = post(ringName, `{"leaseDuration": 60}`)
+		assert.Equal(http.StatusBadRequest, code)
+	}
+	assert.NoError(me.PropEq("@/rings/internal/lease_duration", "1440"))
+
+	// Valid, but not configured at this site
+	code, _ = post("wan", `{"leaseDuration": 60}`)
+	assert.Equal(http.StatusNotFound, code)
+}
+
+// errExec returns a cfgapi.ConfigExec which fails every operation with err
+func errExec(err error) cfgapi.ConfigExec {
+	me := mockcfg.NewMockExec()
+	me.SetErr(err)
+	return me
+}
+
+func TestNetworkConfigErrors(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	defer dMock.AssertExpectations(t)
+
+	var exec cfgapi.ConfigExec
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(exec), nil
+	}
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		url := fmt.Sprintf("/api/sites/%s/%s", m0.UUID, path)
+		req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// A site without the configuration is reported as such, with an empty
+	// but valid body.
+	absent := map[string]string{
+		"network/dns":         `{"domain": "", "servers": []}`,
+		"network/wan":         `{}`,
+		"network/wan/uplinks": `[]`,
+		"rings":               `{}`,
+		"devices":             `[]`,
+	}
+	for _, err := range []error{cfgapi.ErrNoConfig, cfgapi.ErrNoProp} {
+		exec = errExec(err)
+		for path, body := range absent {
+			t.Logf("GET %s with %v", path, err)
+			rec := get(path)
+			assert.Equal(http.StatusOK, rec.Code)
+			assert.JSONEq(body, rec.Body.String())
+		}
+	}
+
+	// Failing to reach the site's config is an upstream failure, not an
+	// empty configuration.
+	failures := map[error]int{
+		cfgapi.ErrComm:    http.StatusBadGateway,
+		cfgapi.ErrTimeout: http.StatusGatewayTimeout,
+	}
+	for err, code := range failures {
+		exec = errExec(err)
+		for path := range absent {
+			t.Logf("GET %s with %v", path, err)
+			rec := get(path)
+			assert.Equal(code, rec.Code)
+		}
+	}
+}
+
+func TestNetworkRegulatory(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	defer dMock.AssertExpectations(t)
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(me), nil
+	}
+	err := cfgapi.NewHandle(me).SetProp("@/network/regdomain", "GB", nil)
+	assert.NoError(err)
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	url := fmt.Sprintf("/api/sites/%s/network/regulatory", m0.UUID)
+	req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	t.Logf("return body: %s", rec.Body.String())
+
+	var resp apiRegulatory
+	err = json.Unmarshal(rec.Body.Bytes(), &resp)
+	assert.NoError(err)
+	assert.Equal("GB", resp.CountryCode)
+
+	lo := make([]int, 0)
+	for _, ch := range resp.LoBand {
+		lo = append(lo, ch.Channel)
+		assert.Equal(20, ch.MaxPower)
+	}
+	assert.Equal([]int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13}, lo)
+
+	hi := make(map[int]cfgapi.RegChannel)
+	for _, ch := range resp.HiBand {
+		hi[ch.Channel] = ch
+	}
+	assert.Contains(hi, 36)
+	assert.False(hi[36].DFS)
+	assert.True(hi[100].DFS)
+	assert.NotContains(hi, 149)
+	assert.NotContains(hi, 165)
+}
+
+func TestNetworkWanUplinks(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	defer dMock.AssertExpectations(t)
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(me), nil
+	}
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	url := fmt.Sprintf("/api/sites/%s/network/wan/uplinks", m0.UUID)
+
+	// A single-uplink appliance has none configured
+	req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.JSONEq(`[]`, rec.Body.String())
+
+	// A wired uplink which has failed over to LTE
+	err := cfgapi.NewHandle(me).CreateProps(map[string]string{
+		"@/network/wan/uplinks/lte0/type":     "lte",
+		"@/network/wan/uplinks/lte0/priority": "10",
+		"@/network/wan/uplinks/lte0/state":    cfgapi.UplinkActive,
+		"@/network/wan/uplinks/eth0/type":     "wired",
+		"@/network/wan/uplinks/eth0/priority": "1",
+		"@/network/wan/uplinks/eth0/state":    cfgapi.UplinkDown,
+	}, nil)
+	assert.NoError(err)
+
+	req, rec = setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	t.Logf("return body: %s", rec.Body.String())
+	assert.JSONEq(`[
+		{"name": "eth0", "type": "wired", "priority": 1, "state": "down"},
+		{"name": "lte0", "type": "lte", "priority": 10, "state": "active"}
+	]`, rec.Body.String())
+}
+
+func TestNetworkDNSEntries(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	defer dMock.AssertExpectations(t)
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(me), nil
+	}
+	err := cfgapi.NewHandle(me).CreateProps(map[string]string{
+		"@/clients/00:11:22:33:44:55/ring":         "standard",
+		"@/clients/00:11:22:33:44:55/dns_name":     "printer",
+		"@/clients/66:77:88:99:aa:bb/ring":         "devices",
+		"@/clients/66:77:88:99:aa:bb/friendly_dns": "living-room-tv",
+	}, nil)
+	assert.NoError(err)
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	url := fmt.Sprintf("/api/sites/%s/network/dns/entries", m0.UUID)
+	post := func(body string) int {
+		req, rec := setupReqRec(&mockAccount, echo.POST, url,
+			strings.NewReader(body), ss)
+		req.Header.Add("Content-Type", "application/json")
+		e.ServeHTTP(rec, req)
+		t.Logf("return body: %s", rec.Body.String())
+		return rec.Code
+	}
+	del := func(name string) int {
+		req, rec := setupReqRec(&mockAccount, echo.DELETE,
+			url+"/"+name, nil, ss)
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	get := func() []cfgapi.CustomDNSEntry {
+		var entries []cfgapi.CustomDNSEntry
+		req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+		e.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &entries))
+		return entries
+	}
+
+	assert.Empty(get())
+
+	// The standard ring is 192.168.5.0/24 in the default tree
+	assert.Equal(http.StatusOK,
+		post(`{"name": "NAS", "address": "192.168.5.50"}`))
+	assert.NoError(me.PropEq("@/dns/custom/nas", "192.168.5.50"))
+
+	// Addresses outside the site's rings must be marked as external
+	assert.Equal(http.StatusBadRequest,
+		post(`{"name": "backup", "address": "10.0.0.5"}`))
+	assert.Equal(http.StatusOK,
+		post(`{"name": "backup", "address": "10.0.0.5", "external": true}`))
+
+	// Bad names and addresses
+	for _, body := range []string{
+		`{"name": "", "address": "192.168.5.51"}`,
+		`{"name": "bad name", "address": "192.168.5.51"}`,
+		`{"name": "bad.name", "address": "192.168.5.51"}`,
+		`{"name": "-bad", "address": "192.168.5.51"}`,
+		`{"name": "camera", "address": ""}`,
+		`{"name": "camera", "address": "192.168.5.300"}`,
+		`{"name": "camera", "address": "fe80::1", "external": true}`,
+		`{"name": "camera", "address": 17}`,
+	} {
+		assert.Equal(http.StatusBadRequest, post(body), body)
+	}
+
+	// Names already used by clients are rejected, regardless of case
+	assert.Equal(http.StatusBadRequest,
+		post(`{"name": "printer", "address": "192.168.5.51"}`))
+	assert.Equal(http.StatusBadRequest,
+		post(`{"name": "Living-Room-TV", "address": "192.168.6.51"}`))
+	assert.NoError(me.PropAbsent("@/dns/custom/living-room-tv"))
+
+	assert.Equal([]cfgapi.CustomDNSEntry{
+		{Name: "backup", Address: "10.0.0.5"},
+		{Name: "nas", Address: "192.168.5.50"},
+	}, get())
+
+	assert.Equal(http.StatusOK, del("BACKUP"))
+	assert.Equal(http.StatusNotFound, del("backup"))
+	assert.Equal(http.StatusNotFound, del("printer"))
+	assert.Equal([]cfgapi.CustomDNSEntry{
+		{Name: "nas", Address: "192.168.5.50"},
+	}, get())
+}
+
+func mkTestCAPEM(t *testing.T, cn string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl,
+		&key.PublicKey, key)
+	require.NoError(t, err)
+
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: der,
+	}))
+}
+
+func TestTrustedCAs(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	defer dMock.AssertExpectations(t)
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(me), nil
+	}
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	url := fmt.Sprintf("/api/sites/%s/security/trusted-cas", m0.UUID)
+	post := func(name, pemData string) int {
+		body, err := json.Marshal(&apiTrustedCAAdd{Name: name, PEM: pemData})
+		assert.NoError(err)
+		req, rec := setupReqRec(&mockAccount, echo.POST, url,
+			strings.NewReader(string(body)), ss)
+		req.Header.Add("Content-Type", "application/json")
+		e.ServeHTTP(rec, req)
+		t.Logf("return body: %s", rec.Body.String())
+		return rec.Code
+	}
+	del := func(name string) int {
+		req, rec := setupReqRec(&mockAccount, echo.DELETE,
+			url+"/"+name, nil, ss)
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	get := func() (string, []apiTrustedCA) {
+		var cas []apiTrustedCA
+		req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+		e.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &cas))
+		return rec.Body.String(), cas
+	}
+
+	_, cas := get()
+	assert.Empty(cas)
+
+	proxyPEM := mkTestCAPEM(t, "Example Proxy CA")
+	assert.Equal(http.StatusOK, post("proxy", proxyPEM))
+	assert.NoError(me.PropEq("@/security/trusted_cas/proxy/pem", proxyPEM))
+	assert.Equal(http.StatusOK,
+		post("logs", mkTestCAPEM(t, "Example Logging CA")))
+
+	// The certificates themselves aren't returned
+	body, cas := get()
+	assert.NotContains(body, "BEGIN CERTIFICATE")
+	assert.NotContains(body, "pem")
+	assert.Len(cas, 2)
+	assert.Equal("logs", cas[0].Name)
+	assert.Equal("CN=Example Logging CA", cas[0].Subject)
+	assert.Equal("proxy", cas[1].Name)
+	assert.Equal("CN=Example Proxy CA", cas[1].Subject)
+	assert.Len(cas[1].Fingerprint, 64)
+
+	// Invalid certificates and names
+	for _, bad := range []struct {
+		name    string
+		pemData string
+	}{
+		{"garbage", "not a certificate"},
+		{"empty", ""},
+		{"corrupt", "-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"},
+		{"two", proxyPEM + proxyPEM},
+		{"", proxyPEM},
+		{"bad name", proxyPEM},
+	} {
+		assert.Equal(http.StatusBadRequest, post(bad.name, bad.pemData),
+			bad.name)
+	}
+	req, rec := setupReqRec(&mockAccount, echo.POST, url,
+		strings.NewReader(`{"name": 17}`), ss)
+	req.Header.Add("Content-Type", "application/json")
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusBadRequest, rec.Code)
+	_, cas = get()
+	assert.Len(cas, 2)
+
+	assert.Equal(http.StatusOK, del("logs"))
+	assert.Equal(http.StatusNotFound, del("logs"))
+	assert.NoError(me.PropAbsent("@/security/trusted_cas/logs"))
+	_, cas = get()
+	assert.Len(cas, 1)
+	assert.Equal("proxy", cas[0].Name)
+}
+
+func TestNodeChannelRecommend(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	defer dMock.AssertExpectations(t)
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(me), nil
+	}
+
+	// A node with one radio in each band, and a wired-only node.  The
+	// 5GHz radio supports a DFS channel, which shouldn't be recommended.
+	node := "001-201901BB-000001"
+	wiredNode := "001-201901BB-000002"
+	nics := "@/nodes/" + node + "/nics/"
+	wiredNics := "@/nodes/" + wiredNode + "/nics/"
+	survey := "@/metrics/wifi/" + node
+	lo := survey + "/" + wifi.LoBand
+	hi := survey + "/" + wifi.HiBand
+	err := cfgapi.NewHandle(me).CreateProps(map[string]string{
+		"@/network/regdomain":         "US",
+		nics + "wlan0/kind":           "wireless",
+		nics + "wlan0/channels":       "1,2,3,4,5,6,7,8,9,10,11",
+		nics + "wlan0/active_band":    wifi.LoBand,
+		nics + "wlan0/active_channel": "6",
+		nics + "wlan1/kind":           "wireless",
+		nics + "wlan1/channels":       "36,40,44,48,52,149,153",
+		nics + "wlan1/active_band":    wifi.HiBand,
+		nics + "wlan1/active_channel": "153",
+		nics + "wan/kind":             "wired",
+		wiredNics + "lan0/kind":       "wired",
+
+		lo + "/busy":                "45",
+		lo + "/survey/1/neighbors":  "3",
+		lo + "/survey/6/neighbors":  "1",
+		hi + "/busy":                "0",
+		hi + "/survey/36/neighbors": "2",
+		hi + "/survey/40/neighbors": "1",
+	}, nil)
+	assert.NoError(err)
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	get := func(nodeID string) (int, *apiChannelRecommendation) {
+		url := fmt.Sprintf("/api/sites/%s/nodes/%s/channel/recommend",
+			m0.UUID, nodeID)
+		req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+		e.ServeHTTP(rec, req)
+		t.Logf("return body: %s", rec.Body.String())
+		if rec.Code != http.StatusOK {
+			return rec.Code, nil
+		}
+		var resp apiChannelRecommendation
+		err := json.Unmarshal(rec.Body.Bytes(), &resp)
+		assert.NoError(err)
+		return rec.Code, &resp
+	}
+
+	code, resp := get(node)
+	assert.Equal(http.StatusOK, code)
+
+	// In 2.4GHz, neighbors on overlapping channels count against a
+	// channel, and the measured utilization of the current channel
+	// outweighs its one neighbor.
+	loRec := resp.LoBand
+	assert.NotNil(loRec)
+	assert.Equal(6, loRec.Current)
+	assert.Equal(11, loRec.Recommended)
+	scores := make(map[int]float64)
+	neighbors := make(map[int]int)
+	for _, cand := range loRec.Candidates {
+		scores[cand.Channel] = cand.Score
+		neighbors[cand.Channel] = cand.Neighbors
+		if cand.Channel == 6 {
+			assert.NotNil(cand.Busy)
+			assert.Equal(45.0, *cand.Busy)
+		} else {
+			assert.Nil(cand.Busy)
+		}
+	}
+	assert.Len(loRec.Candidates, 11)
+	assert.Equal(map[int]int{1: 3, 2: 4, 3: 4, 4: 4, 5: 4, 6: 1, 7: 1, 8: 1,
+		9: 1, 10: 1, 11: 0}, neighbors)
+	assert.Equal(30.0, scores[1])
+	assert.Equal(40.0, scores[5])
+	assert.Equal(45.0, scores[6])
+	assert.Equal(10.0, scores[7])
+	assert.Equal(0.0, scores[11])
+
+	// In 5GHz, only neighbors on the same channel count.  Several
+	// channels are uncongested, so the current one is kept.
+	hiRec := resp.HiBand
+	assert.NotNil(hiRec)
+	assert.Equal(153, hiRec.Current)
+	assert.Equal(153, hiRec.Recommended)
+	channels := make([]int, 0)
+	for _, cand := range hiRec.Candidates {
+		channels = append(channels, cand.Channel)
+	}
+	assert.Equal([]int{36, 40, 44, 48, 149, 153}, channels)
+	assert.Equal(20.0, hiRec.Candidates[0].Score)
+	assert.Equal(10.0, hiRec.Candidates[1].Score)
+
+	// A node without radios gets no recommendations
+	code, resp = get(wiredNode)
+	assert.Equal(http.StatusOK, code)
+	assert.Nil(resp.LoBand)
+	assert.Nil(resp.HiBand)
+
+	code, _ = get("001-201901BB-000003")
+	assert.Equal(http.StatusNotFound, code)
+}
+
+func TestNodeConfigDrift(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	dMock.On("ApplianceIDByHWSerial", mock.Anything, mock.Anything).Return(nil, appliancedb.NotFoundError{})
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(me), nil
+	}
+
+	// wlan0 has a channel change which hasn't been applied; wlan1 is
+	// running as configured.
+	node := "001-201901BB-000001"
+	nics := "@/nodes/" + node + "/nics/"
+	err := cfgapi.NewHandle(me).CreateProps(map[string]string{
+		nics + "wlan0/name":           "wlan0",
+		nics + "wlan0/kind":           "wireless",
+		nics + "wlan0/cfg_channel":    "11",
+		nics + "wlan0/active_band":    wifi.LoBand,
+		nics + "wlan0/active_channel": "6",
+		nics + "wlan0/active_width":   "20",
+		nics + "wlan1/name":           "wlan1",
+		nics + "wlan1/kind":           "wireless",
+		nics + "wlan1/cfg_channel":    "149",
+		nics + "wlan1/active_band":    wifi.HiBand,
+		nics + "wlan1/active_channel": "149",
+		nics + "wlan1/active_width":   "80",
+		nics + "wan/name":             "wan",
+		nics + "wan/kind":             "wired",
+	}, nil)
+	assert.NoError(err)
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	url := fmt.Sprintf("/api/sites/%s/nodes", m0.UUID)
+	req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	t.Logf("return body: %s", rec.Body.String())
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var nodes []apiNodeInfo
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &nodes))
+	assert.Len(nodes, 1)
+	drift := make(map[string]*cfgapi.WifiDrift)
+	for _, nic := range nodes[0].Nics {
+		drift[nic.Name] = nic.ConfigDrift
+	}
+	assert.Len(drift, 3)
+	assert.Equal(&cfgapi.WifiDrift{
+		Fields:        []string{"channel"},
+		ConfigChannel: 11,
+		ActiveBand:    wifi.LoBand,
+		ActiveChannel: 6,
+		ActiveWidth:   "20",
+	}, drift["wlan0"])
+	assert.Nil(drift["wlan1"])
+	assert.Nil(drift["wan"])
+}
+
+func TestNodePortMTU(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	dMock.On("ApplianceIDByHWSerial", mock.Anything, mock.Anything).Return(nil, appliancedb.NotFoundError{})
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(me), nil
+	}
+
+	node := "001-201901BB-000001"
+	nics := "@/nodes/" + node + "/nics/"
+	err := cfgapi.NewHandle(me).CreateProps(map[string]string{
+		nics + "wan/name":   "wan",
+		nics + "wan/kind":   "wired",
+		nics + "wan/mtu":    "1492",
+		nics + "lan0/name":  "lan0",
+		nics + "lan0/kind":  "wired",
+		nics + "wlan0/name": "wlan0",
+		nics + "wlan0/kind": "wireless",
+	}, nil)
+	assert.NoError(err)
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	post := func(port string, body string) int {
+		url := fmt.Sprintf("/api/sites/%s/nodes/%s/ports/%s/mtu",
+			m0.UUID, node, port)
+		req, rec := setupReqRec(&mockAccount, echo.POST, url,
+			strings.NewReader(body), ss)
+		req.Header.Add("Content-Type", "application/json")
+		e.ServeHTTP(rec, req)
+		t.Logf("return body: %s", rec.Body.String())
+		return rec.Code
+	}
+	getMTUs := func() map[string]int {
+		url := fmt.Sprintf("/api/sites/%s/nodes", m0.UUID)
+		req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+		e.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		var nodes []apiNodeInfo
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &nodes))
+		assert.Len(nodes, 1)
+		mtus := make(map[string]int)
+		for _, nic := range nodes[0].Nics {
+			mtus[nic.Name] = nic.MTU
+		}
+		return mtus
+	}
+
+	// Ports without a configured MTU report none
+	assert.Equal(map[string]int{"wan": 1492, "lan0": 0, "wlan0": 0},
+		getMTUs())
+
+	assert.Equal(http.StatusOK, post("lan0", `{"mtu": 9000}`))
+	assert.NoError(me.PropEq(nics+"lan0/mtu", "9000"))
+	assert.Equal(map[string]int{"wan": 1492, "lan0": 9000, "wlan0": 0},
+		getMTUs())
+
+	// Out of range MTUs are rejected
+	assert.Equal(http.StatusBadRequest, post("wan", `{"mtu": 9001}`))
+	assert.Equal(http.StatusBadRequest, post("wan", `{"mtu": 575}`))
+	assert.Equal(http.StatusBadRequest, post("wan", `{}`))
+	assert.NoError(me.PropEq(nics+"wan/mtu", "1492"))
+
+	// Only wired ports have a settable MTU
+	assert.Equal(http.StatusBadRequest, post("wlan0", `{"mtu": 1500}`))
+	assert.NoError(me.PropAbsent(nics + "wlan0/mtu"))
+	assert.Equal(http.StatusBadRequest, post("lan9", `{"mtu": 1500}`))
+}
+
+// Attributes of the fake clients used by TestDevicesPaginated
+func fakeClientMAC(i int) string {
+	return fmt.Sprintf("00:40:00:00:%02x:%02x", i/256, i%256)
+}
+
+func fakeClientRing(i int) string {
+	return []string{"standard", "devices", "guest"}[i%3]
+}
+
+func fakeClientActive(i int) bool   { return i%2 == 0 }
+func fakeClientWireless(i int) bool { return i%4 < 2 }
+
+func fakeClientDHCPName(i int) string {
+	if i == 123 {
+		return "Living-Room-TV"
+	}
+	return fmt.Sprintf("host-%03d", i)
+}
+
+func TestDevicesPaginated(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+
+	const nClients = 400
+	me := mockcfg.NewMockExecFromDefaults()
+	props := make(map[string]string)
+	for i := 0; i < nClients; i++ {
+		client := "@/clients/" + fakeClientMAC(i) + "/"
+		props[client+"ring"] = fakeClientRing(i)
+		props[client+"dhcp_name"] = fakeClientDHCPName(i)
+		props[client+"connection/active"] =
+			strconv.FormatBool(fakeClientActive(i))
+		props[client+"connection/wireless"] =
+			strconv.FormatBool(fakeClientWireless(i))
+	}
+	assert.NoError(cfgapi.NewHandle(me).CreateProps(props, nil))
+
+	rec := &cfgapi.OpRecorder{}
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		hdl := cfgapi.NewHandle(me)
+		hdl.Use(rec.Intercept)
+		return hdl, nil
+	}
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		target := fmt.Sprintf("/api/sites/%s/devices?%s", m0.UUID, query)
+		req, rr := setupReqRec(&mockAccount, echo.GET, target, nil, ss)
+		e.ServeHTTP(rr, req)
+		return rr
+	}
+	getList := func(query string) []string {
+		rr := get(query)
+		assert.Equal(http.StatusOK, rr.Code)
+		var devices []apiDevice
+		assert.NoError(json.Unmarshal(rr.Body.Bytes(), &devices))
+		macs := make([]string, 0)
+		for _, d := range devices {
+			macs = append(macs, d.HwAddr)
+		}
+		return macs
+	}
+	getPage := func(query string) (apiDevicePage, []string) {
+		rr := get(query)
+		assert.Equal(http.StatusOK, rr.Code)
+		var page apiDevicePage
+		assert.NoError(json.Unmarshal(rr.Body.Bytes(), &page))
+		macs := make([]string, 0)
+		for _, d := range page.Devices {
+			macs = append(macs, d.HwAddr)
+		}
+		return page, macs
+	}
+	expect := func(match func(i int) bool) []string {
+		macs := make([]string, 0)
+		for i := 0; i < nClients; i++ {
+			if match(i) {
+				macs = append(macs, fakeClientMAC(i))
+			}
+		}
+		return macs
+	}
+
+	// Without pagination parameters, every device is returned in a bare
+	// list.
+	assert.Equal(expect(func(i int) bool { return true }), getList(""))
+
+	filters := map[string]func(i int) bool{
+		"ring=guest": func(i int) bool {
+			return fakeClientRing(i) == "guest"
+		},
+		"active=true": func(i int) bool {
+			return fakeClientActive(i)
+		},
+		"wireless=false": func(i int) bool {
+			return !fakeClientWireless(i)
+		},
+		"ring=standard&active=true&wireless=false": func(i int) bool {
+			return fakeClientRing(i) == "standard" &&
+				fakeClientActive(i) && !fakeClientWireless(i)
+		},
+		"q=living": func(i int) bool {
+			return i == 123
+		},
+		"q=HOST-01": func(i int) bool {
+			return strings.HasPrefix(fakeClientDHCPName(i), "host-01")
+		},
+		"q=00:40:00:00:01:": func(i int) bool {
+			return i >= 256
+		},
+		"q=host-01&ring=devices&active=false": func(i int) bool {
+			return strings.HasPrefix(fakeClientDHCPName(i), "host-01") &&
+				fakeClientRing(i) == "devices" && !fakeClientActive(i)
+		},
+		"ring=quarantine": func(i int) bool {
+			return false
+		},
+	}
+	for query, match := range filters {
+		t.Logf("filter %s", query)
+		assert.Equal(expect(match), getList(query), query)
+	}
+
+	// Walk through the pages of a filtered list
+	all := expect(filters["active=true"])
+	seen := make([]string, 0)
+	cursor := ""
+	for pages := 0; ; pages++ {
+		assert.True(pages < 5)
+		page, macs := getPage("active=true&limit=50&cursor=" + cursor)
+		assert.Equal(len(all), page.TotalCount)
+		assert.True(len(macs) <= 50)
+		seen = append(seen, macs...)
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	assert.Equal(all, seen)
+
+	// The cursor marks a position in mac order, so it is unaffected by
+	// devices coming and going on earlier pages.
+	page, first := getPage("limit=10")
+	assert.Equal(nClients, page.TotalCount)
+	assert.Equal(expect(func(i int) bool { return i < 10 }), first)
+	hdl := cfgapi.NewHandle(me)
+	assert.NoError(hdl.DeleteProp("@/clients/" + fakeClientMAC(3)))
+	assert.NoError(hdl.CreateProp("@/clients/00:00:00:00:00:01/ring",
+		"standard", nil))
+	page, second := getPage("limit=10&cursor=" + page.NextCursor)
+	assert.Equal(nClients, page.TotalCount)
+	assert.Equal(expect(func(i int) bool { return i >= 10 && i < 20 }),
+		second)
+
+	// The per-device details are only gathered for the devices returned
+	rec.Reset()
+	_, macs := getPage("ring=devices&limit=7")
+	assert.Len(macs, 7)
+	members := make(map[string]bool)
+	for _, mac := range macs {
+		members[mac] = true
+	}
+	fetched := map[string]int{}
+	for _, op := range rec.Ops() {
+		for _, detail := range []string{"/scans", "/vulnerabilities"} {
+			if strings.HasSuffix(op.Name, detail) {
+				mac := strings.Split(op.Name, "/")[2]
+				assert.True(members[mac], op.Name)
+				fetched[detail]++
+			}
+		}
+	}
+	assert.Equal(map[string]int{"/scans": 7, "/vulnerabilities": 7},
+		fetched)
+
+	// Malformed parameters
+	for _, query := range []string{
+		"limit=0", "limit=-1", "limit=ten", "cursor=garbage",
+		"active=maybe", "wireless=2",
+	} {
+		assert.Equal(http.StatusBadRequest, get(query).Code, query)
+	}
+}
+
+func TestConfigSearch(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	var exec cfgapi.ConfigExec = me
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(exec), nil
+	}
+	err := cfgapi.NewHandle(me).CreateProps(map[string]string{
+		"@/users/alice/display_name":      "Alice",
+		"@/users/alice/user_password":     "$2a$10$notarealhash",
+		"@/users/alice/user_md4_password": "0123456789abcdef",
+	}, nil)
+	assert.NoError(err)
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	search := func(pattern string) *httptest.ResponseRecorder {
+		q := url.QueryEscape(pattern)
+		target := fmt.Sprintf("/api/sites/%s/config/search?pattern=%s",
+			m0.UUID, q)
+		req, rec := setupReqRec(&mockAccount, echo.GET, target, nil, ss)
+		e.ServeHTTP(rec, req)
+		t.Logf("return body: %s", rec.Body.String())
+		return rec
+	}
+	matches := func(rec *httptest.ResponseRecorder) []apiConfigMatch {
+		var m []apiConfigMatch
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &m))
+		return m
+	}
+
+	// The psk VAP's passphrase matches the wildcard, but is withheld
+	rec := search("@/network/vap/psk/*")
+	assert.NotContains(rec.Body.String(), "sosecretive")
+	m := matches(rec)
+	assert.NotEmpty(m)
+	byPath := make(map[string]apiConfigMatch)
+	for i := range m {
+		if i > 0 {
+			assert.True(m[i-1].Path < m[i].Path)
+		}
+		byPath[m[i].Path] = m[i]
+	}
+	assert.Equal(apiConfigMatch{
+		Path:  "@/network/vap/psk/ssid",
+		Value: "setme-devices",
+	}, byPath["@/network/vap/psk/ssid"])
+	assert.Equal(apiConfigMatch{
+		Path:     "@/network/vap/psk/passphrase",
+		Redacted: true,
+	}, byPath["@/network/vap/psk/passphrase"])
+
+	// Wildcards match within a level, across VAPs
+	for _, match := range matches(search("@/network/vap/*/ssid")) {
+		assert.True(strings.HasSuffix(match.Path, "/ssid"))
+		assert.False(match.Redacted)
+		assert.NotEmpty(match.Value)
+	}
+
+	assert.Equal([]apiConfigMatch{
+		{Path: "@/users/alice/display_name", Value: "Alice"},
+		{Path: "@/users/alice/user_md4_password", Redacted: true},
+		{Path: "@/users/alice/user_password", Redacted: true},
+	}, matches(search("@/users/*/*")))
+
+	assert.Empty(matches(search("@/nosuch/*")))
+
+	// Malformed patterns
+	for _, pattern := range []string{"", "network/*", "@/network/["} {
+		rec = search(pattern)
+		assert.Equal(http.StatusBadRequest, rec.Code)
+	}
+
+	// Failing to reach the site's config is an upstream failure
+	exec = errExec(cfgapi.ErrComm)
+	rec = search("@/network/vap/*/ssid")
+	assert.Equal(http.StatusBadGateway, rec.Code)
+}
+
+func TestConfigHash(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(me), nil
+	}
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+
+	getHash := func(root string, status int) string {
+		target := fmt.Sprintf("/api/sites/%s/config/hash", m0.UUID)
+		if root != "" {
+			target += "?root=" + url.QueryEscape(root)
+		}
+		req, rec := setupReqRec(&mockAccount, echo.GET, target, nil, ss)
+		e.ServeHTTP(rec, req)
+		t.Logf("return body: %s", rec.Body.String())
+		assert.Equal(status, rec.Code)
+		if status != http.StatusOK {
+			return ""
+		}
+		var resp apiConfigHash
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &resp))
+		assert.NotEmpty(resp.Hash)
+		return resp.Hash
+	}
+
+	// The whole tree is hashed by default
+	all := getHash("", http.StatusOK)
+	assert.Equal(all, getHash("@/", http.StatusOK))
+	vap := getHash("@/network/vap", http.StatusOK)
+	assert.NotEqual(all, vap)
+
+	// Changing the config changes the hashes of the trees containing it
+	hdl := cfgapi.NewHandle(me)
+	assert.NoError(hdl.SetProp("@/network/vap/psk/ssid", "changed", nil))
+	assert.NotEqual(all, getHash("", http.StatusOK))
+	assert.NotEqual(vap, getHash("@/network/vap", http.StatusOK))
+
+	// But not of those which don't
+	dns := getHash("@/network/dns", http.StatusOK)
+	assert.NoError(hdl.SetProp("@/network/vap/psk/ssid", "again", nil))
+	assert.Equal(dns, getHash("@/network/dns", http.StatusOK))
+
+	_ = getHash("@/no/such/prop", http.StatusNotFound)
+	_ = getHash("network/vap", http.StatusBadRequest)
+}
+
+func TestHealth(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	hb := &appliancedb.HeartbeatIngest{SiteUUID: m0.UUID, RecordTS: time.Now()}
+	dMock.On("LatestHeartbeatBySiteUUID", mock.Anything, m0.UUID).Return(hb, nil)
+	dMock.On("CommandAuditHealth", mock.Anything, mock.Anything, mock.Anything, false).Return(
+		[]*appliancedb.SiteCommand{}, nil)
+	defer dMock.AssertExpectations(t)
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	me.SetPingDelay(20 * time.Millisecond)
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(me), nil
+	}
+
+	defer func(timeout time.Duration) {
+		healthPingTimeout = timeout
+	}(healthPingTimeout)
+	healthPingTimeout = 200 * time.Millisecond
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+	url := fmt.Sprintf("/api/sites/%s/health", m0.UUID)
+
+	var latency float64
+	getHealth := func() siteHealth {
+		req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+		e.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		t.Logf("return body: %s", rec.Body.String())
+
+		var resp siteHealth
+		err := json.Unmarshal(rec.Body.Bytes(), &resp)
+		assert.NoError(err)
+
+		// The config plane's latency is checked separately
+		latency = resp.ConfigLatencyMs
+		resp.ConfigLatencyMs = 0
+		return resp
+	}
+
+	assert.Equal(siteHealth{}, getHealth())
+	assert.True(latency >= 20, "latency %v", latency)
+
+	// A service holding a change until it restarts is reported as a
+	// pending change, until the restart happens.
+	hdl := cfgapi.NewHandle(me)
+	assert.NoError(hdl.SetPendingRestart("hostapd", "wlan0 cfg_channel changed"))
+	assert.Equal(siteHealth{PendingChanges: true}, getHealth())
+
+	assert.NoError(hdl.ClearPendingRestart("hostapd"))
+	assert.Equal(siteHealth{}, getHealth())
+
+	// A config plane which doesn't answer in time is a problem, and we
+	// report how long we waited.
+	me.SetPingDelay(time.Minute)
+	assert.Equal(siteHealth{ConfigProblem: true}, getHealth())
+	assert.True(latency >= 200, "latency %v", latency)
+	me.SetPingDelay(20 * time.Millisecond)
+
+	// A site which has stopped sending heartbeats is a problem
+	hb.RecordTS = time.Now().Add(-time.Hour)
+	assert.Equal(siteHealth{HeartbeatProblem: true}, getHealth())
+
+	// ... unless it has been archived, in which case its health isn't
+	// evaluated at all.
+	m0.ArchivedAt = null.TimeFrom(time.Now())
+	assert.Equal(siteHealth{Archived: true}, getHealth())
+	assert.Zero(latency)
+
+	// Unarchiving the site restores the usual checks
+	m0.ArchivedAt = null.Time{}
+	assert.Equal(siteHealth{HeartbeatProblem: true}, getHealth())
+}
+
+func TestPendingActions(t *testing.T) {
+	assert := require.New(t)
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	defer dMock.AssertExpectations(t)
+
+	me := mockcfg.NewMockExecFromDefaults()
+	me.Logf = t.Logf
+	getClientHandle := func(uuid string) (*cfgapi.Handle, error) {
+		return cfgapi.NewHandle(me), nil
+	}
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getClientHandle, nil)
+	url := fmt.Sprintf("/api/sites/%s/pending", m0.UUID)
+
+	// Nothing pending yet: an empty list, not null
+	req, rec := setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.JSONEq("[]", rec.Body.String())
+
+	reboot := time.Date(2020, 6, 1, 3, 0, 0, 0, time.UTC)
+	upgrade := time.Date(2020, 5, 31, 2, 0, 0, 0, time.UTC)
+	err := cfgapi.NewHandle(me).CreateProps(map[string]string{
+		"@/pending/reboot/scheduled":  reboot.Format(time.RFC3339),
+		"@/pending/upgrade/scheduled": upgrade.Format(time.RFC3339),
+	}, nil)
+	assert.NoError(err)
+
+	req, rec = setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	t.Logf("return body: %s", rec.Body.String())
+
+	var resp []cfgapi.PendingAction
+	err = json.Unmarshal(rec.Body.Bytes(), &resp)
+	assert.NoError(err)
+	assert.Len(resp, 2)
+	assert.Equal(cfgapi.PendingUpgrade, resp[0].Name)
+	assert.True(upgrade.Equal(resp[0].Scheduled))
+	assert.Equal(cfgapi.PendingReboot, resp[1].Name)
+	assert.True(reboot.Equal(resp[1].Scheduled))
+}
+
+// Stands in for the database's keyed hash of a guest phone number
+func mockPhoneHash(phone string) []byte {
+	mac := hmac.New(sha256.New, []byte("I LIKE COCONUTS"))
+	mac.Write([]byte(phone))
+	return mac.Sum(nil)
+}
+
+func TestEnrollGuest(t *testing.T) {
+	assert := require.New(t)
+
+	// Fake Twilio endpoint; numbers ending in 0000 are rejected
+	var sent int
+	twilioSrv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_ = r.ParseForm()
+			w.Header().Set("Content-Type", "application/json")
+			if strings.HasSuffix(r.PostForm.Get("To"), "0000") {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = io.WriteString(w, `{"code": 21211, "status": 400,
+				    "message": "The 'To' number is not a valid phone number."}`)
+				return
+			}
+			sent++
+			w.WriteHeader(http.StatusCreated)
+			_, _ = io.WriteString(w, `{"sid": "SM0123", "status": "queued"}`)
+		}))
+	defer twilioSrv.Close()
+	twil := gotwilio.NewTwilioClient("AC0123", "authtoken")
+	twil.BaseUrl = twilioSrv.URL
+
+	// Mock DB
+	m0 := mockSites[0]
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	dMock.On("HashGuestPhoneNumber", mock.Anything).Return(mockPhoneHash)
+	recorded := make([]appliancedb.GuestEnrollAttempt, 0)
+	dMock.On("RecordGuestEnrollAttempt", mock.Anything, mock.Anything).Run(
+		func(args mock.Arguments) {
+			recorded = append(recorded, args.Get(1).(appliancedb.GuestEnrollAttempt))
+		}).Return(nil)
+	defer dMock.AssertExpectations(t)
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getMockClientHandle, twil)
+
+	url := fmt.Sprintf("/api/sites/%s/enroll_guest", m0.UUID)
+	enroll := func(phone string) siteEnrollGuestResponse {
+		var resp siteEnrollGuestResponse
+		body := strings.NewReader(fmt.Sprintf(
+			`{"kind": "psk", "phoneNumber": %q}`, phone))
+		req, rec := setupReqRec(&mockAccount, echo.POST, url, body, ss)
+		req.Header.Add("Content-Type", "application/json")
+		e.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		t.Logf("return body: %s", rec.Body.String())
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp
+	}
+
+	// Success: both messages are sent, and the attempt is recorded
+	resp := enroll("650-555-1212")
+	assert.True(resp.SMSDelivered)
+	assert.Equal(2, sent)
+	assert.Len(recorded, 1)
+	assert.Equal(appliancedb.GuestEnrollSent, recorded[0].Result)
+	assert.Equal(m0.UUID, recorded[0].SiteUUID)
+	assert.Equal(uuid.NullUUID{UUID: accountUUID, Valid: true}, recorded[0].AccountUUID)
+	assert.Equal(mockPhoneHash("+16505551212"), recorded[0].PhoneHash)
+
+	// Failure at Twilio
+	resp = enroll("650-555-0000")
+	assert.False(resp.SMSDelivered)
+	assert.Equal(2, sent)
+	assert.Len(recorded, 2)
+	assert.Equal(appliancedb.GuestEnrollInvalidNumber, recorded[1].Result)
+	assert.Equal(mockPhoneHash("+16505550000"), recorded[1].PhoneHash)
+
+	// Failure to parse the number
+	resp = enroll("not a phone number")
+	assert.False(resp.SMSDelivered)
+	assert.Equal(2, sent)
+	assert.Len(recorded, 3)
+	assert.Equal(appliancedb.GuestEnrollInvalidNumber, recorded[2].Result)
+	assert.NotNil(recorded[2].PhoneHash)
+	assert.Empty(recorded[2].PhoneHash)
+
+	// Equivalent numbers are recorded identically
+	_ = enroll("(650) 555-1212")
+	assert.Len(recorded, 4)
+	assert.Equal(recorded[0].PhoneHash, recorded[3].PhoneHash)
+	dMock.AssertNotCalled(t, "HashGuestPhoneNumber", "not a phone number")
+}
+
+func TestGuestEnrollAttempts(t *testing.T) {
+	assert := require.New(t)
+
+	now := time.Now()
+	attempts := []appliancedb.GuestEnrollAttempt{
+		{
+			ID:          2,
+			AccountUUID: uuid.NullUUID{UUID: accountUUID, Valid: true},
+			SiteUUID:    mockSites[0].UUID,
+			Timestamp:   now,
+			PhoneHash:   mockPhoneHash("+16505550000"),
+			Result:      appliancedb.GuestEnrollInvalidNumber,
+		},
+		{
+			ID:        1,
+			SiteUUID:  mockSites[0].UUID,
+			Timestamp: now.Add(-time.Hour),
+			PhoneHash: mockPhoneHash("+16505551212"),
+			Result:    appliancedb.GuestEnrollSent,
+		},
+		{
+			ID:        0,
+			SiteUUID:  mockSites[0].UUID,
+			Timestamp: now.Add(-2 * time.Hour),
+			PhoneHash: []byte{},
+			Result:    appliancedb.GuestEnrollInvalidNumber,
+		},
+	}
+
+	// Mock DB
+	m0 := mockSites[0]
+	since, _ := time.Parse(time.RFC3339, "2020-01-02T15:04:05Z")
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, accountUUID, orgUUID).Return(mockAccountOrgRoles, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	dMock.On("GuestEnrollAttemptsBySite", mock.Anything, m0.UUID, since).Return(attempts, nil)
+	dMock.On("GuestEnrollAttemptsBySite", mock.Anything, m0.UUID, mock.Anything).Return(attempts[:1], nil)
+	defer dMock.AssertExpectations(t)
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getMockClientHandle, nil)
+
+	url := fmt.Sprintf("/api/sites/%s/guests/attempts", m0.UUID)
+	req, rec := setupReqRec(&mockAccount, echo.GET, url+"?since=2020-01-02T15:04:05Z", nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	t.Logf("return body: %s", rec.Body.String())
+	assert.NotContains(rec.Body.String(), "650555")
+
+	var resp []apiGuestEnrollAttempt
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Len(resp, 3)
+	assert.Equal(appliancedb.GuestEnrollInvalidNumber, resp[0].Result)
+	assert.Equal(accountUUID, *resp[0].AccountUUID)
+	assert.Equal(hex.EncodeToString(attempts[0].PhoneHash[:guestPhoneIDLen]), resp[0].PhoneID)
+	assert.NotContains(rec.Body.String(), hex.EncodeToString(attempts[0].PhoneHash))
+	assert.Equal(appliancedb.GuestEnrollSent, resp[1].Result)
+	assert.Nil(resp[1].AccountUUID)
+	assert.Equal("", resp[2].PhoneID)
+
+	// Default window
+	req, rec = setupReqRec(&mockAccount, echo.GET, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Len(resp, 1)
+
+	req, rec = setupReqRec(&mockAccount, echo.GET, url+"?since=yesterday", nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusBadRequest, rec.Code)
+}
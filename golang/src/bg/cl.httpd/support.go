@@ -0,0 +1,310 @@
+//
+// Copyright 2020 Brightgate Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+//
+
+
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"bg/cloud_models/appliancedb"
+
+	"github.com/labstack/echo"
+	"github.com/satori/uuid"
+)
+
+// Support staff belong to an organization which has a "support" relationship
+// with each customer organization.  That relationship gives them no roles of
+// its own: an admin of the customer organization must first create a support
+// grant, and the support account must then start a support session for the
+// organization.  While the session lasts, the account's roles in the
+// organization come from the grant rather than from account_org_role, every
+// request it makes there is recorded in the support audit trail, and a
+// read-only grant blocks any request which could make changes.
+const supportRelationship = "support"
+
+type apiSupportGrant struct {
+	Scope    string `json:"scope"`
+	Duration string `json:"duration"`
+}
+
+// safeMethod returns true if requests with the given method never change
+// anything, and so are permitted under a read-only support grant
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead ||
+		method == http.MethodOptions
+}
+
+// effectiveRoles computes which of allowedRoles an account holds in an
+// organization.  If the account is in a support session for the organization,
+// the roles come from the organization's active support grant, which is also
+// returned; otherwise they come from the account's ordinary roles.
+func effectiveRoles(c echo.Context, db appliancedb.DataStore,
+	accountUUID, orgUUID uuid.UUID,
+	allowedRoles []string) (matchedRoles, *appliancedb.SupportGrant, error) {
+
+	ctx := c.Request().Context()
+	aoRoles, err := db.AccountOrgRolesByAccountTarget(ctx, accountUUID,
+		orgUUID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	supportOrg, _ := c.Get("support_org_uuid").(uuid.UUID)
+	impersonating := supportOrg != uuid.Nil && supportOrg == orgUUID
+
+	var grant *appliancedb.SupportGrant
+	matches := make(matchedRoles)
+	for _, aor := range aoRoles {
+		var roles []string
+		if aor.Relationship == supportRelationship {
+			if !impersonating {
+				continue
+			}
+			if grant == nil {
+				grant, err = db.ActiveSupportGrant(ctx, orgUUID)
+				if _, ok := err.(appliancedb.NotFoundError); ok {
+					return matches, nil, nil
+				} else if err != nil {
+					return nil, nil, err
+				}
+			}
+			roles = aor.LimitRoles
+		} else if !impersonating {
+			roles = aor.Roles
+		}
+		for _, r := range roles {
+			for _, rr := range allowedRoles {
+				if r == rr {
+					matches[r] = true
+				}
+			}
+		}
+	}
+	return matches, grant, nil
+}
+
+// serveSupport records a request made under a support grant in the audit
+// trail, and passes it on to the handler if the grant's scope permits it.  If
+// the request can't be recorded, it is refused.
+func serveSupport(c echo.Context, db appliancedb.DataStore,
+	grant *appliancedb.SupportGrant, accountUUID uuid.UUID,
+	next echo.HandlerFunc) error {
+
+	req := c.Request()
+	allowed := !grant.ReadOnly() || safeMethod(req.Method)
+	rec := &appliancedb.SupportAudit{
+		GrantUUID:        grant.UUID,
+		AccountUUID:      accountUUID,
+		GrantedBy:        grant.GrantedBy,
+		OrganizationUUID: grant.OrganizationUUID,
+		Method:           req.Method,
+		Path:             req.URL.Path,
+		Allowed:          allowed,
+	}
+	if err := db.InsertSupportAudit(req.Context(), rec); err != nil {
+		c.Logger().Errorf("failed to record support request: %v", err)
+		return newHTTPError(http.StatusInternalServerError)
+	}
+	if !allowed {
+		return newHTTPError(http.StatusForbidden,
+			"support grant is read-only")
+	}
+	c.Set("support_grant", grant)
+	return next(c)
+}
+
+// impersonated returns true if the request is being made under a support
+// grant
+func impersonated(c echo.Context) bool {
+	grant, _ := c.Get("support_grant").(*appliancedb.SupportGrant)
+	return grant != nil
+}
+
+// readOnlyImpersonated returns true if the request is being made under a
+// read-only support grant.  Handlers which make changes in response to a safe
+// method must check this themselves.
+func readOnlyImpersonated(c echo.Context) bool {
+	grant, _ := c.Get("support_grant").(*appliancedb.SupportGrant)
+	return grant != nil && grant.ReadOnly()
+}
+
+// getSupportGrants implements GET /api/org/:org_uuid/support-grant, returning
+// all of the organization's support grants, newest first.
+func (o *orgHandler) getSupportGrants(c echo.Context) error {
+	orgUUID, err := uuid.FromString(c.Param("org_uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	grants, err := o.db.SupportGrantsByOrganization(c.Request().Context(),
+		orgUUID)
+	if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+	return c.JSON(http.StatusOK, grants)
+}
+
+// postSupportGrant implements POST /api/org/:org_uuid/support-grant, which
+// gives the organization's support staff access to it for the given duration
+// (e.g., "4h"), with the given scope: "read-only" or "read-write".
+func (o *orgHandler) postSupportGrant(c echo.Context) error {
+	ctx := c.Request().Context()
+	accountUUID, ok := c.Get("account_uuid").(uuid.UUID)
+	if !ok || accountUUID == uuid.Nil {
+		return newHTTPError(http.StatusUnauthorized)
+	}
+	orgUUID, err := uuid.FromString(c.Param("org_uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	// Support staff can't extend their own access
+	if impersonated(c) {
+		return newHTTPError(http.StatusForbidden)
+	}
+
+	var input apiSupportGrant
+	if err := c.Bind(&input); err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	d, err := time.ParseDuration(input.Duration)
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, "bad duration")
+	}
+
+	now := time.Now()
+	grant := &appliancedb.SupportGrant{
+		OrganizationUUID: orgUUID,
+		GrantedBy:        uuid.NullUUID{UUID: accountUUID, Valid: true},
+		Scope:            input.Scope,
+		CreatedAt:        now,
+		ExpiresAt:        now.Add(d),
+	}
+	err = o.db.InsertSupportGrant(ctx, grant)
+	if verr, ok := err.(appliancedb.ValidationError); ok {
+		return newHTTPError(http.StatusBadRequest, verr.Error())
+	} else if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+	return c.JSON(http.StatusOK, grant)
+}
+
+// deleteSupportGrant implements DELETE
+// /api/org/:org_uuid/support-grant/:grant_uuid, revoking the grant.
+func (o *orgHandler) deleteSupportGrant(c echo.Context) error {
+	accountUUID, ok := c.Get("account_uuid").(uuid.UUID)
+	if !ok || accountUUID == uuid.Nil {
+		return newHTTPError(http.StatusUnauthorized)
+	}
+	orgUUID, err := uuid.FromString(c.Param("org_uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	grantUUID, err := uuid.FromString(c.Param("grant_uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	if impersonated(c) {
+		return newHTTPError(http.StatusForbidden)
+	}
+
+	err = o.db.RevokeSupportGrant(c.Request().Context(), orgUUID,
+		grantUUID, accountUUID)
+	if _, ok := err.(appliancedb.NotFoundError); ok {
+		return newHTTPError(http.StatusNotFound)
+	} else if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// getSupportAudit implements GET /api/org/:org_uuid/support-audit, returning
+// the requests support staff have made within the organization, newest first.
+func (o *orgHandler) getSupportAudit(c echo.Context) error {
+	orgUUID, err := uuid.FromString(c.Param("org_uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	recs, err := o.db.SupportAuditByOrganization(c.Request().Context(),
+		orgUUID)
+	if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+	return c.JSON(http.StatusOK, recs)
+}
+
+// postSupportSession implements POST /api/org/:org_uuid/support-session,
+// which starts a support session for the organization.  The session's account
+// must belong to an organization with a support relationship to it, and the
+// organization must have an active support grant, which is returned.
+func (o *orgHandler) postSupportSession(c echo.Context) error {
+	ctx := c.Request().Context()
+	accountUUID, ok := c.Get("account_uuid").(uuid.UUID)
+	if !ok || accountUUID == uuid.Nil {
+		return newHTTPError(http.StatusUnauthorized)
+	}
+	orgUUID, err := uuid.FromString(c.Param("org_uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+
+	acct, err := o.db.AccountByUUID(ctx, accountUUID)
+	if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+	rels, err := o.db.OrgOrgRelationshipsByOrgTarget(ctx,
+		acct.OrganizationUUID, orgUUID)
+	if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+	supporter := false
+	for _, rel := range rels {
+		if rel.Relationship == supportRelationship {
+			supporter = true
+		}
+	}
+	if !supporter {
+		return newHTTPError(http.StatusUnauthorized)
+	}
+
+	grant, err := o.db.ActiveSupportGrant(ctx, orgUUID)
+	if _, ok := err.(appliancedb.NotFoundError); ok {
+		return newHTTPError(http.StatusForbidden, "no active support grant")
+	} else if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+
+	session, err := o.sessionStore.Get(c.Request(), sessionCookieName)
+	if err != nil {
+		return newHTTPError(http.StatusUnauthorized)
+	}
+	session.Values["support_org_uuid"] = orgUUID.String()
+	if err = session.Save(c.Request(), c.Response()); err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+	c.Logger().Infof("account %v started support session for org %v "+
+		"under grant %v", accountUUID, orgUUID, grant.UUID)
+	return c.JSON(http.StatusOK, grant)
+}
+
+// deleteSupportSession implements DELETE /api/org/:org_uuid/support-session,
+// ending the session's support session for the organization, if any.
+func (o *orgHandler) deleteSupportSession(c echo.Context) error {
+	session, err := o.sessionStore.Get(c.Request(), sessionCookieName)
+	if err != nil {
+		return newHTTPError(http.StatusUnauthorized)
+	}
+	if so, ok := session.Values["support_org_uuid"].(string); ok &&
+		so == c.Param("org_uuid") {
+		delete(session.Values, "support_org_uuid")
+		if err = session.Save(c.Request(), c.Response()); err != nil {
+			return newHTTPError(http.StatusInternalServerError, err)
+		}
+	}
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,349 @@
+//
+// Copyright 2020 Brightgate Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+//
+
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo"
+	"github.com/satori/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"bg/cloud_models/appliancedb"
+	"bg/cloud_models/appliancedb/mocks"
+)
+
+var (
+	supportOrgUUID = uuid.Must(uuid.FromString("10000000-0000-0000-0000-000000000003"))
+
+	mockSupportAccount = appliancedb.Account{
+		UUID:             uuid.Must(uuid.FromString("20000000-0000-0000-0000-000000000003")),
+		Email:            "staff@support.example.com",
+		OrganizationUUID: supportOrgUUID,
+		PersonUUID:       personUUID,
+	}
+
+	mockSupportAccountOrgRoles = []appliancedb.AccountOrgRoles{
+		{
+			AccountUUID:            mockSupportAccount.UUID,
+			OrganizationUUID:       supportOrgUUID,
+			TargetOrganizationUUID: orgUUID,
+			Relationship:           supportRelationship,
+			LimitRoles:             []string{"admin", "user"},
+			Roles:                  []string{},
+		},
+	}
+)
+
+// supportState stands in for the support_grant and support_audit tables
+type supportState struct {
+	sync.Mutex
+	grant *appliancedb.SupportGrant
+	audit []appliancedb.SupportAudit
+}
+
+func (s *supportState) setGrant(scope string) {
+	s.Lock()
+	defer s.Unlock()
+	if scope == "" {
+		s.grant = nil
+		return
+	}
+	now := time.Now()
+	s.grant = &appliancedb.SupportGrant{
+		UUID:             uuid.NewV4(),
+		OrganizationUUID: orgUUID,
+		GrantedBy:        uuid.NullUUID{UUID: mockAccount.UUID, Valid: true},
+		Scope:            scope,
+		CreatedAt:        now,
+		ExpiresAt:        now.Add(time.Hour),
+	}
+}
+
+func (s *supportState) activeGrant(context.Context, uuid.UUID) *appliancedb.SupportGrant {
+	s.Lock()
+	defer s.Unlock()
+	return s.grant
+}
+
+func (s *supportState) activeGrantErr(context.Context, uuid.UUID) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.grant == nil {
+		return appliancedb.NotFoundError{}
+	}
+	return nil
+}
+
+func (s *supportState) record(args mock.Arguments) {
+	s.Lock()
+	s.audit = append(s.audit, *args.Get(1).(*appliancedb.SupportAudit))
+	s.Unlock()
+}
+
+func (s *supportState) lastAudit() (int, appliancedb.SupportAudit) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.audit) == 0 {
+		return 0, appliancedb.SupportAudit{}
+	}
+	return len(s.audit), s.audit[len(s.audit)-1]
+}
+
+func setupSupportTest(t *testing.T) (*echo.Echo, *mocks.DataStore, sessions.Store, *supportState) {
+	m0 := mockSites[0]
+	state := &supportState{}
+
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountByUUID", mock.Anything, mockAccount.UUID).Return(&mockAccount, nil)
+	dMock.On("AccountByUUID", mock.Anything, mockSupportAccount.UUID).Return(&mockSupportAccount, nil)
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, mockAccount.UUID, mock.Anything).Return(mockAccountOrgRoles, nil)
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, mockUserAccount.UUID, mock.Anything).Return(mockUserAccountOrgRoles, nil)
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything, mockSupportAccount.UUID, orgUUID).Return(mockSupportAccountOrgRoles, nil)
+	dMock.On("OrgOrgRelationshipsByOrgTarget", mock.Anything, supportOrgUUID, orgUUID).Return(
+		[]appliancedb.OrgOrgRelationship{
+			{
+				OrganizationUUID:       supportOrgUUID,
+				TargetOrganizationUUID: orgUUID,
+				Relationship:           supportRelationship,
+			},
+		}, nil)
+	dMock.On("OrgOrgRelationshipsByOrgTarget", mock.Anything, supportOrgUUID, mock.Anything).Return(
+		[]appliancedb.OrgOrgRelationship{}, nil)
+	dMock.On("ActiveSupportGrant", mock.Anything, orgUUID).Return(
+		state.activeGrant, state.activeGrantErr)
+	dMock.On("InsertSupportAudit", mock.Anything, mock.Anything).Run(
+		state.record).Return(nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	dMock.On("UpdateCustomerSite", mock.Anything, mock.Anything).Return(nil)
+
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	_ = newSiteHandler(e, dMock, mw, getMockClientHandle, nil)
+	_ = newOrgHandler(e, dMock, mw, ss)
+	return e, dMock, ss, state
+}
+
+// startSupportSession starts a support session for orgUUID, and returns the
+// session cookie to use for subsequent requests
+func startSupportSession(t *testing.T, e *echo.Echo, ss sessions.Store) string {
+	assert := require.New(t)
+	url := fmt.Sprintf("/api/org/%s/support-session", orgUUID)
+	req, rec := setupReqRec(&mockSupportAccount, echo.POST, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	cookie := rec.Header().Get("Set-Cookie")
+	assert.NotEmpty(cookie)
+	return cookie
+}
+
+// supportRequest makes a request in the support session identified by cookie,
+// and returns the response code
+func supportRequest(e *echo.Echo, cookie, method, url string, body string) int {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Add("Cookie", cookie)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	e.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestSupportNoGrant(t *testing.T) {
+	assert := require.New(t)
+	e, dMock, ss, state := setupSupportTest(t)
+
+	siteURL := fmt.Sprintf("/api/sites/%s", mockSites[0].UUID)
+	accountsURL := fmt.Sprintf("/api/org/%s/accounts", orgUUID)
+
+	// The support relationship alone gives no access
+	req, rec := setupReqRec(&mockSupportAccount, echo.GET, siteURL, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+	req, rec = setupReqRec(&mockSupportAccount, echo.GET, accountsURL, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+
+	// Nor can a support session start without a grant
+	url := fmt.Sprintf("/api/org/%s/support-session", orgUUID)
+	req, rec = setupReqRec(&mockSupportAccount, echo.POST, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusForbidden, rec.Code)
+
+	// An organization without a support relationship can't be supported
+	state.setGrant(appliancedb.SupportScopeReadWrite)
+	url = fmt.Sprintf("/api/org/%s/support-session", otherOrgUUID)
+	req, rec = setupReqRec(&mockSupportAccount, echo.POST, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+
+	dMock.AssertNotCalled(t, "InsertSupportAudit", mock.Anything,
+		mock.Anything)
+}
+
+func TestSupportReadOnly(t *testing.T) {
+	assert := require.New(t)
+	e, dMock, ss, state := setupSupportTest(t)
+
+	state.setGrant(appliancedb.SupportScopeReadOnly)
+	cookie := startSupportSession(t, e, ss)
+	siteURL := fmt.Sprintf("/api/sites/%s", mockSites[0].UUID)
+
+	// Looking is allowed, and audited with both identities
+	code := supportRequest(e, cookie, echo.GET, siteURL, "")
+	assert.Equal(http.StatusOK, code)
+	n, audit := state.lastAudit()
+	assert.Equal(1, n)
+	assert.Equal(mockSupportAccount.UUID, audit.AccountUUID)
+	assert.Equal(mockAccount.UUID, audit.GrantedBy.UUID)
+	assert.Equal(orgUUID, audit.OrganizationUUID)
+	assert.Equal(state.grant.UUID, audit.GrantUUID)
+	assert.Equal(echo.GET, audit.Method)
+	assert.Equal(siteURL, audit.Path)
+	assert.True(audit.Allowed)
+
+	// Changing things isn't, but the attempt is still audited
+	code = supportRequest(e, cookie, echo.POST, siteURL, `{"name": "x"}`)
+	assert.Equal(http.StatusForbidden, code)
+	n, audit = state.lastAudit()
+	assert.Equal(2, n)
+	assert.Equal(echo.POST, audit.Method)
+	assert.False(audit.Allowed)
+	dMock.AssertNotCalled(t, "UpdateCustomerSite", mock.Anything, mock.Anything)
+}
+
+func TestSupportDiagConnectivity(t *testing.T) {
+	assert := require.New(t)
+	e, _, ss, state := setupSupportTest(t)
+
+	// Polling for connectivity results would request a new check, which
+	// writes to the appliance's config
+	state.setGrant(appliancedb.SupportScopeReadOnly)
+	cookie := startSupportSession(t, e, ss)
+	url := fmt.Sprintf("/api/sites/%s/diag/connectivity", mockSites[0].UUID)
+	code := supportRequest(e, cookie, echo.GET, url, "")
+	assert.Equal(http.StatusForbidden, code)
+	_, audit := state.lastAudit()
+	assert.Equal(url, audit.Path)
+
+	// A read-write grant allows it
+	state.setGrant(appliancedb.SupportScopeReadWrite)
+	code = supportRequest(e, cookie, echo.GET, url, "")
+	assert.Equal(http.StatusAccepted, code)
+}
+
+func TestSupportReadWrite(t *testing.T) {
+	assert := require.New(t)
+	e, dMock, ss, state := setupSupportTest(t)
+
+	state.setGrant(appliancedb.SupportScopeReadWrite)
+	cookie := startSupportSession(t, e, ss)
+	siteURL := fmt.Sprintf("/api/sites/%s", mockSites[0].UUID)
+
+	code := supportRequest(e, cookie, echo.POST, siteURL, `{"name": "x"}`)
+	assert.Equal(http.StatusOK, code)
+	n, audit := state.lastAudit()
+	assert.Equal(1, n)
+	assert.Equal(echo.POST, audit.Method)
+	assert.True(audit.Allowed)
+	dMock.AssertCalled(t, "UpdateCustomerSite", mock.Anything, mock.Anything)
+
+	// Support staff can't extend their own access
+	url := fmt.Sprintf("/api/org/%s/support-grant", orgUUID)
+	code = supportRequest(e, cookie, echo.POST, url,
+		`{"scope": "read-write", "duration": "720h"}`)
+	assert.Equal(http.StatusForbidden, code)
+	dMock.AssertNotCalled(t, "InsertSupportGrant", mock.Anything, mock.Anything)
+}
+
+func TestSupportGrantExpiry(t *testing.T) {
+	assert := require.New(t)
+	e, _, ss, state := setupSupportTest(t)
+
+	state.setGrant(appliancedb.SupportScopeReadWrite)
+	cookie := startSupportSession(t, e, ss)
+	siteURL := fmt.Sprintf("/api/sites/%s", mockSites[0].UUID)
+
+	code := supportRequest(e, cookie, echo.GET, siteURL, "")
+	assert.Equal(http.StatusOK, code)
+
+	// Once the grant has expired or been revoked, the support session no
+	// longer gives access to anything.
+	state.setGrant("")
+	code = supportRequest(e, cookie, echo.GET, siteURL, "")
+	assert.Equal(http.StatusUnauthorized, code)
+	code = supportRequest(e, cookie, echo.GET,
+		fmt.Sprintf("/api/org/%s/accounts", orgUUID), "")
+	assert.Equal(http.StatusUnauthorized, code)
+
+	n, _ := state.lastAudit()
+	assert.Equal(1, n)
+}
+
+func TestSupportGrantAdmin(t *testing.T) {
+	assert := require.New(t)
+	e, dMock, ss, _ := setupSupportTest(t)
+
+	var inserted *appliancedb.SupportGrant
+	dMock.On("InsertSupportGrant", mock.Anything, mock.Anything).Run(
+		func(args mock.Arguments) {
+			inserted = args.Get(1).(*appliancedb.SupportGrant)
+		}).Return(nil)
+	dMock.On("RevokeSupportGrant", mock.Anything, orgUUID, mock.Anything,
+		mockAccount.UUID).Return(nil)
+
+	url := fmt.Sprintf("/api/org/%s/support-grant", orgUUID)
+	body := `{"scope": "read-only", "duration": "4h"}`
+
+	// Only admins can grant access
+	req, rec := setupReqRec(&mockUserAccount, echo.POST, url,
+		strings.NewReader(body), ss)
+	req.Header.Set("Content-Type", "application/json")
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+
+	req, rec = setupReqRec(&mockAccount, echo.POST, url,
+		strings.NewReader(`{"scope": "read-only", "duration": "soon"}`), ss)
+	req.Header.Set("Content-Type", "application/json")
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusBadRequest, rec.Code)
+
+	before := time.Now()
+	req, rec = setupReqRec(&mockAccount, echo.POST, url,
+		strings.NewReader(body), ss)
+	req.Header.Set("Content-Type", "application/json")
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.NotNil(inserted)
+	assert.Equal(orgUUID, inserted.OrganizationUUID)
+	assert.Equal(mockAccount.UUID, inserted.GrantedBy.UUID)
+	assert.Equal(appliancedb.SupportScopeReadOnly, inserted.Scope)
+	assert.Equal(4*time.Hour, inserted.ExpiresAt.Sub(inserted.CreatedAt))
+	assert.False(inserted.CreatedAt.Before(before))
+
+	url = fmt.Sprintf("/api/org/%s/support-grant/%s", orgUUID, uuid.NewV4())
+	req, rec = setupReqRec(&mockAccount, echo.DELETE, url, nil, ss)
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+}
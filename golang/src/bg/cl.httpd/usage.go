@@ -0,0 +1,224 @@
+//
+// Copyright 2020 Brightgate Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+//
+
+
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"bg/cloud_models/appliancedb"
+
+	"github.com/labstack/echo"
+	"github.com/satori/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	usageFlushInterval = time.Minute
+	usageFlushTimeout  = 30 * time.Second
+)
+
+// usageKey identifies a bucket of metered API calls.  For site-scoped routes,
+// the organization owning the site is known at request time; for other routes
+// it is left as uuid.Nil and resolved from the account when the bucket is
+// flushed, so that request handling never waits on the database.
+type usageKey struct {
+	org     uuid.UUID
+	account uuid.UUID
+	class   string
+	hour    time.Time
+}
+
+type usageCount struct {
+	count int64
+	bytes int64
+}
+
+// usageMeter counts customer API calls per organization.  Counts are
+// aggregated in memory and periodically flushed to the api_usage table as
+// hourly rollups; a crash loses at most one flush interval's worth of counts.
+type usageMeter struct {
+	db       appliancedb.DataStore
+	log      *zap.SugaredLogger
+	interval time.Duration
+
+	sync.Mutex
+	counts map[usageKey]*usageCount
+
+	// Only accessed by the flushing goroutine
+	accountOrgs map[uuid.UUID]uuid.UUID
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// usageEndpointClass returns the class of API endpoint a route belongs to,
+// for metering purposes, or "" if the route isn't metered.
+func usageEndpointClass(path string) string {
+	if !strings.HasPrefix(path, "/api/") {
+		return ""
+	}
+	class := strings.SplitN(strings.TrimPrefix(path, "/api/"), "/", 2)[0]
+	if class == "sites" {
+		class = "site"
+	}
+	return class
+}
+
+func (m *usageMeter) add(key usageKey, count, bytes int64) {
+	m.Lock()
+	uc := m.counts[key]
+	if uc == nil {
+		uc = &usageCount{}
+		m.counts[key] = uc
+	}
+	uc.count += count
+	uc.bytes += bytes
+	m.Unlock()
+}
+
+// Middleware attributes each authenticated API request to an organization and
+// counts it.  Site-scoped requests which made it past the site middleware are
+// attributed to the organization owning the site; everything else is
+// attributed to the organization of the account making the request.
+func (m *usageMeter) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+
+		class := usageEndpointClass(c.Path())
+		accountUUID, ok := c.Get("account_uuid").(uuid.UUID)
+		if class == "" || !ok || accountUUID == uuid.Nil {
+			return err
+		}
+
+		key := usageKey{
+			account: accountUUID,
+			class:   class,
+			hour:    time.Now().UTC().Truncate(time.Hour),
+		}
+		if siteOrg, ok := c.Get("site_org_uuid").(uuid.UUID); ok {
+			key.org = siteOrg
+		}
+		bytes := c.Response().Size
+		if c.Request().ContentLength > 0 {
+			bytes += c.Request().ContentLength
+		}
+		m.add(key, 1, bytes)
+		return err
+	}
+}
+
+func (m *usageMeter) accountOrg(ctx context.Context, account uuid.UUID) (uuid.UUID, error) {
+	if org, ok := m.accountOrgs[account]; ok {
+		return org, nil
+	}
+	acct, err := m.db.AccountByUUID(ctx, account)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	m.accountOrgs[account] = acct.OrganizationUUID
+	return acct.OrganizationUUID, nil
+}
+
+// flush writes out the accumulated counts.  Counts which can't be written are
+// put back, to be retried on the next flush.
+func (m *usageMeter) flush() {
+	m.Lock()
+	counts := m.counts
+	m.counts = make(map[usageKey]*usageCount)
+	m.Unlock()
+
+	if len(counts) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		usageFlushTimeout)
+	defer cancel()
+
+	var failed int
+	for key, uc := range counts {
+		if key.org == uuid.Nil {
+			org, err := m.accountOrg(ctx, key.account)
+			if _, ok := err.(appliancedb.NotFoundError); ok {
+				m.log.Warnf("dropping usage for unknown account %v",
+					key.account)
+				continue
+			} else if err != nil {
+				m.log.Warnf("looking up org for account %v: %v",
+					key.account, err)
+				m.add(key, uc.count, uc.bytes)
+				failed++
+				continue
+			}
+			key.org = org
+		}
+
+		rollup := &appliancedb.UsageRollup{
+			OrganizationUUID: key.org,
+			AccountUUID:      key.account,
+			EndpointClass:    key.class,
+			Hour:             key.hour,
+			Count:            uc.count,
+			Bytes:            uc.bytes,
+		}
+		if err := m.db.UpsertUsageRollup(ctx, rollup); err != nil {
+			m.log.Warnf("recording usage %+v: %v", rollup, err)
+			m.add(key, uc.count, uc.bytes)
+			failed++
+		}
+	}
+	if failed > 0 {
+		m.log.Warnf("failed to flush %d of %d usage rollups", failed,
+			len(counts))
+	}
+}
+
+func (m *usageMeter) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.flush()
+		case <-m.stop:
+			m.flush()
+			return
+		}
+	}
+}
+
+// Stop halts the periodic flushing, and flushes whatever counts remain.
+func (m *usageMeter) Stop() {
+	close(m.stop)
+	<-m.done
+}
+
+// newUsageMeter creates a usageMeter which flushes to the given DataStore
+// every interval, until stopped.
+func newUsageMeter(db appliancedb.DataStore, log *zap.SugaredLogger,
+	interval time.Duration) *usageMeter {
+
+	m := &usageMeter{
+		db:          db,
+		log:         log,
+		interval:    interval,
+		counts:      make(map[usageKey]*usageCount),
+		accountOrgs: make(map[uuid.UUID]uuid.UUID),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
@@ -0,0 +1,242 @@
+//
+// Copyright 2020 Brightgate Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+//
+
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo"
+	"github.com/satori/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"bg/cloud_models/appliancedb"
+	"bg/cloud_models/appliancedb/mocks"
+)
+
+var (
+	mspOrgUUID   = uuid.Must(uuid.FromString("10000000-0000-0000-0000-000000000001"))
+	otherOrgUUID = uuid.Must(uuid.FromString("10000000-0000-0000-0000-000000000002"))
+
+	mockMSPAccount = appliancedb.Account{
+		UUID:             uuid.Must(uuid.FromString("20000000-0000-0000-0000-000000000002")),
+		Email:            "manager@msp.example.com",
+		OrganizationUUID: mspOrgUUID,
+		PersonUUID:       personUUID,
+	}
+
+	mockOtherSite = appliancedb.CustomerSite{
+		UUID:             uuid.Must(uuid.FromString("8cc4b2a5-7d9c-4b05-a3d6-2a3b29cf7d5a")),
+		Name:             "other-site",
+		OrganizationUUID: otherOrgUUID,
+	}
+)
+
+// usageRecorder collects the rollups passed to a mock UpsertUsageRollup
+type usageRecorder struct {
+	sync.Mutex
+	rollups []appliancedb.UsageRollup
+}
+
+func (r *usageRecorder) record(args mock.Arguments) {
+	r.Lock()
+	r.rollups = append(r.rollups, *args.Get(1).(*appliancedb.UsageRollup))
+	r.Unlock()
+}
+
+// totals sums the recorded rollups by organization and endpoint class
+func (r *usageRecorder) totals() map[string]usageCount {
+	r.Lock()
+	defer r.Unlock()
+
+	totals := make(map[string]usageCount)
+	for _, rollup := range r.rollups {
+		key := rollup.OrganizationUUID.String() + "/" + rollup.EndpointClass
+		t := totals[key]
+		t.count += rollup.Count
+		t.bytes += rollup.Bytes
+		totals[key] = t
+	}
+	return totals
+}
+
+func TestUsageEndpointClass(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Equal("site", usageEndpointClass("/api/sites"))
+	assert.Equal("site", usageEndpointClass("/api/sites/:uuid/devices"))
+	assert.Equal("account", usageEndpointClass("/api/account/:acct_uuid/wg"))
+	assert.Equal("org", usageEndpointClass("/api/org/:org_uuid/usage"))
+	assert.Equal("", usageEndpointClass("/auth/userid"))
+	assert.Equal("", usageEndpointClass("/client-web/*"))
+	assert.Equal("", usageEndpointClass(""))
+}
+
+func TestUsageSiteAttribution(t *testing.T) {
+	assert := require.New(t)
+	m0 := mockSites[0]
+
+	var rec usageRecorder
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything,
+		mockMSPAccount.UUID, orgUUID).Return(
+		[]appliancedb.AccountOrgRoles{
+			{
+				AccountUUID:            mockMSPAccount.UUID,
+				OrganizationUUID:       mspOrgUUID,
+				TargetOrganizationUUID: orgUUID,
+				Relationship:           "msp",
+				LimitRoles:             []string{"admin", "user"},
+				Roles:                  []string{"admin"},
+			},
+		}, nil)
+	dMock.On("AccountOrgRolesByAccountTarget", mock.Anything,
+		mockMSPAccount.UUID, otherOrgUUID).Return(
+		[]appliancedb.AccountOrgRoles{}, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, m0.UUID).Return(&m0, nil)
+	dMock.On("CustomerSiteByUUID", mock.Anything, mockOtherSite.UUID).Return(
+		&mockOtherSite, nil)
+	dMock.On("CustomerSitesByAccount", mock.Anything, mock.Anything).Return(
+		mockSites, nil)
+	dMock.On("AccountByUUID", mock.Anything, mockMSPAccount.UUID).Return(
+		&mockMSPAccount, nil)
+	dMock.On("UpsertUsageRollup", mock.Anything, mock.Anything).Run(
+		rec.record).Return(nil)
+	defer dMock.AssertExpectations(t)
+
+	meter := newUsageMeter(dMock, zaptest.NewLogger(t).Sugar(), time.Hour)
+
+	// Setup Echo
+	ss := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	mw := []echo.MiddlewareFunc{
+		newSessionMiddleware(ss).Process,
+	}
+	e := echo.New()
+	e.Use(meter.Middleware)
+	_ = newSiteHandler(e, dMock, mw, getMockClientHandle, nil)
+
+	// Two calls against a site managed on behalf of another org
+	siteURL := fmt.Sprintf("/api/sites/%s", m0.UUID)
+	for i := 0; i < 2; i++ {
+		req, rr := setupReqRec(&mockMSPAccount, echo.GET, siteURL, nil, ss)
+		e.ServeHTTP(rr, req)
+		assert.Equal(http.StatusOK, rr.Code)
+	}
+
+	// The site list isn't site-scoped
+	req, rr := setupReqRec(&mockMSPAccount, echo.GET, "/api/sites", nil, ss)
+	e.ServeHTTP(rr, req)
+	assert.Equal(http.StatusOK, rr.Code)
+
+	// A rejected call against someone else's site mustn't be billed to the
+	// owner of that site.
+	otherURL := fmt.Sprintf("/api/sites/%s", mockOtherSite.UUID)
+	req, rr = setupReqRec(&mockMSPAccount, echo.GET, otherURL, nil, ss)
+	e.ServeHTTP(rr, req)
+	assert.Equal(http.StatusUnauthorized, rr.Code)
+
+	// Unauthenticated calls aren't metered
+	req = httptest.NewRequest(echo.GET, siteURL, nil)
+	rr = httptest.NewRecorder()
+	e.ServeHTTP(rr, req)
+	assert.Equal(http.StatusUnauthorized, rr.Code)
+
+	meter.Stop()
+
+	totals := rec.totals()
+	assert.Len(totals, 2)
+	assert.Equal(int64(2), totals[orgUUID.String()+"/site"].count)
+	assert.True(totals[orgUUID.String()+"/site"].bytes > 0)
+	assert.Equal(int64(2), totals[mspOrgUUID.String()+"/site"].count)
+	for _, rollup := range rec.rollups {
+		assert.Equal(mockMSPAccount.UUID, rollup.AccountUUID)
+		assert.Equal(rollup.Hour, rollup.Hour.Truncate(time.Hour))
+	}
+}
+
+func TestUsageFlushOnShutdown(t *testing.T) {
+	assert := require.New(t)
+
+	var rec usageRecorder
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	dMock := &mocks.DataStore{}
+	dMock.On("AccountByUUID", mock.Anything, mockAccount.UUID).Return(
+		&mockAccount, nil)
+	// The first flush stalls, and then fails
+	dMock.On("UpsertUsageRollup", mock.Anything, mock.Anything).Run(
+		func(args mock.Arguments) {
+			close(blocked)
+			<-release
+		}).Return(errors.New("database unavailable")).Once()
+	dMock.On("UpsertUsageRollup", mock.Anything, mock.Anything).Run(
+		rec.record).Return(nil)
+	defer dMock.AssertExpectations(t)
+
+	meter := newUsageMeter(dMock, zaptest.NewLogger(t).Sugar(), time.Hour)
+
+	e := echo.New()
+	e.Use(meter.Middleware)
+	e.GET("/api/test", func(c echo.Context) error {
+		c.Set("account_uuid", mockAccount.UUID)
+		return c.String(http.StatusOK, "hello")
+	})
+	get := func() {
+		rr := httptest.NewRecorder()
+		e.ServeHTTP(rr, httptest.NewRequest(echo.GET, "/api/test", nil))
+		assert.Equal(http.StatusOK, rr.Code)
+	}
+
+	for i := 0; i < 3; i++ {
+		get()
+	}
+
+	// Requests are still handled while a flush is stalled on the database
+	flushed := make(chan struct{})
+	go func() {
+		meter.flush()
+		close(flushed)
+	}()
+	<-blocked
+	handled := make(chan struct{})
+	go func() {
+		get()
+		close(handled)
+	}()
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		assert.Fail("request blocked by flush")
+	}
+	close(release)
+	<-flushed
+
+	// Nothing has been recorded yet; the failed rollup, along with the
+	// request made during the flush, is written out at shutdown.
+	assert.Len(rec.rollups, 0)
+	meter.Lock()
+	assert.NotEmpty(meter.counts)
+	meter.Unlock()
+
+	meter.Stop()
+	totals := rec.totals()
+	assert.Len(totals, 1)
+	assert.Equal(int64(4), totals[orgUUID.String()+"/test"].count)
+	assert.Equal(int64(4*len("hello")), totals[orgUUID.String()+"/test"].bytes)
+}
@@ -25,15 +25,23 @@ import (
 	"google.golang.org/grpc"
 )
 
+// cmdHdl tracks a command submitted to cl.configd.  Its mutex protects the
+// command's state, and is held across status and cancel rpcs, so that
+// concurrent callers see the command's updates in order.
 type cmdHdl struct {
 	cfg      *Configd
 	cmdID    int64
 	inflight bool
 	result   string
 	err      error
+
+	sync.Mutex
 }
 
-// Configd represents an established gRPC connection to cl.configd.
+// Configd represents an established gRPC connection to cl.configd.  It is safe
+// for concurrent use by multiple goroutines, except that SetVerbose,
+// SetTimeout, and SetLevel must be called before the Configd is shared.  The
+// mutex protects the monitor state and its registered handlers.
 type Configd struct {
 	sender   string
 	uuid     string
@@ -106,6 +114,8 @@ func (c *cmdHdl) String() string {
 	return fmt.Sprintf("%s:%d", c.cfg.uuid, c.cmdID)
 }
 
+// update records a response from cl.configd.  It must be called with the lock
+// held.
 func (c *cmdHdl) update(r *cfgmsg.ConfigResponse) {
 	if !c.inflight {
 		log.Printf("Updating completed cmd %v\n", c)
@@ -137,6 +147,8 @@ func (c *cmdHdl) Status(ctx context.Context) (string, error) {
 		log.Printf("checking status of %v\n", c)
 	}
 
+	c.Lock()
+	defer c.Unlock()
 	if c.inflight {
 		cmd := rpc.CfgCmdID{
 			Time:     ptypes.TimestampNow(),
@@ -153,6 +165,8 @@ func (c *cmdHdl) Status(ctx context.Context) (string, error) {
 			if c.err != nil {
 				msg = c.err.Error()
 				err = c.err
+			} else {
+				msg = c.result
 			}
 		}
 	} else {
@@ -170,6 +184,12 @@ func (c *cmdHdl) Status(ctx context.Context) (string, error) {
 	return msg, err
 }
 
+func (c *cmdHdl) isInflight() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.inflight
+}
+
 // Wait will block until the given command completes or times out
 func (c *cmdHdl) Wait(ctx context.Context) (string, error) {
 	var msg string
@@ -180,7 +200,7 @@ func (c *cmdHdl) Wait(ctx context.Context) (string, error) {
 		ctx, ctxcancel := c.cfg.getContext(ctx)
 		msg, err = c.Status(ctx)
 		ctxcancel()
-		if !c.inflight {
+		if !c.isInflight() {
 			break
 		}
 
@@ -196,6 +216,9 @@ func (c *cmdHdl) Wait(ctx context.Context) (string, error) {
 // Cancel will attempt to cancel the command-- i.e. remove it from the queue
 func (c *cmdHdl) Cancel(ctx context.Context) error {
 	var err error
+
+	c.Lock()
+	defer c.Unlock()
 	if !c.inflight {
 		return fmt.Errorf("command not in-flight; cannot cancel")
 	}
@@ -253,6 +276,9 @@ func (c *Configd) ExecuteAt(ctx context.Context, ops []cfgapi.PropertyOp,
 	}
 
 	cmd.Sender = c.sender
+	if origin := cfgapi.OriginFromContext(ctx); origin != "" {
+		cmd.Sender = origin
+	}
 	cmd.Level = int32(level)
 	cmd.SiteUUID = c.uuid
 
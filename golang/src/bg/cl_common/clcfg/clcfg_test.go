@@ -0,0 +1,271 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package clcfg
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	rpc "bg/cloud_rpc"
+	"bg/common/cfgapi"
+	"bg/common/cfgmsg"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// fakeFrontEnd stands in for cl.configd.  Every command is queued when it is
+// submitted, and completes the first time its status is checked.  Property
+// updates written to the updates channel are delivered to any monitor.
+type fakeFrontEnd struct {
+	lastID   int64
+	queued   map[int64]bool
+	statuses int
+	updates  chan *rpc.CfgFrontEndUpdate
+
+	sync.Mutex
+}
+
+type fakeMonitorStream struct {
+	ctx     context.Context
+	updates chan *rpc.CfgFrontEndUpdate
+
+	grpc.ClientStream
+}
+
+func newFakeFrontEnd() *fakeFrontEnd {
+	return &fakeFrontEnd{
+		queued:  make(map[int64]bool),
+		updates: make(chan *rpc.CfgFrontEndUpdate),
+	}
+}
+
+func (f *fakeFrontEnd) Ping(ctx context.Context, in *rpc.CfgFrontEndPing,
+	opts ...grpc.CallOption) (*rpc.CfgFrontEndPing, error) {
+	return in, nil
+}
+
+func (f *fakeFrontEnd) Submit(ctx context.Context, in *cfgmsg.ConfigQuery,
+	opts ...grpc.CallOption) (*cfgmsg.ConfigResponse, error) {
+
+	f.Lock()
+	defer f.Unlock()
+	f.lastID++
+	f.queued[f.lastID] = true
+	return &cfgmsg.ConfigResponse{
+		Response: cfgmsg.ConfigResponse_QUEUED,
+		CmdID:    f.lastID,
+	}, nil
+}
+
+func (f *fakeFrontEnd) Status(ctx context.Context, in *rpc.CfgCmdID,
+	opts ...grpc.CallOption) (*cfgmsg.ConfigResponse, error) {
+
+	f.Lock()
+	defer f.Unlock()
+	f.statuses++
+	if !f.queued[in.CmdID] {
+		return &cfgmsg.ConfigResponse{
+			Response: cfgmsg.ConfigResponse_NOCMD,
+			CmdID:    in.CmdID,
+		}, nil
+	}
+	delete(f.queued, in.CmdID)
+	return &cfgmsg.ConfigResponse{
+		Response: cfgmsg.ConfigResponse_OK,
+		CmdID:    in.CmdID,
+		Value:    fmt.Sprintf("%d", in.CmdID),
+	}, nil
+}
+
+func (f *fakeFrontEnd) Cancel(ctx context.Context, in *rpc.CfgCmdID,
+	opts ...grpc.CallOption) (*cfgmsg.ConfigResponse, error) {
+	return nil, cfgapi.ErrNotSupp
+}
+
+func (f *fakeFrontEnd) Monitor(ctx context.Context, in *rpc.CfgFrontEndMonitor,
+	opts ...grpc.CallOption) (rpc.ConfigFrontEnd_MonitorClient, error) {
+	return &fakeMonitorStream{ctx: ctx, updates: f.updates}, nil
+}
+
+func (s *fakeMonitorStream) Recv() (*rpc.CfgFrontEndUpdate, error) {
+	select {
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	case u, ok := <-s.updates:
+		if !ok {
+			return nil, io.EOF
+		}
+		return u, nil
+	}
+}
+
+func testUpdate(prop string, t rpc.CfgUpdate_Type) *rpc.CfgFrontEndUpdate {
+	return &rpc.CfgFrontEndUpdate{
+		Updates: []*rpc.CfgUpdate{
+			{Type: t, Property: prop, Value: "1"},
+		},
+	}
+}
+
+func newTestConfigd(f *fakeFrontEnd) *Configd {
+	return &Configd{
+		sender:  "clcfg-test",
+		uuid:    "00000000-0000-0000-0000-000000000001",
+		client:  f,
+		timeout: 10 * time.Second,
+		level:   cfgapi.AccessUser,
+	}
+}
+
+func TestConcurrentWait(t *testing.T) {
+	assert := require.New(t)
+	f := newFakeFrontEnd()
+	c := newTestConfigd(f)
+
+	hdl := c.Execute(nil, []cfgapi.PropertyOp{
+		{Op: cfgapi.PropSet, Name: "@/test", Value: "1"},
+	})
+
+	// Every waiter sees the same result, but only one of them needs to
+	// ask cl.configd for it.
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	results := make(chan string, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rval, err := hdl.Wait(nil)
+			if err != nil {
+				errs <- err
+			}
+			results <- rval
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	close(results)
+	for err := range errs {
+		assert.NoError(err)
+	}
+	for r := range results {
+		assert.Equal("1", r)
+	}
+	assert.Equal(1, f.statuses)
+}
+
+func TestConcurrentConfigd(t *testing.T) {
+	const workers = 8
+	const iters = 50
+
+	assert := require.New(t)
+	f := newFakeFrontEnd()
+	c := newTestConfigd(f)
+	hdl := cfgapi.NewHandle(c)
+	errs := make(chan error, 3*workers*iters)
+
+	var changes, deletes, nested int64
+	onChange := func([]string, string, *time.Time) {
+		atomic.AddInt64(&changes, 1)
+	}
+	onDelete := func([]string) {
+		atomic.AddInt64(&deletes, 1)
+	}
+
+	// Registering a handler from within a handler mustn't deadlock
+	var once sync.Once
+	err := hdl.HandleChange(`^@/test/`, func([]string, string, *time.Time) {
+		once.Do(func() {
+			err := hdl.HandleChange(`^@/test/`,
+				func([]string, string, *time.Time) {
+					atomic.AddInt64(&nested, 1)
+				})
+			if err != nil {
+				errs <- err
+			}
+		})
+	})
+	assert.NoError(err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(3)
+
+		// Register handlers while updates are being delivered
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iters; j++ {
+				if err := hdl.HandleChange(`^@/test/`, onChange); err != nil {
+					errs <- err
+				}
+				if err := hdl.HandleDelete(`^@/test/`, onDelete); err != nil {
+					errs <- err
+				}
+			}
+		}()
+
+		// Deliver updates
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < iters; j++ {
+				prop := fmt.Sprintf("@/test/%d/%d", i, j)
+				f.updates <- testUpdate(prop, rpc.CfgUpdate_UPDATE)
+				f.updates <- testUpdate(prop, rpc.CfgUpdate_DELETE)
+			}
+		}(i)
+
+		// Submit commands, and wait for them to complete
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iters; j++ {
+				if err := hdl.SetProp("@/test/x", "1", nil); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The monitor delivers updates one at a time, so once it has accepted
+	// an update, it has finished delivering all of the earlier ones.
+	settle := func() {
+		f.updates <- testUpdate("@/other", rpc.CfgUpdate_UPDATE)
+		f.updates <- testUpdate("@/other", rpc.CfgUpdate_UPDATE)
+	}
+	settle()
+	close(errs)
+	for err := range errs {
+		assert.NoError(err)
+	}
+	assert.True(atomic.LoadInt64(&nested) > 0)
+
+	// Now that registration has finished, every handler sees each update
+	beforeChanges := atomic.LoadInt64(&changes)
+	beforeDeletes := atomic.LoadInt64(&deletes)
+	f.updates <- testUpdate("@/test/final", rpc.CfgUpdate_UPDATE)
+	f.updates <- testUpdate("@/test/final", rpc.CfgUpdate_DELETE)
+	settle()
+	assert.Equal(beforeChanges+workers*iters, atomic.LoadInt64(&changes))
+	assert.Equal(beforeDeletes+workers*iters, atomic.LoadInt64(&deletes))
+
+	// When the stream ends, the monitor cleans up after itself
+	close(f.updates)
+	assert.Eventually(func() bool {
+		c.Lock()
+		defer c.Unlock()
+		return c.monState == nil
+	}, time.Second, 10*time.Millisecond)
+}
@@ -32,6 +32,8 @@ type delexpMatch struct {
 	handler func([]string)
 }
 
+// monitorState tracks the registered event handlers, and the goroutine
+// delivering events to them.  It is protected by the Configd's mutex.
 type monitorState struct {
 	changeHandlers []changeMatch
 	deleteHandlers []delexpMatch
@@ -40,30 +42,38 @@ type monitorState struct {
 	cancelFunc context.CancelFunc
 }
 
-func (c *Configd) monitorClose() {
+func (c *Configd) monitorClose(m *monitorState) {
 	c.Lock()
 	defer c.Unlock()
-	if c.monState != nil {
-		c.monState.cancelFunc()
+	m.cancelFunc()
+	if c.monState == m {
 		c.monState = nil
 	}
 }
 
-func (c *Configd) monitor() {
-	defer c.monitorClose()
+// handlers returns the handlers registered so far.  The handler slices are
+// only ever appended to, so the caller may iterate over them without holding
+// the lock, while other goroutines register new handlers.
+func (c *Configd) handlers(m *monitorState) ([]changeMatch, []delexpMatch) {
+	c.Lock()
+	defer c.Unlock()
+	return m.changeHandlers, m.deleteHandlers
+}
+
+func (c *Configd) monitor(m *monitorState) {
+	defer c.monitorClose(m)
 
 	monitorCmd := &rpc.CfgFrontEndMonitor{
 		Time:     ptypes.TimestampNow(),
 		SiteUUID: c.uuid,
 	}
 
-	stream, err := c.client.Monitor(c.monState.ctx, monitorCmd)
+	stream, err := c.client.Monitor(m.ctx, monitorCmd)
 	if err != nil {
 		log.Printf("Failed to make MonitorStream: %v", err)
 		return
 	}
 
-	m := c.monState
 	for {
 		resp, rerr := stream.Recv()
 		if rerr != nil {
@@ -75,12 +85,13 @@ func (c *Configd) monitor() {
 			log.Printf("FetchStream() failed: %s\n", resp.Errmsg)
 		}
 
+		changeHandlers, deleteHandlers := c.handlers(m)
 		for _, u := range resp.Updates {
 			prop := u.GetProperty()
 			path := strings.Split(prop, "/")
 			switch u.Type {
 			case rpc.CfgUpdate_UPDATE:
-				for _, h := range m.changeHandlers {
+				for _, h := range changeHandlers {
 					if h.match.MatchString(prop) {
 						var exp *time.Time
 
@@ -93,7 +104,7 @@ func (c *Configd) monitor() {
 					}
 				}
 			case rpc.CfgUpdate_DELETE:
-				for _, h := range m.deleteHandlers {
+				for _, h := range deleteHandlers {
 					if h.match.MatchString(prop) {
 						h.handler(path)
 
@@ -104,10 +115,16 @@ func (c *Configd) monitor() {
 	}
 }
 
-func (c *Configd) handleCommon(path string) (re *regexp.Regexp, err error) {
-	re, err = regexp.Compile(path)
-	if err == nil && c.monState == nil {
+// handleCommon compiles the path, and returns the monitor state to which the
+// new handler should be added, starting the monitor if it isn't already
+// running.  It must be called with the lock held.
+func (c *Configd) handleCommon(path string) (*regexp.Regexp, *monitorState, error) {
+	re, err := regexp.Compile(path)
+	if err != nil {
+		return nil, nil, err
+	}
 
+	if c.monState == nil {
 		ctx, cancelFunc := context.WithCancel(context.Background())
 		c.monState = &monitorState{
 			changeHandlers: make([]changeMatch, 0),
@@ -115,9 +132,9 @@ func (c *Configd) handleCommon(path string) (re *regexp.Regexp, err error) {
 			ctx:            ctx,
 			cancelFunc:     cancelFunc,
 		}
-		go c.monitor()
+		go c.monitor(c.monState)
 	}
-	return re, err
+	return re, c.monState, nil
 }
 
 // HandleChange registers a callback function for property change events
@@ -127,10 +144,8 @@ func (c *Configd) HandleChange(path string, handler func([]string, string,
 	c.Lock()
 	defer c.Unlock()
 
-	re, err := c.handleCommon(path)
+	re, m, err := c.handleCommon(path)
 	if err == nil {
-		m := c.monState
-
 		match := changeMatch{
 			match:   re,
 			handler: handler,
@@ -142,9 +157,11 @@ func (c *Configd) HandleChange(path string, handler func([]string, string,
 
 // HandleDelete registers a callback function for property delete events
 func (c *Configd) HandleDelete(path string, handler func([]string)) error {
-	re, err := c.handleCommon(path)
+	c.Lock()
+	defer c.Unlock()
+
+	re, m, err := c.handleCommon(path)
 	if err == nil {
-		m := c.monState
 		match := delexpMatch{
 			match:   re,
 			handler: handler,
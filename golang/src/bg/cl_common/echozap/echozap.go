@@ -301,6 +301,18 @@ type stackTracer interface {
 // Logger is an echo middleware that logs requests using a zap logger.  It is
 // based on the LoggerWithConfig middleware bundled with echo.
 func Logger(log *zap.Logger, requestedFields []Field) echo.MiddlewareFunc {
+	return RedactingLogger(log, requestedFields, nil)
+}
+
+// URIRedactor returns the URI of a request as it should appear in the logs.
+type URIRedactor func(req *http.Request) string
+
+// RedactingLogger is like Logger, but the request URI is passed through redact
+// before it is logged, both in the message and in the "uri" field, so that
+// secrets carried in the URI can be kept out of the logs.
+func RedactingLogger(log *zap.Logger, requestedFields []Field,
+	redact URIRedactor) echo.MiddlewareFunc {
+
 	if len(requestedFields) == 0 {
 		requestedFields = DefaultFields
 	}
@@ -316,6 +328,12 @@ func Logger(log *zap.Logger, requestedFields []Field) echo.MiddlewareFunc {
 
 			req := c.Request()
 			res := c.Response()
+			if redact != nil {
+				// Only the copy which is logged is altered
+				logged := *req
+				logged.RequestURI = redact(req)
+				req = &logged
+			}
 
 			fields := make([]zap.Field, 0, len(requestedFields))
 
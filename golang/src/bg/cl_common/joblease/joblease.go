@@ -0,0 +1,137 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// Package joblease keeps periodic cloud maintenance jobs from running
+// concurrently, on one host or several, using the job leases in the appliance
+// database.  A job acquires its lease before it starts, and the lease is
+// renewed in the background until the job releases it.  If the job's process
+// dies, the lease expires on its own, and the next run can take it.
+package joblease
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"bg/cloud_models/appliancedb"
+
+	"go.uber.org/zap"
+)
+
+// Lease is a job lease held by this process
+type Lease struct {
+	db     appliancedb.DataStore
+	job    string
+	holder string
+	ttl    time.Duration
+	log    *zap.SugaredLogger
+
+	expires time.Time
+	lost    chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+// DefaultHolder identifies this process as a lease holder, by host and pid
+func DefaultHolder() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// Acquire acquires the named job's lease for this process, for the given time.
+// Until the lease is released, it is renewed every third of that time.  If
+// another process holds the lease, appliancedb.JobLeaseHeldError is returned.
+func Acquire(ctx context.Context, db appliancedb.DataStore, job string,
+	ttl time.Duration, log *zap.SugaredLogger) (*Lease, error) {
+
+	holder := DefaultHolder()
+	dbLease, err := db.AcquireJobLease(ctx, job, holder, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Lease{
+		db:      db,
+		job:     job,
+		holder:  holder,
+		ttl:     ttl,
+		log:     log.With("job", job, "holder", holder),
+		expires: dbLease.ExpiresAt,
+		lost:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	l.log.Infof("acquired job lease until %s",
+		l.expires.Format(time.RFC3339))
+
+	l.wg.Add(1)
+	go l.renewLoop()
+	return l, nil
+}
+
+// Lost returns a channel which is closed if the lease can't be renewed.  The
+// job should then stop, since another process may take the lease over.
+func (l *Lease) Lost() <-chan struct{} {
+	return l.lost
+}
+
+func (l *Lease) renewLoop() {
+	defer l.wg.Done()
+
+	t := time.NewTicker(l.ttl / 3)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-t.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), l.ttl/3)
+		dbLease, err := l.db.RenewJobLease(ctx, l.job, l.holder, l.ttl)
+		cancel()
+		if err == nil {
+			l.expires = dbLease.ExpiresAt
+			continue
+		}
+
+		// If the database is briefly unreachable, we still hold the
+		// lease until it expires, and can keep trying until then.
+		var nfErr appliancedb.NotFoundError
+		if errors.As(err, &nfErr) || !time.Now().Before(l.expires) {
+			l.log.Errorw("lost job lease", "error", err)
+			close(l.lost)
+			return
+		}
+		l.log.Warnw("failed to renew job lease", "error", err)
+	}
+}
+
+// Release stops renewing the lease, and gives it up so that another process
+// may acquire it right away.  It may be called more than once.
+func (l *Lease) Release(ctx context.Context) error {
+	var err error
+
+	l.once.Do(func() {
+		close(l.done)
+		l.wg.Wait()
+		err = l.db.ReleaseJobLease(ctx, l.job, l.holder)
+		if err == nil {
+			l.log.Infof("released job lease")
+		}
+	})
+	return err
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package joblease
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"bg/cloud_models/appliancedb"
+	"bg/cloud_models/appliancedb/mocks"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+const testTTL = 60 * time.Millisecond
+
+func mkLease(ttl time.Duration) *appliancedb.JobLease {
+	now := time.Now()
+	return &appliancedb.JobLease{
+		JobName:    "job",
+		Holder:     DefaultHolder(),
+		AcquiredAt: now,
+		RenewedAt:  now,
+		ExpiresAt:  now.Add(ttl),
+	}
+}
+
+func TestAcquireRenewRelease(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	holder := DefaultHolder()
+
+	dMock := &mocks.DataStore{}
+	dMock.On("AcquireJobLease", mock.Anything, "job", holder, testTTL).
+		Return(mkLease(testTTL), nil).Once()
+	dMock.On("RenewJobLease", mock.Anything, "job", holder, testTTL).
+		Return(func(context.Context, string, string, time.Duration) *appliancedb.JobLease {
+			return mkLease(testTTL)
+		}, nil)
+	dMock.On("ReleaseJobLease", mock.Anything, "job", holder).
+		Return(nil).Once()
+	defer dMock.AssertExpectations(t)
+
+	l, err := Acquire(ctx, dMock, "job", testTTL, zaptest.NewLogger(t).Sugar())
+	assert.NoError(err)
+
+	// Hold the lease across several TTLs; it must be kept alive
+	select {
+	case <-l.Lost():
+		t.Fatalf("lease lost")
+	case <-time.After(3 * testTTL):
+	}
+	dMock.AssertCalled(t, "RenewJobLease", mock.Anything, "job", holder,
+		testTTL)
+
+	assert.NoError(l.Release(ctx))
+	assert.NoError(l.Release(ctx))
+
+	// No renewals after the release
+	calls := len(dMock.Calls)
+	time.Sleep(testTTL)
+	assert.Len(dMock.Calls, calls)
+}
+
+func TestAcquireHeld(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+
+	heldErr := appliancedb.JobLeaseHeldError{
+		JobName:   "job",
+		Holder:    "elsewhere:1",
+		ExpiresAt: time.Now().Add(time.Minute),
+	}
+	dMock := &mocks.DataStore{}
+	dMock.On("AcquireJobLease", mock.Anything, "job", mock.Anything,
+		testTTL).Return(nil, heldErr).Once()
+	defer dMock.AssertExpectations(t)
+
+	l, err := Acquire(ctx, dMock, "job", testTTL, zaptest.NewLogger(t).Sugar())
+	assert.Nil(l)
+	assert.Equal(heldErr, err)
+}
+
+func TestLeaseLost(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+
+	// Someone else took the lease over
+	dMock := &mocks.DataStore{}
+	dMock.On("AcquireJobLease", mock.Anything, "job", mock.Anything,
+		testTTL).Return(mkLease(testTTL), nil).Once()
+	dMock.On("RenewJobLease", mock.Anything, "job", mock.Anything,
+		testTTL).Return(nil, appliancedb.NotFoundError{}).Once()
+	dMock.On("ReleaseJobLease", mock.Anything, "job", mock.Anything).
+		Return(nil).Once()
+	defer dMock.AssertExpectations(t)
+
+	l, err := Acquire(ctx, dMock, "job", testTTL, zaptest.NewLogger(t).Sugar())
+	assert.NoError(err)
+	select {
+	case <-l.Lost():
+	case <-time.After(3 * testTTL):
+		t.Fatalf("lease not lost")
+	}
+	assert.NoError(l.Release(ctx))
+}
+
+func TestLeaseUnreachable(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+
+	// Transient failures are tolerated until the lease expires
+	acquired := mkLease(testTTL)
+	dMock := &mocks.DataStore{}
+	dMock.On("AcquireJobLease", mock.Anything, "job", mock.Anything,
+		testTTL).Return(acquired, nil).Once()
+	dMock.On("RenewJobLease", mock.Anything, "job", mock.Anything,
+		testTTL).Return(nil, errors.New("connection refused"))
+	dMock.On("ReleaseJobLease", mock.Anything, "job", mock.Anything).
+		Return(nil).Once()
+	defer dMock.AssertExpectations(t)
+
+	l, err := Acquire(ctx, dMock, "job", testTTL, zaptest.NewLogger(t).Sugar())
+	assert.NoError(err)
+	select {
+	case <-l.Lost():
+		assert.False(time.Now().Before(acquired.ExpiresAt))
+	case <-time.After(5 * testTTL):
+		t.Fatalf("lease not lost")
+	}
+	assert.NoError(l.Release(ctx))
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package push
+
+import (
+	"context"
+
+	"bg/cloud_models/appliancedb"
+
+	"go.uber.org/zap"
+)
+
+// stubProvider stands in for a real push platform: it logs the notifications
+// it is asked to send, and drops them.
+//
+// XXX: replace with real FCM and APNs clients once we have credentials for
+// them.
+type stubProvider struct {
+	name string
+	log  *zap.SugaredLogger
+}
+
+func (p *stubProvider) Send(ctx context.Context, token string, n *Notification) error {
+	p.log.Infow("dropping push notification", "provider", p.name,
+		"title", n.Title)
+	return nil
+}
+
+// NewFCMProvider returns a Provider for Firebase Cloud Messaging, used for
+// Android devices.
+func NewFCMProvider(log *zap.SugaredLogger) Provider {
+	return &stubProvider{name: "fcm", log: log}
+}
+
+// NewAPNsProvider returns a Provider for the Apple Push Notification service,
+// used for iOS devices.
+func NewAPNsProvider(log *zap.SugaredLogger) Provider {
+	return &stubProvider{name: "apns", log: log}
+}
+
+// DefaultProviders returns the Providers for each of the platforms we support
+func DefaultProviders(log *zap.SugaredLogger) map[string]Provider {
+	return map[string]Provider{
+		appliancedb.PushPlatformAndroid: NewFCMProvider(log),
+		appliancedb.PushPlatformIOS:     NewAPNsProvider(log),
+	}
+}
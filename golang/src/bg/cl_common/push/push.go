@@ -0,0 +1,186 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// Package push delivers notifications to the mobile devices which the
+// recipients' accounts have registered for push notifications.
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"bg/cloud_models/appliancedb"
+
+	"github.com/satori/uuid"
+	"go.uber.org/zap"
+)
+
+// ErrInvalidToken is returned (possibly wrapped) by a Provider when the push
+// platform reports that a token is no longer valid, e.g., because the app was
+// uninstalled.
+var ErrInvalidToken = errors.New("invalid push token")
+
+// Notification is the payload of a push notification
+type Notification struct {
+	Title string
+	Body  string
+	Data  map[string]string
+}
+
+// Provider delivers notifications through a single push platform
+type Provider interface {
+	Send(ctx context.Context, token string, n *Notification) error
+}
+
+// Result summarizes the outcome of a call to Dispatch
+type Result struct {
+	Sent     int // notifications accepted by the provider
+	Disabled int // tokens disabled because the provider reported them invalid
+	Failed   int // notifications which couldn't be sent
+}
+
+// Dispatcher fans notifications out to the active push tokens of a set of
+// accounts, using the Provider for each token's platform.
+type Dispatcher struct {
+	db        appliancedb.DataStore
+	providers map[string]Provider
+	log       *zap.SugaredLogger
+}
+
+// NewDispatcher returns a Dispatcher which sends notifications through the
+// given providers, indexed by platform (appliancedb.PushPlatformIOS, etc.).
+func NewDispatcher(db appliancedb.DataStore, providers map[string]Provider,
+	log *zap.SugaredLogger) *Dispatcher {
+
+	return &Dispatcher{
+		db:        db,
+		providers: providers,
+		log:       log,
+	}
+}
+
+func (d *Dispatcher) send(ctx context.Context, tok *appliancedb.PushToken,
+	n *Notification, res *Result) error {
+
+	slog := d.log.With("account_uuid", tok.AccountUUID,
+		"platform", tok.Platform)
+
+	provider := d.providers[tok.Platform]
+	if provider == nil {
+		slog.Warnf("no push provider for platform")
+		res.Failed++
+		return nil
+	}
+
+	err := provider.Send(ctx, tok.Token, n)
+	if errors.Is(err, ErrInvalidToken) {
+		slog.Infof("disabling invalid push token")
+		res.Disabled++
+		return d.db.DisablePushToken(ctx, tok)
+	} else if err != nil {
+		slog.Warnf("push notification failed: %v", err)
+		res.Failed++
+		return nil
+	}
+	res.Sent++
+	return nil
+}
+
+// Dispatch sends a notification to every active push token belonging to the
+// given accounts, skipping accounts which have push notifications turned off.
+// A failure to deliver to one token doesn't affect the others; tokens which
+// the provider reports as invalid are disabled.  The returned error reflects
+// failures to access the database, in which case the Result covers the
+// accounts which were processed.
+func (d *Dispatcher) Dispatch(ctx context.Context, accounts []uuid.UUID,
+	n *Notification) (Result, error) {
+
+	var res Result
+	var rerr error
+
+	for _, acct := range accounts {
+		prefs, err := d.db.NotificationPrefsByAccount(ctx, acct)
+		if err != nil {
+			rerr = fmt.Errorf("notification prefs for %v: %w", acct, err)
+			continue
+		}
+		if !prefs.PushEnabled {
+			continue
+		}
+
+		toks, err := d.db.ActivePushTokensByAccount(ctx, acct)
+		if err != nil {
+			rerr = fmt.Errorf("push tokens for %v: %w", acct, err)
+			continue
+		}
+		for i := range toks {
+			err = d.send(ctx, &toks[i], n, &res)
+			if err != nil {
+				rerr = fmt.Errorf("disabling push token for %v: %w",
+					acct, err)
+			}
+		}
+	}
+	return res, rerr
+}
+
+// DispatchTemplate renders the named notification template for each of the
+// given accounts in its own locale (see appliancedb.RenderNotification), and
+// sends the result to the account's active push tokens.  The template is
+// rendered once per locale, so accounts sharing a locale receive the same
+// notification.  Failures are handled as for Dispatch; an account whose
+// notification can't be rendered is skipped, and the failure reported.
+func (d *Dispatcher) DispatchTemplate(ctx context.Context,
+	accounts []appliancedb.Account, name string, vars map[string]string,
+	data map[string]string) (Result, error) {
+
+	var res Result
+	var rerr error
+
+	byLocale := make(map[string][]uuid.UUID)
+	locales := make([]string, 0)
+	for _, acct := range accounts {
+		if _, ok := byLocale[acct.Locale]; !ok {
+			locales = append(locales, acct.Locale)
+		}
+		byLocale[acct.Locale] = append(byLocale[acct.Locale], acct.UUID)
+	}
+
+	for _, locale := range locales {
+		r, err := appliancedb.RenderNotification(ctx, d.db, name, locale,
+			vars)
+		if err != nil {
+			rerr = fmt.Errorf("rendering %s for %q: %w", name, locale,
+				err)
+			continue
+		}
+		n := &Notification{
+			Title: r.Subject,
+			Body:  r.Body,
+			Data:  data,
+		}
+		lres, err := d.Dispatch(ctx, byLocale[locale], n)
+		res.Sent += lres.Sent
+		res.Disabled += lres.Disabled
+		res.Failed += lres.Failed
+		if err != nil {
+			rerr = err
+		}
+	}
+	return res, rerr
+}
+
+// Prune deletes the push tokens which haven't been refreshed within
+// appliancedb.PushTokenMaxAge, returning the number deleted.
+func (d *Dispatcher) Prune(ctx context.Context) (int64, error) {
+	return d.db.PrunePushTokens(ctx,
+		time.Now().Add(-appliancedb.PushTokenMaxAge))
+}
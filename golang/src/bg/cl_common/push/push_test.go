@@ -0,0 +1,245 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"bg/cloud_models/appliancedb"
+	"bg/cloud_models/appliancedb/mocks"
+
+	"github.com/satori/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+var (
+	account1 = uuid.Must(uuid.FromString("20000000-0000-0000-0000-000000000001"))
+	account2 = uuid.Must(uuid.FromString("20000000-0000-0000-0000-000000000002"))
+	account3 = uuid.Must(uuid.FromString("20000000-0000-0000-0000-000000000003"))
+	account4 = uuid.Must(uuid.FromString("20000000-0000-0000-0000-000000000004"))
+)
+
+// recordingProvider records the tokens it is asked to send to, and what it sent
+// to each, and fails the sends to the tokens in its errors map.
+type recordingProvider struct {
+	sent     []string
+	received map[string]*Notification
+	errors   map[string]error
+}
+
+func (p *recordingProvider) Send(ctx context.Context, token string, n *Notification) error {
+	if err := p.errors[token]; err != nil {
+		return err
+	}
+	p.sent = append(p.sent, token)
+	p.received[token] = n
+	return nil
+}
+
+func mkToken(account uuid.UUID, platform, token string) appliancedb.PushToken {
+	return appliancedb.PushToken{
+		AccountUUID: account,
+		Platform:    platform,
+		Token:       token,
+	}
+}
+
+func mkPrefs(account uuid.UUID, enabled bool) *appliancedb.NotificationPrefs {
+	return &appliancedb.NotificationPrefs{
+		AccountUUID: account,
+		PushEnabled: enabled,
+	}
+}
+
+func setupDispatcher(t *testing.T, dMock *mocks.DataStore) (*Dispatcher, *recordingProvider, *recordingProvider) {
+	ios := &recordingProvider{
+		received: make(map[string]*Notification),
+		errors:   make(map[string]error),
+	}
+	android := &recordingProvider{
+		received: make(map[string]*Notification),
+		errors:   make(map[string]error),
+	}
+	providers := map[string]Provider{
+		appliancedb.PushPlatformIOS:     ios,
+		appliancedb.PushPlatformAndroid: android,
+	}
+	d := NewDispatcher(dMock, providers, zaptest.NewLogger(t).Sugar())
+	return d, ios, android
+}
+
+func TestDispatchInvalidToken(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+
+	toks := []appliancedb.PushToken{
+		mkToken(account1, appliancedb.PushPlatformIOS, "ios-good"),
+		mkToken(account1, appliancedb.PushPlatformIOS, "ios-stale"),
+		mkToken(account1, appliancedb.PushPlatformAndroid, "android-good"),
+		mkToken(account1, appliancedb.PushPlatformAndroid, "android-flaky"),
+	}
+	dMock := &mocks.DataStore{}
+	dMock.On("NotificationPrefsByAccount", mock.Anything, account1).Return(
+		mkPrefs(account1, true), nil)
+	dMock.On("ActivePushTokensByAccount", mock.Anything, account1).Return(
+		toks, nil)
+	dMock.On("DisablePushToken", mock.Anything, mock.MatchedBy(
+		func(tok *appliancedb.PushToken) bool {
+			return tok.Token == "ios-stale"
+		})).Return(nil).Once()
+	defer dMock.AssertExpectations(t)
+
+	d, ios, android := setupDispatcher(t, dMock)
+	ios.errors["ios-stale"] = fmt.Errorf("apns: %w", ErrInvalidToken)
+	android.errors["android-flaky"] = errors.New("service unavailable")
+
+	// A token reported invalid is disabled; a transient failure leaves the
+	// token alone.  Neither stops delivery to the other tokens.
+	res, err := d.Dispatch(ctx, []uuid.UUID{account1}, &Notification{
+		Title: "test",
+	})
+	assert.NoError(err)
+	assert.Equal(Result{Sent: 2, Disabled: 1, Failed: 1}, res)
+	assert.Equal([]string{"ios-good"}, ios.sent)
+	assert.Equal([]string{"android-good"}, android.sent)
+}
+
+func TestDispatchPrefsGating(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+
+	dMock := &mocks.DataStore{}
+	dMock.On("NotificationPrefsByAccount", mock.Anything, account1).Return(
+		mkPrefs(account1, true), nil)
+	dMock.On("NotificationPrefsByAccount", mock.Anything, account2).Return(
+		mkPrefs(account2, false), nil)
+	dMock.On("ActivePushTokensByAccount", mock.Anything, account1).Return(
+		[]appliancedb.PushToken{
+			mkToken(account1, appliancedb.PushPlatformIOS, "ios-1"),
+		}, nil)
+	defer dMock.AssertExpectations(t)
+
+	d, ios, android := setupDispatcher(t, dMock)
+
+	// account2 has push notifications turned off, so its tokens aren't
+	// even looked up.
+	res, err := d.Dispatch(ctx, []uuid.UUID{account1, account2},
+		&Notification{Title: "test"})
+	assert.NoError(err)
+	assert.Equal(Result{Sent: 1}, res)
+	assert.Equal([]string{"ios-1"}, ios.sent)
+	assert.Empty(android.sent)
+	dMock.AssertNotCalled(t, "ActivePushTokensByAccount", mock.Anything,
+		account2)
+}
+
+func TestDispatchDBError(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+
+	dMock := &mocks.DataStore{}
+	dMock.On("NotificationPrefsByAccount", mock.Anything, account1).Return(
+		nil, errors.New("database unavailable"))
+	dMock.On("NotificationPrefsByAccount", mock.Anything, account2).Return(
+		mkPrefs(account2, true), nil)
+	dMock.On("ActivePushTokensByAccount", mock.Anything, account2).Return(
+		[]appliancedb.PushToken{
+			mkToken(account2, appliancedb.PushPlatformAndroid, "android-2"),
+		}, nil)
+	defer dMock.AssertExpectations(t)
+
+	d, _, android := setupDispatcher(t, dMock)
+
+	// A failure for one account doesn't keep the others from being
+	// notified, but is reported.
+	res, err := d.Dispatch(ctx, []uuid.UUID{account1, account2},
+		&Notification{Title: "test"})
+	assert.Error(err)
+	assert.Equal(Result{Sent: 1}, res)
+	assert.Equal([]string{"android-2"}, android.sent)
+}
+
+func mkTemplate(locale, subject, body string) *appliancedb.NotificationTemplate {
+	return &appliancedb.NotificationTemplate{
+		Name:    "alert",
+		Locale:  locale,
+		Subject: subject,
+		Body:    body,
+	}
+}
+
+func TestDispatchTemplateLocales(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+
+	accounts := []appliancedb.Account{
+		{UUID: account1, Locale: "en-US"},
+		{UUID: account2, Locale: "de-DE"},
+		{UUID: account3, Locale: "fr-FR"},
+		{UUID: account4, Locale: "de-DE"},
+	}
+	notFound := appliancedb.NotFoundError{}
+
+	dMock := &mocks.DataStore{}
+	for i, acct := range accounts {
+		dMock.On("NotificationPrefsByAccount", mock.Anything, acct.UUID).Return(
+			mkPrefs(acct.UUID, true), nil)
+		tok := mkToken(acct.UUID, appliancedb.PushPlatformIOS,
+			fmt.Sprintf("ios-%d", i+1))
+		dMock.On("ActivePushTokensByAccount", mock.Anything, acct.UUID).Return(
+			[]appliancedb.PushToken{tok}, nil)
+	}
+	// There's a German translation, but no French one
+	dMock.On("NotificationTemplate", mock.Anything, "alert", "en-US").Return(
+		mkTemplate("en-US", "Alert at {site}", "{message}"), nil)
+	dMock.On("NotificationTemplate", mock.Anything, "alert", "de-DE").Return(
+		nil, notFound)
+	dMock.On("NotificationTemplate", mock.Anything, "alert", "de").Return(
+		mkTemplate("de", "Alarm bei {site}", "{message}"), nil)
+	dMock.On("NotificationTemplate", mock.Anything, "alert", "fr-FR").Return(
+		nil, notFound)
+	dMock.On("NotificationTemplate", mock.Anything, "alert", "fr").Return(
+		nil, notFound)
+	dMock.On("NotificationTemplate", mock.Anything, "missing", mock.Anything).Return(
+		nil, notFound)
+	defer dMock.AssertExpectations(t)
+
+	d, ios, _ := setupDispatcher(t, dMock)
+
+	// One event fans out to each recipient in their own language
+	vars := map[string]string{"site": "Scranton", "message": "BAD_RING"}
+	data := map[string]string{"reason": "BAD_RING"}
+	res, err := d.DispatchTemplate(ctx, accounts, "alert", vars, data)
+	assert.NoError(err)
+	assert.Equal(Result{Sent: 4}, res)
+	assert.Equal([]string{"ios-1", "ios-2", "ios-4", "ios-3"}, ios.sent)
+	assert.Equal(&Notification{"Alert at Scranton", "BAD_RING", data},
+		ios.received["ios-1"])
+	assert.Equal(&Notification{"Alarm bei Scranton", "BAD_RING", data},
+		ios.received["ios-2"])
+	assert.Equal(&Notification{"Alert at Scranton", "BAD_RING", data},
+		ios.received["ios-3"])
+	assert.Equal(ios.received["ios-2"], ios.received["ios-4"])
+
+	// Each locale is rendered only once: en-US; de-DE, de; fr-FR, fr, en-US
+	dMock.AssertNumberOfCalls(t, "NotificationTemplate", 6)
+
+	// Nothing is sent if the notification can't be rendered
+	ios.sent = nil
+	res, err = d.DispatchTemplate(ctx, accounts, "missing", vars, data)
+	assert.Error(err)
+	assert.Equal(Result{}, res)
+	assert.Empty(ios.sent)
+}
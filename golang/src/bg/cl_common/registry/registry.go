@@ -172,6 +172,24 @@ func DeleteOAuth2OrganizationRule(ctx context.Context, db appliancedb.DataStore,
 	return rule, nil
 }
 
+// OAuth2OrganizationRuleImpact looks up an oauth2_organization_rule in the
+// registry, and returns it along with the accounts which depend upon it to map
+// them to their organization.
+func OAuth2OrganizationRuleImpact(ctx context.Context, db appliancedb.DataStore,
+	provider string, ruleType appliancedb.OAuth2OrgRuleType,
+	ruleValue string) (*appliancedb.OAuth2OrganizationRule, []appliancedb.Account, error) {
+
+	rule, err := db.OAuth2OrganizationRuleTest(ctx, provider, ruleType, ruleValue)
+	if err != nil {
+		return nil, nil, err
+	}
+	accts, err := db.OAuth2OrganizationRuleImpact(ctx, rule)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rule, accts, nil
+}
+
 // AccountInformation is a convenience type to return detailed information
 // about a single user account; it includes associated structures Person,
 // Organization, and any OAuth2Identity records.
@@ -32,12 +32,19 @@ type accountManager interface {
 
 	AccountsByOrganization(context.Context, uuid.UUID) ([]Account, error)
 	AccountByUUID(context.Context, uuid.UUID) (*Account, error)
+	AccountByEmail(context.Context, uuid.UUID, string) (*Account, error)
 	InsertAccount(context.Context, *Account) error
 	InsertAccountTx(context.Context, DBX, *Account) error
 	UpdateAccount(context.Context, *Account) error
 	UpdateAccountTx(context.Context, DBX, *Account) error
 	DeleteAccount(context.Context, uuid.UUID) error
 	DeleteAccountTx(context.Context, DBX, uuid.UUID) error
+	MergeAccounts(context.Context, uuid.UUID, uuid.UUID) error
+	MergeAccountsTx(context.Context, DBX, uuid.UUID, uuid.UUID) error
+	DuplicatePrimaryEmails(context.Context) ([]EmailDup, error)
+
+	AccountSetPhoneRegion(region string)
+	NormalizeExistingAccounts(context.Context) (*NormalizeReport, error)
 
 	AccountInfosByOrganization(context.Context, uuid.UUID) ([]AccountInfo, error)
 	AccountInfoByUUID(context.Context, uuid.UUID) (*AccountInfo, error)
@@ -52,8 +59,10 @@ type accountManager interface {
 	AccountOrgRolesByAccount(context.Context, uuid.UUID) ([]AccountOrgRoles, error)
 	AccountOrgRolesByAccountTarget(context.Context, uuid.UUID, uuid.UUID) ([]AccountOrgRoles, error)
 	AccountPrimaryOrgRoles(context.Context, uuid.UUID) ([]string, error)
+	AccountOrgRoleGrantsByAccount(context.Context, uuid.UUID) ([]AccountOrgRole, error)
 	AccountOrgRolesByOrg(context.Context, uuid.UUID, string) ([]AccountOrgRole, error)
 	AccountOrgRolesByOrgTx(context.Context, DBX, uuid.UUID, string) ([]AccountOrgRole, error)
+	AccountsByOrgAndRole(context.Context, uuid.UUID, string) ([]AccountInfo, error)
 	InsertAccountOrgRole(context.Context, *AccountOrgRole) error
 	InsertAccountOrgRoleTx(context.Context, DBX, *AccountOrgRole) error
 	DeleteAccountOrgRole(context.Context, *AccountOrgRole) error
@@ -111,14 +120,21 @@ func (db *ApplianceDB) InsertPerson(ctx context.Context,
 	return db.InsertPersonTx(ctx, nil, person)
 }
 
-// InsertPersonTx inserts a Person, possibly inside a transaction.
+// InsertPersonTx inserts a Person, possibly inside a transaction.  The
+// person's email address is normalized in place; ValidationError is returned if
+// it is malformed.
 func (db *ApplianceDB) InsertPersonTx(ctx context.Context, dbx DBX,
 	person *Person) error {
 
 	if dbx == nil {
 		dbx = db
 	}
-	_, err := dbx.NamedExecContext(ctx,
+	email, err := normalizeEmailField("primary_email", person.PrimaryEmail)
+	if err != nil {
+		return err
+	}
+	person.PrimaryEmail = email
+	_, err = dbx.NamedExecContext(ctx,
 		`INSERT INTO person
 		 (uuid, name, primary_email)
 		 VALUES (:uuid, :name, :primary_email)`, person)
@@ -133,6 +149,7 @@ type Account struct {
 	AvatarHash       []byte    `db:"avatar_hash"`
 	PersonUUID       uuid.UUID `db:"person_uuid"`
 	OrganizationUUID uuid.UUID `db:"organization_uuid"`
+	Locale           string    `db:"locale"`
 }
 
 // AccountsByOrganization returns a list of all accounts for a given organization
@@ -166,23 +183,57 @@ func (db *ApplianceDB) AccountByUUID(ctx context.Context, acctUUID uuid.UUID) (*
 	}
 }
 
+// AccountByEmail returns the Account in the given organization with the given
+// email address.  The address is normalized before the lookup.  Accounts stored
+// before normalization was introduced are only found once
+// NormalizeExistingAccounts has been run.
+func (db *ApplianceDB) AccountByEmail(ctx context.Context, org uuid.UUID, email string) (*Account, error) {
+	norm, err := NormalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	var acct Account
+	err = db.GetContext(ctx, &acct,
+		`SELECT *
+		    FROM account
+		    WHERE organization_uuid=$1 AND email=$2 AND email != ''
+		    ORDER BY uuid
+		    LIMIT 1`, org, norm)
+	switch err {
+	case sql.ErrNoRows:
+		return nil, NotFoundError{fmt.Sprintf(
+			"AccountByEmail: Couldn't find record for %s in %s",
+			norm, org)}
+	case nil:
+		return &acct, nil
+	default:
+		return nil, err
+	}
+}
+
 // InsertAccount inserts a Account
 func (db *ApplianceDB) InsertAccount(ctx context.Context,
 	account *Account) error {
 	return db.InsertAccountTx(ctx, nil, account)
 }
 
-// InsertAccountTx inserts a Account, possibly inside a transaction.
+// InsertAccountTx inserts a Account, possibly inside a transaction.  The
+// account's email address, phone number, and locale are normalized in place;
+// ValidationError is returned if any is malformed.  An empty locale is stored
+// as DefaultLocale.
 func (db *ApplianceDB) InsertAccountTx(ctx context.Context, dbx DBX,
 	account *Account) error {
 
 	if dbx == nil {
 		dbx = db
 	}
+	if err := db.normalizeAccount(account, nil); err != nil {
+		return err
+	}
 	_, err := dbx.NamedExecContext(ctx,
 		`INSERT INTO account
-		 (uuid, email, phone_number, avatar_hash, person_uuid, organization_uuid)
-		 VALUES (:uuid, :email, :phone_number, :avatar_hash, :person_uuid, :organization_uuid)`,
+		 (uuid, email, phone_number, avatar_hash, person_uuid, organization_uuid, locale)
+		 VALUES (:uuid, :email, :phone_number, :avatar_hash, :person_uuid, :organization_uuid, :locale)`,
 		account)
 	return err
 }
@@ -194,18 +245,34 @@ func (db *ApplianceDB) UpdateAccount(ctx context.Context,
 }
 
 // UpdateAccountTx updates an Account's modifiable details, possibly inside a transaction.
+// As with InsertAccountTx, the email address, phone number, and locale are
+// normalized in place, but only if they differ from the stored values; a
+// stored value which predates normalization is left as it is.
 func (db *ApplianceDB) UpdateAccountTx(ctx context.Context, dbx DBX,
 	account *Account) error {
 
 	if dbx == nil {
 		dbx = db
 	}
-	_, err := dbx.NamedExecContext(ctx,
+	var stored Account
+	err := dbx.GetContext(ctx, &stored,
+		`SELECT * FROM account WHERE uuid=$1`, account.UUID)
+	switch err {
+	case sql.ErrNoRows:
+		err = db.normalizeAccount(account, nil)
+	case nil:
+		err = db.normalizeAccount(account, &stored)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = dbx.NamedExecContext(ctx,
 		`UPDATE account
 		SET
 		  email=:email,
 		  phone_number=:phone_number,
-		  avatar_hash=:avatar_hash
+		  avatar_hash=:avatar_hash,
+		  locale=:locale
 		WHERE
 		  uuid=:uuid`,
 		account)
@@ -262,6 +329,11 @@ func (db *ApplianceDB) DeleteAccountTx(ctx context.Context, dbx DBX,
 	if err != nil {
 		panic(err)
 	}
+	_, err = dbx.ExecContext(ctx,
+		`DELETE FROM account_invite WHERE accepted_account_uuid=$1`, acctuu)
+	if err != nil {
+		panic(err)
+	}
 	_, err = dbx.ExecContext(ctx,
 		`DELETE FROM account WHERE uuid=$1`, acctuu)
 	if err != nil {
@@ -275,6 +347,183 @@ func (db *ApplianceDB) DeleteAccountTx(ctx context.Context, dbx DBX,
 	return nil
 }
 
+// MergeAccounts folds one account into another, for use when a person has
+// ended up with duplicate accounts.  See MergeAccountsTx.
+func (db *ApplianceDB) MergeAccounts(ctx context.Context,
+	keep, remove uuid.UUID) error {
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := db.MergeAccountsTx(ctx, tx, keep, remove); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MergeAccountsTx folds the 'remove' account into the 'keep' account, as a
+// transaction.  The removed account's OAuth2 identities (and so its logins),
+// roles, and push tokens are transferred to the kept account, and records
+// naming the removed account, such as the invitations it accepted, are updated
+// to name the kept one.  What remains of the removed account, including its
+// person if no other account refers to it, is then deleted.  Both accounts
+// must belong to the same organization.
+func (db *ApplianceDB) MergeAccountsTx(ctx context.Context, dbx DBX,
+	keep, remove uuid.UUID) error {
+
+	if dbx == nil {
+		panic("dbx cannot be nil")
+	}
+	if keep == remove {
+		return ValidationError{
+			Field:  "account",
+			Value:  remove.String(),
+			Reason: "cannot merge an account with itself",
+		}
+	}
+
+	// Lock both rows with a single query, in a consistent order, so that
+	// concurrent merges of the same pair of accounts can't deadlock.
+	var accts []Account
+	err := dbx.SelectContext(ctx, &accts,
+		`SELECT * FROM account WHERE uuid IN ($1, $2) ORDER BY uuid FOR UPDATE`,
+		keep, remove)
+	if err != nil {
+		return err
+	}
+	var keepAcct, removeAcct *Account
+	for i := range accts {
+		if accts[i].UUID == keep {
+			keepAcct = &accts[i]
+		} else {
+			removeAcct = &accts[i]
+		}
+	}
+	if keepAcct == nil {
+		return NotFoundError{fmt.Sprintf(
+			"MergeAccountsTx: Couldn't find record for %s", keep)}
+	}
+	if removeAcct == nil {
+		return NotFoundError{fmt.Sprintf(
+			"MergeAccountsTx: Couldn't find record for %s", remove)}
+	}
+	if keepAcct.OrganizationUUID != removeAcct.OrganizationUUID {
+		return ValidationError{
+			Field: "organization_uuid",
+			Value: removeAcct.OrganizationUUID.String(),
+			Reason: fmt.Sprintf("account %s belongs to organization %s",
+				keep, keepAcct.OrganizationUUID),
+		}
+	}
+
+	stmts := []string{
+		`UPDATE oauth2_identity SET account_uuid = $1
+		 WHERE account_uuid = $2`,
+		`INSERT INTO account_org_role
+		 (account_uuid, organization_uuid, target_organization_uuid, relationship, role)
+		 SELECT $1, organization_uuid, target_organization_uuid, relationship, role
+		 FROM account_org_role
+		 WHERE account_uuid = $2
+		 ON CONFLICT DO NOTHING`,
+		`UPDATE account_push_tokens SET account_uuid = $1
+		 WHERE account_uuid = $2`,
+		`UPDATE guest_enroll_attempt SET account_uuid = $1
+		 WHERE account_uuid = $2`,
+		`UPDATE support_grant SET granted_by = $1 WHERE granted_by = $2`,
+		`UPDATE support_grant SET revoked_by = $1 WHERE revoked_by = $2`,
+		`UPDATE account_invite SET accepted_account_uuid = $1
+		 WHERE accepted_account_uuid = $2`,
+
+		`DELETE FROM account_secrets WHERE account_uuid = $2`,
+		`DELETE FROM account_org_role WHERE account_uuid = $2`,
+		`DELETE FROM account WHERE uuid = $2`,
+	}
+	for _, stmt := range stmts {
+		if _, err := dbx.ExecContext(ctx, stmt, keep, remove); err != nil {
+			return err
+		}
+	}
+
+	_, err = dbx.ExecContext(ctx, `
+		DELETE FROM person
+		WHERE uuid = $1 AND
+		  NOT EXISTS (SELECT 1 FROM account WHERE person_uuid = $1)`,
+		removeAcct.PersonUUID)
+	return err
+}
+
+// EmailDup is a primary email address shared by more than one person, which
+// may mean that one human has been split across organizations.  Accounts and
+// Organizations are those of the persons sharing the address.
+type EmailDup struct {
+	Email         string
+	Persons       []uuid.UUID
+	Accounts      []uuid.UUID
+	Organizations []uuid.UUID
+}
+
+// DuplicatePrimaryEmails returns the primary email addresses, compared without
+// regard to case, which are shared by more than one person, ordered by
+// address.
+func (db *ApplianceDB) DuplicatePrimaryEmails(ctx context.Context) ([]EmailDup, error) {
+	var rows []struct {
+		Email            string        `db:"email"`
+		PersonUUID       uuid.UUID     `db:"person_uuid"`
+		AccountUUID      uuid.NullUUID `db:"account_uuid"`
+		OrganizationUUID uuid.NullUUID `db:"organization_uuid"`
+	}
+	err := db.SelectContext(ctx, &rows, `
+		WITH dups AS (
+		  SELECT lower(trim(primary_email)) AS email
+		  FROM person
+		  WHERE trim(primary_email) != ''
+		  GROUP BY 1
+		  HAVING count(*) > 1
+		) SELECT
+		  dups.email,
+		  p.uuid AS person_uuid,
+		  a.uuid AS account_uuid,
+		  a.organization_uuid
+		FROM dups
+		  JOIN person p ON lower(trim(p.primary_email)) = dups.email
+		  LEFT JOIN account a ON a.person_uuid = p.uuid
+		ORDER BY dups.email, p.uuid, a.uuid`)
+	if err != nil {
+		return nil, err
+	}
+
+	dups := make([]EmailDup, 0)
+	var persons, orgs map[uuid.UUID]bool
+	for _, r := range rows {
+		if len(dups) == 0 || dups[len(dups)-1].Email != r.Email {
+			dups = append(dups, EmailDup{
+				Email:         r.Email,
+				Persons:       make([]uuid.UUID, 0),
+				Accounts:      make([]uuid.UUID, 0),
+				Organizations: make([]uuid.UUID, 0),
+			})
+			persons = make(map[uuid.UUID]bool)
+			orgs = make(map[uuid.UUID]bool)
+		}
+		dup := &dups[len(dups)-1]
+		if !persons[r.PersonUUID] {
+			dup.Persons = append(dup.Persons, r.PersonUUID)
+			persons[r.PersonUUID] = true
+		}
+		if r.AccountUUID.Valid {
+			dup.Accounts = append(dup.Accounts, r.AccountUUID.UUID)
+		}
+		if r.OrganizationUUID.Valid && !orgs[r.OrganizationUUID.UUID] {
+			dup.Organizations = append(dup.Organizations,
+				r.OrganizationUUID.UUID)
+			orgs[r.OrganizationUUID.UUID] = true
+		}
+	}
+	return dups, nil
+}
+
 // AccountInfo represents the join of Account and Person
 type AccountInfo struct {
 	UUID         uuid.UUID `db:"uuid" json:"accountUUID"`
@@ -283,6 +532,7 @@ type AccountInfo struct {
 	HasAvatar    bool      `db:"has_avatar" json:"hasAvatar"`
 	Name         string    `db:"name" json:"name"`
 	PrimaryEmail string    `db:"primary_email" json:"primaryEmail"`
+	Locale       string    `db:"locale" json:"locale"`
 }
 
 // AccountInfosByOrganization returns a list of all AccountInfos for a given organization
@@ -295,7 +545,8 @@ func (db *ApplianceDB) AccountInfosByOrganization(ctx context.Context, org uuid.
 		  a.phone_number,
 		  (length(a.avatar_hash) > 0) as has_avatar,
 		  p.name,
-		  p.primary_email
+		  p.primary_email,
+		  a.locale
 		FROM account a, person p
 		WHERE
 		  a.organization_uuid = $1 AND
@@ -316,7 +567,8 @@ func (db *ApplianceDB) AccountInfoByUUID(ctx context.Context, acct uuid.UUID) (*
 		  a.phone_number,
 		  (length(a.avatar_hash) > 0) as has_avatar,
 		  p.name,
-		  p.primary_email
+		  p.primary_email,
+		  a.locale
 		FROM account a, person p
 		WHERE
 		  a.uuid = $1 AND
@@ -525,72 +777,110 @@ type AccountOrgRoles struct {
 	Roles                  pq.StringArray `db:"roles"`
 }
 
+// effectiveOrgRolesQuery is the single place in which an account's roles are
+// resolved.  It yields one row for each account and each org/org relationship
+// originating at the account's organization, so an account which reaches a
+// target organization through more than one relationship gets one row per
+// relationship.  Each row carries the relationship's limit set of roles, and
+// those of the account's roles granted through the relationship which fall
+// within that limit; roles outside the limit are never reported.
+// Relationships without a limit set of roles give no access, and are omitted.
+//
+// $1 and $2 optionally restrict the rows to an account and to a target
+// organization.
+const effectiveOrgRolesQuery = `
+	WITH limit_roles AS (
+	  SELECT relationship, array_agg(DISTINCT role ORDER BY role) AS limit_roles
+	  FROM relationship_roles
+	  GROUP BY relationship
+	) SELECT
+	  account.uuid AS account_uuid,
+	  account.organization_uuid,
+	  oo.target_organization_uuid,
+	  oo.relationship,
+	  limit_roles.limit_roles,
+	  ARRAY(
+	    SELECT ar.role
+	    FROM account_org_role AS ar
+	    WHERE
+	      ar.account_uuid = account.uuid AND
+	      ar.organization_uuid = account.organization_uuid AND
+	      ar.target_organization_uuid = oo.target_organization_uuid AND
+	      ar.relationship = oo.relationship AND
+	      ar.role = ANY (limit_roles.limit_roles)
+	    ORDER BY ar.role
+	  ) AS roles
+	FROM account
+	  JOIN org_org_relationship AS oo USING (organization_uuid)
+	  JOIN limit_roles USING (relationship)
+	WHERE
+	  ($1::uuid IS NULL OR account.uuid = $1::uuid) AND
+	  ($2::uuid IS NULL OR oo.target_organization_uuid = $2::uuid)
+	ORDER BY account.uuid, oo.target_organization_uuid, oo.relationship`
+
+// effectiveOrgRoles runs effectiveOrgRolesQuery, possibly inside a
+// transaction.
+func (db *ApplianceDB) effectiveOrgRoles(ctx context.Context, dbx DBX,
+	account uuid.NullUUID, target uuid.NullUUID) ([]AccountOrgRoles, error) {
+	var roles []AccountOrgRoles
+	if dbx == nil {
+		dbx = db
+	}
+	err := dbx.SelectContext(ctx, &roles, effectiveOrgRolesQuery,
+		account, target)
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
 // AccountOrgRolesByAccount computes the limit and effective roles for an
 // account across all target organizations.
 func (db *ApplianceDB) AccountOrgRolesByAccount(ctx context.Context,
 	account uuid.UUID) ([]AccountOrgRoles, error) {
-	o := uuid.NullUUID{Valid: false}
-	return db.accountOrgRolesByAccountTargetCommon(ctx, account, o)
+	a := uuid.NullUUID{UUID: account, Valid: true}
+	return db.effectiveOrgRoles(ctx, nil, a, uuid.NullUUID{})
 }
 
-// AccountOrgRolesByAccountTarget computes the effective roles for an account with
-// respect to a specific organization; this query also makes sure to constrain
-// the effective roles against the limit set of roles for the relationship
-// type, for safety.
+// AccountOrgRolesByAccountTarget computes the limit and effective roles for an
+// account with respect to a specific organization.
 func (db *ApplianceDB) AccountOrgRolesByAccountTarget(ctx context.Context,
 	account uuid.UUID, org uuid.UUID) ([]AccountOrgRoles, error) {
+	a := uuid.NullUUID{UUID: account, Valid: true}
 	o := uuid.NullUUID{UUID: org, Valid: true}
-	return db.accountOrgRolesByAccountTargetCommon(ctx, account, o)
+	return db.effectiveOrgRoles(ctx, nil, a, o)
 }
 
-func (db *ApplianceDB) accountOrgRolesByAccountTargetCommon(ctx context.Context,
-	account uuid.UUID, org uuid.NullUUID) ([]AccountOrgRoles, error) {
-	var roles []AccountOrgRoles
-	err := db.SelectContext(ctx, &roles, `
-                WITH limit_roles AS (
-                  SELECT
-                    account.uuid as account_uuid,
-                    account.organization_uuid,
-                    org_org_relationship.target_organization_uuid,
-                    org_org_relationship.relationship,
-                    array_agg(DISTINCT(relationship_roles.role)) as limit_roles
-                    FROM account
-                    JOIN org_org_relationship USING (organization_uuid)
-                    JOIN relationship_roles USING (relationship)
-                    WHERE
-		      account.uuid = $1
-		      AND ($2::uuid IS NULL OR org_org_relationship.target_organization_uuid=$2::uuid)
-                    GROUP BY (account.uuid, account.organization_uuid, org_org_relationship.target_organization_uuid, org_org_relationship.relationship)
-                ) SELECT
-                  $1 as account_uuid,
-                  limit_roles.organization_uuid,
-                  limit_roles.target_organization_uuid,
-                  limit_roles.relationship,
-                  array_remove(array_agg(DISTINCT(ar.role)), NULL) AS roles,
-		  limit_roles.limit_roles
-                  FROM limit_roles
-                  LEFT JOIN account_org_role AS ar USING (account_uuid, organization_uuid, target_organization_uuid, relationship)
-                  GROUP BY (ar.account_uuid, limit_roles.organization_uuid, limit_roles.target_organization_uuid, limit_roles.relationship, limit_roles.limit_roles)`,
-		account, org)
+// AccountPrimaryOrgRoles computes the roles in effect for an account's
+// primary ("home") organization.
+func (db *ApplianceDB) AccountPrimaryOrgRoles(ctx context.Context,
+	account uuid.UUID) ([]string, error) {
+	aoRoles, err := db.AccountOrgRolesByAccount(ctx, account)
 	if err != nil {
 		return nil, err
 	}
+	var roles []string
+	for _, aor := range aoRoles {
+		if aor.OrganizationUUID == aor.TargetOrganizationUUID {
+			roles = append(roles, aor.Roles...)
+		}
+	}
 	return roles, nil
 }
 
-// AccountPrimaryOrgRoles computes the roles in effect for an account's
-// primary ("home") organization.
-func (db *ApplianceDB) AccountPrimaryOrgRoles(ctx context.Context,
-	account uuid.UUID) ([]string, error) {
-	var roles []string
+// AccountOrgRoleGrantsByAccount returns the roles granted to an account, as
+// they are stored.  Unlike the methods above, it doesn't consult the limit
+// roles of the relationships through which the roles are granted, so it
+// includes roles which confer nothing; it exists to explain why an account
+// lacks access, and must not be used to grant it.
+func (db *ApplianceDB) AccountOrgRoleGrantsByAccount(ctx context.Context,
+	account uuid.UUID) ([]AccountOrgRole, error) {
+	var roles []AccountOrgRole
 	err := db.SelectContext(ctx, &roles, `
-		SELECT account_org_role.role AS role
+		SELECT *
 		FROM account_org_role
-		  JOIN relationship_roles USING (relationship, role)
-		WHERE
-		  account_org_role.account_uuid=$1 AND
-		  account_org_role.organization_uuid = account_org_role.target_organization_uuid`,
-		account)
+		WHERE account_uuid = $1
+		ORDER BY target_organization_uuid, relationship, role`, account)
 	if err != nil {
 		return nil, err
 	}
@@ -609,22 +899,63 @@ func (db *ApplianceDB) AccountOrgRolesByOrg(ctx context.Context,
 // select all roles.
 func (db *ApplianceDB) AccountOrgRolesByOrgTx(ctx context.Context, dbx DBX,
 	org uuid.UUID, role string) ([]AccountOrgRole, error) {
+	o := uuid.NullUUID{UUID: org, Valid: true}
+	aoRoles, err := db.effectiveOrgRoles(ctx, dbx, uuid.NullUUID{}, o)
+	if err != nil {
+		return nil, err
+	}
 	var roles []AccountOrgRole
-	var err error
-	if dbx == nil {
-		dbx = db
+	for _, aor := range aoRoles {
+		for _, r := range aor.Roles {
+			if role != "" && r != role {
+				continue
+			}
+			roles = append(roles, AccountOrgRole{
+				AccountUUID:            aor.AccountUUID,
+				OrganizationUUID:       aor.OrganizationUUID,
+				TargetOrganizationUUID: aor.TargetOrganizationUUID,
+				Role:                   r,
+				Relationship:           aor.Relationship,
+			})
+		}
 	}
+	return roles, nil
+}
 
-	err = dbx.SelectContext(ctx, &roles, `
-		SELECT * FROM account_org_role
+// AccountsByOrgAndRole returns the accounts possessing the given role for a
+// target organization, ordered by name.  As with AccountOrgRolesByOrg, this
+// includes accounts from other organizations which hold the role through an
+// org/org relationship.  If role is "", accounts holding any role are
+// returned.  Each account appears once, however many relationships give it the
+// role.
+func (db *ApplianceDB) AccountsByOrgAndRole(ctx context.Context,
+	org uuid.UUID, role string) ([]AccountInfo, error) {
+	accts := make([]AccountInfo, 0)
+	o := uuid.NullUUID{UUID: org, Valid: true}
+	err := db.SelectContext(ctx, &accts, `
+		SELECT
+		  a.uuid,
+		  a.email,
+		  a.phone_number,
+		  (length(a.avatar_hash) > 0) as has_avatar,
+		  p.name,
+		  p.primary_email,
+		  a.locale
+		FROM account a, person p
 		WHERE
-		  account_org_role.target_organization_uuid=$1 AND
-		  ($2='' OR account_org_role.role=$2)`,
-		org, role)
+		  a.person_uuid = p.uuid AND
+		  a.uuid IN (
+		    SELECT r.account_uuid
+		    FROM (`+effectiveOrgRolesQuery+`) AS r
+		    WHERE
+		      cardinality(r.roles) > 0 AND
+		      ($3 = '' OR $3 = ANY (r.roles))
+		  )
+		ORDER BY p.name, a.uuid`, uuid.NullUUID{}, o, role)
 	if err != nil {
 		return nil, err
 	}
-	return roles, nil
+	return accts, nil
 }
 
 // InsertAccountOrgRole inserts a row in account_org_role
@@ -866,6 +1197,7 @@ func (db *ApplianceDB) LoginInfoByProviderAndSubject(ctx context.Context,
 		  a.person_uuid,
 		  a.organization_uuid,
 		  a.avatar_hash,
+		  a.locale,
 		  p.uuid,
 		  p.name,
 		  p.primary_email,
@@ -883,6 +1215,7 @@ func (db *ApplianceDB) LoginInfoByProviderAndSubject(ctx context.Context,
 		&li.Account.PersonUUID,
 		&li.Account.OrganizationUUID,
 		&li.Account.AvatarHash,
+		&li.Account.Locale,
 		&li.Person.UUID,
 		&li.Person.Name,
 		&li.Person.PrimaryEmail,
@@ -19,6 +19,7 @@ import (
 	"strings"
 	"time"
 
+	"bg/cl_common/pgutils"
 	"bg/cl_common/vaultdb"
 
 	"github.com/guregu/null"
@@ -52,17 +53,22 @@ type DataStore interface {
 	InsertCustomerSiteTx(context.Context, DBX, *CustomerSite) error
 	UpdateCustomerSite(context.Context, *CustomerSite) error
 	UpdateCustomerSiteTx(context.Context, DBX, *CustomerSite) error
+	ArchiveCustomerSite(context.Context, uuid.UUID) error
+	UnarchiveCustomerSite(context.Context, uuid.UUID) error
 
 	AllApplianceIDs(context.Context) ([]ApplianceID, error)
 	ApplianceIDsBySiteID(context.Context, uuid.UUID) ([]ApplianceID, error)
 	ApplianceIDsByOrgID(context.Context, uuid.UUID) ([]ApplianceID, error)
 	ApplianceIDByClientID(context.Context, string) (*ApplianceID, error)
+	SiteUUIDByClientID(context.Context, string) (uuid.UUID, error)
 	ApplianceIDByUUID(context.Context, uuid.UUID) (*ApplianceID, error)
 	ApplianceIDByHWSerial(context.Context, string) (*ApplianceID, error)
 	InsertApplianceID(context.Context, *ApplianceID) error
 	InsertApplianceIDTx(context.Context, DBX, *ApplianceID) error
 	UpdateApplianceID(context.Context, *ApplianceID) error
 	UpdateApplianceIDTx(context.Context, DBX, *ApplianceID) error
+	SetApplianceLifecycle(context.Context, uuid.UUID, string) error
+	AppliancesByLifecycle(context.Context, string) ([]ApplianceID, error)
 
 	InsertApplianceKeyTx(context.Context, DBX, uuid.UUID, *AppliancePubKey) error
 	KeysByUUID(context.Context, uuid.UUID) ([]AppliancePubKey, error)
@@ -84,10 +90,16 @@ type DataStore interface {
 	OAuth2OrganizationRuleTest(context.Context, string, OAuth2OrgRuleType, string) (*OAuth2OrganizationRule, error)
 	InsertOAuth2OrganizationRule(context.Context, *OAuth2OrganizationRule) error
 	InsertOAuth2OrganizationRuleTx(context.Context, DBX, *OAuth2OrganizationRule) error
+	InsertOAuth2OrganizationRules(context.Context, []*OAuth2OrganizationRule) error
 	DeleteOAuth2OrganizationRule(context.Context, *OAuth2OrganizationRule) error
 	DeleteOAuth2OrganizationRuleTx(context.Context, DBX, *OAuth2OrganizationRule) error
+	OAuth2OrganizationRuleImpact(context.Context, *OAuth2OrganizationRule) ([]Account, error)
 
 	AppSiteOrgChain(context.Context, []uuid.UUID) ([]AppSiteOrg, error)
+	InconsistentApplianceOrgs(context.Context, bool) ([]ApplianceOrgMismatch, error)
+
+	// Methods related to references from sites to external systems
+	siteRefManager
 
 	// Methods related to accounts, persons, identity
 	accountManager
@@ -98,12 +110,57 @@ type DataStore interface {
 	// Methods related to the command queue
 	commandQueue
 
+	// Methods related to site configuration checkpoints
+	checkpointManager
+
+	// Methods related to support notes about appliances and sites
+	noteManager
+
 	// Methods related to heartbeats, exceptions, and other events
 	eventManager
 
 	// Methods related to software releases
 	releaseManager
 
+	// Methods related to staged rollouts of releases
+	deploymentManager
+
+	// Methods related to API usage metering
+	usageManager
+
+	// Methods related to mobile push notifications
+	pushManager
+
+	// Methods related to localized notification templates
+	templateManager
+
+	// Methods related to appliance firmware versions
+	firmwareManager
+
+	// Methods related to support grants and their audit trail
+	supportManager
+
+	// Methods related to customer contracts
+	entitlementManager
+
+	// Methods related to the health of the database itself
+	healthManager
+
+	// Methods related to site integration tokens
+	integrationManager
+
+	// Methods related to invitations to join an organization
+	inviteManager
+
+	// Methods related to leases held by cloud maintenance jobs
+	jobLeaseManager
+
+	// Methods related to the cloud shards serving each site
+	siteShardManager
+
+	// Methods related to the seed data every registry needs
+	bootstrapManager
+
 	Ping() error
 	PingContext(context.Context) error
 	Close() error
@@ -115,14 +172,26 @@ type DataStore interface {
 type ApplianceDB struct {
 	*sqlx.DB
 	accountSecretsPassphrase []byte
+	phoneRegion              string
+	guestPhoneKey            []byte
 }
 
 // CustomerSite represents a customer installation of a group of
-// Appliances at a single physical location.
+// Appliances at a single physical location.  Version is used to detect
+// conflicting updates; see UpdateCustomerSite.  ArchivedAt is set while the
+// site is archived; see ArchiveCustomerSite.
 type CustomerSite struct {
 	UUID             uuid.UUID `db:"uuid"`
 	OrganizationUUID uuid.UUID `db:"organization_uuid"`
 	Name             string    `db:"name"`
+	Version          int64     `db:"version"`
+	UpdatedAt        time.Time `db:"updated_at"`
+	ArchivedAt       null.Time `db:"archived_at"`
+}
+
+// Archived returns true if the site is archived
+func (cs *CustomerSite) Archived() bool {
+	return cs.ArchivedAt.Valid
 }
 
 // NullSiteUUID is a reserved UUID for appliances which have no associated
@@ -153,6 +222,33 @@ type ApplianceID struct {
 	// Appliance Registry name and ID in the Registry
 	ApplianceReg   string `json:"appliance_reg" db:"appliance_reg"`
 	ApplianceRegID string `json:"appliance_reg_id" db:"appliance_reg_id"`
+
+	// Hardware lifecycle state; see SetApplianceLifecycle
+	LifecycleState string `json:"lifecycle_state" db:"lifecycle_state"`
+
+	// Used to detect conflicting updates; see UpdateApplianceID
+	Version   int64     `json:"version" db:"version"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// Hardware lifecycle states of an appliance
+const (
+	LifecycleActive       = "active"
+	LifecycleRMARequested = "rma-requested"
+	LifecycleRetired      = "retired"
+)
+
+// lifecycleTransitions lists the states to which an appliance may move from
+// each state.  An RMA may be abandoned, but a retired appliance stays retired.
+var lifecycleTransitions = map[string][]string{
+	LifecycleActive:       {LifecycleRMARequested, LifecycleRetired},
+	LifecycleRMARequested: {LifecycleActive, LifecycleRetired},
+	LifecycleRetired:      {},
+}
+
+// Retired returns true if the appliance has been retired
+func (id *ApplianceID) Retired() bool {
+	return id.LifecycleState == LifecycleRetired
 }
 
 // AppliancePubKey represents one of the public keys for an Appliance.
@@ -187,6 +283,60 @@ func (e NotFoundError) Error() string {
 	return e.s
 }
 
+// ValidationError is returned when a value can't be stored because it is
+// malformed.
+type ValidationError struct {
+	Field  string
+	Value  string
+	Reason string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s %q: %s", e.Field, e.Value, e.Reason)
+}
+
+// ConflictError is returned when a record can't be updated because it has
+// been changed since the caller read it: the version the caller expected to
+// replace is no longer the current one.
+type ConflictError struct {
+	Table    string
+	Key      string
+	Expected int64
+	Actual   int64
+}
+
+func (e ConflictError) Error() string {
+	return fmt.Sprintf("%s %s was modified concurrently: expected "+
+		"version %d, found version %d", e.Table, e.Key, e.Expected,
+		e.Actual)
+}
+
+// versionConflict is called when an update of a versioned record matched no
+// rows, to work out whether that was because the record doesn't exist or
+// because its version had changed.
+func versionConflict(ctx context.Context, dbx DBX, table, keyCol string,
+	key uuid.UUID, expected int64) error {
+
+	var actual int64
+	row := dbx.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT version FROM %s WHERE %s=$1", table, keyCol), key)
+	err := row.Scan(&actual)
+	switch err {
+	case sql.ErrNoRows:
+		return NotFoundError{fmt.Sprintf(
+			"Couldn't find %s record for %v", table, key)}
+	case nil:
+		return ConflictError{
+			Table:    table,
+			Key:      key.String(),
+			Expected: expected,
+			Actual:   actual,
+		}
+	default:
+		return err
+	}
+}
+
 // SyntaxError may be returned when there is a syntax error in the SQL query.
 type SyntaxError struct {
 	err   *pq.Error
@@ -283,10 +433,19 @@ func (i *ApplianceID) ClientID() string {
 func Connect(dataSource string) (DataStore, error) {
 	// Force all sessions to operate in UTC, so we don't rely on whatever
 	// weird timezone is configured on the server, like GMT.
-	sqldb, err := sqlx.Open("postgres", dataSource+"&timezone=UTC")
+	return connectZone(dataSource, "UTC")
+}
+
+// connectZone opens a new connection to the DataStore whose sessions operate
+// in the given time zone.  Times read from the database are normalized to UTC
+// regardless; only the tests have reason to use anything other than UTC here.
+func connectZone(dataSource, zone string) (DataStore, error) {
+	connector, err := pq.NewConnector(
+		pgutils.AddTimezone(dataSource, zone))
 	if err != nil {
 		return nil, err
 	}
+	sqldb := sqlx.NewDb(sql.OpenDB(utcConnector{connector}), "postgres")
 	// We found that not limiting this can cause problems as Go attempts to
 	// open many many connections to the database.  (presumably the cloud
 	// sql proxy can't handle massive numbers of connections)
@@ -300,7 +459,7 @@ func Connect(dataSource string) (DataStore, error) {
 // VaultConnect takes an existing VaultDB object, opens the connection, and
 // creates a DataStore from it.
 func VaultConnect(vdbc *vaultdb.Connector) (DataStore, error) {
-	db := sqlx.NewDb(sql.OpenDB(vdbc), "postgres")
+	db := sqlx.NewDb(sql.OpenDB(utcConnector{vdbc}), "postgres")
 	db.SetMaxOpenConns(16)
 	if err := vdbc.SetConnMaxLifetime(db.DB); err != nil {
 		return nil, err
@@ -340,7 +499,8 @@ func (db *ApplianceDB) LoadSchema(ctx context.Context, schemaDir string) error {
 	return nil
 }
 
-// InsertCustomerSite inserts a record into the customer_site table.
+// InsertCustomerSite inserts a record into the customer_site table.  The site's
+// Version and UpdatedAt fields are filled in from the database.
 func (db *ApplianceDB) InsertCustomerSite(ctx context.Context,
 	cs *CustomerSite) error {
 	return db.InsertCustomerSiteTx(ctx, nil, cs)
@@ -354,17 +514,22 @@ func (db *ApplianceDB) InsertCustomerSiteTx(ctx context.Context, dbx DBX,
 	if dbx == nil {
 		dbx = db
 	}
-	_, err := dbx.ExecContext(ctx,
+	row := dbx.QueryRowContext(ctx,
 		`INSERT INTO customer_site
 		 (uuid, organization_uuid, name)
-		 VALUES ($1, $2, $3)`,
+		 VALUES ($1, $2, $3)
+		 RETURNING version, updated_at`,
 		cs.UUID,
 		cs.OrganizationUUID,
 		cs.Name)
-	return err
+	return row.Scan(&cs.Version, &cs.UpdatedAt)
 }
 
-// UpdateCustomerSite updates a record into the customer_site table.
+// UpdateCustomerSite updates a record into the customer_site table.  The
+// site's Version must match the stored version, or else ConflictError is
+// returned and nothing is changed; this keeps concurrent edits from silently
+// overwriting one another.  On success, the site's Version and UpdatedAt
+// fields are updated.
 func (db *ApplianceDB) UpdateCustomerSite(ctx context.Context,
 	cs *CustomerSite) error {
 	return db.UpdateCustomerSiteTx(ctx, nil, cs)
@@ -378,21 +543,92 @@ func (db *ApplianceDB) UpdateCustomerSiteTx(ctx context.Context, dbx DBX,
 	if dbx == nil {
 		dbx = db
 	}
-	_, err := dbx.NamedExecContext(ctx,
+	row := dbx.QueryRowContext(ctx,
 		`UPDATE customer_site
 		 SET
-		   name=:name,
-		   organization_uuid=:organization_uuid
-		 WHERE uuid=:uuid`, cs)
+		   name=$1,
+		   organization_uuid=$2,
+		   version=version+1,
+		   updated_at=now()
+		 WHERE uuid=$3 AND version=$4
+		 RETURNING version, updated_at`,
+		cs.Name, cs.OrganizationUUID, cs.UUID, cs.Version)
+	err := row.Scan(&cs.Version, &cs.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return versionConflict(ctx, dbx, "customer_site", "uuid",
+			cs.UUID, cs.Version)
+	}
 	return err
 }
 
+// SiteArchivedError is returned when an operation can't be applied to a site
+// because it is archived; the site must be unarchived first.
+type SiteArchivedError struct {
+	SiteUUID uuid.UUID
+}
+
+func (e SiteArchivedError) Error() string {
+	return fmt.Sprintf("site %v is archived; unarchive it first", e.SiteUUID)
+}
+
+// setCustomerSiteArchived archives or unarchives a site.  A site which is
+// already in the requested state is left alone, so that archiving it again
+// doesn't change when it was archived.
+func (db *ApplianceDB) setCustomerSiteArchived(ctx context.Context,
+	u uuid.UUID, archive bool) error {
+
+	res, err := db.ExecContext(ctx,
+		`UPDATE customer_site
+		 SET
+		   archived_at=CASE WHEN $2 THEN now() END,
+		   version=version+1,
+		   updated_at=now()
+		 WHERE uuid=$1 AND (archived_at IS NULL) = $2`,
+		u, archive)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+
+	var exists bool
+	err = db.GetContext(ctx, &exists,
+		"SELECT EXISTS (SELECT 1 FROM customer_site WHERE uuid=$1)", u)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return NotFoundError{fmt.Sprintf(
+			"setCustomerSiteArchived: Couldn't find site for %v", u)}
+	}
+	return nil
+}
+
+// ArchiveCustomerSite marks a site as archived: it is kept, along with its
+// appliances and history, but is inactive.  Archived sites are left out of
+// health reporting and alerting, and can't be sent commands.  Archiving the
+// site bumps its Version.  NotFoundError is returned if there is no such site.
+func (db *ApplianceDB) ArchiveCustomerSite(ctx context.Context,
+	u uuid.UUID) error {
+	return db.setCustomerSiteArchived(ctx, u, true)
+}
+
+// UnarchiveCustomerSite returns an archived site to normal operation,
+// bumping its Version.  NotFoundError is returned if there is no such site.
+func (db *ApplianceDB) UnarchiveCustomerSite(ctx context.Context,
+	u uuid.UUID) error {
+	return db.setCustomerSiteArchived(ctx, u, false)
+}
+
 // AllCustomerSites returns a complete list of the Customer Sites in the
 // database
 func (db *ApplianceDB) AllCustomerSites(ctx context.Context) ([]CustomerSite, error) {
 	var sites []CustomerSite
 	err := db.SelectContext(ctx, &sites,
-		"SELECT uuid, organization_uuid, name FROM customer_site")
+		`SELECT uuid, organization_uuid, name, version, updated_at,
+		   archived_at
+		 FROM customer_site`)
 	if err != nil {
 		return nil, err
 	}
@@ -433,7 +669,8 @@ func (db *ApplianceDB) CustomerSitesByOrganization(ctx context.Context,
 }
 
 // CustomerSitesByAccount returns a list of the customer_site
-// records for the given Account's set of roles.
+// records for the given Account's set of roles.  Archived sites are included;
+// see CustomerSite.Archived.
 func (db *ApplianceDB) CustomerSitesByAccount(ctx context.Context,
 	accountUUID uuid.UUID) ([]CustomerSite, error) {
 
@@ -442,7 +679,10 @@ func (db *ApplianceDB) CustomerSitesByAccount(ctx context.Context,
 		`SELECT
 		  DISTINCT customer_site.uuid,
 		  customer_site.organization_uuid AS organization_uuid,
-		  customer_site.name AS name
+		  customer_site.name AS name,
+		  customer_site.version AS version,
+		  customer_site.updated_at AS updated_at,
+		  customer_site.archived_at AS archived_at
 		FROM
 		  customer_site, account_org_role
 		WHERE
@@ -561,7 +801,42 @@ func (db *ApplianceDB) ApplianceIDByClientID(ctx context.Context, clientID strin
 	}
 }
 
-// InsertApplianceID inserts an ApplianceID.
+// SiteUUIDByClientID returns the UUID of the site to which the appliance with
+// the given client ID (see ApplianceIDByClientID) belongs.  Unlike
+// ApplianceIDByClientID, the client ID is split into its parts so that the
+// lookup can use the registry index, making this suitable for busy ingest
+// paths.  An appliance which hasn't been assigned a site yields NullSiteUUID.
+// NotFoundError is returned if the client ID is malformed or unknown.
+func (db *ApplianceDB) SiteUUIDByClientID(ctx context.Context,
+	clientID string) (uuid.UUID, error) {
+
+	parts := strings.Split(clientID, "/")
+	if len(parts) != 8 || parts[0] != "projects" ||
+		parts[2] != "locations" || parts[4] != "registries" ||
+		parts[6] != "appliances" {
+		return uuid.Nil, NotFoundError{fmt.Sprintf(
+			"SiteUUIDByClientID: malformed client ID %s", clientID)}
+	}
+
+	var siteUU uuid.UUID
+	err := db.GetContext(ctx, &siteUU, `
+		SELECT s.uuid
+		FROM appliance_id_map a
+		    JOIN customer_site s ON a.site_uuid = s.uuid
+		WHERE a.gcp_project = $1 AND a.gcp_region = $2 AND
+		    a.appliance_reg = $3 AND a.appliance_reg_id = $4`,
+		parts[1], parts[3], parts[5], parts[7])
+	if err == sql.ErrNoRows {
+		return uuid.Nil, NotFoundError{fmt.Sprintf(
+			"SiteUUIDByClientID: Couldn't find %s", clientID)}
+	} else if err != nil {
+		return uuid.Nil, err
+	}
+	return siteUU, nil
+}
+
+// InsertApplianceID inserts an ApplianceID.  Its Version and UpdatedAt fields
+// are filled in from the database.
 func (db *ApplianceDB) InsertApplianceID(ctx context.Context,
 	id *ApplianceID) error {
 	return db.InsertApplianceIDTx(ctx, nil, id)
@@ -574,7 +849,7 @@ func (db *ApplianceDB) InsertApplianceIDTx(ctx context.Context, dbx DBX,
 	if dbx == nil {
 		dbx = db
 	}
-	_, err := dbx.ExecContext(ctx,
+	row := dbx.QueryRowContext(ctx,
 		`INSERT INTO appliance_id_map
 		 (appliance_uuid,
 		      site_uuid,
@@ -584,7 +859,8 @@ func (db *ApplianceDB) InsertApplianceIDTx(ctx context.Context, dbx DBX,
 		      gcp_region,
 		      appliance_reg,
 		      appliance_reg_id)
-		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		 RETURNING lifecycle_state, version, updated_at`,
 		id.ApplianceUUID,
 		id.SiteUUID,
 		id.SystemReprMAC,
@@ -593,10 +869,12 @@ func (db *ApplianceDB) InsertApplianceIDTx(ctx context.Context, dbx DBX,
 		id.GCPRegion,
 		id.ApplianceReg,
 		id.ApplianceRegID)
-	return err
+	return row.Scan(&id.LifecycleState, &id.Version, &id.UpdatedAt)
 }
 
-// UpdateApplianceID inserts an ApplianceID.
+// UpdateApplianceID updates an ApplianceID.  The ApplianceID's Version must
+// match the stored version, or else ConflictError is returned and nothing is
+// changed.  On success, its Version and UpdatedAt fields are updated.
 func (db *ApplianceDB) UpdateApplianceID(ctx context.Context,
 	id *ApplianceID) error {
 	return db.UpdateApplianceIDTx(ctx, nil, id)
@@ -611,14 +889,108 @@ func (db *ApplianceDB) UpdateApplianceIDTx(ctx context.Context, dbx DBX,
 	if dbx == nil {
 		dbx = db
 	}
-	_, err := dbx.NamedExecContext(ctx,
+	row := dbx.QueryRowContext(ctx,
 		`UPDATE appliance_id_map
 		 SET
-		   site_uuid=:site_uuid
-		 WHERE appliance_uuid=:appliance_uuid`, id)
+		   site_uuid=$1,
+		   version=version+1,
+		   updated_at=now()
+		 WHERE appliance_uuid=$2 AND version=$3
+		 RETURNING version, updated_at`,
+		id.SiteUUID, id.ApplianceUUID, id.Version)
+	err := row.Scan(&id.Version, &id.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return versionConflict(ctx, dbx, "appliance_id_map",
+			"appliance_uuid", id.ApplianceUUID, id.Version)
+	}
 	return err
 }
 
+func validateLifecycle(state string) error {
+	if _, ok := lifecycleTransitions[state]; !ok {
+		return ValidationError{"lifecycle_state", state,
+			"not a lifecycle state"}
+	}
+	return nil
+}
+
+// SetApplianceLifecycle moves an appliance to a new hardware lifecycle state,
+// bumping its Version.  An active appliance may have an RMA requested, which
+// may be abandoned; either may be retired, after which the appliance can't be
+// moved to another state.  ValidationError is returned for an unknown state or
+// a disallowed transition, and NotFoundError if there is no such appliance.
+// Setting the state the appliance is already in changes nothing.
+func (db *ApplianceDB) SetApplianceLifecycle(ctx context.Context,
+	u uuid.UUID, state string) error {
+
+	if err := validateLifecycle(state); err != nil {
+		return err
+	}
+
+	dbx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer dbx.Rollback()
+
+	var cur string
+	err = dbx.GetContext(ctx, &cur,
+		`SELECT lifecycle_state
+		 FROM appliance_id_map
+		 WHERE appliance_uuid=$1
+		 FOR UPDATE`, u)
+	if err == sql.ErrNoRows {
+		return NotFoundError{fmt.Sprintf(
+			"SetApplianceLifecycle: Couldn't find %s", u)}
+	} else if err != nil {
+		return err
+	}
+	if cur == state {
+		return nil
+	}
+
+	allowed := false
+	for _, next := range lifecycleTransitions[cur] {
+		allowed = allowed || next == state
+	}
+	if !allowed {
+		return ValidationError{"lifecycle_state", state,
+			fmt.Sprintf("appliance %s is %s", u, cur)}
+	}
+
+	_, err = dbx.ExecContext(ctx,
+		`UPDATE appliance_id_map
+		 SET
+		   lifecycle_state=$2,
+		   version=version+1,
+		   updated_at=now()
+		 WHERE appliance_uuid=$1`, u, state)
+	if err != nil {
+		return err
+	}
+	return dbx.Commit()
+}
+
+// AppliancesByLifecycle returns the appliances in the given hardware lifecycle
+// state, sorted by UUID.
+func (db *ApplianceDB) AppliancesByLifecycle(ctx context.Context,
+	state string) ([]ApplianceID, error) {
+
+	if err := validateLifecycle(state); err != nil {
+		return nil, err
+	}
+
+	ids := make([]ApplianceID, 0)
+	err := db.SelectContext(ctx, &ids,
+		`SELECT * FROM appliance_id_map
+		 WHERE lifecycle_state=$1
+		 ORDER BY appliance_uuid`, state)
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
 // InsertApplianceKeyTx adds an appliance's public key to the registry.
 func (db *ApplianceDB) InsertApplianceKeyTx(ctx context.Context, dbx DBX, u uuid.UUID, key *AppliancePubKey) error {
 	if dbx == nil {
@@ -759,13 +1131,18 @@ type Organization struct {
 	// across cloud properties
 	UUID uuid.UUID `db:"uuid"`
 	Name string    `db:"name"` // Familiar name of customer
+
+	// Used to detect conflicting updates; see UpdateOrganization
+	Version   int64     `db:"version"`
+	UpdatedAt time.Time `db:"updated_at"`
 }
 
 // AllOrganizations returns a complete list of the organization records in the
 // database
 func (db *ApplianceDB) AllOrganizations(ctx context.Context) ([]Organization, error) {
 	var orgs []Organization
-	err := db.SelectContext(ctx, &orgs, "SELECT uuid, name FROM organization")
+	err := db.SelectContext(ctx, &orgs,
+		"SELECT uuid, name, version, updated_at FROM organization")
 	if err != nil {
 		return nil, err
 	}
@@ -790,7 +1167,8 @@ func (db *ApplianceDB) OrganizationByUUID(ctx context.Context, orgUUID uuid.UUID
 	}
 }
 
-// InsertOrganization inserts an Organization.
+// InsertOrganization inserts an Organization.  Its Version and UpdatedAt fields
+// are filled in from the database.
 func (db *ApplianceDB) InsertOrganization(ctx context.Context,
 	org *Organization) error {
 	dbx, err := db.BeginTxx(ctx, nil)
@@ -798,9 +1176,10 @@ func (db *ApplianceDB) InsertOrganization(ctx context.Context,
 		return err
 	}
 	defer dbx.Rollback()
-	_, err = dbx.NamedExecContext(ctx,
-		`INSERT INTO organization (uuid, name) VALUES (:uuid,:name)`, org)
-	if err != nil {
+	row := dbx.QueryRowContext(ctx,
+		`INSERT INTO organization (uuid, name) VALUES ($1, $2)
+		 RETURNING version, updated_at`, org.UUID, org.Name)
+	if err = row.Scan(&org.Version, &org.UpdatedAt); err != nil {
 		return err
 	}
 	// To keep things deterministic for testing purposes, we always set the
@@ -820,7 +1199,9 @@ func (db *ApplianceDB) InsertOrganization(ctx context.Context,
 	return err
 }
 
-// UpdateOrganization updates an Organization.
+// UpdateOrganization updates an Organization.  The Organization's Version must
+// match the stored version, or else ConflictError is returned and nothing is
+// changed.  On success, its Version and UpdatedAt fields are updated.
 func (db *ApplianceDB) UpdateOrganization(ctx context.Context,
 	org *Organization) error {
 	return db.UpdateOrganizationTx(ctx, nil, org)
@@ -833,8 +1214,17 @@ func (db *ApplianceDB) UpdateOrganizationTx(ctx context.Context, dbx DBX,
 	if dbx == nil {
 		dbx = db
 	}
-	_, err := dbx.NamedExecContext(ctx,
-		`UPDATE organization SET name=:name WHERE uuid=:uuid`, org)
+	row := dbx.QueryRowContext(ctx,
+		`UPDATE organization
+		 SET name=$1, version=version+1, updated_at=now()
+		 WHERE uuid=$2 AND version=$3
+		 RETURNING version, updated_at`,
+		org.Name, org.UUID, org.Version)
+	err := row.Scan(&org.Version, &org.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return versionConflict(ctx, dbx, "organization", "uuid",
+			org.UUID, org.Version)
+	}
 	return err
 }
 
@@ -857,6 +1247,60 @@ type OAuth2OrganizationRule struct {
 	OrganizationUUID uuid.UUID         `db:"organization_uuid"`
 }
 
+// normalizeRuleValue returns a rule value in the form in which it is stored;
+// email and domain rules are matched case-insensitively.
+func normalizeRuleValue(ruleType OAuth2OrgRuleType, ruleValue string) string {
+	if ruleType == RuleTypeDomain || ruleType == RuleTypeEmail {
+		return strings.ToLower(ruleValue)
+	}
+	return ruleValue
+}
+
+// OAuth2OrgRuleLookup searches for the rule with the given provider, rule type
+// and rule value.
+type OAuth2OrgRuleLookup func(provider string, ruleType OAuth2OrgRuleType,
+	ruleValue string) (*OAuth2OrganizationRule, error)
+
+// MatchOAuth2OrganizationRule finds the rule which maps an OAuth2 identity to
+// its organization, using 'lookup' to search the set of rules.  Three tests
+// are made, in order:
+//
+// 1. If the identity's tenant ID is known, look for a matching tenant rule.
+// This is by far the best and most secure method.
+// 2. If an email address is present, look for a rule matching its domain.
+// 3. If an email address is present, look for a rule matching the address.
+//
+// NotFoundError is returned if none of the rules match.
+func MatchOAuth2OrganizationRule(provider, tenant, email string,
+	lookup OAuth2OrgRuleLookup) (*OAuth2OrganizationRule, error) {
+
+	if tenant != "" {
+		rule, err := lookup(provider, RuleTypeTenant, tenant)
+		if err == nil {
+			return rule, nil
+		}
+	}
+
+	split := strings.SplitN(email, "@", 2)
+	if len(split) == 2 && split[1] != "" {
+		rule, err := lookup(provider, RuleTypeDomain, split[1])
+		if err == nil {
+			return rule, nil
+		}
+	}
+
+	if email != "" {
+		rule, err := lookup(provider, RuleTypeEmail, email)
+		if err == nil {
+			return rule, nil
+		}
+	}
+
+	return nil, NotFoundError{fmt.Sprintf(
+		"MatchOAuth2OrganizationRule: No rules matched (%v,%v,%v)",
+		provider, tenant, email)}
+}
+
 // AllOAuth2OrganizationRules returns a complete list of the
 // oauth2_organization_rule records in the database
 func (db *ApplianceDB) AllOAuth2OrganizationRules(ctx context.Context) ([]OAuth2OrganizationRule, error) {
@@ -876,10 +1320,8 @@ func (db *ApplianceDB) OAuth2OrganizationRuleTest(ctx context.Context,
 
 	var rule OAuth2OrganizationRule
 
-	if ruleType == RuleTypeDomain || ruleType == RuleTypeEmail {
-		ruleValue = strings.ToLower(ruleValue)
-	}
 	// Also perform case-insensitive compares for email and domain
+	ruleValue = normalizeRuleValue(ruleType, ruleValue)
 	err := db.GetContext(ctx, &rule,
 		`SELECT *
 		    FROM oauth2_organization_rule
@@ -912,9 +1354,7 @@ func (db *ApplianceDB) InsertOAuth2OrganizationRuleTx(ctx context.Context, dbx D
 	}
 	// Take a copy so as not to modify caller's data
 	rule := *insRule
-	if rule.RuleType == RuleTypeDomain || rule.RuleType == RuleTypeEmail {
-		rule.RuleValue = strings.ToLower(rule.RuleValue)
-	}
+	rule.RuleValue = normalizeRuleValue(rule.RuleType, rule.RuleValue)
 	_, err := dbx.NamedExecContext(ctx,
 		`INSERT INTO oauth2_organization_rule
 		 (provider, rule_type, rule_value, organization_uuid)
@@ -923,6 +1363,28 @@ func (db *ApplianceDB) InsertOAuth2OrganizationRuleTx(ctx context.Context, dbx D
 	return err
 }
 
+// InsertOAuth2OrganizationRules inserts a set of OAuth2OrganizationRules in a
+// single transaction.  If any of them can't be inserted (because it duplicates
+// an existing rule, or another in the set), none of them are.
+func (db *ApplianceDB) InsertOAuth2OrganizationRules(ctx context.Context,
+	rules []*OAuth2OrganizationRule) error {
+
+	dbx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer dbx.Rollback()
+
+	for _, rule := range rules {
+		err = db.InsertOAuth2OrganizationRuleTx(ctx, dbx, rule)
+		if err != nil {
+			return errors.Wrapf(err, "inserting rule (%v,%v,%v)",
+				rule.Provider, rule.RuleType, rule.RuleValue)
+		}
+	}
+	return dbx.Commit()
+}
+
 // DeleteOAuth2OrganizationRule deletes an OAuth2OrganizationRule.
 func (db *ApplianceDB) DeleteOAuth2OrganizationRule(ctx context.Context,
 	rule *OAuth2OrganizationRule) error {
@@ -938,9 +1400,7 @@ func (db *ApplianceDB) DeleteOAuth2OrganizationRuleTx(ctx context.Context, dbx D
 	}
 	// Take a copy so as not to modify caller's data
 	rule := *delRule
-	if rule.RuleType == RuleTypeDomain || rule.RuleType == RuleTypeEmail {
-		rule.RuleValue = strings.ToLower(rule.RuleValue)
-	}
+	rule.RuleValue = normalizeRuleValue(rule.RuleType, rule.RuleValue)
 	_, err := dbx.NamedExecContext(ctx, `
 		DELETE FROM oauth2_organization_rule
 		WHERE
@@ -951,6 +1411,92 @@ func (db *ApplianceDB) DeleteOAuth2OrganizationRuleTx(ctx context.Context, dbx D
 	return err
 }
 
+// OAuth2OrganizationRuleImpact returns the accounts which depend upon the given
+// rule to map them to their organization: accounts in the rule's organization
+// with an identity from the rule's provider, to which the rule applies, and
+// which none of the other rules would map to the same organization.  Matching
+// follows MatchOAuth2OrganizationRule.  Because the tenant IDs of identities
+// are not recorded, a tenant rule is assumed to apply to all such accounts, and
+// other tenant rules are never considered as alternatives; the result may
+// therefore overstate, but will not understate, the impact of removing a rule.
+func (db *ApplianceDB) OAuth2OrganizationRuleImpact(ctx context.Context,
+	target *OAuth2OrganizationRule) ([]Account, error) {
+
+	var accts []Account
+	err := db.SelectContext(ctx, &accts, `
+		SELECT *
+		FROM account
+		WHERE organization_uuid = $1 AND uuid IN (
+		    SELECT account_uuid
+		    FROM oauth2_identity
+		    WHERE provider = $2)
+		ORDER BY email`, target.OrganizationUUID, target.Provider)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []OAuth2OrganizationRule
+	err = db.SelectContext(ctx, &rules,
+		"SELECT * FROM oauth2_organization_rule WHERE provider=$1",
+		target.Provider)
+	if err != nil {
+		return nil, err
+	}
+
+	type ruleKey struct {
+		ruleType  OAuth2OrgRuleType
+		ruleValue string
+	}
+	self := ruleKey{target.RuleType,
+		normalizeRuleValue(target.RuleType, target.RuleValue)}
+	others := make(map[ruleKey]OAuth2OrganizationRule)
+	for _, r := range rules {
+		key := ruleKey{r.RuleType, normalizeRuleValue(r.RuleType, r.RuleValue)}
+		if key != self {
+			others[key] = r
+		}
+	}
+
+	mkLookup := func(match func(ruleKey) (OAuth2OrganizationRule, bool)) OAuth2OrgRuleLookup {
+		return func(provider string, ruleType OAuth2OrgRuleType,
+			ruleValue string) (*OAuth2OrganizationRule, error) {
+
+			key := ruleKey{ruleType, normalizeRuleValue(ruleType, ruleValue)}
+			if r, ok := match(key); ok {
+				return &r, nil
+			}
+			return nil, NotFoundError{fmt.Sprintf(
+				"OAuth2OrganizationRuleImpact: Couldn't find record for (%v,%v,%v)",
+				provider, ruleType, ruleValue)}
+		}
+	}
+	selfLookup := mkLookup(func(key ruleKey) (OAuth2OrganizationRule, bool) {
+		return *target, key == self
+	})
+	othersLookup := mkLookup(func(key ruleKey) (OAuth2OrganizationRule, bool) {
+		r, ok := others[key]
+		return r, ok
+	})
+
+	affected := make([]Account, 0)
+	for _, acct := range accts {
+		if target.RuleType != RuleTypeTenant {
+			_, err := MatchOAuth2OrganizationRule(target.Provider, "",
+				acct.Email, selfLookup)
+			if err != nil {
+				continue
+			}
+		}
+		alt, err := MatchOAuth2OrganizationRule(target.Provider, "",
+			acct.Email, othersLookup)
+		if err == nil && alt.OrganizationUUID == target.OrganizationUUID {
+			continue
+		}
+		affected = append(affected, acct)
+	}
+	return affected, nil
+}
+
 // AppSiteOrg is a tuple of the name and UUID of an appliance, its site, and its
 // organization.
 type AppSiteOrg struct {
@@ -995,3 +1541,71 @@ func (db *ApplianceDB) AppSiteOrgChain(ctx context.Context, appUUs []uuid.UUID)
 	return chain, err
 }
 
+// Reasons for which an appliance's organization may be inconsistent
+const (
+	MismatchNullSite  = "null site outside null organization"
+	MismatchNullOrg   = "site belongs to null organization"
+	MismatchHeartbeat = "latest heartbeat from another organization"
+)
+
+// ApplianceOrgMismatch describes an appliance whose site belongs to an
+// organization other than the one expected.  ExpectedOrgUUID is not valid if
+// any real organization would do.
+type ApplianceOrgMismatch struct {
+	AppUUID         uuid.UUID     `db:"app_uuid"`
+	AppName         string        `db:"app_name"`
+	SiteUUID        uuid.UUID     `db:"site_uuid"`
+	SiteName        string        `db:"site_name"`
+	OrgUUID         uuid.UUID     `db:"org_uuid"`
+	ExpectedOrgUUID uuid.NullUUID `db:"expected_org_uuid"`
+	Reason          string        `db:"reason"`
+}
+
+// InconsistentApplianceOrgs returns the appliances whose site belongs to an
+// unexpected organization.  An appliance registered to the null site should be
+// in the null organization; any other appliance should be in a real
+// organization, and in particular the organization of the site from which it
+// most recently sent a heartbeat.  Retired appliances are left out unless
+// includeRetired is set.
+func (db *ApplianceDB) InconsistentApplianceOrgs(ctx context.Context,
+	includeRetired bool) ([]ApplianceOrgMismatch, error) {
+
+	var mismatches []ApplianceOrgMismatch
+	err := db.SelectContext(ctx, &mismatches, `
+		WITH latest_hb AS (
+		    SELECT DISTINCT ON (appliance_uuid) appliance_uuid, site_uuid
+		    FROM heartbeat_ingest
+		    ORDER BY appliance_uuid, record_ts DESC, ingest_id DESC
+		), app AS (
+		    SELECT a.appliance_uuid AS app_uuid,
+		      a.appliance_reg_id AS app_name,
+		      s.uuid AS site_uuid,
+		      s.name AS site_name,
+		      s.organization_uuid AS org_uuid,
+		      hs.organization_uuid AS hb_org_uuid
+		    FROM appliance_id_map a
+		    JOIN customer_site s ON a.site_uuid = s.uuid
+		    LEFT JOIN latest_hb h ON a.appliance_uuid = h.appliance_uuid
+		    LEFT JOIN customer_site hs ON h.site_uuid = hs.uuid
+		    WHERE $6 OR a.lifecycle_state <> $7
+		)
+		SELECT app_uuid, app_name, site_uuid, site_name, org_uuid,
+		  CASE WHEN site_uuid = $1 THEN $2 ELSE hb_org_uuid END
+		    AS expected_org_uuid,
+		  CASE
+		    WHEN site_uuid = $1 THEN $3
+		    WHEN org_uuid = $2 THEN $4
+		    ELSE $5
+		  END AS reason
+		FROM app
+		WHERE
+		  (site_uuid = $1 AND org_uuid != $2) OR
+		  (site_uuid != $1 AND org_uuid = $2) OR
+		  (site_uuid != $1 AND hb_org_uuid != org_uuid)
+		ORDER BY app_uuid`,
+		NullSiteUUID, NullOrganizationUUID,
+		MismatchNullSite, MismatchNullOrg, MismatchHeartbeat,
+		includeRetired, LifecycleRetired)
+	return mismatches, err
+}
+
@@ -11,6 +11,7 @@ package appliancedb
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -22,6 +23,7 @@ import (
 	"time"
 
 	"bg/common/briefpg"
+	"bg/common/cfgmsg"
 
 	"github.com/guregu/null"
 	"github.com/satori/uuid"
@@ -153,7 +155,7 @@ var (
 	testAccount1 = Account{
 		UUID:             uuid.Must(uuid.FromString(account1Str)),
 		Email:            "foo@foo.net",
-		PhoneNumber:      "555-1212",
+		PhoneNumber:      "+16505551212",
 		PersonUUID:       testPerson1.UUID,
 		OrganizationUUID: testOrg1.UUID,
 		AvatarHash:       []byte{},
@@ -161,7 +163,7 @@ var (
 	testAccount2 = Account{
 		UUID:             uuid.Must(uuid.FromString(account2Str)),
 		Email:            "bar@bar.net",
-		PhoneNumber:      "555-2222",
+		PhoneNumber:      "+16505552222",
 		PersonUUID:       testPerson2.UUID,
 		OrganizationUUID: testOrg1.UUID,
 		AvatarHash:       []byte{},
@@ -169,7 +171,7 @@ var (
 	testMSPAccount1 = Account{
 		UUID:             uuid.Must(uuid.FromString(accountMSP1Str)),
 		Email:            "manager@msp.net",
-		PhoneNumber:      "555-1212",
+		PhoneNumber:      "+16505551212",
 		PersonUUID:       testMSPPerson1.UUID,
 		OrganizationUUID: testMSPOrg1.UUID,
 		AvatarHash:       []byte{},
@@ -177,7 +179,7 @@ var (
 	testMSPAccount2 = Account{
 		UUID:             uuid.Must(uuid.FromString(accountMSP2Str)),
 		Email:            "employee@msp.net",
-		PhoneNumber:      "555-1212",
+		PhoneNumber:      "+16505551212",
 		PersonUUID:       testMSPPerson2.UUID,
 		OrganizationUUID: testMSPOrg1.UUID,
 		AvatarHash:       []byte{},
@@ -322,6 +324,59 @@ func TestApplianceIDStruct(t *testing.T) {
 	assert.Equal(testClientID1, x.ClientID())
 }
 
+func TestMatchOAuth2OrganizationRule(t *testing.T) {
+	_, _ = setupLogging(t)
+	assert := require.New(t)
+
+	rules := []OAuth2OrganizationRule{
+		{"google", RuleTypeTenant, "tenant.example.com", testOrg1.UUID},
+		{"google", RuleTypeDomain, "example.com", testOrg2.UUID},
+		{"google", RuleTypeEmail, "user@example.com", testMSPOrg1.UUID},
+		{"google", RuleTypeEmail, "user@other.com", testOrg1.UUID},
+	}
+	lookup := func(provider string, ruleType OAuth2OrgRuleType,
+		ruleValue string) (*OAuth2OrganizationRule, error) {
+		for _, r := range rules {
+			if r.Provider == provider && r.RuleType == ruleType &&
+				r.RuleValue == ruleValue {
+				return &r, nil
+			}
+		}
+		return nil, NotFoundError{"no match"}
+	}
+
+	testCases := []struct {
+		provider string
+		tenant   string
+		email    string
+		expected uuid.UUID
+	}{
+		// tenant, then domain, then email
+		{"google", "tenant.example.com", "user@example.com", testOrg1.UUID},
+		{"google", "", "user@example.com", testOrg2.UUID},
+		{"google", "other-tenant", "user@example.com", testOrg2.UUID},
+		{"google", "", "user@other.com", testOrg1.UUID},
+		{"google", "tenant.example.com", "", testOrg1.UUID},
+		// no match
+		{"google", "", "", uuid.Nil},
+		{"google", "", "someone@other.com", uuid.Nil},
+		{"google", "", "example.com", uuid.Nil},
+		{"azureadv2", "tenant.example.com", "user@example.com", uuid.Nil},
+	}
+
+	for _, tc := range testCases {
+		rule, err := MatchOAuth2OrganizationRule(tc.provider, tc.tenant,
+			tc.email, lookup)
+		if tc.expected == uuid.Nil {
+			assert.Error(err)
+			assert.IsType(NotFoundError{}, err)
+		} else {
+			assert.NoError(err)
+			assert.Equal(tc.expected, rule.OrganizationUUID, "%v", tc)
+		}
+	}
+}
+
 type dbTestFunc func(*testing.T, DataStore, *zap.Logger, *zap.SugaredLogger)
 
 // mkOrgSiteApp is a help function to prep the database: if not nil, add
@@ -431,6 +486,109 @@ func testSiteNetException(t *testing.T, ds DataStore, logger *zap.Logger, slogge
 	mac := uint64(0x1122334455)
 	err = ds.InsertSiteNetException(ctx, testID1.SiteUUID, time.Now(), "foo", &mac, exc)
 	assert.NoError(err)
+
+	// Read them back a page at a time
+	recs, err := ds.SiteNetExceptionsBySite(ctx, testID1.SiteUUID, 0, 1)
+	assert.NoError(err)
+	assert.Len(recs, 1)
+	assert.Equal(testID1.SiteUUID, recs[0].SiteUUID)
+	assert.Equal("foo", recs[0].Reason.String)
+	assert.False(recs[0].MacAddr.Valid)
+	assert.JSONEq(exc, recs[0].Exception)
+
+	recs, err = ds.SiteNetExceptionsBySite(ctx, testID1.SiteUUID, recs[0].ID, 10)
+	assert.NoError(err)
+	assert.Len(recs, 1)
+	assert.Equal(int64(mac), recs[0].MacAddr.Int64)
+	recs, err = ds.SiteNetExceptionsBySite(ctx, testID1.SiteUUID, recs[0].ID, 10)
+	assert.NoError(err)
+	assert.NotNil(recs)
+	assert.Empty(recs)
+}
+
+// Test recording and retrieval of guest enrollment attempts.  subtest of
+// TestDatabaseModel
+func testGuestEnrollAttempt(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	ds.GuestEnrollSetPhoneKey([]byte("I LIKE COCONUTS"))
+	phone := "+16505551212"
+	attempt := GuestEnrollAttempt{
+		AccountUUID: uuid.NullUUID{UUID: testAccount1.UUID, Valid: true},
+		SiteUUID:    testSite1.UUID,
+		PhoneHash:   ds.HashGuestPhoneNumber(phone),
+		Result:      GuestEnrollSent,
+	}
+	// expect to fail because the site and account don't exist
+	err := ds.RecordGuestEnrollAttempt(ctx, attempt)
+	assert.Error(err)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, &testID2)
+	_ = mkAccount(t, ds, &testPerson1, &testAccount1, []string{"admin"})
+
+	start := time.Now().Add(-time.Minute)
+	attempts, err := ds.GuestEnrollAttemptsBySite(ctx, testSite1.UUID, start)
+	assert.NoError(err)
+	assert.Len(attempts, 0)
+
+	// An attempt from well before the query window
+	old := attempt
+	old.Timestamp = start.Add(-time.Hour)
+	err = ds.RecordGuestEnrollAttempt(ctx, old)
+	assert.NoError(err)
+
+	err = ds.RecordGuestEnrollAttempt(ctx, attempt)
+	assert.NoError(err)
+
+	failed := attempt
+	failed.Timestamp = time.Now().Add(time.Second)
+	failed.PhoneHash = []byte{}
+	failed.Result = GuestEnrollInvalidNumber
+	err = ds.RecordGuestEnrollAttempt(ctx, failed)
+	assert.NoError(err)
+
+	attempts, err = ds.GuestEnrollAttemptsBySite(ctx, testSite1.UUID, start)
+	assert.NoError(err)
+	assert.Len(attempts, 2)
+	// Most recent first
+	assert.Equal(GuestEnrollInvalidNumber, attempts[0].Result)
+	assert.Equal(failed.PhoneHash, attempts[0].PhoneHash)
+	assert.Equal(GuestEnrollSent, attempts[1].Result)
+	assert.Equal(attempt.PhoneHash, attempts[1].PhoneHash)
+	assert.Equal(attempt.AccountUUID, attempts[1].AccountUUID)
+	assert.Equal(testSite1.UUID, attempts[1].SiteUUID)
+	assert.WithinDuration(time.Now(), attempts[1].Timestamp, time.Minute)
+	assert.NotContains(string(attempts[1].PhoneHash), "555")
+	assert.Empty(attempts[0].PhoneHash)
+
+	// The hash depends on the key, so it can't be reversed by hashing every
+	// possible phone number without the key.
+	unkeyed := sha256.Sum256([]byte(phone))
+	assert.NotEqual(unkeyed[:], attempts[1].PhoneHash)
+	ds.GuestEnrollSetPhoneKey([]byte("I DO NOT LIKE COCONUTS"))
+	assert.NotEqual(attempt.PhoneHash, ds.HashGuestPhoneNumber(phone))
+	ds.GuestEnrollSetPhoneKey([]byte("I LIKE COCONUTS"))
+	assert.Equal(attempt.PhoneHash, ds.HashGuestPhoneNumber(phone))
+
+	attempts, err = ds.GuestEnrollAttemptsBySite(ctx, testSite1.UUID, old.Timestamp)
+	assert.NoError(err)
+	assert.Len(attempts, 3)
+
+	attempts, err = ds.GuestEnrollAttemptsBySite(ctx, testSite2.UUID, old.Timestamp)
+	assert.NoError(err)
+	assert.Len(attempts, 0)
+
+	// Attempts outlive the account which made them
+	err = ds.DeleteAccount(ctx, testAccount1.UUID)
+	assert.NoError(err)
+	attempts, err = ds.GuestEnrollAttemptsBySite(ctx, testSite1.UUID, old.Timestamp)
+	assert.NoError(err)
+	assert.Len(attempts, 3)
+	for _, a := range attempts {
+		assert.False(a.AccountUUID.Valid)
+	}
 }
 
 // Test insert of registry data.  subtest of TestDatabaseModel
@@ -516,6 +674,31 @@ func testApplianceID(t *testing.T, ds DataStore, logger *zap.Logger, slogger *za
 	assert.IsType(NotFoundError{}, err)
 }
 
+// Test lookup of an appliance's site by its client ID.  subtest of
+// TestDatabaseModel
+func testSiteUUIDByClientID(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	mkOrgSiteApp(t, ds, nil, nil, &testIDN)
+
+	site, err := ds.SiteUUIDByClientID(ctx, testClientID1)
+	assert.NoError(err)
+	assert.Equal(testSite1.UUID, site)
+
+	// Appliances not yet assigned to a site are at the null site
+	site, err = ds.SiteUUIDByClientID(ctx, testIDN.ClientID())
+	assert.NoError(err)
+	assert.Equal(NullSiteUUID, site)
+
+	_, err = ds.SiteUUIDByClientID(ctx, testClientID1+"-unknown")
+	assert.IsType(NotFoundError{}, err)
+
+	_, err = ds.SiteUUIDByClientID(ctx, "not-a-real-clientid")
+	assert.IsType(NotFoundError{}, err)
+}
+
 // Test operations related to appliance public keys.  subtest of TestDatabaseModel
 func testAppliancePubKey(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
 	ctx := context.Background()
@@ -629,6 +812,122 @@ func testCustomerSite(t *testing.T, ds DataStore, logger *zap.Logger, slogger *z
 	assert.Equal(chg, *schg)
 }
 
+// Test that stale updates of versioned records are rejected.  subtest of
+// TestDatabaseModel
+func testUpdateConflicts(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, nil)
+
+	// Two admins read the same organization; the first to write wins, and
+	// the second is told about the conflict rather than clobbering it.
+	org, err := ds.OrganizationByUUID(ctx, testOrg1.UUID)
+	assert.NoError(err)
+	assert.Equal(int64(1), org.Version)
+	first, second := *org, *org
+	first.Name = "first"
+	err = ds.UpdateOrganization(ctx, &first)
+	assert.NoError(err)
+	assert.Equal(int64(2), first.Version)
+	assert.False(first.UpdatedAt.Before(org.UpdatedAt))
+	second.Name = "second"
+	err = ds.UpdateOrganization(ctx, &second)
+	assert.Equal(ConflictError{
+		Table:    "organization",
+		Key:      testOrg1.UUID.String(),
+		Expected: 1,
+		Actual:   2,
+	}, err)
+	assert.Equal(int64(1), second.Version)
+	org, err = ds.OrganizationByUUID(ctx, testOrg1.UUID)
+	assert.NoError(err)
+	assert.Equal(first, *org)
+
+	// Having re-read the record, the second admin can apply their change
+	second = *org
+	second.Name = "second"
+	err = ds.UpdateOrganization(ctx, &second)
+	assert.NoError(err)
+	assert.Equal(int64(3), second.Version)
+
+	site, err := ds.CustomerSiteByUUID(ctx, testSite1.UUID)
+	assert.NoError(err)
+	stale := *site
+	site.Name = "renamed"
+	err = ds.UpdateCustomerSite(ctx, site)
+	assert.NoError(err)
+	stale.OrganizationUUID = testOrg2.UUID
+	err = ds.UpdateCustomerSite(ctx, &stale)
+	assert.IsType(ConflictError{}, err)
+	site, err = ds.CustomerSiteByUUID(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.Equal("renamed", site.Name)
+	assert.Equal(testOrg1.UUID, site.OrganizationUUID)
+
+	// Versions read through the list interfaces work too
+	sites, err := ds.CustomerSitesByOrganization(ctx, testOrg1.UUID)
+	assert.NoError(err)
+	assert.Len(sites, 1)
+	assert.Equal(site.Version, sites[0].Version)
+	sites, err = ds.AllCustomerSites(ctx)
+	assert.NoError(err)
+	for _, s := range sites {
+		if s.UUID == testSite1.UUID {
+			assert.Equal(site.Version, s.Version)
+		}
+	}
+
+	app, err := ds.ApplianceIDByUUID(ctx, testID1.ApplianceUUID)
+	assert.NoError(err)
+	stale2 := *app
+	app.SiteUUID = testSite2.UUID
+	err = ds.UpdateApplianceID(ctx, app)
+	assert.NoError(err)
+	stale2.SiteUUID = NullSiteUUID
+	err = ds.UpdateApplianceID(ctx, &stale2)
+	assert.IsType(ConflictError{}, err)
+	app, err = ds.ApplianceIDByUUID(ctx, testID1.ApplianceUUID)
+	assert.NoError(err)
+	assert.Equal(testSite2.UUID, app.SiteUUID)
+
+	// Updating a record which doesn't exist is not a conflict
+	missing := testOrg4
+	missing.Version = 1
+	err = ds.UpdateOrganization(ctx, &missing)
+	assert.IsType(NotFoundError{}, err)
+}
+
+// Test that cl.httpd's database role can rename a site.  subtest of
+// TestDatabaseModel
+func testHTTPDSiteRename(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+
+	site, err := ds.CustomerSiteByUUID(ctx, testSite1.UUID)
+	assert.NoError(err)
+
+	// Run the update with the privileges cl.httpd is granted
+	adb := ds.(*ApplianceDB)
+	tx, err := adb.BeginTxx(ctx, nil)
+	assert.NoError(err)
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "SET LOCAL ROLE httpd_group")
+	assert.NoError(err)
+
+	site.Name = "renamed by httpd"
+	err = ds.UpdateCustomerSiteTx(ctx, tx, site)
+	assert.NoError(err)
+	assert.NoError(tx.Commit())
+
+	site, err = ds.CustomerSiteByUUID(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.Equal("renamed by httpd", site.Name)
+}
+
 // Test AppSiteOrgChain().  subtest of TestDatabaseModel
 func testAppSiteOrgChain(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
 	ctx := context.Background()
@@ -660,6 +959,182 @@ func testAppSiteOrgChain(t *testing.T, ds DataStore, logger *zap.Logger, slogger
 	}
 }
 
+// Test detection of appliances in unexpected organizations.  subtest of
+// TestDatabaseModel
+func testInconsistentApplianceOrgs(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, &testID2)
+	mkOrgSiteApp(t, ds, nil, nil, &testIDN)
+
+	heartbeat := func(app, site uuid.UUID, age time.Duration) {
+		hb := HeartbeatIngest{
+			ApplianceUUID: app,
+			SiteUUID:      site,
+			BootTS:        time.Now().Add(-time.Hour),
+			RecordTS:      time.Now().Add(-age),
+		}
+		err := ds.InsertHeartbeatIngest(ctx, &hb)
+		assert.NoError(err)
+	}
+
+	// Everything starts out consistent
+	heartbeat(testID1.ApplianceUUID, testSite1.UUID, time.Minute)
+	heartbeat(testID2.ApplianceUUID, testSite2.UUID, 10*time.Minute)
+	mismatches, err := ds.InconsistentApplianceOrgs(ctx, false)
+	assert.NoError(err)
+	assert.Empty(mismatches)
+
+	// app2's latest heartbeat comes from a site in org1.  Older heartbeats
+	// from another organization don't matter.
+	heartbeat(testID2.ApplianceUUID, testSite1.UUID, time.Minute)
+	heartbeat(testID1.ApplianceUUID, testSite2.UUID, time.Hour)
+
+	// A site which was never assigned to a real organization
+	orphanSite := CustomerSite{
+		UUID:             uuid.Must(uuid.FromString("20000000-2000-2000-2000-000000000009")),
+		OrganizationUUID: NullOrganizationUUID,
+		Name:             "orphan",
+	}
+	orphanApp := ApplianceID{
+		ApplianceUUID:  uuid.Must(uuid.FromString("10000000-1000-1000-1000-000000000008")),
+		SiteUUID:       orphanSite.UUID,
+		GCPProject:     testProject,
+		GCPRegion:      testRegion,
+		ApplianceReg:   testReg,
+		ApplianceRegID: testRegID + "-orphan",
+	}
+	mkOrgSiteApp(t, ds, nil, &orphanSite, &orphanApp)
+
+	// The null site drifts into a real organization
+	_, err = ds.(*ApplianceDB).ExecContext(ctx,
+		"UPDATE customer_site SET organization_uuid=$1 WHERE uuid=$2",
+		testOrg1.UUID, NullSiteUUID)
+	assert.NoError(err)
+
+	mismatches, err = ds.InconsistentApplianceOrgs(ctx, false)
+	assert.NoError(err)
+	assert.Len(mismatches, 3)
+
+	// Results are sorted by appliance UUID
+	m := mismatches[0]
+	assert.Equal(testID2.ApplianceUUID, m.AppUUID)
+	assert.Equal(testID2.ApplianceRegID, m.AppName)
+	assert.Equal(testSite2.UUID, m.SiteUUID)
+	assert.Equal(testSite2.Name, m.SiteName)
+	assert.Equal(testOrg2.UUID, m.OrgUUID)
+	assert.Equal(uuid.NullUUID{UUID: testOrg1.UUID, Valid: true}, m.ExpectedOrgUUID)
+	assert.Equal(MismatchHeartbeat, m.Reason)
+
+	m = mismatches[1]
+	assert.Equal(orphanApp.ApplianceUUID, m.AppUUID)
+	assert.Equal(orphanSite.UUID, m.SiteUUID)
+	assert.Equal(NullOrganizationUUID, m.OrgUUID)
+	assert.False(m.ExpectedOrgUUID.Valid)
+	assert.Equal(MismatchNullOrg, m.Reason)
+
+	m = mismatches[2]
+	assert.Equal(testIDN.ApplianceUUID, m.AppUUID)
+	assert.Equal(NullSiteUUID, m.SiteUUID)
+	assert.Equal(testOrg1.UUID, m.OrgUUID)
+	assert.Equal(uuid.NullUUID{UUID: NullOrganizationUUID, Valid: true}, m.ExpectedOrgUUID)
+	assert.Equal(MismatchNullSite, m.Reason)
+
+	// Retired appliances are only reported on request
+	err = ds.SetApplianceLifecycle(ctx, testID2.ApplianceUUID, LifecycleRetired)
+	assert.NoError(err)
+	mismatches, err = ds.InconsistentApplianceOrgs(ctx, false)
+	assert.NoError(err)
+	assert.Len(mismatches, 2)
+	assert.Equal(orphanApp.ApplianceUUID, mismatches[0].AppUUID)
+	mismatches, err = ds.InconsistentApplianceOrgs(ctx, true)
+	assert.NoError(err)
+	assert.Len(mismatches, 3)
+	assert.Equal(testID2.ApplianceUUID, mismatches[0].AppUUID)
+}
+
+// Test appliance hardware lifecycle states.  subtest of TestDatabaseModel
+func testApplianceLifecycle(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, &testID2)
+
+	uuids := func(state string) []uuid.UUID {
+		ids, err := ds.AppliancesByLifecycle(ctx, state)
+		assert.NoError(err)
+		rval := make([]uuid.UUID, len(ids))
+		for i, id := range ids {
+			assert.Equal(state, id.LifecycleState)
+			rval[i] = id.ApplianceUUID
+		}
+		return rval
+	}
+	version := func(u uuid.UUID) int64 {
+		id, err := ds.ApplianceIDByUUID(ctx, u)
+		assert.NoError(err)
+		return id.Version
+	}
+
+	// New appliances are active
+	assert.Equal(LifecycleActive, testID1.LifecycleState)
+	assert.False(testID1.Retired())
+	assert.Equal([]uuid.UUID{testID1.ApplianceUUID, testID2.ApplianceUUID},
+		uuids(LifecycleActive))
+	assert.Empty(uuids(LifecycleRMARequested))
+	assert.Empty(uuids(LifecycleRetired))
+
+	// An RMA may be requested and abandoned; each change bumps the version
+	v := version(testID1.ApplianceUUID)
+	err := ds.SetApplianceLifecycle(ctx, testID1.ApplianceUUID, LifecycleRMARequested)
+	assert.NoError(err)
+	assert.Equal(v+1, version(testID1.ApplianceUUID))
+	assert.Equal([]uuid.UUID{testID1.ApplianceUUID}, uuids(LifecycleRMARequested))
+	assert.Equal([]uuid.UUID{testID2.ApplianceUUID}, uuids(LifecycleActive))
+
+	err = ds.SetApplianceLifecycle(ctx, testID1.ApplianceUUID, LifecycleRMARequested)
+	assert.NoError(err)
+	assert.Equal(v+1, version(testID1.ApplianceUUID))
+
+	err = ds.SetApplianceLifecycle(ctx, testID1.ApplianceUUID, LifecycleActive)
+	assert.NoError(err)
+	assert.Equal(v+2, version(testID1.ApplianceUUID))
+	assert.Empty(uuids(LifecycleRMARequested))
+
+	// Once retired, an appliance stays that way
+	err = ds.SetApplianceLifecycle(ctx, testID1.ApplianceUUID, LifecycleRMARequested)
+	assert.NoError(err)
+	err = ds.SetApplianceLifecycle(ctx, testID1.ApplianceUUID, LifecycleRetired)
+	assert.NoError(err)
+	err = ds.SetApplianceLifecycle(ctx, testID2.ApplianceUUID, LifecycleRetired)
+	assert.NoError(err)
+	assert.Equal([]uuid.UUID{testID1.ApplianceUUID, testID2.ApplianceUUID},
+		uuids(LifecycleRetired))
+	assert.Empty(uuids(LifecycleActive))
+
+	id, err := ds.ApplianceIDByUUID(ctx, testID1.ApplianceUUID)
+	assert.NoError(err)
+	assert.True(id.Retired())
+
+	for _, state := range []string{LifecycleActive, LifecycleRMARequested} {
+		err = ds.SetApplianceLifecycle(ctx, testID1.ApplianceUUID, state)
+		assert.IsType(ValidationError{}, err)
+	}
+	assert.Equal([]uuid.UUID{testID1.ApplianceUUID, testID2.ApplianceUUID},
+		uuids(LifecycleRetired))
+
+	// Bad states and appliances
+	err = ds.SetApplianceLifecycle(ctx, testID1.ApplianceUUID, "lost")
+	assert.IsType(ValidationError{}, err)
+	_, err = ds.AppliancesByLifecycle(ctx, "lost")
+	assert.IsType(ValidationError{}, err)
+	err = ds.SetApplianceLifecycle(ctx, uuid.NewV4(), LifecycleRetired)
+	assert.IsType(NotFoundError{}, err)
+}
+
 // Test OAuth2OrganizationRule APIs.  subtest of TestDatabaseModel
 func testOAuth2OrganizationRule(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
 	ctx := context.Background()
@@ -741,6 +1216,124 @@ func testOAuth2OrganizationRule(t *testing.T, ds DataStore, logger *zap.Logger,
 	assert.NoError(err)
 }
 
+// Test inserting a batch of OAuth2OrganizationRules.  subtest of
+// TestDatabaseModel
+func testOAuth2OrganizationRules(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	const testProvider = "google"
+
+	mkOrgSiteApp(t, ds, &testOrg1, nil, nil)
+
+	batch := []*OAuth2OrganizationRule{
+		{testProvider, RuleTypeTenant, "tenant.brightgate-test.net", testOrg1.UUID},
+		{testProvider, RuleTypeDomain, "brightgate-test.net", testOrg1.UUID},
+		{testProvider, RuleTypeDomain, "brightgate-test.com", testOrg1.UUID},
+		{testProvider, RuleTypeEmail, "foo@brightgate-test.org", testOrg1.UUID},
+	}
+
+	// An empty batch is fine
+	err := ds.InsertOAuth2OrganizationRules(ctx, nil)
+	assert.NoError(err)
+
+	// A duplicate within the batch (after case folding) spoils it all
+	dupBatch := append([]*OAuth2OrganizationRule{}, batch...)
+	dupBatch = append(dupBatch, &OAuth2OrganizationRule{
+		testProvider, RuleTypeDomain, "BrightGate-Test.NET", testOrg1.UUID})
+	err = ds.InsertOAuth2OrganizationRules(ctx, dupBatch)
+	assert.Error(err)
+	rules, err := ds.AllOAuth2OrganizationRules(ctx)
+	assert.NoError(err)
+	assert.Len(rules, 0)
+
+	err = ds.InsertOAuth2OrganizationRules(ctx, batch)
+	assert.NoError(err)
+	rules, err = ds.AllOAuth2OrganizationRules(ctx)
+	assert.NoError(err)
+	assert.Len(rules, len(batch))
+
+	// As does a duplicate of an existing rule
+	err = ds.InsertOAuth2OrganizationRules(ctx, []*OAuth2OrganizationRule{
+		{testProvider, RuleTypeEmail, "bar@brightgate-test.org", testOrg1.UUID},
+		batch[0],
+	})
+	assert.Error(err)
+	_, err = ds.OAuth2OrganizationRuleTest(ctx, testProvider, RuleTypeEmail,
+		"bar@brightgate-test.org")
+	assert.IsType(NotFoundError{}, err)
+	rules, err = ds.AllOAuth2OrganizationRules(ctx)
+	assert.NoError(err)
+	assert.Len(rules, len(batch))
+}
+
+// Test analysis of which accounts depend on an OAuth2 rule.  subtest of
+// TestDatabaseModel
+func testOAuth2OrganizationRuleImpact(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, nil, nil)
+	mkOrgSiteApp(t, ds, &testMSPOrg1, nil, nil)
+	// foo@foo.net and bar@bar.net, both in testOrg1
+	_ = mkAccount(t, ds, &testPerson1, &testAccount1, []string{"user"})
+	_ = mkAccount(t, ds, &testPerson2, &testAccount2, []string{"user"})
+	// manager@msp.net, in testMSPOrg1
+	_ = mkAccount(t, ds, &testMSPPerson1, &testMSPAccount1, []string{"user"})
+
+	mkRule := func(provider string, ruleType OAuth2OrgRuleType, value string,
+		org uuid.UUID) *OAuth2OrganizationRule {
+		rule := &OAuth2OrganizationRule{provider, ruleType, value, org}
+		err := ds.InsertOAuth2OrganizationRule(ctx, rule)
+		assert.NoError(err)
+		return rule
+	}
+	impact := func(rule *OAuth2OrganizationRule) []string {
+		accts, err := ds.OAuth2OrganizationRuleImpact(ctx, rule)
+		assert.NoError(err)
+		emails := make([]string, 0)
+		for _, a := range accts {
+			emails = append(emails, a.Email)
+		}
+		return emails
+	}
+
+	// Accounts covered by a single rule
+	fooDomain := mkRule("google", RuleTypeDomain, "foo.net", testOrg1.UUID)
+	assert.Equal([]string{"foo@foo.net"}, impact(fooDomain))
+
+	// ... and by two overlapping rules; rules match case-insensitively
+	fooEmail := mkRule("google", RuleTypeEmail, "Foo@FOO.net", testOrg1.UUID)
+	assert.Empty(impact(fooDomain))
+	assert.Empty(impact(fooEmail))
+
+	// Rules which cover no accounts
+	unused := mkRule("google", RuleTypeDomain, "unused.net", testOrg1.UUID)
+	assert.Empty(impact(unused))
+	azure := mkRule("azureadv2", RuleTypeDomain, "bar.net", testOrg1.UUID)
+	assert.Empty(impact(azure))
+	msp := mkRule("google", RuleTypeDomain, "msp.net", testOrg1.UUID)
+	assert.Empty(impact(msp))
+
+	// Tenant IDs aren't recorded, so a tenant rule is assumed to cover
+	// every account in the org which isn't covered by some other rule.
+	tenant := mkRule("google", RuleTypeTenant, "foo-tenant", testOrg1.UUID)
+	assert.Equal([]string{"bar@bar.net"}, impact(tenant))
+
+	// An overlapping rule which maps the account to a different org doesn't
+	// count as coverage.
+	barDomain := mkRule("google", RuleTypeDomain, "bar.net", testOrg1.UUID)
+	assert.Equal([]string{"bar@bar.net"}, impact(barDomain))
+	_ = mkRule("google", RuleTypeEmail, "bar@bar.net", testMSPOrg1.UUID)
+	assert.Equal([]string{"bar@bar.net"}, impact(barDomain))
+
+	// Once the domain rule for foo.net is gone, foo@foo.net depends on the
+	// email rule.
+	err := ds.DeleteOAuth2OrganizationRule(ctx, fooDomain)
+	assert.NoError(err)
+	assert.Equal([]string{"foo@foo.net"}, impact(fooEmail))
+}
+
 // Test Person APIs.  subtest of TestDatabaseModel
 func testPerson(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
 	ctx := context.Background()
@@ -811,6 +1404,7 @@ func testAccount(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.Su
 		PhoneNumber:  testAccount1.PhoneNumber,
 		Name:         testPerson1.Name,
 		PrimaryEmail: testPerson1.PrimaryEmail,
+		Locale:       DefaultLocale,
 	}
 
 	acctInfo, err := ds.AccountInfoByUUID(ctx, testAccount1.UUID)
@@ -1054,6 +1648,18 @@ func testAccountOrgRole(t *testing.T, ds DataStore, logger *zap.Logger, slogger
 	assert.Len(roles, 0)
 }
 
+// selfRole returns the AccountOrgRole giving an account a role in its own
+// organization
+func selfRole(account *Account, role string) AccountOrgRole {
+	return AccountOrgRole{
+		AccountUUID:            account.UUID,
+		OrganizationUUID:       account.OrganizationUUID,
+		TargetOrganizationUUID: account.OrganizationUUID,
+		Relationship:           "self",
+		Role:                   role,
+	}
+}
+
 // Test AccountOrgRole APIs for MSP use cases.  subtest of TestDatabaseModel
 func testAccountOrgRoleMSP(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
 	ctx := context.Background()
@@ -1104,6 +1710,302 @@ func testAccountOrgRoleMSP(t *testing.T, ds DataStore, logger *zap.Logger, slogg
 	assert.NoError(err)
 	assert.Len(aoroles, 1)
 	assertRolesMatch(t, aoroles, &testAccount2, testAccount2.OrganizationUUID, "self", allLimitRoles, []string{"user"})
+
+	// Reach the same target through a second relationship; each
+	// relationship gets its own row, with its own roles.
+	supportRel := OrgOrgRelationship{
+		UUID:                   uuid.NewV4(),
+		OrganizationUUID:       testMSPOrg1.UUID,
+		TargetOrganizationUUID: testOrg1.UUID,
+		Relationship:           "support",
+	}
+	err = ds.InsertOrgOrgRelationship(ctx, &supportRel)
+	assert.NoError(err)
+	userRoleSupport := AccountOrgRole{
+		AccountUUID:            testMSPAccount1.UUID,
+		OrganizationUUID:       testMSPOrg1.UUID,
+		TargetOrganizationUUID: testOrg1.UUID,
+		Relationship:           "support",
+		Role:                   "user",
+	}
+	err = ds.InsertAccountOrgRole(ctx, &userRoleSupport)
+	assert.NoError(err)
+
+	aoroles, err = ds.AccountOrgRolesByAccount(ctx, testMSPAccount1.UUID)
+	assert.NoError(err)
+	assert.Len(aoroles, 3)
+	assertRolesMatch(t, aoroles, &testMSPAccount1, testMSPAccount1.OrganizationUUID, "self", allLimitRoles, []string{"admin", "user"})
+	assertRolesMatch(t, aoroles, &testMSPAccount1, testOrg1.UUID, "msp", allLimitRoles, []string{"admin"})
+	assertRolesMatch(t, aoroles, &testMSPAccount1, testOrg1.UUID, "support", allLimitRoles, []string{"user"})
+
+	aoroles, err = ds.AccountOrgRolesByAccountTarget(ctx, testMSPAccount1.UUID, testOrg1.UUID)
+	assert.NoError(err)
+	assert.Len(aoroles, 2)
+	assertRolesMatch(t, aoroles, &testMSPAccount1, testOrg1.UUID, "msp", allLimitRoles, []string{"admin"})
+	assertRolesMatch(t, aoroles, &testMSPAccount1, testOrg1.UUID, "support", allLimitRoles, []string{"user"})
+
+	aoroles, err = ds.AccountOrgRolesByAccountTarget(ctx, testMSPAccount2.UUID, testOrg1.UUID)
+	assert.NoError(err)
+	assert.Len(aoroles, 2)
+	assertRolesMatch(t, aoroles, &testMSPAccount2, testOrg1.UUID, "msp", allLimitRoles, []string{})
+	assertRolesMatch(t, aoroles, &testMSPAccount2, testOrg1.UUID, "support", allLimitRoles, []string{})
+
+	roles, err := ds.AccountOrgRolesByOrg(ctx, testOrg1.UUID, "")
+	assert.NoError(err)
+	assert.ElementsMatch([]AccountOrgRole{
+		adminRoleMSP,
+		userRoleSupport,
+		selfRole(&testAccount1, "admin"),
+		selfRole(&testAccount1, "user"),
+		selfRole(&testAccount2, "user"),
+	}, roles)
+
+	rolesStrs, err := ds.AccountPrimaryOrgRoles(ctx, testMSPAccount1.UUID)
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"admin", "user"}, rolesStrs)
+
+	// Narrow the limit roles of the support and self relationships; the
+	// roles which now exceed them are filtered out by every method.
+	_, err = ds.(*ApplianceDB).ExecContext(ctx, `
+		DELETE FROM relationship_roles
+		WHERE (relationship, role) IN (('support', 'user'), ('self', 'admin'))`)
+	assert.NoError(err)
+
+	aoroles, err = ds.AccountOrgRolesByAccount(ctx, testMSPAccount1.UUID)
+	assert.NoError(err)
+	assert.Len(aoroles, 3)
+	assertRolesMatch(t, aoroles, &testMSPAccount1, testMSPAccount1.OrganizationUUID, "self", []string{"user"}, []string{"user"})
+	assertRolesMatch(t, aoroles, &testMSPAccount1, testOrg1.UUID, "msp", allLimitRoles, []string{"admin"})
+	assertRolesMatch(t, aoroles, &testMSPAccount1, testOrg1.UUID, "support", []string{"admin"}, []string{})
+
+	aoroles, err = ds.AccountOrgRolesByAccountTarget(ctx, testMSPAccount1.UUID, testOrg1.UUID)
+	assert.NoError(err)
+	assert.Len(aoroles, 2)
+	assertRolesMatch(t, aoroles, &testMSPAccount1, testOrg1.UUID, "msp", allLimitRoles, []string{"admin"})
+	assertRolesMatch(t, aoroles, &testMSPAccount1, testOrg1.UUID, "support", []string{"admin"}, []string{})
+
+	roles, err = ds.AccountOrgRolesByOrg(ctx, testOrg1.UUID, "")
+	assert.NoError(err)
+	assert.ElementsMatch([]AccountOrgRole{
+		adminRoleMSP,
+		selfRole(&testAccount1, "user"),
+		selfRole(&testAccount2, "user"),
+	}, roles)
+
+	roles, err = ds.AccountOrgRolesByOrg(ctx, testOrg1.UUID, "admin")
+	assert.NoError(err)
+	assert.ElementsMatch([]AccountOrgRole{adminRoleMSP}, roles)
+
+	rolesStrs, err = ds.AccountPrimaryOrgRoles(ctx, testMSPAccount1.UUID)
+	assert.NoError(err)
+	assert.Equal([]string{"user"}, rolesStrs)
+
+	// ... but the grants themselves remain
+	grants, err := ds.AccountOrgRoleGrantsByAccount(ctx, testMSPAccount1.UUID)
+	assert.NoError(err)
+	assert.ElementsMatch([]AccountOrgRole{
+		adminRoleMSP,
+		userRoleSupport,
+		selfRole(&testMSPAccount1, "admin"),
+		selfRole(&testMSPAccount1, "user"),
+	}, grants)
+	rolesStrs, err = ds.AccountPrimaryOrgRoles(ctx, testAccount1.UUID)
+	assert.NoError(err)
+	assert.Equal([]string{"user"}, rolesStrs)
+}
+
+// Test merging duplicate accounts.  subtest of TestDatabaseModel
+func testMergeAccounts(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testMSPOrg1, nil, nil)
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, nil)
+
+	id1 := mkAccount(t, ds, &testPerson1, &testAccount1, []string{"user"})
+	id2 := mkAccount(t, ds, &testPerson2, &testAccount2, []string{"admin", "user"})
+	mspID := mkAccount(t, ds, &testMSPPerson1, &testMSPAccount1, []string{"admin"})
+
+	ds.AccountSecretsSetPassphrase([]byte("I LIKE COCONUTS"))
+	err := ds.UpsertAccountSecrets(ctx, &AccountSecrets{testAccount2.UUID,
+		"k1", "regime", time.Now(), "k2", "regime", time.Now()})
+	assert.NoError(err)
+
+	// Accounts in different organizations can't be merged
+	err = ds.MergeAccounts(ctx, testAccount1.UUID, testMSPAccount1.UUID)
+	assert.IsType(ValidationError{}, err)
+	assert.Equal("organization_uuid", err.(ValidationError).Field)
+	ids, err := ds.OAuth2IdentitiesByAccount(ctx, testMSPAccount1.UUID)
+	assert.NoError(err)
+	assert.Equal([]OAuth2Identity{*mspID}, ids)
+	_, err = ds.AccountByUUID(ctx, testMSPAccount1.UUID)
+	assert.NoError(err)
+
+	err = ds.MergeAccounts(ctx, testAccount1.UUID, testAccount1.UUID)
+	assert.IsType(ValidationError{}, err)
+	err = ds.MergeAccounts(ctx, testAccount1.UUID, badUUID)
+	assert.IsType(NotFoundError{}, err)
+	err = ds.MergeAccounts(ctx, badUUID, testAccount2.UUID)
+	assert.IsType(NotFoundError{}, err)
+
+	// A clean merge
+	err = ds.MergeAccounts(ctx, testAccount1.UUID, testAccount2.UUID)
+	assert.NoError(err)
+
+	ids, err = ds.OAuth2IdentitiesByAccount(ctx, testAccount1.UUID)
+	assert.NoError(err)
+	assert.ElementsMatch([]OAuth2Identity{
+		*id1,
+		{
+			ID:          id2.ID,
+			Provider:    id2.Provider,
+			Subject:     id2.Subject,
+			AccountUUID: testAccount1.UUID,
+		},
+	}, ids)
+
+	// Logging in with the removed account's identity yields the kept one
+	li, err := ds.LoginInfoByProviderAndSubject(ctx, id2.Provider, id2.Subject)
+	assert.NoError(err)
+	assert.Equal(testAccount1, li.Account)
+	assert.Equal(testPerson1, li.Person)
+
+	roles, err := ds.AccountPrimaryOrgRoles(ctx, testAccount1.UUID)
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"admin", "user"}, roles)
+
+	_, err = ds.AccountByUUID(ctx, testAccount2.UUID)
+	assert.IsType(NotFoundError{}, err)
+	_, err = ds.PersonByUUID(ctx, testPerson2.UUID)
+	assert.IsType(NotFoundError{}, err)
+	_, err = ds.AccountSecretsByUUID(ctx, testAccount2.UUID)
+	assert.IsType(NotFoundError{}, err)
+	ids, err = ds.OAuth2IdentitiesByAccount(ctx, testAccount2.UUID)
+	assert.NoError(err)
+	assert.Empty(ids)
+
+	// The kept account is otherwise untouched
+	acct, err := ds.AccountByUUID(ctx, testAccount1.UUID)
+	assert.NoError(err)
+	assert.Equal(testAccount1, *acct)
+}
+
+// Test finding persons who share a primary email.  subtest of
+// TestDatabaseModel
+func testDuplicatePrimaryEmails(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testMSPOrg1, nil, nil)
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, nil)
+
+	dups, err := ds.DuplicatePrimaryEmails(ctx)
+	assert.NoError(err)
+	assert.Empty(dups)
+
+	_ = mkAccount(t, ds, &testPerson1, &testAccount1, []string{"user"})
+	_ = mkAccount(t, ds, &testPerson2, &testAccount2, []string{"user"})
+	_ = mkAccount(t, ds, &testMSPPerson1, &testMSPAccount1, []string{"admin"})
+
+	dups, err = ds.DuplicatePrimaryEmails(ctx)
+	assert.NoError(err)
+	assert.Empty(dups)
+
+	// The MSP's person has the same address as testPerson1, as stored
+	// before normalization was introduced.
+	adb := ds.(*ApplianceDB)
+	_, err = adb.ExecContext(ctx,
+		`UPDATE person SET primary_email=$1 WHERE uuid=$2`,
+		" Foo@FOO.net", testMSPPerson1.UUID)
+	assert.NoError(err)
+
+	dups, err = ds.DuplicatePrimaryEmails(ctx)
+	assert.NoError(err)
+	assert.Len(dups, 1)
+	dup := dups[0]
+	assert.Equal("foo@foo.net", dup.Email)
+	assert.ElementsMatch([]uuid.UUID{testPerson1.UUID, testMSPPerson1.UUID},
+		dup.Persons)
+	assert.ElementsMatch([]uuid.UUID{testAccount1.UUID, testMSPAccount1.UUID},
+		dup.Accounts)
+	assert.ElementsMatch([]uuid.UUID{testOrg1.UUID, testMSPOrg1.UUID},
+		dup.Organizations)
+}
+
+// Test listing the accounts holding a role in an organization.  subtest of
+// TestDatabaseModel
+func testAccountsByOrgAndRole(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testMSPOrg1, nil, nil)
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, nil)
+
+	mkAccount(t, ds, &testMSPPerson1, &testMSPAccount1, []string{"admin", "user"})
+	mkAccount(t, ds, &testMSPPerson2, &testMSPAccount2, nil)
+	mkAccount(t, ds, &testPerson1, &testAccount1, []string{"admin", "user"})
+	mkAccount(t, ds, &testPerson2, &testAccount2, []string{"user"})
+
+	err := ds.InsertOrgOrgRelationship(ctx, &testOrgOrgRel1)
+	assert.NoError(err)
+	err = ds.InsertAccountOrgRole(ctx, &AccountOrgRole{
+		AccountUUID:            testMSPAccount1.UUID,
+		OrganizationUUID:       testMSPOrg1.UUID,
+		TargetOrganizationUUID: testOrg1.UUID,
+		Relationship:           "msp",
+		Role:                   "admin",
+	})
+	assert.NoError(err)
+
+	uuids := func(org uuid.UUID, role string) []uuid.UUID {
+		accts, err := ds.AccountsByOrgAndRole(ctx, org, role)
+		assert.NoError(err)
+		assert.NotNil(accts)
+		u := make([]uuid.UUID, 0)
+		for _, a := range accts {
+			u = append(u, a.UUID)
+		}
+		return u
+	}
+
+	// Admins of the org include the MSP's admin
+	accts, err := ds.AccountsByOrgAndRole(ctx, testOrg1.UUID, "admin")
+	assert.NoError(err)
+	assert.Len(accts, 2)
+	assert.Equal(testAccount1.UUID, accts[0].UUID)
+	assert.Equal(testPerson1.Name, accts[0].Name)
+	assert.Equal(testAccount1.Email, accts[0].Email)
+	assert.Equal(testMSPAccount1.UUID, accts[1].UUID)
+	assert.Equal(testMSPPerson1.Name, accts[1].Name)
+
+	assert.Equal([]uuid.UUID{testAccount2.UUID, testAccount1.UUID},
+		uuids(testOrg1.UUID, "user"))
+
+	// Any role; the MSP account with no roles is left out, and the MSP
+	// admin appears only once.
+	assert.Equal([]uuid.UUID{testAccount2.UUID, testAccount1.UUID,
+		testMSPAccount1.UUID}, uuids(testOrg1.UUID, ""))
+
+	// Roles held in the target org don't leak back to the MSP
+	assert.Equal([]uuid.UUID{testMSPAccount1.UUID},
+		uuids(testMSPOrg1.UUID, "admin"))
+	assert.Equal([]uuid.UUID{testMSPAccount1.UUID},
+		uuids(testMSPOrg1.UUID, "user"))
+
+	assert.Empty(uuids(testOrg1.UUID, "bogus"))
+	assert.Empty(uuids(badUUID, "admin"))
+
+	// Revoking a role removes the account from the list
+	err = ds.DeleteAccountOrgRole(ctx, &AccountOrgRole{
+		AccountUUID:            testMSPAccount1.UUID,
+		OrganizationUUID:       testMSPOrg1.UUID,
+		TargetOrganizationUUID: testOrg1.UUID,
+		Relationship:           "msp",
+		Role:                   "admin",
+	})
+	assert.NoError(err)
+	assert.Equal([]uuid.UUID{testAccount1.UUID},
+		uuids(testOrg1.UUID, "admin"))
 }
 
 func testOAuth2Identity(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
@@ -1543,13 +2445,226 @@ func testCommandQueue(t *testing.T, ds DataStore, logger *zap.Logger, slogger *z
 	assert.NoError(err)
 	assert.Len(cmds, 0)
 
-	cmds, err = ds.CommandAuditHealth(ctx, su1, time.Now())
+	cmds, err = ds.CommandAuditHealth(ctx, su1, time.Now(), false)
 	assert.NoError(err)
 	assert.Len(cmds, 10)
 
-	cmds, err = ds.CommandAuditHealth(ctx, su1, time.Now().Add(-1*time.Minute))
+	cmds, err = ds.CommandAuditHealth(ctx, su1, time.Now().Add(-1*time.Minute), false)
+	assert.NoError(err)
+	assert.Len(cmds, 0)
+}
+
+// Test archiving and unarchiving sites.  subtest of TestDatabaseModel
+func testCustomerSiteArchive(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	_ = mkAccount(t, ds, &testPerson1, &testAccount1, []string{"admin"})
+
+	err := ds.ArchiveCustomerSite(ctx, badUUID)
+	assert.IsType(NotFoundError{}, err)
+	err = ds.UnarchiveCustomerSite(ctx, badUUID)
+	assert.IsType(NotFoundError{}, err)
+
+	site, err := ds.CustomerSiteByUUID(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.False(site.Archived())
+	version := site.Version
+
+	err = ds.ArchiveCustomerSite(ctx, testSite1.UUID)
+	assert.NoError(err)
+	site, err = ds.CustomerSiteByUUID(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.True(site.Archived())
+	assert.Equal(version+1, site.Version)
+	archivedAt := site.ArchivedAt.Time
+
+	// Archiving the site again doesn't change when it was archived
+	err = ds.ArchiveCustomerSite(ctx, testSite1.UUID)
+	assert.NoError(err)
+	site, err = ds.CustomerSiteByUUID(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.True(site.ArchivedAt.Time.Equal(archivedAt))
+	assert.Equal(version+1, site.Version)
+
+	// Archived sites are still listed, marked as such
+	sites, err := ds.CustomerSitesByAccount(ctx, testAccount1.UUID)
+	assert.NoError(err)
+	assert.Len(sites, 1)
+	assert.True(sites[0].Archived())
+	sites, err = ds.AllCustomerSites(ctx)
+	assert.NoError(err)
+	for _, s := range sites {
+		assert.Equal(s.UUID == testSite1.UUID, s.Archived())
+	}
+
+	// An archived site can still be renamed
+	site.Name = "Summer Camp (closed)"
+	err = ds.UpdateCustomerSite(ctx, site)
+	assert.NoError(err)
+
+	err = ds.UnarchiveCustomerSite(ctx, testSite1.UUID)
+	assert.NoError(err)
+	site, err = ds.CustomerSiteByUUID(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.False(site.Archived())
+	assert.Equal("Summer Camp (closed)", site.Name)
+	assert.Equal(version+3, site.Version)
+	sites, err = ds.CustomerSitesByAccount(ctx, testAccount1.UUID)
+	assert.NoError(err)
+	assert.False(sites[0].Archived())
+}
+
+// Test that archived sites can't be sent commands, and are left out of
+// command health reports.  subtest of TestDatabaseModel
+func testCommandQueueArchived(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, &testID2)
+	su1 := uuid.NullUUID{UUID: testSite1.UUID, Valid: true}
+	sNull := uuid.NullUUID{}
+
+	// A stuck command at each site
+	enqTime := time.Now().Add(-10 * time.Minute)
+	for _, u := range []uuid.UUID{testSite1.UUID, testSite2.UUID} {
+		cmd := &SiteCommand{
+			EnqueuedTime: enqTime,
+			Query:        []byte("stuck"),
+		}
+		assert.NoError(ds.CommandSubmit(ctx, u, cmd))
+	}
+	cmds, err := ds.CommandAuditHealth(ctx, sNull, time.Now(), false)
+	assert.NoError(err)
+	assert.Len(cmds, 2)
+
+	assert.NoError(ds.ArchiveCustomerSite(ctx, testSite1.UUID))
+
+	// The archived site no longer accepts commands
+	cmd := &SiteCommand{
+		EnqueuedTime: time.Now(),
+		Query:        []byte("rejected"),
+	}
+	err = ds.CommandSubmit(ctx, testSite1.UUID, cmd)
+	assert.IsType(SiteArchivedError{}, err)
+	assert.Equal(testSite1.UUID, err.(SiteArchivedError).SiteUUID)
+	assert.Zero(cmd.ID)
+	cmd.Query = []byte("accepted")
+	assert.NoError(ds.CommandSubmit(ctx, testSite2.UUID, cmd))
+
+	// Its stuck command is no longer reported, unless asked for
+	cmds, err = ds.CommandAuditHealth(ctx, sNull, time.Now(), false)
+	assert.NoError(err)
+	assert.Len(cmds, 1)
+	assert.Equal(testSite2.UUID, cmds[0].UUID)
+	cmds, err = ds.CommandAuditHealth(ctx, su1, time.Now(), false)
 	assert.NoError(err)
 	assert.Len(cmds, 0)
+	cmds, err = ds.CommandAuditHealth(ctx, sNull, time.Now(), true)
+	assert.NoError(err)
+	assert.Len(cmds, 2)
+	cmds, err = ds.CommandAuditHealth(ctx, su1, time.Now(), true)
+	assert.NoError(err)
+	assert.Len(cmds, 1)
+
+	// Unarchiving the site restores it to normal
+	assert.NoError(ds.UnarchiveCustomerSite(ctx, testSite1.UUID))
+	cmds, err = ds.CommandAuditHealth(ctx, sNull, time.Now(), false)
+	assert.NoError(err)
+	assert.Len(cmds, 2)
+	cmd = &SiteCommand{
+		EnqueuedTime: time.Now(),
+		Query:        []byte("welcome back"),
+	}
+	assert.NoError(ds.CommandSubmit(ctx, testSite1.UUID, cmd))
+	assert.NotZero(cmd.ID)
+}
+
+func testCommandsTouchingPath(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, &testID2)
+
+	ring := "@/clients/00:11:22:33:44:55/ring"
+	submit := func(u uuid.UUID, enq time.Time, ops ...*cfgmsg.ConfigOp) int64 {
+		query, err := json.Marshal(&cfgmsg.ConfigQuery{Ops: ops})
+		assert.NoError(err)
+		cmd := &SiteCommand{
+			EnqueuedTime: enq,
+			Query:        query,
+		}
+		assert.NoError(ds.CommandSubmit(ctx, u, cmd))
+		return cmd.ID
+	}
+	op := func(operation cfgmsg.ConfigOp_Operation, prop string) *cfgmsg.ConfigOp {
+		return &cfgmsg.ConfigOp{Operation: operation, Property: prop}
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	now := time.Now()
+	since := now.Add(-time.Hour)
+
+	// Too old to be found
+	submit(testSite1.UUID, old, op(cfgmsg.ConfigOp_SET, ring))
+	// The property itself, among other operations
+	setRing := submit(testSite1.UUID, now,
+		op(cfgmsg.ConfigOp_TEST, "@/clients/00:11:22:33:44:55"),
+		op(cfgmsg.ConfigOp_SET, ring))
+	// A sibling, and a client whose address shares a prefix
+	submit(testSite1.UUID, now,
+		op(cfgmsg.ConfigOp_SET, "@/clients/00:11:22:33:44:55/dns_name"))
+	submit(testSite1.UUID, now,
+		op(cfgmsg.ConfigOp_SET, "@/clients/00:11:22:33:44:55:66/ring"))
+	// Reading the whole tree doesn't count, but deleting an ancestor does
+	submit(testSite1.UUID, now, op(cfgmsg.ConfigOp_GET, "@/"))
+	delClient := submit(testSite1.UUID, now,
+		op(cfgmsg.ConfigOp_DELETE, "@/clients/00:11:22:33:44:55"))
+	// Payloads which aren't queries are passed over
+	cmd := &SiteCommand{EnqueuedTime: now, Query: []byte("not json")}
+	assert.NoError(ds.CommandSubmit(ctx, testSite1.UUID, cmd))
+	// Another site's commands are left out
+	submit(testSite2.UUID, now, op(cfgmsg.ConfigOp_SET, ring))
+
+	ids := func(cmds []*SiteCommand) []int64 {
+		rval := make([]int64, len(cmds))
+		for i, c := range cmds {
+			rval[i] = c.ID
+		}
+		return rval
+	}
+
+	cmds, err := ds.CommandsTouchingPath(ctx, testSite1.UUID, ring, since)
+	assert.NoError(err)
+	assert.Equal([]int64{setRing, delClient}, ids(cmds))
+	assert.Equal("ENQD", cmds[0].State)
+
+	// A trailing slash makes no difference
+	cmds, err = ds.CommandsTouchingPath(ctx, testSite1.UUID, ring+"/", since)
+	assert.NoError(err)
+	assert.Equal([]int64{setRing, delClient}, ids(cmds))
+
+	// Going back further finds the older command too
+	cmds, err = ds.CommandsTouchingPath(ctx, testSite1.UUID, ring,
+		old.Add(-time.Minute))
+	assert.NoError(err)
+	assert.Len(cmds, 3)
+
+	// Everything under a client, but not the similarly named one
+	cmds, err = ds.CommandsTouchingPath(ctx, testSite1.UUID,
+		"@/clients/00:11:22:33:44:55", since)
+	assert.NoError(err)
+	assert.Len(cmds, 3)
+
+	cmds, err = ds.CommandsTouchingPath(ctx, testSite1.UUID, "@/users", since)
+	assert.NoError(err)
+	assert.Empty(cmds)
+
+	_, err = ds.CommandsTouchingPath(ctx, testSite1.UUID, "clients", since)
+	assert.IsType(ValidationError{}, err)
 }
 
 // make a template database, loaded with the schema.  Subsequently
@@ -1568,10 +2683,127 @@ func mkTemplate(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to load schema: %+v", err)
 	}
+
+	// Replace the seed rows created by the schema files with those from
+	// Bootstrap, so that the tests show that it leaves a working registry.
+	err = clearBootstrapSeeds(ctx, templateDB.(*ApplianceDB))
+	if err != nil {
+		return fmt.Errorf("failed to clear seed rows: %+v", err)
+	}
+	findings, err := templateDB.Bootstrap(ctx, BootstrapOpts{})
+	if err != nil {
+		return fmt.Errorf("failed to bootstrap: %+v", err)
+	}
+	var seeds int
+	for _, s := range bootstrapSeeds {
+		seeds += len(s.rows)
+	}
+	if len(findings) != seeds {
+		return fmt.Errorf("bootstrap created %d of %d seed rows",
+			len(findings), seeds)
+	}
 	return nil
 }
 
-func TestDatabaseModel(t *testing.T) {
+// The subtests of TestDatabaseModel and TestDatabaseTZ
+var dbTestCases = []struct {
+	name  string
+	tFunc dbTestFunc
+}{
+	{"testPing", testPing},
+	{"testTimestampColumns", testTimestampColumns},
+	{"testTimestampRoundTrip", testTimestampRoundTrip},
+	{"testHeartbeatIngest", testHeartbeatIngest},
+	{"testSiteNetException", testSiteNetException},
+	{"testGuestEnrollAttempt", testGuestEnrollAttempt},
+	{"testApplianceID", testApplianceID},
+	{"testSiteUUIDByClientID", testSiteUUIDByClientID},
+	{"testAppliancePubKey", testAppliancePubKey},
+	{"testInconsistentApplianceOrgs", testInconsistentApplianceOrgs},
+	{"testApplianceLifecycle", testApplianceLifecycle},
+
+	{"testOrganization", testOrganization},
+	{"testCustomerSite", testCustomerSite},
+	{"testCustomerSiteArchive", testCustomerSiteArchive},
+	{"testUpdateConflicts", testUpdateConflicts},
+	{"testHTTPDSiteRename", testHTTPDSiteRename},
+	{"testOAuth2OrganizationRule", testOAuth2OrganizationRule},
+	{"testOAuth2OrganizationRules", testOAuth2OrganizationRules},
+	{"testOAuth2OrganizationRuleImpact", testOAuth2OrganizationRuleImpact},
+	{"testPerson", testPerson},
+	{"testAccount", testAccount},
+	{"testAccountOrgRole", testAccountOrgRole},
+	{"testAccountOrgRoleMSP", testAccountOrgRoleMSP},
+	{"testAccountsByOrgAndRole", testAccountsByOrgAndRole},
+	{"testMergeAccounts", testMergeAccounts},
+	{"testDuplicatePrimaryEmails", testDuplicatePrimaryEmails},
+	{"testOAuth2Identity", testOAuth2Identity},
+	{"testOrgOrg", testOrgOrg},
+
+	{"testCloudStorage", testCloudStorage},
+	{"testUnittestData", testUnittestData},
+	{"testConfigStore", testConfigStore},
+
+	{"testCommandQueue", testCommandQueue},
+	{"testCommandQueueArchived", testCommandQueueArchived},
+	{"testCommandsTouchingPath", testCommandsTouchingPath},
+	{"testCheckpoints", testCheckpoints},
+	{"testCheckpointRetention", testCheckpointRetention},
+	{"testNotes", testNotes},
+	{"testNoteValidation", testNoteValidation},
+	{"testNoteTombstones", testNoteTombstones},
+	{"testServerCerts", testServerCerts},
+	{"testServerCertsDelete", testServerCertsDelete},
+	{"testSiteCertCoverage", testSiteCertCoverage},
+	{"testRenewalsDueBySite", testRenewalsDueBySite},
+	{"testAllDomains", testAllDomains},
+	{"testCertsExpirationMismatch", testCertsExpirationMismatch},
+
+	{"testReleaseArtifacts", testReleaseArtifacts},
+	{"testReleaseStatus", testReleaseStatus},
+	{"testReleases", testReleases},
+	{"testDeploymentOverlap", testDeploymentOverlap},
+	{"testDeploymentLaggards", testDeploymentLaggards},
+	{"testDeploymentStatus", testDeploymentStatus},
+	{"testSitesEligibleForRollout", testSitesEligibleForRollout},
+
+	{"testUsageRollup", testUsageRollup},
+	{"testSiteUsageDaily", testSiteUsageDaily},
+
+	{"testPushTokens", testPushTokens},
+	{"testNotificationPrefs", testNotificationPrefs},
+
+	{"testSiteExternalRefs", testSiteExternalRefs},
+
+	{"testAccountNormalization", testAccountNormalization},
+	{"testNormalizeExistingAccounts", testNormalizeExistingAccounts},
+	{"testAccountLocale", testAccountLocale},
+
+	{"testNotificationTemplates", testNotificationTemplates},
+
+	{"testApplianceFirmware", testApplianceFirmware},
+
+	{"testSupportGrants", testSupportGrants},
+
+	{"testOrgEntitlements", testOrgEntitlements},
+
+	{"testSiteIntegrationTokens", testSiteIntegrationTokens},
+	{"testAccountInvites", testAccountInvites},
+	{"testCreateInvitedAccount", testCreateInvitedAccount},
+
+	{"testJobLeases", testJobLeases},
+	{"testJobLeaseContention", testJobLeaseContention},
+
+	{"testSiteShards", testSiteShards},
+
+	{"testBootstrap", testBootstrap},
+
+	{"testDatabaseHealth", testDatabaseHealth},
+}
+
+// runDatabaseTests runs each of the database tests against a fresh copy of
+// the template database, using sessions in the given time zone.
+func runDatabaseTests(t *testing.T, zone string) {
 	var ctx = context.Background()
 	bpg = briefpg.New(nil)
 	defer bpg.Fini(ctx)
@@ -1584,40 +2816,7 @@ func TestDatabaseModel(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	testCases := []struct {
-		name  string
-		tFunc dbTestFunc
-	}{
-		{"testPing", testPing},
-		{"testHeartbeatIngest", testHeartbeatIngest},
-		{"testSiteNetException", testSiteNetException},
-		{"testApplianceID", testApplianceID},
-		{"testAppliancePubKey", testAppliancePubKey},
-
-		{"testOrganization", testOrganization},
-		{"testCustomerSite", testCustomerSite},
-		{"testOAuth2OrganizationRule", testOAuth2OrganizationRule},
-		{"testPerson", testPerson},
-		{"testAccount", testAccount},
-		{"testAccountOrgRole", testAccountOrgRole},
-		{"testAccountOrgRoleMSP", testAccountOrgRoleMSP},
-		{"testOAuth2Identity", testOAuth2Identity},
-		{"testOrgOrg", testOrgOrg},
-
-		{"testCloudStorage", testCloudStorage},
-		{"testUnittestData", testUnittestData},
-		{"testConfigStore", testConfigStore},
-
-		{"testCommandQueue", testCommandQueue},
-		{"testServerCerts", testServerCerts},
-		{"testServerCertsDelete", testServerCertsDelete},
-
-		{"testReleaseArtifacts", testReleaseArtifacts},
-		{"testReleaseStatus", testReleaseStatus},
-		{"testReleases", testReleases},
-	}
-
-	for _, tc := range testCases {
+	for _, tc := range dbTestCases {
 		t.Run(tc.name, func(t *testing.T) {
 			logger, slogger := setupLogging(t)
 			bpg.Logger = zap.NewStdLog(logger)
@@ -1628,7 +2827,7 @@ func TestDatabaseModel(t *testing.T) {
 			if err != nil {
 				t.Fatalf("CreateDB Failed: %v", err)
 			}
-			ds, err := Connect(testdb)
+			ds, err := connectZone(testdb, zone)
 			if err != nil {
 				t.Fatalf("Connect failed: %v", err)
 			}
@@ -1638,6 +2837,26 @@ func TestDatabaseModel(t *testing.T) {
 	}
 }
 
+func TestDatabaseModel(t *testing.T) {
+	runDatabaseTests(t, "UTC")
+}
+
+// TestDatabaseTZ reruns the database tests with the server sessions and the
+// test process each in a time zone with an unusual offset from UTC, and from
+// each other.  Anything which depends on the zone of either, rather than on
+// the instants being stored, should fail here.
+func TestDatabaseTZ(t *testing.T) {
+	local, err := time.LoadLocation("America/St_Johns")
+	if err != nil {
+		t.Skipf("time zone database unavailable: %v", err)
+	}
+	oldLocal := time.Local
+	time.Local = local
+	defer func() { time.Local = oldLocal }()
+
+	runDatabaseTests(t, "Pacific/Chatham")
+}
+
 func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
@@ -0,0 +1,317 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/satori/uuid"
+)
+
+type bootstrapManager interface {
+	Bootstrap(context.Context, BootstrapOpts) ([]BootstrapFinding, error)
+	VerifyBootstrap(context.Context) ([]BootstrapFinding, error)
+}
+
+// Kinds of BootstrapFinding
+const (
+	// The row doesn't exist
+	BootstrapMissing = "missing"
+	// The row exists, but one of its columns no longer has the value it
+	// was seeded with
+	BootstrapMutated = "mutated"
+	// The row was missing, and Bootstrap created it
+	BootstrapCreated = "created"
+)
+
+// BootstrapOpts controls the behavior of Bootstrap
+type BootstrapOpts struct {
+	// DryRun reports the rows which would be created, without creating
+	// them.
+	DryRun bool
+}
+
+// BootstrapFinding describes a seed row which was missing or altered, or
+// which Bootstrap created.  Column, Expected, and Actual are only set for
+// mutated rows.
+type BootstrapFinding struct {
+	Table    string `json:"table"`
+	Key      string `json:"key"`
+	Kind     string `json:"kind"`
+	Column   string `json:"column,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+func (f BootstrapFinding) String() string {
+	if f.Kind == BootstrapMutated {
+		return fmt.Sprintf("%s %s: %s is %q, expected %q", f.Table,
+			f.Key, f.Column, f.Actual, f.Expected)
+	}
+	return fmt.Sprintf("%s %s: %s", f.Table, f.Key, f.Kind)
+}
+
+// seedTable describes the rows of a table which every registry needs.  The
+// first nKey columns identify a row.  If fixed is set, the rest of the columns
+// must keep the values they were seeded with; otherwise they may be changed by
+// operators, and are only used when the row is created.
+type seedTable struct {
+	table string
+	cols  []string
+	nKey  int
+	fixed bool
+	rows  [][]string
+}
+
+// bootstrapSeeds lists the seed rows, in the order in which they must be
+// created to satisfy foreign keys.  The schema files create the same rows as
+// they go, so this must be kept in step with them.
+var bootstrapSeeds = []seedTable{
+	{
+		table: "organization",
+		cols:  []string{"uuid", "name"},
+		nKey:  1,
+		fixed: true,
+		rows: [][]string{
+			{NullOrganizationUUID.String(), "sentinel:null-organization"},
+		},
+	},
+	{
+		table: "customer_site",
+		cols:  []string{"uuid", "organization_uuid", "name"},
+		nKey:  1,
+		fixed: true,
+		rows: [][]string{
+			{NullSiteUUID.String(), NullOrganizationUUID.String(),
+				"sentinel:null-site"},
+		},
+	},
+	{
+		table: "oauth2_providers",
+		cols:  []string{"name"},
+		nKey:  1,
+		rows:  [][]string{{"google"}, {"azureadv2"}},
+	},
+	{
+		table: "ao_role",
+		cols:  []string{"name"},
+		nKey:  1,
+		rows:  [][]string{{"admin"}, {"user"}},
+	},
+	{
+		table: "relationship",
+		cols:  []string{"name"},
+		nKey:  1,
+		rows:  [][]string{{"self"}, {"msp"}, {"support"}},
+	},
+	{
+		table: "relationship_roles",
+		cols:  []string{"relationship", "role"},
+		nKey:  2,
+		rows: [][]string{
+			{"self", "admin"},
+			{"self", "user"},
+			{"msp", "admin"},
+			{"msp", "user"},
+			{"support", "admin"},
+			{"support", "user"},
+		},
+	},
+	{
+		table: "platforms",
+		cols:  []string{"name"},
+		nKey:  1,
+		rows:  [][]string{{"mt7623"}, {"rpi3"}, {"x86"}},
+	},
+	{
+		table: "repository_abbreviations",
+		cols:  []string{"abbrev"},
+		nKey:  1,
+		rows:  [][]string{{"PS"}, {"XS"}, {"WRT"}, {"VUB"}},
+	},
+	{
+		table: "hash_types",
+		cols:  []string{"name"},
+		nKey:  1,
+		rows:  [][]string{{"SHA256"}},
+	},
+	{
+		table: "releases",
+		cols:  []string{"release_uuid", "metadata"},
+		nKey:  1,
+		fixed: true,
+		rows: [][]string{
+			{uuid.Nil.String(), `{"name": "Unknown/Mixed"}`},
+		},
+	},
+	{
+		table: "notification_templates",
+		cols:  []string{"name", "locale", "subject", "body"},
+		nKey:  2,
+		rows: [][]string{
+			{"net-exception", "en-US", "Alert at {site}", "{message}"},
+		},
+	},
+}
+
+func (s *seedTable) key(row []string) string {
+	parts := make([]string, s.nKey)
+	for i := 0; i < s.nKey; i++ {
+		parts[i] = s.cols[i] + "=" + row[i]
+	}
+	return strings.Join(parts, ",")
+}
+
+// verify checks a seed row against the database, returning a finding for each
+// way in which it differs.
+func (s *seedTable) verify(ctx context.Context, dbx DBX,
+	row []string) ([]BootstrapFinding, error) {
+
+	var findings []BootstrapFinding
+
+	sel := make([]string, len(s.cols))
+	for i, c := range s.cols {
+		sel[i] = c + "::text"
+	}
+	where := make([]string, s.nKey)
+	args := make([]interface{}, s.nKey)
+	for i := 0; i < s.nKey; i++ {
+		where[i] = fmt.Sprintf("%s = $%d", s.cols[i], i+1)
+		args[i] = row[i]
+	}
+	q := fmt.Sprintf("SELECT %s FROM %s WHERE %s",
+		strings.Join(sel, ", "), s.table, strings.Join(where, " AND "))
+
+	actual := make([]sql.NullString, len(s.cols))
+	dest := make([]interface{}, len(s.cols))
+	for i := range actual {
+		dest[i] = &actual[i]
+	}
+	err := dbx.QueryRowContext(ctx, q, args...).Scan(dest...)
+	if err == sql.ErrNoRows {
+		return append(findings, BootstrapFinding{
+			Table: s.table,
+			Key:   s.key(row),
+			Kind:  BootstrapMissing,
+		}), nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "checking %s %s", s.table,
+			s.key(row))
+	}
+
+	if !s.fixed {
+		return findings, nil
+	}
+	for i := s.nKey; i < len(s.cols); i++ {
+		if actual[i].String != row[i] {
+			findings = append(findings, BootstrapFinding{
+				Table:    s.table,
+				Key:      s.key(row),
+				Kind:     BootstrapMutated,
+				Column:   s.cols[i],
+				Expected: row[i],
+				Actual:   actual[i].String,
+			})
+		}
+	}
+	return findings, nil
+}
+
+func (s *seedTable) insert(ctx context.Context, dbx DBX, row []string) error {
+	params := make([]string, len(s.cols))
+	args := make([]interface{}, len(s.cols))
+	for i := range s.cols {
+		params[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = row[i]
+	}
+	q := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", s.table,
+		strings.Join(s.cols, ", "), strings.Join(params, ", "))
+	if _, err := dbx.ExecContext(ctx, q, args...); err != nil {
+		return errors.Wrapf(err, "creating %s %s", s.table, s.key(row))
+	}
+	return nil
+}
+
+// checkBootstrap verifies each of the seed rows, optionally creating those
+// which are missing.
+func checkBootstrap(ctx context.Context, dbx DBX,
+	create bool) ([]BootstrapFinding, error) {
+
+	findings := make([]BootstrapFinding, 0)
+	for i := range bootstrapSeeds {
+		s := &bootstrapSeeds[i]
+		for _, row := range s.rows {
+			f, err := s.verify(ctx, dbx, row)
+			if err != nil {
+				return nil, err
+			}
+			if create && len(f) == 1 && f[0].Kind == BootstrapMissing {
+				if err = s.insert(ctx, dbx, row); err != nil {
+					return nil, err
+				}
+				f[0].Kind = BootstrapCreated
+			}
+			findings = append(findings, f...)
+		}
+	}
+	return findings, nil
+}
+
+// VerifyBootstrap checks that the seed rows which every registry needs are
+// present, and that the sentinels among them haven't been altered.  Each
+// problem found is reported; an empty result means the registry is intact.
+func (db *ApplianceDB) VerifyBootstrap(ctx context.Context) ([]BootstrapFinding, error) {
+	return checkBootstrap(ctx, db, false)
+}
+
+// Bootstrap creates any of the seed rows which every registry needs that are
+// missing, in an order which satisfies their foreign keys: the sentinel
+// organization, the null site, the relationship and role limits, and so on.
+// Rows which already exist are verified rather than recreated, so it is safe
+// to run Bootstrap repeatedly.  The rows created (or with DryRun, which would
+// be) are returned.  If any sentinel has been altered, nothing is changed, and
+// the alterations are returned along with an error.
+func (db *ApplianceDB) Bootstrap(ctx context.Context,
+	opts BootstrapOpts) ([]BootstrapFinding, error) {
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	findings, err := checkBootstrap(ctx, tx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var mutated int
+	for _, f := range findings {
+		if f.Kind == BootstrapMutated {
+			mutated++
+		}
+	}
+	if mutated > 0 {
+		return findings, fmt.Errorf("%d seed values have been altered; "+
+			"they must be repaired by hand", mutated)
+	}
+	if opts.DryRun || len(findings) == 0 {
+		return findings, nil
+	}
+
+	if findings, err = checkBootstrap(ctx, tx, true); err != nil {
+		return nil, err
+	}
+	return findings, tx.Commit()
+}
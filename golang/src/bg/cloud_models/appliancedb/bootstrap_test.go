@@ -0,0 +1,145 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.uber.org/zap"
+)
+
+// clearBootstrapSeeds deletes all of the seed rows, in the reverse of the
+// order in which Bootstrap creates them.
+func clearBootstrapSeeds(ctx context.Context, db *ApplianceDB) error {
+	for i := len(bootstrapSeeds) - 1; i >= 0; i-- {
+		s := &bootstrapSeeds[i]
+		where := make([]string, s.nKey)
+		for j := 0; j < s.nKey; j++ {
+			where[j] = fmt.Sprintf("%s = $%d", s.cols[j], j+1)
+		}
+		q := fmt.Sprintf("DELETE FROM %s WHERE %s", s.table,
+			strings.Join(where, " AND "))
+
+		for _, row := range s.rows {
+			args := make([]interface{}, s.nKey)
+			for j := range args {
+				args[j] = row[j]
+			}
+			if _, err := db.ExecContext(ctx, q, args...); err != nil {
+				return fmt.Errorf("clearing %s %s: %v", s.table,
+					s.key(row), err)
+			}
+		}
+	}
+	return nil
+}
+
+func findingStrings(findings []BootstrapFinding) []string {
+	rval := make([]string, len(findings))
+	for i, f := range findings {
+		rval[i] = f.String()
+	}
+	return rval
+}
+
+// Test creating and verifying the seed rows.  The template database is itself
+// stripped of its seed rows and then bootstrapped, so every other test also
+// exercises Bootstrap.  subtest of TestDatabaseModel
+func testBootstrap(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+	adb := ds.(*ApplianceDB)
+
+	findings, err := ds.VerifyBootstrap(ctx)
+	assert.NoError(err)
+	assert.Empty(findings)
+	findings, err = ds.Bootstrap(ctx, BootstrapOpts{})
+	assert.NoError(err)
+	assert.Empty(findings)
+
+	// Missing rows are reported, and recreated in dependency order
+	_, err = adb.ExecContext(ctx, `
+		DELETE FROM relationship_roles WHERE relationship = 'support'`)
+	assert.NoError(err)
+	_, err = adb.ExecContext(ctx, `
+		DELETE FROM relationship WHERE name = 'support'`)
+	assert.NoError(err)
+
+	missing := []string{
+		"relationship name=support: missing",
+		"relationship_roles relationship=support,role=admin: missing",
+		"relationship_roles relationship=support,role=user: missing",
+	}
+	findings, err = ds.VerifyBootstrap(ctx)
+	assert.NoError(err)
+	assert.Equal(missing, findingStrings(findings))
+
+	findings, err = ds.Bootstrap(ctx, BootstrapOpts{DryRun: true})
+	assert.NoError(err)
+	assert.Equal(missing, findingStrings(findings))
+	findings, err = ds.VerifyBootstrap(ctx)
+	assert.NoError(err)
+	assert.Len(findings, 3)
+
+	findings, err = ds.Bootstrap(ctx, BootstrapOpts{})
+	assert.NoError(err)
+	assert.Equal([]string{
+		"relationship name=support: created",
+		"relationship_roles relationship=support,role=admin: created",
+		"relationship_roles relationship=support,role=user: created",
+	}, findingStrings(findings))
+
+	// Running it again is harmless
+	findings, err = ds.Bootstrap(ctx, BootstrapOpts{})
+	assert.NoError(err)
+	assert.Empty(findings)
+	findings, err = ds.VerifyBootstrap(ctx)
+	assert.NoError(err)
+	assert.Empty(findings)
+
+	// Operators may reword notifications
+	_, err = adb.ExecContext(ctx, `
+		UPDATE notification_templates SET body = 'Look: {message}'
+		WHERE name = 'net-exception'`)
+	assert.NoError(err)
+	findings, err = ds.VerifyBootstrap(ctx)
+	assert.NoError(err)
+	assert.Empty(findings)
+
+	// But an altered sentinel is reported, and keeps Bootstrap from doing
+	// anything at all
+	_, err = adb.ExecContext(ctx, `
+		UPDATE organization SET name = 'Acme' WHERE uuid = $1`,
+		NullOrganizationUUID)
+	assert.NoError(err)
+	_, err = adb.ExecContext(ctx, `
+		DELETE FROM hash_types WHERE name = 'SHA256'`)
+	assert.NoError(err)
+
+	broken := []string{
+		`organization uuid=00000000-0000-0000-0000-000000000000: name is "Acme", expected "sentinel:null-organization"`,
+		"hash_types name=SHA256: missing",
+	}
+	findings, err = ds.VerifyBootstrap(ctx)
+	assert.NoError(err)
+	assert.Equal(broken, findingStrings(findings))
+
+	findings, err = ds.Bootstrap(ctx, BootstrapOpts{})
+	assert.Error(err)
+	assert.Equal(broken, findingStrings(findings))
+	findings, err = ds.VerifyBootstrap(ctx)
+	assert.NoError(err)
+	assert.Equal(broken, findingStrings(findings))
+}
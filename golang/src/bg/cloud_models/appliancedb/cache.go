@@ -0,0 +1,370 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/satori/uuid"
+)
+
+// CachedDataStore is a DataStore which caches the results of a few lookups
+// which are made on nearly every request, but whose results rarely change:
+// sites and organizations by UUID, and the relationships between
+// organizations.  Every other method passes straight through to the
+// underlying DataStore.
+//
+// Mutations made through the CachedDataStore invalidate the affected entries,
+// so a process always sees its own changes.  Changes made by other processes,
+// or made directly through the underlying DataStore, are not seen until the
+// cached entries expire: the TTL is the bound on how stale a lookup may be.
+// A caller which reads a site or organization in order to update it may thus
+// be handed an old Version, and have its update rejected with ConflictError;
+// it should retry as it would after any other conflict.  Mutations made
+// within a transaction invalidate the cache when they are made, not when the
+// transaction commits, so a lookup made in between may also return the old
+// value until it expires.
+//
+// Errors, including NotFoundError, are never cached.
+type CachedDataStore struct {
+	DataStore
+
+	opts    CacheOptions
+	sites   *cacheTable
+	orgs    *cacheTable
+	orgRels *cacheTable
+}
+
+// CacheOptions controls the behavior of a CachedDataStore.  Zero values are
+// replaced with the defaults.
+type CacheOptions struct {
+	// TTL is how long a lookup is cached; see CachedDataStore
+	TTL time.Duration
+	// MaxEntries bounds the number of entries cached for each kind of
+	// lookup; the least recently used are evicted first.
+	MaxEntries int
+
+	// OnHit and OnMiss, if set, are called with the name of the method on
+	// each cache hit or miss, e.g., to feed metrics.
+	OnHit  func(method string)
+	OnMiss func(method string)
+
+	clock gcache.Clock
+}
+
+// Defaults for CacheOptions
+const (
+	DefaultCacheTTL        = 30 * time.Second
+	DefaultCacheMaxEntries = 10000
+)
+
+// cacheTable is one kind of cached lookup.  Its generation counts
+// invalidations, so that a lookup which raced with one doesn't put the
+// value it read, which may predate the mutation, back into the cache.
+type cacheTable struct {
+	sync.Mutex
+	cache      gcache.Cache
+	generation uint64
+}
+
+func newCacheTable(opts *CacheOptions) *cacheTable {
+	return &cacheTable{
+		cache: gcache.New(opts.MaxEntries).LRU().Clock(opts.clock).Build(),
+	}
+}
+
+func (t *cacheTable) get(key interface{}) (interface{}, uint64, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	val, err := t.cache.GetIFPresent(key)
+	return val, t.generation, err == nil
+}
+
+func (t *cacheTable) set(key, val interface{}, gen uint64, ttl time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+
+	if gen == t.generation {
+		// This cannot fail unless gcache's serialization is used
+		_ = t.cache.SetWithExpire(key, val, ttl)
+	}
+}
+
+func (t *cacheTable) remove(key interface{}) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.generation++
+	t.cache.Remove(key)
+}
+
+func (t *cacheTable) purge() {
+	t.Lock()
+	defer t.Unlock()
+
+	t.generation++
+	t.cache.Purge()
+}
+
+type orgRelKey struct {
+	org uuid.UUID
+	tgt uuid.UUID // uuid.Nil for OrgOrgRelationshipsByOrg
+}
+
+// NewCachedDataStore returns a CachedDataStore wrapping the given DataStore
+func NewCachedDataStore(ds DataStore, opts CacheOptions) *CachedDataStore {
+	if opts.TTL <= 0 {
+		opts.TTL = DefaultCacheTTL
+	}
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = DefaultCacheMaxEntries
+	}
+	if opts.clock == nil {
+		opts.clock = gcache.NewRealClock()
+	}
+
+	return &CachedDataStore{
+		DataStore: ds,
+		opts:      opts,
+		sites:     newCacheTable(&opts),
+		orgs:      newCacheTable(&opts),
+		orgRels:   newCacheTable(&opts),
+	}
+}
+
+func (c *CachedDataStore) hit(method string) {
+	if c.opts.OnHit != nil {
+		c.opts.OnHit(method)
+	}
+}
+
+func (c *CachedDataStore) miss(method string) {
+	if c.opts.OnMiss != nil {
+		c.opts.OnMiss(method)
+	}
+}
+
+// The cached values are copied on the way in and out, so that callers are free
+// to modify what they are handed.
+
+func copyOrgRels(rels []OrgOrgRelationship) []OrgOrgRelationship {
+	if rels == nil {
+		return nil
+	}
+	cp := make([]OrgOrgRelationship, len(rels))
+	for i, rel := range rels {
+		cp[i] = rel
+		if rel.LimitRoles != nil {
+			cp[i].LimitRoles = append(rel.LimitRoles[:0:0],
+				rel.LimitRoles...)
+		}
+	}
+	return cp
+}
+
+// CustomerSiteByUUID implements DataStore, with caching
+func (c *CachedDataStore) CustomerSiteByUUID(ctx context.Context,
+	u uuid.UUID) (*CustomerSite, error) {
+
+	const method = "CustomerSiteByUUID"
+	val, gen, ok := c.sites.get(u)
+	if ok {
+		c.hit(method)
+		site := val.(CustomerSite)
+		return &site, nil
+	}
+
+	c.miss(method)
+	site, err := c.DataStore.CustomerSiteByUUID(ctx, u)
+	if err == nil {
+		c.sites.set(u, *site, gen, c.opts.TTL)
+	}
+	return site, err
+}
+
+// InsertCustomerSite implements DataStore, invalidating the cached site
+func (c *CachedDataStore) InsertCustomerSite(ctx context.Context,
+	cs *CustomerSite) error {
+
+	defer c.sites.remove(cs.UUID)
+	return c.DataStore.InsertCustomerSite(ctx, cs)
+}
+
+// InsertCustomerSiteTx implements DataStore, invalidating the cached site
+func (c *CachedDataStore) InsertCustomerSiteTx(ctx context.Context, dbx DBX,
+	cs *CustomerSite) error {
+
+	defer c.sites.remove(cs.UUID)
+	return c.DataStore.InsertCustomerSiteTx(ctx, dbx, cs)
+}
+
+// UpdateCustomerSite implements DataStore, invalidating the cached site.
+// This covers moving the site to another organization.
+func (c *CachedDataStore) UpdateCustomerSite(ctx context.Context,
+	cs *CustomerSite) error {
+
+	defer c.sites.remove(cs.UUID)
+	return c.DataStore.UpdateCustomerSite(ctx, cs)
+}
+
+// UpdateCustomerSiteTx implements DataStore, invalidating the cached site
+func (c *CachedDataStore) UpdateCustomerSiteTx(ctx context.Context, dbx DBX,
+	cs *CustomerSite) error {
+
+	defer c.sites.remove(cs.UUID)
+	return c.DataStore.UpdateCustomerSiteTx(ctx, dbx, cs)
+}
+
+// ArchiveCustomerSite implements DataStore, invalidating the cached site
+func (c *CachedDataStore) ArchiveCustomerSite(ctx context.Context,
+	u uuid.UUID) error {
+
+	defer c.sites.remove(u)
+	return c.DataStore.ArchiveCustomerSite(ctx, u)
+}
+
+// UnarchiveCustomerSite implements DataStore, invalidating the cached site
+func (c *CachedDataStore) UnarchiveCustomerSite(ctx context.Context,
+	u uuid.UUID) error {
+
+	defer c.sites.remove(u)
+	return c.DataStore.UnarchiveCustomerSite(ctx, u)
+}
+
+// OrganizationByUUID implements DataStore, with caching
+func (c *CachedDataStore) OrganizationByUUID(ctx context.Context,
+	u uuid.UUID) (*Organization, error) {
+
+	const method = "OrganizationByUUID"
+	val, gen, ok := c.orgs.get(u)
+	if ok {
+		c.hit(method)
+		org := val.(Organization)
+		return &org, nil
+	}
+
+	c.miss(method)
+	org, err := c.DataStore.OrganizationByUUID(ctx, u)
+	if err == nil {
+		c.orgs.set(u, *org, gen, c.opts.TTL)
+	}
+	return org, err
+}
+
+// InsertOrganization implements DataStore, invalidating the cached
+// organization
+func (c *CachedDataStore) InsertOrganization(ctx context.Context,
+	org *Organization) error {
+
+	defer c.orgs.remove(org.UUID)
+	return c.DataStore.InsertOrganization(ctx, org)
+}
+
+// UpdateOrganization implements DataStore, invalidating the cached
+// organization
+func (c *CachedDataStore) UpdateOrganization(ctx context.Context,
+	org *Organization) error {
+
+	defer c.orgs.remove(org.UUID)
+	return c.DataStore.UpdateOrganization(ctx, org)
+}
+
+// UpdateOrganizationTx implements DataStore, invalidating the cached
+// organization
+func (c *CachedDataStore) UpdateOrganizationTx(ctx context.Context, dbx DBX,
+	org *Organization) error {
+
+	defer c.orgs.remove(org.UUID)
+	return c.DataStore.UpdateOrganizationTx(ctx, dbx, org)
+}
+
+func (c *CachedDataStore) orgRelsByKey(method string, key orgRelKey,
+	lookup func() ([]OrgOrgRelationship, error)) ([]OrgOrgRelationship, error) {
+
+	val, gen, ok := c.orgRels.get(key)
+	if ok {
+		c.hit(method)
+		return copyOrgRels(val.([]OrgOrgRelationship)), nil
+	}
+
+	c.miss(method)
+	rels, err := lookup()
+	if err == nil {
+		c.orgRels.set(key, copyOrgRels(rels), gen, c.opts.TTL)
+	}
+	return rels, err
+}
+
+// OrgOrgRelationshipsByOrg implements DataStore, with caching
+func (c *CachedDataStore) OrgOrgRelationshipsByOrg(ctx context.Context,
+	org uuid.UUID) ([]OrgOrgRelationship, error) {
+
+	return c.orgRelsByKey("OrgOrgRelationshipsByOrg",
+		orgRelKey{org: org},
+		func() ([]OrgOrgRelationship, error) {
+			return c.DataStore.OrgOrgRelationshipsByOrg(ctx, org)
+		})
+}
+
+// OrgOrgRelationshipsByOrgTarget implements DataStore, with caching
+func (c *CachedDataStore) OrgOrgRelationshipsByOrgTarget(ctx context.Context,
+	org uuid.UUID, tgt uuid.UUID) ([]OrgOrgRelationship, error) {
+
+	return c.orgRelsByKey("OrgOrgRelationshipsByOrgTarget",
+		orgRelKey{org: org, tgt: tgt},
+		func() ([]OrgOrgRelationship, error) {
+			return c.DataStore.OrgOrgRelationshipsByOrgTarget(ctx,
+				org, tgt)
+		})
+}
+
+// Relationships are deleted by their own UUID, which doesn't tell us which
+// organizations' entries are affected, and they change rarely enough that
+// any change simply drops every cached relationship.
+
+// InsertOrgOrgRelationship implements DataStore, invalidating the cached
+// relationships
+func (c *CachedDataStore) InsertOrgOrgRelationship(ctx context.Context,
+	rel *OrgOrgRelationship) error {
+
+	defer c.orgRels.purge()
+	return c.DataStore.InsertOrgOrgRelationship(ctx, rel)
+}
+
+// InsertOrgOrgRelationshipTx implements DataStore, invalidating the cached
+// relationships
+func (c *CachedDataStore) InsertOrgOrgRelationshipTx(ctx context.Context,
+	dbx DBX, rel *OrgOrgRelationship) error {
+
+	defer c.orgRels.purge()
+	return c.DataStore.InsertOrgOrgRelationshipTx(ctx, dbx, rel)
+}
+
+// DeleteOrgOrgRelationship implements DataStore, invalidating the cached
+// relationships
+func (c *CachedDataStore) DeleteOrgOrgRelationship(ctx context.Context,
+	uu uuid.UUID) error {
+
+	defer c.orgRels.purge()
+	return c.DataStore.DeleteOrgOrgRelationship(ctx, uu)
+}
+
+// DeleteOrgOrgRelationshipTx implements DataStore, invalidating the cached
+// relationships
+func (c *CachedDataStore) DeleteOrgOrgRelationshipTx(ctx context.Context,
+	dbx DBX, uu uuid.UUID) error {
+
+	defer c.orgRels.purge()
+	return c.DataStore.DeleteOrgOrgRelationshipTx(ctx, dbx, uu)
+}
@@ -0,0 +1,419 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/guregu/null"
+	"github.com/satori/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStore is an in-memory stand-in for the handful of DataStore methods the
+// cache is concerned with, counting the calls made to each.  Calling any
+// other method panics.
+type fakeStore struct {
+	DataStore
+
+	calls map[string]int
+	sites map[uuid.UUID]CustomerSite
+	orgs  map[uuid.UUID]Organization
+	rels  []OrgOrgRelationship
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		calls: make(map[string]int),
+		sites: map[uuid.UUID]CustomerSite{
+			testSite1.UUID: testSite1,
+			testSite2.UUID: testSite2,
+		},
+		orgs: map[uuid.UUID]Organization{
+			testOrg1.UUID: testOrg1,
+			testOrg2.UUID: testOrg2,
+		},
+		rels: []OrgOrgRelationship{
+			{
+				UUID:                   uuid.Must(uuid.FromString(orgOrgRel1Str)),
+				OrganizationUUID:       testMSPOrg1.UUID,
+				TargetOrganizationUUID: testOrg1.UUID,
+				Relationship:           "msp",
+				LimitRoles:             []string{"admin", "user"},
+			},
+		},
+	}
+}
+
+func (f *fakeStore) CustomerSiteByUUID(ctx context.Context, u uuid.UUID) (*CustomerSite, error) {
+	f.calls["CustomerSiteByUUID"]++
+	site, ok := f.sites[u]
+	if !ok {
+		return nil, NotFoundError{fmt.Sprintf("no site %v", u)}
+	}
+	return &site, nil
+}
+
+func (f *fakeStore) CustomerSitesByOrganization(ctx context.Context, org uuid.UUID) ([]CustomerSite, error) {
+	f.calls["CustomerSitesByOrganization"]++
+	sites := make([]CustomerSite, 0)
+	for _, s := range f.sites {
+		if s.OrganizationUUID == org {
+			sites = append(sites, s)
+		}
+	}
+	return sites, nil
+}
+
+func (f *fakeStore) UpdateCustomerSite(ctx context.Context, cs *CustomerSite) error {
+	f.calls["UpdateCustomerSite"]++
+	cs.Version++
+	f.sites[cs.UUID] = *cs
+	return nil
+}
+
+func (f *fakeStore) UpdateCustomerSiteTx(ctx context.Context, dbx DBX, cs *CustomerSite) error {
+	f.calls["UpdateCustomerSiteTx"]++
+	cs.Version++
+	f.sites[cs.UUID] = *cs
+	return nil
+}
+
+func (f *fakeStore) ArchiveCustomerSite(ctx context.Context, u uuid.UUID) error {
+	f.calls["ArchiveCustomerSite"]++
+	site := f.sites[u]
+	site.ArchivedAt = null.TimeFrom(time.Now())
+	site.Version++
+	f.sites[u] = site
+	return nil
+}
+
+func (f *fakeStore) OrganizationByUUID(ctx context.Context, u uuid.UUID) (*Organization, error) {
+	f.calls["OrganizationByUUID"]++
+	org, ok := f.orgs[u]
+	if !ok {
+		return nil, NotFoundError{fmt.Sprintf("no org %v", u)}
+	}
+	return &org, nil
+}
+
+func (f *fakeStore) UpdateOrganization(ctx context.Context, org *Organization) error {
+	f.calls["UpdateOrganization"]++
+	org.Version++
+	f.orgs[org.UUID] = *org
+	return nil
+}
+
+func (f *fakeStore) OrgOrgRelationshipsByOrg(ctx context.Context, org uuid.UUID) ([]OrgOrgRelationship, error) {
+	f.calls["OrgOrgRelationshipsByOrg"]++
+	return f.OrgOrgRelationshipsByOrgTarget(ctx, org, uuid.Nil)
+}
+
+func (f *fakeStore) OrgOrgRelationshipsByOrgTx(ctx context.Context, dbx DBX, org uuid.UUID) ([]OrgOrgRelationship, error) {
+	f.calls["OrgOrgRelationshipsByOrgTx"]++
+	return f.OrgOrgRelationshipsByOrgTarget(ctx, org, uuid.Nil)
+}
+
+func (f *fakeStore) OrgOrgRelationshipsByOrgTarget(ctx context.Context, org, tgt uuid.UUID) ([]OrgOrgRelationship, error) {
+	if tgt != uuid.Nil {
+		f.calls["OrgOrgRelationshipsByOrgTarget"]++
+	}
+	rels := make([]OrgOrgRelationship, 0)
+	for _, r := range f.rels {
+		if r.OrganizationUUID == org &&
+			(tgt == uuid.Nil || r.TargetOrganizationUUID == tgt) {
+			r.LimitRoles = append([]string{}, r.LimitRoles...)
+			rels = append(rels, r)
+		}
+	}
+	return rels, nil
+}
+
+func (f *fakeStore) InsertOrgOrgRelationship(ctx context.Context, rel *OrgOrgRelationship) error {
+	f.calls["InsertOrgOrgRelationship"]++
+	f.rels = append(f.rels, *rel)
+	return nil
+}
+
+func (f *fakeStore) DeleteOrgOrgRelationship(ctx context.Context, u uuid.UUID) error {
+	f.calls["DeleteOrgOrgRelationship"]++
+	rels := make([]OrgOrgRelationship, 0)
+	for _, r := range f.rels {
+		if r.UUID != u {
+			rels = append(rels, r)
+		}
+	}
+	f.rels = rels
+	return nil
+}
+
+type cacheCounts struct {
+	hits   map[string]int
+	misses map[string]int
+}
+
+func newTestCache(f *fakeStore, opts CacheOptions) (*CachedDataStore, *cacheCounts, gcache.FakeClock) {
+	counts := &cacheCounts{
+		hits:   make(map[string]int),
+		misses: make(map[string]int),
+	}
+	clock := gcache.NewFakeClock()
+	opts.OnHit = func(method string) { counts.hits[method]++ }
+	opts.OnMiss = func(method string) { counts.misses[method]++ }
+	opts.clock = clock
+	return NewCachedDataStore(f, opts), counts, clock
+}
+
+func TestCacheHitMiss(t *testing.T) {
+	ctx := context.Background()
+	assert := require.New(t)
+	f := newFakeStore()
+	c, counts, _ := newTestCache(f, CacheOptions{})
+
+	for i := 0; i < 3; i++ {
+		site, err := c.CustomerSiteByUUID(ctx, testSite1.UUID)
+		assert.NoError(err)
+		assert.Equal(testSite1, *site)
+
+		org, err := c.OrganizationByUUID(ctx, testOrg1.UUID)
+		assert.NoError(err)
+		assert.Equal(testOrg1, *org)
+
+		rels, err := c.OrgOrgRelationshipsByOrg(ctx, testMSPOrg1.UUID)
+		assert.NoError(err)
+		assert.Len(rels, 1)
+		rels, err = c.OrgOrgRelationshipsByOrgTarget(ctx,
+			testMSPOrg1.UUID, testOrg1.UUID)
+		assert.NoError(err)
+		assert.Len(rels, 1)
+		rels, err = c.OrgOrgRelationshipsByOrgTarget(ctx,
+			testMSPOrg1.UUID, testOrg2.UUID)
+		assert.NoError(err)
+		assert.Len(rels, 0)
+	}
+	assert.Equal(map[string]int{
+		"CustomerSiteByUUID":             1,
+		"OrganizationByUUID":             1,
+		"OrgOrgRelationshipsByOrg":       1,
+		"OrgOrgRelationshipsByOrgTarget": 2,
+	}, f.calls)
+	assert.Equal(map[string]int{
+		"CustomerSiteByUUID":             2,
+		"OrganizationByUUID":             2,
+		"OrgOrgRelationshipsByOrg":       2,
+		"OrgOrgRelationshipsByOrgTarget": 4,
+	}, counts.hits)
+	assert.Equal(f.calls, counts.misses)
+
+	// Each key is cached separately
+	site, err := c.CustomerSiteByUUID(ctx, testSite2.UUID)
+	assert.NoError(err)
+	assert.Equal(testSite2, *site)
+	assert.Equal(2, f.calls["CustomerSiteByUUID"])
+
+	// Callers may scribble on what they are handed
+	site.Name = "scribbled"
+	rels, err := c.OrgOrgRelationshipsByOrg(ctx, testMSPOrg1.UUID)
+	assert.NoError(err)
+	rels[0].LimitRoles[0] = "scribbled"
+	site, err = c.CustomerSiteByUUID(ctx, testSite2.UUID)
+	assert.NoError(err)
+	assert.Equal(testSite2, *site)
+	rels, err = c.OrgOrgRelationshipsByOrg(ctx, testMSPOrg1.UUID)
+	assert.NoError(err)
+	assert.Equal([]string{"admin", "user"}, []string(rels[0].LimitRoles))
+
+	// Errors are never cached
+	for i := 0; i < 2; i++ {
+		_, err = c.CustomerSiteByUUID(ctx, badUUID)
+		assert.IsType(NotFoundError{}, err)
+		_, err = c.OrganizationByUUID(ctx, badUUID)
+		assert.IsType(NotFoundError{}, err)
+	}
+	assert.Equal(4, f.calls["CustomerSiteByUUID"])
+	assert.Equal(3, f.calls["OrganizationByUUID"])
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	ctx := context.Background()
+	assert := require.New(t)
+	f := newFakeStore()
+	c, _, _ := newTestCache(f, CacheOptions{})
+
+	// Moving a site to another organization is seen at once
+	site, err := c.CustomerSiteByUUID(ctx, testSite1.UUID)
+	assert.NoError(err)
+	site.OrganizationUUID = testOrg2.UUID
+	assert.NoError(c.UpdateCustomerSite(ctx, site))
+	site, err = c.CustomerSiteByUUID(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.Equal(testOrg2.UUID, site.OrganizationUUID)
+	assert.Equal(int64(1), site.Version)
+	assert.Equal(2, f.calls["CustomerSiteByUUID"])
+
+	// ... including in a transaction
+	site.Name = "renamed"
+	assert.NoError(c.UpdateCustomerSiteTx(ctx, nil, site))
+	site, err = c.CustomerSiteByUUID(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.Equal("renamed", site.Name)
+	assert.Equal(3, f.calls["CustomerSiteByUUID"])
+
+	// Other sites' entries are unaffected
+	_, err = c.CustomerSiteByUUID(ctx, testSite2.UUID)
+	assert.NoError(err)
+	site, err = c.CustomerSiteByUUID(ctx, testSite1.UUID)
+	assert.NoError(err)
+	site.Name = "renamed again"
+	assert.NoError(c.UpdateCustomerSite(ctx, site))
+	_, err = c.CustomerSiteByUUID(ctx, testSite2.UUID)
+	assert.NoError(err)
+	assert.Equal(4, f.calls["CustomerSiteByUUID"])
+
+	// Archiving a site is seen at once
+	assert.NoError(c.ArchiveCustomerSite(ctx, testSite2.UUID))
+	site, err = c.CustomerSiteByUUID(ctx, testSite2.UUID)
+	assert.NoError(err)
+	assert.True(site.Archived())
+	assert.Equal(5, f.calls["CustomerSiteByUUID"])
+
+	org, err := c.OrganizationByUUID(ctx, testOrg1.UUID)
+	assert.NoError(err)
+	org.Name = "renamed"
+	assert.NoError(c.UpdateOrganization(ctx, org))
+	org, err = c.OrganizationByUUID(ctx, testOrg1.UUID)
+	assert.NoError(err)
+	assert.Equal("renamed", org.Name)
+	assert.Equal(2, f.calls["OrganizationByUUID"])
+
+	// Changes to relationships drop all of the cached relationships
+	rels, err := c.OrgOrgRelationshipsByOrgTarget(ctx, testMSPOrg1.UUID,
+		testOrg2.UUID)
+	assert.NoError(err)
+	assert.Len(rels, 0)
+	rel := &OrgOrgRelationship{
+		UUID:                   uuid.Must(uuid.FromString(orgOrgRel2Str)),
+		OrganizationUUID:       testMSPOrg1.UUID,
+		TargetOrganizationUUID: testOrg2.UUID,
+		Relationship:           "msp",
+		LimitRoles:             []string{"admin", "user"},
+	}
+	assert.NoError(c.InsertOrgOrgRelationship(ctx, rel))
+	rels, err = c.OrgOrgRelationshipsByOrgTarget(ctx, testMSPOrg1.UUID,
+		testOrg2.UUID)
+	assert.NoError(err)
+	assert.Len(rels, 1)
+	rels, err = c.OrgOrgRelationshipsByOrg(ctx, testMSPOrg1.UUID)
+	assert.NoError(err)
+	assert.Len(rels, 2)
+
+	assert.NoError(c.DeleteOrgOrgRelationship(ctx, rel.UUID))
+	rels, err = c.OrgOrgRelationshipsByOrgTarget(ctx, testMSPOrg1.UUID,
+		testOrg2.UUID)
+	assert.NoError(err)
+	assert.Len(rels, 0)
+	rels, err = c.OrgOrgRelationshipsByOrg(ctx, testMSPOrg1.UUID)
+	assert.NoError(err)
+	assert.Len(rels, 1)
+
+	// The mutations all went through to the underlying store
+	assert.Equal(2, f.calls["UpdateCustomerSite"])
+	assert.Equal(1, f.calls["UpdateCustomerSiteTx"])
+	assert.Equal(1, f.calls["ArchiveCustomerSite"])
+	assert.Equal(1, f.calls["UpdateOrganization"])
+	assert.Equal(1, f.calls["InsertOrgOrgRelationship"])
+	assert.Equal(1, f.calls["DeleteOrgOrgRelationship"])
+}
+
+func TestCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	assert := require.New(t)
+	f := newFakeStore()
+	c, _, clock := newTestCache(f, CacheOptions{TTL: time.Minute})
+
+	site, err := c.CustomerSiteByUUID(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.Equal(testOrg1.UUID, site.OrganizationUUID)
+
+	// Another process moves the site; we don't see it until the entry
+	// expires.
+	moved := testSite1
+	moved.OrganizationUUID = testOrg2.UUID
+	f.sites[moved.UUID] = moved
+
+	clock.Advance(59 * time.Second)
+	site, err = c.CustomerSiteByUUID(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.Equal(testOrg1.UUID, site.OrganizationUUID)
+	assert.Equal(1, f.calls["CustomerSiteByUUID"])
+
+	clock.Advance(2 * time.Second)
+	site, err = c.CustomerSiteByUUID(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.Equal(testOrg2.UUID, site.OrganizationUUID)
+	assert.Equal(2, f.calls["CustomerSiteByUUID"])
+
+	// The new entry has a fresh TTL
+	clock.Advance(30 * time.Second)
+	_, err = c.CustomerSiteByUUID(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.Equal(2, f.calls["CustomerSiteByUUID"])
+}
+
+func TestCacheMaxEntries(t *testing.T) {
+	ctx := context.Background()
+	assert := require.New(t)
+	f := newFakeStore()
+	f.sites[testSite4.UUID] = testSite4
+	c, _, _ := newTestCache(f, CacheOptions{MaxEntries: 2})
+
+	// Caching a third site evicts the least recently used
+	for _, u := range []uuid.UUID{testSite1.UUID, testSite2.UUID,
+		testSite1.UUID, testSite4.UUID, testSite1.UUID} {
+		_, err := c.CustomerSiteByUUID(ctx, u)
+		assert.NoError(err)
+	}
+	assert.Equal(3, f.calls["CustomerSiteByUUID"])
+	_, err := c.CustomerSiteByUUID(ctx, testSite2.UUID)
+	assert.NoError(err)
+	assert.Equal(4, f.calls["CustomerSiteByUUID"])
+}
+
+func TestCachePassThrough(t *testing.T) {
+	ctx := context.Background()
+	assert := require.New(t)
+	f := newFakeStore()
+	c, counts, _ := newTestCache(f, CacheOptions{})
+
+	for i := 1; i <= 3; i++ {
+		sites, err := c.CustomerSitesByOrganization(ctx, testOrg1.UUID)
+		assert.NoError(err)
+		assert.Len(sites, 1)
+		assert.Equal(i, f.calls["CustomerSitesByOrganization"])
+	}
+	assert.Empty(counts.hits)
+	assert.Empty(counts.misses)
+
+	// Lookups within a transaction must see the transaction's own
+	// changes, so they aren't cached either.
+	for i := 1; i <= 3; i++ {
+		rels, err := c.OrgOrgRelationshipsByOrgTx(ctx, nil,
+			testMSPOrg1.UUID)
+		assert.NoError(err)
+		assert.Len(rels, 1)
+		assert.Equal(i, f.calls["OrgOrgRelationshipsByOrgTx"])
+	}
+	assert.Empty(counts.hits)
+	assert.Empty(counts.misses)
+}
@@ -11,6 +11,7 @@ package appliancedb
 
 import (
 	"context"
+	"crypto/x509"
 	"database/sql"
 	"fmt"
 	"strings"
@@ -19,6 +20,7 @@ import (
 
 	"bg/base_def"
 
+	"github.com/guregu/null"
 	"github.com/jmoiron/sqlx"
 	"github.com/satori/uuid"
 )
@@ -39,9 +41,13 @@ type certManager interface {
 	GetSiteUUIDByDomain(context.Context, DecomposedDomain) (uuid.UUID, error)
 	GetCertConfigInfoByDomain(context.Context, []DecomposedDomain) (map[string]CertConfigInfo, error)
 	CertsExpiringWithin(context.Context, time.Duration) ([]ServerCert, error)
+	RenewalsDueBySite(context.Context, time.Duration) (map[uuid.UUID][]ServerCert, error)
+	CertsWithExpirationMismatch(context.Context) ([]ServerCert, error)
 	FailDomains(context.Context, []DecomposedDomain) error
 	FailedDomains(context.Context, bool) ([]DecomposedDomain, error)
 	ComputeDomain(context.Context, int32, string) (string, error)
+	SiteCertCoverage(context.Context, []uuid.UUID) (map[uuid.UUID]CertCoverage, error)
+	AllDomains(context.Context, int, int) ([]DomainStatus, error)
 }
 
 // SiteDomain represents the Brightgate domain used at a particular site.
@@ -80,6 +86,30 @@ type CertConfigInfo struct {
 	Expiration  time.Time
 }
 
+// CertCoverage is used by SiteCertCoverage to report whether a site has a
+// valid certificate for its domain.  Expiration is that of the site's latest
+// certificate, if it has any, even if it has expired; DaysRemaining is only
+// meaningful if HasCert is true.
+type CertCoverage struct {
+	HasCert       bool      `json:"hasCert"`
+	Expiration    time.Time `json:"expiration"`
+	DaysRemaining int       `json:"daysRemaining"`
+}
+
+// DomainStatus is used by AllDomains to report the state of a domain: whether
+// it has been claimed by a site, whether it has an unexpired certificate, and
+// how many times ACME validation has failed for it since the failures were
+// last cleared.  CertExpiration is that of the domain's latest certificate, if
+// it has any, even if it has expired.
+type DomainStatus struct {
+	DecomposedDomain
+	Claimed        bool          `json:"claimed"`
+	SiteUUID       uuid.NullUUID `json:"siteUUID"`
+	HasCert        bool          `json:"hasCert"`
+	CertExpiration null.Time     `json:"certExpiration"`
+	FailCount      int           `json:"failCount"`
+}
+
 var (
 	computeDomain     = make(map[string]func(int32, string) string)
 	computeDomainLock sync.Mutex
@@ -196,6 +226,85 @@ func (db *ApplianceDB) CertsExpiringWithin(ctx context.Context, grace time.Durat
 	return certs, nil
 }
 
+// RenewalsDueBySite returns the same certificates as CertsExpiringWithin,
+// grouped by the site which has claimed each one's domain, so that renewals
+// can be scheduled in each site's maintenance window.  Certificates for
+// domains which no site has claimed are omitted; each site's certificates are
+// ordered by jurisdiction and siteid.
+func (db *ApplianceDB) RenewalsDueBySite(ctx context.Context, grace time.Duration) (map[uuid.UUID][]ServerCert, error) {
+	var rows []struct {
+		SiteUUID uuid.UUID `db:"site_uuid"`
+		ServerCert
+	}
+
+	err := db.SelectContext(ctx, &rows,
+		`SELECT
+		     d.site_uuid,
+		     c.siteid, c.jurisdiction, c.fingerprint, c.expiration, c.cert,
+		     c.issuercert, c.key
+		 FROM (
+		     SELECT DISTINCT ON (siteid, jurisdiction)
+		         siteid, jurisdiction, fingerprint, expiration, cert, issuercert, key
+		     FROM site_certs
+		     ORDER BY siteid, jurisdiction, expiration DESC
+		 ) AS c, site_domains d
+		 WHERE
+		     d.siteid = c.siteid AND
+		     d.jurisdiction = c.jurisdiction AND
+		     c.expiration - $1::interval < now()
+		 ORDER BY d.site_uuid, c.jurisdiction, c.siteid`,
+		grace.String())
+	if err != nil {
+		return nil, err
+	}
+
+	due := make(map[uuid.UUID][]ServerCert)
+	for _, row := range rows {
+		cert := row.ServerCert
+		cert.Domain, err = db.ComputeDomain(ctx, cert.SiteID,
+			cert.Jurisdiction)
+		if err != nil {
+			return nil, err
+		}
+		due[row.SiteUUID] = append(due[row.SiteUUID], cert)
+	}
+	return due, nil
+}
+
+// CertsWithExpirationMismatch returns the certs whose expiration column
+// disagrees with the NotAfter time of the certificate itself.  Certs whose
+// bytes can't be parsed are returned too, since their expiration can't be
+// trusted either.  Note that cl-cert's expiration override, used in testing,
+// deliberately produces such mismatches.
+func (db *ApplianceDB) CertsWithExpirationMismatch(ctx context.Context) ([]ServerCert, error) {
+	var certs []ServerCert
+
+	// The certificates have to be parsed here, so we have no choice but
+	// to look at every one of them.
+	err := db.SelectContext(ctx, &certs,
+		`SELECT siteid, jurisdiction, fingerprint, expiration, cert, issuercert, key
+		 FROM site_certs
+		 ORDER BY jurisdiction, siteid, expiration`)
+	if err != nil {
+		return nil, err
+	}
+
+	mismatched := make([]ServerCert, 0)
+	for _, cert := range certs {
+		parsed, err := x509.ParseCertificate(cert.Cert)
+		if err == nil && parsed.NotAfter.Equal(cert.Expiration) {
+			continue
+		}
+		cert.Domain, err = db.ComputeDomain(ctx, cert.SiteID,
+			cert.Jurisdiction)
+		if err != nil {
+			return nil, err
+		}
+		mismatched = append(mismatched, cert)
+	}
+	return mismatched, nil
+}
+
 // ServerCertByFingerprint returns the certificate for the given fingerprint.
 func (db *ApplianceDB) ServerCertByFingerprint(ctx context.Context, fingerprint []byte) (*ServerCert, error) {
 	var cert ServerCert
@@ -570,18 +679,128 @@ func (db *ApplianceDB) GetCertConfigInfoByDomain(ctx context.Context, domains []
 	return retmap, err
 }
 
+// SiteCertCoverage returns, for each of the given sites, whether it has an
+// unexpired certificate bound to its domain.  Every site passed in appears in
+// the returned map; sites without a domain or without any certificates are
+// reported as having no certificate.
+func (db *ApplianceDB) SiteCertCoverage(ctx context.Context, sites []uuid.UUID) (map[uuid.UUID]CertCoverage, error) {
+	coverage := make(map[uuid.UUID]CertCoverage, len(sites))
+	if len(sites) == 0 {
+		return coverage, nil
+	}
+	for _, u := range sites {
+		coverage[u] = CertCoverage{}
+	}
+
+	query, args, err := sqlx.In(`
+		SELECT d.site_uuid, max(c.expiration)
+		FROM site_domains d, site_certs c
+		WHERE
+			d.site_uuid IN (?) AND
+			d.jurisdiction = c.jurisdiction AND
+			d.siteid = c.siteid
+		GROUP BY d.site_uuid`, sites)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, db.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	for rows.Next() {
+		var u uuid.UUID
+		var cov CertCoverage
+		if err = rows.Scan(&u, &cov.Expiration); err != nil {
+			return nil, err
+		}
+		if cov.Expiration.After(now) {
+			cov.HasCert = true
+			cov.DaysRemaining = int(cov.Expiration.Sub(now) /
+				(24 * time.Hour))
+		}
+		coverage[u] = cov
+	}
+	return coverage, rows.Err()
+}
+
+// AllDomains returns the status of every domain we know about, whether or not
+// it has been claimed by a site: those with certificates, those registered to
+// sites, and those which have failed ACME validation.  The domains are ordered
+// by jurisdiction and siteid; offset and limit select a page of them.
+func (db *ApplianceDB) AllDomains(ctx context.Context, offset, limit int) ([]DomainStatus, error) {
+	rows, err := db.QueryContext(ctx,
+		`WITH domains AS (
+		     SELECT siteid, jurisdiction FROM site_domains
+		     UNION
+		     SELECT siteid, jurisdiction FROM site_certs
+		     UNION
+		     SELECT siteid, jurisdiction FROM failed_domains
+		 )
+		 SELECT
+		     dom.siteid, dom.jurisdiction, d.site_uuid,
+		     (SELECT max(c.expiration)
+		      FROM site_certs c
+		      WHERE (c.siteid, c.jurisdiction) = (dom.siteid, dom.jurisdiction)),
+		     COALESCE(f.fail_count, 0)
+		 FROM domains dom
+		 LEFT JOIN site_domains d USING (siteid, jurisdiction)
+		 LEFT JOIN failed_domains f USING (siteid, jurisdiction)
+		 ORDER BY dom.jurisdiction, dom.siteid
+		 OFFSET $1 LIMIT $2`,
+		offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	domains := make([]DomainStatus, 0)
+	for rows.Next() {
+		var st DomainStatus
+		err = rows.Scan(&st.SiteID, &st.Jurisdiction, &st.SiteUUID,
+			&st.CertExpiration, &st.FailCount)
+		if err != nil {
+			return nil, err
+		}
+		st.Domain, err = db.ComputeDomain(ctx, st.SiteID, st.Jurisdiction)
+		if err != nil {
+			return nil, err
+		}
+		st.Claimed = st.SiteUUID.Valid
+		st.HasCert = st.CertExpiration.Valid &&
+			st.CertExpiration.Time.After(now)
+		domains = append(domains, st)
+	}
+	return domains, rows.Err()
+}
+
 // FailDomains records the given domains as having failed ACME validation (for
-// whatever reason).
+// whatever reason).  Each call counts as another failure for a domain which
+// has already failed.
 func (db *ApplianceDB) FailDomains(ctx context.Context, domains []DecomposedDomain) error {
 	if len(domains) == 0 {
 		return nil
 	}
 
 	// What we really want is batch insert: https://github.com/jmoiron/sqlx/pull/285
-	placeholders := make([]string, len(domains))
+	// A row may only be updated once per statement, so fold duplicates.
+	type key struct {
+		siteid       int32
+		jurisdiction string
+	}
+	seen := make(map[key]bool)
+	placeholders := make([]string, 0, len(domains))
 	values := []interface{}{}
-	for i, dom := range domains {
-		placeholders[i] = "(?, ?)"
+	for _, dom := range domains {
+		k := key{dom.SiteID, dom.Jurisdiction}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		placeholders = append(placeholders, "(?, ?)")
 		values = append(values, dom.SiteID, dom.Jurisdiction)
 	}
 
@@ -589,7 +808,8 @@ func (db *ApplianceDB) FailDomains(ctx context.Context, domains []DecomposedDoma
 	query := `INSERT INTO failed_domains
 		  (siteid, jurisdiction)
 		  VALUES ` + valuesStr + `
-		  ON CONFLICT DO NOTHING`
+		  ON CONFLICT (siteid, jurisdiction) DO UPDATE
+		  SET fail_count = failed_domains.fail_count + 1`
 	query = db.Rebind(query)
 	_, err := db.ExecContext(ctx, query, values...)
 	return err
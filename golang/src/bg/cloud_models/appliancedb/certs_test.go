@@ -11,8 +11,14 @@ package appliancedb
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"database/sql"
 	"fmt"
+	"math/big"
 	"testing"
 	"time"
 
@@ -504,3 +510,362 @@ func testServerCertsDelete(t *testing.T, ds DataStore, logger *zap.Logger, slogg
 	assert.EqualValues(2, count)
 }
 
+
+func testSiteCertCoverage(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, &testID2)
+	mkOrgSiteApp(t, ds, &testOrg3, &testSite3, &testID3)
+	sites := []uuid.UUID{testSite1.UUID, testSite2.UUID, testSite3.UUID}
+
+	// An empty list of sites returns an empty map.
+	coverage, err := ds.SiteCertCoverage(ctx, []uuid.UUID{})
+	assert.NoError(err)
+	assert.Empty(coverage)
+
+	// One domain per site; nothing is covered yet.
+	var domains []DecomposedDomain
+	for range sites {
+		domain, err := ds.NextDomain(ctx, "")
+		assert.NoError(err)
+		domains = append(domains, domain)
+	}
+	for _, site := range sites {
+		_, _, err := ds.RegisterDomain(ctx, site, "")
+		assert.NoError(err)
+	}
+	coverage, err = ds.SiteCertCoverage(ctx, sites)
+	assert.NoError(err)
+	assert.Len(coverage, 3)
+	for _, site := range sites {
+		assert.False(coverage[site].HasCert)
+		assert.True(coverage[site].Expiration.IsZero())
+	}
+
+	now := time.Now()
+	expValid := now.Add(90*24*time.Hour + time.Hour).Round(time.Millisecond).UTC()
+	expSoon := now.Add(5*24*time.Hour + time.Hour).Round(time.Millisecond).UTC()
+	expPast := now.Add(-30 * 24 * time.Hour).Round(time.Millisecond).UTC()
+
+	mkCert := func(domain DecomposedDomain, fp byte, exp time.Time) {
+		err := ds.InsertServerCert(ctx, &ServerCert{
+			Domain:       domain.Domain,
+			SiteID:       domain.SiteID,
+			Jurisdiction: domain.Jurisdiction,
+			Fingerprint:  []byte{fp, fp, fp, fp},
+			Expiration:   exp,
+			Cert:         []byte{fp},
+			IssuerCert:   []byte{fp},
+			Key:          []byte{fp},
+		})
+		assert.NoError(err)
+	}
+
+	// Site 1 has a valid cert; site 2 has an expired cert and one about
+	// to expire; site 3 has no certs at all.
+	mkCert(domains[0], 0x01, expValid)
+	mkCert(domains[1], 0x02, expPast)
+	mkCert(domains[1], 0x03, expSoon)
+
+	// Include a site we know nothing about.
+	unknown := uuid.Must(uuid.FromString("20000000-2000-2000-2000-000000000099"))
+	coverage, err = ds.SiteCertCoverage(ctx, append(sites, unknown))
+	assert.NoError(err)
+	assert.Len(coverage, 4)
+
+	cov := coverage[testSite1.UUID]
+	assert.True(cov.HasCert)
+	assert.Equal(expValid, cov.Expiration.UTC())
+	assert.Equal(90, cov.DaysRemaining)
+
+	cov = coverage[testSite2.UUID]
+	assert.True(cov.HasCert)
+	assert.Equal(expSoon, cov.Expiration.UTC())
+	assert.Equal(5, cov.DaysRemaining)
+
+	assert.Equal(CertCoverage{}, coverage[testSite3.UUID])
+	assert.Equal(CertCoverage{}, coverage[unknown])
+
+	// Once the only cert a site has expires, it is no longer covered, but
+	// we still report when that happened.
+	mkCert(domains[2], 0x04, expPast)
+	coverage, err = ds.SiteCertCoverage(ctx, sites)
+	assert.NoError(err)
+	cov = coverage[testSite3.UUID]
+	assert.False(cov.HasCert)
+	assert.Equal(expPast, cov.Expiration.UTC())
+	assert.Equal(0, cov.DaysRemaining)
+}
+
+func testRenewalsDueBySite(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, &testID2)
+	mkOrgSiteApp(t, ds, &testOrg3, &testSite3, &testID3)
+	sites := []uuid.UUID{testSite1.UUID, testSite2.UUID, testSite3.UUID}
+
+	due, err := ds.RenewalsDueBySite(ctx, 30*24*time.Hour)
+	assert.NoError(err)
+	assert.Empty(due)
+
+	// One domain per site, and one which no site has claimed
+	var domains []DecomposedDomain
+	for range sites {
+		domain, err := ds.NextDomain(ctx, "")
+		assert.NoError(err)
+		domains = append(domains, domain)
+	}
+	for _, site := range sites {
+		_, _, err := ds.RegisterDomain(ctx, site, "")
+		assert.NoError(err)
+	}
+	unclaimed, err := ds.NextDomain(ctx, "")
+	assert.NoError(err)
+
+	now := time.Now()
+	expValid := now.Add(90 * 24 * time.Hour).Round(time.Millisecond).UTC()
+	expSoon := now.Add(5 * 24 * time.Hour).Round(time.Millisecond).UTC()
+	expPast := now.Add(-30 * 24 * time.Hour).Round(time.Millisecond).UTC()
+
+	mkCert := func(domain DecomposedDomain, fp byte, exp time.Time) {
+		err := ds.InsertServerCert(ctx, &ServerCert{
+			Domain:       domain.Domain,
+			SiteID:       domain.SiteID,
+			Jurisdiction: domain.Jurisdiction,
+			Fingerprint:  []byte{fp, fp, fp, fp},
+			Expiration:   exp,
+			Cert:         []byte{fp},
+			IssuerCert:   []byte{fp},
+			Key:          []byte{fp},
+		})
+		assert.NoError(err)
+	}
+
+	// Site 1's cert is about to expire; site 2's expired, but has since
+	// been renewed; site 3's has expired.  The unclaimed domain's cert is
+	// about to expire, but there's no site to renew it for.
+	mkCert(domains[0], 0x01, expSoon)
+	mkCert(domains[1], 0x02, expPast)
+	mkCert(domains[1], 0x03, expValid)
+	mkCert(domains[2], 0x04, expPast)
+	mkCert(unclaimed, 0x05, expSoon)
+
+	due, err = ds.RenewalsDueBySite(ctx, 30*24*time.Hour)
+	assert.NoError(err)
+	assert.Len(due, 2)
+	assert.Len(due[testSite1.UUID], 1)
+	cert := due[testSite1.UUID][0]
+	assert.Equal(domains[0].Domain, cert.Domain)
+	assert.Equal([]byte{0x01, 0x01, 0x01, 0x01}, cert.Fingerprint)
+	assert.Equal(expSoon, cert.Expiration.UTC())
+	assert.Len(due[testSite3.UUID], 1)
+	cert = due[testSite3.UUID][0]
+	assert.Equal(domains[2].Domain, cert.Domain)
+	assert.Equal([]byte{0x04, 0x04, 0x04, 0x04}, cert.Fingerprint)
+	assert.NotContains(due, testSite2.UUID)
+
+	// The same certs as CertsExpiringWithin, less the unclaimed one
+	expiring, err := ds.CertsExpiringWithin(ctx, 30*24*time.Hour)
+	assert.NoError(err)
+	assert.Len(expiring, 3)
+
+	// A shorter window leaves out the cert which hasn't expired yet
+	due, err = ds.RenewalsDueBySite(ctx, 24*time.Hour)
+	assert.NoError(err)
+	assert.Len(due, 1)
+	assert.Len(due[testSite3.UUID], 1)
+}
+
+func testAllDomains(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, &testID2)
+
+	// Nothing known yet
+	all, err := ds.AllDomains(ctx, 0, 100)
+	assert.NoError(err)
+	assert.Empty(all)
+
+	var domains []DecomposedDomain
+	for i := 0; i < 4; i++ {
+		domain, err := ds.NextDomain(ctx, "")
+		assert.NoError(err)
+		domains = append(domains, domain)
+	}
+	for _, site := range []uuid.UUID{testSite1.UUID, testSite2.UUID} {
+		_, _, err := ds.RegisterDomain(ctx, site, "")
+		assert.NoError(err)
+	}
+
+	now := time.Now()
+	expValid := now.Add(90 * 24 * time.Hour).Round(time.Millisecond).UTC()
+	expPast := now.Add(-30 * 24 * time.Hour).Round(time.Millisecond).UTC()
+	mkCert := func(domain DecomposedDomain, fp byte, exp time.Time) {
+		err := ds.InsertServerCert(ctx, &ServerCert{
+			Domain:       domain.Domain,
+			SiteID:       domain.SiteID,
+			Jurisdiction: domain.Jurisdiction,
+			Fingerprint:  []byte{fp, fp, fp, fp},
+			Expiration:   exp,
+			Cert:         []byte{fp},
+			IssuerCert:   []byte{fp},
+			Key:          []byte{fp},
+		})
+		assert.NoError(err)
+	}
+
+	// Domain 0 is claimed by site 1, has a valid cert (and an older expired
+	// one), and has failed twice.  Domain 1 is claimed by site 2, with no
+	// cert.  Domain 2 is unclaimed, with only an expired cert.  Domain 3
+	// has only failed, as has a domain in another jurisdiction.
+	mkCert(domains[0], 0x01, expPast)
+	mkCert(domains[0], 0x02, expValid)
+	mkCert(domains[2], 0x03, expPast)
+	ukDomain := DecomposedDomain{SiteID: 5, Jurisdiction: "uk"}
+	err = ds.FailDomains(ctx, []DecomposedDomain{domains[0], domains[3],
+		ukDomain, domains[3]})
+	assert.NoError(err)
+	err = ds.FailDomains(ctx, []DecomposedDomain{domains[0]})
+	assert.NoError(err)
+
+	all, err = ds.AllDomains(ctx, 0, 100)
+	assert.NoError(err)
+	assert.Len(all, 5)
+
+	d := all[0]
+	assert.Equal(domains[0], d.DecomposedDomain)
+	assert.True(d.Claimed)
+	assert.Equal(uuid.NullUUID{UUID: testSite1.UUID, Valid: true}, d.SiteUUID)
+	assert.True(d.HasCert)
+	assert.Equal(expValid, d.CertExpiration.Time.UTC())
+	assert.Equal(2, d.FailCount)
+
+	d = all[1]
+	assert.Equal(domains[1], d.DecomposedDomain)
+	assert.True(d.Claimed)
+	assert.Equal(testSite2.UUID, d.SiteUUID.UUID)
+	assert.False(d.HasCert)
+	assert.False(d.CertExpiration.Valid)
+	assert.Equal(0, d.FailCount)
+
+	d = all[2]
+	assert.Equal(domains[2], d.DecomposedDomain)
+	assert.False(d.Claimed)
+	assert.False(d.SiteUUID.Valid)
+	assert.False(d.HasCert)
+	assert.Equal(expPast, d.CertExpiration.Time.UTC())
+	assert.Equal(0, d.FailCount)
+
+	d = all[3]
+	assert.Equal(domains[3], d.DecomposedDomain)
+	assert.False(d.Claimed)
+	assert.False(d.HasCert)
+	assert.Equal(1, d.FailCount)
+
+	d = all[4]
+	assert.Equal("uk", d.Jurisdiction)
+	assert.Equal(int32(5), d.SiteID)
+	assert.NotEmpty(d.Domain)
+	assert.False(d.Claimed)
+	assert.Equal(1, d.FailCount)
+
+	// Paging through the domains gives the same results
+	page, err := ds.AllDomains(ctx, 0, 2)
+	assert.NoError(err)
+	assert.Equal(all[:2], page)
+	page, err = ds.AllDomains(ctx, 2, 2)
+	assert.NoError(err)
+	assert.Equal(all[2:4], page)
+	page, err = ds.AllDomains(ctx, 4, 2)
+	assert.NoError(err)
+	assert.Equal(all[4:], page)
+
+	// Clearing the failures resets the counts, and forgets the domains we
+	// only knew about because they failed.
+	_, err = ds.FailedDomains(ctx, false)
+	assert.NoError(err)
+	all, err = ds.AllDomains(ctx, 0, 100)
+	assert.NoError(err)
+	assert.Len(all, 3)
+	for _, d := range all {
+		assert.Equal(0, d.FailCount)
+	}
+}
+
+// mkTestCertDER returns a DER-encoded self-signed certificate which expires at
+// notAfter.
+func mkTestCertDER(t *testing.T, notAfter time.Time) []byte {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test.brightgate.net"},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		&priv.PublicKey, priv)
+	require.NoError(t, err)
+	return der
+}
+
+func testCertsExpirationMismatch(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	certs, err := ds.CertsWithExpirationMismatch(ctx)
+	assert.NoError(err)
+	assert.Empty(certs)
+
+	domain, err := ds.NextDomain(ctx, "")
+	assert.NoError(err)
+
+	// Certificate validity times have a resolution of one second
+	notAfter := time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second)
+	mkCert := func(fp byte, exp time.Time, der []byte) {
+		err := ds.InsertServerCert(ctx, &ServerCert{
+			SiteID:       domain.SiteID,
+			Jurisdiction: domain.Jurisdiction,
+			Fingerprint:  []byte{fp, fp, fp, fp},
+			Expiration:   exp,
+			Cert:         der,
+			IssuerCert:   []byte{fp},
+			Key:          []byte{fp},
+		})
+		assert.NoError(err)
+	}
+
+	// A cert whose expiration matches its bytes is fine, regardless of the
+	// time zone it was recorded in.
+	mkCert(0x01, notAfter.In(time.FixedZone("PDT", -7*60*60)),
+		mkTestCertDER(t, notAfter))
+	certs, err = ds.CertsWithExpirationMismatch(ctx)
+	assert.NoError(err)
+	assert.Empty(certs)
+
+	// A cert whose recorded expiration is off by a day is reported
+	mkCert(0x02, notAfter.Add(24*time.Hour), mkTestCertDER(t, notAfter))
+	certs, err = ds.CertsWithExpirationMismatch(ctx)
+	assert.NoError(err)
+	assert.Len(certs, 1)
+	assert.Equal([]byte{0x02, 0x02, 0x02, 0x02}, certs[0].Fingerprint)
+	assert.Equal(domain.Domain, certs[0].Domain)
+	assert.Equal(notAfter.Add(24*time.Hour).UTC(), certs[0].Expiration.UTC())
+
+	// As is one whose bytes aren't a certificate at all
+	mkCert(0x03, notAfter, []byte{0x03})
+	certs, err = ds.CertsWithExpirationMismatch(ctx)
+	assert.NoError(err)
+	assert.Len(certs, 2)
+	fps := [][]byte{certs[0].Fingerprint, certs[1].Fingerprint}
+	assert.ElementsMatch([][]byte{
+		{0x02, 0x02, 0x02, 0x02},
+		{0x03, 0x03, 0x03, 0x03},
+	}, fps)
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/lib/pq"
+	"github.com/satori/uuid"
+)
+
+// MaxSiteCheckpoints is the number of configuration checkpoints retained for
+// each site.  Creating a checkpoint beyond this limit discards the oldest.
+const MaxSiteCheckpoints = 20
+
+type checkpointManager interface {
+	CreateCheckpoint(context.Context, uuid.UUID, string, string) (*SiteConfigCheckpoint, error)
+	ListCheckpoints(context.Context, uuid.UUID) ([]SiteConfigCheckpoint, error)
+	GetCheckpoint(context.Context, uuid.UUID, int64) (*SiteConfigCheckpoint, error)
+	DeleteCheckpoint(context.Context, uuid.UUID, int64) error
+	RollbackPlan(context.Context, uuid.UUID, int64) (*RollbackPlan, error)
+}
+
+// SiteConfigCheckpoint represents a row in the site_config_checkpoint table: a
+// named copy of a site's config store, along with the ID of the last command
+// which had completed when the copy was made.  LastCommandID is null if no
+// command had completed yet.
+type SiteConfigCheckpoint struct {
+	ID            int64     `json:"id" db:"id"`
+	SiteUUID      uuid.UUID `json:"site_uuid" db:"site_uuid"`
+	Name          string    `json:"name" db:"name"`
+	CreatedBy     string    `json:"created_by" db:"created_by"`
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+	RootHash      []byte    `json:"root_hash" db:"root_hash"`
+	Config        []byte    `json:"config" db:"config"`
+	LastCommandID null.Int  `json:"last_command_id" db:"last_command_id"`
+}
+
+// RollbackPlan describes what restoring a checkpoint would undo: the commands
+// which have completed since the checkpoint was captured, oldest first.
+type RollbackPlan struct {
+	Checkpoint *SiteConfigCheckpoint
+	Completed  []*SiteCommand
+}
+
+// CreateCheckpoint captures the current contents of a site's config store
+// under the given name.  The config and the ID of the most recent completed
+// command are read by a single statement, so they are consistent with one
+// another even while the site is processing commands.  If the site already has
+// MaxSiteCheckpoints checkpoints, the oldest are deleted.
+func (db *ApplianceDB) CreateCheckpoint(ctx context.Context, siteUUID uuid.UUID,
+	name, actor string) (*SiteConfigCheckpoint, error) {
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var cp SiteConfigCheckpoint
+	err = tx.GetContext(ctx, &cp, `
+		INSERT INTO site_config_checkpoint
+		    (site_uuid, name, created_by, root_hash, config, last_command_id)
+		SELECT cs.site_uuid, $2, $3, cs.root_hash, cs.config, (
+		    SELECT max(id)
+		    FROM site_commands
+		    WHERE site_uuid = $1 AND state = 'DONE')
+		FROM site_config_store cs
+		WHERE cs.site_uuid = $1
+		RETURNING *`,
+		siteUUID, name, actor)
+	if err == sql.ErrNoRows {
+		return nil, NotFoundError{fmt.Sprintf(
+			"CreateCheckpoint: Couldn't find config for %v", siteUUID)}
+	} else if pqErr, ok := err.(*pq.Error); ok &&
+		pqErr.Code.Name() == "unique_violation" {
+		return nil, UniqueViolationError{
+			Message:    pqErr.Message,
+			Detail:     pqErr.Detail,
+			Schema:     pqErr.Schema,
+			Table:      pqErr.Table,
+			Constraint: pqErr.Constraint,
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM site_config_checkpoint
+		WHERE site_uuid = $1 AND id NOT IN (
+		    SELECT id
+		    FROM site_config_checkpoint
+		    WHERE site_uuid = $1
+		    ORDER BY created_at DESC, id DESC
+		    LIMIT $2)`,
+		siteUUID, MaxSiteCheckpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// ListCheckpoints returns the checkpoints for a site, newest first.  The
+// Config field of the returned checkpoints is not filled in; use GetCheckpoint
+// to retrieve it.
+func (db *ApplianceDB) ListCheckpoints(ctx context.Context, siteUUID uuid.UUID) ([]SiteConfigCheckpoint, error) {
+	var cps []SiteConfigCheckpoint
+	err := db.SelectContext(ctx, &cps, `
+		SELECT id, site_uuid, name, created_by, created_at, root_hash,
+		    last_command_id
+		FROM site_config_checkpoint
+		WHERE site_uuid = $1
+		ORDER BY created_at DESC, id DESC`, siteUUID)
+	if err != nil {
+		return nil, err
+	}
+	return cps, nil
+}
+
+// GetCheckpoint returns a single checkpoint belonging to a site
+func (db *ApplianceDB) GetCheckpoint(ctx context.Context, siteUUID uuid.UUID,
+	id int64) (*SiteConfigCheckpoint, error) {
+
+	var cp SiteConfigCheckpoint
+	err := db.GetContext(ctx, &cp, `
+		SELECT * FROM site_config_checkpoint
+		WHERE site_uuid = $1 AND id = $2`, siteUUID, id)
+	switch err {
+	case sql.ErrNoRows:
+		return nil, NotFoundError{fmt.Sprintf(
+			"GetCheckpoint: Couldn't find checkpoint %d for %v",
+			id, siteUUID)}
+	case nil:
+		return &cp, nil
+	default:
+		return nil, err
+	}
+}
+
+// DeleteCheckpoint removes a checkpoint belonging to a site.  NotFoundError is
+// returned if there is no such checkpoint.
+func (db *ApplianceDB) DeleteCheckpoint(ctx context.Context, siteUUID uuid.UUID,
+	id int64) error {
+
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM site_config_checkpoint
+		WHERE site_uuid = $1 AND id = $2`, siteUUID, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return NotFoundError{fmt.Sprintf(
+			"DeleteCheckpoint: Couldn't find checkpoint %d for %v",
+			id, siteUUID)}
+	}
+	return nil
+}
+
+// RollbackPlan reports the commands which have completed since a checkpoint
+// was captured, so that an operator can see what restoring it would undo.  A
+// command counts if its ID is beyond the checkpoint's last completed command,
+// or if it was still in flight at capture time and has completed since.
+//
+// The plan only covers commands still in the queue; those removed by
+// CommandDelete can't be reported.
+func (db *ApplianceDB) RollbackPlan(ctx context.Context, siteUUID uuid.UUID,
+	id int64) (*RollbackPlan, error) {
+
+	cp, err := db.GetCheckpoint(ctx, siteUUID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	u := uuid.NullUUID{UUID: siteUUID, Valid: true}
+	cmds, err := db.CommandAudit(ctx, u, 0, math.MaxUint32)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &RollbackPlan{
+		Checkpoint: cp,
+		Completed:  make([]*SiteCommand, 0),
+	}
+	for _, cmd := range cmds {
+		if cmd.State != "DONE" {
+			continue
+		}
+		if !cp.LastCommandID.Valid || cmd.ID > cp.LastCommandID.Int64 ||
+			(cmd.DoneTime.Valid && cmd.DoneTime.Time.After(cp.CreatedAt)) {
+			plan.Completed = append(plan.Completed, cmd)
+		}
+	}
+	return plan, nil
+}
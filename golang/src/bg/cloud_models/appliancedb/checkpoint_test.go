@@ -0,0 +1,186 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/satori/uuid"
+	"github.com/stretchr/testify/require"
+
+	"go.uber.org/zap"
+)
+
+func testCheckpoints(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, &testID2)
+
+	submit := func(u uuid.UUID, query string) int64 {
+		cmd := &SiteCommand{
+			EnqueuedTime: time.Now(),
+			Query:        []byte(query),
+		}
+		err := ds.CommandSubmit(ctx, u, cmd)
+		assert.NoError(err)
+		return cmd.ID
+	}
+	complete := func(u uuid.UUID, id int64) {
+		_, _, err := ds.CommandComplete(ctx, u, id, []byte("ok"))
+		assert.NoError(err)
+	}
+
+	// A site without a config store can't be checkpointed
+	_, err := ds.CreateCheckpoint(ctx, testSite1.UUID, "empty", "tester")
+	assert.IsType(NotFoundError{}, err)
+
+	acs := SiteConfigStore{
+		RootHash:  hexDecode("cafebeef"),
+		TimeStamp: time.Now(),
+		Config:    hexDecode("deadbeef"),
+	}
+	err = ds.UpsertConfigStore(ctx, testSite1.UUID, &acs)
+	assert.NoError(err)
+
+	// Before any command has completed, there is no last command
+	cp0, err := ds.CreateCheckpoint(ctx, testSite1.UUID, "initial", "tester")
+	assert.NoError(err)
+	assert.False(cp0.LastCommandID.Valid)
+
+	// The checkpoint captures the config store and the newest completed
+	// command; commands which are queued, in flight, or belong to other
+	// sites don't count.
+	done1 := submit(testSite1.UUID, "one")
+	inflight := submit(testSite1.UUID, "two")
+	done2 := submit(testSite1.UUID, "three")
+	queued := submit(testSite1.UUID, "four")
+	other := submit(testSite2.UUID, "other")
+	complete(testSite1.UUID, done1)
+	complete(testSite1.UUID, done2)
+	complete(testSite2.UUID, other)
+	_, err = ds.CommandFetch(ctx, testSite1.UUID, done1, 1)
+	assert.NoError(err)
+
+	cp, err := ds.CreateCheckpoint(ctx, testSite1.UUID, "before-change",
+		"support@brightgate.com")
+	assert.NoError(err)
+	assert.Equal(testSite1.UUID, cp.SiteUUID)
+	assert.Equal("before-change", cp.Name)
+	assert.Equal("support@brightgate.com", cp.CreatedBy)
+	assert.Equal(hexDecode("cafebeef"), cp.RootHash)
+	assert.Equal(hexDecode("deadbeef"), cp.Config)
+	assert.True(cp.LastCommandID.Valid)
+	assert.Equal(done2, cp.LastCommandID.Int64)
+
+	// Names are unique within a site
+	_, err = ds.CreateCheckpoint(ctx, testSite1.UUID, "before-change", "tester")
+	assert.IsType(UniqueViolationError{}, err)
+
+	// Later changes to the site don't affect the checkpoint
+	acs.RootHash = hexDecode("feedface")
+	acs.Config = hexDecode("f00dface")
+	err = ds.UpsertConfigStore(ctx, testSite1.UUID, &acs)
+	assert.NoError(err)
+	done3 := submit(testSite1.UUID, "five")
+	complete(testSite1.UUID, done3)
+	complete(testSite1.UUID, inflight)
+	_, _, err = ds.CommandCancel(ctx, testSite1.UUID, queued)
+	assert.NoError(err)
+
+	got, err := ds.GetCheckpoint(ctx, testSite1.UUID, cp.ID)
+	assert.NoError(err)
+	assert.Equal(hexDecode("deadbeef"), got.Config)
+	assert.Equal(done2, got.LastCommandID.Int64)
+
+	// The plan lists what completed since the checkpoint: newer commands,
+	// and commands which were in flight when it was taken.  Canceled
+	// commands didn't change anything.
+	plan, err := ds.RollbackPlan(ctx, testSite1.UUID, cp.ID)
+	assert.NoError(err)
+	assert.Equal(cp.ID, plan.Checkpoint.ID)
+	assert.Len(plan.Completed, 2)
+	assert.Equal(inflight, plan.Completed[0].ID)
+	assert.Equal(done3, plan.Completed[1].ID)
+
+	plan, err = ds.RollbackPlan(ctx, testSite1.UUID, cp0.ID)
+	assert.NoError(err)
+	assert.Len(plan.Completed, 4)
+
+	// Checkpoints are scoped to their site
+	_, err = ds.GetCheckpoint(ctx, testSite2.UUID, cp.ID)
+	assert.IsType(NotFoundError{}, err)
+	_, err = ds.RollbackPlan(ctx, testSite2.UUID, cp.ID)
+	assert.IsType(NotFoundError{}, err)
+	err = ds.DeleteCheckpoint(ctx, testSite2.UUID, cp.ID)
+	assert.IsType(NotFoundError{}, err)
+
+	cps, err := ds.ListCheckpoints(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.Len(cps, 2)
+	assert.Equal(cp.ID, cps[0].ID)
+	assert.Equal(cp0.ID, cps[1].ID)
+	assert.Nil(cps[0].Config)
+
+	err = ds.DeleteCheckpoint(ctx, testSite1.UUID, cp0.ID)
+	assert.NoError(err)
+	err = ds.DeleteCheckpoint(ctx, testSite1.UUID, cp0.ID)
+	assert.IsType(NotFoundError{}, err)
+}
+
+func testCheckpointRetention(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, &testID2)
+
+	acs := SiteConfigStore{
+		RootHash:  hexDecode("cafebeef"),
+		TimeStamp: time.Now(),
+		Config:    hexDecode("deadbeef"),
+	}
+	for _, u := range []uuid.UUID{testSite1.UUID, testSite2.UUID} {
+		err := ds.UpsertConfigStore(ctx, u, &acs)
+		assert.NoError(err)
+	}
+
+	other, err := ds.CreateCheckpoint(ctx, testSite2.UUID, "other", "tester")
+	assert.NoError(err)
+
+	var first *SiteConfigCheckpoint
+	for i := 0; i < MaxSiteCheckpoints+2; i++ {
+		cp, err := ds.CreateCheckpoint(ctx, testSite1.UUID,
+			fmt.Sprintf("cp-%d", i), "tester")
+		assert.NoError(err)
+		if first == nil {
+			first = cp
+		}
+	}
+
+	// The oldest checkpoints are discarded once the limit is reached
+	cps, err := ds.ListCheckpoints(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.Len(cps, MaxSiteCheckpoints)
+	assert.Equal(fmt.Sprintf("cp-%d", MaxSiteCheckpoints+1), cps[0].Name)
+	assert.Equal("cp-2", cps[MaxSiteCheckpoints-1].Name)
+	_, err = ds.GetCheckpoint(ctx, testSite1.UUID, first.ID)
+	assert.IsType(NotFoundError{}, err)
+
+	// Each site has its own limit
+	cps, err = ds.ListCheckpoints(ctx, testSite2.UUID)
+	assert.NoError(err)
+	assert.Len(cps, 1)
+	assert.Equal(other.ID, cps[0].ID)
+}
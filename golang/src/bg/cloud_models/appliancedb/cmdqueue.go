@@ -12,9 +12,13 @@ package appliancedb
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
+	"bg/common/cfgmsg"
+
 	"github.com/guregu/null"
 	"github.com/satori/uuid"
 )
@@ -24,10 +28,11 @@ type commandQueue interface {
 	CommandSubmit(context.Context, uuid.UUID, *SiteCommand) error
 	CommandFetch(context.Context, uuid.UUID, int64, uint32) ([]*SiteCommand, error)
 	CommandAudit(context.Context, uuid.NullUUID, int64, uint32) ([]*SiteCommand, error)
-	CommandAuditHealth(context.Context, uuid.NullUUID, time.Time) ([]*SiteCommand, error)
+	CommandAuditHealth(context.Context, uuid.NullUUID, time.Time, bool) ([]*SiteCommand, error)
 	CommandCancel(context.Context, uuid.UUID, int64) (*SiteCommand, *SiteCommand, error)
 	CommandComplete(context.Context, uuid.UUID, int64, []byte) (*SiteCommand, *SiteCommand, error)
 	CommandDelete(context.Context, uuid.UUID, int64) (int64, error)
+	CommandsTouchingPath(context.Context, uuid.UUID, string, time.Time) ([]*SiteCommand, error)
 }
 
 // SiteCommand represents an entry in the persisted command queue.
@@ -64,11 +69,16 @@ func (db *ApplianceDB) CommandSearch(ctx context.Context, u uuid.UUID, cmdID int
 }
 
 // CommandSubmit adds a command to the command queue, and returns its ID.
+// Commands can't be submitted to an archived site; SiteArchivedError is
+// returned instead.
 func (db *ApplianceDB) CommandSubmit(ctx context.Context, u uuid.UUID, cmd *SiteCommand) error {
 	rows, err := db.QueryContext(ctx,
 		`INSERT INTO site_commands
 		 (site_uuid, enq_ts, config_query)
-		 VALUES ($1, $2, $3)
+		 SELECT $1::uuid, $2::timestamp with time zone, $3::bytea
+		 WHERE NOT EXISTS (
+		   SELECT 1 FROM customer_site
+		   WHERE uuid = $1 AND archived_at IS NOT NULL)
 		 RETURNING id`,
 		u,
 		cmd.EnqueuedTime,
@@ -81,8 +91,8 @@ func (db *ApplianceDB) CommandSubmit(ctx context.Context, u uuid.UUID, cmd *Site
 		if err = rows.Err(); err != nil {
 			return err
 		}
-		// This is probably impossible.
-		return fmt.Errorf("INSERT INTO site_commands didn't insert?")
+		// Nothing was inserted, so the site is archived.
+		return SiteArchivedError{u}
 	}
 	var id int64
 	if err = rows.Scan(&id); err != nil {
@@ -192,18 +202,22 @@ func (db *ApplianceDB) CommandAudit(ctx context.Context, u uuid.NullUUID, start
 // Care must be used to be sure that public consumers of this interface are not
 // allowed to pass a nulled UUID, which would allow access to all commands.
 //
-func (db *ApplianceDB) CommandAuditHealth(ctx context.Context, u uuid.NullUUID, before time.Time) ([]*SiteCommand, error) {
+// Commands for archived sites are left out unless includeArchived is set.
+//
+func (db *ApplianceDB) CommandAuditHealth(ctx context.Context, u uuid.NullUUID, before time.Time, includeArchived bool) ([]*SiteCommand, error) {
 	// Maybe this should return some stats instead?  Then we'd know something about the
 	// last time we completed a command too.  Or extend audit with a Nullable state.-- maybe better.
 	cmds := make([]*SiteCommand, 0)
 
 	err := db.SelectContext(ctx, &cmds,
-		`SELECT *
-		     FROM site_commands
-		     WHERE ($1::uuid IS NULL OR site_uuid = $1)
-		       AND (state = 'ENQD' or state = 'WORK')
-		       AND (enq_ts < $2)
-		     ORDER BY id`, u, before)
+		`SELECT c.*
+		     FROM site_commands c
+		       JOIN customer_site s ON c.site_uuid = s.uuid
+		     WHERE ($1::uuid IS NULL OR c.site_uuid = $1)
+		       AND (c.state = 'ENQD' or c.state = 'WORK')
+		       AND (c.enq_ts < $2)
+		       AND ($3 OR s.archived_at IS NULL)
+		     ORDER BY c.id`, u, before, includeArchived)
 	return cmds, err
 }
 
@@ -284,3 +298,64 @@ func (db *ApplianceDB) CommandDelete(ctx context.Context, u uuid.UUID, keep int6
 	return numDeleted, err
 }
 
+
+// opTouchesPath returns true if a config operation reads or changes the given
+// property or anything beneath it.  An operation on one of the property's
+// ancestors only counts if it could have changed the property: reading the
+// whole tree doesn't touch every path in it, but deleting or replacing it
+// does.
+func opTouchesPath(op *cfgmsg.ConfigOp, prefix string) bool {
+	prop := strings.TrimSuffix(op.Property, "/")
+	if prop == prefix || strings.HasPrefix(prop, prefix+"/") {
+		return true
+	}
+
+	switch op.Operation {
+	case cfgmsg.ConfigOp_REPLACE:
+		return true
+	case cfgmsg.ConfigOp_DELETE:
+		return strings.HasPrefix(prefix, prop+"/")
+	}
+	return false
+}
+
+// CommandsTouchingPath returns a site's commands enqueued since the given
+// time, sorted by ID, whose operations touch the given property path or
+// anything beneath it (see opTouchesPath).  The queries are stored as opaque
+// payloads, so the site's recent commands are fetched and decoded here; those
+// which can't be decoded are skipped.
+func (db *ApplianceDB) CommandsTouchingPath(ctx context.Context, u uuid.UUID,
+	pathPrefix string, since time.Time) ([]*SiteCommand, error) {
+
+	if !strings.HasPrefix(pathPrefix, "@") {
+		return nil, ValidationError{"pathPrefix", pathPrefix,
+			"must start with @"}
+	}
+	prefix := strings.TrimSuffix(pathPrefix, "/")
+
+	cmds := make([]*SiteCommand, 0)
+	err := db.SelectContext(ctx, &cmds,
+		`SELECT *
+		     FROM site_commands
+		     WHERE site_uuid = $1 AND enq_ts >= $2
+		     ORDER BY id`,
+		u, since)
+	if err != nil {
+		return nil, err
+	}
+
+	matched := make([]*SiteCommand, 0)
+	for _, cmd := range cmds {
+		var query cfgmsg.ConfigQuery
+		if err := json.Unmarshal(cmd.Query, &query); err != nil {
+			continue
+		}
+		for _, op := range query.Ops {
+			if op != nil && opTouchesPath(op, prefix) {
+				matched = append(matched, cmd)
+				break
+			}
+		}
+	}
+	return matched, nil
+}
@@ -0,0 +1,416 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/lib/pq"
+	"github.com/satori/uuid"
+)
+
+// DefaultReleaseChannel is the channel of a release whose metadata doesn't
+// name one.
+const DefaultReleaseChannel = "default"
+
+// The results a site may report for a deployment.  DeploymentPending is not a
+// result; it is used to count the targets which haven't reported yet.
+const (
+	DeploymentSuccess    = "success"
+	DeploymentFailed     = "failed"
+	DeploymentRolledBack = "rolled-back"
+	DeploymentPending    = "pending"
+)
+
+var deploymentResults = map[string]bool{
+	DeploymentSuccess:    true,
+	DeploymentFailed:     true,
+	DeploymentRolledBack: true,
+}
+
+type deploymentManager interface {
+	CreateDeployment(context.Context, uuid.UUID, string, []uuid.UUID) (*ReleaseDeployment, error)
+	RecordDeploymentResult(context.Context, uuid.UUID, uuid.UUID, string, string, time.Time) error
+	DeploymentStatus(context.Context, uuid.UUID, time.Duration) (*DeploymentSummary, error)
+	SitesEligibleForRollout(context.Context, RolloutCriteria) ([]CustomerSite, error)
+}
+
+// ReleaseDeployment represents a row in the release_deployment table: a
+// campaign to roll a release out to a fixed set of sites.
+type ReleaseDeployment struct {
+	UUID        uuid.UUID `json:"deployment_uuid" db:"deployment_uuid"`
+	ReleaseUUID uuid.UUID `json:"release_uuid" db:"release_uuid"`
+	Channel     string    `json:"channel" db:"channel"`
+	Name        string    `json:"name" db:"name"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+}
+
+// DeploymentTarget represents a row in the release_deployment_target table: a
+// site included in a deployment, along with the most recent result it
+// reported.  Status is null until the site reports.
+type DeploymentTarget struct {
+	DeploymentUUID uuid.UUID   `json:"deployment_uuid" db:"deployment_uuid"`
+	SiteUUID       uuid.UUID   `json:"site_uuid" db:"site_uuid"`
+	Channel        string      `json:"channel" db:"channel"`
+	Status         null.String `json:"status" db:"status"`
+	Detail         null.String `json:"detail" db:"detail"`
+	ReportedAt     null.Time   `json:"reported_at" db:"reported_at"`
+}
+
+// DeploymentSummary describes the progress of a deployment.  Counts holds the
+// number of targets with each result, with those yet to report counted as
+// DeploymentPending.  Laggards lists the pending sites which have had longer
+// than the allotted window to report.
+type DeploymentSummary struct {
+	Deployment ReleaseDeployment `json:"deployment"`
+	Targets    int               `json:"targets"`
+	Counts     map[string]int    `json:"counts"`
+	Laggards   []uuid.UUID       `json:"laggards"`
+}
+
+// RolloutCriteria describes the sites to which a staged rollout may proceed.
+// MinRelease, if not uuid.Nil, requires that each of a site's appliances be
+// known to be running that release or a later one; HeartbeatWithin, if
+// non-zero, requires that each of them have sent a heartbeat within that
+// long.  Feature flags are kept in each site's configuration tree, so callers
+// must check those themselves.
+type RolloutCriteria struct {
+	MinRelease      uuid.UUID
+	HeartbeatWithin time.Duration
+}
+
+// DeploymentOverlapError is returned when a deployment would target sites
+// which are still awaiting another deployment on the same release channel.
+// Sites maps each such site to the deployment it is awaiting, when known.
+type DeploymentOverlapError struct {
+	Channel string
+	Sites   map[uuid.UUID]uuid.UUID
+}
+
+func (e DeploymentOverlapError) Error() string {
+	if len(e.Sites) == 0 {
+		return fmt.Sprintf("sites are already in an active deployment "+
+			"on channel %q", e.Channel)
+	}
+
+	sites := make([]string, 0, len(e.Sites))
+	for site, dep := range e.Sites {
+		sites = append(sites, fmt.Sprintf("%s (in %s)", site, dep))
+	}
+	sort.Strings(sites)
+	return fmt.Sprintf("sites already in an active deployment on channel "+
+		"%q: %s", e.Channel, strings.Join(sites, ", "))
+}
+
+// CreateDeployment starts a deployment of a release to the given sites.  The
+// list of sites is recorded with the deployment, and is not affected by later
+// changes to the sites.  The deployment belongs to the release channel named
+// in the release's metadata, or DefaultReleaseChannel if there is none.  A
+// site can only await one deployment per channel; if any of the sites has yet
+// to report a result for another deployment on the channel,
+// DeploymentOverlapError is returned and nothing is created.
+func (db *ApplianceDB) CreateDeployment(ctx context.Context, relUU uuid.UUID,
+	name string, sites []uuid.UUID) (*ReleaseDeployment, error) {
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, ValidationError{"name", name, "must not be empty"}
+	}
+	if len(sites) == 0 {
+		return nil, ValidationError{"sites", "", "must not be empty"}
+	}
+	seen := make(map[uuid.UUID]bool)
+	targets := make([]uuid.UUID, 0, len(sites))
+	for _, site := range sites {
+		if !seen[site] {
+			seen[site] = true
+			targets = append(targets, site)
+		}
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var channel string
+	err = tx.GetContext(ctx, &channel, `
+		SELECT COALESCE(metadata->>'channel', $2)
+		FROM releases
+		WHERE release_uuid = $1`,
+		relUU, DefaultReleaseChannel)
+	if err == sql.ErrNoRows {
+		return nil, NotFoundError{fmt.Sprintf(
+			"CreateDeployment: Couldn't find release %v", relUU)}
+	} else if err != nil {
+		return nil, err
+	}
+
+	var busy []DeploymentTarget
+	err = tx.SelectContext(ctx, &busy, `
+		SELECT *
+		FROM release_deployment_target
+		WHERE channel = $1 AND status IS NULL AND site_uuid = ANY($2)`,
+		channel, pq.Array(targets))
+	if err != nil {
+		return nil, err
+	}
+	if len(busy) > 0 {
+		oe := DeploymentOverlapError{
+			Channel: channel,
+			Sites:   make(map[uuid.UUID]uuid.UUID),
+		}
+		for _, t := range busy {
+			oe.Sites[t.SiteUUID] = t.DeploymentUUID
+		}
+		return nil, oe
+	}
+
+	var dep ReleaseDeployment
+	err = tx.GetContext(ctx, &dep, `
+		INSERT INTO release_deployment
+		    (deployment_uuid, release_uuid, channel, name)
+		VALUES (uuid_generate_v4(), $1, $2, $3)
+		RETURNING *`,
+		relUU, channel, name)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO release_deployment_target
+		    (deployment_uuid, site_uuid, channel)
+		SELECT $1, unnest($2::uuid[]), $3`,
+		dep.UUID, pq.Array(targets), channel)
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code.Name() {
+		case "unique_violation":
+			// Another deployment claimed one of the sites after
+			// we checked.
+			return nil, DeploymentOverlapError{Channel: channel}
+		case "foreign_key_violation":
+			return nil, ForeignKeyError{
+				simpleMessage: "Unknown site in deployment targets",
+				Message:       pqErr.Message,
+				Detail:        pqErr.Detail,
+				Schema:        pqErr.Schema,
+				Table:         pqErr.Table,
+				Constraint:    pqErr.Constraint,
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &dep, nil
+}
+
+// RecordDeploymentResult records the result a site reported for a deployment,
+// as of the time ts.  Reports may arrive out of order; one which is older than
+// the result already recorded for the site is ignored.  NotFoundError is
+// returned if the site isn't targeted by the deployment.
+func (db *ApplianceDB) RecordDeploymentResult(ctx context.Context, depUU,
+	siteUU uuid.UUID, status, detail string, ts time.Time) error {
+
+	if !deploymentResults[status] {
+		return ValidationError{"status", status, "unknown result"}
+	}
+
+	res, err := db.ExecContext(ctx, `
+		UPDATE release_deployment_target
+		SET (status, detail, reported_at) = ($3, $4, $5)
+		WHERE deployment_uuid = $1 AND site_uuid = $2 AND
+		    (reported_at IS NULL OR reported_at <= $5)`,
+		depUU, siteUU, status, null.NewString(detail, detail != ""), ts)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+
+	// Either the report is stale, or the site isn't a target
+	var exists bool
+	err = db.GetContext(ctx, &exists, `
+		SELECT EXISTS (
+		    SELECT 1 FROM release_deployment_target
+		    WHERE deployment_uuid = $1 AND site_uuid = $2)`,
+		depUU, siteUU)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return NotFoundError{fmt.Sprintf(
+			"RecordDeploymentResult: site %v is not a target of "+
+				"deployment %v", siteUU, depUU)}
+	}
+	return nil
+}
+
+// DeploymentStatus summarizes the results reported for a deployment.  Sites
+// which haven't reported within the window following the deployment's
+// creation are listed as laggards.
+func (db *ApplianceDB) DeploymentStatus(ctx context.Context, depUU uuid.UUID,
+	window time.Duration) (*DeploymentSummary, error) {
+
+	var dep ReleaseDeployment
+	err := db.GetContext(ctx, &dep, `
+		SELECT *
+		FROM release_deployment
+		WHERE deployment_uuid = $1`,
+		depUU)
+	if err == sql.ErrNoRows {
+		return nil, NotFoundError{fmt.Sprintf(
+			"DeploymentStatus: Couldn't find deployment %v", depUU)}
+	} else if err != nil {
+		return nil, err
+	}
+
+	summary := &DeploymentSummary{
+		Deployment: dep,
+		Counts:     make(map[string]int),
+		Laggards:   make([]uuid.UUID, 0),
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT COALESCE(status::text, $2), count(*)
+		FROM release_deployment_target
+		WHERE deployment_uuid = $1
+		GROUP BY status`,
+		depUU, DeploymentPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status string
+		var n int
+		if err = rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		summary.Counts[status] = n
+		summary.Targets += n
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Go SQL drivers cannot automatically convert time.Duration to
+	// interval, so we do that manually via the string representation.
+	err = db.SelectContext(ctx, &summary.Laggards, `
+		SELECT t.site_uuid
+		FROM release_deployment_target t
+		    JOIN release_deployment d USING (deployment_uuid)
+		WHERE t.deployment_uuid = $1 AND t.status IS NULL AND
+		    d.created_at + $2::interval < now()
+		ORDER BY t.site_uuid`,
+		depUU, window.String())
+	if err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// SitesEligibleForRollout returns the sites meeting the rollout criteria,
+// ordered by name.  Only sites which aren't in maintenance are considered:
+// archived sites, sites still awaiting a deployment, sites with an appliance
+// awaiting RMA, and sites with no appliances in service are never eligible.
+// Retired appliances are ignored.  Releases are ordered by their creation
+// time; an appliance whose release is unknown doesn't meet a minimum release.
+func (db *ApplianceDB) SitesEligibleForRollout(ctx context.Context,
+	crit RolloutCriteria) ([]CustomerSite, error) {
+
+	var minTS null.Time
+	if crit.MinRelease != uuid.Nil {
+		err := db.GetContext(ctx, &minTS, `
+			SELECT create_ts
+			FROM releases
+			WHERE release_uuid = $1`,
+			crit.MinRelease)
+		if err == sql.ErrNoRows {
+			return nil, NotFoundError{fmt.Sprintf(
+				"SitesEligibleForRollout: Couldn't find release %v",
+				crit.MinRelease)}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	// Go SQL drivers cannot automatically convert time.Duration to
+	// interval, so we do that manually via the string representation.
+	var within null.String
+	if crit.HeartbeatWithin > 0 {
+		within = null.StringFrom(crit.HeartbeatWithin.String())
+	}
+
+	sites := make([]CustomerSite, 0)
+	err := db.SelectContext(ctx, &sites, `
+		WITH apps AS (
+		    SELECT appliance_uuid, site_uuid, lifecycle_state
+		    FROM appliance_id_map
+		    WHERE lifecycle_state <> $1
+		), cur AS (
+		    SELECT DISTINCT ON (h.appliance_uuid)
+		        h.appliance_uuid, h.release_uuid, r.create_ts
+		    FROM appliance_release_history h
+		        JOIN releases r USING (release_uuid)
+		    WHERE h.stage = 'complete'
+		    ORDER BY h.appliance_uuid, h.updated_ts DESC
+		), hb AS (
+		    SELECT appliance_uuid, max(record_ts) AS record_ts
+		    FROM heartbeat_ingest
+		    GROUP BY appliance_uuid
+		)
+		SELECT s.uuid, s.organization_uuid, s.name, s.version,
+		    s.updated_at, s.archived_at
+		FROM customer_site s
+		WHERE s.archived_at IS NULL AND s.uuid <> $2 AND
+		    EXISTS (
+		        SELECT 1 FROM apps
+		        WHERE apps.site_uuid = s.uuid) AND
+		    NOT EXISTS (
+		        SELECT 1 FROM apps
+		        WHERE apps.site_uuid = s.uuid AND
+		            apps.lifecycle_state = $3) AND
+		    NOT EXISTS (
+		        SELECT 1 FROM release_deployment_target t
+		        WHERE t.site_uuid = s.uuid AND t.status IS NULL) AND
+		    ($4::timestamptz IS NULL OR NOT EXISTS (
+		        SELECT 1 FROM apps
+		            LEFT JOIN cur USING (appliance_uuid)
+		        WHERE apps.site_uuid = s.uuid AND
+		            (cur.release_uuid IS NULL OR
+		             cur.release_uuid = $5 OR
+		             cur.create_ts < $4))) AND
+		    ($6::interval IS NULL OR NOT EXISTS (
+		        SELECT 1 FROM apps
+		            LEFT JOIN hb USING (appliance_uuid)
+		        WHERE apps.site_uuid = s.uuid AND
+		            (hb.record_ts IS NULL OR
+		             hb.record_ts < now() - $6::interval)))
+		ORDER BY s.name, s.uuid`,
+		LifecycleRetired, NullSiteUUID, LifecycleRMARequested, minTS,
+		uuid.Nil, within)
+	if err != nil {
+		return nil, err
+	}
+	return sites, nil
+}
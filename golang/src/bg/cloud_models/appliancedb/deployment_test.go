@@ -0,0 +1,362 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/satori/uuid"
+	"github.com/stretchr/testify/require"
+
+	"go.uber.org/zap"
+)
+
+func mkDeploymentRelease(t *testing.T, ds DataStore, metadata map[string]string) uuid.UUID {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	ra, err := ds.InsertArtifact(ctx, *buildPS(nil, 0, "x86"))
+	assert.NoError(err)
+	relUU, err := ds.InsertRelease(ctx, []*ReleaseArtifact{ra}, metadata)
+	assert.NoError(err)
+	return relUU
+}
+
+func mkDeploymentSites(t *testing.T, ds DataStore) []uuid.UUID {
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, nil)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, nil)
+	mkOrgSiteApp(t, ds, &testOrg4, &testSite4, nil)
+	return []uuid.UUID{testSite1.UUID, testSite2.UUID, testSite4.UUID}
+}
+
+func testDeploymentOverlap(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	sites := mkDeploymentSites(t, ds)
+	rel1 := mkDeploymentRelease(t, ds, map[string]string{"name": "rel1"})
+	rel2 := mkDeploymentRelease(t, ds, map[string]string{"name": "rel2"})
+	beta := mkDeploymentRelease(t, ds, map[string]string{
+		"name": "beta", "channel": "beta"})
+
+	dep1, err := ds.CreateDeployment(ctx, rel1, " wave 1 ", sites[:2])
+	assert.NoError(err)
+	assert.Equal("wave 1", dep1.Name)
+	assert.Equal(DefaultReleaseChannel, dep1.Channel)
+	assert.Equal(rel1, dep1.ReleaseUUID)
+
+	// Sites awaiting a deployment can't be targeted by another on the
+	// same channel, even for a different release.  Nothing is created.
+	_, err = ds.CreateDeployment(ctx, rel2, "wave 2", sites[1:])
+	assert.IsType(DeploymentOverlapError{}, err)
+	oe := err.(DeploymentOverlapError)
+	assert.Equal(DefaultReleaseChannel, oe.Channel)
+	assert.Equal(map[uuid.UUID]uuid.UUID{sites[1]: dep1.UUID}, oe.Sites)
+	var count int
+	err = ds.(*ApplianceDB).GetContext(ctx, &count,
+		`SELECT count(*) FROM release_deployment`)
+	assert.NoError(err)
+	assert.Equal(1, count)
+
+	// Other channels are independent
+	_, err = ds.CreateDeployment(ctx, beta, "beta wave", sites)
+	assert.NoError(err)
+
+	// Sites not in the first deployment are free; duplicates are folded
+	dep2, err := ds.CreateDeployment(ctx, rel2, "wave 2",
+		[]uuid.UUID{sites[2], sites[2]})
+	assert.NoError(err)
+	status, err := ds.DeploymentStatus(ctx, dep2.UUID, time.Hour)
+	assert.NoError(err)
+	assert.Equal(1, status.Targets)
+
+	// Once a site has reported, it is no longer in an active deployment
+	now := time.Now()
+	err = ds.RecordDeploymentResult(ctx, dep1.UUID, sites[1],
+		DeploymentFailed, "no space", now)
+	assert.NoError(err)
+	_, err = ds.CreateDeployment(ctx, rel2, "retry", sites[:2])
+	assert.IsType(DeploymentOverlapError{}, err)
+	assert.Equal(map[uuid.UUID]uuid.UUID{sites[0]: dep1.UUID},
+		err.(DeploymentOverlapError).Sites)
+	_, err = ds.CreateDeployment(ctx, rel2, "retry", sites[1:2])
+	assert.NoError(err)
+
+	// Bad input
+	_, err = ds.CreateDeployment(ctx, rel1, "  ", sites)
+	assert.IsType(ValidationError{}, err)
+	_, err = ds.CreateDeployment(ctx, rel1, "empty", nil)
+	assert.IsType(ValidationError{}, err)
+	_, err = ds.CreateDeployment(ctx, uuid.NewV4(), "no release", sites)
+	assert.IsType(NotFoundError{}, err)
+	_, err = ds.CreateDeployment(ctx, beta, "no site",
+		[]uuid.UUID{uuid.NewV4()})
+	assert.IsType(ForeignKeyError{}, err)
+}
+
+func testDeploymentLaggards(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	sites := mkDeploymentSites(t, ds)
+	rel := mkDeploymentRelease(t, ds, map[string]string{"name": "rel"})
+	dep, err := ds.CreateDeployment(ctx, rel, "wave", sites)
+	assert.NoError(err)
+
+	err = ds.RecordDeploymentResult(ctx, dep.UUID, sites[0],
+		DeploymentSuccess, "", time.Now())
+	assert.NoError(err)
+
+	// Freshly created, so nobody is late yet
+	status, err := ds.DeploymentStatus(ctx, dep.UUID, time.Hour)
+	assert.NoError(err)
+	assert.Empty(status.Laggards)
+
+	// Pretend the deployment started two hours ago
+	_, err = ds.(*ApplianceDB).ExecContext(ctx, `
+		UPDATE release_deployment
+		SET created_at = now() - '2 hours'::interval
+		WHERE deployment_uuid = $1`, dep.UUID)
+	assert.NoError(err)
+
+	status, err = ds.DeploymentStatus(ctx, dep.UUID, 3*time.Hour)
+	assert.NoError(err)
+	assert.Empty(status.Laggards)
+
+	// Only the sites which haven't reported are laggards
+	status, err = ds.DeploymentStatus(ctx, dep.UUID, time.Hour)
+	assert.NoError(err)
+	assert.ElementsMatch(sites[1:], status.Laggards)
+
+	// A late report takes a site off the list
+	err = ds.RecordDeploymentResult(ctx, dep.UUID, sites[2],
+		DeploymentRolledBack, "", time.Now())
+	assert.NoError(err)
+	status, err = ds.DeploymentStatus(ctx, dep.UUID, time.Hour)
+	assert.NoError(err)
+	assert.Equal([]uuid.UUID{sites[1]}, status.Laggards)
+
+	_, err = ds.DeploymentStatus(ctx, uuid.NewV4(), time.Hour)
+	assert.IsType(NotFoundError{}, err)
+}
+
+func testDeploymentStatus(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	sites := mkDeploymentSites(t, ds)
+	rel := mkDeploymentRelease(t, ds, map[string]string{"name": "rel"})
+	dep, err := ds.CreateDeployment(ctx, rel, "wave", sites)
+	assert.NoError(err)
+
+	status, err := ds.DeploymentStatus(ctx, dep.UUID, time.Hour)
+	assert.NoError(err)
+	assert.Equal(dep.UUID, status.Deployment.UUID)
+	assert.Equal("wave", status.Deployment.Name)
+	assert.Equal(3, status.Targets)
+	assert.Equal(map[string]int{DeploymentPending: 3}, status.Counts)
+
+	// Results trickle in out of order: the newest report for each site
+	// wins, regardless of the order in which they arrive.
+	t0 := time.Now().Add(-time.Hour)
+	t1 := t0.Add(10 * time.Minute)
+	t2 := t0.Add(20 * time.Minute)
+	reports := []struct {
+		site   uuid.UUID
+		status string
+		detail string
+		ts     time.Time
+	}{
+		{sites[0], DeploymentSuccess, "", t2},
+		{sites[1], DeploymentRolledBack, "watchdog", t2},
+		{sites[0], DeploymentFailed, "download failed", t1},
+		{sites[1], DeploymentFailed, "download failed", t0},
+	}
+	for _, r := range reports {
+		err = ds.RecordDeploymentResult(ctx, dep.UUID, r.site, r.status,
+			r.detail, r.ts)
+		assert.NoError(err)
+	}
+
+	status, err = ds.DeploymentStatus(ctx, dep.UUID, time.Hour)
+	assert.NoError(err)
+	assert.Equal(3, status.Targets)
+	assert.Equal(map[string]int{
+		DeploymentSuccess:    1,
+		DeploymentRolledBack: 1,
+		DeploymentPending:    1,
+	}, status.Counts)
+
+	var target DeploymentTarget
+	err = ds.(*ApplianceDB).GetContext(ctx, &target, `
+		SELECT * FROM release_deployment_target
+		WHERE deployment_uuid = $1 AND site_uuid = $2`,
+		dep.UUID, sites[1])
+	assert.NoError(err)
+	assert.Equal(null.StringFrom(DeploymentRolledBack), target.Status)
+	assert.Equal(null.StringFrom("watchdog"), target.Detail)
+	assert.Equal(t2.Unix(), target.ReportedAt.Time.Unix())
+
+	// A newer report replaces an older one
+	err = ds.RecordDeploymentResult(ctx, dep.UUID, sites[1],
+		DeploymentSuccess, "", t2.Add(time.Minute))
+	assert.NoError(err)
+	err = ds.RecordDeploymentResult(ctx, dep.UUID, sites[2],
+		DeploymentFailed, "", t0)
+	assert.NoError(err)
+	status, err = ds.DeploymentStatus(ctx, dep.UUID, time.Hour)
+	assert.NoError(err)
+	assert.Equal(map[string]int{
+		DeploymentSuccess: 2,
+		DeploymentFailed:  1,
+	}, status.Counts)
+
+	// Reports for sites outside the deployment, and bogus results, are
+	// rejected.
+	err = ds.RecordDeploymentResult(ctx, dep.UUID, uuid.NewV4(),
+		DeploymentSuccess, "", time.Now())
+	assert.IsType(NotFoundError{}, err)
+	err = ds.RecordDeploymentResult(ctx, dep.UUID, sites[0],
+		"exploded", "", time.Now())
+	assert.IsType(ValidationError{}, err)
+}
+
+func testSitesEligibleForRollout(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	oldRel := mkDeploymentRelease(t, ds, map[string]string{"name": "old"})
+	newRel := mkDeploymentRelease(t, ds, map[string]string{"name": "new"})
+	mkOrgSiteApp(t, ds, &testOrg1, nil, nil)
+
+	now := time.Now()
+	stale := now.Add(-2 * time.Hour)
+
+	mkSite := func(name string) uuid.UUID {
+		site := CustomerSite{
+			UUID:             uuid.NewV4(),
+			OrganizationUUID: testOrg1.UUID,
+			Name:             name,
+		}
+		mkOrgSiteApp(t, ds, nil, &site, nil)
+		return site.UUID
+	}
+	// Add an appliance running the given release, which last sent a
+	// heartbeat at the given time.
+	mkApp := func(siteUU uuid.UUID, rel uuid.UUID, hbTS time.Time) uuid.UUID {
+		appUU := uuid.NewV4()
+		app := ApplianceID{
+			ApplianceUUID:  appUU,
+			SiteUUID:       siteUU,
+			GCPProject:     testProject,
+			GCPRegion:      testRegion,
+			ApplianceReg:   testReg,
+			ApplianceRegID: testRegID + "-" + appUU.String(),
+		}
+		mkOrgSiteApp(t, ds, nil, nil, &app)
+		err := ds.SetCurrentRelease(ctx, app.ApplianceUUID, rel, hbTS, nil)
+		assert.NoError(err)
+		err = ds.InsertHeartbeatIngest(ctx, &HeartbeatIngest{
+			ApplianceUUID: app.ApplianceUUID,
+			SiteUUID:      siteUU,
+			BootTS:        hbTS,
+			RecordTS:      hbTS,
+		})
+		assert.NoError(err)
+		return app.ApplianceUUID
+	}
+
+	good := mkSite("good")
+	mkApp(good, newRel, now)
+	mkApp(mkSite("old"), oldRel, now)
+	mkApp(mkSite("unknown"), uuid.Nil, now)
+	mkApp(mkSite("quiet"), newRel, stale)
+	// One of this site's appliances is behind, but it has been retired
+	retired := mkSite("retired")
+	mkApp(retired, newRel, now)
+	retiredApp := mkApp(retired, oldRel, stale)
+	err := ds.SetApplianceLifecycle(ctx, retiredApp, LifecycleRetired)
+	assert.NoError(err)
+
+	// Sites in maintenance are never eligible
+	mkSite("empty")
+	goneApp := mkApp(mkSite("gone"), newRel, now)
+	err = ds.SetApplianceLifecycle(ctx, goneApp, LifecycleRetired)
+	assert.NoError(err)
+	rmaApp := mkApp(mkSite("rma"), newRel, now)
+	err = ds.SetApplianceLifecycle(ctx, rmaApp, LifecycleRMARequested)
+	assert.NoError(err)
+	archived := mkSite("archived")
+	mkApp(archived, newRel, now)
+	err = ds.ArchiveCustomerSite(ctx, archived)
+	assert.NoError(err)
+	busy := mkSite("busy")
+	mkApp(busy, newRel, now)
+	dep, err := ds.CreateDeployment(ctx, newRel, "wave", []uuid.UUID{busy})
+	assert.NoError(err)
+
+	names := func(sites []CustomerSite) []string {
+		n := make([]string, len(sites))
+		for i, s := range sites {
+			n[i] = s.Name
+		}
+		return n
+	}
+
+	sites, err := ds.SitesEligibleForRollout(ctx, RolloutCriteria{})
+	assert.NoError(err)
+	assert.Equal([]string{"good", "old", "quiet", "retired", "unknown"},
+		names(sites))
+	assert.Equal(good, sites[0].UUID)
+	assert.Equal(testOrg1.UUID, sites[0].OrganizationUUID)
+
+	// An unknown release never satisfies a minimum release
+	sites, err = ds.SitesEligibleForRollout(ctx, RolloutCriteria{
+		MinRelease: oldRel,
+	})
+	assert.NoError(err)
+	assert.Equal([]string{"good", "old", "quiet", "retired"}, names(sites))
+
+	sites, err = ds.SitesEligibleForRollout(ctx, RolloutCriteria{
+		MinRelease: newRel,
+	})
+	assert.NoError(err)
+	assert.Equal([]string{"good", "quiet", "retired"}, names(sites))
+
+	sites, err = ds.SitesEligibleForRollout(ctx, RolloutCriteria{
+		HeartbeatWithin: time.Hour,
+	})
+	assert.NoError(err)
+	assert.Equal([]string{"good", "old", "retired", "unknown"}, names(sites))
+
+	crit := RolloutCriteria{
+		MinRelease:      newRel,
+		HeartbeatWithin: time.Hour,
+	}
+	sites, err = ds.SitesEligibleForRollout(ctx, crit)
+	assert.NoError(err)
+	assert.Equal([]string{"good", "retired"}, names(sites))
+
+	// Once the site reports on its deployment, it is eligible again
+	err = ds.RecordDeploymentResult(ctx, dep.UUID, busy, DeploymentSuccess,
+		"", now)
+	assert.NoError(err)
+	sites, err = ds.SitesEligibleForRollout(ctx, crit)
+	assert.NoError(err)
+	assert.Equal([]string{"busy", "good", "retired"}, names(sites))
+
+	_, err = ds.SitesEligibleForRollout(ctx, RolloutCriteria{
+		MinRelease: uuid.NewV4(),
+	})
+	assert.IsType(NotFoundError{}, err)
+}
@@ -0,0 +1,396 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/lib/pq"
+	"github.com/satori/uuid"
+)
+
+// Support tiers an organization may be entitled to
+const (
+	SupportTierNone     = "none"
+	SupportTierBasic    = "basic"
+	SupportTierStandard = "standard"
+	SupportTierPremium  = "premium"
+)
+
+var supportTiers = map[string]bool{
+	SupportTierNone:     true,
+	SupportTierBasic:    true,
+	SupportTierStandard: true,
+	SupportTierPremium:  true,
+}
+
+// Summary states of an organization's compliance with its contract, in
+// decreasing order of urgency
+const (
+	EntitlementUncontracted = "uncontracted"
+	EntitlementExpired      = "expired"
+	EntitlementOverContract = "over-contract"
+	EntitlementOK           = "ok"
+)
+
+type entitlementManager interface {
+	OrgEntitlementsByOrganization(context.Context, uuid.UUID) (*OrgEntitlements, error)
+	UpsertOrgEntitlements(context.Context, *OrgEntitlements) error
+	EntitlementCompliance(context.Context, uuid.UUID) (*EntitlementCompliance, error)
+	AllEntitlementCompliance(context.Context) ([]EntitlementCompliance, error)
+}
+
+// OrgEntitlements represents a row in the org_entitlements table: the terms of
+// an organization's contract.  The contract dates are whole (UTC) days.
+type OrgEntitlements struct {
+	OrganizationUUID     uuid.UUID `json:"organizationUUID" db:"organization_uuid"`
+	SupportTier          string    `json:"supportTier" db:"support_tier"`
+	ContractedAppliances int       `json:"contractedAppliances" db:"contracted_appliances"`
+	ContractedAccounts   int       `json:"contractedAccounts" db:"contracted_accounts"`
+	ContractStart        time.Time `json:"contractStart" db:"contract_start"`
+	ContractEnd          time.Time `json:"contractEnd" db:"contract_end"`
+	Notes                string    `json:"notes" db:"notes"`
+	UpdatedAt            time.Time `json:"updatedAt" db:"updated_at"`
+}
+
+// Truncate a time to the start of its UTC day
+func utcDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// Validate checks the entitlements for consistency, returning a
+// ValidationError describing the first problem found.
+func (e *OrgEntitlements) Validate() error {
+	if !supportTiers[e.SupportTier] {
+		return ValidationError{"support_tier", e.SupportTier,
+			"unknown support tier"}
+	}
+	if e.ContractedAppliances < 0 {
+		return ValidationError{"contracted_appliances",
+			fmt.Sprintf("%d", e.ContractedAppliances),
+			"must not be negative"}
+	}
+	if e.ContractedAccounts < 0 {
+		return ValidationError{"contracted_accounts",
+			fmt.Sprintf("%d", e.ContractedAccounts),
+			"must not be negative"}
+	}
+	if !utcDay(e.ContractEnd).After(utcDay(e.ContractStart)) {
+		return ValidationError{"contract_end",
+			e.ContractEnd.Format("2006-01-02"),
+			"must be after contract start"}
+	}
+	return nil
+}
+
+// EntitlementCompliance compares what an organization is using with what it
+// is entitled to.  Entitlements is nil for an organization without a contract.
+type EntitlementCompliance struct {
+	OrganizationUUID uuid.UUID        `json:"organizationUUID"`
+	OrganizationName string           `json:"organizationName"`
+	Entitlements     *OrgEntitlements `json:"entitlements"`
+	Appliances       int              `json:"appliances"`
+	Accounts         int              `json:"accounts"`
+
+	// Whole days from today until the contract end; negative once the
+	// contract has expired.  Zero for an uncontracted organization.
+	DaysUntilRenewal int `json:"daysUntilRenewal"`
+}
+
+// NewEntitlementCompliance computes an organization's compliance as of the
+// given time, from its entitlements (nil if it has none) and its current
+// appliance and account counts.
+func NewEntitlementCompliance(org Organization, ent *OrgEntitlements,
+	appliances, accounts int, now time.Time) EntitlementCompliance {
+
+	c := EntitlementCompliance{
+		OrganizationUUID: org.UUID,
+		OrganizationName: org.Name,
+		Entitlements:     ent,
+		Appliances:       appliances,
+		Accounts:         accounts,
+	}
+	if ent != nil {
+		days := utcDay(ent.ContractEnd).Sub(utcDay(now)) / (24 * time.Hour)
+		c.DaysUntilRenewal = int(days)
+	}
+	return c
+}
+
+// Uncontracted returns true if the organization has no entitlements on record
+func (c *EntitlementCompliance) Uncontracted() bool {
+	return c.Entitlements == nil
+}
+
+// Expired returns true if the organization's contract has ended
+func (c *EntitlementCompliance) Expired() bool {
+	return c.Entitlements != nil && c.DaysUntilRenewal < 0
+}
+
+// ExcessAppliances returns the number of appliances beyond those contracted
+// for, or zero if the organization is within its contract.
+func (c *EntitlementCompliance) ExcessAppliances() int {
+	if c.Entitlements == nil ||
+		c.Appliances <= c.Entitlements.ContractedAppliances {
+		return 0
+	}
+	return c.Appliances - c.Entitlements.ContractedAppliances
+}
+
+// ExcessAccounts returns the number of accounts beyond those contracted for,
+// or zero if the organization is within its contract.
+func (c *EntitlementCompliance) ExcessAccounts() int {
+	if c.Entitlements == nil ||
+		c.Accounts <= c.Entitlements.ContractedAccounts {
+		return 0
+	}
+	return c.Accounts - c.Entitlements.ContractedAccounts
+}
+
+// OverContract returns true if the organization is using more appliances or
+// accounts than its contract covers.  An uncontracted organization is not
+// considered to be over contract.
+func (c *EntitlementCompliance) OverContract() bool {
+	return c.ExcessAppliances() > 0 || c.ExcessAccounts() > 0
+}
+
+// ExpiringWithin returns true if the organization's contract is up for renewal
+// within the given number of days, or has already expired.
+func (c *EntitlementCompliance) ExpiringWithin(days int) bool {
+	return c.Entitlements != nil && c.DaysUntilRenewal <= days
+}
+
+// Status summarizes the organization's compliance as one of the Entitlement*
+// states.
+func (c *EntitlementCompliance) Status() string {
+	switch {
+	case c.Uncontracted():
+		return EntitlementUncontracted
+	case c.Expired():
+		return EntitlementExpired
+	case c.OverContract():
+		return EntitlementOverContract
+	default:
+		return EntitlementOK
+	}
+}
+
+// EntitlementFilter selects the organizations of interest from a fleet-wide
+// compliance report.  An organization is selected if it matches any of the
+// enabled criteria; with no criteria enabled, every organization is selected.
+// Uncontracted organizations are always selected, since they have no contract
+// against which to check the criteria.
+type EntitlementFilter struct {
+	ExpiringWithin *int // days
+	OverContract   bool
+}
+
+// Match returns true if the organization is selected by the filter
+func (f EntitlementFilter) Match(c *EntitlementCompliance) bool {
+	if c.Uncontracted() {
+		return true
+	}
+	if f.ExpiringWithin == nil && !f.OverContract {
+		return true
+	}
+	if f.ExpiringWithin != nil && c.ExpiringWithin(*f.ExpiringWithin) {
+		return true
+	}
+	return f.OverContract && c.OverContract()
+}
+
+// Apply returns the organizations selected by the filter, in their original
+// order.
+func (f EntitlementFilter) Apply(all []EntitlementCompliance) []EntitlementCompliance {
+	selected := make([]EntitlementCompliance, 0)
+	for i := range all {
+		if f.Match(&all[i]) {
+			selected = append(selected, all[i])
+		}
+	}
+	return selected
+}
+
+// OrgEntitlementsByOrganization returns the entitlements of an organization.
+// NotFoundError is returned if it has none.
+func (db *ApplianceDB) OrgEntitlementsByOrganization(ctx context.Context,
+	org uuid.UUID) (*OrgEntitlements, error) {
+
+	var ent OrgEntitlements
+	err := db.GetContext(ctx, &ent, `
+		SELECT * FROM org_entitlements
+		WHERE organization_uuid = $1`, org)
+	switch err {
+	case sql.ErrNoRows:
+		return nil, NotFoundError{fmt.Sprintf(
+			"OrgEntitlementsByOrganization: Couldn't find record for %s",
+			org)}
+	case nil:
+		return &ent, nil
+	default:
+		return nil, err
+	}
+}
+
+// UpsertOrgEntitlements creates or replaces the entitlements of an
+// organization.  The contract dates are truncated to whole UTC days, and the
+// UpdatedAt field is filled in.  ValidationError is returned if the
+// entitlements are inconsistent; ForeignKeyError is returned if the
+// organization doesn't exist.
+func (db *ApplianceDB) UpsertOrgEntitlements(ctx context.Context,
+	ent *OrgEntitlements) error {
+
+	if err := ent.Validate(); err != nil {
+		return err
+	}
+	ent.ContractStart = utcDay(ent.ContractStart)
+	ent.ContractEnd = utcDay(ent.ContractEnd)
+
+	row := db.QueryRowContext(ctx, `
+		INSERT INTO org_entitlements
+		    (organization_uuid, support_tier, contracted_appliances,
+		     contracted_accounts, contract_start, contract_end, notes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (organization_uuid) DO UPDATE SET
+		    support_tier = EXCLUDED.support_tier,
+		    contracted_appliances = EXCLUDED.contracted_appliances,
+		    contracted_accounts = EXCLUDED.contracted_accounts,
+		    contract_start = EXCLUDED.contract_start,
+		    contract_end = EXCLUDED.contract_end,
+		    notes = EXCLUDED.notes,
+		    updated_at = now()
+		RETURNING updated_at`,
+		ent.OrganizationUUID, ent.SupportTier, ent.ContractedAppliances,
+		ent.ContractedAccounts, ent.ContractStart, ent.ContractEnd,
+		ent.Notes)
+	err := row.Scan(&ent.UpdatedAt)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "foreign_key_violation" {
+		return ForeignKeyError{
+			simpleMessage: fmt.Sprintf("Unknown organization %s",
+				ent.OrganizationUUID),
+			Message:    pqErr.Message,
+			Detail:     pqErr.Detail,
+			Schema:     pqErr.Schema,
+			Table:      pqErr.Table,
+			Constraint: pqErr.Constraint,
+		}
+	}
+	return err
+}
+
+// One row of complianceQuery.  The entitlement columns are all NULL for an
+// organization without a contract.
+type complianceRow struct {
+	UUID       uuid.UUID `db:"uuid"`
+	Name       string    `db:"name"`
+	Appliances int       `db:"appliances"`
+	Accounts   int       `db:"accounts"`
+
+	SupportTier          null.String `db:"support_tier"`
+	ContractedAppliances null.Int    `db:"contracted_appliances"`
+	ContractedAccounts   null.Int    `db:"contracted_accounts"`
+	ContractStart        null.Time   `db:"contract_start"`
+	ContractEnd          null.Time   `db:"contract_end"`
+	Notes                null.String `db:"notes"`
+	UpdatedAt            null.Time   `db:"updated_at"`
+}
+
+// Gather each organization's appliance and account counts alongside its
+// entitlements.  $1 optionally restricts the results to a single organization;
+// $2 is the null organization, which is never party to a contract.
+const complianceQuery = `
+	SELECT
+	    o.uuid,
+	    o.name,
+	    (SELECT count(*)
+	        FROM appliance_id_map a
+	        JOIN customer_site s ON a.site_uuid = s.uuid
+	        WHERE s.organization_uuid = o.uuid) AS appliances,
+	    (SELECT count(*)
+	        FROM account
+	        WHERE account.organization_uuid = o.uuid) AS accounts,
+	    e.support_tier,
+	    e.contracted_appliances,
+	    e.contracted_accounts,
+	    e.contract_start,
+	    e.contract_end,
+	    e.notes,
+	    e.updated_at
+	FROM organization o
+	LEFT JOIN org_entitlements e ON e.organization_uuid = o.uuid
+	WHERE ($1::uuid IS NULL OR o.uuid = $1) AND o.uuid <> $2
+	ORDER BY o.name, o.uuid`
+
+func (r *complianceRow) compliance(now time.Time) EntitlementCompliance {
+	var ent *OrgEntitlements
+
+	if r.SupportTier.Valid {
+		ent = &OrgEntitlements{
+			OrganizationUUID:     r.UUID,
+			SupportTier:          r.SupportTier.String,
+			ContractedAppliances: int(r.ContractedAppliances.Int64),
+			ContractedAccounts:   int(r.ContractedAccounts.Int64),
+			ContractStart:        r.ContractStart.Time,
+			ContractEnd:          r.ContractEnd.Time,
+			Notes:                r.Notes.String,
+			UpdatedAt:            r.UpdatedAt.Time,
+		}
+	}
+	org := Organization{UUID: r.UUID, Name: r.Name}
+	return NewEntitlementCompliance(org, ent, r.Appliances, r.Accounts, now)
+}
+
+func (db *ApplianceDB) entitlementCompliance(ctx context.Context,
+	org uuid.NullUUID) ([]EntitlementCompliance, error) {
+
+	var rows []complianceRow
+	err := db.SelectContext(ctx, &rows, complianceQuery, org,
+		NullOrganizationUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	result := make([]EntitlementCompliance, len(rows))
+	for i := range rows {
+		result[i] = rows[i].compliance(now)
+	}
+	return result, nil
+}
+
+// EntitlementCompliance compares an organization's current appliance and
+// account counts with its entitlements.  An organization without entitlements
+// is reported as uncontracted, rather than as an error; NotFoundError is only
+// returned if the organization doesn't exist.
+func (db *ApplianceDB) EntitlementCompliance(ctx context.Context,
+	org uuid.UUID) (*EntitlementCompliance, error) {
+
+	result, err := db.entitlementCompliance(ctx,
+		uuid.NullUUID{UUID: org, Valid: true})
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, NotFoundError{fmt.Sprintf(
+			"EntitlementCompliance: Couldn't find organization %s", org)}
+	}
+	return &result[0], nil
+}
+
+// AllEntitlementCompliance returns the compliance of every organization other
+// than the null organization, ordered by name.
+func (db *ApplianceDB) AllEntitlementCompliance(ctx context.Context) ([]EntitlementCompliance, error) {
+	return db.entitlementCompliance(ctx, uuid.NullUUID{})
+}
@@ -0,0 +1,255 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/satori/uuid"
+	"github.com/stretchr/testify/require"
+
+	"go.uber.org/zap"
+)
+
+func day(s string) time.Time {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func mkEntitlements(org uuid.UUID, appliances, accounts int, end string) *OrgEntitlements {
+	return &OrgEntitlements{
+		OrganizationUUID:     org,
+		SupportTier:          SupportTierStandard,
+		ContractedAppliances: appliances,
+		ContractedAccounts:   accounts,
+		ContractStart:        day("2020-01-01"),
+		ContractEnd:          day(end),
+	}
+}
+
+func TestEntitlementValidate(t *testing.T) {
+	assert := require.New(t)
+
+	good := mkEntitlements(testOrg1.UUID, 0, 0, "2021-01-01")
+	assert.NoError(good.Validate())
+
+	testCases := []struct {
+		field  string
+		modify func(*OrgEntitlements)
+	}{
+		{"support_tier", func(e *OrgEntitlements) { e.SupportTier = "gold" }},
+		{"support_tier", func(e *OrgEntitlements) { e.SupportTier = "" }},
+		{"contracted_appliances", func(e *OrgEntitlements) { e.ContractedAppliances = -1 }},
+		{"contracted_accounts", func(e *OrgEntitlements) { e.ContractedAccounts = -1 }},
+		{"contract_end", func(e *OrgEntitlements) { e.ContractEnd = e.ContractStart }},
+		{"contract_end", func(e *OrgEntitlements) {
+			e.ContractEnd = e.ContractStart.AddDate(0, 0, -1)
+		}},
+		// Contract dates are whole days
+		{"contract_end", func(e *OrgEntitlements) {
+			e.ContractEnd = e.ContractStart.Add(12 * time.Hour)
+		}},
+	}
+	for _, tc := range testCases {
+		e := *good
+		tc.modify(&e)
+		err := e.Validate()
+		assert.IsType(ValidationError{}, err, "%+v", e)
+		assert.Equal(tc.field, err.(ValidationError).Field)
+	}
+}
+
+func TestEntitlementCompliance(t *testing.T) {
+	assert := require.New(t)
+
+	now := day("2020-06-01").Add(15 * time.Hour)
+	ent := mkEntitlements(testOrg1.UUID, 2, 5, "2020-07-01")
+
+	c := NewEntitlementCompliance(testOrg1, ent, 2, 5, now)
+	assert.Equal(30, c.DaysUntilRenewal)
+	assert.False(c.OverContract())
+	assert.False(c.Expired())
+	assert.Equal(EntitlementOK, c.Status())
+
+	c = NewEntitlementCompliance(testOrg1, ent, 3, 5, now)
+	assert.True(c.OverContract())
+	assert.Equal(1, c.ExcessAppliances())
+	assert.Equal(0, c.ExcessAccounts())
+	assert.Equal(EntitlementOverContract, c.Status())
+
+	c = NewEntitlementCompliance(testOrg1, ent, 0, 9, now)
+	assert.True(c.OverContract())
+	assert.Equal(0, c.ExcessAppliances())
+	assert.Equal(4, c.ExcessAccounts())
+
+	// Expiry trumps being over contract
+	c = NewEntitlementCompliance(testOrg1, ent, 3, 5, day("2020-07-02"))
+	assert.Equal(-1, c.DaysUntilRenewal)
+	assert.True(c.Expired())
+	assert.Equal(EntitlementExpired, c.Status())
+
+	// The renewal day itself isn't expired
+	c = NewEntitlementCompliance(testOrg1, ent, 0, 0,
+		day("2020-07-01").Add(23*time.Hour))
+	assert.Equal(0, c.DaysUntilRenewal)
+	assert.False(c.Expired())
+
+	// No contract is not an error, and is never over contract
+	c = NewEntitlementCompliance(testOrg2, nil, 10, 10, now)
+	assert.True(c.Uncontracted())
+	assert.False(c.OverContract())
+	assert.False(c.Expired())
+	assert.False(c.ExpiringWithin(60))
+	assert.Equal(EntitlementUncontracted, c.Status())
+}
+
+func TestEntitlementFilter(t *testing.T) {
+	assert := require.New(t)
+
+	now := day("2020-06-01")
+	org := func(name string) Organization {
+		return Organization{UUID: uuid.NewV4(), Name: name}
+	}
+	all := []EntitlementCompliance{
+		NewEntitlementCompliance(org("expired"),
+			mkEntitlements(uuid.Nil, 5, 5, "2020-05-01"), 1, 1, now),
+		NewEntitlementCompliance(org("soon"),
+			mkEntitlements(uuid.Nil, 5, 5, "2020-07-01"), 1, 1, now),
+		NewEntitlementCompliance(org("edge"),
+			mkEntitlements(uuid.Nil, 5, 5, "2020-07-31"), 1, 1, now),
+		NewEntitlementCompliance(org("later-over"),
+			mkEntitlements(uuid.Nil, 1, 1, "2021-06-01"), 2, 1, now),
+		NewEntitlementCompliance(org("later-ok"),
+			mkEntitlements(uuid.Nil, 5, 5, "2021-06-01"), 1, 1, now),
+		NewEntitlementCompliance(org("none"), nil, 3, 3, now),
+	}
+	names := func(report []EntitlementCompliance) []string {
+		n := make([]string, 0)
+		for _, c := range report {
+			n = append(n, c.OrganizationName)
+		}
+		return n
+	}
+	days := func(d int) *int { return &d }
+
+	assert.Equal([]string{"expired", "soon", "edge", "later-over",
+		"later-ok", "none"}, names(EntitlementFilter{}.Apply(all)))
+
+	f := EntitlementFilter{ExpiringWithin: days(60)}
+	assert.Equal([]string{"expired", "soon", "edge", "none"},
+		names(f.Apply(all)))
+
+	f = EntitlementFilter{ExpiringWithin: days(30)}
+	assert.Equal([]string{"expired", "soon", "none"}, names(f.Apply(all)))
+
+	f = EntitlementFilter{OverContract: true}
+	assert.Equal([]string{"later-over", "none"}, names(f.Apply(all)))
+
+	f = EntitlementFilter{ExpiringWithin: days(30), OverContract: true}
+	assert.Equal([]string{"expired", "soon", "later-over", "none"},
+		names(f.Apply(all)))
+}
+
+// Test storing entitlements and checking compliance against them.  subtest of
+// TestDatabaseModel
+func testOrgEntitlements(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, &testID2)
+	_ = mkAccount(t, ds, &testPerson1, &testAccount1, nil)
+	_ = mkAccount(t, ds, &testPerson2, &testAccount2, nil)
+
+	_, err := ds.OrgEntitlementsByOrganization(ctx, testOrg1.UUID)
+	assert.IsType(NotFoundError{}, err)
+
+	// Orgs without a contract are reported, not rejected
+	c, err := ds.EntitlementCompliance(ctx, testOrg1.UUID)
+	assert.NoError(err)
+	assert.True(c.Uncontracted())
+	assert.Equal(1, c.Appliances)
+	assert.Equal(2, c.Accounts)
+
+	_, err = ds.EntitlementCompliance(ctx, badUUID)
+	assert.IsType(NotFoundError{}, err)
+
+	bad := mkEntitlements(testOrg1.UUID, -1, 1, "2021-01-01")
+	assert.IsType(ValidationError{}, ds.UpsertOrgEntitlements(ctx, bad))
+	bad = mkEntitlements(testOrg1.UUID, 1, 1, "2019-01-01")
+	assert.IsType(ValidationError{}, ds.UpsertOrgEntitlements(ctx, bad))
+	bad = mkEntitlements(badUUID, 1, 1, "2021-01-01")
+	assert.IsType(ForeignKeyError{}, ds.UpsertOrgEntitlements(ctx, bad))
+
+	// One appliance and two accounts against a contract for one of each
+	end := utcDay(time.Now()).AddDate(0, 0, 45)
+	ent := mkEntitlements(testOrg1.UUID, 1, 1, "2021-01-01")
+	ent.ContractEnd = end.Add(6 * time.Hour)
+	ent.Notes = "renewal call scheduled"
+	assert.NoError(ds.UpsertOrgEntitlements(ctx, ent))
+	assert.False(ent.UpdatedAt.IsZero())
+	assert.Equal(end, ent.ContractEnd)
+
+	got, err := ds.OrgEntitlementsByOrganization(ctx, testOrg1.UUID)
+	assert.NoError(err)
+	assert.Equal(ent, got)
+
+	c, err = ds.EntitlementCompliance(ctx, testOrg1.UUID)
+	assert.NoError(err)
+	assert.Equal(ent, c.Entitlements)
+	assert.Equal(45, c.DaysUntilRenewal)
+	assert.True(c.OverContract())
+	assert.Equal(0, c.ExcessAppliances())
+	assert.Equal(1, c.ExcessAccounts())
+
+	// Upserting replaces the existing terms
+	ent.SupportTier = SupportTierPremium
+	ent.ContractedAccounts = 2
+	assert.NoError(ds.UpsertOrgEntitlements(ctx, ent))
+	c, err = ds.EntitlementCompliance(ctx, testOrg1.UUID)
+	assert.NoError(err)
+	assert.Equal(SupportTierPremium, c.Entitlements.SupportTier)
+	assert.False(c.OverContract())
+	assert.Equal(EntitlementOK, c.Status())
+
+	// The fleet-wide report includes the uncontracted org2
+	all, err := ds.AllEntitlementCompliance(ctx)
+	assert.NoError(err)
+	byOrg := make(map[uuid.UUID]EntitlementCompliance)
+	for _, c := range all {
+		byOrg[c.OrganizationUUID] = c
+	}
+	assert.Contains(byOrg, testOrg1.UUID)
+	assert.Contains(byOrg, testOrg2.UUID)
+	c2 := byOrg[testOrg2.UUID]
+	assert.Equal(EntitlementUncontracted, c2.Status())
+	assert.Equal(1, c2.Appliances)
+	assert.Equal(0, c2.Accounts)
+
+	days := 60
+	expiring := EntitlementFilter{ExpiringWithin: &days}.Apply(all)
+	found := make(map[uuid.UUID]bool)
+	for _, c := range expiring {
+		found[c.OrganizationUUID] = true
+	}
+	assert.True(found[testOrg1.UUID])
+	assert.True(found[testOrg2.UUID])
+
+	days = 30
+	expiring = EntitlementFilter{ExpiringWithin: &days}.Apply(all)
+	for _, c := range expiring {
+		assert.NotEqual(testOrg1.UUID, c.OrganizationUUID)
+	}
+}
@@ -11,12 +11,15 @@ package appliancedb
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
 	"fmt"
 	"time"
 
 	"bg/cloud_rpc"
 
+	"github.com/guregu/null"
 	"github.com/satori/uuid"
 )
 
@@ -24,6 +27,11 @@ type eventManager interface {
 	InsertHeartbeatIngest(context.Context, *HeartbeatIngest) error
 	LatestHeartbeatBySiteUUID(context.Context, uuid.UUID) (*HeartbeatIngest, error)
 	InsertSiteNetException(context.Context, uuid.UUID, time.Time, string, *uint64, string) error
+	SiteNetExceptionsBySite(context.Context, uuid.UUID, int64, int) ([]SiteNetExceptionRecord, error)
+	GuestEnrollSetPhoneKey(key []byte)
+	HashGuestPhoneNumber(phone string) []byte
+	RecordGuestEnrollAttempt(context.Context, GuestEnrollAttempt) error
+	GuestEnrollAttemptsBySite(context.Context, uuid.UUID, time.Time) ([]GuestEnrollAttempt, error)
 }
 
 // HeartbeatIngest represents a row in the heartbeat_ingest table.  In this
@@ -79,3 +87,105 @@ func (db *ApplianceDB) InsertSiteNetException(ctx context.Context, siteUUID uuid
 	return err
 }
 
+// SiteNetExceptionRecord represents a row in the site_net_exception table, as
+// read back out.  Exception is the exception's JSON representation.
+type SiteNetExceptionRecord struct {
+	ID        int64       `json:"id" db:"id"`
+	SiteUUID  uuid.UUID   `json:"siteUUID" db:"site_uuid"`
+	Timestamp time.Time   `json:"timestamp" db:"ts"`
+	Reason    null.String `json:"reason" db:"reason"`
+	MacAddr   null.Int    `json:"macAddr" db:"macaddr"`
+	Exception string      `json:"exception" db:"exc"`
+}
+
+// SiteNetExceptionsBySite returns up to limit of the exceptions reported by the
+// given site whose IDs are greater than after, in ID order.  Callers can page
+// through all of a site's exceptions by passing the last ID they received.
+func (db *ApplianceDB) SiteNetExceptionsBySite(ctx context.Context, site uuid.UUID, after int64, limit int) ([]SiteNetExceptionRecord, error) {
+	recs := make([]SiteNetExceptionRecord, 0)
+	err := db.SelectContext(ctx, &recs, `
+		SELECT id, site_uuid, ts, reason, macaddr, exc
+		FROM site_net_exception
+		WHERE site_uuid = $1 AND id > $2
+		ORDER BY id
+		LIMIT $3`, site, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// Possible results of a guest enrollment attempt
+const (
+	GuestEnrollSent          = "sent"
+	GuestEnrollUndelivered   = "undelivered"
+	GuestEnrollInvalidNumber = "invalid_number"
+	GuestEnrollSendError     = "send_error"
+)
+
+// GuestEnrollAttempt represents a row in the guest_enroll_attempt table.  The
+// phone number the enrollment was sent to is not stored; only its keyed hash
+// is recorded, so that repeated attempts against the same number can be
+// spotted.  An empty PhoneHash marks an attempt whose number couldn't be
+// parsed.
+type GuestEnrollAttempt struct {
+	ID          uint64        `db:"id"`
+	AccountUUID uuid.NullUUID `db:"account_uuid"`
+	SiteUUID    uuid.UUID     `db:"site_uuid"`
+	Timestamp   time.Time     `db:"attempt_ts"`
+	PhoneHash   []byte        `db:"phone_hash"`
+	Result      string        `db:"result"`
+}
+
+// GuestEnrollSetPhoneKey sets the secret key used by HashGuestPhoneNumber.
+func (db *ApplianceDB) GuestEnrollSetPhoneKey(key []byte) {
+	db.guestPhoneKey = key
+}
+
+// HashGuestPhoneNumber returns the redacted form of a phone number suitable
+// for storing in GuestEnrollAttempt.PhoneHash.  There are few enough phone
+// numbers that a plain hash could be reversed by brute force, so the number
+// is hashed with HMAC-SHA256, keyed with the secret set by
+// GuestEnrollSetPhoneKey.  Callers should normalize the number (e.g., to E.164
+// format) first, so that equivalent numbers hash identically.
+func (db *ApplianceDB) HashGuestPhoneNumber(phone string) []byte {
+	if len(db.guestPhoneKey) == 0 {
+		panic("HashGuestPhoneNumber: no guest phone key set")
+	}
+	mac := hmac.New(sha256.New, db.guestPhoneKey)
+	mac.Write([]byte(phone))
+	return mac.Sum(nil)
+}
+
+// RecordGuestEnrollAttempt adds a row to the guest_enroll_attempt table.  If
+// the attempt's timestamp is unset, the current time is used.
+func (db *ApplianceDB) RecordGuestEnrollAttempt(ctx context.Context, attempt GuestEnrollAttempt) error {
+	if attempt.Timestamp.IsZero() {
+		attempt.Timestamp = time.Now()
+	}
+	_, err := db.ExecContext(ctx,
+		`INSERT INTO guest_enroll_attempt
+		    (account_uuid, site_uuid, attempt_ts, phone_hash, result)
+		    VALUES ($1, $2, $3, $4, $5)`,
+		attempt.AccountUUID,
+		attempt.SiteUUID,
+		attempt.Timestamp,
+		attempt.PhoneHash,
+		attempt.Result)
+	return err
+}
+
+// GuestEnrollAttemptsBySite returns the guest enrollment attempts made at the
+// given site since the given time, most recent first.
+func (db *ApplianceDB) GuestEnrollAttemptsBySite(ctx context.Context, site uuid.UUID, since time.Time) ([]GuestEnrollAttempt, error) {
+	var attempts []GuestEnrollAttempt
+	err := db.SelectContext(ctx, &attempts, `
+		SELECT *
+		FROM guest_enroll_attempt
+		WHERE site_uuid = $1 AND attempt_ts >= $2
+		ORDER BY attempt_ts DESC, id DESC`, site, since)
+	if err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/satori/uuid"
+)
+
+// MaxFirmwareComponentLength is the longest permitted firmware component name
+const MaxFirmwareComponentLength = 64
+
+type firmwareManager interface {
+	UpsertApplianceFirmware(context.Context, uuid.UUID, map[string]string) error
+	ApplianceFirmware(context.Context, uuid.UUID) (map[string]string, error)
+}
+
+// UpsertApplianceFirmware records the versions of an appliance's firmware
+// components (e.g., "uboot" or "kernel"), replacing any versions previously
+// recorded for those components.  Components not mentioned are left alone.
+// ValidationError is returned for empty or overlong component names and empty
+// versions, and ForeignKeyError if the appliance doesn't exist.
+func (db *ApplianceDB) UpsertApplianceFirmware(ctx context.Context,
+	appUU uuid.UUID, components map[string]string) error {
+
+	names := make([]string, 0, len(components))
+	versions := make([]string, 0, len(components))
+	for name, version := range components {
+		if strings.TrimSpace(name) == "" {
+			return ValidationError{"component", name, "must not be empty"}
+		}
+		if len(name) > MaxFirmwareComponentLength {
+			return ValidationError{"component", name, fmt.Sprintf(
+				"longer than %d characters",
+				MaxFirmwareComponentLength)}
+		}
+		if strings.TrimSpace(version) == "" {
+			return ValidationError{"version", version, fmt.Sprintf(
+				"version of %s must not be empty", name)}
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	// Apply the rows in a consistent order, so that concurrent updates for
+	// the same appliance can't deadlock.
+	sort.Strings(names)
+	for _, name := range names {
+		versions = append(versions, components[name])
+	}
+
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO appliance_firmware (appliance_uuid, component, version)
+		SELECT $1, c.component, c.version
+		FROM unnest($2::varchar[], $3::text[]) AS c(component, version)
+		ON CONFLICT (appliance_uuid, component) DO
+			UPDATE SET (version, changed_ts) = (EXCLUDED.version, now())
+			WHERE appliance_firmware.version IS DISTINCT FROM EXCLUDED.version`,
+		appUU, pq.Array(names), pq.Array(versions))
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "foreign_key_violation" {
+		return ForeignKeyError{
+			simpleMessage: fmt.Sprintf("Unknown appliance UUID %s", appUU),
+			Message:       pqErr.Message,
+			Detail:        pqErr.Detail,
+			Schema:        pqErr.Schema,
+			Table:         pqErr.Table,
+			Constraint:    pqErr.Constraint,
+		}
+	}
+	return err
+}
+
+// ApplianceFirmware returns the most recently recorded version of each of an
+// appliance's firmware components, keyed by component name.  The map is empty
+// if nothing has been recorded for the appliance.
+func (db *ApplianceDB) ApplianceFirmware(ctx context.Context,
+	appUU uuid.UUID) (map[string]string, error) {
+
+	rows := []struct {
+		Component string
+		Version   string
+	}{}
+	err := db.SelectContext(ctx, &rows, `
+		SELECT component, version
+		FROM appliance_firmware
+		WHERE appliance_uuid = $1`, appUU)
+	if err != nil {
+		return nil, err
+	}
+
+	components := make(map[string]string, len(rows))
+	for _, r := range rows {
+		components[r.Component] = r.Version
+	}
+	return components, nil
+}
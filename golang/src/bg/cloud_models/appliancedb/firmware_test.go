@@ -0,0 +1,100 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.uber.org/zap"
+)
+
+// Test recording firmware versions.  subtest of TestDatabaseModel
+func testApplianceFirmware(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, &testID2)
+	app1 := testID1.ApplianceUUID
+	app2 := testID2.ApplianceUUID
+
+	// Nothing recorded yet
+	fw, err := ds.ApplianceFirmware(ctx, app1)
+	assert.NoError(err)
+	assert.NotNil(fw)
+	assert.Empty(fw)
+
+	err = ds.UpsertApplianceFirmware(ctx, app1, map[string]string{
+		"uboot":  "2019.07-bg1",
+		"kernel": "4.19.66",
+	})
+	assert.NoError(err)
+	err = ds.UpsertApplianceFirmware(ctx, app2, map[string]string{
+		"uboot": "2018.03",
+	})
+	assert.NoError(err)
+
+	fw, err = ds.ApplianceFirmware(ctx, app1)
+	assert.NoError(err)
+	assert.Equal(map[string]string{
+		"uboot":  "2019.07-bg1",
+		"kernel": "4.19.66",
+	}, fw)
+
+	// Upserting overwrites the components given, and leaves the rest
+	// alone
+	err = ds.UpsertApplianceFirmware(ctx, app1, map[string]string{
+		"uboot": "2020.01-bg2",
+		"tfa":   "2.2",
+	})
+	assert.NoError(err)
+	fw, err = ds.ApplianceFirmware(ctx, app1)
+	assert.NoError(err)
+	assert.Equal(map[string]string{
+		"uboot":  "2020.01-bg2",
+		"kernel": "4.19.66",
+		"tfa":    "2.2",
+	}, fw)
+
+	// Other appliances are unaffected
+	fw, err = ds.ApplianceFirmware(ctx, app2)
+	assert.NoError(err)
+	assert.Equal(map[string]string{"uboot": "2018.03"}, fw)
+
+	// Nothing to do
+	err = ds.UpsertApplianceFirmware(ctx, app1, map[string]string{})
+	assert.NoError(err)
+
+	// Bad input is rejected, and nothing is changed
+	bad := []map[string]string{
+		{"": "1.0"},
+		{strings.Repeat("x", MaxFirmwareComponentLength+1): "1.0"},
+		{"uboot": "2021.01", "kernel": " "},
+	}
+	for _, components := range bad {
+		err = ds.UpsertApplianceFirmware(ctx, app1, components)
+		assert.IsType(ValidationError{}, err, "%v", components)
+	}
+	fw, err = ds.ApplianceFirmware(ctx, app1)
+	assert.NoError(err)
+	assert.Equal("2020.01-bg2", fw["uboot"])
+
+	err = ds.UpsertApplianceFirmware(ctx, badUUID, map[string]string{
+		"uboot": "2020.01",
+	})
+	assert.IsType(ForeignKeyError{}, err)
+	fw, err = ds.ApplianceFirmware(ctx, badUUID)
+	assert.NoError(err)
+	assert.Empty(fw)
+}
@@ -0,0 +1,332 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// Severities of the findings in a database health report, in increasing order
+// of urgency
+const (
+	HealthOK       = "ok"
+	HealthWarning  = "warning"
+	HealthCritical = "critical"
+)
+
+var healthRank = map[string]int{
+	HealthOK:       0,
+	HealthWarning:  1,
+	HealthCritical: 2,
+}
+
+// Thresholds at which the findings in a database health report become
+// warnings or critical.
+const (
+	// Tables with fewer dead tuples than this are left to autovacuum,
+	// whatever their ratio.
+	deadTupleMinimum  = 10000
+	deadRatioWarning  = 0.2
+	deadRatioCritical = 0.5
+
+	// Indexes which have never been scanned are only worth mentioning if
+	// they're big enough to cost something to maintain.
+	unusedIndexBytes = 64 * 1024 * 1024
+
+	sequenceRatioWarning  = 0.75
+	sequenceRatioCritical = 0.9
+
+	longTransactionWarning  = 5 * time.Minute
+	longTransactionCritical = time.Hour
+)
+
+type healthManager interface {
+	DatabaseHealth(context.Context) (*DatabaseHealthReport, error)
+}
+
+// TableHealth describes the size and bloat of a table
+type TableHealth struct {
+	Table      string    `json:"table" db:"table_name"`
+	LiveTuples int64     `json:"liveTuples" db:"live_tuples"`
+	DeadTuples int64     `json:"deadTuples" db:"dead_tuples"`
+	DeadRatio  float64   `json:"deadRatio" db:"-"`
+	TotalBytes int64     `json:"totalBytes" db:"total_bytes"`
+	TableBytes int64     `json:"tableBytes" db:"table_bytes"`
+	IndexBytes int64     `json:"indexBytes" db:"index_bytes"`
+	LastVacuum null.Time `json:"lastVacuum" db:"last_vacuum"`
+	Severity   string    `json:"severity" db:"-"`
+}
+
+// IndexHealth describes the size and use of an index.  The scan count is
+// cumulative since the statistics were last reset.
+type IndexHealth struct {
+	Table    string `json:"table" db:"table_name"`
+	Index    string `json:"index" db:"index_name"`
+	Bytes    int64  `json:"bytes" db:"bytes"`
+	Scans    int64  `json:"scans" db:"scans"`
+	Severity string `json:"severity" db:"-"`
+}
+
+// SequenceHealth describes how close a sequence is to running out of values.
+// MaxValue is the lesser of the sequence's own limit and that of the column
+// which owns it, if any.
+type SequenceHealth struct {
+	Sequence  string      `json:"sequence" db:"sequence_name"`
+	OwnedBy   null.String `json:"ownedBy" db:"owned_by"`
+	LastValue null.Int    `json:"lastValue" db:"last_value"`
+	MaxValue  int64       `json:"maxValue" db:"max_value"`
+	UsedRatio float64     `json:"usedRatio" db:"-"`
+	Severity  string      `json:"severity" db:"-"`
+}
+
+// MissingIndex describes an entry in the hot_path_index table which isn't
+// satisfied by any index in the database.
+type MissingIndex struct {
+	Name     string         `json:"name" db:"name"`
+	Table    string         `json:"table" db:"table_name"`
+	Columns  pq.StringArray `json:"columns" db:"columns"`
+	Reason   string         `json:"reason" db:"reason"`
+	Severity string         `json:"severity" db:"-"`
+}
+
+// LongTransaction describes a transaction which has been open for long enough
+// to hold back vacuum.
+type LongTransaction struct {
+	PID         int         `json:"pid" db:"pid"`
+	User        null.String `json:"user" db:"user_name"`
+	Application string      `json:"application" db:"application_name"`
+	State       null.String `json:"state" db:"state"`
+	Start       time.Time   `json:"start" db:"xact_start"`
+	AgeSeconds  float64     `json:"ageSeconds" db:"age_seconds"`
+	Query       string      `json:"query" db:"query"`
+	Severity    string      `json:"severity" db:"-"`
+}
+
+// DatabaseHealthReport collects the findings about the state of the database
+// which an operator might need to act on.
+type DatabaseHealthReport struct {
+	GeneratedAt      time.Time         `json:"generatedAt"`
+	Tables           []TableHealth     `json:"tables"`
+	Indexes          []IndexHealth     `json:"indexes"`
+	Sequences        []SequenceHealth  `json:"sequences"`
+	MissingIndexes   []MissingIndex    `json:"missingIndexes"`
+	LongTransactions []LongTransaction `json:"longTransactions"`
+}
+
+// Return the more urgent of two severities
+func worseHealth(a, b string) string {
+	if healthRank[b] > healthRank[a] {
+		return b
+	}
+	return a
+}
+
+// Severity returns the most urgent severity of any finding in the report
+func (r *DatabaseHealthReport) Severity() string {
+	s := HealthOK
+	for _, t := range r.Tables {
+		s = worseHealth(s, t.Severity)
+	}
+	for _, i := range r.Indexes {
+		s = worseHealth(s, i.Severity)
+	}
+	for _, q := range r.Sequences {
+		s = worseHealth(s, q.Severity)
+	}
+	for _, m := range r.MissingIndexes {
+		s = worseHealth(s, m.Severity)
+	}
+	for _, l := range r.LongTransactions {
+		s = worseHealth(s, l.Severity)
+	}
+	return s
+}
+
+func deadTupleSeverity(live, dead int64) (float64, string) {
+	if live+dead == 0 {
+		return 0, HealthOK
+	}
+	ratio := float64(dead) / float64(live+dead)
+	switch {
+	case dead < deadTupleMinimum:
+		return ratio, HealthOK
+	case ratio >= deadRatioCritical:
+		return ratio, HealthCritical
+	case ratio >= deadRatioWarning:
+		return ratio, HealthWarning
+	}
+	return ratio, HealthOK
+}
+
+func indexSeverity(bytes, scans int64) string {
+	if scans == 0 && bytes >= unusedIndexBytes {
+		return HealthWarning
+	}
+	return HealthOK
+}
+
+// Sequences which have never been used have no last value
+func sequenceSeverity(last null.Int, max int64) (float64, string) {
+	if !last.Valid || max <= 0 {
+		return 0, HealthOK
+	}
+	ratio := float64(last.Int64) / float64(max)
+	switch {
+	case ratio >= sequenceRatioCritical:
+		return ratio, HealthCritical
+	case ratio >= sequenceRatioWarning:
+		return ratio, HealthWarning
+	}
+	return ratio, HealthOK
+}
+
+func transactionSeverity(ageSeconds float64) string {
+	age := time.Duration(ageSeconds * float64(time.Second))
+	switch {
+	case age >= longTransactionCritical:
+		return HealthCritical
+	case age >= longTransactionWarning:
+		return HealthWarning
+	}
+	return HealthOK
+}
+
+// DatabaseHealth examines the Postgres catalogs and statistics for the
+// database, and reports on the size and bloat of its tables and indexes,
+// sequences approaching their limits, hot-path indexes which are missing, and
+// transactions which have been open for too long.
+func (db *ApplianceDB) DatabaseHealth(ctx context.Context) (*DatabaseHealthReport, error) {
+	r := &DatabaseHealthReport{
+		Tables:           make([]TableHealth, 0),
+		Indexes:          make([]IndexHealth, 0),
+		Sequences:        make([]SequenceHealth, 0),
+		MissingIndexes:   make([]MissingIndex, 0),
+		LongTransactions: make([]LongTransaction, 0),
+	}
+
+	err := db.GetContext(ctx, &r.GeneratedAt, "SELECT now()")
+	if err != nil {
+		return nil, errors.Wrap(err, "reading time")
+	}
+
+	err = db.SelectContext(ctx, &r.Tables, `
+	    SELECT
+	      relname AS table_name,
+	      n_live_tup AS live_tuples,
+	      n_dead_tup AS dead_tuples,
+	      pg_total_relation_size(relid) AS total_bytes,
+	      pg_relation_size(relid) AS table_bytes,
+	      pg_indexes_size(relid) AS index_bytes,
+	      GREATEST(last_vacuum, last_autovacuum) AS last_vacuum
+	    FROM pg_stat_user_tables
+	    WHERE schemaname = current_schema()
+	    ORDER BY total_bytes DESC, table_name`)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading table statistics")
+	}
+	for i := range r.Tables {
+		t := &r.Tables[i]
+		t.DeadRatio, t.Severity = deadTupleSeverity(t.LiveTuples,
+			t.DeadTuples)
+	}
+
+	err = db.SelectContext(ctx, &r.Indexes, `
+	    SELECT
+	      relname AS table_name,
+	      indexrelname AS index_name,
+	      pg_relation_size(indexrelid) AS bytes,
+	      idx_scan AS scans
+	    FROM pg_stat_user_indexes
+	    WHERE schemaname = current_schema()
+	    ORDER BY bytes DESC, index_name`)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading index statistics")
+	}
+	for i := range r.Indexes {
+		x := &r.Indexes[i]
+		x.Severity = indexSeverity(x.Bytes, x.Scans)
+	}
+
+	// A sequence owned by a column can run out when the column's type
+	// does, even if the sequence itself has room.  This is typical of
+	// serial columns created before Postgres 10.
+	err = db.SelectContext(ctx, &r.Sequences, `
+	    SELECT
+	      s.sequencename AS sequence_name,
+	      col.owned_by,
+	      s.last_value,
+	      LEAST(s.max_value, COALESCE(col.max_value, s.max_value)) AS max_value
+	    FROM pg_sequences s
+	    LEFT JOIN LATERAL (
+	      SELECT
+	        a.attrelid::regclass::text || '.' || a.attname AS owned_by,
+	        CASE a.atttypid
+	          WHEN 'int2'::regtype THEN 32767
+	          WHEN 'int4'::regtype THEN 2147483647
+	        END AS max_value
+	      FROM pg_depend d
+	      JOIN pg_attribute a
+	        ON a.attrelid = d.refobjid AND a.attnum = d.refobjsubid
+	      WHERE d.classid = 'pg_class'::regclass
+	        AND d.refclassid = 'pg_class'::regclass
+	        AND d.objid = format('%I.%I', s.schemaname, s.sequencename)::regclass
+	        AND d.deptype IN ('a', 'i')
+	    ) col ON true
+	    WHERE s.schemaname = current_schema()
+	    ORDER BY sequence_name`)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading sequences")
+	}
+	for i := range r.Sequences {
+		q := &r.Sequences[i]
+		q.UsedRatio, q.Severity = sequenceSeverity(q.LastValue, q.MaxValue)
+	}
+
+	err = db.SelectContext(ctx, &r.MissingIndexes, `
+	    SELECT name, table_name, columns, reason
+	    FROM missing_hot_path_index
+	    ORDER BY name`)
+	if err != nil {
+		return nil, errors.Wrap(err, "checking hot path indexes")
+	}
+	for i := range r.MissingIndexes {
+		r.MissingIndexes[i].Severity = HealthWarning
+	}
+
+	err = db.SelectContext(ctx, &r.LongTransactions, `
+	    SELECT
+	      pid,
+	      usename AS user_name,
+	      application_name,
+	      state,
+	      xact_start,
+	      extract(epoch FROM clock_timestamp() - xact_start) AS age_seconds,
+	      left(query, 200) AS query
+	    FROM pg_stat_activity
+	    WHERE datname = current_database()
+	      AND pid <> pg_backend_pid()
+	      AND clock_timestamp() - xact_start > $1::float8 * interval '1 second'
+	    ORDER BY xact_start`,
+		longTransactionWarning.Seconds())
+	if err != nil {
+		return nil, errors.Wrap(err, "reading transactions")
+	}
+	for i := range r.LongTransactions {
+		l := &r.LongTransactions[i]
+		l.Severity = transactionSeverity(l.AgeSeconds)
+	}
+
+	return r, nil
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/guregu/null"
+	"github.com/stretchr/testify/require"
+
+	"go.uber.org/zap"
+)
+
+func TestHealthSeverity(t *testing.T) {
+	assert := require.New(t)
+
+	ratio, s := deadTupleSeverity(0, 0)
+	assert.Equal(0.0, ratio)
+	assert.Equal(HealthOK, s)
+	// Small tables are left alone, however bloated
+	_, s = deadTupleSeverity(10, deadTupleMinimum-1)
+	assert.Equal(HealthOK, s)
+	ratio, s = deadTupleSeverity(40000, 10000)
+	assert.Equal(0.2, ratio)
+	assert.Equal(HealthWarning, s)
+	_, s = deadTupleSeverity(10000, 10000)
+	assert.Equal(HealthCritical, s)
+	_, s = deadTupleSeverity(1000000, 10000)
+	assert.Equal(HealthOK, s)
+
+	assert.Equal(HealthOK, indexSeverity(unusedIndexBytes, 1))
+	assert.Equal(HealthOK, indexSeverity(unusedIndexBytes-1, 0))
+	assert.Equal(HealthWarning, indexSeverity(unusedIndexBytes, 0))
+
+	_, s = sequenceSeverity(null.Int{}, math.MaxInt32)
+	assert.Equal(HealthOK, s)
+	ratio, s = sequenceSeverity(null.IntFrom(50), 100)
+	assert.Equal(0.5, ratio)
+	assert.Equal(HealthOK, s)
+	_, s = sequenceSeverity(null.IntFrom(75), 100)
+	assert.Equal(HealthWarning, s)
+	_, s = sequenceSeverity(null.IntFrom(90), 100)
+	assert.Equal(HealthCritical, s)
+	_, s = sequenceSeverity(null.IntFrom(math.MaxInt32), math.MaxInt32)
+	assert.Equal(HealthCritical, s)
+
+	assert.Equal(HealthOK, transactionSeverity(60))
+	assert.Equal(HealthWarning, transactionSeverity(300))
+	assert.Equal(HealthCritical, transactionSeverity(3600))
+
+	r := &DatabaseHealthReport{}
+	assert.Equal(HealthOK, r.Severity())
+	r.Tables = []TableHealth{{Severity: HealthOK}}
+	r.Sequences = []SequenceHealth{{Severity: HealthCritical}}
+	r.MissingIndexes = []MissingIndex{{Severity: HealthWarning}}
+	assert.Equal(HealthCritical, r.Severity())
+}
+
+// Test the database health report.  subtest of TestDatabaseModel
+func testDatabaseHealth(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+	adb := ds.(*ApplianceDB)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	_ = mkAccount(t, ds, &testPerson1, &testAccount1, nil)
+
+	r, err := ds.DatabaseHealth(ctx)
+	assert.NoError(err)
+	assert.False(r.GeneratedAt.IsZero())
+	assert.Empty(r.LongTransactions)
+
+	tables := make(map[string]TableHealth)
+	for _, th := range r.Tables {
+		tables[th.Table] = th
+	}
+	assert.Contains(tables, "account")
+	assert.Contains(tables, "hot_path_index")
+	assert.True(tables["account"].TotalBytes > 0)
+
+	indexes := make(map[string]IndexHealth)
+	for _, ih := range r.Indexes {
+		indexes[ih.Index] = ih
+	}
+	assert.Contains(indexes, "account_person_uuid")
+	assert.Equal("account", indexes["account_person_uuid"].Table)
+
+	// Every index the schema asks for is present in a fresh database, so
+	// the list can't drift from the schema without failing here.
+	assert.Empty(r.MissingIndexes)
+
+	seqs := make(map[string]SequenceHealth)
+	for _, sh := range r.Sequences {
+		seqs[sh.Sequence] = sh
+	}
+	assert.Contains(seqs, "oauth2_identity_id_seq")
+	oid := seqs["oauth2_identity_id_seq"]
+	assert.Equal(null.StringFrom("oauth2_identity.id"), oid.OwnedBy)
+	assert.Equal(int64(math.MaxInt32), oid.MaxValue)
+	assert.Equal(HealthOK, oid.Severity)
+	assert.Contains(seqs, "oauth2_access_token_id_seq")
+	assert.Equal(int64(math.MaxInt64),
+		seqs["oauth2_access_token_id_seq"].MaxValue)
+	assert.Equal(HealthOK, r.Severity())
+
+	// An index which goes missing is reported under its expected name
+	_, err = adb.ExecContext(ctx, "DROP INDEX account_person_uuid")
+	assert.NoError(err)
+	r, err = ds.DatabaseHealth(ctx)
+	assert.NoError(err)
+	assert.Equal([]MissingIndex{
+		{
+			Name:     "account_person_uuid",
+			Table:    "account",
+			Columns:  []string{"person_uuid"},
+			Reason:   "accounts by person",
+			Severity: HealthWarning,
+		},
+	}, r.MissingIndexes)
+	assert.Equal(HealthWarning, r.Severity())
+
+	// Any index with the right leading columns will do
+	_, err = adb.ExecContext(ctx,
+		"CREATE INDEX test_person_org ON account (person_uuid, organization_uuid)")
+	assert.NoError(err)
+	r, err = ds.DatabaseHealth(ctx)
+	assert.NoError(err)
+	assert.Empty(r.MissingIndexes)
+
+	// Widening the sequence doesn't help if the column is still an int4
+	_, err = adb.ExecContext(ctx, `
+	    ALTER SEQUENCE oauth2_identity_id_seq AS bigint;
+	    SELECT setval('oauth2_identity_id_seq', 2000000000)`)
+	assert.NoError(err)
+	r, err = ds.DatabaseHealth(ctx)
+	assert.NoError(err)
+	for _, sh := range r.Sequences {
+		seqs[sh.Sequence] = sh
+	}
+	oid = seqs["oauth2_identity_id_seq"]
+	assert.Equal(null.IntFrom(2000000000), oid.LastValue)
+	assert.Equal(int64(math.MaxInt32), oid.MaxValue)
+	assert.InDelta(0.931, oid.UsedRatio, 0.001)
+	assert.Equal(HealthCritical, oid.Severity)
+	assert.Equal(HealthCritical, r.Severity())
+
+	_, err = adb.ExecContext(ctx,
+		"SELECT setval('oauth2_identity_id_seq', 1700000000)")
+	assert.NoError(err)
+	r, err = ds.DatabaseHealth(ctx)
+	assert.NoError(err)
+	for _, sh := range r.Sequences {
+		seqs[sh.Sequence] = sh
+	}
+	assert.Equal(HealthWarning, seqs["oauth2_identity_id_seq"].Severity)
+}
@@ -0,0 +1,279 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/lib/pq"
+	"github.com/satori/uuid"
+)
+
+// Classes of read-only data which an integration token may export
+const (
+	IntegrationScopeEvents    = "events"
+	IntegrationScopeInventory = "inventory"
+)
+
+// IntegrationScopes lists all of the valid integration token scopes
+var IntegrationScopes = []string{
+	IntegrationScopeEvents,
+	IntegrationScopeInventory,
+}
+
+// MaxIntegrationTokenDuration is the longest time for which an integration
+// token may be valid
+const MaxIntegrationTokenDuration = 366 * 24 * time.Hour
+
+// IntegrationTokenUseInterval is the granularity with which a token's LastUsed
+// time is maintained; recording every use would turn each export request into
+// a database write.
+const IntegrationTokenUseInterval = time.Minute
+
+// Integration tokens are presented as "<token uuid>.<secret>".  The secret is
+// integrationSecretLen random bytes, base64url-encoded.
+const (
+	integrationTokenSep  = "."
+	integrationSecretLen = 32
+)
+
+type integrationManager interface {
+	CreateSiteIntegrationToken(context.Context, *SiteIntegrationToken) (string, error)
+	ValidateSiteIntegrationToken(context.Context, string) (*SiteIntegrationToken, error)
+	SiteIntegrationTokensBySite(context.Context, uuid.UUID) ([]SiteIntegrationToken, error)
+	RevokeSiteIntegrationToken(context.Context, uuid.UUID, uuid.UUID) error
+}
+
+// SiteIntegrationToken represents a row in the site_integration_tokens table: a
+// credential with which an external system may export some classes of a
+// single site's data, until the token expires or is revoked.
+type SiteIntegrationToken struct {
+	UUID       uuid.UUID      `json:"uuid" db:"uuid"`
+	SiteUUID   uuid.UUID      `json:"siteUUID" db:"site_uuid"`
+	Name       string         `json:"name" db:"name"`
+	SecretHash []byte         `json:"-" db:"secret_hash"`
+	Scopes     pq.StringArray `json:"scopes" db:"scopes"`
+	CreatedBy  string         `json:"createdBy" db:"created_by"`
+	CreatedAt  time.Time      `json:"createdAt" db:"created_at"`
+	ExpiresAt  time.Time      `json:"expiresAt" db:"expires_at"`
+	LastUsed   null.Time      `json:"lastUsed" db:"last_used"`
+	RevokedAt  null.Time      `json:"revokedAt" db:"revoked_at"`
+}
+
+// HasScope returns true if the token permits exporting the given class of data
+func (t *SiteIntegrationToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Active returns true if the token is accepted at the given time
+func (t *SiteIntegrationToken) Active(now time.Time) bool {
+	return !t.RevokedAt.Valid && now.Before(t.ExpiresAt)
+}
+
+func hashIntegrationSecret(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+func validIntegrationScope(scope string) bool {
+	for _, s := range IntegrationScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateSiteIntegrationToken records a new integration token, returning the
+// token in the form its holder must present it.  Only a hash of the token's
+// secret is stored, so this is the only time the token is available.  The
+// token's UUID and SecretHash are filled in, as is CreatedAt if it is unset.
+// ValidationError is returned if the name or scopes are invalid, or if the
+// token doesn't expire after it is created and within
+// MaxIntegrationTokenDuration; UniqueViolationError is returned if the site
+// already has an unrevoked token with the same name; ForeignKeyError is
+// returned if the site doesn't exist.
+func (db *ApplianceDB) CreateSiteIntegrationToken(ctx context.Context,
+	tok *SiteIntegrationToken) (string, error) {
+
+	if tok.Name == "" {
+		return "", ValidationError{"name", tok.Name, "must not be empty"}
+	}
+	if len(tok.Scopes) == 0 {
+		return "", ValidationError{"scopes", "", "at least one required"}
+	}
+	for _, s := range tok.Scopes {
+		if !validIntegrationScope(s) {
+			return "", ValidationError{"scope", s, fmt.Sprintf(
+				"must be one of %s",
+				strings.Join(IntegrationScopes, ", "))}
+		}
+	}
+	tok.UUID = uuid.NewV4()
+	if tok.CreatedAt.IsZero() {
+		tok.CreatedAt = time.Now()
+	}
+	d := tok.ExpiresAt.Sub(tok.CreatedAt)
+	if d <= 0 || d > MaxIntegrationTokenDuration {
+		return "", ValidationError{"expires", tok.ExpiresAt.String(),
+			fmt.Sprintf("must be within %v of creation",
+				MaxIntegrationTokenDuration)}
+	}
+
+	raw := make([]byte, integrationSecretLen)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate secret: %v", err)
+	}
+	secret := base64.RawURLEncoding.EncodeToString(raw)
+	tok.SecretHash = hashIntegrationSecret(secret)
+
+	_, err := db.NamedExecContext(ctx, `
+		INSERT INTO site_integration_tokens
+		    (uuid, site_uuid, name, secret_hash, scopes, created_by,
+		     created_at, expires_at)
+		VALUES
+		    (:uuid, :site_uuid, :name, :secret_hash, :scopes, :created_by,
+		     :created_at, :expires_at)`, tok)
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code.Name() {
+		case "foreign_key_violation":
+			return "", ForeignKeyError{
+				simpleMessage: fmt.Sprintf("Unknown site %s",
+					tok.SiteUUID),
+				Message:    pqErr.Message,
+				Detail:     pqErr.Detail,
+				Schema:     pqErr.Schema,
+				Table:      pqErr.Table,
+				Constraint: pqErr.Constraint,
+			}
+		case "unique_violation":
+			return "", UniqueViolationError{
+				Message:    pqErr.Message,
+				Detail:     pqErr.Detail,
+				Schema:     pqErr.Schema,
+				Table:      pqErr.Table,
+				Constraint: pqErr.Constraint,
+			}
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return tok.UUID.String() + integrationTokenSep + secret, nil
+}
+
+// ValidateSiteIntegrationToken checks a token presented by an external system,
+// returning the token's record if it is currently accepted.  The token's
+// LastUsed time is updated, at most once per IntegrationTokenUseInterval.
+// NotFoundError is returned if the token is malformed, unknown, has the wrong
+// secret, or has expired or been revoked; callers should not distinguish
+// between these cases in anything they return to the token's holder.
+func (db *ApplianceDB) ValidateSiteIntegrationToken(ctx context.Context,
+	token string) (*SiteIntegrationToken, error) {
+
+	invalid := func(reason string) error {
+		return NotFoundError{fmt.Sprintf(
+			"ValidateSiteIntegrationToken: %s", reason)}
+	}
+
+	parts := strings.SplitN(token, integrationTokenSep, 2)
+	if len(parts) != 2 {
+		return nil, invalid("malformed token")
+	}
+	tokUUID, err := uuid.FromString(parts[0])
+	if err != nil {
+		return nil, invalid("malformed token")
+	}
+	hash := hashIntegrationSecret(parts[1])
+
+	var tok SiteIntegrationToken
+	err = db.GetContext(ctx, &tok, `
+		SELECT * FROM site_integration_tokens
+		WHERE uuid = $1`, tokUUID)
+	if err == sql.ErrNoRows {
+		return nil, invalid(fmt.Sprintf("unknown token %v", tokUUID))
+	} else if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(hash, tok.SecretHash) != 1 {
+		return nil, invalid(fmt.Sprintf("bad secret for token %v",
+			tokUUID))
+	}
+	if !tok.Active(time.Now()) {
+		return nil, invalid(fmt.Sprintf("token %v expired or revoked",
+			tokUUID))
+	}
+
+	row := db.QueryRowContext(ctx, `
+		UPDATE site_integration_tokens
+		SET last_used = now()
+		WHERE uuid = $1 AND
+		    (last_used IS NULL OR last_used < now() - $2::interval)
+		RETURNING last_used`,
+		tokUUID, IntegrationTokenUseInterval.String())
+	if err = row.Scan(&tok.LastUsed); err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return &tok, nil
+}
+
+// SiteIntegrationTokensBySite returns all of a site's integration tokens,
+// including expired and revoked ones, newest first.
+func (db *ApplianceDB) SiteIntegrationTokensBySite(ctx context.Context,
+	site uuid.UUID) ([]SiteIntegrationToken, error) {
+
+	toks := make([]SiteIntegrationToken, 0)
+	err := db.SelectContext(ctx, &toks, `
+		SELECT * FROM site_integration_tokens
+		WHERE site_uuid = $1
+		ORDER BY created_at DESC`, site)
+	if err != nil {
+		return nil, err
+	}
+	return toks, nil
+}
+
+// RevokeSiteIntegrationToken ends one of a site's integration tokens before it
+// expires.  The token is refused from then on.  NotFoundError is returned if
+// the site has no such token, or if it has already been revoked.
+func (db *ApplianceDB) RevokeSiteIntegrationToken(ctx context.Context,
+	site uuid.UUID, tokUUID uuid.UUID) error {
+
+	res, err := db.ExecContext(ctx, `
+		UPDATE site_integration_tokens
+		SET revoked_at = now()
+		WHERE site_uuid = $1 AND uuid = $2 AND revoked_at IS NULL`,
+		site, tokUUID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return NotFoundError{fmt.Sprintf(
+			"RevokeSiteIntegrationToken: Couldn't find token %v for %v",
+			tokUUID, site)}
+	}
+	return nil
+}
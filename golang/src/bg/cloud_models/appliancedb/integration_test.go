@@ -0,0 +1,172 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/satori/uuid"
+	"github.com/stretchr/testify/require"
+
+	"go.uber.org/zap"
+)
+
+// Test site integration tokens.  subtest of TestDatabaseModel
+func testSiteIntegrationTokens(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, &testID2)
+
+	toks, err := ds.SiteIntegrationTokensBySite(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.NotNil(toks)
+	assert.Empty(toks)
+
+	// Bad names, scopes, and durations
+	now := time.Now()
+	bad := []SiteIntegrationToken{
+		{Name: "", Scopes: pq.StringArray{IntegrationScopeEvents},
+			ExpiresAt: now.Add(time.Hour)},
+		{Name: "siem", ExpiresAt: now.Add(time.Hour)},
+		{Name: "siem", Scopes: pq.StringArray{"config"},
+			ExpiresAt: now.Add(time.Hour)},
+		{Name: "siem", Scopes: pq.StringArray{IntegrationScopeEvents},
+			ExpiresAt: now.Add(-time.Hour)},
+		{Name: "siem", Scopes: pq.StringArray{IntegrationScopeEvents},
+			ExpiresAt: now.Add(MaxIntegrationTokenDuration + time.Hour)},
+	}
+	for _, tok := range bad {
+		tok.SiteUUID = testSite1.UUID
+		tok.CreatedBy = "tester"
+		_, err = ds.CreateSiteIntegrationToken(ctx, &tok)
+		assert.IsType(ValidationError{}, err, "%v", tok)
+	}
+
+	// Unknown site
+	tok := SiteIntegrationToken{
+		SiteUUID:  uuid.NewV4(),
+		Name:      "siem",
+		Scopes:    pq.StringArray{IntegrationScopeEvents},
+		CreatedBy: "tester",
+		ExpiresAt: now.Add(time.Hour),
+	}
+	_, err = ds.CreateSiteIntegrationToken(ctx, &tok)
+	assert.IsType(ForeignKeyError{}, err)
+
+	tok.SiteUUID = testSite1.UUID
+	secret, err := ds.CreateSiteIntegrationToken(ctx, &tok)
+	assert.NoError(err)
+	assert.NotEqual(uuid.Nil, tok.UUID)
+	assert.True(strings.HasPrefix(secret, tok.UUID.String()+"."))
+
+	// The plaintext is never stored, nor returned again
+	toks, err = ds.SiteIntegrationTokensBySite(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.Len(toks, 1)
+	assert.Equal(tok.UUID, toks[0].UUID)
+	assert.Equal([]string{IntegrationScopeEvents}, []string(toks[0].Scopes))
+	assert.False(toks[0].LastUsed.Valid)
+	plain := strings.SplitN(secret, ".", 2)[1]
+	assert.Equal(hashIntegrationSecret(plain), toks[0].SecretHash)
+	assert.NotContains(string(toks[0].SecretHash), plain)
+
+	// Names are unique among a site's unrevoked tokens
+	dup := tok
+	_, err = ds.CreateSiteIntegrationToken(ctx, &dup)
+	assert.IsType(UniqueViolationError{}, err)
+	dup.SiteUUID = testSite2.UUID
+	secret2, err := ds.CreateSiteIntegrationToken(ctx, &dup)
+	assert.NoError(err)
+	assert.NotEqual(secret, secret2)
+
+	// Validation accepts the token and records its use
+	v, err := ds.ValidateSiteIntegrationToken(ctx, secret)
+	assert.NoError(err)
+	assert.Equal(tok.UUID, v.UUID)
+	assert.Equal(testSite1.UUID, v.SiteUUID)
+	assert.True(v.HasScope(IntegrationScopeEvents))
+	assert.False(v.HasScope(IntegrationScopeInventory))
+	assert.True(v.LastUsed.Valid)
+	firstUse := v.LastUsed.Time
+
+	// ... but only once per interval
+	v, err = ds.ValidateSiteIntegrationToken(ctx, secret)
+	assert.NoError(err)
+	assert.True(firstUse.Equal(v.LastUsed.Time))
+	_, err = ds.(*ApplianceDB).ExecContext(ctx, `
+		UPDATE site_integration_tokens
+		SET last_used = now() - '1 hour'::interval
+		WHERE uuid = $1`, tok.UUID)
+	assert.NoError(err)
+	v, err = ds.ValidateSiteIntegrationToken(ctx, secret)
+	assert.NoError(err)
+	assert.True(v.LastUsed.Time.After(firstUse.Add(-time.Minute)))
+
+	// Malformed, unknown, and wrong tokens
+	badSecrets := []string{
+		"",
+		"garbage",
+		tok.UUID.String(),
+		tok.UUID.String() + ".",
+		tok.UUID.String() + "." + plain + "x",
+		uuid.NewV4().String() + "." + plain,
+		dup.UUID.String() + "." + plain,
+	}
+	for _, s := range badSecrets {
+		_, err = ds.ValidateSiteIntegrationToken(ctx, s)
+		assert.IsType(NotFoundError{}, err, "%q", s)
+	}
+
+	// Expired tokens are refused
+	expired := SiteIntegrationToken{
+		SiteUUID:  testSite1.UUID,
+		Name:      "expired",
+		Scopes:    pq.StringArray{IntegrationScopeInventory},
+		CreatedBy: "tester",
+		CreatedAt: now.Add(-2 * time.Hour),
+		ExpiresAt: now.Add(-time.Hour),
+	}
+	expiredSecret, err := ds.CreateSiteIntegrationToken(ctx, &expired)
+	assert.NoError(err)
+	_, err = ds.ValidateSiteIntegrationToken(ctx, expiredSecret)
+	assert.IsType(NotFoundError{}, err)
+
+	// Revocation takes effect immediately, can only be done once, and only
+	// by the token's site
+	err = ds.RevokeSiteIntegrationToken(ctx, testSite2.UUID, tok.UUID)
+	assert.IsType(NotFoundError{}, err)
+	err = ds.RevokeSiteIntegrationToken(ctx, testSite1.UUID, tok.UUID)
+	assert.NoError(err)
+	_, err = ds.ValidateSiteIntegrationToken(ctx, secret)
+	assert.IsType(NotFoundError{}, err)
+	err = ds.RevokeSiteIntegrationToken(ctx, testSite1.UUID, tok.UUID)
+	assert.IsType(NotFoundError{}, err)
+	_, err = ds.ValidateSiteIntegrationToken(ctx, secret2)
+	assert.NoError(err)
+
+	// Revoked tokens are still listed, and their names may be reused
+	toks, err = ds.SiteIntegrationTokensBySite(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.Len(toks, 2)
+	assert.Equal(tok.UUID, toks[0].UUID)
+	assert.True(toks[0].RevokedAt.Valid)
+	assert.False(toks[0].Active(time.Now()))
+	assert.Equal(expired.UUID, toks[1].UUID)
+	again := tok
+	again.CreatedAt = time.Time{}
+	_, err = ds.CreateSiteIntegrationToken(ctx, &again)
+	assert.NoError(err)
+}
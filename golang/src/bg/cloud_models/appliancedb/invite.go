@@ -0,0 +1,357 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/lib/pq"
+	"github.com/satori/uuid"
+)
+
+// MaxInviteDuration is the longest time for which an invitation may be
+// accepted
+const MaxInviteDuration = 30 * 24 * time.Hour
+
+// Invitation tokens are inviteTokenLen random bytes, base64url-encoded
+const inviteTokenLen = 32
+
+type inviteManager interface {
+	CreateInvite(context.Context, *AccountInvite) (string, error)
+	InviteByToken(context.Context, string) (*AccountInvite, error)
+	PendingInvitesByOrg(context.Context, uuid.UUID) ([]AccountInvite, error)
+	AcceptInvite(context.Context, string, uuid.UUID) (*AccountInvite, error)
+	CreateInvitedAccount(context.Context, string, *Person, *Account,
+		*OAuth2Identity) (*AccountInvite, error)
+	ExpireStaleInvites(context.Context, time.Time) (int64, error)
+}
+
+// AccountInvite represents a row in the account_invite table: an invitation
+// for the holder of an email address to join an organization with a role.
+// The invitation is pending until it is accepted or it expires.
+type AccountInvite struct {
+	UUID                uuid.UUID     `json:"uuid" db:"uuid"`
+	OrganizationUUID    uuid.UUID     `json:"organizationUUID" db:"organization_uuid"`
+	Email               string        `json:"email" db:"email"`
+	Role                string        `json:"role" db:"role"`
+	TokenHash           []byte        `json:"-" db:"token_hash"`
+	CreatedAt           time.Time     `json:"createdAt" db:"created_at"`
+	ExpiresAt           time.Time     `json:"expiresAt" db:"expires_at"`
+	AcceptedAt          null.Time     `json:"acceptedAt" db:"accepted_at"`
+	AcceptedAccountUUID uuid.NullUUID `json:"acceptedAccountUUID" db:"accepted_account_uuid"`
+}
+
+// Pending returns true if the invitation may be accepted at the given time
+func (inv *AccountInvite) Pending(now time.Time) bool {
+	return !inv.AcceptedAt.Valid && now.Before(inv.ExpiresAt)
+}
+
+// InviteOrgMismatchError is returned when an account tries to accept an
+// invitation to an organization other than its own.  An account only has
+// access to its own organization, so the invitee must log in with an account
+// in the invited organization instead.
+type InviteOrgMismatchError struct {
+	AccountUUID         uuid.UUID
+	AccountOrganization uuid.UUID
+	InviteOrganization  uuid.UUID
+}
+
+func (e InviteOrgMismatchError) Error() string {
+	return fmt.Sprintf("account %s belongs to organization %s, not the "+
+		"invited organization %s", e.AccountUUID, e.AccountOrganization,
+		e.InviteOrganization)
+}
+
+func hashInviteToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// CreateInvite records a new invitation, returning the token with which it
+// may be accepted.  Only a hash of the token is stored, so this is the only
+// time the token is available.  The invitation's UUID and TokenHash are filled
+// in, as is CreatedAt if it is unset, and its Email is normalized.  Inviting
+// an address which already has a pending invitation to the organization
+// replaces that invitation, so only the newest token is accepted.
+// ValidationError is returned if the email or role is missing, or if the
+// invitation doesn't expire after it is created and within MaxInviteDuration;
+// ForeignKeyError is returned if the organization or role doesn't exist.
+func (db *ApplianceDB) CreateInvite(ctx context.Context,
+	inv *AccountInvite) (string, error) {
+
+	email, err := NormalizeEmail(inv.Email)
+	if err != nil {
+		return "", err
+	}
+	if email == "" {
+		return "", ValidationError{"email", inv.Email, "must not be empty"}
+	}
+	if inv.Role == "" {
+		return "", ValidationError{"role", inv.Role, "must not be empty"}
+	}
+	if inv.CreatedAt.IsZero() {
+		inv.CreatedAt = time.Now()
+	}
+	d := inv.ExpiresAt.Sub(inv.CreatedAt)
+	if d <= 0 || d > MaxInviteDuration {
+		return "", ValidationError{"expires", inv.ExpiresAt.String(),
+			fmt.Sprintf("must be within %v of creation",
+				MaxInviteDuration)}
+	}
+
+	raw := make([]byte, inviteTokenLen)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	inv.UUID = uuid.NewV4()
+	inv.Email = email
+	inv.TokenHash = hashInviteToken(token)
+	inv.AcceptedAt = null.Time{}
+	inv.AcceptedAccountUUID = uuid.NullUUID{}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM account_invite
+		WHERE organization_uuid = $1 AND email = $2 AND
+		    accepted_at IS NULL`,
+		inv.OrganizationUUID, inv.Email)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.NamedExecContext(ctx, `
+		INSERT INTO account_invite
+		    (uuid, organization_uuid, email, role, token_hash,
+		     created_at, expires_at)
+		VALUES
+		    (:uuid, :organization_uuid, :email, :role, :token_hash,
+		     :created_at, :expires_at)`, inv)
+	if pqErr, ok := err.(*pq.Error); ok &&
+		pqErr.Code.Name() == "foreign_key_violation" {
+		return "", ForeignKeyError{
+			simpleMessage: fmt.Sprintf("Unknown organization %s or "+
+				"role %q", inv.OrganizationUUID, inv.Role),
+			Message:    pqErr.Message,
+			Detail:     pqErr.Detail,
+			Schema:     pqErr.Schema,
+			Table:      pqErr.Table,
+			Constraint: pqErr.Constraint,
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// InviteByToken returns the pending invitation with the given token.
+// NotFoundError is returned if the token is unknown, or if its invitation has
+// been accepted or has expired.
+func (db *ApplianceDB) InviteByToken(ctx context.Context,
+	token string) (*AccountInvite, error) {
+
+	var inv AccountInvite
+	err := db.GetContext(ctx, &inv, `
+		SELECT * FROM account_invite
+		WHERE token_hash = $1 AND accepted_at IS NULL AND
+		    expires_at > now()`,
+		hashInviteToken(token))
+	if err == sql.ErrNoRows {
+		return nil, NotFoundError{
+			"InviteByToken: unknown, accepted or expired invitation"}
+	} else if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// PendingInvitesByOrg returns the invitations to an organization which may
+// still be accepted, oldest first.
+func (db *ApplianceDB) PendingInvitesByOrg(ctx context.Context,
+	org uuid.UUID) ([]AccountInvite, error) {
+
+	invs := make([]AccountInvite, 0)
+	err := db.SelectContext(ctx, &invs, `
+		SELECT * FROM account_invite
+		WHERE organization_uuid = $1 AND accepted_at IS NULL AND
+		    expires_at > now()
+		ORDER BY created_at, email`, org)
+	if err != nil {
+		return nil, err
+	}
+	return invs, nil
+}
+
+// AcceptInvite accepts the pending invitation with the given token on behalf
+// of an account, granting the account the invitation's role in the
+// organization.  The accepted invitation is returned.  NotFoundError is
+// returned if the token is unknown, or if its invitation has already been
+// accepted or has expired; ForeignKeyError is returned if the account doesn't
+// exist; InviteOrgMismatchError is returned if the account belongs to another
+// organization, in which case the invitation remains pending.
+func (db *ApplianceDB) AcceptInvite(ctx context.Context, token string,
+	account uuid.UUID) (*AccountInvite, error) {
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	inv, err := db.acceptInviteTx(ctx, tx, token, account)
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+func (db *ApplianceDB) acceptInviteTx(ctx context.Context, dbx DBX,
+	token string, account uuid.UUID) (*AccountInvite, error) {
+
+	var inv AccountInvite
+	err := dbx.GetContext(ctx, &inv, `
+		UPDATE account_invite
+		SET (accepted_at, accepted_account_uuid) = (now(), $2)
+		WHERE token_hash = $1 AND accepted_at IS NULL AND
+		    expires_at > now()
+		RETURNING *`,
+		hashInviteToken(token), account)
+	if pqErr, ok := err.(*pq.Error); ok &&
+		pqErr.Code.Name() == "foreign_key_violation" {
+		return nil, ForeignKeyError{
+			simpleMessage: fmt.Sprintf("Unknown account %s", account),
+			Message:       pqErr.Message,
+			Detail:        pqErr.Detail,
+			Schema:        pqErr.Schema,
+			Table:         pqErr.Table,
+			Constraint:    pqErr.Constraint,
+		}
+	} else if err == sql.ErrNoRows {
+		return nil, NotFoundError{
+			"AcceptInvite: unknown, accepted or expired invitation"}
+	} else if err != nil {
+		return nil, err
+	}
+
+	var accountOrg uuid.UUID
+	err = dbx.GetContext(ctx, &accountOrg,
+		"SELECT organization_uuid FROM account WHERE uuid=$1", account)
+	if err != nil {
+		return nil, err
+	}
+	if accountOrg != inv.OrganizationUUID {
+		return nil, InviteOrgMismatchError{
+			AccountUUID:         account,
+			AccountOrganization: accountOrg,
+			InviteOrganization:  inv.OrganizationUUID,
+		}
+	}
+
+	err = db.InsertAccountOrgRoleTx(ctx, dbx, &AccountOrgRole{
+		AccountUUID:            account,
+		OrganizationUUID:       inv.OrganizationUUID,
+		TargetOrganizationUUID: inv.OrganizationUUID,
+		Relationship:           "self",
+		Role:                   inv.Role,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// CreateInvitedAccount accepts the pending invitation with the given token on
+// behalf of a person who has no account yet.  The person is created, along
+// with their account in the invited organization and the OAuth2 identity with
+// which they log in; the account is granted the invitation's role.  The
+// account's OrganizationUUID and the identity's AccountUUID are filled in, and
+// the accepted invitation is returned.  NotFoundError is returned if the token
+// is unknown, or if its invitation has already been accepted or has expired.
+func (db *ApplianceDB) CreateInvitedAccount(ctx context.Context, token string,
+	person *Person, account *Account,
+	id *OAuth2Identity) (*AccountInvite, error) {
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var orgUUID uuid.UUID
+	err = tx.GetContext(ctx, &orgUUID, `
+		SELECT organization_uuid FROM account_invite
+		WHERE token_hash = $1 AND accepted_at IS NULL AND
+		    expires_at > now()
+		FOR UPDATE`,
+		hashInviteToken(token))
+	if err == sql.ErrNoRows {
+		return nil, NotFoundError{"CreateInvitedAccount: unknown, " +
+			"accepted or expired invitation"}
+	} else if err != nil {
+		return nil, err
+	}
+
+	account.OrganizationUUID = orgUUID
+	id.AccountUUID = account.UUID
+	if err = db.InsertPersonTx(ctx, tx, person); err != nil {
+		return nil, err
+	}
+	if err = db.InsertAccountTx(ctx, tx, account); err != nil {
+		return nil, err
+	}
+	if err = db.InsertOAuth2IdentityTx(ctx, tx, id); err != nil {
+		return nil, err
+	}
+	inv, err := db.acceptInviteTx(ctx, tx, token, account.UUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// ExpireStaleInvites deletes the invitations which expired before the given
+// time without being accepted, returning the number deleted.  Accepted
+// invitations are kept as a record of how their accounts joined.
+func (db *ApplianceDB) ExpireStaleInvites(ctx context.Context,
+	before time.Time) (int64, error) {
+
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM account_invite
+		WHERE accepted_at IS NULL AND expires_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/satori/uuid"
+	"github.com/stretchr/testify/require"
+
+	"go.uber.org/zap"
+)
+
+// Test invitations to join an organization.  subtest of TestDatabaseModel
+func testAccountInvites(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, nil, nil)
+	mkOrgSiteApp(t, ds, &testOrg2, nil, nil)
+	_ = mkAccount(t, ds, &testPerson1, &testAccount1, []string{"user"})
+	invitee := testAccount2
+	invitee.OrganizationUUID = testOrg2.UUID
+	_ = mkAccount(t, ds, &testPerson2, &invitee, nil)
+
+	invs, err := ds.PendingInvitesByOrg(ctx, testOrg2.UUID)
+	assert.NoError(err)
+	assert.NotNil(invs)
+	assert.Empty(invs)
+
+	// Bad addresses, roles, and durations
+	now := time.Now()
+	bad := []AccountInvite{
+		{Email: "", Role: "user", ExpiresAt: now.Add(time.Hour)},
+		{Email: "not-an-address", Role: "user",
+			ExpiresAt: now.Add(time.Hour)},
+		{Email: "foo@foo.net", ExpiresAt: now.Add(time.Hour)},
+		{Email: "foo@foo.net", Role: "user",
+			ExpiresAt: now.Add(-time.Hour)},
+		{Email: "foo@foo.net", Role: "user",
+			ExpiresAt: now.Add(MaxInviteDuration + time.Hour)},
+	}
+	for _, inv := range bad {
+		inv.OrganizationUUID = testOrg2.UUID
+		_, err = ds.CreateInvite(ctx, &inv)
+		assert.IsType(ValidationError{}, err, "%v", inv)
+	}
+
+	// Unknown organization or role
+	inv := AccountInvite{
+		OrganizationUUID: uuid.NewV4(),
+		Email:            "foo@foo.net",
+		Role:             "user",
+		ExpiresAt:        now.Add(time.Hour),
+	}
+	_, err = ds.CreateInvite(ctx, &inv)
+	assert.IsType(ForeignKeyError{}, err)
+	inv.OrganizationUUID = testOrg2.UUID
+	inv.Role = "overlord"
+	_, err = ds.CreateInvite(ctx, &inv)
+	assert.IsType(ForeignKeyError{}, err)
+
+	// Create.  The address is normalized.
+	inv = AccountInvite{
+		OrganizationUUID: testOrg2.UUID,
+		Email:            " Foo@Foo.NET ",
+		Role:             "admin",
+		ExpiresAt:        now.Add(time.Hour),
+	}
+	token, err := ds.CreateInvite(ctx, &inv)
+	assert.NoError(err)
+	assert.NotEmpty(token)
+	assert.NotEqual(uuid.Nil, inv.UUID)
+	assert.Equal("foo@foo.net", inv.Email)
+
+	got, err := ds.InviteByToken(ctx, token)
+	assert.NoError(err)
+	assert.Equal(inv.UUID, got.UUID)
+	assert.Equal(testOrg2.UUID, got.OrganizationUUID)
+	assert.Equal("admin", got.Role)
+	assert.True(got.Pending(time.Now()))
+	_, err = ds.InviteByToken(ctx, token+"x")
+	assert.IsType(NotFoundError{}, err)
+
+	// Re-inviting the same address replaces its pending invitation
+	inv2 := AccountInvite{
+		OrganizationUUID: testOrg2.UUID,
+		Email:            "foo@foo.net",
+		Role:             "user",
+		ExpiresAt:        now.Add(time.Hour),
+	}
+	token2, err := ds.CreateInvite(ctx, &inv2)
+	assert.NoError(err)
+	assert.NotEqual(token, token2)
+	_, err = ds.InviteByToken(ctx, token)
+	assert.IsType(NotFoundError{}, err)
+	invs, err = ds.PendingInvitesByOrg(ctx, testOrg2.UUID)
+	assert.NoError(err)
+	assert.Len(invs, 1)
+	assert.Equal(inv2.UUID, invs[0].UUID)
+
+	// An account in another organization can't accept the invitation,
+	// which remains pending.
+	_, err = ds.AcceptInvite(ctx, token2, uuid.NewV4())
+	assert.IsType(ForeignKeyError{}, err)
+	_, err = ds.AcceptInvite(ctx, token2, testAccount1.UUID)
+	assert.Equal(InviteOrgMismatchError{
+		AccountUUID:         testAccount1.UUID,
+		AccountOrganization: testOrg1.UUID,
+		InviteOrganization:  testOrg2.UUID,
+	}, err)
+	_, err = ds.InviteByToken(ctx, token2)
+	assert.NoError(err)
+	roles, err := ds.AccountOrgRoleGrantsByAccount(ctx, testAccount1.UUID)
+	assert.NoError(err)
+	for _, role := range roles {
+		assert.NotEqual(testOrg2.UUID, role.OrganizationUUID)
+	}
+
+	// Accept.  The account is granted the role in the organization, and
+	// the token can't be used again.
+	accepted, err := ds.AcceptInvite(ctx, token2, invitee.UUID)
+	assert.NoError(err)
+	assert.Equal(inv2.UUID, accepted.UUID)
+	assert.True(accepted.AcceptedAt.Valid)
+	assert.Equal(invitee.UUID, accepted.AcceptedAccountUUID.UUID)
+	assert.False(accepted.Pending(time.Now()))
+
+	roles, err = ds.AccountOrgRoleGrantsByAccount(ctx, invitee.UUID)
+	assert.NoError(err)
+	assert.Contains(roles, AccountOrgRole{
+		AccountUUID:            invitee.UUID,
+		OrganizationUUID:       testOrg2.UUID,
+		TargetOrganizationUUID: testOrg2.UUID,
+		Relationship:           "self",
+		Role:                   "user",
+	})
+
+	_, err = ds.AcceptInvite(ctx, token2, invitee.UUID)
+	assert.IsType(NotFoundError{}, err)
+	_, err = ds.InviteByToken(ctx, token2)
+	assert.IsType(NotFoundError{}, err)
+	invs, err = ds.PendingInvitesByOrg(ctx, testOrg2.UUID)
+	assert.NoError(err)
+	assert.Empty(invs)
+
+	// Once accepted, the address can be invited again
+	_, err = ds.CreateInvite(ctx, &AccountInvite{
+		OrganizationUUID: testOrg2.UUID,
+		Email:            "foo@foo.net",
+		Role:             "admin",
+		ExpiresAt:        now.Add(time.Hour),
+	})
+	assert.NoError(err)
+
+	// Expiry.  An invitation created long enough ago has expired, and can
+	// no longer be looked up or accepted.
+	stale := AccountInvite{
+		OrganizationUUID: testOrg1.UUID,
+		Email:            "bar@bar.net",
+		Role:             "user",
+		CreatedAt:        now.Add(-3 * time.Hour),
+		ExpiresAt:        now.Add(-2 * time.Hour),
+	}
+	staleToken, err := ds.CreateInvite(ctx, &stale)
+	assert.NoError(err)
+	_, err = ds.InviteByToken(ctx, staleToken)
+	assert.IsType(NotFoundError{}, err)
+	_, err = ds.AcceptInvite(ctx, staleToken, testAccount1.UUID)
+	assert.IsType(NotFoundError{}, err)
+	invs, err = ds.PendingInvitesByOrg(ctx, testOrg1.UUID)
+	assert.NoError(err)
+	assert.Empty(invs)
+
+	// Only unaccepted invitations which expired before the cutoff are
+	// deleted.
+	n, err := ds.ExpireStaleInvites(ctx, now.Add(-3*time.Hour))
+	assert.NoError(err)
+	assert.Equal(int64(0), n)
+	n, err = ds.ExpireStaleInvites(ctx, now.Add(2*time.Hour))
+	assert.NoError(err)
+	assert.Equal(int64(2), n)
+
+	var count int
+	err = ds.(*ApplianceDB).GetContext(ctx, &count,
+		"SELECT count(*) FROM account_invite")
+	assert.NoError(err)
+	assert.Equal(1, count, "only the accepted invitation should remain")
+
+	// An accepted invitation follows its account when the account is
+	// merged into another, and is deleted along with that account.
+	person := Person{
+		UUID:         uuid.NewV4(),
+		Name:         "Baz Qux",
+		PrimaryEmail: "baz@baz.net",
+	}
+	keep := Account{
+		UUID:             uuid.NewV4(),
+		Email:            "baz@baz.net",
+		PersonUUID:       person.UUID,
+		OrganizationUUID: testOrg2.UUID,
+		AvatarHash:       []byte{},
+	}
+	_ = mkAccount(t, ds, &person, &keep, nil)
+	err = ds.MergeAccounts(ctx, keep.UUID, invitee.UUID)
+	assert.NoError(err)
+	err = ds.(*ApplianceDB).GetContext(ctx, &count, `
+		SELECT count(*) FROM account_invite
+		WHERE accepted_account_uuid = $1`, keep.UUID)
+	assert.NoError(err)
+	assert.Equal(1, count)
+
+	err = ds.DeleteAccount(ctx, keep.UUID)
+	assert.NoError(err)
+	err = ds.(*ApplianceDB).GetContext(ctx, &count,
+		"SELECT count(*) FROM account_invite")
+	assert.NoError(err)
+	assert.Equal(0, count)
+}
+
+// Test accepting an invitation by logging in for the first time.  subtest of
+// TestDatabaseModel
+func testCreateInvitedAccount(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg2, nil, nil)
+
+	token, err := ds.CreateInvite(ctx, &AccountInvite{
+		OrganizationUUID: testOrg2.UUID,
+		Email:            "foo@foo.net",
+		Role:             "admin",
+		ExpiresAt:        time.Now().Add(time.Hour),
+	})
+	assert.NoError(err)
+
+	mkInvitee := func() (*Person, *Account, *OAuth2Identity) {
+		person := testPerson1
+		account := testAccount1
+		account.OrganizationUUID = uuid.Nil
+		id := &OAuth2Identity{
+			Subject:  "invitee",
+			Provider: "google",
+		}
+		return &person, &account, id
+	}
+
+	// An unknown token creates nothing
+	person, account, id := mkInvitee()
+	_, err = ds.CreateInvitedAccount(ctx, token+"x", person, account, id)
+	assert.IsType(NotFoundError{}, err)
+	_, err = ds.PersonByUUID(ctx, person.UUID)
+	assert.IsType(NotFoundError{}, err)
+
+	// The account is created in the invited organization, with the
+	// invited role, and can be used to log in.
+	inv, err := ds.CreateInvitedAccount(ctx, token, person, account, id)
+	assert.NoError(err)
+	assert.Equal(testOrg2.UUID, account.OrganizationUUID)
+	assert.Equal(account.UUID, id.AccountUUID)
+	assert.Equal(account.UUID, inv.AcceptedAccountUUID.UUID)
+
+	li, err := ds.LoginInfoByProviderAndSubject(ctx, "google", "invitee")
+	assert.NoError(err)
+	assert.Equal(account.UUID, li.Account.UUID)
+	assert.Equal(testOrg2.UUID, li.Account.OrganizationUUID)
+	assert.Equal(person.UUID, li.Person.UUID)
+	assert.Equal([]string{"admin"}, li.PrimaryOrgRoles)
+
+	// The token can't be used again
+	person, account, id = mkInvitee()
+	person.UUID = uuid.NewV4()
+	account.UUID = uuid.NewV4()
+	account.PersonUUID = person.UUID
+	id.Subject = "invitee2"
+	_, err = ds.CreateInvitedAccount(ctx, token, person, account, id)
+	assert.IsType(NotFoundError{}, err)
+	_, err = ds.PersonByUUID(ctx, person.UUID)
+	assert.IsType(NotFoundError{}, err)
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type jobLeaseManager interface {
+	AcquireJobLease(context.Context, string, string, time.Duration) (*JobLease, error)
+	RenewJobLease(context.Context, string, string, time.Duration) (*JobLease, error)
+	ReleaseJobLease(context.Context, string, string) error
+	JobLeaseStatus(context.Context) ([]JobLease, error)
+}
+
+// JobLease represents a row in the job_leases table: the right of a single
+// holder to run a job until the lease expires.  Stale is only filled in by
+// JobLeaseStatus.
+type JobLease struct {
+	JobName    string    `db:"job_name" json:"jobName"`
+	Holder     string    `db:"holder" json:"holder"`
+	AcquiredAt time.Time `db:"acquired_at" json:"acquiredAt"`
+	RenewedAt  time.Time `db:"renewed_at" json:"renewedAt"`
+	ExpiresAt  time.Time `db:"expires_at" json:"expiresAt"`
+	Stale      bool      `db:"stale" json:"stale"`
+}
+
+// JobLeaseHeldError is returned when a job's lease can't be acquired because
+// another holder has it and it hasn't yet expired.
+type JobLeaseHeldError struct {
+	JobName   string
+	Holder    string
+	ExpiresAt time.Time
+}
+
+func (e JobLeaseHeldError) Error() string {
+	return fmt.Sprintf("job %s is leased to %s until %s", e.JobName,
+		e.Holder, e.ExpiresAt.Format(time.RFC3339))
+}
+
+func validateJobLease(job, holder string, ttl time.Duration) error {
+	if job == "" {
+		return ValidationError{"job name", job, "must not be empty"}
+	}
+	if holder == "" {
+		return ValidationError{"holder", holder, "must not be empty"}
+	}
+	if ttl <= 0 {
+		return ValidationError{"ttl", ttl.String(), "must be positive"}
+	}
+	return nil
+}
+
+// AcquireJobLease acquires the named job's lease for the holder, for the
+// given time.  The lease is granted if nobody holds it, if its previous holder
+// let it expire, or if the holder already has it, in which case it is renewed.
+// Otherwise, JobLeaseHeldError is returned.  The test and the update are a
+// single statement, so of several holders racing for the same lease, exactly
+// one wins.
+func (db *ApplianceDB) AcquireJobLease(ctx context.Context, job, holder string,
+	ttl time.Duration) (*JobLease, error) {
+
+	if err := validateJobLease(job, holder, ttl); err != nil {
+		return nil, err
+	}
+
+	var lease JobLease
+	err := db.GetContext(ctx, &lease, `
+		INSERT INTO job_leases
+		    (job_name, holder, acquired_at, renewed_at, expires_at)
+		    VALUES ($1, $2, now(), now(),
+		        now() + $3::float8 * interval '1 second')
+		ON CONFLICT (job_name)
+		DO UPDATE SET
+		    holder = EXCLUDED.holder,
+		    acquired_at = CASE
+		        WHEN job_leases.holder = EXCLUDED.holder
+		        THEN job_leases.acquired_at
+		        ELSE EXCLUDED.acquired_at
+		    END,
+		    renewed_at = EXCLUDED.renewed_at,
+		    expires_at = EXCLUDED.expires_at
+		WHERE job_leases.expires_at <= now()
+		    OR job_leases.holder = EXCLUDED.holder
+		RETURNING job_name, holder, acquired_at, renewed_at, expires_at,
+		    false AS stale`,
+		job, holder, ttl.Seconds())
+	if err == sql.ErrNoRows {
+		return nil, db.jobLeaseHeld(ctx, job)
+	} else if err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// Work out who holds the lease we failed to acquire.  If it was released in
+// the meantime, we still report the failure; the caller may try again.
+func (db *ApplianceDB) jobLeaseHeld(ctx context.Context, job string) error {
+	var lease JobLease
+	err := db.GetContext(ctx, &lease, `
+		SELECT job_name, holder, expires_at
+		FROM job_leases
+		WHERE job_name = $1`, job)
+	if err == sql.ErrNoRows {
+		return JobLeaseHeldError{JobName: job}
+	} else if err != nil {
+		return err
+	}
+	return JobLeaseHeldError{
+		JobName:   lease.JobName,
+		Holder:    lease.Holder,
+		ExpiresAt: lease.ExpiresAt,
+	}
+}
+
+// RenewJobLease extends the holder's lease on the named job, so that it
+// expires the given time from now.  NotFoundError is returned if the holder
+// doesn't have the lease, including if it let the lease expire: another holder
+// may already have taken it, and the job should stop.
+func (db *ApplianceDB) RenewJobLease(ctx context.Context, job, holder string,
+	ttl time.Duration) (*JobLease, error) {
+
+	if err := validateJobLease(job, holder, ttl); err != nil {
+		return nil, err
+	}
+
+	var lease JobLease
+	err := db.GetContext(ctx, &lease, `
+		UPDATE job_leases
+		SET
+		    renewed_at = now(),
+		    expires_at = now() + $3::float8 * interval '1 second'
+		WHERE job_name = $1 AND holder = $2 AND expires_at > now()
+		RETURNING job_name, holder, acquired_at, renewed_at, expires_at,
+		    false AS stale`,
+		job, holder, ttl.Seconds())
+	if err == sql.ErrNoRows {
+		return nil, NotFoundError{fmt.Sprintf(
+			"%s doesn't hold the lease for job %s", holder, job)}
+	} else if err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// ReleaseJobLease gives up the holder's lease on the named job, so that
+// another holder may acquire it right away.  Releasing a lease the holder
+// doesn't have is not an error.
+func (db *ApplianceDB) ReleaseJobLease(ctx context.Context, job,
+	holder string) error {
+
+	_, err := db.ExecContext(ctx, `
+		DELETE FROM job_leases
+		WHERE job_name = $1 AND holder = $2`, job, holder)
+	return err
+}
+
+// JobLeaseStatus returns the most recent lease on each job, ordered by job
+// name.  Leases which have expired without being released are marked Stale;
+// their holders have probably crashed.
+func (db *ApplianceDB) JobLeaseStatus(ctx context.Context) ([]JobLease, error) {
+	leases := make([]JobLease, 0)
+	err := db.SelectContext(ctx, &leases, `
+		SELECT
+		    job_name, holder, acquired_at, renewed_at, expires_at,
+		    expires_at <= now() AS stale
+		FROM job_leases
+		ORDER BY job_name`)
+	if err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
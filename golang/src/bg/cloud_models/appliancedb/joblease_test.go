@@ -0,0 +1,173 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.uber.org/zap"
+)
+
+func testJobLeases(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	_, err := ds.AcquireJobLease(ctx, "", "a", time.Minute)
+	assert.IsType(ValidationError{}, err)
+	_, err = ds.AcquireJobLease(ctx, "job", "", time.Minute)
+	assert.IsType(ValidationError{}, err)
+	_, err = ds.AcquireJobLease(ctx, "job", "a", 0)
+	assert.IsType(ValidationError{}, err)
+	_, err = ds.RenewJobLease(ctx, "job", "a", -time.Minute)
+	assert.IsType(ValidationError{}, err)
+
+	status, err := ds.JobLeaseStatus(ctx)
+	assert.NoError(err)
+	assert.Len(status, 0)
+
+	// Renewing a lease nobody holds fails
+	_, err = ds.RenewJobLease(ctx, "job", "a", time.Minute)
+	assert.IsType(NotFoundError{}, err)
+
+	lease, err := ds.AcquireJobLease(ctx, "job", "a", time.Minute)
+	assert.NoError(err)
+	assert.Equal("job", lease.JobName)
+	assert.Equal("a", lease.Holder)
+	assert.WithinDuration(lease.AcquiredAt.Add(time.Minute),
+		lease.ExpiresAt, time.Second)
+	acquired := lease.AcquiredAt
+
+	// Another holder can't take it, or renew it
+	_, err = ds.AcquireJobLease(ctx, "job", "b", time.Minute)
+	assert.IsType(JobLeaseHeldError{}, err)
+	held := err.(JobLeaseHeldError)
+	assert.Equal("a", held.Holder)
+	assert.True(held.ExpiresAt.Equal(lease.ExpiresAt))
+	_, err = ds.RenewJobLease(ctx, "job", "b", time.Minute)
+	assert.IsType(NotFoundError{}, err)
+
+	// Renewal extends the lease, as does acquiring it again, but neither
+	// changes when it was acquired.
+	lease, err = ds.RenewJobLease(ctx, "job", "a", time.Hour)
+	assert.NoError(err)
+	assert.Equal("a", lease.Holder)
+	assert.True(lease.AcquiredAt.Equal(acquired))
+	assert.WithinDuration(lease.RenewedAt.Add(time.Hour),
+		lease.ExpiresAt, time.Second)
+	assert.True(lease.ExpiresAt.After(acquired.Add(time.Minute)))
+	lease, err = ds.AcquireJobLease(ctx, "job", "a", 2*time.Hour)
+	assert.NoError(err)
+	assert.True(lease.AcquiredAt.Equal(acquired))
+	assert.WithinDuration(lease.RenewedAt.Add(2*time.Hour),
+		lease.ExpiresAt, time.Second)
+
+	status, err = ds.JobLeaseStatus(ctx)
+	assert.NoError(err)
+	assert.Len(status, 1)
+	assert.Equal("a", status[0].Holder)
+	assert.False(status[0].Stale)
+
+	// Let the lease expire, as if its holder had crashed
+	_, err = ds.(*ApplianceDB).ExecContext(ctx, `
+		UPDATE job_leases
+		SET
+		    renewed_at = now() - interval '2 hours',
+		    expires_at = now() - interval '1 hour'
+		WHERE job_name = 'job'`)
+	assert.NoError(err)
+	status, err = ds.JobLeaseStatus(ctx)
+	assert.NoError(err)
+	assert.Len(status, 1)
+	assert.Equal("a", status[0].Holder)
+	assert.True(status[0].Stale)
+
+	// The old holder can't renew a stale lease, but anyone can take it
+	_, err = ds.RenewJobLease(ctx, "job", "a", time.Minute)
+	assert.IsType(NotFoundError{}, err)
+	lease, err = ds.AcquireJobLease(ctx, "job", "b", time.Minute)
+	assert.NoError(err)
+	assert.Equal("b", lease.Holder)
+	assert.True(lease.AcquiredAt.After(acquired))
+	status, err = ds.JobLeaseStatus(ctx)
+	assert.NoError(err)
+	assert.Len(status, 1)
+	assert.Equal("b", status[0].Holder)
+	assert.False(status[0].Stale)
+
+	// Releasing someone else's lease does nothing
+	assert.NoError(ds.ReleaseJobLease(ctx, "job", "a"))
+	_, err = ds.AcquireJobLease(ctx, "job", "a", time.Minute)
+	assert.IsType(JobLeaseHeldError{}, err)
+
+	// Once released, the lease is free for the taking
+	assert.NoError(ds.ReleaseJobLease(ctx, "job", "b"))
+	status, err = ds.JobLeaseStatus(ctx)
+	assert.NoError(err)
+	assert.Len(status, 0)
+	lease, err = ds.AcquireJobLease(ctx, "job", "a", time.Minute)
+	assert.NoError(err)
+	assert.Equal("a", lease.Holder)
+
+	// Leases on different jobs are independent
+	_, err = ds.AcquireJobLease(ctx, "other", "b", time.Minute)
+	assert.NoError(err)
+	status, err = ds.JobLeaseStatus(ctx)
+	assert.NoError(err)
+	assert.Len(status, 2)
+	assert.Equal("job", status[0].JobName)
+	assert.Equal("other", status[1].JobName)
+}
+
+func testJobLeaseContention(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	// Race several holders for each of several leases; exactly one must
+	// win each, and the others must be told who did.
+	const holders = 8
+	for i := 0; i < 5; i++ {
+		job := fmt.Sprintf("race%d", i)
+		start := make(chan struct{})
+		errs := make([]error, holders)
+		var wg sync.WaitGroup
+		for h := 0; h < holders; h++ {
+			wg.Add(1)
+			go func(h int) {
+				defer wg.Done()
+				<-start
+				_, errs[h] = ds.AcquireJobLease(ctx, job,
+					fmt.Sprintf("holder%d", h), time.Minute)
+			}(h)
+		}
+		close(start)
+		wg.Wait()
+
+		winner := ""
+		for h, err := range errs {
+			if err == nil {
+				assert.Empty(winner, "two holders won %s", job)
+				winner = fmt.Sprintf("holder%d", h)
+			}
+		}
+		assert.NotEmpty(winner, "nobody won %s", job)
+		for _, err := range errs {
+			if err != nil {
+				assert.IsType(JobLeaseHeldError{}, err)
+				assert.Equal(winner, err.(JobLeaseHeldError).Holder)
+			}
+		}
+	}
+}
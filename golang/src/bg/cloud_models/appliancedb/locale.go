@@ -0,0 +1,103 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// DefaultLocale is the locale of accounts which haven't chosen one, and the
+// locale in which every notification template must exist.
+const DefaultLocale = "en-US"
+
+// SupportedLocales are the BCP 47 tags which may be chosen as an account's
+// locale, in canonical form.
+var SupportedLocales = []string{
+	"de-DE",
+	"en-GB",
+	"en-US",
+	"es-ES",
+	"es-MX",
+	"fr-CA",
+	"fr-FR",
+	"ja-JP",
+}
+
+// canonicalLocale returns the canonical form of a BCP 47 tag, e.g., "en-US"
+// for "en_us".
+func canonicalLocale(field, locale string) (string, error) {
+	trimmed := strings.Replace(strings.TrimSpace(locale), "_", "-", -1)
+	tag, err := language.Parse(trimmed)
+	if err != nil {
+		return "", ValidationError{field, locale, "not a BCP 47 tag"}
+	}
+	return tag.String(), nil
+}
+
+// localeLanguage returns the base language of a canonical locale, e.g., "de"
+// for "de-DE".
+func localeLanguage(locale string) string {
+	return strings.SplitN(locale, "-", 2)[0]
+}
+
+// NormalizeLocale returns the canonical form of a supported locale.  The empty
+// string is taken to mean DefaultLocale; anything which isn't one of the
+// SupportedLocales results in a ValidationError.
+func NormalizeLocale(locale string) (string, error) {
+	if strings.TrimSpace(locale) == "" {
+		return DefaultLocale, nil
+	}
+	norm, err := canonicalLocale("locale", locale)
+	if err != nil {
+		return "", err
+	}
+	for _, l := range SupportedLocales {
+		if l == norm {
+			return norm, nil
+		}
+	}
+	return "", ValidationError{"locale", locale, "unsupported locale"}
+}
+
+// normalizeTemplateLocale returns the canonical form of a notification
+// template's locale, which may be either a supported locale, or the bare
+// language of one, so that a single translation can serve, e.g., both "fr-CA"
+// and "fr-FR".
+func normalizeTemplateLocale(locale string) (string, error) {
+	norm, err := canonicalLocale("locale", locale)
+	if err != nil {
+		return "", err
+	}
+	for _, l := range SupportedLocales {
+		if l == norm || localeLanguage(l) == norm {
+			return norm, nil
+		}
+	}
+	return "", ValidationError{"locale", locale, "unsupported locale"}
+}
+
+// localeFallbacks returns the locales in which to look for a notification
+// template for the given locale, in order of preference: the locale itself,
+// then its base language, then DefaultLocale.  Unsupported locales go straight
+// to DefaultLocale.
+func localeFallbacks(locale string) []string {
+	norm, err := NormalizeLocale(locale)
+	if err != nil {
+		return []string{DefaultLocale}
+	}
+
+	chain := []string{norm, localeLanguage(norm)}
+	if norm != DefaultLocale {
+		chain = append(chain, DefaultLocale)
+	}
+	return chain
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.uber.org/zap"
+)
+
+func TestNormalizeLocale(t *testing.T) {
+	assert := require.New(t)
+
+	testCases := []struct {
+		in       string
+		expected string
+		valid    bool
+	}{
+		{"en-US", "en-US", true},
+		{"de-DE", "de-DE", true},
+		{"en-us", "en-US", true},
+		{" fr_ca ", "fr-CA", true},
+		{"JA-jp", "ja-JP", true},
+		{"", DefaultLocale, true},
+		{"  ", DefaultLocale, true},
+		{"de", "", false},
+		{"pt-BR", "", false},
+		{"english", "", false},
+		{"en-US-x-", "", false},
+	}
+	for _, tc := range testCases {
+		norm, err := NormalizeLocale(tc.in)
+		if tc.valid {
+			assert.NoError(err, "%q", tc.in)
+			assert.Equal(tc.expected, norm, "%q", tc.in)
+		} else {
+			assert.IsType(ValidationError{}, err, "%q", tc.in)
+			assert.Equal("locale", err.(ValidationError).Field)
+			assert.Equal(tc.in, err.(ValidationError).Value)
+		}
+	}
+}
+
+func TestLocaleFallbacks(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Equal([]string{"de-DE", "de", "en-US"}, localeFallbacks("de-DE"))
+	assert.Equal([]string{"en-GB", "en", "en-US"}, localeFallbacks("en_gb"))
+	assert.Equal([]string{"en-US", "en"}, localeFallbacks("en-US"))
+	assert.Equal([]string{"en-US", "en"}, localeFallbacks(""))
+	assert.Equal([]string{"en-US"}, localeFallbacks("pt-BR"))
+}
+
+// Test the locale stored with accounts.  subtest of TestDatabaseModel
+func testAccountLocale(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, nil, nil)
+	person := testPerson1
+	err := ds.InsertPerson(ctx, &person)
+	assert.NoError(err)
+
+	// Accounts which don't choose a locale get the default
+	acct := testAccount1
+	acct.Locale = ""
+	err = ds.InsertAccount(ctx, &acct)
+	assert.NoError(err)
+	assert.Equal(DefaultLocale, acct.Locale)
+	stored, err := ds.AccountByUUID(ctx, acct.UUID)
+	assert.NoError(err)
+	assert.Equal(DefaultLocale, stored.Locale)
+
+	// Locales are normalized on the way in
+	stored.Locale = "de_de"
+	err = ds.UpdateAccount(ctx, stored)
+	assert.NoError(err)
+	assert.Equal("de-DE", stored.Locale)
+	stored, err = ds.AccountByUUID(ctx, acct.UUID)
+	assert.NoError(err)
+	assert.Equal("de-DE", stored.Locale)
+	info, err := ds.AccountInfoByUUID(ctx, acct.UUID)
+	assert.NoError(err)
+	assert.Equal("de-DE", info.Locale)
+
+	// Unsupported locales are rejected, and nothing is changed
+	bad := *stored
+	bad.Locale = "tlh"
+	err = ds.UpdateAccount(ctx, &bad)
+	assert.IsType(ValidationError{}, err)
+	stored, err = ds.AccountByUUID(ctx, acct.UUID)
+	assert.NoError(err)
+	assert.Equal("de-DE", stored.Locale)
+}
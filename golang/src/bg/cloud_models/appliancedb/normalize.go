@@ -0,0 +1,215 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"strings"
+	"unicode"
+
+	"github.com/satori/uuid"
+	"github.com/ttacon/libphonenumber"
+)
+
+// DefaultPhoneRegion is the region used to interpret phone numbers which lack
+// a country code, unless overridden with AccountSetPhoneRegion.
+const DefaultPhoneRegion = "US"
+
+// NormalizeEmail returns the canonical, lowercased form of an email address.
+// The empty string is left alone, since not every identity provider supplies
+// an address; anything else which doesn't look like an address results in a
+// ValidationError.
+func NormalizeEmail(email string) (string, error) {
+	return normalizeEmailField("email", email)
+}
+
+func normalizeEmailField(field, email string) (string, error) {
+	norm := strings.ToLower(strings.TrimSpace(email))
+	if norm == "" {
+		return "", nil
+	}
+
+	at := strings.LastIndex(norm, "@")
+	if at <= 0 || at == len(norm)-1 {
+		return "", ValidationError{field, email, "not an email address"}
+	}
+	if strings.IndexFunc(norm, unicode.IsSpace) >= 0 {
+		return "", ValidationError{field, email, "contains whitespace"}
+	}
+	return norm, nil
+}
+
+// NormalizePhoneNumber returns the E.164 form of a phone number.  Numbers
+// without a country code are interpreted as belonging to the given region.  The
+// empty string is left alone; anything else which isn't a valid phone number
+// results in a ValidationError.
+func NormalizePhoneNumber(phone, region string) (string, error) {
+	trimmed := strings.TrimSpace(phone)
+	if trimmed == "" {
+		return "", nil
+	}
+	if region == "" {
+		region = DefaultPhoneRegion
+	}
+
+	num, err := libphonenumber.Parse(trimmed, region)
+	if err != nil {
+		return "", ValidationError{"phone_number", phone, err.Error()}
+	}
+	if !libphonenumber.IsValidNumber(num) {
+		return "", ValidationError{"phone_number", phone,
+			"not a valid number in region " + region}
+	}
+	return libphonenumber.Format(num, libphonenumber.E164), nil
+}
+
+// AccountSetPhoneRegion sets the region used to interpret account phone numbers
+// which lack a country code.
+func (db *ApplianceDB) AccountSetPhoneRegion(region string) {
+	db.phoneRegion = strings.ToUpper(region)
+}
+
+// normalizeAccount normalizes the account's fields in place.  If 'stored' is
+// not nil, fields whose values match the stored account are left alone, so
+// that a legacy value which can't be normalized doesn't prevent updates to the
+// account's other fields.
+func (db *ApplianceDB) normalizeAccount(account, stored *Account) error {
+	var err error
+
+	email, phone, locale := account.Email, account.PhoneNumber, account.Locale
+	if stored == nil || email != stored.Email {
+		if email, err = NormalizeEmail(email); err != nil {
+			return err
+		}
+	}
+	if stored == nil || phone != stored.PhoneNumber {
+		phone, err = NormalizePhoneNumber(phone, db.phoneRegion)
+		if err != nil {
+			return err
+		}
+	}
+	if stored == nil || locale != stored.Locale {
+		if locale, err = NormalizeLocale(locale); err != nil {
+			return err
+		}
+	}
+	account.Email = email
+	account.PhoneNumber = phone
+	account.Locale = locale
+	return nil
+}
+
+// NormalizeRow describes a stored value examined by NormalizeExistingAccounts.
+// For values which couldn't be normalized, Err is set and New is empty.
+type NormalizeRow struct {
+	Table string
+	UUID  uuid.UUID
+	Field string
+	Old   string
+	New   string
+	Err   error
+}
+
+// NormalizeReport describes the outcome of NormalizeExistingAccounts
+type NormalizeReport struct {
+	Changed     []NormalizeRow
+	Unparseable []NormalizeRow
+}
+
+// normalize runs a value through a normalization function, recording the
+// outcome in the report.  It returns the value which should be stored; values
+// which can't be normalized are stored unchanged.
+func (r *NormalizeReport) normalize(table string, id uuid.UUID, field, old string,
+	norm func(string) (string, error)) string {
+
+	row := NormalizeRow{
+		Table: table,
+		UUID:  id,
+		Field: field,
+		Old:   old,
+	}
+	value, err := norm(old)
+	if err != nil {
+		row.Err = err
+		r.Unparseable = append(r.Unparseable, row)
+		return old
+	}
+	if value != old {
+		row.New = value
+		r.Changed = append(r.Changed, row)
+	}
+	return value
+}
+
+// NormalizeExistingAccounts rewrites the email addresses and phone numbers of
+// existing accounts and persons into their normalized forms.  It is meant to
+// be run once, to clean up rows stored before normalization was introduced.
+// Values which can't be normalized are left as they are and listed in the
+// report's Unparseable rows, so that they can be fixed by hand.
+func (db *ApplianceDB) NormalizeExistingAccounts(ctx context.Context) (*NormalizeReport, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var accts []Account
+	err = tx.SelectContext(ctx, &accts, `SELECT * FROM account ORDER BY uuid`)
+	if err != nil {
+		return nil, err
+	}
+	var persons []Person
+	err = tx.SelectContext(ctx, &persons, `SELECT * FROM person ORDER BY uuid`)
+	if err != nil {
+		return nil, err
+	}
+
+	phoneNorm := func(phone string) (string, error) {
+		return NormalizePhoneNumber(phone, db.phoneRegion)
+	}
+	primaryEmailNorm := func(email string) (string, error) {
+		return normalizeEmailField("primary_email", email)
+	}
+
+	report := &NormalizeReport{}
+	for _, acct := range accts {
+		email := report.normalize("account", acct.UUID, "email",
+			acct.Email, NormalizeEmail)
+		phone := report.normalize("account", acct.UUID, "phone_number",
+			acct.PhoneNumber, phoneNorm)
+		if email == acct.Email && phone == acct.PhoneNumber {
+			continue
+		}
+		_, err = tx.ExecContext(ctx,
+			`UPDATE account SET email=$1, phone_number=$2 WHERE uuid=$3`,
+			email, phone, acct.UUID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, person := range persons {
+		email := report.normalize("person", person.UUID, "primary_email",
+			person.PrimaryEmail, primaryEmailNorm)
+		if email == person.PrimaryEmail {
+			continue
+		}
+		_, err = tx.ExecContext(ctx,
+			`UPDATE person SET primary_email=$1 WHERE uuid=$2`,
+			email, person.UUID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
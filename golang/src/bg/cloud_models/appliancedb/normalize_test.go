@@ -0,0 +1,237 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.uber.org/zap"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	assert := require.New(t)
+
+	testCases := []struct {
+		in       string
+		expected string
+		valid    bool
+	}{
+		{"foo@foo.net", "foo@foo.net", true},
+		{"Foo@Foo.NET", "foo@foo.net", true},
+		{"  foo@foo.net\t\n", "foo@foo.net", true},
+		{"first.last+tag@sub.example.com", "first.last+tag@sub.example.com", true},
+		{"", "", true},
+		{"   ", "", true},
+		{"foo", "", false},
+		{"foo@", "", false},
+		{"@foo.net", "", false},
+		{"foo bar@foo.net", "", false},
+	}
+	for _, tc := range testCases {
+		norm, err := NormalizeEmail(tc.in)
+		if tc.valid {
+			assert.NoError(err, "%q", tc.in)
+			assert.Equal(tc.expected, norm, "%q", tc.in)
+		} else {
+			assert.IsType(ValidationError{}, err, "%q", tc.in)
+			assert.Equal("email", err.(ValidationError).Field)
+			assert.Equal(tc.in, err.(ValidationError).Value)
+		}
+	}
+}
+
+func TestNormalizePhoneNumber(t *testing.T) {
+	assert := require.New(t)
+
+	testCases := []struct {
+		in       string
+		region   string
+		expected string
+		valid    bool
+	}{
+		{"+16505551212", "US", "+16505551212", true},
+		{"+1 (650) 555 1212", "US", "+16505551212", true},
+		{"650-555-1212", "US", "+16505551212", true},
+		{"(650) 555-1212", "", "+16505551212", true},
+		{"650.555.1212", "US", "+16505551212", true},
+		{"1-650-555-1212", "US", "+16505551212", true},
+		{"6505551212", "US", "+16505551212", true},
+		{" 650 555 1212 ", "US", "+16505551212", true},
+		{"(650) 555-1212 x4321", "US", "+16505551212", true},
+		{"+44 20 7946 0958", "US", "+442079460958", true},
+		{"020 7946 0958", "GB", "+442079460958", true},
+		{"", "US", "", true},
+		// Too short to be a US number
+		{"555-1212", "US", "", false},
+		{"x4321", "US", "", false},
+		{"not a number", "US", "", false},
+		// A national number only makes sense in its own region
+		{"020 7946 0958", "US", "", false},
+	}
+	for _, tc := range testCases {
+		norm, err := NormalizePhoneNumber(tc.in, tc.region)
+		if tc.valid {
+			assert.NoError(err, "%q", tc.in)
+			assert.Equal(tc.expected, norm, "%q", tc.in)
+		} else {
+			assert.IsType(ValidationError{}, err, "%q", tc.in)
+			assert.Equal("phone_number", err.(ValidationError).Field)
+		}
+	}
+}
+
+func testAccountNormalization(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, nil, nil)
+	mkOrgSiteApp(t, ds, &testOrg2, nil, nil)
+
+	person := testPerson1
+	person.PrimaryEmail = " Foo@Foo.NET"
+	err := ds.InsertPerson(ctx, &person)
+	assert.NoError(err)
+	assert.Equal("foo@foo.net", person.PrimaryEmail)
+
+	// Values are normalized on the way in, and the caller's copy updated
+	acct := testAccount1
+	acct.Email = "Foo@Foo.NET "
+	acct.PhoneNumber = "(650) 555-1212"
+	err = ds.InsertAccount(ctx, &acct)
+	assert.NoError(err)
+	assert.Equal("foo@foo.net", acct.Email)
+	assert.Equal("+16505551212", acct.PhoneNumber)
+
+	stored, err := ds.AccountByUUID(ctx, acct.UUID)
+	assert.NoError(err)
+	assert.Equal("foo@foo.net", stored.Email)
+	assert.Equal("+16505551212", stored.PhoneNumber)
+
+	// Unparseable values are rejected, and nothing is changed
+	bad := *stored
+	bad.PhoneNumber = "555-1212"
+	err = ds.UpdateAccount(ctx, &bad)
+	assert.IsType(ValidationError{}, err)
+	bad = *stored
+	bad.Email = "foo at foo.net"
+	err = ds.UpdateAccount(ctx, &bad)
+	assert.IsType(ValidationError{}, err)
+	stored, err = ds.AccountByUUID(ctx, acct.UUID)
+	assert.NoError(err)
+	assert.Equal("+16505551212", stored.PhoneNumber)
+
+	// Numbers without a country code are interpreted in the configured
+	// region.
+	ds.AccountSetPhoneRegion("gb")
+	defer ds.AccountSetPhoneRegion("")
+	stored.PhoneNumber = "020 7946 0958"
+	err = ds.UpdateAccount(ctx, stored)
+	assert.NoError(err)
+	assert.Equal("+442079460958", stored.PhoneNumber)
+
+	// A stored value which predates normalization doesn't block updates to
+	// the account's other fields, and is left as it is.
+	adb := ds.(*ApplianceDB)
+	_, err = adb.ExecContext(ctx,
+		`UPDATE account SET phone_number=$1 WHERE uuid=$2`,
+		"x4321", acct.UUID)
+	assert.NoError(err)
+	stored, err = ds.AccountByUUID(ctx, acct.UUID)
+	assert.NoError(err)
+	stored.AvatarHash = []byte{0xfe, 0xed}
+	err = ds.UpdateAccount(ctx, stored)
+	assert.NoError(err)
+	stored, err = ds.AccountByUUID(ctx, acct.UUID)
+	assert.NoError(err)
+	assert.Equal([]byte{0xfe, 0xed}, stored.AvatarHash)
+	assert.Equal("x4321", stored.PhoneNumber)
+
+	// Changing it still requires a valid value
+	bad = *stored
+	bad.PhoneNumber = "x1234"
+	err = ds.UpdateAccount(ctx, &bad)
+	assert.IsType(ValidationError{}, err)
+
+	// Email lookups are normalized, and scoped to the organization
+	found, err := ds.AccountByEmail(ctx, testOrg1.UUID, "  FOO@foo.net")
+	assert.NoError(err)
+	assert.Equal(acct.UUID, found.UUID)
+	_, err = ds.AccountByEmail(ctx, testOrg2.UUID, "foo@foo.net")
+	assert.IsType(NotFoundError{}, err)
+	_, err = ds.AccountByEmail(ctx, testOrg1.UUID, "bar@foo.net")
+	assert.IsType(NotFoundError{}, err)
+	_, err = ds.AccountByEmail(ctx, testOrg1.UUID, "")
+	assert.IsType(NotFoundError{}, err)
+	_, err = ds.AccountByEmail(ctx, testOrg1.UUID, "foo")
+	assert.IsType(ValidationError{}, err)
+}
+
+func testNormalizeExistingAccounts(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, nil, nil)
+	_ = mkAccount(t, ds, &testPerson1, &testAccount1, []string{"user"})
+	_ = mkAccount(t, ds, &testPerson2, &testAccount2, []string{"user"})
+
+	// Simulate rows stored before normalization was introduced
+	adb := ds.(*ApplianceDB)
+	_, err := adb.ExecContext(ctx,
+		`UPDATE account SET email=$1, phone_number=$2 WHERE uuid=$3`,
+		" Foo@Foo.NET", "+1 (650) 555 1212", testAccount1.UUID)
+	assert.NoError(err)
+	_, err = adb.ExecContext(ctx,
+		`UPDATE account SET email=$1, phone_number=$2 WHERE uuid=$3`,
+		"Bar@Bar.net", "x4321", testAccount2.UUID)
+	assert.NoError(err)
+	_, err = adb.ExecContext(ctx,
+		`UPDATE person SET primary_email=$1 WHERE uuid=$2`,
+		"FOO@foo.net", testPerson1.UUID)
+	assert.NoError(err)
+
+	report, err := ds.NormalizeExistingAccounts(ctx)
+	assert.NoError(err)
+	assert.Len(report.Changed, 4)
+	assert.Len(report.Unparseable, 1)
+
+	// The unparseable phone number is flagged and left alone, but the rest
+	// of the row is still cleaned up.
+	bad := report.Unparseable[0]
+	assert.Equal("account", bad.Table)
+	assert.Equal(testAccount2.UUID, bad.UUID)
+	assert.Equal("phone_number", bad.Field)
+	assert.Equal("x4321", bad.Old)
+	assert.IsType(ValidationError{}, bad.Err)
+
+	acct, err := ds.AccountByUUID(ctx, testAccount1.UUID)
+	assert.NoError(err)
+	assert.Equal("foo@foo.net", acct.Email)
+	assert.Equal("+16505551212", acct.PhoneNumber)
+	acct, err = ds.AccountByUUID(ctx, testAccount2.UUID)
+	assert.NoError(err)
+	assert.Equal("bar@bar.net", acct.Email)
+	assert.Equal("x4321", acct.PhoneNumber)
+	person, err := ds.PersonByUUID(ctx, testPerson1.UUID)
+	assert.NoError(err)
+	assert.Equal("foo@foo.net", person.PrimaryEmail)
+
+	found, err := ds.AccountByEmail(ctx, testOrg1.UUID, "BAR@bar.net")
+	assert.NoError(err)
+	assert.Equal(testAccount2.UUID, found.UUID)
+
+	// A second run has nothing left to change
+	report, err = ds.NormalizeExistingAccounts(ctx)
+	assert.NoError(err)
+	assert.Len(report.Changed, 0)
+	assert.Len(report.Unparseable, 1)
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/guregu/null"
+	"github.com/satori/uuid"
+)
+
+// Limits on the size of the free-form fields of a note, in characters
+const (
+	MaxNoteLength       = 4000
+	MaxNoteTicketRef    = 128
+	MaxNoteAuthorLength = 128
+)
+
+type noteManager interface {
+	AddNote(context.Context, *Note) error
+	ListNotes(context.Context, NoteSubject, bool) ([]Note, error)
+	DeleteNote(context.Context, NoteSubject, int64, string) error
+	ApplianceNoteCounts(context.Context) (map[uuid.UUID]int, error)
+	SiteNoteCounts(context.Context) (map[uuid.UUID]int, error)
+}
+
+// NoteSubject identifies what a note is about: either an appliance or a site,
+// but never both.
+type NoteSubject struct {
+	ApplianceUUID uuid.NullUUID `json:"appliance_uuid" db:"appliance_uuid"`
+	SiteUUID      uuid.NullUUID `json:"site_uuid" db:"site_uuid"`
+}
+
+// ApplianceNoteSubject returns the subject for notes about an appliance
+func ApplianceNoteSubject(u uuid.UUID) NoteSubject {
+	return NoteSubject{ApplianceUUID: uuid.NullUUID{UUID: u, Valid: true}}
+}
+
+// SiteNoteSubject returns the subject for notes about a site
+func SiteNoteSubject(u uuid.UUID) NoteSubject {
+	return NoteSubject{SiteUUID: uuid.NullUUID{UUID: u, Valid: true}}
+}
+
+func (s NoteSubject) String() string {
+	if s.ApplianceUUID.Valid {
+		return "appliance " + s.ApplianceUUID.UUID.String()
+	}
+	return "site " + s.SiteUUID.UUID.String()
+}
+
+// Returns the column identifying the subject, and its value
+func (s NoteSubject) column() (string, uuid.UUID, error) {
+	if s.ApplianceUUID.Valid == s.SiteUUID.Valid {
+		return "", uuid.Nil, fmt.Errorf(
+			"note subject must be exactly one of appliance or site")
+	}
+	if s.ApplianceUUID.Valid {
+		return "appliance_uuid", s.ApplianceUUID.UUID, nil
+	}
+	return "site_uuid", s.SiteUUID.UUID, nil
+}
+
+// Note represents a row in the appliance_notes table: a free-form annotation
+// about an appliance or a site, optionally referring to a ticket in an external
+// support system.  Deleted notes are kept as tombstones, with DeletedAt and
+// DeletedBy filled in.
+type Note struct {
+	ID int64 `json:"id" db:"id"`
+	NoteSubject
+	Author    string      `json:"author" db:"author"`
+	CreatedAt time.Time   `json:"created_at" db:"created_at"`
+	Text      string      `json:"text" db:"text"`
+	TicketRef null.String `json:"ticket_ref" db:"ticket_ref"`
+	DeletedAt null.Time   `json:"deleted_at" db:"deleted_at"`
+	DeletedBy null.String `json:"deleted_by" db:"deleted_by"`
+}
+
+func checkNoteField(field, value string, max int) error {
+	if value == "" {
+		return ValidationError{field, value, "must not be empty"}
+	}
+	if n := utf8.RuneCountInString(value); n > max {
+		return ValidationError{field, value,
+			fmt.Sprintf("%d characters exceeds limit of %d", n, max)}
+	}
+	return nil
+}
+
+// AddNote records a new note.  Leading and trailing whitespace is removed from
+// the text, author, and ticket reference before they are checked against the
+// length limits; ValidationError is returned if any is out of bounds.  An empty
+// ticket reference is treated as absent.  The note's ID and CreatedAt fields
+// are filled in.
+func (db *ApplianceDB) AddNote(ctx context.Context, note *Note) error {
+	if _, _, err := note.NoteSubject.column(); err != nil {
+		return err
+	}
+
+	note.Text = strings.TrimSpace(note.Text)
+	note.Author = strings.TrimSpace(note.Author)
+	if err := checkNoteField("text", note.Text, MaxNoteLength); err != nil {
+		return err
+	}
+	if err := checkNoteField("author", note.Author,
+		MaxNoteAuthorLength); err != nil {
+		return err
+	}
+	ref := strings.TrimSpace(note.TicketRef.String)
+	note.TicketRef = null.NewString(ref, ref != "")
+	if note.TicketRef.Valid {
+		if err := checkNoteField("ticket_ref", ref,
+			MaxNoteTicketRef); err != nil {
+			return err
+		}
+	}
+
+	row := db.QueryRowContext(ctx, `
+		INSERT INTO appliance_notes
+		    (appliance_uuid, site_uuid, author, text, ticket_ref)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`,
+		note.ApplianceUUID, note.SiteUUID, note.Author, note.Text,
+		note.TicketRef)
+	return row.Scan(&note.ID, &note.CreatedAt)
+}
+
+// ListNotes returns the notes about a subject, newest first.  Deleted notes are
+// only included if deleted is true.
+func (db *ApplianceDB) ListNotes(ctx context.Context, subject NoteSubject,
+	deleted bool) ([]Note, error) {
+
+	col, u, err := subject.column()
+	if err != nil {
+		return nil, err
+	}
+
+	notes := make([]Note, 0)
+	err = db.SelectContext(ctx, &notes, `
+		SELECT * FROM appliance_notes
+		WHERE `+col+` = $1 AND ($2 OR deleted_at IS NULL)
+		ORDER BY created_at DESC, id DESC`, u, deleted)
+	if err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+// DeleteNote marks a note about a subject as deleted by the given actor.  The
+// note itself is retained as a tombstone.  NotFoundError is returned if the
+// subject has no such note, or if it has already been deleted.
+func (db *ApplianceDB) DeleteNote(ctx context.Context, subject NoteSubject,
+	id int64, actor string) error {
+
+	col, u, err := subject.column()
+	if err != nil {
+		return err
+	}
+	actor = strings.TrimSpace(actor)
+	if err = checkNoteField("author", actor, MaxNoteAuthorLength); err != nil {
+		return err
+	}
+
+	res, err := db.ExecContext(ctx, `
+		UPDATE appliance_notes
+		SET deleted_at = now(), deleted_by = $3
+		WHERE `+col+` = $1 AND id = $2 AND deleted_at IS NULL`,
+		u, id, actor)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return NotFoundError{fmt.Sprintf(
+			"DeleteNote: Couldn't find note %d for %v", id, subject)}
+	}
+	return nil
+}
+
+func (db *ApplianceDB) noteCounts(ctx context.Context,
+	col string) (map[uuid.UUID]int, error) {
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+col+`, count(*)
+		FROM appliance_notes
+		WHERE `+col+` IS NOT NULL AND deleted_at IS NULL
+		GROUP BY `+col)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[uuid.UUID]int)
+	for rows.Next() {
+		var u uuid.UUID
+		var n int
+		if err = rows.Scan(&u, &n); err != nil {
+			return nil, err
+		}
+		counts[u] = n
+	}
+	return counts, rows.Err()
+}
+
+// ApplianceNoteCounts returns the number of notes about each appliance,
+// excluding deleted notes.  Appliances without notes are omitted.
+func (db *ApplianceDB) ApplianceNoteCounts(ctx context.Context) (map[uuid.UUID]int, error) {
+	return db.noteCounts(ctx, "appliance_uuid")
+}
+
+// SiteNoteCounts returns the number of notes about each site, excluding deleted
+// notes.  Sites without notes are omitted.
+func (db *ApplianceDB) SiteNoteCounts(ctx context.Context) (map[uuid.UUID]int, error) {
+	return db.noteCounts(ctx, "site_uuid")
+}
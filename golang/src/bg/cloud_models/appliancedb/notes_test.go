@@ -0,0 +1,213 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/guregu/null"
+	"github.com/stretchr/testify/require"
+
+	"go.uber.org/zap"
+)
+
+func testNotes(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, &testID2)
+
+	app1 := ApplianceNoteSubject(testID1.ApplianceUUID)
+	app2 := ApplianceNoteSubject(testID2.ApplianceUUID)
+	site1 := SiteNoteSubject(testSite1.UUID)
+
+	add := func(subject NoteSubject, text string) *Note {
+		note := &Note{
+			NoteSubject: subject,
+			Author:      "support@brightgate.com",
+			Text:        text,
+		}
+		err := ds.AddNote(ctx, note)
+		assert.NoError(err)
+		return note
+	}
+
+	n1 := add(app1, "RMA'd once")
+	n2 := add(app1, "flaky 5GHz radio")
+	n3 := &Note{
+		NoteSubject: app1,
+		Author:      " support@brightgate.com ",
+		Text:        "  customer prefers evening calls\n",
+		TicketRef:   null.StringFrom(" ZD-1234 "),
+	}
+	err := ds.AddNote(ctx, n3)
+	assert.NoError(err)
+	assert.Equal("customer prefers evening calls", n3.Text)
+	assert.Equal("support@brightgate.com", n3.Author)
+	assert.Equal(null.StringFrom("ZD-1234"), n3.TicketRef)
+	s1 := add(site1, "site-wide outage on 3/14")
+	add(app2, "other appliance")
+
+	// Notes are listed newest first, and only for the requested subject
+	notes, err := ds.ListNotes(ctx, app1, false)
+	assert.NoError(err)
+	assert.Len(notes, 3)
+	assert.Equal(n3.ID, notes[0].ID)
+	assert.Equal(n2.ID, notes[1].ID)
+	assert.Equal(n1.ID, notes[2].ID)
+	assert.Equal("ZD-1234", notes[0].TicketRef.String)
+	assert.False(notes[1].TicketRef.Valid)
+	assert.Equal(testID1.ApplianceUUID, notes[0].ApplianceUUID.UUID)
+	assert.False(notes[0].SiteUUID.Valid)
+
+	notes, err = ds.ListNotes(ctx, site1, false)
+	assert.NoError(err)
+	assert.Len(notes, 1)
+	assert.Equal(s1.ID, notes[0].ID)
+	assert.Equal(testSite1.UUID, notes[0].SiteUUID.UUID)
+
+	notes, err = ds.ListNotes(ctx, SiteNoteSubject(testSite2.UUID), false)
+	assert.NoError(err)
+	assert.Len(notes, 0)
+
+	appCounts, err := ds.ApplianceNoteCounts(ctx)
+	assert.NoError(err)
+	assert.Equal(3, appCounts[testID1.ApplianceUUID])
+	assert.Equal(1, appCounts[testID2.ApplianceUUID])
+	siteCounts, err := ds.SiteNoteCounts(ctx)
+	assert.NoError(err)
+	assert.Len(siteCounts, 1)
+	assert.Equal(1, siteCounts[testSite1.UUID])
+
+	// Subjects must name exactly one of an appliance or a site
+	both := app1
+	both.SiteUUID = site1.SiteUUID
+	err = ds.AddNote(ctx, &Note{NoteSubject: both, Author: "a", Text: "b"})
+	assert.Error(err)
+	_, err = ds.ListNotes(ctx, NoteSubject{}, false)
+	assert.Error(err)
+}
+
+func testNoteValidation(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	subject := ApplianceNoteSubject(testID1.ApplianceUUID)
+
+	testCases := []struct {
+		author string
+		text   string
+		ticket null.String
+		field  string
+	}{
+		{"tester", "", null.String{}, "text"},
+		{"tester", " \t\n", null.String{}, "text"},
+		{"tester", strings.Repeat("x", MaxNoteLength+1), null.String{}, "text"},
+		{"", "hello", null.String{}, "author"},
+		{strings.Repeat("a", MaxNoteAuthorLength+1), "hello", null.String{}, "author"},
+		{"tester", "hello", null.StringFrom(strings.Repeat("t", MaxNoteTicketRef+1)), "ticket_ref"},
+	}
+	for _, tc := range testCases {
+		err := ds.AddNote(ctx, &Note{
+			NoteSubject: subject,
+			Author:      tc.author,
+			Text:        tc.text,
+			TicketRef:   tc.ticket,
+		})
+		assert.IsType(ValidationError{}, err, "%s", tc.field)
+		assert.Equal(tc.field, err.(ValidationError).Field)
+	}
+
+	// The limits are in characters, not bytes
+	note := &Note{
+		NoteSubject: subject,
+		Author:      "tester",
+		Text:        strings.Repeat("é", MaxNoteLength),
+		TicketRef:   null.StringFrom("  "),
+	}
+	err := ds.AddNote(ctx, note)
+	assert.NoError(err)
+	assert.False(note.TicketRef.Valid)
+
+	notes, err := ds.ListNotes(ctx, subject, true)
+	assert.NoError(err)
+	assert.Len(notes, 1)
+}
+
+func testNoteTombstones(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	app := ApplianceNoteSubject(testID1.ApplianceUUID)
+	site := SiteNoteSubject(testSite1.UUID)
+
+	var ids []int64
+	for _, text := range []string{"one", "two", "three"} {
+		note := &Note{NoteSubject: app, Author: "tester", Text: text}
+		err := ds.AddNote(ctx, note)
+		assert.NoError(err)
+		ids = append(ids, note.ID)
+	}
+
+	// Notes can only be deleted through their own subject
+	err := ds.DeleteNote(ctx, site, ids[1], "remover")
+	assert.IsType(NotFoundError{}, err)
+	err = ds.DeleteNote(ctx, app, ids[1], "")
+	assert.IsType(ValidationError{}, err)
+
+	err = ds.DeleteNote(ctx, app, ids[1], "remover")
+	assert.NoError(err)
+
+	// Deleted notes disappear from listings and counts ...
+	notes, err := ds.ListNotes(ctx, app, false)
+	assert.NoError(err)
+	assert.Len(notes, 2)
+	assert.Equal(ids[2], notes[0].ID)
+	assert.Equal(ids[0], notes[1].ID)
+	counts, err := ds.ApplianceNoteCounts(ctx)
+	assert.NoError(err)
+	assert.Equal(2, counts[testID1.ApplianceUUID])
+
+	// ... but are retained as tombstones, in their original position
+	notes, err = ds.ListNotes(ctx, app, true)
+	assert.NoError(err)
+	assert.Len(notes, 3)
+	tomb := notes[1]
+	assert.Equal(ids[1], tomb.ID)
+	assert.Equal("two", tomb.Text)
+	assert.Equal("tester", tomb.Author)
+	assert.True(tomb.DeletedAt.Valid)
+	assert.False(tomb.DeletedAt.Time.Before(tomb.CreatedAt))
+	assert.Equal(null.StringFrom("remover"), tomb.DeletedBy)
+	assert.False(notes[0].DeletedAt.Valid)
+	assert.False(notes[0].DeletedBy.Valid)
+
+	// A tombstone can't be deleted again, and isn't disturbed by the attempt
+	err = ds.DeleteNote(ctx, app, ids[1], "someone else")
+	assert.IsType(NotFoundError{}, err)
+	notes, err = ds.ListNotes(ctx, app, true)
+	assert.NoError(err)
+	assert.Equal(null.StringFrom("remover"), notes[1].DeletedBy)
+	assert.Equal(tomb.DeletedAt.Time.Unix(), notes[1].DeletedAt.Time.Unix())
+
+	// Once every note is deleted, the appliance drops out of the counts
+	for _, id := range []int64{ids[0], ids[2]} {
+		err = ds.DeleteNote(ctx, app, id, "remover")
+		assert.NoError(err)
+	}
+	counts, err = ds.ApplianceNoteCounts(ctx)
+	assert.NoError(err)
+	assert.NotContains(counts, testID1.ApplianceUUID)
+}
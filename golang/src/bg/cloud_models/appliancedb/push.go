@@ -0,0 +1,170 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/satori/uuid"
+)
+
+type pushManager interface {
+	RegisterPushToken(context.Context, *PushToken) error
+	RefreshPushToken(context.Context, *PushToken) error
+	DisablePushToken(context.Context, *PushToken) error
+	ActivePushTokensByAccount(context.Context, uuid.UUID) ([]PushToken, error)
+	PrunePushTokens(context.Context, time.Time) (int64, error)
+
+	NotificationPrefsByAccount(context.Context, uuid.UUID) (*NotificationPrefs, error)
+	UpsertNotificationPrefs(context.Context, *NotificationPrefs) error
+}
+
+// Push notification platforms, as stored in account_push_tokens.platform
+const (
+	PushPlatformIOS     = "ios"
+	PushPlatformAndroid = "android"
+)
+
+// PushTokenMaxAge is how long a push token may go without being refreshed
+// before it is pruned.
+const PushTokenMaxAge = 90 * 24 * time.Hour
+
+// PushToken represents a row in the account_push_tokens table
+type PushToken struct {
+	AccountUUID uuid.UUID `db:"account_uuid"`
+	Platform    string    `db:"platform"`
+	Token       string    `db:"token"`
+	AppVersion  string    `db:"app_version"`
+	Created     time.Time `db:"created"`
+	LastSeen    time.Time `db:"last_seen"`
+	Disabled    bool      `db:"disabled"`
+}
+
+// NotificationPrefs represents a row in the account_notification_prefs table
+type NotificationPrefs struct {
+	AccountUUID uuid.UUID `db:"account_uuid"`
+	PushEnabled bool      `db:"push_enabled"`
+}
+
+// RegisterPushToken records a device's push token for an account.
+// Registration is idempotent: registering a token which is already known
+// refreshes it, re-enables it if it had been disabled, and moves it to the
+// given account if it was registered by another.  The token's Created and
+// LastSeen fields are filled in from the database.
+func (db *ApplianceDB) RegisterPushToken(ctx context.Context, tok *PushToken) error {
+	row := db.QueryRowContext(ctx, `
+		INSERT INTO account_push_tokens
+		    (account_uuid, platform, token, app_version)
+		    VALUES ($1, $2, $3, $4)
+		ON CONFLICT (platform, token)
+		DO UPDATE SET
+		    account_uuid = EXCLUDED.account_uuid,
+		    app_version = EXCLUDED.app_version,
+		    last_seen = now(),
+		    disabled = false
+		RETURNING created, last_seen, disabled`,
+		tok.AccountUUID, tok.Platform, tok.Token, tok.AppVersion)
+	return row.Scan(&tok.Created, &tok.LastSeen, &tok.Disabled)
+}
+
+// RefreshPushToken updates the time an account's active push token was last
+// seen.  NotFoundError is returned if the account has no such active token.
+func (db *ApplianceDB) RefreshPushToken(ctx context.Context, tok *PushToken) error {
+	row := db.QueryRowContext(ctx, `
+		UPDATE account_push_tokens
+		SET last_seen = now()
+		WHERE account_uuid = $1 AND platform = $2 AND token = $3
+		    AND NOT disabled
+		RETURNING last_seen`,
+		tok.AccountUUID, tok.Platform, tok.Token)
+	err := row.Scan(&tok.LastSeen)
+	if err == sql.ErrNoRows {
+		return NotFoundError{fmt.Sprintf(
+			"RefreshPushToken: no active %s token for %v",
+			tok.Platform, tok.AccountUUID)}
+	}
+	return err
+}
+
+// DisablePushToken stops notifications from being sent to an account's push
+// token.  NotFoundError is returned if the account has no such token.
+func (db *ApplianceDB) DisablePushToken(ctx context.Context, tok *PushToken) error {
+	res, err := db.ExecContext(ctx, `
+		UPDATE account_push_tokens
+		SET disabled = true
+		WHERE account_uuid = $1 AND platform = $2 AND token = $3`,
+		tok.AccountUUID, tok.Platform, tok.Token)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return NotFoundError{fmt.Sprintf(
+			"DisablePushToken: no %s token for %v", tok.Platform,
+			tok.AccountUUID)}
+	}
+	tok.Disabled = true
+	return nil
+}
+
+// ActivePushTokensByAccount returns the push tokens to which notifications for
+// the given account should be sent.
+func (db *ApplianceDB) ActivePushTokensByAccount(ctx context.Context, account uuid.UUID) ([]PushToken, error) {
+	var toks []PushToken
+	err := db.SelectContext(ctx, &toks, `
+		SELECT * FROM account_push_tokens
+		WHERE account_uuid = $1 AND NOT disabled
+		ORDER BY platform, token`, account)
+	if err != nil {
+		return nil, err
+	}
+	return toks, nil
+}
+
+// PrunePushTokens deletes the push tokens, active or not, which haven't been
+// seen since the given time, returning the number of tokens deleted.
+func (db *ApplianceDB) PrunePushTokens(ctx context.Context, before time.Time) (int64, error) {
+	res, err := db.ExecContext(ctx,
+		"DELETE FROM account_push_tokens WHERE last_seen < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// NotificationPrefsByAccount returns an account's notification preferences.
+// Accounts which haven't set any preferences get the defaults.
+func (db *ApplianceDB) NotificationPrefsByAccount(ctx context.Context, account uuid.UUID) (*NotificationPrefs, error) {
+	prefs := NotificationPrefs{
+		AccountUUID: account,
+		PushEnabled: true,
+	}
+	err := db.GetContext(ctx, &prefs, `
+		SELECT * FROM account_notification_prefs
+		WHERE account_uuid = $1`, account)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return &prefs, nil
+}
+
+// UpsertNotificationPrefs sets an account's notification preferences.
+func (db *ApplianceDB) UpsertNotificationPrefs(ctx context.Context, prefs *NotificationPrefs) error {
+	_, err := db.NamedExecContext(ctx, `
+		INSERT INTO account_notification_prefs
+		    (account_uuid, push_enabled)
+		    VALUES (:account_uuid, :push_enabled)
+		ON CONFLICT (account_uuid)
+		DO UPDATE SET
+		    push_enabled = EXCLUDED.push_enabled`, prefs)
+	return err
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.uber.org/zap"
+)
+
+func testPushTokens(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, nil, nil)
+	_ = mkAccount(t, ds, &testPerson1, &testAccount1, []string{"user"})
+	_ = mkAccount(t, ds, &testPerson2, &testAccount2, []string{"user"})
+
+	tok := &PushToken{
+		AccountUUID: testAccount1.UUID,
+		Platform:    PushPlatformIOS,
+		Token:       "ios-token-1",
+		AppVersion:  "1.0",
+	}
+	err := ds.RegisterPushToken(ctx, tok)
+	assert.NoError(err)
+	assert.False(tok.Created.IsZero())
+	assert.False(tok.Disabled)
+	created := tok.Created
+
+	// Registering the same token again is idempotent: it updates the app
+	// version and last_seen, but doesn't add a second token.
+	again := *tok
+	again.AppVersion = "1.1"
+	err = ds.RegisterPushToken(ctx, &again)
+	assert.NoError(err)
+	assert.Equal(created, again.Created)
+	assert.False(again.LastSeen.Before(tok.LastSeen))
+
+	toks, err := ds.ActivePushTokensByAccount(ctx, testAccount1.UUID)
+	assert.NoError(err)
+	assert.Len(toks, 1)
+	assert.Equal("1.1", toks[0].AppVersion)
+
+	// The same token on a different platform is a different token
+	android := &PushToken{
+		AccountUUID: testAccount1.UUID,
+		Platform:    PushPlatformAndroid,
+		Token:       "ios-token-1",
+	}
+	err = ds.RegisterPushToken(ctx, android)
+	assert.NoError(err)
+	toks, err = ds.ActivePushTokensByAccount(ctx, testAccount1.UUID)
+	assert.NoError(err)
+	assert.Len(toks, 2)
+
+	// Unknown platforms are rejected
+	err = ds.RegisterPushToken(ctx, &PushToken{
+		AccountUUID: testAccount1.UUID,
+		Platform:    "blackberry",
+		Token:       "bb-token",
+	})
+	assert.Error(err)
+
+	// Disabled tokens aren't active, and can't be refreshed
+	err = ds.DisablePushToken(ctx, android)
+	assert.NoError(err)
+	toks, err = ds.ActivePushTokensByAccount(ctx, testAccount1.UUID)
+	assert.NoError(err)
+	assert.Len(toks, 1)
+	assert.Equal(PushPlatformIOS, toks[0].Platform)
+	err = ds.RefreshPushToken(ctx, android)
+	assert.IsType(NotFoundError{}, err)
+
+	// Re-registering a disabled token enables it again
+	err = ds.RegisterPushToken(ctx, android)
+	assert.NoError(err)
+	assert.False(android.Disabled)
+	err = ds.RefreshPushToken(ctx, android)
+	assert.NoError(err)
+
+	// An account can only disable its own tokens
+	err = ds.DisablePushToken(ctx, &PushToken{
+		AccountUUID: testAccount2.UUID,
+		Platform:    PushPlatformIOS,
+		Token:       "ios-token-1",
+	})
+	assert.IsType(NotFoundError{}, err)
+
+	// A token registered by another account moves to that account
+	moved := &PushToken{
+		AccountUUID: testAccount2.UUID,
+		Platform:    PushPlatformIOS,
+		Token:       "ios-token-1",
+	}
+	err = ds.RegisterPushToken(ctx, moved)
+	assert.NoError(err)
+	toks, err = ds.ActivePushTokensByAccount(ctx, testAccount1.UUID)
+	assert.NoError(err)
+	assert.Len(toks, 1)
+	toks, err = ds.ActivePushTokensByAccount(ctx, testAccount2.UUID)
+	assert.NoError(err)
+	assert.Len(toks, 1)
+
+	// Tokens which haven't been seen in a while are pruned
+	_, err = ds.(*ApplianceDB).ExecContext(ctx, `
+	    UPDATE account_push_tokens SET last_seen = $1
+	    WHERE account_uuid = $2`,
+		time.Now().Add(-PushTokenMaxAge-time.Hour), testAccount1.UUID)
+	assert.NoError(err)
+	pruned, err := ds.PrunePushTokens(ctx, time.Now().Add(-PushTokenMaxAge))
+	assert.NoError(err)
+	assert.EqualValues(1, pruned)
+	toks, err = ds.ActivePushTokensByAccount(ctx, testAccount1.UUID)
+	assert.NoError(err)
+	assert.Len(toks, 0)
+	toks, err = ds.ActivePushTokensByAccount(ctx, testAccount2.UUID)
+	assert.NoError(err)
+	assert.Len(toks, 1)
+}
+
+func testNotificationPrefs(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, nil, nil)
+	_ = mkAccount(t, ds, &testPerson1, &testAccount1, []string{"user"})
+
+	// Push notifications are enabled by default
+	prefs, err := ds.NotificationPrefsByAccount(ctx, testAccount1.UUID)
+	assert.NoError(err)
+	assert.Equal(testAccount1.UUID, prefs.AccountUUID)
+	assert.True(prefs.PushEnabled)
+
+	prefs.PushEnabled = false
+	err = ds.UpsertNotificationPrefs(ctx, prefs)
+	assert.NoError(err)
+	prefs, err = ds.NotificationPrefsByAccount(ctx, testAccount1.UUID)
+	assert.NoError(err)
+	assert.False(prefs.PushEnabled)
+
+	prefs.PushEnabled = true
+	err = ds.UpsertNotificationPrefs(ctx, prefs)
+	assert.NoError(err)
+	prefs, err = ds.NotificationPrefsByAccount(ctx, testAccount1.UUID)
+	assert.NoError(err)
+	assert.True(prefs.PushEnabled)
+}
@@ -0,0 +1,35 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS guest_enroll_attempt (
+    id               bigserial PRIMARY KEY,
+    account_uuid     uuid REFERENCES account(uuid) ON DELETE SET NULL,
+    site_uuid        uuid REFERENCES customer_site(uuid) NOT NULL,
+    attempt_ts       timestamp with time zone NOT NULL DEFAULT now(),
+    phone_hash       bytea NOT NULL,
+    result           text NOT NULL
+);
+CREATE INDEX ON guest_enroll_attempt (site_uuid, attempt_ts);
+COMMENT ON TABLE guest_enroll_attempt IS 'Record of guest enrollment attempts, for abuse monitoring';
+COMMENT ON COLUMN guest_enroll_attempt.account_uuid IS 'Account which requested the enrollment';
+COMMENT ON COLUMN guest_enroll_attempt.site_uuid IS 'Site to which the guest was being enrolled';
+COMMENT ON COLUMN guest_enroll_attempt.attempt_ts IS 'Time of the enrollment attempt';
+COMMENT ON COLUMN guest_enroll_attempt.phone_hash IS 'HMAC-SHA256 of the phone number the enrollment was sent to, keyed with a server-side secret; empty if the number could not be parsed';
+COMMENT ON COLUMN guest_enroll_attempt.result IS 'Outcome of the enrollment attempt';
+
+GRANT INSERT, SELECT
+    ON TABLE guest_enroll_attempt
+    TO httpd_group;
+GRANT USAGE
+    ON SEQUENCE guest_enroll_attempt_id_seq
+    TO httpd_group;
+
+COMMIT;
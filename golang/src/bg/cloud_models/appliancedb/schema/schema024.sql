@@ -0,0 +1,33 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS api_usage (
+    organization_uuid  uuid REFERENCES organization(uuid) NOT NULL,
+    account_uuid       uuid NOT NULL,
+    endpoint_class     text NOT NULL,
+    hour               timestamp with time zone NOT NULL,
+    request_count      bigint NOT NULL DEFAULT 0,
+    bytes              bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (organization_uuid, hour, endpoint_class, account_uuid)
+);
+COMMENT ON TABLE api_usage IS 'Hourly rollups of customer API calls, for metering';
+COMMENT ON COLUMN api_usage.organization_uuid IS 'Organization to which the calls are attributed';
+COMMENT ON COLUMN api_usage.account_uuid IS 'Account which made the calls; not a foreign key, so that usage outlives the account';
+COMMENT ON COLUMN api_usage.endpoint_class IS 'Class of API endpoint called (e.g., site, account, org)';
+COMMENT ON COLUMN api_usage.hour IS 'Start of the hour covered by this rollup';
+COMMENT ON COLUMN api_usage.request_count IS 'Number of calls made during the hour';
+COMMENT ON COLUMN api_usage.bytes IS 'Bytes transferred (request and response bodies) during the hour';
+
+GRANT INSERT, SELECT, UPDATE
+    ON TABLE api_usage
+    TO httpd_group;
+
+COMMIT;
@@ -0,0 +1,44 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS account_push_tokens (
+    account_uuid     uuid REFERENCES account(uuid) ON DELETE CASCADE NOT NULL,
+    platform         text NOT NULL CHECK (platform IN ('ios', 'android')),
+    token            text NOT NULL,
+    app_version      text NOT NULL DEFAULT '',
+    created          timestamp with time zone NOT NULL DEFAULT now(),
+    last_seen        timestamp with time zone NOT NULL DEFAULT now(),
+    disabled         boolean NOT NULL DEFAULT false,
+    PRIMARY KEY (platform, token)
+);
+CREATE INDEX ON account_push_tokens (account_uuid);
+CREATE INDEX ON account_push_tokens (last_seen);
+COMMENT ON TABLE account_push_tokens IS 'Mobile device tokens to which push notifications for an account are sent';
+COMMENT ON COLUMN account_push_tokens.account_uuid IS 'Account which registered the token';
+COMMENT ON COLUMN account_push_tokens.platform IS 'Push platform which issued the token';
+COMMENT ON COLUMN account_push_tokens.token IS 'Device token, as issued by the push platform';
+COMMENT ON COLUMN account_push_tokens.app_version IS 'Version of the app which registered the token';
+COMMENT ON COLUMN account_push_tokens.created IS 'Time the token was first registered';
+COMMENT ON COLUMN account_push_tokens.last_seen IS 'Time the token was most recently registered or refreshed';
+COMMENT ON COLUMN account_push_tokens.disabled IS 'Whether the token was unregistered, or reported invalid by the platform';
+
+CREATE TABLE IF NOT EXISTS account_notification_prefs (
+    account_uuid     uuid PRIMARY KEY REFERENCES account(uuid) ON DELETE CASCADE,
+    push_enabled     boolean NOT NULL DEFAULT true
+);
+COMMENT ON TABLE account_notification_prefs IS 'Per-account notification preferences; accounts without a row get the defaults';
+COMMENT ON COLUMN account_notification_prefs.push_enabled IS 'Whether alerts are sent as push notifications';
+
+GRANT INSERT, SELECT, UPDATE
+    ON TABLE account_push_tokens, account_notification_prefs
+    TO httpd_group;
+
+COMMIT;
@@ -0,0 +1,26 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS site_external_ref (
+    site_uuid        uuid REFERENCES customer_site(uuid) ON DELETE CASCADE NOT NULL,
+    system           text NOT NULL,
+    external_id      text NOT NULL,
+    created          timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (site_uuid, system, external_id)
+);
+CREATE INDEX ON site_external_ref (system, external_id);
+COMMENT ON TABLE site_external_ref IS 'Cross-references between sites and records in external systems, such as support tickets';
+COMMENT ON COLUMN site_external_ref.site_uuid IS 'Site being referenced';
+COMMENT ON COLUMN site_external_ref.system IS 'External system (e.g., a ticketing system) holding the record';
+COMMENT ON COLUMN site_external_ref.external_id IS 'Identifier of the record within the external system';
+COMMENT ON COLUMN site_external_ref.created IS 'Time the reference was added';
+
+COMMIT;
@@ -0,0 +1,32 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS site_config_checkpoint (
+    id               bigserial PRIMARY KEY,
+    site_uuid        uuid REFERENCES customer_site(uuid) ON DELETE CASCADE NOT NULL,
+    name             text NOT NULL,
+    created_by       text NOT NULL,
+    created_at       timestamp with time zone NOT NULL DEFAULT now(),
+    root_hash        bytea NOT NULL,
+    config           bytea NOT NULL,
+    last_command_id  bigint,
+    UNIQUE (site_uuid, name)
+);
+COMMENT ON TABLE site_config_checkpoint IS 'Named snapshots of a site''s config store, tied to a position in the command queue';
+COMMENT ON COLUMN site_config_checkpoint.site_uuid IS 'Site whose configuration was captured';
+COMMENT ON COLUMN site_config_checkpoint.name IS 'Operator-supplied name, unique within the site';
+COMMENT ON COLUMN site_config_checkpoint.created_by IS 'Person or tool which created the checkpoint';
+COMMENT ON COLUMN site_config_checkpoint.created_at IS 'Time the checkpoint was captured';
+COMMENT ON COLUMN site_config_checkpoint.root_hash IS 'Root hash of the captured config tree';
+COMMENT ON COLUMN site_config_checkpoint.config IS 'Captured contents of site_config_store.config';
+COMMENT ON COLUMN site_config_checkpoint.last_command_id IS 'Highest completed site_commands ID at capture time; NULL if none had completed';
+
+COMMIT;
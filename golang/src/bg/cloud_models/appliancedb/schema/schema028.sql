@@ -0,0 +1,27 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+ALTER TABLE organization ADD COLUMN version bigint NOT NULL DEFAULT 1;
+ALTER TABLE organization ADD COLUMN updated_at timestamp with time zone NOT NULL DEFAULT now();
+COMMENT ON COLUMN organization.version IS 'Incremented on each update; used to detect conflicting updates';
+COMMENT ON COLUMN organization.updated_at IS 'Time of the most recent update';
+
+ALTER TABLE customer_site ADD COLUMN version bigint NOT NULL DEFAULT 1;
+ALTER TABLE customer_site ADD COLUMN updated_at timestamp with time zone NOT NULL DEFAULT now();
+COMMENT ON COLUMN customer_site.version IS 'Incremented on each update; used to detect conflicting updates';
+COMMENT ON COLUMN customer_site.updated_at IS 'Time of the most recent update';
+
+ALTER TABLE appliance_id_map ADD COLUMN version bigint NOT NULL DEFAULT 1;
+ALTER TABLE appliance_id_map ADD COLUMN updated_at timestamp with time zone NOT NULL DEFAULT now();
+COMMENT ON COLUMN appliance_id_map.version IS 'Incremented on each update; used to detect conflicting updates';
+COMMENT ON COLUMN appliance_id_map.updated_at IS 'Time of the most recent update';
+
+COMMIT;
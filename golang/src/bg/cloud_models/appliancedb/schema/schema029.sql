@@ -0,0 +1,36 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS appliance_notes (
+    id              bigserial PRIMARY KEY,
+    appliance_uuid  uuid REFERENCES appliance_id_map(appliance_uuid) ON DELETE CASCADE,
+    site_uuid       uuid REFERENCES customer_site(uuid) ON DELETE CASCADE,
+    author          text NOT NULL,
+    created_at      timestamp with time zone NOT NULL DEFAULT now(),
+    text            text NOT NULL,
+    ticket_ref      text,
+    deleted_at      timestamp with time zone,
+    deleted_by      text,
+    CHECK ((appliance_uuid IS NULL) <> (site_uuid IS NULL)),
+    CHECK ((deleted_at IS NULL) = (deleted_by IS NULL))
+);
+CREATE INDEX IF NOT EXISTS appliance_notes_appliance_uuid ON appliance_notes (appliance_uuid) WHERE appliance_uuid IS NOT NULL;
+CREATE INDEX IF NOT EXISTS appliance_notes_site_uuid ON appliance_notes (site_uuid) WHERE site_uuid IS NOT NULL;
+COMMENT ON TABLE appliance_notes IS 'Free-form support notes about appliances and sites';
+COMMENT ON COLUMN appliance_notes.appliance_uuid IS 'Appliance the note is about; exactly one of appliance_uuid and site_uuid is set';
+COMMENT ON COLUMN appliance_notes.site_uuid IS 'Site the note is about; exactly one of appliance_uuid and site_uuid is set';
+COMMENT ON COLUMN appliance_notes.author IS 'Person or tool which wrote the note';
+COMMENT ON COLUMN appliance_notes.text IS 'Body of the note';
+COMMENT ON COLUMN appliance_notes.ticket_ref IS 'Optional reference to a ticket in an external support system';
+COMMENT ON COLUMN appliance_notes.deleted_at IS 'If set, the time the note was deleted; deleted notes are retained as tombstones';
+COMMENT ON COLUMN appliance_notes.deleted_by IS 'Person or tool which deleted the note';
+
+COMMIT;
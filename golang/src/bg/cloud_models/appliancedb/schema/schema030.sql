@@ -0,0 +1,17 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+-- cl.httpd renames sites (POST /api/sites/:uuid)
+GRANT UPDATE
+    ON TABLE customer_site
+    TO httpd_group;
+
+COMMIT;
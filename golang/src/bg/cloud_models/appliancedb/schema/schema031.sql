@@ -0,0 +1,54 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+CREATE TYPE deployment_result AS ENUM (
+        'success',
+        'failed',
+        'rolled-back'
+);
+
+CREATE TABLE IF NOT EXISTS release_deployment (
+    deployment_uuid  uuid PRIMARY KEY,
+    release_uuid     uuid REFERENCES releases(release_uuid) NOT NULL,
+    channel          text NOT NULL,
+    name             text NOT NULL,
+    created_at       timestamp with time zone NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS release_deployment_release_uuid ON release_deployment (release_uuid);
+COMMENT ON TABLE release_deployment IS 'Campaigns to roll a release out to a set of sites';
+COMMENT ON COLUMN release_deployment.deployment_uuid IS 'Deployment UUID';
+COMMENT ON COLUMN release_deployment.release_uuid IS 'Release being deployed';
+COMMENT ON COLUMN release_deployment.channel IS 'Release channel, taken from the release metadata when the deployment was created';
+COMMENT ON COLUMN release_deployment.name IS 'Human-readable name for the deployment';
+COMMENT ON COLUMN release_deployment.created_at IS 'Time when the deployment was created';
+
+CREATE TABLE IF NOT EXISTS release_deployment_target (
+    deployment_uuid  uuid REFERENCES release_deployment(deployment_uuid) ON DELETE CASCADE NOT NULL,
+    site_uuid        uuid REFERENCES customer_site(uuid) NOT NULL,
+    channel          text NOT NULL,
+    status           deployment_result,
+    detail           text,
+    reported_at      timestamp with time zone,
+    PRIMARY KEY (deployment_uuid, site_uuid),
+    CHECK ((status IS NULL) = (reported_at IS NULL))
+);
+-- A site may only be awaiting one deployment per channel at a time
+CREATE UNIQUE INDEX IF NOT EXISTS release_deployment_target_active
+    ON release_deployment_target (site_uuid, channel) WHERE status IS NULL;
+COMMENT ON TABLE release_deployment_target IS 'Sites targeted by a deployment, and what they reported';
+COMMENT ON COLUMN release_deployment_target.deployment_uuid IS 'Deployment UUID';
+COMMENT ON COLUMN release_deployment_target.site_uuid IS 'Site told to upgrade';
+COMMENT ON COLUMN release_deployment_target.channel IS 'Copy of the deployment channel, for the active target index';
+COMMENT ON COLUMN release_deployment_target.status IS 'Most recent result reported by the site, or NULL if it has not reported';
+COMMENT ON COLUMN release_deployment_target.detail IS 'Free-form detail accompanying the result';
+COMMENT ON COLUMN release_deployment_target.reported_at IS 'Time of the most recent result';
+
+COMMIT;
@@ -0,0 +1,15 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+ALTER TABLE failed_domains ADD COLUMN IF NOT EXISTS fail_count integer NOT NULL DEFAULT 1;
+COMMENT ON COLUMN failed_domains.fail_count IS 'number of ACME verification failures since the domain was last cleared';
+
+COMMIT;
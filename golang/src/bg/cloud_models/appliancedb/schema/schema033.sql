@@ -0,0 +1,38 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+ALTER TABLE account ADD COLUMN IF NOT EXISTS locale varchar(35) NOT NULL DEFAULT 'en-US';
+COMMENT ON COLUMN account.locale IS 'BCP 47 tag for the language in which the account is sent notifications';
+
+CREATE TABLE IF NOT EXISTS notification_templates (
+    name             varchar(64) NOT NULL,
+    locale           varchar(35) NOT NULL,
+    subject          text NOT NULL DEFAULT '',
+    body             text NOT NULL,
+    updated          timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (name, locale)
+);
+COMMENT ON TABLE notification_templates IS 'Localized text of the notifications sent to accounts';
+COMMENT ON COLUMN notification_templates.name IS 'Name of the notification';
+COMMENT ON COLUMN notification_templates.locale IS 'BCP 47 tag for the language of the template; either a full locale or a bare language';
+COMMENT ON COLUMN notification_templates.subject IS 'Subject or title, with {placeholder} substitutions';
+COMMENT ON COLUMN notification_templates.body IS 'Body, with {placeholder} substitutions';
+COMMENT ON COLUMN notification_templates.updated IS 'Time the template was last changed';
+
+INSERT INTO notification_templates (name, locale, subject, body) VALUES
+    ('net-exception', 'en-US', 'Alert at {site}', '{message}')
+    ON CONFLICT DO NOTHING;
+
+GRANT SELECT
+    ON TABLE notification_templates
+    TO httpd_group;
+
+COMMIT;
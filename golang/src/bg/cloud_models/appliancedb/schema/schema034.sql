@@ -0,0 +1,34 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS appliance_firmware (
+    appliance_uuid   uuid REFERENCES appliance_id_map(appliance_uuid) ON DELETE CASCADE NOT NULL,
+    component        varchar(64) NOT NULL,
+    version          text NOT NULL,
+    changed_ts       timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (appliance_uuid, component)
+);
+COMMENT ON TABLE appliance_firmware IS 'Versions of the firmware components (bootloader, kernel, etc.) installed on each appliance';
+COMMENT ON COLUMN appliance_firmware.component IS 'Name of the component, e.g., uboot or kernel';
+COMMENT ON COLUMN appliance_firmware.version IS 'Version string reported by the appliance';
+COMMENT ON COLUMN appliance_firmware.changed_ts IS 'Time the component was first reported at this version';
+
+GRANT INSERT
+    ON TABLE appliance_firmware
+    TO rpcd_group;
+GRANT SELECT
+    ON TABLE appliance_firmware
+    TO rpcd_group;
+GRANT UPDATE
+    ON TABLE appliance_firmware
+    TO rpcd_group;
+
+COMMIT;
@@ -0,0 +1,72 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+-- Support staff reach a customer organization through a 'support'
+-- relationship, but hold no roles there except through a support grant.
+INSERT INTO relationship VALUES ('support');
+INSERT INTO relationship_roles VALUES
+    ('support', 'admin'),
+    ('support', 'user');
+
+CREATE TABLE IF NOT EXISTS support_grant (
+    uuid              uuid PRIMARY KEY,
+    organization_uuid uuid REFERENCES organization(uuid) ON DELETE CASCADE NOT NULL,
+    granted_by        uuid REFERENCES account(uuid) ON DELETE SET NULL,
+    scope             varchar(32) NOT NULL CHECK (scope IN ('read-only', 'read-write')),
+    created_at        timestamp with time zone NOT NULL DEFAULT now(),
+    expires_at        timestamp with time zone NOT NULL,
+    revoked_at        timestamp with time zone,
+    revoked_by        uuid REFERENCES account(uuid) ON DELETE SET NULL,
+    CHECK (expires_at > created_at)
+);
+CREATE INDEX ON support_grant (organization_uuid, expires_at);
+COMMENT ON TABLE support_grant IS 'Time-limited consent from an organization for support staff to act within it';
+COMMENT ON COLUMN support_grant.organization_uuid IS 'Organization granting access';
+COMMENT ON COLUMN support_grant.granted_by IS 'Admin account which created the grant';
+COMMENT ON COLUMN support_grant.scope IS 'Whether support staff may make changes (read-write) or only look (read-only)';
+COMMENT ON COLUMN support_grant.expires_at IS 'Time after which the grant no longer gives access';
+COMMENT ON COLUMN support_grant.revoked_at IS 'Time the grant was revoked, if it was revoked before it expired';
+COMMENT ON COLUMN support_grant.revoked_by IS 'Account which revoked the grant';
+
+CREATE TABLE IF NOT EXISTS support_audit (
+    id                bigserial PRIMARY KEY,
+    grant_uuid        uuid NOT NULL,
+    account_uuid      uuid NOT NULL,
+    granted_by        uuid,
+    organization_uuid uuid NOT NULL,
+    method            varchar(16) NOT NULL,
+    path              text NOT NULL,
+    allowed           boolean NOT NULL,
+    ts                timestamp with time zone NOT NULL DEFAULT now()
+);
+CREATE INDEX ON support_audit (organization_uuid, ts);
+CREATE INDEX ON support_audit (grant_uuid);
+COMMENT ON TABLE support_audit IS 'Record of every request made by support staff under a support grant';
+COMMENT ON COLUMN support_audit.grant_uuid IS 'Support grant under which the request was made; not a foreign key, so that the record outlives the grant';
+COMMENT ON COLUMN support_audit.account_uuid IS 'Support account which made the request; not a foreign key, so that the record outlives the account';
+COMMENT ON COLUMN support_audit.granted_by IS 'Customer account which created the grant, as of the request';
+COMMENT ON COLUMN support_audit.organization_uuid IS 'Organization in which the request was made';
+COMMENT ON COLUMN support_audit.method IS 'HTTP method of the request';
+COMMENT ON COLUMN support_audit.path IS 'Path of the request';
+COMMENT ON COLUMN support_audit.allowed IS 'Whether the request was permitted by the grant scope';
+COMMENT ON COLUMN support_audit.ts IS 'Time of the request';
+
+GRANT INSERT, SELECT, UPDATE
+    ON TABLE support_grant
+    TO httpd_group;
+GRANT INSERT, SELECT
+    ON TABLE support_audit
+    TO httpd_group;
+GRANT USAGE
+    ON SEQUENCE support_audit_id_seq
+    TO httpd_group;
+
+COMMIT;
@@ -0,0 +1,41 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+CREATE TYPE support_tier AS ENUM (
+        'none',
+        'basic',
+        'standard',
+        'premium'
+);
+
+CREATE TABLE IF NOT EXISTS org_entitlements (
+    organization_uuid     uuid PRIMARY KEY REFERENCES organization(uuid) ON DELETE CASCADE,
+    support_tier          support_tier NOT NULL DEFAULT 'none',
+    contracted_appliances integer NOT NULL CHECK (contracted_appliances >= 0),
+    contracted_accounts   integer NOT NULL CHECK (contracted_accounts >= 0),
+    contract_start        date NOT NULL,
+    contract_end          date NOT NULL,
+    notes                 text NOT NULL DEFAULT '',
+    updated_at            timestamp with time zone NOT NULL DEFAULT now(),
+    CHECK (contract_end > contract_start)
+);
+CREATE INDEX ON org_entitlements (contract_end);
+COMMENT ON TABLE org_entitlements IS 'What each customer organization is entitled to under its contract';
+COMMENT ON COLUMN org_entitlements.organization_uuid IS 'Organization holding the contract';
+COMMENT ON COLUMN org_entitlements.support_tier IS 'Level of support purchased';
+COMMENT ON COLUMN org_entitlements.contracted_appliances IS 'Number of appliances covered by the contract';
+COMMENT ON COLUMN org_entitlements.contracted_accounts IS 'Number of user accounts covered by the contract';
+COMMENT ON COLUMN org_entitlements.contract_start IS 'First day of the contract';
+COMMENT ON COLUMN org_entitlements.contract_end IS 'Day on which the contract is up for renewal';
+COMMENT ON COLUMN org_entitlements.notes IS 'Free-form notes from sales or support';
+COMMENT ON COLUMN org_entitlements.updated_at IS 'Time of the most recent change';
+
+COMMIT;
@@ -0,0 +1,78 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+-- The foreign keys our hot paths look rows up by.  This table is the only
+-- list of them: the statement below creates any of the indexes which are
+-- missing, and the database health report checks it against the catalogs.
+-- To add to the list, add a row here (or in a later schema file) rather than
+-- creating the index directly.
+CREATE TABLE IF NOT EXISTS hot_path_index (
+    name             text PRIMARY KEY,
+    table_name       text NOT NULL,
+    columns          text[] NOT NULL CHECK (cardinality(columns) > 0),
+    reason           text NOT NULL
+);
+COMMENT ON TABLE hot_path_index IS 'Indexes the application relies on, checked by the database health report';
+COMMENT ON COLUMN hot_path_index.name IS 'Name given to the index if it needs to be created';
+COMMENT ON COLUMN hot_path_index.table_name IS 'Table being indexed';
+COMMENT ON COLUMN hot_path_index.columns IS 'Leading columns of any index which satisfies the need';
+COMMENT ON COLUMN hot_path_index.reason IS 'Lookup which depends on the index';
+
+INSERT INTO hot_path_index (name, table_name, columns, reason) VALUES
+    ('customer_site_organization_uuid', 'customer_site', '{organization_uuid}', 'sites by organization'),
+    ('appliance_id_map_site_uuid', 'appliance_id_map', '{site_uuid}', 'appliances by site'),
+    ('appliance_pubkey_appliance_uuid', 'appliance_pubkey', '{appliance_uuid}', 'appliance authentication'),
+    ('account_organization_uuid', 'account', '{organization_uuid}', 'accounts by organization'),
+    ('account_person_uuid', 'account', '{person_uuid}', 'accounts by person'),
+    ('oauth2_identity_account_uuid', 'oauth2_identity', '{account_uuid}', 'identities by account'),
+    ('account_org_role_target_organization_uuid', 'account_org_role', '{target_organization_uuid}', 'roles by organization'),
+    ('site_commands_site_uuid', 'site_commands', '{site_uuid}', 'command queue fetch'),
+    ('site_net_exception_site_uuid', 'site_net_exception', '{site_uuid}', 'exceptions by site'),
+    ('site_config_checkpoint_site_uuid', 'site_config_checkpoint', '{site_uuid}', 'checkpoints by site'),
+    ('release_artifacts_release_uuid', 'release_artifacts', '{release_uuid}', 'artifacts by release'),
+    ('account_push_tokens_account_uuid', 'account_push_tokens', '{account_uuid}', 'push notification fan-out'),
+    ('guest_enroll_attempt_site_uuid', 'guest_enroll_attempt', '{site_uuid}', 'enrollment rate limiting'),
+    ('support_audit_grant_uuid', 'support_audit', '{grant_uuid}', 'audit trail by grant')
+ON CONFLICT DO NOTHING;
+
+-- Entries in hot_path_index which aren't satisfied by any valid index on the
+-- table whose leading columns match.  The name of an existing index doesn't
+-- matter.
+CREATE OR REPLACE VIEW missing_hot_path_index AS
+    SELECT h.name, h.table_name, h.columns, h.reason
+    FROM hot_path_index h
+    WHERE NOT EXISTS (
+        SELECT 1
+        FROM pg_index x
+        JOIN pg_class t ON t.oid = x.indrelid
+        JOIN pg_namespace n ON n.oid = t.relnamespace
+        WHERE n.nspname = current_schema()
+          AND t.relname = h.table_name
+          AND x.indisvalid
+          AND h.columns = (
+              SELECT array_agg(a.attname::text ORDER BY k.ord)
+              FROM unnest(x.indkey::int2[]) WITH ORDINALITY AS k(attnum, ord)
+              JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = k.attnum
+              WHERE k.ord <= cardinality(h.columns)));
+COMMENT ON VIEW missing_hot_path_index IS 'Entries in hot_path_index with no matching index';
+
+DO $$
+DECLARE
+    h record;
+BEGIN
+    FOR h IN SELECT * FROM missing_hot_path_index LOOP
+        EXECUTE format('CREATE INDEX %I ON %I (%s)', h.name, h.table_name,
+            (SELECT string_agg(quote_ident(c), ', ') FROM unnest(h.columns) c));
+    END LOOP;
+END
+$$;
+
+COMMIT;
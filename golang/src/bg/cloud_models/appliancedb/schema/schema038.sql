@@ -0,0 +1,46 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS site_integration_tokens (
+    uuid         uuid PRIMARY KEY,
+    site_uuid    uuid REFERENCES customer_site(uuid) ON DELETE CASCADE NOT NULL,
+    name         text NOT NULL,
+    secret_hash  bytea NOT NULL,
+    scopes       varchar(32)[] NOT NULL CHECK (
+        cardinality(scopes) > 0 AND
+        scopes <@ ARRAY['events', 'inventory']::varchar(32)[]),
+    created_by   text NOT NULL,
+    created_at   timestamp with time zone NOT NULL DEFAULT now(),
+    expires_at   timestamp with time zone NOT NULL,
+    last_used    timestamp with time zone,
+    revoked_at   timestamp with time zone,
+    CHECK (expires_at > created_at)
+);
+CREATE UNIQUE INDEX ON site_integration_tokens (site_uuid, name)
+    WHERE revoked_at IS NULL;
+COMMENT ON TABLE site_integration_tokens IS 'Credentials with which external systems (e.g., a SIEM) may export a single site''s events and inventory';
+COMMENT ON COLUMN site_integration_tokens.site_uuid IS 'Site to which the token is bound';
+COMMENT ON COLUMN site_integration_tokens.name IS 'Operator-supplied name, unique among the site''s unrevoked tokens';
+COMMENT ON COLUMN site_integration_tokens.secret_hash IS 'SHA256 hash of the token''s secret; the secret itself is never stored';
+COMMENT ON COLUMN site_integration_tokens.scopes IS 'Classes of read-only data the token may export';
+COMMENT ON COLUMN site_integration_tokens.created_by IS 'Person or tool which created the token';
+COMMENT ON COLUMN site_integration_tokens.expires_at IS 'Time after which the token is no longer accepted';
+COMMENT ON COLUMN site_integration_tokens.last_used IS 'Approximate time the token was last accepted; updated at most once a minute';
+COMMENT ON COLUMN site_integration_tokens.revoked_at IS 'Time the token was revoked, if it was revoked before it expired';
+
+GRANT SELECT, UPDATE
+    ON TABLE site_integration_tokens
+    TO httpd_group;
+GRANT SELECT
+    ON TABLE site_net_exception
+    TO httpd_group;
+
+COMMIT;
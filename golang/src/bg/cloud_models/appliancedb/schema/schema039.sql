@@ -0,0 +1,34 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS site_usage_daily (
+    site_uuid  uuid REFERENCES customer_site(uuid) ON DELETE CASCADE NOT NULL,
+    day        date NOT NULL,
+    bytes_in   bigint NOT NULL CHECK (bytes_in >= 0),
+    bytes_out  bigint NOT NULL CHECK (bytes_out >= 0),
+    updated_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (site_uuid, day)
+);
+COMMENT ON TABLE site_usage_daily IS 'Daily rollups of each site''s WAN traffic, kept for historical charts';
+COMMENT ON COLUMN site_usage_daily.site_uuid IS 'Site whose traffic is counted';
+COMMENT ON COLUMN site_usage_daily.day IS 'UTC day covered by this rollup';
+COMMENT ON COLUMN site_usage_daily.bytes_in IS 'Bytes received from the WAN during the day';
+COMMENT ON COLUMN site_usage_daily.bytes_out IS 'Bytes sent to the WAN during the day';
+COMMENT ON COLUMN site_usage_daily.updated_at IS 'Time of the most recent upsert';
+
+GRANT INSERT, SELECT, UPDATE
+    ON TABLE site_usage_daily
+    TO rpcd_group;
+GRANT SELECT
+    ON TABLE site_usage_daily
+    TO httpd_group;
+
+COMMIT;
@@ -0,0 +1,34 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS job_leases (
+    job_name    varchar(128) PRIMARY KEY,
+    holder      varchar(256) NOT NULL,
+    acquired_at timestamp with time zone NOT NULL DEFAULT now(),
+    renewed_at  timestamp with time zone NOT NULL DEFAULT now(),
+    expires_at  timestamp with time zone NOT NULL,
+    CHECK (expires_at > renewed_at)
+);
+COMMENT ON TABLE job_leases IS 'Leases held by cloud maintenance jobs, so that only one instance of each runs at a time';
+COMMENT ON COLUMN job_leases.job_name IS 'Name of the job the lease is for';
+COMMENT ON COLUMN job_leases.holder IS 'Identity of the process holding the lease, e.g., host and pid';
+COMMENT ON COLUMN job_leases.acquired_at IS 'Time the current holder acquired the lease';
+COMMENT ON COLUMN job_leases.renewed_at IS 'Time the current holder last renewed the lease';
+COMMENT ON COLUMN job_leases.expires_at IS 'Time after which the lease may be taken by another holder';
+
+GRANT DELETE, INSERT, SELECT, UPDATE
+    ON TABLE job_leases
+    TO rpcd_group;
+GRANT DELETE, INSERT, SELECT, UPDATE
+    ON TABLE job_leases
+    TO httpd_group;
+
+COMMIT;
@@ -0,0 +1,30 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS site_shard (
+    site_uuid  uuid PRIMARY KEY REFERENCES customer_site(uuid) ON DELETE CASCADE,
+    shard      varchar(128) NOT NULL CHECK (shard <> ''),
+    updated_at timestamp with time zone NOT NULL DEFAULT now()
+);
+CREATE INDEX ON site_shard (shard);
+COMMENT ON TABLE site_shard IS 'The cloud shard (cl.httpd/cl.configd pod) serving each site, for routing';
+COMMENT ON COLUMN site_shard.site_uuid IS 'Site being served';
+COMMENT ON COLUMN site_shard.shard IS 'Name of the shard serving the site';
+COMMENT ON COLUMN site_shard.updated_at IS 'Time the site was assigned to the shard';
+
+GRANT SELECT
+    ON TABLE site_shard
+    TO rpcd_group;
+GRANT SELECT
+    ON TABLE site_shard
+    TO httpd_group;
+
+COMMIT;
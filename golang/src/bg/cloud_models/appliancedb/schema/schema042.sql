@@ -0,0 +1,16 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+ALTER TABLE customer_site ADD COLUMN IF NOT EXISTS
+    archived_at timestamp with time zone;
+COMMENT ON COLUMN customer_site.archived_at IS 'Time the site was archived; NULL if it is active.  Archived sites are kept, but left out of health reporting and alerting, and can''t be sent commands';
+
+COMMIT;
@@ -0,0 +1,17 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+ALTER TABLE appliance_id_map ADD COLUMN IF NOT EXISTS
+    lifecycle_state varchar(32) NOT NULL DEFAULT 'active'
+    CHECK (lifecycle_state IN ('active', 'rma-requested', 'retired'));
+COMMENT ON COLUMN appliance_id_map.lifecycle_state IS 'Hardware lifecycle state: active, rma-requested (returned, or due to be returned, for repair or replacement), or retired.  Retired appliances are kept for their history, but may be left out of health reporting';
+
+COMMIT;
@@ -0,0 +1,40 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS account_invite (
+    uuid                  uuid PRIMARY KEY,
+    organization_uuid     uuid REFERENCES organization(uuid) NOT NULL,
+    email                 text NOT NULL,
+    role                  varchar(64) REFERENCES ao_role(name) NOT NULL,
+    token_hash            bytea NOT NULL UNIQUE,
+    created_at            timestamp with time zone NOT NULL DEFAULT now(),
+    expires_at            timestamp with time zone NOT NULL,
+    accepted_at           timestamp with time zone,
+    accepted_account_uuid uuid REFERENCES account(uuid),
+    CHECK (expires_at > created_at),
+    CHECK ((accepted_at IS NULL) = (accepted_account_uuid IS NULL))
+);
+CREATE UNIQUE INDEX ON account_invite (organization_uuid, email)
+    WHERE accepted_at IS NULL;
+COMMENT ON TABLE account_invite IS 'Invitations for people to join an organization, before they first log in';
+COMMENT ON COLUMN account_invite.organization_uuid IS 'Organization the invitee is invited to join';
+COMMENT ON COLUMN account_invite.email IS 'Normalized email address to which the invitation was sent; an organization has at most one pending invitation per address';
+COMMENT ON COLUMN account_invite.role IS 'Role granted in the organization when the invitation is accepted';
+COMMENT ON COLUMN account_invite.token_hash IS 'SHA256 hash of the invitation''s token; the token itself is never stored';
+COMMENT ON COLUMN account_invite.expires_at IS 'Time after which the invitation can no longer be accepted';
+COMMENT ON COLUMN account_invite.accepted_at IS 'Time the invitation was accepted; NULL while it is pending';
+COMMENT ON COLUMN account_invite.accepted_account_uuid IS 'Account which accepted the invitation';
+
+GRANT SELECT, INSERT, UPDATE, DELETE
+    ON TABLE account_invite
+    TO httpd_group;
+
+COMMIT;
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/satori/uuid"
+)
+
+type siteRefManager interface {
+	SetSiteExternalRef(context.Context, *SiteExternalRef) error
+	SiteExternalRefsBySite(context.Context, uuid.UUID) ([]SiteExternalRef, error)
+	SiteExternalRefsByExternalID(context.Context, string, string) ([]SiteExternalRef, error)
+	DeleteSiteExternalRef(context.Context, *SiteExternalRef) error
+}
+
+// SiteExternalRef represents a row in the site_external_ref table: a
+// reference from a site to a record, such as a support ticket, in an external
+// system.
+type SiteExternalRef struct {
+	SiteUUID   uuid.UUID `db:"site_uuid"`
+	System     string    `db:"system"`
+	ExternalID string    `db:"external_id"`
+	Created    time.Time `db:"created"`
+}
+
+// SetSiteExternalRef associates a site with a record in an external system.
+// Setting a reference which already exists has no effect.  The reference's
+// Created field is filled in from the database.
+func (db *ApplianceDB) SetSiteExternalRef(ctx context.Context, ref *SiteExternalRef) error {
+	row := db.QueryRowContext(ctx, `
+		INSERT INTO site_external_ref (site_uuid, system, external_id)
+		    VALUES ($1, $2, $3)
+		ON CONFLICT (site_uuid, system, external_id)
+		DO UPDATE SET created = site_external_ref.created
+		RETURNING created`,
+		ref.SiteUUID, ref.System, ref.ExternalID)
+	return row.Scan(&ref.Created)
+}
+
+// SiteExternalRefsBySite returns all of the external references for a site
+func (db *ApplianceDB) SiteExternalRefsBySite(ctx context.Context, site uuid.UUID) ([]SiteExternalRef, error) {
+	var refs []SiteExternalRef
+	err := db.SelectContext(ctx, &refs, `
+		SELECT * FROM site_external_ref
+		WHERE site_uuid = $1
+		ORDER BY system, external_id`, site)
+	if err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// SiteExternalRefsByExternalID returns the references to the given record in
+// an external system; there is one for each site associated with the record.
+func (db *ApplianceDB) SiteExternalRefsByExternalID(ctx context.Context, system, externalID string) ([]SiteExternalRef, error) {
+	var refs []SiteExternalRef
+	err := db.SelectContext(ctx, &refs, `
+		SELECT * FROM site_external_ref
+		WHERE system = $1 AND external_id = $2
+		ORDER BY site_uuid`, system, externalID)
+	if err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// DeleteSiteExternalRef removes a reference from a site to an external record.
+// NotFoundError is returned if there is no such reference.
+func (db *ApplianceDB) DeleteSiteExternalRef(ctx context.Context, ref *SiteExternalRef) error {
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM site_external_ref
+		WHERE site_uuid = $1 AND system = $2 AND external_id = $3`,
+		ref.SiteUUID, ref.System, ref.ExternalID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return NotFoundError{fmt.Sprintf(
+			"DeleteSiteExternalRef: no %s reference %s for %v",
+			ref.System, ref.ExternalID, ref.SiteUUID)}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.uber.org/zap"
+)
+
+func testSiteExternalRefs(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, nil)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, nil)
+
+	// A site may have several references, to the same system or others
+	refs := []*SiteExternalRef{
+		{SiteUUID: testSite1.UUID, System: "zendesk", ExternalID: "1001"},
+		{SiteUUID: testSite1.UUID, System: "zendesk", ExternalID: "1002"},
+		{SiteUUID: testSite1.UUID, System: "salesforce", ExternalID: "A-17"},
+		{SiteUUID: testSite2.UUID, System: "zendesk", ExternalID: "1001"},
+	}
+	for _, ref := range refs {
+		err := ds.SetSiteExternalRef(ctx, ref)
+		assert.NoError(err)
+		assert.False(ref.Created.IsZero())
+	}
+
+	// Setting a reference again is harmless
+	again := *refs[0]
+	err := ds.SetSiteExternalRef(ctx, &again)
+	assert.NoError(err)
+	assert.Equal(refs[0].Created, again.Created)
+
+	got, err := ds.SiteExternalRefsBySite(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.Len(got, 3)
+	assert.Equal("salesforce", got[0].System)
+	assert.Equal("1001", got[1].ExternalID)
+	assert.Equal("1002", got[2].ExternalID)
+
+	// A single external record may refer to several sites
+	got, err = ds.SiteExternalRefsByExternalID(ctx, "zendesk", "1001")
+	assert.NoError(err)
+	assert.Len(got, 2)
+	got, err = ds.SiteExternalRefsByExternalID(ctx, "zendesk", "1002")
+	assert.NoError(err)
+	assert.Len(got, 1)
+	assert.Equal(testSite1.UUID, got[0].SiteUUID)
+
+	// IDs are scoped to their system
+	got, err = ds.SiteExternalRefsByExternalID(ctx, "salesforce", "1001")
+	assert.NoError(err)
+	assert.Len(got, 0)
+
+	err = ds.DeleteSiteExternalRef(ctx, refs[1])
+	assert.NoError(err)
+	err = ds.DeleteSiteExternalRef(ctx, refs[1])
+	assert.IsType(NotFoundError{}, err)
+	got, err = ds.SiteExternalRefsBySite(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.Len(got, 2)
+
+	// References go away with their site
+	_, err = ds.(*ApplianceDB).ExecContext(ctx,
+		"DELETE FROM customer_site WHERE uuid = $1", testSite2.UUID)
+	assert.NoError(err)
+	got, err = ds.SiteExternalRefsByExternalID(ctx, "zendesk", "1001")
+	assert.NoError(err)
+	assert.Len(got, 1)
+	assert.Equal(testSite1.UUID, got[0].SiteUUID)
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/satori/uuid"
+)
+
+type siteShardManager interface {
+	SetSiteShard(context.Context, uuid.UUID, string) error
+	SiteShard(context.Context, uuid.UUID) (string, error)
+	SitesByShard(context.Context, string) ([]uuid.UUID, error)
+}
+
+// SetSiteShard assigns a site to the cloud shard which is to serve it,
+// replacing any previous assignment.  ForeignKeyError is returned if the site
+// doesn't exist.
+func (db *ApplianceDB) SetSiteShard(ctx context.Context, site uuid.UUID,
+	shard string) error {
+
+	if shard == "" {
+		return ValidationError{"shard", shard, "must not be empty"}
+	}
+
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO site_shard (site_uuid, shard)
+		    VALUES ($1, $2)
+		ON CONFLICT (site_uuid) DO
+		    UPDATE SET (shard, updated_at) = (EXCLUDED.shard, now())
+		    WHERE site_shard.shard IS DISTINCT FROM EXCLUDED.shard`,
+		site, shard)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "foreign_key_violation" {
+		return ForeignKeyError{
+			simpleMessage: fmt.Sprintf("Unknown site UUID %s", site),
+			Message:       pqErr.Message,
+			Detail:        pqErr.Detail,
+			Schema:        pqErr.Schema,
+			Table:         pqErr.Table,
+			Constraint:    pqErr.Constraint,
+		}
+	}
+	return err
+}
+
+// SiteShard returns the name of the cloud shard serving a site.
+// NotFoundError is returned if the site hasn't been assigned to one.
+func (db *ApplianceDB) SiteShard(ctx context.Context, site uuid.UUID) (string, error) {
+	var shard string
+	err := db.GetContext(ctx, &shard, `
+		SELECT shard FROM site_shard
+		WHERE site_uuid = $1`, site)
+	if err == sql.ErrNoRows {
+		return "", NotFoundError{fmt.Sprintf(
+			"SiteShard: no shard assigned to site %v", site)}
+	} else if err != nil {
+		return "", err
+	}
+	return shard, nil
+}
+
+// SitesByShard returns the sites served by a cloud shard
+func (db *ApplianceDB) SitesByShard(ctx context.Context, shard string) ([]uuid.UUID, error) {
+	sites := make([]uuid.UUID, 0)
+	err := db.SelectContext(ctx, &sites, `
+		SELECT site_uuid FROM site_shard
+		WHERE shard = $1
+		ORDER BY site_uuid`, shard)
+	if err != nil {
+		return nil, err
+	}
+	return sites, nil
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/satori/uuid"
+	"github.com/stretchr/testify/require"
+
+	"go.uber.org/zap"
+)
+
+// Test assigning sites to shards.  subtest of TestDatabaseModel
+func testSiteShards(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, nil)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, nil)
+
+	// Nothing assigned yet
+	_, err := ds.SiteShard(ctx, testSite1.UUID)
+	assert.IsType(NotFoundError{}, err)
+	sites, err := ds.SitesByShard(ctx, "shard-a")
+	assert.NoError(err)
+	assert.Empty(sites)
+
+	err = ds.SetSiteShard(ctx, testSite1.UUID, "")
+	assert.IsType(ValidationError{}, err)
+	err = ds.SetSiteShard(ctx, badUUID, "shard-a")
+	assert.IsType(ForeignKeyError{}, err)
+
+	assert.NoError(ds.SetSiteShard(ctx, testSite1.UUID, "shard-a"))
+	assert.NoError(ds.SetSiteShard(ctx, testSite2.UUID, "shard-a"))
+	shard, err := ds.SiteShard(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.Equal("shard-a", shard)
+
+	// Reverse lookup finds every site on the shard, and only those
+	sites, err = ds.SitesByShard(ctx, "shard-a")
+	assert.NoError(err)
+	assert.ElementsMatch([]uuid.UUID{testSite1.UUID, testSite2.UUID}, sites)
+	sites, err = ds.SitesByShard(ctx, "shard-b")
+	assert.NoError(err)
+	assert.Empty(sites)
+
+	// Moving a site replaces its assignment; setting the same one again is
+	// harmless.
+	assert.NoError(ds.SetSiteShard(ctx, testSite2.UUID, "shard-b"))
+	assert.NoError(ds.SetSiteShard(ctx, testSite2.UUID, "shard-b"))
+	shard, err = ds.SiteShard(ctx, testSite2.UUID)
+	assert.NoError(err)
+	assert.Equal("shard-b", shard)
+	sites, err = ds.SitesByShard(ctx, "shard-a")
+	assert.NoError(err)
+	assert.Equal([]uuid.UUID{testSite1.UUID}, sites)
+	sites, err = ds.SitesByShard(ctx, "shard-b")
+	assert.NoError(err)
+	assert.Equal([]uuid.UUID{testSite2.UUID}, sites)
+}
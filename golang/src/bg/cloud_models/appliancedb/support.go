@@ -0,0 +1,222 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/lib/pq"
+	"github.com/satori/uuid"
+)
+
+// Scopes of a support grant
+const (
+	SupportScopeReadOnly  = "read-only"
+	SupportScopeReadWrite = "read-write"
+)
+
+// MaxSupportGrantDuration is the longest time for which a support grant may
+// be given
+const MaxSupportGrantDuration = 30 * 24 * time.Hour
+
+type supportManager interface {
+	InsertSupportGrant(context.Context, *SupportGrant) error
+	SupportGrantsByOrganization(context.Context, uuid.UUID) ([]SupportGrant, error)
+	ActiveSupportGrant(context.Context, uuid.UUID) (*SupportGrant, error)
+	RevokeSupportGrant(context.Context, uuid.UUID, uuid.UUID, uuid.UUID) error
+	InsertSupportAudit(context.Context, *SupportAudit) error
+	SupportAuditByOrganization(context.Context, uuid.UUID) ([]SupportAudit, error)
+}
+
+// SupportGrant represents a row in the support_grant table: an organization's
+// consent for accounts in its support organization to act within it, until the
+// grant expires or is revoked.
+type SupportGrant struct {
+	UUID             uuid.UUID     `json:"uuid" db:"uuid"`
+	OrganizationUUID uuid.UUID     `json:"organizationUUID" db:"organization_uuid"`
+	GrantedBy        uuid.NullUUID `json:"grantedBy" db:"granted_by"`
+	Scope            string        `json:"scope" db:"scope"`
+	CreatedAt        time.Time     `json:"createdAt" db:"created_at"`
+	ExpiresAt        time.Time     `json:"expiresAt" db:"expires_at"`
+	RevokedAt        null.Time     `json:"revokedAt" db:"revoked_at"`
+	RevokedBy        uuid.NullUUID `json:"revokedBy" db:"revoked_by"`
+}
+
+// ReadOnly returns true if the grant only permits support staff to look
+func (g *SupportGrant) ReadOnly() bool {
+	return g.Scope != SupportScopeReadWrite
+}
+
+// Active returns true if the grant gives access at the given time
+func (g *SupportGrant) Active(t time.Time) bool {
+	return !g.RevokedAt.Valid && t.Before(g.ExpiresAt)
+}
+
+// SupportAudit represents a row in the support_audit table: a request made by
+// a support account under a support grant.
+type SupportAudit struct {
+	ID               int64         `json:"id" db:"id"`
+	GrantUUID        uuid.UUID     `json:"grantUUID" db:"grant_uuid"`
+	AccountUUID      uuid.UUID     `json:"accountUUID" db:"account_uuid"`
+	GrantedBy        uuid.NullUUID `json:"grantedBy" db:"granted_by"`
+	OrganizationUUID uuid.UUID     `json:"organizationUUID" db:"organization_uuid"`
+	Method           string        `json:"method" db:"method"`
+	Path             string        `json:"path" db:"path"`
+	Allowed          bool          `json:"allowed" db:"allowed"`
+	Timestamp        time.Time     `json:"timestamp" db:"ts"`
+}
+
+// InsertSupportGrant records a new support grant.  If the grant's UUID or
+// CreatedAt are unset, they are filled in.  ValidationError is returned if the
+// scope is unknown, or if the grant doesn't expire after it is created and
+// within MaxSupportGrantDuration; ForeignKeyError is returned if the
+// organization or granting account doesn't exist.
+func (db *ApplianceDB) InsertSupportGrant(ctx context.Context,
+	grant *SupportGrant) error {
+
+	if grant.Scope != SupportScopeReadOnly &&
+		grant.Scope != SupportScopeReadWrite {
+		return ValidationError{"scope", grant.Scope, fmt.Sprintf(
+			"must be %s or %s", SupportScopeReadOnly,
+			SupportScopeReadWrite)}
+	}
+	if grant.UUID == uuid.Nil {
+		grant.UUID = uuid.NewV4()
+	}
+	if grant.CreatedAt.IsZero() {
+		grant.CreatedAt = time.Now()
+	}
+	d := grant.ExpiresAt.Sub(grant.CreatedAt)
+	if d <= 0 || d > MaxSupportGrantDuration {
+		return ValidationError{"expires", grant.ExpiresAt.String(),
+			fmt.Sprintf("must be within %v of creation",
+				MaxSupportGrantDuration)}
+	}
+
+	_, err := db.NamedExecContext(ctx, `
+		INSERT INTO support_grant
+		    (uuid, organization_uuid, granted_by, scope, created_at,
+		     expires_at)
+		VALUES
+		    (:uuid, :organization_uuid, :granted_by, :scope, :created_at,
+		     :expires_at)`, grant)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "foreign_key_violation" {
+		return ForeignKeyError{
+			simpleMessage: fmt.Sprintf(
+				"Unknown organization %s or account %v",
+				grant.OrganizationUUID, grant.GrantedBy.UUID),
+			Message:    pqErr.Message,
+			Detail:     pqErr.Detail,
+			Schema:     pqErr.Schema,
+			Table:      pqErr.Table,
+			Constraint: pqErr.Constraint,
+		}
+	}
+	return err
+}
+
+// SupportGrantsByOrganization returns all of an organization's support grants,
+// including expired and revoked ones, newest first.
+func (db *ApplianceDB) SupportGrantsByOrganization(ctx context.Context,
+	org uuid.UUID) ([]SupportGrant, error) {
+
+	grants := make([]SupportGrant, 0)
+	err := db.SelectContext(ctx, &grants, `
+		SELECT * FROM support_grant
+		WHERE organization_uuid = $1
+		ORDER BY created_at DESC`, org)
+	if err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+// ActiveSupportGrant returns the most recently created of an organization's
+// support grants which has neither expired nor been revoked.  NotFoundError is
+// returned if there is none.
+func (db *ApplianceDB) ActiveSupportGrant(ctx context.Context,
+	org uuid.UUID) (*SupportGrant, error) {
+
+	var grant SupportGrant
+	err := db.GetContext(ctx, &grant, `
+		SELECT * FROM support_grant
+		WHERE organization_uuid = $1 AND
+		    revoked_at IS NULL AND
+		    expires_at > now()
+		ORDER BY created_at DESC
+		LIMIT 1`, org)
+	switch err {
+	case sql.ErrNoRows:
+		return nil, NotFoundError{fmt.Sprintf(
+			"ActiveSupportGrant: no active grant for %v", org)}
+	case nil:
+		return &grant, nil
+	default:
+		return nil, err
+	}
+}
+
+// RevokeSupportGrant ends one of an organization's support grants before it
+// expires, recording the account which revoked it.  NotFoundError is returned
+// if the organization has no such grant, or if it has already been revoked.
+func (db *ApplianceDB) RevokeSupportGrant(ctx context.Context,
+	org uuid.UUID, grantUUID uuid.UUID, by uuid.UUID) error {
+
+	res, err := db.ExecContext(ctx, `
+		UPDATE support_grant
+		SET revoked_at = now(), revoked_by = $3
+		WHERE organization_uuid = $1 AND uuid = $2 AND revoked_at IS NULL`,
+		org, grantUUID, by)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return NotFoundError{fmt.Sprintf(
+			"RevokeSupportGrant: Couldn't find grant %v for %v",
+			grantUUID, org)}
+	}
+	return nil
+}
+
+// InsertSupportAudit records a request made under a support grant.  The
+// record's ID and Timestamp are filled in.
+func (db *ApplianceDB) InsertSupportAudit(ctx context.Context,
+	rec *SupportAudit) error {
+
+	row := db.QueryRowContext(ctx, `
+		INSERT INTO support_audit
+		    (grant_uuid, account_uuid, granted_by, organization_uuid,
+		     method, path, allowed)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, ts`,
+		rec.GrantUUID, rec.AccountUUID, rec.GrantedBy,
+		rec.OrganizationUUID, rec.Method, rec.Path, rec.Allowed)
+	return row.Scan(&rec.ID, &rec.Timestamp)
+}
+
+// SupportAuditByOrganization returns the record of requests made by support
+// staff within an organization, newest first.
+func (db *ApplianceDB) SupportAuditByOrganization(ctx context.Context,
+	org uuid.UUID) ([]SupportAudit, error) {
+
+	recs := make([]SupportAudit, 0)
+	err := db.SelectContext(ctx, &recs, `
+		SELECT * FROM support_audit
+		WHERE organization_uuid = $1
+		ORDER BY ts DESC, id DESC`, org)
+	if err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/satori/uuid"
+	"github.com/stretchr/testify/require"
+
+	"go.uber.org/zap"
+)
+
+// Test support grants and their audit trail.  subtest of TestDatabaseModel
+func testSupportGrants(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	mkOrgSiteApp(t, ds, &testOrg1, nil, nil)
+	mkOrgSiteApp(t, ds, &testMSPOrg1, nil, nil)
+	_ = mkAccount(t, ds, &testPerson1, &testAccount1, []string{"admin"})
+	_ = mkAccount(t, ds, &testMSPPerson1, &testMSPAccount1, nil)
+	grantedBy := uuid.NullUUID{UUID: testAccount1.UUID, Valid: true}
+
+	_, err := ds.ActiveSupportGrant(ctx, testOrg1.UUID)
+	assert.IsType(NotFoundError{}, err)
+	grants, err := ds.SupportGrantsByOrganization(ctx, testOrg1.UUID)
+	assert.NoError(err)
+	assert.Empty(grants)
+
+	// Bad scope or duration
+	now := time.Now()
+	bad := []SupportGrant{
+		{Scope: "everything", ExpiresAt: now.Add(time.Hour)},
+		{Scope: SupportScopeReadOnly, ExpiresAt: now.Add(-time.Hour)},
+		{Scope: SupportScopeReadOnly,
+			ExpiresAt: now.Add(MaxSupportGrantDuration + time.Hour)},
+	}
+	for _, g := range bad {
+		g.OrganizationUUID = testOrg1.UUID
+		g.GrantedBy = grantedBy
+		err = ds.InsertSupportGrant(ctx, &g)
+		assert.IsType(ValidationError{}, err, "%v", g)
+	}
+
+	// A grant which has already expired
+	expired := SupportGrant{
+		OrganizationUUID: testOrg1.UUID,
+		GrantedBy:        grantedBy,
+		Scope:            SupportScopeReadWrite,
+		CreatedAt:        now.Add(-2 * time.Hour),
+		ExpiresAt:        now.Add(-time.Hour),
+	}
+	err = ds.InsertSupportGrant(ctx, &expired)
+	assert.NoError(err)
+	assert.NotEqual(uuid.Nil, expired.UUID)
+	_, err = ds.ActiveSupportGrant(ctx, testOrg1.UUID)
+	assert.IsType(NotFoundError{}, err)
+
+	ro := SupportGrant{
+		OrganizationUUID: testOrg1.UUID,
+		GrantedBy:        grantedBy,
+		Scope:            SupportScopeReadOnly,
+		ExpiresAt:        now.Add(time.Hour),
+	}
+	err = ds.InsertSupportGrant(ctx, &ro)
+	assert.NoError(err)
+	g, err := ds.ActiveSupportGrant(ctx, testOrg1.UUID)
+	assert.NoError(err)
+	assert.Equal(ro.UUID, g.UUID)
+	assert.True(g.ReadOnly())
+	assert.True(g.Active(time.Now()))
+	assert.False(g.Active(now.Add(2 * time.Hour)))
+
+	// Other organizations are unaffected
+	_, err = ds.ActiveSupportGrant(ctx, testMSPOrg1.UUID)
+	assert.IsType(NotFoundError{}, err)
+
+	// Both the grant and its audit trail identify both accounts
+	rec := SupportAudit{
+		GrantUUID:        g.UUID,
+		AccountUUID:      testMSPAccount1.UUID,
+		GrantedBy:        g.GrantedBy,
+		OrganizationUUID: testOrg1.UUID,
+		Method:           "GET",
+		Path:             "/api/org/" + testOrg1.UUID.String() + "/accounts",
+		Allowed:          true,
+	}
+	err = ds.InsertSupportAudit(ctx, &rec)
+	assert.NoError(err)
+	assert.NotZero(rec.ID)
+	recs, err := ds.SupportAuditByOrganization(ctx, testOrg1.UUID)
+	assert.NoError(err)
+	assert.Len(recs, 1)
+	assert.Equal(testMSPAccount1.UUID, recs[0].AccountUUID)
+	assert.Equal(testAccount1.UUID, recs[0].GrantedBy.UUID)
+	assert.Equal(rec.Path, recs[0].Path)
+	assert.True(recs[0].Allowed)
+
+	// Revocation ends the grant, and can only be done once
+	err = ds.RevokeSupportGrant(ctx, testMSPOrg1.UUID, ro.UUID,
+		testAccount1.UUID)
+	assert.IsType(NotFoundError{}, err)
+	err = ds.RevokeSupportGrant(ctx, testOrg1.UUID, ro.UUID,
+		testAccount1.UUID)
+	assert.NoError(err)
+	err = ds.RevokeSupportGrant(ctx, testOrg1.UUID, ro.UUID,
+		testAccount1.UUID)
+	assert.IsType(NotFoundError{}, err)
+	_, err = ds.ActiveSupportGrant(ctx, testOrg1.UUID)
+	assert.IsType(NotFoundError{}, err)
+
+	grants, err = ds.SupportGrantsByOrganization(ctx, testOrg1.UUID)
+	assert.NoError(err)
+	assert.Len(grants, 2)
+	assert.Equal(ro.UUID, grants[0].UUID)
+	assert.True(grants[0].RevokedAt.Valid)
+	assert.Equal(testAccount1.UUID, grants[0].RevokedBy.UUID)
+	assert.False(grants[0].Active(time.Now()))
+	assert.Equal(expired.UUID, grants[1].UUID)
+
+	err = ds.InsertSupportGrant(ctx, &SupportGrant{
+		OrganizationUUID: badUUID,
+		Scope:            SupportScopeReadOnly,
+		ExpiresAt:        now.Add(time.Hour),
+	})
+	assert.IsType(ForeignKeyError{}, err)
+
+	// The audit trail outlives the grants, which are deleted along with
+	// the organization
+	adb := ds.(*ApplianceDB)
+	_, err = adb.ExecContext(ctx,
+		`DELETE FROM support_grant WHERE organization_uuid=$1`,
+		testOrg1.UUID)
+	assert.NoError(err)
+	recs, err = ds.SupportAuditByOrganization(ctx, testOrg1.UUID)
+	assert.NoError(err)
+	assert.Len(recs, 1)
+	assert.Equal(ro.UUID, recs[0].GrantUUID)
+}
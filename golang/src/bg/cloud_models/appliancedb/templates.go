@@ -0,0 +1,208 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+type templateManager interface {
+	NotificationTemplate(context.Context, string, string) (*NotificationTemplate, error)
+	NotificationTemplatesByName(context.Context, string) ([]NotificationTemplate, error)
+	UpsertNotificationTemplate(context.Context, *NotificationTemplate) error
+}
+
+// NotificationTemplate represents a row in the notification_templates table.
+// The subject and body may contain placeholders of the form {name}, which are
+// replaced when the template is rendered.
+type NotificationTemplate struct {
+	Name    string    `db:"name"`
+	Locale  string    `db:"locale"`
+	Subject string    `db:"subject"`
+	Body    string    `db:"body"`
+	Updated time.Time `db:"updated"`
+}
+
+// RenderedNotification is the text of a notification, ready to be sent.  Locale
+// is the locale of the template which was used, which may not be the locale
+// which was asked for.
+type RenderedNotification struct {
+	Locale  string
+	Subject string
+	Body    string
+}
+
+var placeholderRE = regexp.MustCompile(`\{([A-Za-z][A-Za-z0-9_]*)\}`)
+
+// Placeholders returns the names of the placeholders used in the template's
+// subject and body, sorted and without duplicates.
+func (t *NotificationTemplate) Placeholders() []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for _, text := range []string{t.Subject, t.Body} {
+		for _, m := range placeholderRE.FindAllStringSubmatch(text, -1) {
+			if !seen[m[1]] {
+				seen[m[1]] = true
+				names = append(names, m[1])
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Render substitutes values into the template's placeholders.  Placeholders
+// for which no value is given are left as they are, so that the omission is
+// apparent to the recipient.
+func (t *NotificationTemplate) Render(vars map[string]string) *RenderedNotification {
+	subst := func(m string) string {
+		if v, ok := vars[m[1:len(m)-1]]; ok {
+			return v
+		}
+		return m
+	}
+	return &RenderedNotification{
+		Locale:  t.Locale,
+		Subject: placeholderRE.ReplaceAllStringFunc(t.Subject, subst),
+		Body:    placeholderRE.ReplaceAllStringFunc(t.Body, subst),
+	}
+}
+
+// ValidateTranslation checks that a translation uses every placeholder which
+// its base template (the template of the same name in DefaultLocale) does,
+// returning a ValidationError naming the missing placeholders if not.
+func ValidateTranslation(base, translation *NotificationTemplate) error {
+	have := make(map[string]bool)
+	for _, p := range translation.Placeholders() {
+		have[p] = true
+	}
+	missing := make([]string, 0)
+	for _, p := range base.Placeholders() {
+		if !have[p] {
+			missing = append(missing, "{"+p+"}")
+		}
+	}
+	if len(missing) > 0 {
+		return ValidationError{"template",
+			translation.Name + "/" + translation.Locale,
+			"missing placeholders " + strings.Join(missing, ", ")}
+	}
+	return nil
+}
+
+// NotificationTemplateGetter is the subset of DataStore needed to look up
+// notification templates.
+type NotificationTemplateGetter interface {
+	NotificationTemplate(context.Context, string, string) (*NotificationTemplate, error)
+}
+
+// RenderNotification renders the named notification for a recipient in the
+// given locale.  If there is no template for the locale, the template for its
+// base language is used, and failing that, the template for DefaultLocale.
+// NotFoundError is returned if none of them exist.
+func RenderNotification(ctx context.Context, db NotificationTemplateGetter,
+	name, locale string, vars map[string]string) (*RenderedNotification, error) {
+
+	for _, l := range localeFallbacks(locale) {
+		t, err := db.NotificationTemplate(ctx, name, l)
+		if err == nil {
+			return t.Render(vars), nil
+		}
+		if _, ok := err.(NotFoundError); !ok {
+			return nil, err
+		}
+	}
+	return nil, NotFoundError{fmt.Sprintf(
+		"RenderNotification: no template %s for %s", name, locale)}
+}
+
+// NotificationTemplate returns the template with the given name for exactly the
+// given locale.  Most callers want RenderNotification instead.
+func (db *ApplianceDB) NotificationTemplate(ctx context.Context,
+	name, locale string) (*NotificationTemplate, error) {
+
+	var t NotificationTemplate
+	err := db.GetContext(ctx, &t, `
+		SELECT * FROM notification_templates
+		WHERE name = $1 AND locale = $2`, name, locale)
+	switch err {
+	case sql.ErrNoRows:
+		return nil, NotFoundError{fmt.Sprintf(
+			"NotificationTemplate: no template %s for %s", name, locale)}
+	case nil:
+		return &t, nil
+	default:
+		return nil, err
+	}
+}
+
+// NotificationTemplatesByName returns all of the translations of the named
+// template, sorted by locale.
+func (db *ApplianceDB) NotificationTemplatesByName(ctx context.Context,
+	name string) ([]NotificationTemplate, error) {
+
+	var ts []NotificationTemplate
+	err := db.SelectContext(ctx, &ts, `
+		SELECT * FROM notification_templates
+		WHERE name = $1
+		ORDER BY locale`, name)
+	if err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// UpsertNotificationTemplate creates or replaces a template.  The locale is
+// normalized in place, and must be supported, or the bare language of a
+// supported locale.  A translation may only be stored once the template exists
+// in DefaultLocale, and must use all of the placeholders which that template
+// does; ValidationError is returned otherwise.  The template's Updated field is
+// filled in from the database.
+func (db *ApplianceDB) UpsertNotificationTemplate(ctx context.Context,
+	t *NotificationTemplate) error {
+
+	locale, err := normalizeTemplateLocale(t.Locale)
+	if err != nil {
+		return err
+	}
+	t.Locale = locale
+
+	if t.Locale != DefaultLocale {
+		base, err := db.NotificationTemplate(ctx, t.Name, DefaultLocale)
+		if _, ok := err.(NotFoundError); ok {
+			return ValidationError{"template", t.Name,
+				"no " + DefaultLocale + " template to translate"}
+		} else if err != nil {
+			return err
+		}
+		if err = ValidateTranslation(base, t); err != nil {
+			return err
+		}
+	}
+
+	row := db.QueryRowContext(ctx, `
+		INSERT INTO notification_templates
+		    (name, locale, subject, body)
+		    VALUES ($1, $2, $3, $4)
+		ON CONFLICT (name, locale)
+		DO UPDATE SET
+		    subject = EXCLUDED.subject,
+		    body = EXCLUDED.body,
+		    updated = now()
+		RETURNING updated`,
+		t.Name, t.Locale, t.Subject, t.Body)
+	return row.Scan(&t.Updated)
+}
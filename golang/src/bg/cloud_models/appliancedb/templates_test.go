@@ -0,0 +1,229 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.uber.org/zap"
+)
+
+// mapTemplates serves notification templates from memory, keyed by
+// "name/locale", and records the locales it was asked for.
+type mapTemplates struct {
+	templates map[string]*NotificationTemplate
+	asked     []string
+	err       error
+}
+
+func (m *mapTemplates) NotificationTemplate(ctx context.Context, name, locale string) (*NotificationTemplate, error) {
+	m.asked = append(m.asked, locale)
+	if m.err != nil {
+		return nil, m.err
+	}
+	if t, ok := m.templates[name+"/"+locale]; ok {
+		return t, nil
+	}
+	return nil, NotFoundError{"not found"}
+}
+
+func (m *mapTemplates) add(name, locale, subject, body string) {
+	m.templates[name+"/"+locale] = &NotificationTemplate{
+		Name:    name,
+		Locale:  locale,
+		Subject: subject,
+		Body:    body,
+	}
+}
+
+func TestRenderNotification(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+
+	m := &mapTemplates{templates: make(map[string]*NotificationTemplate)}
+	m.add("alert", "en-US", "Alert at {site}", "{message}")
+	m.add("alert", "de", "Alarm bei {site}", "{message}")
+	m.add("alert", "de-CH", "Alarm bei {site} (CH)", "{message}")
+	m.add("alert", "fr-FR", "Alerte à {site}", "{message}")
+	vars := map[string]string{"site": "Scranton", "message": "hello"}
+
+	testCases := []struct {
+		locale  string
+		used    string
+		subject string
+		asked   []string
+	}{
+		// Exact match
+		{"fr-FR", "fr-FR", "Alerte à Scranton", []string{"fr-FR"}},
+		// Falls back to the base language
+		{"de-DE", "de", "Alarm bei Scranton", []string{"de-DE", "de"}},
+		// Falls back to the default, skipping other regions of the
+		// same language
+		{"fr-CA", "en-US", "Alert at Scranton",
+			[]string{"fr-CA", "fr", "en-US"}},
+		{"ja-JP", "en-US", "Alert at Scranton",
+			[]string{"ja-JP", "ja", "en-US"}},
+		{"", "en-US", "Alert at Scranton", []string{"en-US"}},
+		// Unsupported locales go straight to the default
+		{"pt-BR", "en-US", "Alert at Scranton", []string{"en-US"}},
+	}
+	for _, tc := range testCases {
+		m.asked = nil
+		r, err := RenderNotification(ctx, m, "alert", tc.locale, vars)
+		assert.NoError(err, "%q", tc.locale)
+		assert.Equal(tc.used, r.Locale, "%q", tc.locale)
+		assert.Equal(tc.subject, r.Subject, "%q", tc.locale)
+		assert.Equal("hello", r.Body, "%q", tc.locale)
+		assert.Equal(tc.asked, m.asked, "%q", tc.locale)
+	}
+
+	// No template at all
+	_, err := RenderNotification(ctx, m, "missing", "de-DE", vars)
+	assert.IsType(NotFoundError{}, err)
+
+	// Other errors stop the search
+	m.asked = nil
+	m.err = fmt.Errorf("database unavailable")
+	_, err = RenderNotification(ctx, m, "alert", "de-DE", vars)
+	assert.Equal(m.err, err)
+	assert.Equal([]string{"de-DE"}, m.asked)
+}
+
+func TestRender(t *testing.T) {
+	assert := require.New(t)
+
+	tmpl := &NotificationTemplate{
+		Locale:  "en-US",
+		Subject: "{count} alerts at {site}",
+		Body:    "{site}: {message} {unknown} {not a placeholder}",
+	}
+	assert.Equal([]string{"count", "message", "site", "unknown"},
+		tmpl.Placeholders())
+
+	r := tmpl.Render(map[string]string{
+		"count":   "2",
+		"site":    "Scranton",
+		"message": "{site}",
+	})
+	assert.Equal("2 alerts at Scranton", r.Subject)
+	// Values aren't themselves expanded, and placeholders without values
+	// are left alone.
+	assert.Equal("Scranton: {site} {unknown} {not a placeholder}", r.Body)
+}
+
+func TestValidateTranslation(t *testing.T) {
+	assert := require.New(t)
+
+	base := &NotificationTemplate{
+		Name:    "alert",
+		Locale:  "en-US",
+		Subject: "Alert at {site}",
+		Body:    "{message}",
+	}
+
+	// Placeholders may move between subject and body
+	good := &NotificationTemplate{
+		Name:    "alert",
+		Locale:  "de",
+		Subject: "Alarm",
+		Body:    "{site}: {message}",
+	}
+	assert.NoError(ValidateTranslation(base, good))
+
+	bad := &NotificationTemplate{
+		Name:    "alert",
+		Locale:  "fr-FR",
+		Subject: "Alerte",
+		Body:    "{mesage}",
+	}
+	err := ValidateTranslation(base, bad)
+	assert.IsType(ValidationError{}, err)
+	assert.Equal("alert/fr-FR", err.(ValidationError).Value)
+	assert.Contains(err.Error(), "{message}, {site}")
+}
+
+// Test the notification template store.  subtest of TestDatabaseModel
+func testNotificationTemplates(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	// Translations can't precede the base template
+	de := &NotificationTemplate{
+		Name:    "test-alert",
+		Locale:  "de",
+		Subject: "Alarm bei {site}",
+		Body:    "{message}",
+	}
+	err := ds.UpsertNotificationTemplate(ctx, de)
+	assert.IsType(ValidationError{}, err)
+
+	base := &NotificationTemplate{
+		Name:    "test-alert",
+		Locale:  "en-us",
+		Subject: "Alert at {site}",
+		Body:    "{message}",
+	}
+	err = ds.UpsertNotificationTemplate(ctx, base)
+	assert.NoError(err)
+	assert.Equal("en-US", base.Locale)
+	assert.False(base.Updated.IsZero())
+
+	err = ds.UpsertNotificationTemplate(ctx, de)
+	assert.NoError(err)
+
+	// Translations missing placeholders, or in unsupported locales, are
+	// rejected
+	fr := &NotificationTemplate{
+		Name:    "test-alert",
+		Locale:  "fr-FR",
+		Subject: "Alerte",
+		Body:    "{message}",
+	}
+	err = ds.UpsertNotificationTemplate(ctx, fr)
+	assert.IsType(ValidationError{}, err)
+	fr.Locale = "pt-BR"
+	fr.Subject = "Alerta em {site}"
+	err = ds.UpsertNotificationTemplate(ctx, fr)
+	assert.IsType(ValidationError{}, err)
+
+	// Upserting replaces
+	de.Subject = "Warnung bei {site}"
+	err = ds.UpsertNotificationTemplate(ctx, de)
+	assert.NoError(err)
+
+	stored, err := ds.NotificationTemplate(ctx, "test-alert", "de")
+	assert.NoError(err)
+	assert.Equal("Warnung bei {site}", stored.Subject)
+	_, err = ds.NotificationTemplate(ctx, "test-alert", "de-DE")
+	assert.IsType(NotFoundError{}, err)
+
+	all, err := ds.NotificationTemplatesByName(ctx, "test-alert")
+	assert.NoError(err)
+	assert.Len(all, 2)
+	assert.Equal("de", all[0].Locale)
+	assert.Equal("en-US", all[1].Locale)
+
+	vars := map[string]string{"site": "Scranton", "message": "hello"}
+	r, err := RenderNotification(ctx, ds, "test-alert", "de-DE", vars)
+	assert.NoError(err)
+	assert.Equal(&RenderedNotification{"de", "Warnung bei Scranton", "hello"}, r)
+	r, err = RenderNotification(ctx, ds, "test-alert", "ja-JP", vars)
+	assert.NoError(err)
+	assert.Equal(&RenderedNotification{"en-US", "Alert at Scranton", "hello"}, r)
+
+	// The templates used by the cloud services are installed with the
+	// schema
+	_, err = ds.NotificationTemplate(ctx, "net-exception", DefaultLocale)
+	assert.NoError(err)
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/satori/uuid"
+)
+
+type usageManager interface {
+	UpsertUsageRollup(context.Context, *UsageRollup) error
+	UsageReport(context.Context, uuid.UUID, time.Time, time.Time) ([]UsageReportRow, error)
+	UpsertSiteUsageDaily(context.Context, uuid.UUID, time.Time, int64, int64) error
+	SiteUsageDaily(context.Context, uuid.UUID, time.Time, time.Time) ([]SiteUsageDay, error)
+}
+
+// UsageRollup represents a row in the api_usage table: the API calls made by
+// a single account, against a single class of endpoints, during one hour.
+type UsageRollup struct {
+	OrganizationUUID uuid.UUID `db:"organization_uuid"`
+	AccountUUID      uuid.UUID `db:"account_uuid"`
+	EndpointClass    string    `db:"endpoint_class"`
+	Hour             time.Time `db:"hour"`
+	Count            int64     `db:"request_count"`
+	Bytes            int64     `db:"bytes"`
+}
+
+// UsageReportRow summarizes an organization's API calls against a single class
+// of endpoints during one (UTC) day.
+type UsageReportRow struct {
+	Day           time.Time `db:"day" json:"day"`
+	EndpointClass string    `db:"endpoint_class" json:"endpointClass"`
+	Count         int64     `db:"request_count" json:"count"`
+	Bytes         int64     `db:"bytes" json:"bytes"`
+}
+
+// SiteUsageDay represents a row in the site_usage_daily table: the traffic
+// between a site and the WAN during one (UTC) day.
+type SiteUsageDay struct {
+	SiteUUID  uuid.UUID `db:"site_uuid" json:"-"`
+	Day       time.Time `db:"day" json:"day"`
+	BytesIn   int64     `db:"bytes_in" json:"bytesIn"`
+	BytesOut  int64     `db:"bytes_out" json:"bytesOut"`
+	UpdatedAt time.Time `db:"updated_at" json:"updatedAt"`
+}
+
+// UpsertUsageRollup adds the counts in the given rollup to the api_usage
+// table.  If a row for the same organization, account, endpoint class and hour
+// already exists, the counts are added to it rather than replacing it, so
+// callers can flush partial rollups as often as they like.  The rollup's hour
+// is truncated to the start of the hour.
+func (db *ApplianceDB) UpsertUsageRollup(ctx context.Context, rollup *UsageRollup) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO api_usage
+		    (organization_uuid, account_uuid, endpoint_class, hour,
+		     request_count, bytes)
+		    VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (organization_uuid, hour, endpoint_class, account_uuid)
+		DO UPDATE SET
+		    request_count = api_usage.request_count + EXCLUDED.request_count,
+		    bytes = api_usage.bytes + EXCLUDED.bytes`,
+		rollup.OrganizationUUID,
+		rollup.AccountUUID,
+		rollup.EndpointClass,
+		rollup.Hour.UTC().Truncate(time.Hour),
+		rollup.Count,
+		rollup.Bytes)
+	return err
+}
+
+// UsageReport returns an organization's API usage for the hours in [from, to),
+// summed across accounts and grouped by UTC day and endpoint class.
+func (db *ApplianceDB) UsageReport(ctx context.Context, org uuid.UUID, from, to time.Time) ([]UsageReportRow, error) {
+	var rows []UsageReportRow
+	err := db.SelectContext(ctx, &rows, `
+		SELECT
+		    date_trunc('day', hour AT TIME ZONE 'UTC') AT TIME ZONE 'UTC' AS day,
+		    endpoint_class,
+		    sum(request_count)::bigint AS request_count,
+		    sum(bytes)::bigint AS bytes
+		FROM api_usage
+		WHERE organization_uuid = $1 AND hour >= $2 AND hour < $3
+		GROUP BY day, endpoint_class
+		ORDER BY day, endpoint_class`, org, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// UpsertSiteUsageDaily records a site's traffic during the UTC day containing
+// the given time.  Unlike UpsertUsageRollup, it replaces any counts already
+// recorded for the day: the appliance reports running totals for the day, so
+// the latest report supersedes the earlier ones.  ValidationError is returned
+// if either count is negative.
+func (db *ApplianceDB) UpsertSiteUsageDaily(ctx context.Context, site uuid.UUID,
+	day time.Time, bytesIn, bytesOut int64) error {
+
+	if bytesIn < 0 {
+		return ValidationError{"bytesIn",
+			strconv.FormatInt(bytesIn, 10), "must not be negative"}
+	}
+	if bytesOut < 0 {
+		return ValidationError{"bytesOut",
+			strconv.FormatInt(bytesOut, 10), "must not be negative"}
+	}
+
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO site_usage_daily
+		    (site_uuid, day, bytes_in, bytes_out)
+		    VALUES ($1, $2, $3, $4)
+		ON CONFLICT (site_uuid, day)
+		DO UPDATE SET
+		    bytes_in = EXCLUDED.bytes_in,
+		    bytes_out = EXCLUDED.bytes_out,
+		    updated_at = now()`,
+		site, utcDay(day), bytesIn, bytesOut)
+	return err
+}
+
+// SiteUsageDaily returns a site's daily traffic, oldest first, for the UTC
+// days from the one containing from up to, but not including, the one
+// containing to.  Days for which nothing was recorded are omitted.
+func (db *ApplianceDB) SiteUsageDaily(ctx context.Context, site uuid.UUID,
+	from, to time.Time) ([]SiteUsageDay, error) {
+
+	rows := make([]SiteUsageDay, 0)
+	err := db.SelectContext(ctx, &rows, `
+		SELECT *
+		FROM site_usage_daily
+		WHERE site_uuid = $1 AND day >= $2 AND day < $3
+		ORDER BY day`, site, utcDay(from), utcDay(to))
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
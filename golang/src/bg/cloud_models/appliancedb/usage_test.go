@@ -0,0 +1,192 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.uber.org/zap"
+)
+
+func testUsageRollup(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	day := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	rollup := UsageRollup{
+		OrganizationUUID: testOrg1.UUID,
+		AccountUUID:      testAccount1.UUID,
+		EndpointClass:    "site",
+		Hour:             day.Add(9*time.Hour + 17*time.Minute),
+		Count:            3,
+		Bytes:            1000,
+	}
+	// expect to fail because the organization doesn't exist
+	err := ds.UpsertUsageRollup(ctx, &rollup)
+	assert.Error(err)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, &testID2)
+
+	report, err := ds.UsageReport(ctx, testOrg1.UUID, day, day.AddDate(0, 0, 1))
+	assert.NoError(err)
+	assert.Len(report, 0)
+
+	// Upserts into the same hour are additive
+	err = ds.UpsertUsageRollup(ctx, &rollup)
+	assert.NoError(err)
+	again := rollup
+	again.Hour = day.Add(9*time.Hour + 45*time.Minute)
+	again.Count = 2
+	again.Bytes = 500
+	err = ds.UpsertUsageRollup(ctx, &again)
+	assert.NoError(err)
+
+	var count, bytes int64
+	err = ds.(*ApplianceDB).QueryRowContext(ctx, `
+	    SELECT request_count, bytes FROM api_usage
+	    WHERE organization_uuid = $1 AND hour = $2`,
+		testOrg1.UUID, day.Add(9*time.Hour)).Scan(&count, &bytes)
+	assert.NoError(err)
+	assert.Equal(int64(5), count)
+	assert.Equal(int64(1500), bytes)
+
+	// Another account, another hour, and another endpoint class on the
+	// same day; plus some usage on the next day and for another org.
+	other := rollup
+	other.AccountUUID = testAccount2.UUID
+	other.Hour = day.Add(20 * time.Hour)
+	err = ds.UpsertUsageRollup(ctx, &other)
+	assert.NoError(err)
+
+	acct := rollup
+	acct.EndpointClass = "account"
+	acct.Count = 1
+	acct.Bytes = 10
+	err = ds.UpsertUsageRollup(ctx, &acct)
+	assert.NoError(err)
+
+	next := rollup
+	next.Hour = day.AddDate(0, 0, 1).Add(time.Hour)
+	err = ds.UpsertUsageRollup(ctx, &next)
+	assert.NoError(err)
+
+	org2 := rollup
+	org2.OrganizationUUID = testOrg2.UUID
+	err = ds.UpsertUsageRollup(ctx, &org2)
+	assert.NoError(err)
+
+	report, err = ds.UsageReport(ctx, testOrg1.UUID, day, day.AddDate(0, 0, 1))
+	assert.NoError(err)
+	assert.Len(report, 2)
+	assert.True(day.Equal(report[0].Day))
+	assert.Equal("account", report[0].EndpointClass)
+	assert.Equal(int64(1), report[0].Count)
+	assert.Equal(int64(10), report[0].Bytes)
+	assert.True(day.Equal(report[1].Day))
+	assert.Equal("site", report[1].EndpointClass)
+	assert.Equal(int64(8), report[1].Count)
+	assert.Equal(int64(2500), report[1].Bytes)
+
+	report, err = ds.UsageReport(ctx, testOrg1.UUID, day, day.AddDate(0, 0, 7))
+	assert.NoError(err)
+	assert.Len(report, 3)
+	assert.True(day.AddDate(0, 0, 1).Equal(report[2].Day))
+	assert.Equal(int64(3), report[2].Count)
+
+	report, err = ds.UsageReport(ctx, testOrg2.UUID, day, day.AddDate(0, 0, 7))
+	assert.NoError(err)
+	assert.Len(report, 1)
+	assert.Equal(int64(3), report[0].Count)
+}
+
+func testSiteUsageDaily(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	day := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	// expect to fail because the site doesn't exist
+	err := ds.UpsertSiteUsageDaily(ctx, testSite1.UUID, day, 100, 10)
+	assert.Error(err)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, nil)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, nil)
+
+	usage, err := ds.SiteUsageDaily(ctx, testSite1.UUID, day, day.AddDate(0, 0, 7))
+	assert.NoError(err)
+	assert.Len(usage, 0)
+
+	err = ds.UpsertSiteUsageDaily(ctx, testSite1.UUID, day, -1, 10)
+	assert.IsType(ValidationError{}, err)
+	err = ds.UpsertSiteUsageDaily(ctx, testSite1.UUID, day, 100, -1)
+	assert.IsType(ValidationError{}, err)
+
+	// Upserts into the same day replace the earlier counts; any time
+	// during the day will do.
+	err = ds.UpsertSiteUsageDaily(ctx, testSite1.UUID,
+		day.Add(9*time.Hour), 100, 10)
+	assert.NoError(err)
+	err = ds.UpsertSiteUsageDaily(ctx, testSite1.UUID,
+		day.Add(23*time.Hour+59*time.Minute), 5000, 700)
+	assert.NoError(err)
+
+	usage, err = ds.SiteUsageDaily(ctx, testSite1.UUID, day, day.AddDate(0, 0, 1))
+	assert.NoError(err)
+	assert.Len(usage, 1)
+	assert.Equal(testSite1.UUID, usage[0].SiteUUID)
+	assert.True(day.Equal(usage[0].Day))
+	assert.Equal(int64(5000), usage[0].BytesIn)
+	assert.Equal(int64(700), usage[0].BytesOut)
+
+	// A few more days, out of order, plus usage for another site
+	for _, d := range []int{3, 1, 7} {
+		err = ds.UpsertSiteUsageDaily(ctx, testSite1.UUID,
+			day.AddDate(0, 0, d), int64(d*1000), int64(d*100))
+		assert.NoError(err)
+	}
+	err = ds.UpsertSiteUsageDaily(ctx, testSite2.UUID, day, 42, 42)
+	assert.NoError(err)
+
+	// The range covers the days containing from, up to but not including
+	// the day containing to.
+	usage, err = ds.SiteUsageDaily(ctx, testSite1.UUID,
+		day.Add(12*time.Hour), day.AddDate(0, 0, 7).Add(12*time.Hour))
+	assert.NoError(err)
+	assert.Len(usage, 3)
+	for i, d := range []int{0, 1, 3} {
+		assert.True(day.AddDate(0, 0, d).Equal(usage[i].Day))
+	}
+	assert.Equal(int64(1000), usage[1].BytesIn)
+	assert.Equal(int64(300), usage[2].BytesOut)
+
+	usage, err = ds.SiteUsageDaily(ctx, testSite1.UUID,
+		day.AddDate(0, 0, 2), day.AddDate(0, 0, 30))
+	assert.NoError(err)
+	assert.Len(usage, 2)
+	assert.True(day.AddDate(0, 0, 3).Equal(usage[0].Day))
+	assert.True(day.AddDate(0, 0, 7).Equal(usage[1].Day))
+
+	usage, err = ds.SiteUsageDaily(ctx, testSite2.UUID, day, day.AddDate(0, 0, 30))
+	assert.NoError(err)
+	assert.Len(usage, 1)
+	assert.Equal(int64(42), usage[0].BytesIn)
+
+	// Usage goes away with the site
+	_, err = ds.(*ApplianceDB).ExecContext(ctx,
+		"DELETE FROM customer_site WHERE uuid = $1", testSite2.UUID)
+	assert.NoError(err)
+	usage, err = ds.SiteUsageDaily(ctx, testSite2.UUID, day, day.AddDate(0, 0, 30))
+	assert.NoError(err)
+	assert.Len(usage, 0)
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Every timestamp in the schema is a timestamptz, so each one names an
+// unambiguous instant.  However, lib/pq hands back times in the session's time
+// zone (or in an anonymous fixed zone, if Go's zone database disagrees with the
+// server's), and a time.Time carries its location around with it: it shows up
+// in String(), in JSON, and in == and reflect.DeepEqual comparisons.  To keep
+// the server's configuration from leaking into the rest of the system, the
+// connections we hand to database/sql are wrapped so that every time.Time
+// scanned out of a row is normalized to UTC.
+
+// utcConnector wraps a driver.Connector so that the connections it makes
+// return times in UTC.
+type utcConnector struct {
+	driver.Connector
+}
+
+func (c utcConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &utcConn{conn}, nil
+}
+
+// utcConn wraps a driver.Conn, passing through the optional interfaces
+// database/sql looks for, and wrapping the statements and rows it returns.
+type utcConn struct {
+	driver.Conn
+}
+
+func (c *utcConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &utcStmt{stmt}, nil
+}
+
+func (c *utcConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	pc, ok := c.Conn.(driver.ConnPrepareContext)
+	if !ok {
+		return c.Prepare(query)
+	}
+	stmt, err := pc.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &utcStmt{stmt}, nil
+}
+
+func (c *utcConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if bc, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return bc.BeginTx(ctx, opts)
+	}
+	if opts.Isolation != 0 || opts.ReadOnly {
+		return nil, fmt.Errorf("driver does not support transaction options")
+	}
+	return c.Conn.Begin()
+}
+
+func (c *utcConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	qc, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		// database/sql will fall back to preparing a statement
+		return nil, driver.ErrSkip
+	}
+	rows, err := qc.QueryContext(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &utcRows{rows}, nil
+}
+
+func (c *utcConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if ec, ok := c.Conn.(driver.ExecerContext); ok {
+		return ec.ExecContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *utcConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *utcConn) ResetSession(ctx context.Context) error {
+	if sr, ok := c.Conn.(driver.SessionResetter); ok {
+		return sr.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *utcConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	// Use database/sql's default conversions
+	return driver.ErrSkip
+}
+
+// utcStmt wraps a driver.Stmt.  lib/pq's statements don't implement the
+// context-aware interfaces, so database/sql always comes through Query().
+type utcStmt struct {
+	driver.Stmt
+}
+
+func (s *utcStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows, err := s.Stmt.Query(args)
+	if err != nil {
+		return nil, err
+	}
+	return &utcRows{rows}, nil
+}
+
+// utcRows wraps a driver.Rows, converting times to UTC as they are read.
+type utcRows struct {
+	driver.Rows
+}
+
+func (r *utcRows) Next(dest []driver.Value) error {
+	if err := r.Rows.Next(dest); err != nil {
+		return err
+	}
+	for i, v := range dest {
+		if t, ok := v.(time.Time); ok {
+			dest[i] = t.UTC()
+		}
+	}
+	return nil
+}
+
+func (r *utcRows) HasNextResultSet() bool {
+	nr, ok := r.Rows.(driver.RowsNextResultSet)
+	return ok && nr.HasNextResultSet()
+}
+
+func (r *utcRows) NextResultSet() error {
+	if nr, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return nr.NextResultSet()
+	}
+	return io.EOF
+}
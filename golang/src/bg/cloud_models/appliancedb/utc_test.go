@@ -0,0 +1,236 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// Zones with offsets which are neither whole hours nor the same sign as each
+// other, so that any confusion between them will be obvious.
+var (
+	zoneChatham = time.FixedZone("CHADT", (13*60+45)*60)
+	zoneStJohns = time.FixedZone("NDT", -(2*60+30)*60)
+)
+
+// A minimal driver which returns a single row holding a time in the Chatham
+// zone and a NULL, through either a prepared statement or directly through
+// QueryerContext.
+type fakeConnector struct {
+	queryer bool
+}
+
+func (c fakeConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	if c.queryer {
+		return &fakeQueryerConn{}, nil
+	}
+	return &fakeConn{}, nil
+}
+
+func (c fakeConnector) Driver() driver.Driver {
+	return nil
+}
+
+type fakeConn struct{}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+type fakeQueryerConn struct {
+	fakeConn
+}
+
+func (c *fakeQueryerConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return &fakeRows{}, nil
+}
+
+type fakeStmt struct{}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(0), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &fakeRows{}, nil
+}
+
+type fakeRows struct {
+	done bool
+}
+
+func (r *fakeRows) Columns() []string {
+	return []string{"ts", "nothing"}
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = time.Date(2020, 3, 9, 12, 0, 0, 0, zoneChatham)
+	dest[1] = nil
+	return nil
+}
+
+func TestUTCRows(t *testing.T) {
+	assert := require.New(t)
+	expected := time.Date(2020, 3, 8, 22, 15, 0, 0, time.UTC)
+
+	for _, queryer := range []bool{false, true} {
+		db := sql.OpenDB(utcConnector{fakeConnector{queryer}})
+
+		var ts time.Time
+		var nothing null.Time
+		err := db.QueryRow("SELECT").Scan(&ts, &nothing)
+		assert.NoError(err)
+		assert.Equal(expected, ts)
+		assert.Equal(time.UTC, ts.Location())
+		assert.False(nothing.Valid)
+
+		var nts null.Time
+		err = db.QueryRow("SELECT").Scan(&nts, &nothing)
+		assert.NoError(err)
+		assert.Equal(null.TimeFrom(expected), nts)
+		db.Close()
+	}
+}
+
+// Make sure that nothing has crept into the schema which records a time of day
+// without saying which instant it refers to.
+func testTimestampColumns(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	var naive []string
+	err := ds.(*ApplianceDB).SelectContext(ctx, &naive, `
+		SELECT table_name || '.' || column_name
+		FROM information_schema.columns
+		WHERE table_schema = 'public' AND data_type IN (
+		    'timestamp without time zone',
+		    'time without time zone',
+		    'time with time zone',
+		    'date')
+		ORDER BY 1`)
+	assert.NoError(err)
+	assert.Empty(naive, "columns should be timestamp with time zone")
+}
+
+// Store times from a variety of zones and make sure the same instants come
+// back, always in UTC.
+func testTimestampRoundTrip(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	ctx := context.Background()
+	assert := require.New(t)
+
+	assertInstant := func(expected, actual time.Time) {
+		assert.True(expected.Equal(actual), "expected %v, got %v",
+			expected, actual)
+		assert.Equal(time.UTC, actual.Location())
+	}
+
+	// Just before midnight in Chatham, which is late morning the day
+	// before in UTC, and evening the day before in St. John's.
+	base := time.Date(2020, 3, 8, 23, 59, 59, 123456000, zoneChatham)
+
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+
+	hb := HeartbeatIngest{
+		ApplianceUUID: testID1.ApplianceUUID,
+		SiteUUID:      testID1.SiteUUID,
+		BootTS:        base.In(zoneStJohns),
+		RecordTS:      base.Add(time.Minute),
+	}
+	err := ds.InsertHeartbeatIngest(ctx, &hb)
+	assert.NoError(err)
+	hbLatest, err := ds.LatestHeartbeatBySiteUUID(ctx, testID1.SiteUUID)
+	assert.NoError(err)
+	assertInstant(hb.BootTS, hbLatest.BootTS)
+	assertInstant(hb.RecordTS, hbLatest.RecordTS)
+
+	acs := SiteConfigStore{
+		RootHash:  hexDecode("cafebeef"),
+		TimeStamp: base.Local(),
+		Config:    hexDecode("deadbeef"),
+	}
+	err = ds.UpsertConfigStore(ctx, testSite1.UUID, &acs)
+	assert.NoError(err)
+	cfg, err := ds.ConfigStoreByUUID(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assertInstant(base, cfg.TimeStamp)
+
+	k := &AppliancePubKey{
+		Format:     "RS256_X509",
+		Key:        "not a real key",
+		Expiration: null.TimeFrom(base),
+	}
+	err = ds.InsertApplianceKeyTx(ctx, nil, testID1.ApplianceUUID, k)
+	assert.NoError(err)
+	keys, err := ds.KeysByUUID(ctx, testID1.ApplianceUUID)
+	assert.NoError(err)
+	assert.Len(keys, 1)
+	assert.True(keys[0].Expiration.Valid)
+	assertInstant(base, keys[0].Expiration.Time)
+
+	// Times computed by the server, rather than stored, come back as UTC
+	// as well.  The usage report groups by UTC day, whatever the zone of
+	// the session or of the caller.
+	rollup := UsageRollup{
+		OrganizationUUID: testOrg1.UUID,
+		AccountUUID:      testAccount1.UUID,
+		EndpointClass:    "site",
+		Hour:             base,
+		Count:            1,
+		Bytes:            10,
+	}
+	err = ds.UpsertUsageRollup(ctx, &rollup)
+	assert.NoError(err)
+	day := time.Date(2020, 3, 8, 0, 0, 0, 0, time.UTC)
+	report, err := ds.UsageReport(ctx, testOrg1.UUID,
+		day.In(zoneChatham), day.AddDate(0, 0, 1).In(zoneStJohns))
+	assert.NoError(err)
+	assert.Len(report, 1)
+	assertInstant(day, report[0].Day)
+
+	var now time.Time
+	err = ds.(*ApplianceDB).GetContext(ctx, &now, `SELECT now()`)
+	assert.NoError(err)
+	assert.WithinDuration(time.Now(), now, time.Minute)
+	assert.Equal(time.UTC, now.Location())
+}
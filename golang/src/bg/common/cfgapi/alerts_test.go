@@ -0,0 +1,112 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package cfgapi_test
+
+import (
+	"testing"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+
+	"github.com/stretchr/testify/require"
+)
+
+// alertConfig returns a config in which every event type has a rule, as
+// returned by GetAlertConfig
+func alertConfig(rules map[string]cfgapi.AlertRule, channels ...string) cfgapi.AlertConfig {
+	a := cfgapi.AlertConfig{
+		Events:   make(map[string]cfgapi.AlertRule),
+		Channels: append(make([]string, 0), channels...),
+	}
+	for _, event := range cfgapi.AlertEventTypes {
+		a.Events[event] = rules[event]
+	}
+	return a
+}
+
+func TestAlertConfig(t *testing.T) {
+	assert := require.New(t)
+	me := mockcfg.NewMockExecEmptyTree()
+	hdl := cfgapi.NewHandle(me)
+
+	// No policy at all: nothing notifies
+	a, err := hdl.GetAlertConfig()
+	assert.NoError(err)
+	assert.Equal(alertConfig(nil), *a)
+
+	// Round trip
+	configs := []cfgapi.AlertConfig{
+		alertConfig(map[string]cfgapi.AlertRule{
+			cfgapi.AlertRogueAP:     {Notify: true},
+			cfgapi.AlertBadPassword: {Notify: true, Threshold: 5},
+		}, cfgapi.AlertChannelEmail),
+		alertConfig(map[string]cfgapi.AlertRule{
+			cfgapi.AlertNewDevice: {Notify: true, Threshold: 1},
+			cfgapi.AlertBlockedIP: {Notify: false, Threshold: 10},
+		}, cfgapi.AlertChannelPush, cfgapi.AlertChannelSMS),
+		alertConfig(nil),
+	}
+	for _, config := range configs {
+		assert.NoError(hdl.SetAlertConfig(&config))
+		a, err = hdl.GetAlertConfig()
+		assert.NoError(err)
+		assert.Equal(config, *a)
+	}
+
+	// Event types left out of the config are turned off
+	err = hdl.SetAlertConfig(&cfgapi.AlertConfig{
+		Events: map[string]cfgapi.AlertRule{
+			cfgapi.AlertVulnerability: {Notify: true, Threshold: 2},
+		},
+	})
+	assert.NoError(err)
+	a, err = hdl.GetAlertConfig()
+	assert.NoError(err)
+	assert.Equal(alertConfig(map[string]cfgapi.AlertRule{
+		cfgapi.AlertVulnerability: {Notify: true, Threshold: 2},
+	}), *a)
+	assert.NoError(me.PropEq("@/policy/alerts/events/rogue_ap/notify",
+		"false"))
+	assert.NoError(me.PropEq("@/policy/alerts/channels", ""))
+
+	// Bad configs are rejected without changing anything
+	bad := []*cfgapi.AlertConfig{
+		nil,
+		{Events: map[string]cfgapi.AlertRule{
+			"reactor_meltdown": {Notify: true}}},
+		{Events: map[string]cfgapi.AlertRule{
+			cfgapi.AlertRogueAP: {Notify: true, Threshold: -1}}},
+		{Events: map[string]cfgapi.AlertRule{
+			cfgapi.AlertRogueAP: {Notify: true,
+				Threshold: cfgapi.MaxAlertThreshold + 1}}},
+		{Channels: []string{"carrier-pigeon"}},
+		{Channels: []string{cfgapi.AlertChannelSMS,
+			cfgapi.AlertChannelSMS}},
+	}
+	for _, config := range bad {
+		assert.Error(hdl.SetAlertConfig(config))
+	}
+	a, err = hdl.GetAlertConfig()
+	assert.NoError(err)
+	assert.Equal(cfgapi.AlertRule{Notify: true, Threshold: 2},
+		a.Events[cfgapi.AlertVulnerability])
+
+	// Settings for unknown event types are ignored, but a malformed
+	// setting for a known one is an error.
+	assert.NoError(hdl.CreateProp(
+		"@/policy/alerts/events/reactor_meltdown/notify", "true", nil))
+	a, err = hdl.GetAlertConfig()
+	assert.NoError(err)
+	assert.NotContains(a.Events, "reactor_meltdown")
+	assert.NoError(hdl.CreateProp(
+		"@/policy/alerts/events/rogue_ap/threshold", "lots", nil))
+	_, err = hdl.GetAlertConfig()
+	assert.Error(err)
+}
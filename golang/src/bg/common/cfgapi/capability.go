@@ -0,0 +1,255 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package cfgapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// The cloud manages appliances running a range of software releases, many of
+// which speak an older version of the config API than this one.  Rather than
+// scattering version checks through the clients, the versions in which each
+// operation and feature is available are recorded in the tables below.  Every
+// set of operations submitted through a Handle is checked against the remote's
+// version before it is sent, and any operation the remote can't perform is
+// rejected with ErrUnsupportedByRemote.
+//
+// When an operation isn't supported by the remote, the fallbacks are:
+//
+//	TreeReplace        Rejected.  The tree can't be replaced atomically using
+//	                   the older operations.
+//	AddPropValidation  Rejected.  Older configds have a fixed set of property
+//	                   types.
+//	PropTestEq         Rejected, unless the handle has been told to emulate it
+//	                   with EmulateTestEq.
+//
+// Features describe the meaning of properties rather than the operations used
+// to manipulate them, so they aren't enforced by Execute.  Clients should
+// consult GetFeatures before relying on one.
+
+// versionRange is an inclusive range of config API versions.  A 'last' of 0
+// indicates that the capability is still supported.
+type versionRange struct {
+	first int32
+	last  int32
+}
+
+func (r versionRange) contains(v int32) bool {
+	return v >= r.first && (r.last == 0 || v <= r.last)
+}
+
+// The oldest version in the capability matrix.  Operations available since
+// then are assumed to be supported by any remote we might encounter.
+const baseVersion = int32(1)
+
+var opVersions = map[int]versionRange{
+	PropGet:           {first: baseVersion},
+	PropSet:           {first: baseVersion},
+	PropCreate:        {first: baseVersion},
+	PropDelete:        {first: baseVersion},
+	PropTest:          {first: baseVersion},
+	AddPropValidation: {first: 12},
+	PropTestEq:        {first: 22},
+	TreeReplace:       {first: 27},
+}
+
+var featureVersions = map[CfgFeature]versionRange{
+	FeatureClientFriendlyName: {first: 25},
+	FeatureVPNConfig:          {first: 28},
+	FeatureUserServerKey:      {first: 34},
+}
+
+// ErrUnsupportedByRemote is returned when an operation is submitted to a
+// remote whose version doesn't support it.
+type ErrUnsupportedByRemote struct {
+	Op         PropertyOp
+	MinVersion int32 // First version supporting the operation
+	MaxVersion int32 // Last version supporting the operation; 0 -> current
+	Remote     int32 // The remote's version
+}
+
+func (e ErrUnsupportedByRemote) Error() string {
+	if e.MaxVersion != 0 && e.Remote > e.MaxVersion {
+		return fmt.Sprintf("%s of %s unsupported after cfgversion %d; "+
+			"remote is at %d", opName[e.Op.Op], e.Op.Name,
+			e.MaxVersion, e.Remote)
+	}
+	return fmt.Sprintf("%s of %s requires cfgversion %d or greater; "+
+		"remote is at %d", opName[e.Op.Op], e.Op.Name, e.MinVersion,
+		e.Remote)
+}
+
+// Unwrap allows callers to treat ErrUnsupportedByRemote as ErrNotSupp
+func (e ErrUnsupportedByRemote) Unwrap() error {
+	return ErrNotSupp
+}
+
+// OpSupported returns true if the given version of the config API supports the
+// operation.  Operations unknown to the matrix are left for the remote to
+// judge, and are reported as supported.
+func OpSupported(op int, version int32) bool {
+	r, ok := opVersions[op]
+	return !ok || r.contains(version)
+}
+
+// FeaturesForVersion returns the features supported by the given version of
+// the config API.
+func FeaturesForVersion(version int32) CfgFeatures {
+	features := make(CfgFeatures)
+	for f, r := range featureVersions {
+		if r.contains(version) {
+			features[f] = true
+		}
+	}
+	return features
+}
+
+// Does support for the operation depend on the remote's version?
+func versionSensitive(op int) bool {
+	r, ok := opVersions[op]
+	return ok && (r.first > baseVersion || r.last != 0)
+}
+
+// RemoteVersion returns the version of the config API spoken by the remote
+// configd, as recorded in its @/cfgversion property.  The version is read the
+// first time it is needed, and cached for the life of the handle.
+func (c *Handle) RemoteVersion() (int32, error) {
+	c.RLock()
+	v, known := c.remoteVersion, c.versionKnown
+	c.RUnlock()
+	if known {
+		return v, nil
+	}
+
+	// The probe is the handle's own business, so it bypasses the
+	// interceptor chain.
+	ops := []PropertyOp{
+		{Op: PropGet, Name: "@/cfgversion"},
+	}
+	tree, err := c.exec.Execute(nil, ops).Wait(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var node PropertyNode
+	if err = json.Unmarshal([]byte(tree), &node); err != nil {
+		return 0, fmt.Errorf("Failed to decode @/cfgversion: %v", err)
+	}
+	val, err := strconv.ParseInt(node.Value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("malformed cfgversion: %s", node.Value)
+	}
+	v = int32(val)
+
+	c.Lock()
+	c.remoteVersion, c.versionKnown = v, true
+	c.Unlock()
+
+	return v, nil
+}
+
+// EmulateTestEq controls the handling of PropTestEq operations bound for a
+// remote too old to support them.  By default they are rejected.  With
+// emulation enabled, the handle reads each such property itself and, if its
+// value matches, substitutes a PropTest for the PropTestEq.  This is not
+// atomic: the property may change between the read and the execution of the
+// remaining operations, so it should only be enabled by callers which can
+// tolerate that.
+func (c *Handle) EmulateTestEq(enable bool) {
+	c.Lock()
+	c.emulateTestEq = enable
+	c.Unlock()
+}
+
+// Returns an ExecFunc which checks a set of operations against the remote's
+// version before passing them to 'next'.
+func (c *Handle) preflight(next ExecFunc) ExecFunc {
+	return func(ctx context.Context, ops []PropertyOp) CmdHdl {
+		check := false
+		for _, op := range ops {
+			check = check || versionSensitive(op.Op)
+		}
+		if !check {
+			return next(ctx, ops)
+		}
+
+		// If we can't determine the remote's version, leave it to the
+		// remote to reject anything it doesn't understand.
+		v, err := c.RemoteVersion()
+		if err != nil {
+			return next(ctx, ops)
+		}
+
+		c.RLock()
+		emulate := c.emulateTestEq
+		c.RUnlock()
+
+		needEmulation := false
+		for _, op := range ops {
+			if OpSupported(op.Op, v) {
+				continue
+			}
+			if op.Op == PropTestEq && emulate {
+				needEmulation = true
+				continue
+			}
+			r := opVersions[op.Op]
+			return &errCmdHdl{ErrUnsupportedByRemote{
+				Op:         op,
+				MinVersion: r.first,
+				MaxVersion: r.last,
+				Remote:     v,
+			}}
+		}
+
+		if needEmulation {
+			if ops, err = emulateTestEq(ctx, ops, next); err != nil {
+				return &errCmdHdl{err}
+			}
+		}
+		return next(ctx, ops)
+	}
+}
+
+// Replace each PropTestEq with a PropTest, after comparing the property's
+// current value with the expected value ourselves.
+func emulateTestEq(ctx context.Context, ops []PropertyOp,
+	next ExecFunc) ([]PropertyOp, error) {
+
+	rewritten := make([]PropertyOp, len(ops))
+	for i, op := range ops {
+		rewritten[i] = op
+		if op.Op != PropTestEq {
+			continue
+		}
+
+		get := []PropertyOp{
+			{Op: PropGet, Name: op.Name},
+		}
+		tree, err := next(ctx, get).Wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var node PropertyNode
+		if err = json.Unmarshal([]byte(tree), &node); err != nil {
+			return nil, fmt.Errorf("Failed to decode %s: %v",
+				op.Name, err)
+		}
+		if node.Value != op.Value {
+			return nil, ErrNotEqual
+		}
+		rewritten[i] = PropertyOp{Op: PropTest, Name: op.Name}
+	}
+
+	return rewritten, nil
+}
@@ -10,17 +10,26 @@
 package cfgapi
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"math/bits"
 	"net"
+	"path"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"bg/base_def"
@@ -37,7 +46,8 @@ const Version = int32(34)
 
 // CmdHdl is returned when one or more operations are submitted to Execute().
 // This handle can be used to check on the status of a pending operation, or to
-// block until the operation completes or times out.
+// block until the operation completes or times out.  A CmdHdl may be shared
+// between goroutines; all of its methods are safe to call concurrently.
 type CmdHdl interface {
 	Status(ctx context.Context) (string, error)
 	Wait(ctx context.Context) (string, error)
@@ -47,6 +57,14 @@ type CmdHdl interface {
 // ConfigExec defines the operations that must be supplied by a
 // platform-specific communications layer, in order to support the
 // platform-independent cfgapi later.
+//
+// Implementations must be safe for concurrent use by multiple goroutines.  In
+// particular, HandleChange, HandleDelete, and HandleExpire may be called at any
+// time, including while events are being delivered and from within a handler.
+// Handlers are invoked from a goroutine owned by the implementation, without
+// any of its locks held; a handler registered while an event is being
+// delivered may or may not see that event.  Close must not be called until all
+// other use of the ConfigExec has finished.
 type ConfigExec interface {
 	Ping(ctx context.Context) error
 	Execute(ctx context.Context, ops []PropertyOp) CmdHdl
@@ -58,9 +76,32 @@ type ConfigExec interface {
 }
 
 // Handle is an opaque handle that encapsulates a connection to *.configd, and
-// which allows cfgapi operations to be executed.
+// which allows cfgapi operations to be executed.  Every operation submitted
+// through the handle passes through its chain of interceptors; see Use.
+// Operations which survive the chain are checked against the remote's version
+// before being sent; see RemoteVersion.
+//
+// A Handle is safe for concurrent use by multiple goroutines, and a single
+// Handle should be shared by all of the goroutines in a process rather than
+// each creating its own.  The Handle itself holds no state other than its
+// interceptor chain and what it knows of the remote's version, so its
+// guarantees are those of its ConfigExec.  A set of
+// operations submitted in one call is applied atomically, but nothing orders
+// calls made from different goroutines; a read-modify-write sequence built from
+// separate calls should use PropTestEq to detect interference.
 type Handle struct {
-	exec ConfigExec
+	exec         ConfigExec
+	interceptors []Interceptor
+
+	remoteVersion int32
+	versionKnown  bool
+	emulateTestEq bool
+
+	treeLimits *TreeLimits
+
+	subscriptions []*subscription
+
+	sync.RWMutex
 }
 
 // AccessLevel represents a level of privilege needed or obtained for configd operations
@@ -177,6 +218,42 @@ type VirtualAP struct {
 	DefaultRing string   `json:"defaultRing"`
 	Rings       []string `json:"rings"`
 	Disabled    bool     `json:"disabled"`
+	Priority    int      `json:"priority"` // 0 -> not configured
+}
+
+// CaptivePortal captures the configuration of the captive portal (splash page)
+// presented to clients joining a virtual access point
+type CaptivePortal struct {
+	Enabled   bool   `json:"enabled"`
+	SplashURL string `json:"splashURL"`
+}
+
+// GuestQuota captures the usage limits applied to a (typically guest) virtual
+// access point.  A zero value means the corresponding usage is unlimited.
+type GuestQuota struct {
+	DailyBytes uint64 `json:"dailyBytes"`
+	MaxClients int    `json:"maxClients"`
+}
+
+// Security types of a virtual access point
+const (
+	SecurityOpen = "open"
+	SecurityPSK  = "psk"
+	SecurityEAP  = "eap"
+)
+
+// NetworkSecurity summarizes how a virtual access point authenticates its
+// clients, without revealing any of its secrets.  Configured indicates whether
+// the credentials its security type depends on (a passphrase for PSK, the
+// RADIUS secret for EAP) are present.
+type NetworkSecurity struct {
+	VAP        string `json:"vap"`
+	SSID       string `json:"ssid"`
+	KeyMgmt    string `json:"keyMgmt"`
+	Security   string `json:"security"`
+	Configured bool   `json:"configured"`
+	Open       bool   `json:"open"`
+	Disabled   bool   `json:"disabled"`
 }
 
 // WifiInfo contains both the configured and actual band, channel, and channel
@@ -199,6 +276,7 @@ type WifiInfo struct {
 
 // NicInfo contains all the per-nic state stored in the config file
 type NicInfo struct {
+	ID       string // @/nodes/<node>/nics/<ID>
 	Name     string
 	MacAddr  string
 	Kind     string
@@ -242,6 +320,7 @@ type ClientInfo struct {
 	ConnBand     string     // Connection Radio Band (2.4GHz, 5GHz)
 	ConnNode     string     // Connection Node
 	ConnVAP      string     // Connection Virtual AP
+	CertExpiry   *time.Time // EAP-TLS client certificate expiration
 	DevID        *DevIDInfo // Device identification information
 	Wireless     bool       // Is this a wireless client?
 	active       string
@@ -261,6 +340,15 @@ type VulnInfo struct {
 	Repair         *bool      // Null: no info T: watcher listen>repair; F: repair failed
 }
 
+// QuarantineInfo describes a client which has been cut off from the network,
+// either by being placed in the quarantine ring or by having its address
+// blocked by the firewall.
+type QuarantineInfo struct {
+	MAC    string     `json:"mac"`
+	Reason string     `json:"reason"`
+	Since  *time.Time `json:"since"` // nil if unknown
+}
+
 // ScanInfo represents a record of scanning activity for a single client.
 type ScanInfo struct {
 	Start  *time.Time // When the scan was started
@@ -387,6 +475,63 @@ func (c *Handle) HandleDelExp(path string, handler func([]string)) error {
 	return err
 }
 
+// subscription is a handler registered for several properties at once by
+// HandleChanges.  The underlying ConfigExec has no way to withdraw a handler, so
+// tearing down a subscription simply stops it from passing events on.
+type subscription struct {
+	active bool
+	sync.Mutex
+}
+
+func (s *subscription) isActive() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.active
+}
+
+func (s *subscription) cancel() {
+	s.Lock()
+	s.active = false
+	s.Unlock()
+}
+
+// HandleChanges allows clients to register a single callback that will be
+// invoked when any of several properties changes.  The callback is passed the
+// path with which the change was registered, followed by the arguments a
+// HandleChange callback receives.  If any path can't be registered, the
+// callback is withdrawn from all of them and the error is returned.  The
+// callback is also withdrawn when this handle is closed, so it won't be invoked
+// for events which straggle in during teardown.
+func (c *Handle) HandleChanges(paths []string,
+	handler func(string, []string, string, *time.Time)) error {
+
+	sub := &subscription{active: true}
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+
+		p := p
+		err := c.exec.HandleChange(p,
+			func(prop []string, val string, expires *time.Time) {
+				if sub.isActive() {
+					handler(p, prop, val, expires)
+				}
+			})
+		if err != nil {
+			sub.cancel()
+			return fmt.Errorf("registering %s: %w", p, err)
+		}
+	}
+
+	c.Lock()
+	c.subscriptions = append(c.subscriptions, sub)
+	c.Unlock()
+	return nil
+}
+
 // AddPropValidation adds a new property and value type to ap.configd's syntax
 // validation table.
 func (c *Handle) AddPropValidation(path, proptype string) error {
@@ -398,7 +543,7 @@ func (c *Handle) AddPropValidation(path, proptype string) error {
 		},
 	}
 
-	_, err := c.exec.ExecuteAt(nil, ops, AccessInternal).Wait(nil)
+	_, err := c.ExecuteAt(nil, ops, AccessInternal).Wait(nil)
 
 	return err
 }
@@ -420,7 +565,7 @@ func (c *Handle) GetChildren(prop string) ChildMap {
 // GetProps retrieves the properties subtree rooted at the given property, and
 // returns a PropertyNode representing the root of that subtree
 func (c *Handle) GetProps(prop string) (*PropertyNode, error) {
-	var root PropertyNode
+	var root *PropertyNode
 
 	ops := []PropertyOp{
 		{Op: PropGet, Name: prop},
@@ -431,13 +576,40 @@ func (c *Handle) GetProps(prop string) (*PropertyNode, error) {
 	if err == ErrNoProp || err == ErrNoConfig {
 		return nil, err
 	} else if err != nil {
-		return nil, fmt.Errorf("Failed to retrieve %s: %v", prop, err)
-	} else if err = json.Unmarshal([]byte(tree), &root); err != nil {
-		// XXX: this should really be in cfgtree
-		return nil, fmt.Errorf("Failed to decode %s: %v", prop, err)
+		return nil, fmt.Errorf("Failed to retrieve %s: %w", prop, err)
+	} else if root, err = c.decodeTree(tree); err != nil {
+		return nil, fmt.Errorf("Failed to decode %s: %w", prop, err)
 	}
 
-	return &root, err
+	return root, err
+}
+
+// TreeHash returns a hex-encoded hash of the contents of the subtree rooted at
+// the given property, suitable for detecting configuration drift or keying a
+// cache.  The modification times of the properties are ignored, so rewriting a
+// property with its existing value doesn't change the hash.
+func (c *Handle) TreeHash(root string) (string, error) {
+	tree, err := c.GetProps(root)
+	if err != nil {
+		return "", err
+	}
+
+	var clearModified func(*PropertyNode)
+	clearModified = func(n *PropertyNode) {
+		n.Modified = nil
+		for _, child := range n.Children {
+			if child != nil {
+				clearModified(child)
+			}
+		}
+	}
+	clearModified(tree)
+
+	hash, err := tree.Hash()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash), nil
 }
 
 // GetProp retrieves a single property from the tree, returning it as a String
@@ -504,6 +676,66 @@ func (c *Handle) GetPropDuration(prop string) (time.Duration, error) {
 	return rval, err
 }
 
+// FindProps returns the values of all of the leaf properties whose paths match
+// the given pattern, keyed by path.  The pattern uses path.Match syntax, so a
+// wildcard matches within a single level of the tree; e.g.,
+// "@/network/vap/*/ssid".  Only the subtree beneath the pattern's literal
+// prefix is retrieved.  Expired properties are skipped, and it is not
+// considered an error if nothing matches.
+func (c *Handle) FindProps(pattern string) (map[string]string, error) {
+	if !strings.HasPrefix(pattern, "@/") {
+		return nil, fmt.Errorf("pattern must start with @/: %s", pattern)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("bad pattern %s: %v", pattern, err)
+	}
+
+	// Find the deepest subtree which can contain every possible match
+	levels := strings.Split(strings.TrimPrefix(pattern, "@/"), "/")
+	root := "@"
+	depth := 0
+	for _, level := range levels {
+		if strings.ContainsAny(level, `*?[\`) {
+			break
+		}
+		root += "/" + level
+		depth++
+	}
+
+	rval := make(map[string]string)
+	prop := root
+	if depth == 0 {
+		prop = "@/"
+	}
+	node, err := c.GetProps(prop)
+	if err == ErrNoProp {
+		return rval, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var walk func(string, *PropertyNode, int)
+	walk = func(prop string, node *PropertyNode, depth int) {
+		if node.Expired() {
+			return
+		}
+		if depth == len(levels) {
+			if len(node.Children) == 0 {
+				if ok, _ := path.Match(pattern, prop); ok {
+					rval[prop] = node.Value
+				}
+			}
+			return
+		}
+		for name, child := range node.Children {
+			walk(prop+"/"+name, child, depth+1)
+		}
+	}
+	walk(root, node, depth)
+
+	return rval, nil
+}
+
 // SetProp updates a single property, taking an optional expiration time.  If
 // the property doesn't already exist, an error is returned.
 func (c *Handle) SetProp(prop, val string, expires *time.Time) error {
@@ -606,8 +838,17 @@ func (c *Handle) Replace(newTree []byte) error {
 	return err
 }
 
-// Close closes the underlying connection
+// Close withdraws any callbacks registered with HandleChanges, and closes the
+// underlying connection
 func (c *Handle) Close() {
+	c.Lock()
+	subs := c.subscriptions
+	c.subscriptions = nil
+	c.Unlock()
+
+	for _, sub := range subs {
+		sub.cancel()
+	}
 	c.exec.Close()
 }
 
@@ -638,25 +879,11 @@ type CfgFeatures map[CfgFeature]bool
 // GetFeatures returns the Features information for the tree being inspected;
 // this allows clients to determine whether certain functionality is supported.
 func (c *Handle) GetFeatures() (CfgFeatures, error) {
-	val, err := c.GetProp("@/cfgversion")
+	v, err := c.RemoteVersion()
 	if err != nil {
 		return nil, err
 	}
-	var rval int
-	if rval, err = strconv.Atoi(val); err != nil {
-		return nil, fmt.Errorf("malformed cfgversion: %s", val)
-	}
-	features := make(CfgFeatures)
-	if rval >= 25 {
-		features[FeatureClientFriendlyName] = true
-	}
-	if rval >= 28 {
-		features[FeatureVPNConfig] = true
-	}
-	if rval >= 34 {
-		features[FeatureUserServerKey] = true
-	}
-	return features, nil
+	return FeaturesForVersion(v), nil
 }
 
 // DisplayName returns the name of the client suitable for primary
@@ -702,14 +929,20 @@ func (c *ClientInfo) IsActive() bool {
 	return c.HasIP()
 }
 
-func dumpSubtree(w io.Writer, name string, node *PropertyNode, indent string) {
+func dumpSubtree(w io.Writer, name string, node *PropertyNode, indent string,
+	canonical bool) {
+
 	if node.Expired() {
 		return
 	}
 
 	e := ""
 	if node.Expires != nil {
-		e = node.Expires.Format("2006-01-02T15:04:05")
+		if canonical {
+			e = canonicalTime(node.Expires)
+		} else {
+			e = node.Expires.Format("2006-01-02T15:04:05")
+		}
 		fmt.Fprintf(w, "%s%s: %s  %s\n", indent, name, node.Value, e)
 	} else {
 		fmt.Fprintf(w, "%s%s: %s\n", indent, name, node.Value)
@@ -718,7 +951,9 @@ func dumpSubtree(w io.Writer, name string, node *PropertyNode, indent string) {
 	leafChildren := make([]string, 0)
 	interiorChildren := make([]string, 0)
 	for childName, childNode := range node.Children {
-		if len(childNode.Children) == 0 {
+		if childNode == nil {
+			continue
+		} else if len(childNode.Children) == 0 || canonical {
 			leafChildren = append(leafChildren, childName)
 		} else {
 			interiorChildren = append(interiorChildren, childName)
@@ -728,16 +963,116 @@ func dumpSubtree(w io.Writer, name string, node *PropertyNode, indent string) {
 	sort.Strings(interiorChildren)
 	nextIndent := indent + "  "
 	for _, child := range leafChildren {
-		dumpSubtree(w, child, node.Children[child], nextIndent)
+		dumpSubtree(w, child, node.Children[child], nextIndent, canonical)
 	}
 	for _, child := range interiorChildren {
-		dumpSubtree(w, child, node.Children[child], nextIndent)
+		dumpSubtree(w, child, node.Children[child], nextIndent, canonical)
 	}
 }
 
 // DumpTree displays the contents of a property tree in a human-legible format
 func (n *PropertyNode) DumpTree(w io.Writer, root string) {
-	dumpSubtree(w, root, n, "")
+	dumpSubtree(w, root, n, "", false)
+}
+
+// DumpTreeCanonical displays the contents of a property tree in the same
+// format as DumpTree, but in canonical order: the children of each node are
+// sorted by name alone, and expiration times are normalized to UTC, so that
+// dumps of the same tree may be diffed regardless of where they were made.
+func (n *PropertyNode) DumpTreeCanonical(w io.Writer, root string) {
+	dumpSubtree(w, root, n, "", true)
+}
+
+// canonicalTime returns a timestamp normalized to UTC, in RFC3339 format with
+// as many fractional digits as are needed to represent it exactly.
+func canonicalTime(t *time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func (n *PropertyNode) marshalCanonical(b *bytes.Buffer) error {
+	sep := ""
+	field := func(name string, val interface{}) error {
+		j, err := json.Marshal(val)
+		if err == nil {
+			b.WriteString(sep + `"` + name + `":`)
+			b.Write(j)
+			sep = ","
+		}
+		return err
+	}
+
+	b.WriteByte('{')
+	if n.Value != "" {
+		if err := field("Value", n.Value); err != nil {
+			return err
+		}
+	}
+	if n.Modified != nil {
+		if err := field("Modified", canonicalTime(n.Modified)); err != nil {
+			return err
+		}
+	}
+	if n.Expires != nil {
+		if err := field("Expires", canonicalTime(n.Expires)); err != nil {
+			return err
+		}
+	}
+	if len(n.Children) > 0 {
+		names := make([]string, 0, len(n.Children))
+		for name := range n.Children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		b.WriteString(sep + `"Children":{`)
+		for i, name := range names {
+			j, err := json.Marshal(name)
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.Write(j)
+			b.WriteByte(':')
+			if child := n.Children[name]; child == nil {
+				b.WriteString("null")
+			} else if err = child.marshalCanonical(b); err != nil {
+				return err
+			}
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte('}')
+
+	return nil
+}
+
+// MarshalCanonical returns a JSON representation of the property tree rooted
+// at this node, in which the children of each node are sorted by name and all
+// timestamps are normalized to UTC.  Two trees with the same contents will
+// always produce byte-identical output, regardless of how they were built.
+// The output uses the same field names as json.Marshal, so it may be
+// unmarshaled back into a PropertyNode.
+func (n *PropertyNode) MarshalCanonical() ([]byte, error) {
+	var b bytes.Buffer
+
+	if err := n.marshalCanonical(&b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Hash returns the SHA256 hash of the canonical form of the property tree
+// rooted at this node.  It is suitable for cheaply detecting changes to a tree,
+// or for use as an HTTP ETag.
+func (n *PropertyNode) Hash() ([]byte, error) {
+	j, err := n.MarshalCanonical()
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(j)
+	return hash[:], nil
 }
 
 // GetChildByValue searches through a node's list of childrenn, looking for one
@@ -746,7 +1081,7 @@ func (n *PropertyNode) DumpTree(w io.Writer, root string) {
 // value, this will return only the first one found.
 func (n *PropertyNode) GetChildByValue(value string) *PropertyNode {
 	for _, s := range n.Children {
-		if s.Value == value {
+		if s != nil && s.Value == value {
 			return s
 		}
 	}
@@ -755,9 +1090,22 @@ func (n *PropertyNode) GetChildByValue(value string) *PropertyNode {
 
 // Execute takes a slice of PropertyOp structures and enqueues them for
 // submission to a config daemon.  It returns a handle which may be used to
-// check the status of the operation.
+// check the status of the operation.  Operations which the remote's version of
+// the config API doesn't support are rejected with ErrUnsupportedByRemote,
+// without being sent.
 func (c *Handle) Execute(ctx context.Context, ops []PropertyOp) CmdHdl {
-	return c.exec.Execute(ctx, ops)
+	return c.intercept(ctx, ops, c.preflight(c.exec.Execute))
+}
+
+// ExecuteAt is like Execute, but the operations are executed at the specified
+// access level rather than the handle's default.
+func (c *Handle) ExecuteAt(ctx context.Context, ops []PropertyOp,
+	level AccessLevel) CmdHdl {
+
+	return c.intercept(ctx, ops, c.preflight(
+		func(ctx context.Context, ops []PropertyOp) CmdHdl {
+			return c.exec.ExecuteAt(ctx, ops, level)
+		}))
 }
 
 // Ping performs a simple round-trip connectivity test
@@ -765,6 +1113,16 @@ func (c *Handle) Ping(ctx context.Context) error {
 	return c.exec.Ping(ctx)
 }
 
+// PingTimed performs the same round-trip connectivity test as Ping, returning
+// how long the round trip took.  The time is returned even if the ping fails,
+// since a failure after a long wait says something different from an
+// immediate one.
+func (c *Handle) PingTimed(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	err := c.exec.Ping(ctx)
+	return time.Since(start), err
+}
+
 // fetch the various properties we need to calculate the subnet addresses for
 // each ring at this site.
 func (c *Handle) getSubnetInfo() (string, int, error) {
@@ -773,13 +1131,13 @@ func (c *Handle) getSubnetInfo() (string, int, error) {
 	var err error
 
 	if siteProp, err = c.GetProp("@/site_index"); err != nil {
-		err = fmt.Errorf("fetching site index: %v", err)
+		err = fmt.Errorf("fetching site index: %w", err)
 
 	} else if siteIndex, err = strconv.Atoi(siteProp); err != nil {
 		err = fmt.Errorf("parsing site index: %v", err)
 
 	} else if baseProp, err = c.GetProp("@/network/base_address"); err != nil {
-		err = fmt.Errorf("fetching base_address: %v", err)
+		err = fmt.Errorf("fetching base_address: %w", err)
 
 	} else if _, _, err = net.ParseCIDR(baseProp); err != nil {
 		err = fmt.Errorf("parsing base address %s: %v", baseProp, err)
@@ -826,18 +1184,18 @@ func RingSubnet(ring, base string, siteIdx int) (string, error) {
 }
 
 // GetRings fetches the Rings subtree from ap.configd, and converts the json
-// into a Ring -> RingConfig map
-func (c *Handle) GetRings() RingMap {
+// into a Ring -> RingConfig map.  If the rings aren't configured, the error
+// satisfies IsConfigAbsent(); any other error means the configuration couldn't
+// be retrieved.  Malformed rings are logged and left out of the map.
+func (c *Handle) GetRings() (RingMap, error) {
 	base, siteIdx, err := c.getSubnetInfo()
 	if err != nil {
-		log.Printf("Failed to get subnet info: %v\n", err)
-		return nil
+		return nil, err
 	}
 
 	props, err := c.GetProps("@/rings")
 	if err != nil {
-		log.Printf("Failed to get ring list: %v\n", err)
-		return nil
+		return nil, err
 	}
 
 	set := make(map[string]*RingConfig)
@@ -892,7 +1250,85 @@ func (c *Handle) GetRings() RingMap {
 		}
 	}
 
-	return set
+	return set, nil
+}
+
+// RingConfigUpdate describes a change to a ring's configuration.  Nil fields
+// are left unchanged; a non-nil, empty VirtualAPs takes the ring off of every
+// virtual AP.
+type RingConfigUpdate struct {
+	LeaseDuration *int // minutes
+	VirtualAPs    []string
+}
+
+// RingConfigOps returns the operations needed to apply an update to the named
+// ring.  The operations fail with ErrNoProp if the ring doesn't exist.  The
+// ring's virtual APs are a single list property, so the new list replaces the
+// old one in its entirety.
+func RingConfigOps(ring string, u *RingConfigUpdate) ([]PropertyOp, error) {
+	if !ValidRings[ring] {
+		return nil, fmt.Errorf("invalid ring name: %s", ring)
+	}
+	if u.LeaseDuration != nil && *u.LeaseDuration < 0 {
+		return nil, fmt.Errorf("invalid lease duration %d",
+			*u.LeaseDuration)
+	}
+	seen := make(map[string]bool)
+	for _, vap := range u.VirtualAPs {
+		if vap == "" || strings.Contains(vap, ",") {
+			return nil, fmt.Errorf("invalid vap name %q", vap)
+		}
+		if seen[vap] {
+			return nil, fmt.Errorf("vap %s listed twice", vap)
+		}
+		seen[vap] = true
+	}
+
+	path := "@/rings/" + ring
+	ops := []PropertyOp{
+		{
+			Op:   PropTest,
+			Name: path,
+		},
+	}
+	if u.LeaseDuration != nil {
+		ops = append(ops, PropertyOp{
+			Op:    PropCreate,
+			Name:  path + "/lease_duration",
+			Value: strconv.Itoa(*u.LeaseDuration),
+		})
+	}
+	if u.VirtualAPs != nil {
+		ops = append(ops, PropertyOp{
+			Op:    PropCreate,
+			Name:  path + "/vap",
+			Value: strings.Join(u.VirtualAPs, ","),
+		})
+	}
+	return ops, nil
+}
+
+// SetRingConfig applies an update to the named ring's configuration.
+// ErrNoProp is returned if the ring doesn't exist.
+func (c *Handle) SetRingConfig(ring string, u *RingConfigUpdate) error {
+	ops, err := RingConfigOps(ring, u)
+	if err == nil {
+		_, err = c.Execute(nil, ops).Wait(nil)
+	}
+	return err
+}
+
+// GetRingsLegacy is a best-effort form of GetRings, which logs any error and
+// returns a nil map.
+//
+// Deprecated: use GetRings, which distinguishes a site without rings from a
+// failure to retrieve them.
+func (c *Handle) GetRingsLegacy() RingMap {
+	rings, err := c.GetRings()
+	if err != nil {
+		log.Printf("Failed to get rings: %v\n", err)
+	}
+	return rings
 }
 
 func newVAP(name string, root *PropertyNode) *VirtualAP {
@@ -934,6 +1370,11 @@ func newVAP(name string, root *PropertyNode) *VirtualAP {
 		log.Printf("vap %s: missing default_ring", name)
 	}
 
+	priority, err := root.GetChildInt("priority")
+	if err != nil && err != ErrNoProp {
+		log.Printf("vap %s: %v", name, err)
+	}
+
 	return &VirtualAP{
 		SSID:        ssid,
 		KeyMgmt:     keymgmt,
@@ -942,6 +1383,7 @@ func newVAP(name string, root *PropertyNode) *VirtualAP {
 		Rings:       make([]string, 0),
 		DefaultRing: defaultRing,
 		Disabled:    disabled,
+		Priority:    priority,
 	}
 }
 
@@ -976,7 +1418,11 @@ func (c *Handle) GetClientRings(client *ClientInfo, allRings RingMap) []string {
 		return ringList
 	}
 
-	return ringsPerVap(c.GetRings(), client.ConnVAP)
+	rings, err := c.GetRings()
+	if err != nil {
+		log.Printf("Failed to get rings: %v\n", err)
+	}
+	return ringsPerVap(rings, client.ConnVAP)
 }
 
 // GetVirtualAPs returns a map of all the virtual APs configured for this
@@ -989,7 +1435,10 @@ func (c *Handle) GetVirtualAPs() map[string]*VirtualAP {
 		return nil
 	}
 
-	rings := c.GetRings()
+	rings, err := c.GetRings()
+	if err != nil {
+		log.Printf("Failed to get rings: %v\n", err)
+	}
 
 	vaps := make(map[string]*VirtualAP)
 	for vapName, conf := range props.Children {
@@ -1000,118 +1449,1068 @@ func (c *Handle) GetVirtualAPs() map[string]*VirtualAP {
 	return vaps
 }
 
-// DNSInfo captures DNS configuration information
-type DNSInfo struct {
-	Domain  string   `json:"domain"`
-	Servers []string `json:"servers"`
-}
+// GetVAPClientCounts returns the number of clients currently connected to each
+// virtual AP, indexed by VAP name.  Every configured VAP is present in the map,
+// even if no clients are connected to it.  Wired clients, and wireless clients
+// which have disconnected, are not counted.
+func (c *Handle) GetVAPClientCounts() (map[string]int, error) {
+	counts := make(map[string]int)
 
-// GetDNSInfo returns the DNS configuration.
-func (c *Handle) GetDNSInfo() *DNSInfo {
-	domain, _ := c.GetProp("@/siteid")
-	server, _ := c.GetProp("@/network/dnsserver")
-	d := &DNSInfo{
-		Domain:  domain,
-		Servers: make([]string, 0),
+	vaps, err := c.GetProps("@/network/vap")
+	if err == ErrNoProp {
+		return counts, nil
+	} else if err != nil {
+		return nil, err
 	}
-	if server != "" {
-		d.Servers = append(d.Servers, server)
+	for vapName := range vaps.Children {
+		counts[vapName] = 0
 	}
-	return d
-}
 
-// WanInfo captures the configuration information of the WAN link
-type WanInfo struct {
-	CurrentAddress string     `json:"currentAddress,omitempty"`
-	StaticAddress  string     `json:"staticAddress,omitempty"`
-	StaticRoute    *net.IP    `json:"staticRoute,omitempty"`
-	DNSServer      string     `json:"dnsServer,omitempty"`
-	DHCPAddress    string     `json:"dhcpAddress,omitempty"`
-	DHCPStart      *time.Time `json:"dhcpStart,omitempty"`
-	DHCPDuration   int        `json:"dhcpDuration,omitempty"`
-	DHCPRoute      *net.IP    `json:"dhcpRoute,omitempty"`
+	clients, err := c.GetProps("@/clients")
+	if err == ErrNoProp {
+		return counts, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, props := range clients.Children {
+		client := getClient(props)
+		if !client.Wireless || !client.IsActive() {
+			continue
+		}
+		if _, ok := counts[client.ConnVAP]; ok {
+			counts[client.ConnVAP]++
+		}
+	}
+
+	return counts, nil
 }
 
-// GetWanInfo returns the WAN configuration.
-func (c *Handle) GetWanInfo() *WanInfo {
-	var w WanInfo
+// GetNetworkSecuritySummary returns the security type of each virtual access
+// point, sorted by VAP name.  A VAP whose key management is missing or not one
+// we support is reported as open, since that is the most cautious assumption
+// an audit can make.
+func (c *Handle) GetNetworkSecuritySummary() ([]NetworkSecurity, error) {
+	summary := make([]NetworkSecurity, 0)
 
-	props, _ := c.GetProps("@/network")
-	if props == nil {
-		return nil
+	vaps, err := c.GetProps("@/network/vap")
+	if IsConfigAbsent(err) {
+		return summary, nil
+	} else if err != nil {
+		return nil, err
 	}
 
-	wan := props.Children["wan"]
-	if wan == nil {
-		return nil
+	radiusSecret, err := c.GetProp("@/network/radius_auth_secret")
+	if err != nil && !IsConfigAbsent(err) {
+		return nil, err
 	}
 
-	if current := wan.Children["current"]; current != nil {
-		w.CurrentAddress, _ = current.GetChildString("address")
-	}
+	for vapName, props := range vaps.Children {
+		ns := NetworkSecurity{VAP: vapName}
+		ns.SSID, _ = props.GetChildString("ssid")
+		ns.KeyMgmt, _ = props.GetChildString("keymgmt")
+		ns.Disabled, err = props.GetChildBool("disabled")
+		if err != nil && err != ErrNoProp {
+			log.Printf("vap %s: %v", vapName, err)
+		}
 
-	if static := wan.Children["static"]; static != nil {
-		w.StaticAddress, _ = static.GetChildString("address")
-		w.StaticRoute, _ = static.GetChildIPv4("route")
-	}
-	if dhcp := wan.Children["dhcp"]; dhcp != nil {
-		w.DHCPAddress, _ = dhcp.GetChildString("address")
-		w.DHCPRoute, _ = dhcp.GetChildIPv4("route")
-		w.DHCPStart, _ = dhcp.GetChildTime("start")
-		w.DHCPDuration, _ = dhcp.GetChildInt("duration")
+		switch strings.ToLower(ns.KeyMgmt) {
+		case "wpa-psk":
+			pass, _ := props.GetChildString("passphrase")
+			ns.Security = SecurityPSK
+			ns.Configured = pass != ""
+		case "wpa-eap":
+			ns.Security = SecurityEAP
+			ns.Configured = radiusSecret != ""
+		default:
+			ns.Security = SecurityOpen
+			ns.Open = true
+		}
+		summary = append(summary, ns)
 	}
-	w.DNSServer, _ = props.GetChildString("dnsserver")
-	return &w
+	sort.Slice(summary, func(i, j int) bool {
+		return summary[i].VAP < summary[j].VAP
+	})
+
+	return summary, nil
 }
 
-func getClient(client *PropertyNode) *ClientInfo {
-	var ipv4 net.IP
-	var exp *time.Time
-	var wireless bool
-	var username, connVAP, connBand, connNode, active string
-	var devID *DevIDInfo
-	var err error
+// GetCaptivePortal returns the captive portal configuration for the named
+// virtual AP.  A VAP without any portal properties is reported as having a
+// disabled portal.  ErrNoProp is returned if the VAP doesn't exist.
+func (c *Handle) GetCaptivePortal(vap string) (*CaptivePortal, error) {
+	props, err := c.GetProps("@/network/vap/" + vap)
+	if err != nil {
+		return nil, err
+	}
 
-	private, _ := client.GetChildBool("dns_private")
-	ring, _ := client.GetChildString("ring")
-	home, _ := client.GetChildString("home")
-	dhcp, _ := client.GetChildString("dhcp_name")
-	dns, _ := client.GetChildString("dns_name")
-	friendly, _ := client.GetChildString("friendly_name")
-	friendlyDNS, _ := client.GetChildString("friendly_dns")
-	if node, err := client.GetChild("ipv4"); err == nil {
-		if ip, err := node.GetIPv4(); err == nil {
-			ipv4 = ip.To4()
-			exp = node.Expires
+	cp := &CaptivePortal{}
+	if portal := props.Children["portal"]; portal != nil {
+		cp.Enabled, err = portal.GetChildBool("enabled")
+		if err != nil && err != ErrNoProp {
+			log.Printf("vap %s portal: %v", vap, err)
 		}
+		cp.SplashURL, _ = portal.GetChildString("splash_url")
 	}
-	if conn, ok := client.Children["connection"]; ok {
-		username, _ = conn.GetChildString("username")
-		connVAP, _ = conn.GetChildString("vap")
-		connBand, _ = conn.GetChildString("band")
-		connNode, _ = conn.GetChildString("node")
-		active, _ = conn.GetChildString("active")
-		wireless, err = conn.GetChildBool("wireless")
-		// Improve our guess for legacy devices which don't have the
-		// 'wireless' boolean.
-		if err != nil && connVAP != "" {
-			wireless = true
-		}
+
+	return cp, nil
+}
+
+// GetGuestQuota returns the usage quota for the named virtual AP.  A VAP
+// without any quota properties is reported as having an unlimited quota.
+// ErrNoProp is returned if the VAP doesn't exist.
+func (c *Handle) GetGuestQuota(vap string) (*GuestQuota, error) {
+	props, err := c.GetProps("@/network/vap/" + vap)
+	if err != nil {
+		return nil, err
 	}
-	if dev, ok := client.Children["classification"]; ok {
-		ouiMfg, _ := dev.GetChildString("oui_mfg")
-		devGenus, _ := dev.GetChildString("device_genus")
-		osGenus, _ := dev.GetChildString("os_genus")
-		devID = &DevIDInfo{
-			OUIMfg:      ouiMfg,
-			DeviceGenus: devGenus,
-			OSGenus:     osGenus,
+
+	q := &GuestQuota{}
+	if quota := props.Children["quota"]; quota != nil {
+		q.DailyBytes, err = quota.GetChildUint("daily_bytes")
+		if err != nil && err != ErrNoProp {
+			return nil, fmt.Errorf("vap %s daily_bytes: %w", vap, err)
+		}
+		q.MaxClients, err = quota.GetChildInt("max_clients")
+		if err != nil && err != ErrNoProp {
+			return nil, fmt.Errorf("vap %s max_clients: %w", vap, err)
 		}
 	}
 
-	c := ClientInfo{
-		Ring:         ring,
-		Home:         home,
+	return q, nil
+}
+
+// GuestQuotaOps returns the operations needed to set the usage quota for the
+// named virtual AP.  The operations fail with ErrNoProp if the VAP doesn't
+// exist.
+func GuestQuotaOps(vap string, q *GuestQuota) []PropertyOp {
+	path := "@/network/vap/" + vap
+	return []PropertyOp{
+		{
+			Op:   PropTest,
+			Name: path,
+		},
+		{
+			Op:    PropCreate,
+			Name:  path + "/quota/daily_bytes",
+			Value: strconv.FormatUint(q.DailyBytes, 10),
+		},
+		{
+			Op:    PropCreate,
+			Name:  path + "/quota/max_clients",
+			Value: strconv.Itoa(q.MaxClients),
+		},
+	}
+}
+
+// SetGuestQuota sets the usage quota for the named virtual AP, replacing any
+// existing quota.  ErrNoProp is returned if the VAP doesn't exist.
+func (c *Handle) SetGuestQuota(vap string, q *GuestQuota) error {
+	if q == nil {
+		return fmt.Errorf("missing quota")
+	}
+	if q.DailyBytes > math.MaxInt64 {
+		return fmt.Errorf("daily byte quota %d too large", q.DailyBytes)
+	}
+	if q.MaxClients < 0 {
+		return fmt.Errorf("invalid client limit %d", q.MaxClients)
+	}
+
+	_, err := c.Execute(nil, GuestQuotaOps(vap, q)).Wait(nil)
+	return err
+}
+
+// Release channels an appliance may follow, as set in @/policy/update/channel
+const (
+	UpdateChannelStable = "stable"
+	UpdateChannelBeta   = "beta"
+)
+
+// UpdatePolicyPath is the root of the appliance's auto-update policy
+const UpdatePolicyPath = "@/policy/update"
+
+// UpdatePolicy controls whether an appliance installs updates by itself, which
+// releases it follows, and when it may install them.  The maintenance window
+// is given as times of day ("15:04") in the site's time zone, and may span
+// midnight; if both ends are empty, updates may be installed at any time.
+type UpdatePolicy struct {
+	Auto        bool   `json:"auto"`
+	Channel     string `json:"channel"`
+	WindowStart string `json:"windowStart"`
+	WindowEnd   string `json:"windowEnd"`
+}
+
+// Validate checks that the policy names a known channel, and that its
+// maintenance window is either unset or well formed.
+func (p *UpdatePolicy) Validate() error {
+	if p.Channel != UpdateChannelStable && p.Channel != UpdateChannelBeta {
+		return fmt.Errorf("invalid update channel '%s'", p.Channel)
+	}
+	if p.WindowStart == "" && p.WindowEnd == "" {
+		return nil
+	}
+	start, err := time.Parse("15:04", p.WindowStart)
+	if err != nil {
+		return fmt.Errorf("invalid window start '%s'", p.WindowStart)
+	}
+	end, err := time.Parse("15:04", p.WindowEnd)
+	if err != nil {
+		return fmt.Errorf("invalid window end '%s'", p.WindowEnd)
+	}
+	if start.Equal(end) {
+		return fmt.Errorf("empty maintenance window")
+	}
+	return nil
+}
+
+// GetUpdatePolicy returns the appliance's auto-update policy.  An appliance
+// without one doesn't install updates by itself, and follows the stable
+// channel.  A malformed policy is reported as an error.
+func (c *Handle) GetUpdatePolicy() (*UpdatePolicy, error) {
+	p := &UpdatePolicy{Channel: UpdateChannelStable}
+
+	props, err := c.GetProps(UpdatePolicyPath)
+	if err == ErrNoProp {
+		return p, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	p.Auto, err = props.GetChildBool("auto")
+	if err != nil && err != ErrNoProp {
+		return nil, fmt.Errorf("update policy auto: %w", err)
+	}
+	if channel, err := props.GetChildString("channel"); err == nil {
+		p.Channel = channel
+	}
+	if window := props.Children["window"]; window != nil {
+		p.WindowStart, _ = window.GetChildString("start")
+		p.WindowEnd, _ = window.GetChildString("end")
+	}
+
+	if err = p.Validate(); err != nil {
+		return nil, fmt.Errorf("update policy: %w", err)
+	}
+	return p, nil
+}
+
+// UpdatePolicyOps returns the operations needed to replace the appliance's
+// auto-update policy.  The policy should already have been validated.
+func UpdatePolicyOps(p *UpdatePolicy) []PropertyOp {
+	return []PropertyOp{
+		{
+			Op:    PropCreate,
+			Name:  UpdatePolicyPath + "/auto",
+			Value: strconv.FormatBool(p.Auto),
+		},
+		{
+			Op:    PropCreate,
+			Name:  UpdatePolicyPath + "/channel",
+			Value: p.Channel,
+		},
+		{
+			Op:    PropCreate,
+			Name:  UpdatePolicyPath + "/window/start",
+			Value: p.WindowStart,
+		},
+		{
+			Op:    PropCreate,
+			Name:  UpdatePolicyPath + "/window/end",
+			Value: p.WindowEnd,
+		},
+	}
+}
+
+// SetUpdatePolicy replaces the appliance's auto-update policy.
+func (c *Handle) SetUpdatePolicy(p *UpdatePolicy) error {
+	if p == nil {
+		return fmt.Errorf("missing update policy")
+	}
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	_, err := c.Execute(nil, UpdatePolicyOps(p)).Wait(nil)
+	return err
+}
+
+// AlertPolicyPath is the root of the policy deciding which of the events
+// generated by the appliance result in notifications from the cloud
+const AlertPolicyPath = "@/policy/alerts"
+
+// Event types for which alerts may be configured.  new_device is published as
+// a NetEntity event; the rest are the reasons for NetException events, in
+// lower case.
+const (
+	AlertNewDevice            = "new_device"
+	AlertPhishingAddress      = "phishing_address"
+	AlertBlockedIP            = "blocked_ip"
+	AlertVulnerability        = "vulnerability_detected"
+	AlertBadPassword          = "bad_password"
+	AlertBadRing              = "bad_ring"
+	AlertAuthFailureRate      = "auth_failure_rate"
+	AlertVAPCapacity          = "vap_capacity"
+	AlertRegdomainUnsupported = "regdomain_unsupported"
+	AlertEAPCertExpiring      = "eap_cert_expiring"
+	AlertRogueAP              = "rogue_ap"
+)
+
+// AlertEventTypes lists all of the event types for which alerts may be
+// configured
+var AlertEventTypes = []string{
+	AlertNewDevice,
+	AlertPhishingAddress,
+	AlertBlockedIP,
+	AlertVulnerability,
+	AlertBadPassword,
+	AlertBadRing,
+	AlertAuthFailureRate,
+	AlertVAPCapacity,
+	AlertRegdomainUnsupported,
+	AlertEAPCertExpiring,
+	AlertRogueAP,
+}
+
+// Channels over which alert notifications may be delivered
+const (
+	AlertChannelEmail = "email"
+	AlertChannelSMS   = "sms"
+	AlertChannelPush  = "push"
+)
+
+// MaxAlertThreshold is the largest number of occurrences which may be
+// required before an event type results in a notification
+const MaxAlertThreshold = 1000
+
+// AlertRule controls the notifications for one event type.  Threshold is the
+// number of times the event must occur within an hour before a notification is
+// sent; 0 and 1 both mean every occurrence is reported.
+type AlertRule struct {
+	Notify    bool `json:"notify"`
+	Threshold int  `json:"threshold"`
+}
+
+// AlertConfig controls which events generated by the appliance result in
+// notifications, and how those notifications are delivered.  Event types
+// missing from Events don't notify.  GetAlertConfig returns a rule for every
+// known event type.
+type AlertConfig struct {
+	Events   map[string]AlertRule `json:"events"`
+	Channels []string             `json:"channels"`
+}
+
+func validAlertEventType(event string) bool {
+	for _, e := range AlertEventTypes {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that the config only names known event types and channels,
+// and that its thresholds are in range.
+func (a *AlertConfig) Validate() error {
+	for event, rule := range a.Events {
+		if !validAlertEventType(event) {
+			return fmt.Errorf("invalid alert event type '%s'", event)
+		}
+		if rule.Threshold < 0 || rule.Threshold > MaxAlertThreshold {
+			return fmt.Errorf("alert threshold %d for %s out of "+
+				"range (0-%d)", rule.Threshold, event,
+				MaxAlertThreshold)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, ch := range a.Channels {
+		switch ch {
+		case AlertChannelEmail, AlertChannelSMS, AlertChannelPush:
+		default:
+			return fmt.Errorf("invalid alert channel '%s'", ch)
+		}
+		if seen[ch] {
+			return fmt.Errorf("duplicate alert channel '%s'", ch)
+		}
+		seen[ch] = true
+	}
+	return nil
+}
+
+// GetAlertConfig returns the appliance's alert policy.  An appliance without
+// one sends no notifications.  Settings for unknown event types are ignored; a
+// malformed setting for a known one is reported as an error.
+func (c *Handle) GetAlertConfig() (*AlertConfig, error) {
+	a := &AlertConfig{
+		Events:   make(map[string]AlertRule),
+		Channels: make([]string, 0),
+	}
+	for _, event := range AlertEventTypes {
+		a.Events[event] = AlertRule{}
+	}
+
+	props, err := c.GetProps(AlertPolicyPath)
+	if err == ErrNoProp {
+		return a, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if events := props.Children["events"]; events != nil {
+		for event, node := range events.Children {
+			if !validAlertEventType(event) {
+				continue
+			}
+			var rule AlertRule
+			rule.Notify, err = node.GetChildBool("notify")
+			if err != nil && err != ErrNoProp {
+				return nil, fmt.Errorf("alert %s notify: %w",
+					event, err)
+			}
+			rule.Threshold, err = node.GetChildInt("threshold")
+			if err != nil && err != ErrNoProp {
+				return nil, fmt.Errorf("alert %s threshold: %w",
+					event, err)
+			}
+			a.Events[event] = rule
+		}
+	}
+	if channels, err := props.GetChildString("channels"); err == nil {
+		for _, ch := range strings.Split(channels, ",") {
+			if ch = strings.TrimSpace(ch); ch != "" {
+				a.Channels = append(a.Channels, ch)
+			}
+		}
+	}
+
+	if err = a.Validate(); err != nil {
+		return nil, fmt.Errorf("alert policy: %w", err)
+	}
+	return a, nil
+}
+
+// AlertConfigOps returns the operations needed to replace the appliance's
+// alert policy.  Every known event type is written, so types missing from the
+// config are turned off.  The config should already have been validated.
+func AlertConfigOps(a *AlertConfig) []PropertyOp {
+	ops := make([]PropertyOp, 0)
+	for _, event := range AlertEventTypes {
+		rule := a.Events[event]
+		path := AlertPolicyPath + "/events/" + event
+		ops = append(ops, []PropertyOp{
+			{
+				Op:    PropCreate,
+				Name:  path + "/notify",
+				Value: strconv.FormatBool(rule.Notify),
+			},
+			{
+				Op:    PropCreate,
+				Name:  path + "/threshold",
+				Value: strconv.Itoa(rule.Threshold),
+			},
+		}...)
+	}
+	ops = append(ops, PropertyOp{
+		Op:    PropCreate,
+		Name:  AlertPolicyPath + "/channels",
+		Value: strings.Join(a.Channels, ","),
+	})
+	return ops
+}
+
+// SetAlertConfig replaces the appliance's alert policy.
+func (c *Handle) SetAlertConfig(a *AlertConfig) error {
+	if a == nil {
+		return fmt.Errorf("missing alert config")
+	}
+	if err := a.Validate(); err != nil {
+		return err
+	}
+
+	_, err := c.Execute(nil, AlertConfigOps(a)).Wait(nil)
+	return err
+}
+
+// TrustedCAPath is the root of the custom CA certificates trusted by the
+// appliance, for example when forwarding logs or talking to a proxy.  Each is
+// stored as @/security/trusted_cas/<name>/pem.
+const TrustedCAPath = "@/security/trusted_cas"
+
+var trustedCANameRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// TrustedCA describes a CA certificate trusted by the appliance.  All but the
+// name and PEM are derived from the certificate itself.
+type TrustedCA struct {
+	Name        string    `json:"name"`
+	PEM         string    `json:"pem"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	NotBefore   time.Time `json:"notBefore"`
+	NotAfter    time.Time `json:"notAfter"`
+	Fingerprint string    `json:"fingerprint"` // SHA-256, hex encoded
+}
+
+// ParseTrustedCA checks that pemData holds exactly one PEM-encoded X.509
+// certificate, and returns a TrustedCA describing it.
+func ParseTrustedCA(name, pemData string) (*TrustedCA, error) {
+	if !trustedCANameRE.MatchString(name) {
+		return nil, fmt.Errorf("invalid trusted CA name %q", name)
+	}
+
+	block, rest := pem.Decode([]byte(pemData))
+	if block == nil {
+		return nil, fmt.Errorf("trusted CA %s: no PEM data found", name)
+	}
+	if block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("trusted CA %s: PEM block is %q, not "+
+			"a CERTIFICATE", name, block.Type)
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return nil, fmt.Errorf("trusted CA %s: more than one PEM block",
+			name)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("trusted CA %s: %w", name, err)
+	}
+
+	fp := sha256.Sum256(cert.Raw)
+	return &TrustedCA{
+		Name:        name,
+		PEM:         string(pem.EncodeToMemory(block)),
+		Subject:     cert.Subject.String(),
+		Issuer:      cert.Issuer.String(),
+		NotBefore:   cert.NotBefore.UTC(),
+		NotAfter:    cert.NotAfter.UTC(),
+		Fingerprint: hex.EncodeToString(fp[:]),
+	}, nil
+}
+
+// GetTrustedCAs returns the custom CA certificates trusted by the appliance,
+// sorted by name.  A stored certificate which can't be parsed is logged, and
+// returned with only its name and PEM filled in, so that it can be removed.
+func (c *Handle) GetTrustedCAs() ([]TrustedCA, error) {
+	cas := make([]TrustedCA, 0)
+
+	props, err := c.GetProps(TrustedCAPath)
+	if IsConfigAbsent(err) {
+		return cas, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for name, node := range props.Children {
+		pemData, _ := node.GetChildString("pem")
+		ca, err := ParseTrustedCA(name, pemData)
+		if err != nil {
+			log.Printf("%v", err)
+			ca = &TrustedCA{Name: name, PEM: pemData}
+		}
+		cas = append(cas, *ca)
+	}
+	sort.Slice(cas, func(i, j int) bool {
+		return cas[i].Name < cas[j].Name
+	})
+
+	return cas, nil
+}
+
+// TrustedCAOps returns the operations needed to add a trusted CA certificate,
+// as returned by ParseTrustedCA.
+func TrustedCAOps(ca *TrustedCA) []PropertyOp {
+	return []PropertyOp{
+		{
+			Op:    PropCreate,
+			Name:  TrustedCAPath + "/" + ca.Name + "/pem",
+			Value: ca.PEM,
+		},
+	}
+}
+
+// DeleteTrustedCAOps returns the operations needed to remove the named trusted
+// CA certificate.
+func DeleteTrustedCAOps(name string) []PropertyOp {
+	return []PropertyOp{
+		{
+			Op:   PropDelete,
+			Name: TrustedCAPath + "/" + name,
+		},
+	}
+}
+
+// AddTrustedCA adds a PEM-encoded CA certificate to those trusted by the
+// appliance, replacing any existing certificate with the same name.  The PEM
+// must hold a single certificate.
+func (c *Handle) AddTrustedCA(name, pemData string) error {
+	ca, err := ParseTrustedCA(name, pemData)
+	if err != nil {
+		return err
+	}
+	_, err = c.Execute(nil, TrustedCAOps(ca)).Wait(nil)
+	return err
+}
+
+// RemoveTrustedCA removes a CA certificate from those trusted by the
+// appliance.  ErrNoProp is returned if there is no such certificate.
+func (c *Handle) RemoveTrustedCA(name string) error {
+	if !trustedCANameRE.MatchString(name) {
+		return fmt.Errorf("invalid trusted CA name %q", name)
+	}
+	_, err := c.Execute(nil, DeleteTrustedCAOps(name)).Wait(nil)
+	return err
+}
+
+// DNSInfo captures DNS configuration information
+type DNSInfo struct {
+	Domain  string   `json:"domain"`
+	Servers []string `json:"servers"`
+}
+
+// IsConfigAbsent returns true if the error returned by one of the getters
+// means that the requested configuration legitimately doesn't exist, as
+// opposed to it being unretrievable.
+func IsConfigAbsent(err error) bool {
+	return errors.Is(err, ErrNoProp) || errors.Is(err, ErrNoConfig)
+}
+
+// IsConfigTimeout returns true if the error returned by one of the getters
+// means that the request for the configuration timed out.
+func IsConfigTimeout(err error) bool {
+	return errors.Is(err, ErrTimeout)
+}
+
+// GetDNSInfo returns the DNS configuration.  Missing properties are left
+// empty; an error is only returned if the site has no configuration at all, or
+// if the configuration couldn't be retrieved.
+func (c *Handle) GetDNSInfo() (*DNSInfo, error) {
+	domain, err := c.GetProp("@/siteid")
+	if err != nil && !errors.Is(err, ErrNoProp) {
+		return nil, err
+	}
+	server, err := c.GetProp("@/network/dnsserver")
+	if err != nil && !errors.Is(err, ErrNoProp) {
+		return nil, err
+	}
+
+	d := &DNSInfo{
+		Domain:  domain,
+		Servers: make([]string, 0),
+	}
+	if server != "" {
+		d.Servers = append(d.Servers, server)
+	}
+	return d, nil
+}
+
+// GetDNSInfoLegacy is a best-effort form of GetDNSInfo, which returns an empty
+// DNSInfo if the configuration can't be retrieved.
+//
+// Deprecated: use GetDNSInfo, which reports failures to retrieve the
+// configuration.
+func (c *Handle) GetDNSInfoLegacy() *DNSInfo {
+	d, err := c.GetDNSInfo()
+	if err != nil {
+		d = &DNSInfo{Servers: make([]string, 0)}
+	}
+	return d
+}
+
+// CustomDNSPath is the subtree holding a site's custom DNS entries.  Each entry
+// is stored as @/dns/custom/<name>, with the entry's IPv4 address as its value.
+const CustomDNSPath = "@/dns/custom"
+
+// CustomDNSEntry is a locally-defined DNS A record, mapping a hostname in the
+// site's domain to an address.
+type CustomDNSEntry struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+// GetCustomDNSEntries returns the site's custom DNS entries, sorted by name.
+// The slice is empty if there are none.
+func (c *Handle) GetCustomDNSEntries() ([]CustomDNSEntry, error) {
+	rval := make([]CustomDNSEntry, 0)
+	props, err := c.GetProps(CustomDNSPath)
+	if IsConfigAbsent(err) {
+		return rval, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("property get %s failed: %w",
+			CustomDNSPath, err)
+	}
+
+	for name, node := range props.Children {
+		rval = append(rval, CustomDNSEntry{
+			Name:    name,
+			Address: node.Value,
+		})
+	}
+	sort.Slice(rval, func(i, j int) bool {
+		return rval[i].Name < rval[j].Name
+	})
+	return rval, nil
+}
+
+// CustomDNSEntryOps returns the operations needed to add a custom DNS entry,
+// or to replace an existing entry with the same name.
+func CustomDNSEntryOps(entry CustomDNSEntry) []PropertyOp {
+	return []PropertyOp{
+		{
+			Op:    PropCreate,
+			Name:  CustomDNSPath + "/" + strings.ToLower(entry.Name),
+			Value: entry.Address,
+		},
+	}
+}
+
+// DeleteCustomDNSEntryOps returns the operations needed to remove a custom DNS
+// entry.  The operations fail with ErrNoProp if there is no such entry.
+func DeleteCustomDNSEntryOps(name string) []PropertyOp {
+	return []PropertyOp{
+		{
+			Op:   PropDelete,
+			Name: CustomDNSPath + "/" + strings.ToLower(name),
+		},
+	}
+}
+
+// AddCustomDNSEntry adds a custom DNS entry, replacing any existing entry with
+// the same name.
+func (c *Handle) AddCustomDNSEntry(entry CustomDNSEntry) error {
+	_, err := c.Execute(nil, CustomDNSEntryOps(entry)).Wait(nil)
+	return err
+}
+
+// DeleteCustomDNSEntry removes a custom DNS entry.
+func (c *Handle) DeleteCustomDNSEntry(name string) error {
+	_, err := c.Execute(nil, DeleteCustomDNSEntryOps(name)).Wait(nil)
+	return err
+}
+
+// DNSNameInUse returns true if the given hostname is already used as a
+// client's assigned or friendly DNS name, or as the name of a CNAME record.
+// Names are compared without regard to case.  Custom DNS entries are not
+// considered.
+func (c *Handle) DNSNameInUse(name string) bool {
+	for _, client := range c.GetClients() {
+		if strings.EqualFold(client.DNSName, name) ||
+			strings.EqualFold(client.FriendlyDNS, name) {
+			return true
+		}
+	}
+	for cname := range c.GetChildren("@/dns/cnames") {
+		if strings.EqualFold(cname, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// WanInfo captures the configuration information of the WAN link
+type WanInfo struct {
+	CurrentAddress string     `json:"currentAddress,omitempty"`
+	StaticAddress  string     `json:"staticAddress,omitempty"`
+	StaticRoute    *net.IP    `json:"staticRoute,omitempty"`
+	DNSServer      string     `json:"dnsServer,omitempty"`
+	DHCPAddress    string     `json:"dhcpAddress,omitempty"`
+	DHCPStart      *time.Time `json:"dhcpStart,omitempty"`
+	DHCPDuration   int        `json:"dhcpDuration,omitempty"`
+	DHCPRoute      *net.IP    `json:"dhcpRoute,omitempty"`
+}
+
+// GetWanInfo returns the WAN configuration.  ErrNoProp is returned if the
+// site has no WAN configuration.
+func (c *Handle) GetWanInfo() (*WanInfo, error) {
+	var w WanInfo
+
+	props, err := c.GetProps("@/network")
+	if err != nil {
+		return nil, err
+	}
+
+	wan := props.Children["wan"]
+	if wan == nil {
+		return nil, ErrNoProp
+	}
+
+	if current := wan.Children["current"]; current != nil {
+		w.CurrentAddress, _ = current.GetChildString("address")
+	}
+
+	if static := wan.Children["static"]; static != nil {
+		w.StaticAddress, _ = static.GetChildString("address")
+		w.StaticRoute, _ = static.GetChildIPv4("route")
+	}
+	if dhcp := wan.Children["dhcp"]; dhcp != nil {
+		w.DHCPAddress, _ = dhcp.GetChildString("address")
+		w.DHCPRoute, _ = dhcp.GetChildIPv4("route")
+		w.DHCPStart, _ = dhcp.GetChildTime("start")
+		w.DHCPDuration, _ = dhcp.GetChildInt("duration")
+	}
+	w.DNSServer, _ = props.GetChildString("dnsserver")
+	return &w, nil
+}
+
+// GetWanInfoLegacy is a best-effort form of GetWanInfo, which returns nil if
+// the WAN configuration is missing or can't be retrieved.
+//
+// Deprecated: use GetWanInfo, which distinguishes a site without WAN
+// configuration from a failure to retrieve it.
+func (c *Handle) GetWanInfoLegacy() *WanInfo {
+	w, _ := c.GetWanInfo()
+	return w
+}
+
+// Uplink states, as reported in @/network/wan/uplinks/<name>/state
+const (
+	UplinkActive  = "active"  // carrying the site's traffic
+	UplinkStandby = "standby" // usable, held in reserve for failover
+	UplinkDown    = "down"    // unusable
+)
+
+// WanUplink captures the configuration and current state of one of the WAN
+// uplinks of an appliance with failover, such as a wired link backed up by
+// LTE.  Lower Priority values are preferred.  State is empty if the uplink
+// hasn't reported one.
+type WanUplink struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Priority int    `json:"priority"`
+	State    string `json:"state,omitempty"`
+}
+
+// GetWanUplinks returns the configured WAN uplinks, most preferred first.
+// ErrNoProp is returned if the site has no uplinks configured, in which case
+// its only WAN link is the one described by GetWanInfo.
+func (c *Handle) GetWanUplinks() ([]WanUplink, error) {
+	props, err := c.GetProps("@/network/wan/uplinks")
+	if err != nil {
+		return nil, err
+	}
+	if len(props.Children) == 0 {
+		return nil, ErrNoProp
+	}
+
+	uplinks := make([]WanUplink, 0)
+	for name, node := range props.Children {
+		u := WanUplink{Name: name}
+		u.Type, _ = node.GetChildString("type")
+		u.Priority, _ = node.GetChildInt("priority")
+		u.State, _ = node.GetChildString("state")
+		uplinks = append(uplinks, u)
+	}
+
+	sort.Slice(uplinks, func(i, j int) bool {
+		if uplinks[i].Priority == uplinks[j].Priority {
+			return uplinks[i].Name < uplinks[j].Name
+		}
+		return uplinks[i].Priority < uplinks[j].Priority
+	})
+	return uplinks, nil
+}
+
+// RegChannel describes a single 20MHz channel permitted by a regulatory domain.
+// MaxPower is the maximum EIRP allowed on the channel, in dBm.
+type RegChannel struct {
+	Channel  int  `json:"channel"`
+	MaxPower int  `json:"maxPower"`
+	DFS      bool `json:"dfs"`
+}
+
+// RegInfo captures the wireless regulatory domain in effect, and the per-band
+// lists of channels it permits.  If we have no rules specific to the
+// configured country, the channels are those of the world regulatory domain.
+type RegInfo struct {
+	CountryCode string                  `json:"countryCode"`
+	Channels    map[string][]RegChannel `json:"channels"`
+}
+
+var regDomainRE = regexp.MustCompile(`^[A-Z][A-Z]$`)
+
+// GetRegulatoryInfo returns the configured regulatory domain, along with the
+// channels and transmit power limits it allows.  As in ap.wifid, a missing or
+// malformed @/network/regdomain is treated as the default domain.
+func (c *Handle) GetRegulatoryInfo() (*RegInfo, error) {
+	const prop = "@/network/regdomain"
+
+	country := wifi.DefaultRegDomain
+	domain, err := c.GetProp(prop)
+	if err == nil {
+		domain = strings.ToUpper(domain)
+		if regDomainRE.MatchString(domain) {
+			country = domain
+		}
+	} else if !IsConfigAbsent(err) {
+		return nil, fmt.Errorf("property get %s failed: %w", prop, err)
+	}
+
+	rules, ok := wifi.RegDomains[country]
+	if !ok {
+		rules = wifi.RegDomains[wifi.WorldRegDomain]
+	}
+
+	info := &RegInfo{
+		CountryCode: country,
+		Channels:    make(map[string][]RegChannel),
+	}
+	for _, rule := range rules {
+		step := wifi.RegChannelStep(rule.Band)
+		for ch := rule.First; ch <= rule.Last; ch += step {
+			info.Channels[rule.Band] = append(info.Channels[rule.Band],
+				RegChannel{
+					Channel:  ch,
+					MaxPower: rule.MaxPower,
+					DFS:      rule.DFS,
+				})
+		}
+	}
+	return info, nil
+}
+
+// ChannelUtil captures the most recent utilization measurements for the
+// channel a node is using in one band.  Busy is the percentage of time the
+// channel was sensed busy; NoiseFloor is in dBm.
+type ChannelUtil struct {
+	Busy       float64 `json:"busy"`
+	NoiseFloor int     `json:"noiseFloor"`
+}
+
+// GetChannelUtilization returns the channel utilization recorded by a node under
+// @/metrics/wifi/<node>/<band>, keyed by band.  The map is empty if the node
+// hasn't recorded any.
+func (c *Handle) GetChannelUtilization(node string) (map[string]ChannelUtil, error) {
+	prop := "@/metrics/wifi/" + node
+
+	rval := make(map[string]ChannelUtil)
+	props, err := c.GetProps(prop)
+	if IsConfigAbsent(err) {
+		return rval, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("property get %s failed: %w", prop, err)
+	}
+
+	for band, bandNode := range props.Children {
+		if _, ok := wifi.Channels[band]; !ok {
+			continue
+		}
+		busy, err := bandNode.GetChildFloat64("busy")
+		if err != nil {
+			continue
+		}
+		noise, _ := bandNode.GetChildInt("noise_floor")
+		rval[band] = ChannelUtil{
+			Busy:       busy,
+			NoiseFloor: noise,
+		}
+	}
+	return rval, nil
+}
+
+// SurveyChannel summarizes the neighboring access points a node saw on one
+// channel during its most recent wifi survey.  Signal is the strength of the
+// strongest neighbor, in dBm.
+type SurveyChannel struct {
+	Channel   int `json:"channel"`
+	Neighbors int `json:"neighbors"`
+	Signal    int `json:"signal"`
+}
+
+// GetWifiSurvey returns the results of the most recent wifi survey performed
+// by a node, recorded under @/metrics/wifi/<node>/<band>/survey/<channel>.  The
+// results are keyed by band, with each band's channels in ascending order.  The
+// map is empty if the node hasn't recorded a survey.
+func (c *Handle) GetWifiSurvey(node string) (map[string][]SurveyChannel, error) {
+	prop := "@/metrics/wifi/" + node
+
+	rval := make(map[string][]SurveyChannel)
+	props, err := c.GetProps(prop)
+	if IsConfigAbsent(err) {
+		return rval, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("property get %s failed: %w", prop, err)
+	}
+
+	for band, bandNode := range props.Children {
+		if _, ok := wifi.Channels[band]; !ok {
+			continue
+		}
+		survey, ok := bandNode.Children["survey"]
+		if !ok {
+			continue
+		}
+
+		channels := make([]SurveyChannel, 0)
+		for name, chNode := range survey.Children {
+			channel, err := strconv.Atoi(name)
+			if err != nil {
+				continue
+			}
+			neighbors, err := chNode.GetChildInt("neighbors")
+			if err != nil {
+				continue
+			}
+			signal, _ := chNode.GetChildInt("signal")
+			channels = append(channels, SurveyChannel{
+				Channel:   channel,
+				Neighbors: neighbors,
+				Signal:    signal,
+			})
+		}
+		sort.Slice(channels, func(i, j int) bool {
+			return channels[i].Channel < channels[j].Channel
+		})
+		rval[band] = channels
+	}
+	return rval, nil
+}
+
+func getClient(client *PropertyNode) *ClientInfo {
+	var ipv4 net.IP
+	var exp, certExpiry *time.Time
+	var wireless bool
+	var username, connVAP, connBand, connNode, active string
+	var devID *DevIDInfo
+	var err error
+
+	private, _ := client.GetChildBool("dns_private")
+	ring, _ := client.GetChildString("ring")
+	home, _ := client.GetChildString("home")
+	dhcp, _ := client.GetChildString("dhcp_name")
+	dns, _ := client.GetChildString("dns_name")
+	friendly, _ := client.GetChildString("friendly_name")
+	friendlyDNS, _ := client.GetChildString("friendly_dns")
+	if node, err := client.GetChild("ipv4"); err == nil {
+		if ip, err := node.GetIPv4(); err == nil {
+			ipv4 = ip.To4()
+			exp = node.Expires
+		}
+	}
+	if conn, ok := client.Children["connection"]; ok {
+		username, _ = conn.GetChildString("username")
+		connVAP, _ = conn.GetChildString("vap")
+		connBand, _ = conn.GetChildString("band")
+		connNode, _ = conn.GetChildString("node")
+		active, _ = conn.GetChildString("active")
+		certExpiry, _ = conn.GetChildTime("eap_cert_expiry")
+		wireless, err = conn.GetChildBool("wireless")
+		// ap.configd records the 'wireless' boolean when a client is
+		// first observed on the network.  Improve our guess for legacy
+		// devices which predate that.
+		if err != nil && connVAP != "" {
+			wireless = true
+		}
+	}
+	if dev, ok := client.Children["classification"]; ok {
+		ouiMfg, _ := dev.GetChildString("oui_mfg")
+		devGenus, _ := dev.GetChildString("device_genus")
+		osGenus, _ := dev.GetChildString("os_genus")
+		devID = &DevIDInfo{
+			OUIMfg:      ouiMfg,
+			DeviceGenus: devGenus,
+			OSGenus:     osGenus,
+		}
+	}
+
+	c := ClientInfo{
+		Ring:         ring,
+		Home:         home,
 		DHCPName:     dhcp,
 		FriendlyName: friendly,
 		FriendlyDNS:  friendlyDNS,
@@ -1123,6 +2522,7 @@ func getClient(client *PropertyNode) *ClientInfo {
 		ConnBand:     connBand,
 		ConnNode:     connNode,
 		ConnVAP:      connVAP,
+		CertExpiry:   certExpiry,
 		Wireless:     wireless,
 		DevID:        devID,
 		active:       active,
@@ -1200,6 +2600,28 @@ func (c *Handle) GetClients() ClientMap {
 	return set
 }
 
+// GetClientsByMACs fetches the Clients subtree once, and returns a map of
+// ClientInfo structures for those clients in the provided list.  Clients which
+// aren't present in the tree are simply absent from the returned map.
+func (c *Handle) GetClientsByMACs(macs []string) (ClientMap, error) {
+	set := make(ClientMap)
+
+	props, err := c.GetProps("@/clients")
+	if err == ErrNoProp {
+		return set, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, mac := range macs {
+		if client, ok := props.Children[mac]; ok {
+			set[mac] = getClient(client)
+		}
+	}
+
+	return set, nil
+}
+
 // ClientMetrics captures metrics about a specifc client device.
 // The array format is chosen to provide a reasonably compact JSON
 // encoding.
@@ -1300,8 +2722,10 @@ func getNics(prop *PropertyNode, node string) ([]NicInfo, error) {
 		nodeNics := info.Children["nics"]
 
 		if (node == "" || node == name) && nodeNics != nil {
-			for _, nic := range nodeNics.Children {
-				nics = append(nics, getNic(nic))
+			for id, nic := range nodeNics.Children {
+				n := getNic(nic)
+				n.ID = id
+				nics = append(nics, n)
 			}
 		}
 	}
@@ -1352,9 +2776,153 @@ func (c *Handle) GetNic(node, nic string) (*NicInfo, error) {
 		return nil, fmt.Errorf("GetNic: property get %s failed: %v", path, err)
 	}
 	n := getNic(prop)
+	n.ID = nic
 	return &n, nil
 }
 
+// The range of MTUs which may be configured for a nic.  576 is the smallest
+// datagram every IPv4 host must accept; 9000 is the usual jumbo frame limit.
+const (
+	MinInterfaceMTU = 576
+	MaxInterfaceMTU = 9000
+)
+
+// GetInterfaceMTUs returns the MTU configured for each nic on each node, keyed
+// by "<node>/<nic>".  Nics without a configured MTU use the kernel's default,
+// and are left out of the map.
+func (c *Handle) GetInterfaceMTUs() (map[string]int, error) {
+	rval := make(map[string]int)
+	prop, err := c.GetProps("@/nodes")
+	if IsConfigAbsent(err) {
+		return rval, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("property get @/nodes failed: %w", err)
+	}
+
+	for node, info := range prop.Children {
+		nodeNics := info.Children["nics"]
+		if nodeNics == nil {
+			continue
+		}
+		for name, nic := range nodeNics.Children {
+			if mtu, err := nic.GetChildInt("mtu"); err == nil {
+				rval[node+"/"+name] = mtu
+			}
+		}
+	}
+	return rval, nil
+}
+
+// ValidInterfaceMTU checks that an MTU is between MinInterfaceMTU and
+// MaxInterfaceMTU.
+func ValidInterfaceMTU(mtu int) error {
+	if mtu < MinInterfaceMTU || mtu > MaxInterfaceMTU {
+		return fmt.Errorf("MTU %d out of range (%d-%d)", mtu,
+			MinInterfaceMTU, MaxInterfaceMTU)
+	}
+	return nil
+}
+
+// InterfaceMTUOps returns the operations needed to set the MTU of a nic on the
+// named node.  The operations fail if the nic doesn't exist.
+func InterfaceMTUOps(node, nic string, mtu int) []PropertyOp {
+	path := fmt.Sprintf("@/nodes/%s/nics/%s", node, nic)
+	return []PropertyOp{
+		{
+			Op:   PropTest,
+			Name: path,
+		},
+		{
+			Op:    PropCreate,
+			Name:  path + "/mtu",
+			Value: strconv.Itoa(mtu),
+		},
+	}
+}
+
+// SetInterfaceMTU sets the MTU of a nic on the named node.  The MTU must be
+// between MinInterfaceMTU and MaxInterfaceMTU.  ErrNoProp is returned if the
+// nic doesn't exist.
+func (c *Handle) SetInterfaceMTU(node, nic string, mtu int) error {
+	if err := ValidInterfaceMTU(mtu); err != nil {
+		return err
+	}
+
+	_, err := c.Execute(nil, InterfaceMTUOps(node, nic, mtu)).Wait(nil)
+	return err
+}
+
+// WifiDrift describes a wireless nic whose active band, channel, or channel
+// width differs from its configured value, either because a change hasn't been
+// applied yet or because applying it failed.  Fields lists which of "band",
+// "channel", and "width" differ.
+type WifiDrift struct {
+	Fields []string `json:"fields"`
+
+	ConfigBand    string `json:"configBand"`
+	ConfigChannel int    `json:"configChannel"`
+	ConfigWidth   string `json:"configWidth"`
+
+	ActiveBand    string `json:"activeBand"`
+	ActiveChannel int    `json:"activeChannel"`
+	ActiveWidth   string `json:"activeWidth"`
+}
+
+// drift compares a nic's configured wifi settings with its active ones.
+// Settings which aren't configured are chosen automatically, and so can't
+// drift.
+func (w *WifiInfo) drift() []string {
+	fields := make([]string, 0)
+	if w.ConfigBand != "" && w.ConfigBand != w.ActiveBand {
+		fields = append(fields, "band")
+	}
+	if w.ConfigChannel != 0 && w.ConfigChannel != w.ActiveChannel {
+		fields = append(fields, "channel")
+	}
+	if w.ConfigWidth != "" && w.ConfigWidth != w.ActiveWidth {
+		fields = append(fields, "width")
+	}
+	return fields
+}
+
+// GetWifiConfigDrift returns the wireless nics on all nodes whose active wifi
+// settings differ from their configured settings, keyed by "<node>/<nic>".
+// The map is empty if no nic has drifted.
+func (c *Handle) GetWifiConfigDrift() (map[string]WifiDrift, error) {
+	rval := make(map[string]WifiDrift)
+	prop, err := c.GetProps("@/nodes")
+	if IsConfigAbsent(err) {
+		return rval, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("property get @/nodes failed: %w", err)
+	}
+
+	for node, info := range prop.Children {
+		nodeNics := info.Children["nics"]
+		if nodeNics == nil {
+			continue
+		}
+		for name, nic := range nodeNics.Children {
+			w := getNic(nic).WifiInfo
+			if w == nil {
+				continue
+			}
+			if fields := w.drift(); len(fields) > 0 {
+				rval[node+"/"+name] = WifiDrift{
+					Fields:        fields,
+					ConfigBand:    w.ConfigBand,
+					ConfigChannel: w.ConfigChannel,
+					ConfigWidth:   w.ConfigWidth,
+					ActiveBand:    w.ActiveBand,
+					ActiveChannel: w.ActiveChannel,
+					ActiveWidth:   w.ActiveWidth,
+				}
+			}
+		}
+	}
+	return rval, nil
+}
+
 // Build a mac->ip map of all the NICs on the internal ring
 func (c *Handle) getInternalAddrs() map[string]string {
 	addrs := make(map[string]string)
@@ -1375,15 +2943,12 @@ func (c *Handle) getInternalAddrs() map[string]string {
 
 // GetNodes returns a slice of all nodes
 func (c *Handle) GetNodes() ([]NodeInfo, error) {
-	var metrics ChildMap
-
 	prop, err := c.GetProps("@/nodes")
 	if err != nil {
 		return nil, fmt.Errorf("property get @/nodes failed: %v", err)
 	}
-	if x, _ := c.GetProps("@/metrics/health/"); x != nil {
-		metrics = x.Children
-	}
+	// Nodes which haven't reported their health are still listed
+	health, _ := c.GetAllNodeHealth()
 
 	internal := c.getInternalAddrs()
 
@@ -1396,10 +2961,10 @@ func (c *Handle) GetNodes() ([]NodeInfo, error) {
 		ni.Name, _ = node.GetChildString("name")
 		ni.Nics, _ = getNics(prop, nodeName)
 
-		if m, ok := metrics[nodeName]; ok {
-			ni.Alive, _ = m.GetChildTime("alive")
-			ni.BootTime, _ = m.GetChildTime("boot_time")
-			ni.Role, _ = m.GetChildString("role")
+		if h, ok := health[nodeName]; ok {
+			ni.Alive = h.Alive
+			ni.BootTime = h.BootTime
+			ni.Role = h.Role
 			if ni.Role == "gateway" {
 				a, _ := c.GetProp("@/network/wan/current/address")
 				ni.Addr, _, _ = net.ParseCIDR(a)
@@ -1429,6 +2994,14 @@ func (c *Handle) GetNodes() ([]NodeInfo, error) {
 	return nodes, nil
 }
 
+// GetNodeRole returns the role ("gateway" or "satellite") most recently reported
+// by a node in @/metrics/health/<node>/role.  It is a cheaper alternative to
+// GetNodes when only the role is needed.  ErrNoProp is returned if the node
+// hasn't reported a role.
+func (c *Handle) GetNodeRole(id string) (string, error) {
+	return c.GetProp("@/metrics/health/" + id + "/role")
+}
+
 // GetActiveBlocks builds a slice of all the IP addresses that were being
 // actively blocked at the time of the call.
 func (c *Handle) GetActiveBlocks() []string {
@@ -1443,6 +3016,226 @@ func (c *Handle) GetActiveBlocks() []string {
 	return list
 }
 
+// quarantineVulns returns the names of the active, unignored vulnerabilities
+// which may have caused a client to be quarantined.
+func quarantineVulns(client *PropertyNode) []string {
+	names := make([]string, 0)
+	if vulns, err := client.GetChild("vulnerabilities"); err == nil {
+		for name, vuln := range vulns.Children {
+			active, _ := vuln.GetChildBool("active")
+			ignore, _ := vuln.GetChildBool("ignore")
+			if active && !ignore {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetQuarantinedClients returns the clients which are in the quarantine ring,
+// or whose IPv4 address is actively blocked by the firewall, sorted by MAC
+// address.  Since is when the client's ring was last changed, or when its
+// address was blocked, whichever is earlier.
+func (c *Handle) GetQuarantinedClients() ([]QuarantineInfo, error) {
+	list := make([]QuarantineInfo, 0)
+
+	clients, err := c.GetProps("@/clients")
+	if err == ErrNoProp {
+		return list, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	blocks, err := c.GetProps("@/firewall/blocked")
+	if err == ErrNoProp {
+		blocks = &PropertyNode{}
+	} else if err != nil {
+		return nil, err
+	}
+
+	for mac, client := range clients.Children {
+		var reasons []string
+		var since *time.Time
+
+		earliest := func(t *time.Time) {
+			if t != nil && (since == nil || t.Before(*since)) {
+				since = t
+			}
+		}
+
+		if ring, err := client.GetChild("ring"); err == nil &&
+			ring.Value == base_def.RING_QUARANTINE {
+			reason := "quarantined"
+			if vulns := quarantineVulns(client); len(vulns) > 0 {
+				reason = "vulnerable: " + strings.Join(vulns, ",")
+			}
+			reasons = append(reasons, reason)
+			earliest(ring.Modified)
+		}
+
+		addr, _ := client.GetChildString("ipv4")
+		if block, err := blocks.GetChild(addr); err == nil && addr != "" {
+			reasons = append(reasons, "address blocked")
+			earliest(block.Modified)
+		}
+
+		if len(reasons) > 0 {
+			list = append(list, QuarantineInfo{
+				MAC:    mac,
+				Reason: strings.Join(reasons, "; "),
+				Since:  since,
+			})
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].MAC < list[j].MAC
+	})
+	return list, nil
+}
+
+// The actions an appliance may record as pending under @/pending/<name>
+const (
+	PendingReboot      = "reboot"
+	PendingUpgrade     = "upgrade"
+	PendingConfigApply = "config-apply"
+)
+
+// ValidPendingActions is a map containing all of the known pending action
+// names.
+var ValidPendingActions = map[string]bool{
+	PendingReboot:      true,
+	PendingUpgrade:     true,
+	PendingConfigApply: true,
+}
+
+// PendingAction describes an action the appliance intends to take at the
+// scheduled time, recorded in @/pending/<name>/scheduled.
+type PendingAction struct {
+	Name      string    `json:"name"`
+	Scheduled time.Time `json:"scheduled"`
+}
+
+// GetPendingActions returns the appliance's pending actions, ordered by their
+// scheduled times.  Unknown actions, and those without a valid scheduled time,
+// are skipped.  The slice is empty if nothing is pending.
+func (c *Handle) GetPendingActions() ([]PendingAction, error) {
+	const prop = "@/pending"
+
+	rval := make([]PendingAction, 0)
+	props, err := c.GetProps(prop)
+	if IsConfigAbsent(err) {
+		return rval, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("property get %s failed: %w", prop, err)
+	}
+
+	for name, node := range props.Children {
+		if !ValidPendingActions[name] {
+			continue
+		}
+		scheduled, err := node.GetChildTime("scheduled")
+		if err != nil || scheduled == nil {
+			continue
+		}
+		rval = append(rval, PendingAction{
+			Name:      name,
+			Scheduled: *scheduled,
+		})
+	}
+	sort.Slice(rval, func(i, j int) bool {
+		if !rval[i].Scheduled.Equal(rval[j].Scheduled) {
+			return rval[i].Scheduled.Before(rval[j].Scheduled)
+		}
+		return rval[i].Name < rval[j].Name
+	})
+	return rval, nil
+}
+
+// ClearPendingAction removes a pending action.  Clearing an action which isn't
+// pending is not an error.
+func (c *Handle) ClearPendingAction(name string) error {
+	if !ValidPendingActions[name] {
+		return fmt.Errorf("unknown pending action: %s", name)
+	}
+
+	prop := "@/pending/" + name
+	err := c.DeleteProp(prop)
+	if err != nil && !errors.Is(err, ErrNoProp) {
+		return fmt.Errorf("property delete %s failed: %w", prop, err)
+	}
+	return nil
+}
+
+// PendingRestartPath is the subtree in which daemons record changes they have
+// accepted but not yet applied.  When a daemon defers a change until one of
+// its services restarts, it sets @/status/pending_restart/<service> to the
+// reason for the restart; it removes the property once the restart happens.
+const PendingRestartPath = "@/status/pending_restart"
+
+// PendingRestart describes a service restart which is needed to apply a
+// change.  Since is the time the restart was first deferred.
+type PendingRestart struct {
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+}
+
+// GetPendingRestarts returns the services which are waiting to be restarted,
+// keyed by service name.  The map is empty if nothing is pending.
+func (c *Handle) GetPendingRestarts() (map[string]PendingRestart, error) {
+	rval := make(map[string]PendingRestart)
+	props, err := c.GetProps(PendingRestartPath)
+	if IsConfigAbsent(err) {
+		return rval, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("property get %s failed: %w",
+			PendingRestartPath, err)
+	}
+
+	for service, node := range props.Children {
+		var restart PendingRestart
+		restart.Reason = node.Value
+		if node.Modified != nil {
+			restart.Since = *node.Modified
+		}
+		rval[service] = restart
+	}
+	return rval, nil
+}
+
+// HasPendingChanges returns true if any service is waiting to be restarted to
+// apply a change.
+func (c *Handle) HasPendingChanges() (bool, error) {
+	restarts, err := c.GetPendingRestarts()
+	if err != nil {
+		return false, err
+	}
+	return len(restarts) > 0, nil
+}
+
+// SetPendingRestart records that a service needs to be restarted to apply a
+// change, and why.
+func (c *Handle) SetPendingRestart(service, reason string) error {
+	prop := PendingRestartPath + "/" + service
+	if err := c.CreateProp(prop, reason, nil); err != nil {
+		return fmt.Errorf("property set %s failed: %w", prop, err)
+	}
+	return nil
+}
+
+// ClearPendingRestart records that a service has been restarted, and no longer
+// has changes waiting to be applied.  Clearing a service which has nothing
+// pending is not an error.
+func (c *Handle) ClearPendingRestart(service string) error {
+	prop := PendingRestartPath + "/" + service
+	err := c.DeleteProp(prop)
+	if err != nil && !errors.Is(err, ErrNoProp) {
+		return fmt.Errorf("property delete %s failed: %w", prop, err)
+	}
+	return nil
+}
+
 // GetDomain returns the default "appliance domainname" -- i.e.
 // <integer>.[<jurisdiction>.]brightgate.net.
 func (c *Handle) GetDomain() (string, error) {
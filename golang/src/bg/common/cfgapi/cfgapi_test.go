@@ -0,0 +1,1174 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package cfgapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bg/common/wifi"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testModified = time.Date(2020, 3, 14, 15, 9, 26, 535897932, time.UTC)
+	testExpires  = time.Date(2020, 3, 15, 0, 0, 0, 0, time.UTC)
+)
+
+type testLeaf struct {
+	path    string
+	value   string
+	expires *time.Time
+}
+
+var testLeaves = []testLeaf{
+	{"network/base_address", "192.168.0.2/24", nil},
+	{"network/vap/psk/ssid", "setme", nil},
+	{"network/vap/psk/keymgmt", "wpa-psk", nil},
+	{"network/vap/eap/ssid", "setme-eap", nil},
+	{"clients/00:11:22:33:44:55/ring", "standard", &testExpires},
+	{"clients/00:11:22:33:44:55/ipv4", "192.168.2.10", &testExpires},
+	{"site_index", "0", nil},
+}
+
+// buildTree assembles a tree from the test leaves, inserting them in the
+// order given by 'order'.  All timestamps are expressed in 'loc'.
+func buildTree(order []int, loc *time.Location) *PropertyNode {
+	modified := testModified.In(loc)
+	root := &PropertyNode{Modified: &modified}
+
+	for _, idx := range order {
+		leaf := testLeaves[idx]
+		node := root
+		for _, name := range strings.Split(leaf.path, "/") {
+			if node.Children == nil {
+				node.Children = make(ChildMap)
+			}
+			child, ok := node.Children[name]
+			if !ok {
+				child = &PropertyNode{Modified: &modified}
+				node.Children[name] = child
+			}
+			node = child
+		}
+		node.Value = leaf.value
+		if leaf.expires != nil {
+			expires := leaf.expires.In(loc)
+			node.Expires = &expires
+		}
+	}
+	return root
+}
+
+func forward() []int {
+	order := make([]int, len(testLeaves))
+	for i := range order {
+		order[i] = i
+	}
+	return order
+}
+
+func backward() []int {
+	order := make([]int, len(testLeaves))
+	for i := range order {
+		order[i] = len(testLeaves) - 1 - i
+	}
+	return order
+}
+
+func TestMarshalCanonical(t *testing.T) {
+	assert := require.New(t)
+
+	pacific := time.FixedZone("PDT", -7*60*60)
+	a := buildTree(forward(), time.UTC)
+	b := buildTree(backward(), pacific)
+
+	aJSON, err := a.MarshalCanonical()
+	assert.NoError(err)
+	t.Logf("canonical: %s", string(aJSON))
+
+	for i := 0; i < 20; i++ {
+		again, err := a.MarshalCanonical()
+		assert.NoError(err)
+		assert.Equal(aJSON, again)
+
+		bJSON, err := b.MarshalCanonical()
+		assert.NoError(err)
+		assert.Equal(aJSON, bJSON)
+	}
+
+	// Children are sorted, and timestamps are in UTC
+	s := string(aJSON)
+	assert.True(strings.Index(s, `"clients"`) < strings.Index(s, `"network"`))
+	assert.True(strings.Index(s, `"network"`) < strings.Index(s, `"site_index"`))
+	assert.True(strings.Index(s, `"eap"`) < strings.Index(s, `"psk"`))
+	psk := s[strings.Index(s, `"psk"`):]
+	assert.True(strings.Index(psk, `"keymgmt"`) < strings.Index(psk, `"ssid"`))
+	assert.Contains(s, `"Modified":"2020-03-14T15:09:26.535897932Z"`)
+	assert.Contains(s, `"Expires":"2020-03-15T00:00:00Z"`)
+	assert.NotContains(s, "-07:00")
+
+	// The canonical form is valid JSON which unmarshals to the same tree
+	var c PropertyNode
+	assert.NoError(json.Unmarshal(aJSON, &c))
+	cJSON, err := c.MarshalCanonical()
+	assert.NoError(err)
+	assert.Equal(aJSON, cJSON)
+
+	// The default marshaling is untouched
+	bDefault, err := json.Marshal(b)
+	assert.NoError(err)
+	assert.Contains(string(bDefault), "-07:00")
+}
+
+func TestDumpTreeCanonical(t *testing.T) {
+	assert := require.New(t)
+
+	pacific := time.FixedZone("PDT", -7*60*60)
+	expires := time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+	dump := func(order []int, loc *time.Location) string {
+		var b strings.Builder
+		root := buildTree(order, loc)
+		e := expires.In(loc)
+		root.Children["site_index"].Expires = &e
+		root.DumpTreeCanonical(&b, "@")
+		return b.String()
+	}
+
+	a := dump(forward(), time.UTC)
+	t.Logf("canonical dump:\n%s", a)
+	for i := 0; i < 20; i++ {
+		assert.Equal(a, dump(backward(), pacific))
+	}
+
+	// Children are sorted by name alone, rather than leaves first, and
+	// expiration times are in UTC
+	assert.True(strings.Index(a, "network:") < strings.Index(a, "site_index:"))
+	assert.True(strings.Index(a, "keymgmt:") < strings.Index(a, "ssid: setme\n"))
+	assert.Contains(a, "site_index: 0  2099-01-01T00:00:00Z\n")
+
+	// The default dump is untouched
+	var b strings.Builder
+	buildTree(forward(), time.UTC).DumpTree(&b, "@")
+	assert.True(strings.Index(b.String(), "site_index:") < strings.Index(b.String(), "network:"))
+}
+
+func TestHash(t *testing.T) {
+	assert := require.New(t)
+
+	mustHash := func(n *PropertyNode) []byte {
+		h, err := n.Hash()
+		assert.NoError(err)
+		assert.Len(h, 32)
+		return h
+	}
+
+	base := mustHash(buildTree(forward(), time.UTC))
+	assert.Equal(base, mustHash(buildTree(forward(), time.UTC)))
+	assert.Equal(base, mustHash(buildTree(backward(), time.Local)))
+
+	// Value change
+	n := buildTree(forward(), time.UTC)
+	n.Children["site_index"].Value = "1"
+	assert.NotEqual(base, mustHash(n))
+
+	// Expiration changes
+	n = buildTree(forward(), time.UTC)
+	ring := n.Children["clients"].Children["00:11:22:33:44:55"].Children["ring"]
+	later := ring.Expires.Add(time.Nanosecond)
+	ring.Expires = &later
+	assert.NotEqual(base, mustHash(n))
+
+	ring.Expires = nil
+	assert.NotEqual(base, mustHash(n))
+
+	n = buildTree(forward(), time.UTC)
+	n.Children["site_index"].Expires = &testExpires
+	assert.NotEqual(base, mustHash(n))
+
+	// Structural changes
+	n = buildTree(forward(), time.UTC)
+	delete(n.Children["network"].Children["vap"].Children, "eap")
+	assert.NotEqual(base, mustHash(n))
+
+	n = buildTree(forward(), time.UTC)
+	psk := n.Children["network"].Children["vap"].Children["psk"]
+	psk.Children["passphrase"] = &PropertyNode{}
+	assert.NotEqual(base, mustHash(n))
+
+	// Same leaves, reattached under a different parent
+	n = buildTree(forward(), time.UTC)
+	vaps := n.Children["network"].Children["vap"].Children
+	vaps["guest"] = vaps["eap"]
+	delete(vaps, "eap")
+	assert.NotEqual(base, mustHash(n))
+
+	n = buildTree(forward(), time.UTC)
+	n.Children["site_index"].Children = ChildMap{
+		"0": &PropertyNode{},
+	}
+	assert.NotEqual(base, mustHash(n))
+}
+
+// testExec is a minimal ConfigExec, which serves PropGet operations from a
+// fixed tree (or, if raw is set, with that JSON) and counts how many it has
+// seen.  If err is set, every read fails with that error instead.  Other
+// operations are refused, unless sink is set, in which case they succeed and
+// are recorded along with their access level and origin.  Pings take
+// pingDelay to complete, and change handlers may be registered for any path
+// other than badPath, and are driven by change().
+type testExec struct {
+	root      *PropertyNode
+	raw       string
+	err       error
+	sink      bool
+	pingDelay time.Duration
+
+	badPath        string
+	changeHandlers []testChangeHandler
+
+	gets    int
+	ops     []PropertyOp
+	levels  []AccessLevel
+	origins []string
+	mu      sync.Mutex
+}
+
+// newSinkExec builds a sink whose tree claims the given cfgversion, or none
+// if it is ""
+func newSinkExec(version string) *testExec {
+	root := &PropertyNode{
+		Children: ChildMap{
+			"network": &PropertyNode{
+				Children: ChildMap{
+					"base_address": &PropertyNode{
+						Value: "192.168.0.2/24",
+					},
+				},
+			},
+		},
+	}
+	if version != "" {
+		root.Children["cfgversion"] = &PropertyNode{Value: version}
+	}
+
+	return &testExec{root: root, sink: true}
+}
+
+type testChangeHandler struct {
+	match   *regexp.Regexp
+	handler func([]string, string, *time.Time)
+}
+
+type testCmdHdl struct {
+	rval string
+	err  error
+}
+
+func (h *testCmdHdl) Status(ctx context.Context) (string, error) {
+	return h.rval, h.err
+}
+
+func (h *testCmdHdl) Wait(ctx context.Context) (string, error) {
+	return h.rval, h.err
+}
+
+func (h *testCmdHdl) Cancel(ctx context.Context) error {
+	return nil
+}
+
+func (e *testExec) Execute(ctx context.Context, ops []PropertyOp) CmdHdl {
+	return e.ExecuteAt(ctx, ops, AccessUser)
+}
+
+func (e *testExec) ExecuteAt(ctx context.Context, ops []PropertyOp,
+	level AccessLevel) CmdHdl {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(ops) == 1 && ops[0].Op == PropGet {
+		e.gets++
+		if e.err != nil {
+			return &testCmdHdl{err: e.err}
+		}
+		return e.get(ops[0].Name)
+	}
+	if !e.sink {
+		return &testCmdHdl{err: ErrNotSupp}
+	}
+
+	e.ops = append(e.ops, ops...)
+	e.levels = append(e.levels, level)
+	e.origins = append(e.origins, OriginFromContext(ctx))
+	return &testCmdHdl{rval: "ok"}
+}
+
+func (e *testExec) get(prop string) CmdHdl {
+	if e.raw != "" {
+		return &testCmdHdl{rval: e.raw}
+	}
+
+	node := e.root
+	path := strings.TrimPrefix(prop, "@/")
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		child, ok := node.Children[name]
+		if !ok {
+			return &testCmdHdl{err: ErrNoProp}
+		}
+		node = child
+	}
+
+	b, err := json.Marshal(node)
+	if err != nil {
+		return &testCmdHdl{err: err}
+	}
+	return &testCmdHdl{rval: string(b)}
+}
+
+func (e *testExec) Ping(ctx context.Context) error {
+	if e.pingDelay == 0 {
+		return nil
+	}
+	select {
+	case <-time.After(e.pingDelay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *testExec) Close() {}
+
+func (e *testExec) HandleChange(path string,
+	handler func([]string, string, *time.Time)) error {
+	if path == e.badPath {
+		return ErrNotSupp
+	}
+	re, err := regexp.Compile(path)
+	if err == nil {
+		e.changeHandlers = append(e.changeHandlers,
+			testChangeHandler{match: re, handler: handler})
+	}
+	return err
+}
+
+// change delivers a change event to every handler whose path matches
+func (e *testExec) change(prop, val string) {
+	levels := strings.Split(prop[2:], "/")
+	for _, h := range e.changeHandlers {
+		if h.match.MatchString(prop) {
+			h.handler(levels, val, nil)
+		}
+	}
+}
+
+func (e *testExec) HandleDelete(path string, handler func([]string)) error {
+	return ErrNotSupp
+}
+
+func (e *testExec) HandleExpire(path string, handler func([]string)) error {
+	return ErrNotSupp
+}
+
+func TestGetClientsByMACs(t *testing.T) {
+	assert := require.New(t)
+
+	exec := &testExec{
+		root: &PropertyNode{Children: ChildMap{
+			"clients": &PropertyNode{Children: ChildMap{
+				"00:11:22:33:44:55": &PropertyNode{Children: ChildMap{
+					"ring": &PropertyNode{Value: "standard"},
+					"ipv4": &PropertyNode{Value: "192.168.2.10"},
+				}},
+				"66:77:88:99:aa:bb": &PropertyNode{Children: ChildMap{
+					"ring": &PropertyNode{Value: "devices"},
+				}},
+			}},
+			"site_index": &PropertyNode{Value: "0"},
+		}},
+	}
+	c := NewHandle(exec)
+
+	// Partial hit: one known client, one unknown
+	set, err := c.GetClientsByMACs([]string{
+		"00:11:22:33:44:55",
+		"de:ad:be:ef:00:01",
+	})
+	assert.NoError(err)
+	assert.Equal(1, exec.gets)
+	assert.Len(set, 1)
+	assert.Contains(set, "00:11:22:33:44:55")
+	assert.NotContains(set, "de:ad:be:ef:00:01")
+	assert.Equal("standard", set["00:11:22:33:44:55"].Ring)
+	assert.Equal("192.168.2.10", set["00:11:22:33:44:55"].IPv4.String())
+
+	// Everything requested is present
+	set, err = c.GetClientsByMACs([]string{
+		"00:11:22:33:44:55",
+		"66:77:88:99:aa:bb",
+	})
+	assert.NoError(err)
+	assert.Equal(2, exec.gets)
+	assert.Len(set, 2)
+	assert.Equal("devices", set["66:77:88:99:aa:bb"].Ring)
+
+	// Nothing requested is present
+	set, err = c.GetClientsByMACs([]string{"de:ad:be:ef:00:01"})
+	assert.NoError(err)
+	assert.Empty(set)
+
+	// No clients at all
+	delete(exec.root.Children, "clients")
+	set, err = c.GetClientsByMACs([]string{"00:11:22:33:44:55"})
+	assert.NoError(err)
+	assert.NotNil(set)
+	assert.Empty(set)
+}
+
+func testConnection(vap, wireless, active string) *PropertyNode {
+	conn := &PropertyNode{Children: ChildMap{
+		"wireless": &PropertyNode{Value: wireless},
+		"active":   &PropertyNode{Value: active},
+	}}
+	if vap != "" {
+		conn.Children["vap"] = &PropertyNode{Value: vap}
+	}
+	return conn
+}
+
+func TestGetVAPClientCounts(t *testing.T) {
+	assert := require.New(t)
+
+	exec := &testExec{
+		root: &PropertyNode{Children: ChildMap{
+			"network": &PropertyNode{Children: ChildMap{
+				"vap": &PropertyNode{Children: ChildMap{
+					"psk":   &PropertyNode{Children: ChildMap{}},
+					"eap":   &PropertyNode{Children: ChildMap{}},
+					"guest": &PropertyNode{Children: ChildMap{}},
+				}},
+			}},
+			"clients": &PropertyNode{Children: ChildMap{
+				"00:00:00:00:00:01": &PropertyNode{Children: ChildMap{
+					"connection": testConnection("psk", "true", "true"),
+				}},
+				"00:00:00:00:00:02": &PropertyNode{Children: ChildMap{
+					"connection": testConnection("psk", "true", "true"),
+				}},
+				"00:00:00:00:00:03": &PropertyNode{Children: ChildMap{
+					"connection": testConnection("eap", "true", "true"),
+				}},
+				// Last seen on psk, but since disconnected
+				"00:00:00:00:00:04": &PropertyNode{Children: ChildMap{
+					"connection": testConnection("psk", "true", "false"),
+				}},
+				// Wired clients
+				"00:00:00:00:00:05": &PropertyNode{Children: ChildMap{
+					"connection": testConnection("", "false", "true"),
+				}},
+				"00:00:00:00:00:06": &PropertyNode{Children: ChildMap{
+					"ipv4":       &PropertyNode{Value: "192.168.2.10"},
+					"connection": testConnection("", "false", ""),
+				}},
+				// Connected to a VAP which no longer exists
+				"00:00:00:00:00:07": &PropertyNode{Children: ChildMap{
+					"connection": testConnection("old", "true", "true"),
+				}},
+				// Never connected
+				"00:00:00:00:00:08": &PropertyNode{Children: ChildMap{
+					"ring": &PropertyNode{Value: "unenrolled"},
+				}},
+			}},
+		}},
+	}
+	c := NewHandle(exec)
+
+	counts, err := c.GetVAPClientCounts()
+	assert.NoError(err)
+	assert.Equal(map[string]int{"psk": 2, "eap": 1, "guest": 0}, counts)
+
+	// No clients at all
+	delete(exec.root.Children, "clients")
+	counts, err = c.GetVAPClientCounts()
+	assert.NoError(err)
+	assert.Equal(map[string]int{"psk": 0, "eap": 0, "guest": 0}, counts)
+
+	// No VAPs
+	delete(exec.root.Children, "network")
+	counts, err = c.GetVAPClientCounts()
+	assert.NoError(err)
+	assert.NotNil(counts)
+	assert.Empty(counts)
+
+	exec.err = ErrComm
+	counts, err = c.GetVAPClientCounts()
+	assert.Error(err)
+	assert.Nil(counts)
+}
+
+func regChannels(chans []RegChannel) []int {
+	list := make([]int, 0)
+	for _, c := range chans {
+		list = append(list, c.Channel)
+	}
+	return list
+}
+
+func TestGetRegulatoryInfo(t *testing.T) {
+	assert := require.New(t)
+
+	network := &PropertyNode{Children: ChildMap{}}
+	exec := &testExec{
+		root: &PropertyNode{Children: ChildMap{
+			"network": network,
+		}},
+	}
+	c := NewHandle(exec)
+	setDomain := func(domain string) {
+		network.Children["regdomain"] = &PropertyNode{Value: domain}
+	}
+
+	// With no regdomain configured, we get the US rules
+	info, err := c.GetRegulatoryInfo()
+	assert.NoError(err)
+	assert.Equal("US", info.CountryCode)
+	assert.Equal(wifi.Channels[wifi.LoBand],
+		regChannels(info.Channels[wifi.LoBand]))
+	assert.Equal(wifi.Channels[wifi.HiBand],
+		regChannels(info.Channels[wifi.HiBand]))
+	for _, ch := range info.Channels[wifi.HiBand] {
+		switch {
+		case ch.Channel < 52:
+			assert.False(ch.DFS)
+			assert.Equal(23, ch.MaxPower)
+		case ch.Channel < 149:
+			assert.True(ch.DFS)
+		default:
+			assert.False(ch.DFS)
+			assert.Equal(30, ch.MaxPower)
+		}
+	}
+
+	// Great Britain allows channels 12 and 13, but nothing above 140
+	setDomain("gb")
+	info, err = c.GetRegulatoryInfo()
+	assert.NoError(err)
+	assert.Equal("GB", info.CountryCode)
+	assert.Equal([]int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13},
+		regChannels(info.Channels[wifi.LoBand]))
+	hi := info.Channels[wifi.HiBand]
+	assert.Equal(36, hi[0].Channel)
+	assert.Equal(140, hi[len(hi)-1].Channel)
+	assert.Len(hi, 19)
+	for _, ch := range info.Channels[wifi.LoBand] {
+		assert.Equal(20, ch.MaxPower)
+	}
+
+	// Japan
+	setDomain("JP")
+	info, err = c.GetRegulatoryInfo()
+	assert.NoError(err)
+	assert.Equal("JP", info.CountryCode)
+	assert.Len(info.Channels[wifi.LoBand], 13)
+	assert.NotContains(regChannels(info.Channels[wifi.HiBand]), 149)
+
+	// A country we have no rules for gets the world rules
+	setDomain("ZZ")
+	info, err = c.GetRegulatoryInfo()
+	assert.NoError(err)
+	assert.Equal("ZZ", info.CountryCode)
+	assert.Equal([]int{36, 40, 44, 48},
+		regChannels(info.Channels[wifi.HiBand]))
+
+	// A malformed regdomain falls back to the default
+	setDomain("USA")
+	info, err = c.GetRegulatoryInfo()
+	assert.NoError(err)
+	assert.Equal(wifi.DefaultRegDomain, info.CountryCode)
+}
+
+func TestGetChannelUtilization(t *testing.T) {
+	assert := require.New(t)
+
+	node := "001-201901BB-000001"
+	exec := &testExec{
+		root: &PropertyNode{Children: ChildMap{
+			"metrics": &PropertyNode{Children: ChildMap{
+				"wifi": &PropertyNode{Children: ChildMap{
+					node: &PropertyNode{Children: ChildMap{
+						wifi.LoBand: &PropertyNode{Children: ChildMap{
+							"busy":        &PropertyNode{Value: "42.5"},
+							"noise_floor": &PropertyNode{Value: "-95"},
+						}},
+						wifi.HiBand: &PropertyNode{Children: ChildMap{
+							"busy": &PropertyNode{Value: "7"},
+						}},
+						// Not a band
+						"assoc": &PropertyNode{Value: "12"},
+					}},
+				}},
+			}},
+		}},
+	}
+	c := NewHandle(exec)
+
+	util, err := c.GetChannelUtilization(node)
+	assert.NoError(err)
+	assert.Len(util, 2)
+	assert.Equal(ChannelUtil{Busy: 42.5, NoiseFloor: -95}, util[wifi.LoBand])
+	assert.Equal(ChannelUtil{Busy: 7}, util[wifi.HiBand])
+
+	// A node which hasn't recorded anything
+	util, err = c.GetChannelUtilization("001-201901BB-000002")
+	assert.NoError(err)
+	assert.NotNil(util)
+	assert.Empty(util)
+
+	// A band without a busy measurement is skipped
+	exec.root.Children["metrics"].Children["wifi"].Children[node] =
+		&PropertyNode{Children: ChildMap{
+			wifi.LoBand: &PropertyNode{Children: ChildMap{
+				"noise_floor": &PropertyNode{Value: "-95"},
+			}},
+		}}
+	util, err = c.GetChannelUtilization(node)
+	assert.NoError(err)
+	assert.Empty(util)
+
+	exec.err = ErrComm
+	util, err = c.GetChannelUtilization(node)
+	assert.Error(err)
+	assert.False(IsConfigAbsent(err))
+	assert.Nil(util)
+}
+
+func TestGetWifiSurvey(t *testing.T) {
+	assert := require.New(t)
+
+	node := "001-201901BB-000001"
+	exec := &testExec{
+		root: &PropertyNode{Children: ChildMap{
+			"metrics": &PropertyNode{Children: ChildMap{
+				"wifi": &PropertyNode{Children: ChildMap{
+					node: &PropertyNode{Children: ChildMap{
+						wifi.LoBand: &PropertyNode{Children: ChildMap{
+							"busy": &PropertyNode{Value: "42.5"},
+							"survey": &PropertyNode{Children: ChildMap{
+								"11": &PropertyNode{Children: ChildMap{
+									"neighbors": &PropertyNode{Value: "2"},
+									"signal":    &PropertyNode{Value: "-70"},
+								}},
+								"1": &PropertyNode{Children: ChildMap{
+									"neighbors": &PropertyNode{Value: "5"},
+									"signal":    &PropertyNode{Value: "-48"},
+								}},
+								// Malformed entries are skipped
+								"6": &PropertyNode{Children: ChildMap{
+									"signal": &PropertyNode{Value: "-60"},
+								}},
+								"bogus": &PropertyNode{Children: ChildMap{
+									"neighbors": &PropertyNode{Value: "1"},
+								}},
+							}},
+						}},
+						// No survey for this band
+						wifi.HiBand: &PropertyNode{Children: ChildMap{
+							"busy": &PropertyNode{Value: "7"},
+						}},
+					}},
+				}},
+			}},
+		}},
+	}
+	c := NewHandle(exec)
+
+	survey, err := c.GetWifiSurvey(node)
+	assert.NoError(err)
+	assert.Len(survey, 1)
+	assert.Equal([]SurveyChannel{
+		{Channel: 1, Neighbors: 5, Signal: -48},
+		{Channel: 11, Neighbors: 2, Signal: -70},
+	}, survey[wifi.LoBand])
+
+	survey, err = c.GetWifiSurvey("001-201901BB-000002")
+	assert.NoError(err)
+	assert.NotNil(survey)
+	assert.Empty(survey)
+
+	exec.err = ErrComm
+	survey, err = c.GetWifiSurvey(node)
+	assert.Error(err)
+	assert.Nil(survey)
+}
+
+func TestGetNodeRole(t *testing.T) {
+	assert := require.New(t)
+
+	gateway := "001-201901BB-000001"
+	satellite := "001-201901BB-000002"
+	exec := &testExec{
+		root: &PropertyNode{Children: ChildMap{
+			"metrics": &PropertyNode{Children: ChildMap{
+				"health": &PropertyNode{Children: ChildMap{
+					gateway: &PropertyNode{Children: ChildMap{
+						"role":  &PropertyNode{Value: "gateway"},
+						"alive": &PropertyNode{Value: "2020-04-01T12:00:00Z"},
+					}},
+					satellite: &PropertyNode{Children: ChildMap{
+						"role": &PropertyNode{Value: "satellite"},
+					}},
+					// Hasn't reported a role yet
+					"001-201901BB-000003": &PropertyNode{Children: ChildMap{
+						"alive": &PropertyNode{Value: "2020-04-01T12:00:00Z"},
+					}},
+				}},
+			}},
+		}},
+	}
+	c := NewHandle(exec)
+
+	role, err := c.GetNodeRole(gateway)
+	assert.NoError(err)
+	assert.Equal("gateway", role)
+
+	role, err = c.GetNodeRole(satellite)
+	assert.NoError(err)
+	assert.Equal("satellite", role)
+
+	_, err = c.GetNodeRole("001-201901BB-000003")
+	assert.Equal(ErrNoProp, err)
+	_, err = c.GetNodeRole("001-201901BB-000004")
+	assert.Equal(ErrNoProp, err)
+
+	exec.err = ErrComm
+	_, err = c.GetNodeRole(gateway)
+	assert.Error(err)
+	assert.False(IsConfigAbsent(err))
+}
+
+func testWirelessNic(settings map[string]string) *PropertyNode {
+	nic := &PropertyNode{Children: ChildMap{
+		"kind": &PropertyNode{Value: "wireless"},
+	}}
+	for name, val := range settings {
+		nic.Children[name] = &PropertyNode{Value: val}
+	}
+	return nic
+}
+
+func TestGetWifiConfigDrift(t *testing.T) {
+	assert := require.New(t)
+
+	gateway := "001-201901BB-000001"
+	satellite := "001-201901BB-000002"
+	exec := &testExec{
+		root: &PropertyNode{Children: ChildMap{
+			"nodes": &PropertyNode{Children: ChildMap{
+				gateway: &PropertyNode{Children: ChildMap{
+					"nics": &PropertyNode{Children: ChildMap{
+						// Running as configured
+						"wlan0": testWirelessNic(map[string]string{
+							"cfg_band":       wifi.LoBand,
+							"cfg_channel":    "6",
+							"cfg_width":      "20",
+							"active_band":    wifi.LoBand,
+							"active_channel": "6",
+							"active_width":   "20",
+						}),
+						// Nothing configured, so nothing to drift
+						"wlan1": testWirelessNic(map[string]string{
+							"active_band":    wifi.HiBand,
+							"active_channel": "149",
+							"active_width":   "80",
+						}),
+						"wan": &PropertyNode{Children: ChildMap{
+							"kind": &PropertyNode{Value: "wired"},
+						}},
+					}},
+				}},
+				satellite: &PropertyNode{Children: ChildMap{
+					"nics": &PropertyNode{Children: ChildMap{
+						// Channel change not applied yet; the
+						// band is chosen automatically.
+						"wlan0": testWirelessNic(map[string]string{
+							"cfg_channel":    "11",
+							"active_band":    wifi.LoBand,
+							"active_channel": "1",
+							"active_width":   "20",
+						}),
+						// Radio never came up
+						"wlan1": testWirelessNic(map[string]string{
+							"cfg_band":    wifi.HiBand,
+							"cfg_channel": "36",
+							"cfg_width":   "40",
+						}),
+					}},
+				}},
+			}},
+		}},
+	}
+	c := NewHandle(exec)
+
+	drift, err := c.GetWifiConfigDrift()
+	assert.NoError(err)
+	assert.Equal(map[string]WifiDrift{
+		satellite + "/wlan0": {
+			Fields:        []string{"channel"},
+			ConfigChannel: 11,
+			ActiveBand:    wifi.LoBand,
+			ActiveChannel: 1,
+			ActiveWidth:   "20",
+		},
+		satellite + "/wlan1": {
+			Fields:        []string{"band", "channel", "width"},
+			ConfigBand:    wifi.HiBand,
+			ConfigChannel: 36,
+			ConfigWidth:   "40",
+		},
+	}, drift)
+
+	// Once the change is applied, the drift goes away
+	wlan0 := exec.root.Children["nodes"].Children[satellite].Children["nics"].Children["wlan0"]
+	wlan0.Children["active_channel"].Value = "11"
+	drift, err = c.GetWifiConfigDrift()
+	assert.NoError(err)
+	assert.Len(drift, 1)
+	assert.Contains(drift, satellite+"/wlan1")
+
+	exec.root = &PropertyNode{Children: ChildMap{}}
+	drift, err = c.GetWifiConfigDrift()
+	assert.NoError(err)
+	assert.NotNil(drift)
+	assert.Empty(drift)
+
+	exec.err = ErrComm
+	drift, err = c.GetWifiConfigDrift()
+	assert.Error(err)
+	assert.Nil(drift)
+}
+
+func testGetterTree() *PropertyNode {
+	return &PropertyNode{Children: ChildMap{
+		"siteid":     &PropertyNode{Value: "7810.brightgate.net"},
+		"site_index": &PropertyNode{Value: "0"},
+		"network": &PropertyNode{Children: ChildMap{
+			"base_address": &PropertyNode{Value: "192.168.0.0/24"},
+			"dnsserver":    &PropertyNode{Value: "8.8.8.8"},
+			"wan": &PropertyNode{Children: ChildMap{
+				"current": &PropertyNode{Children: ChildMap{
+					"address": &PropertyNode{Value: "10.0.0.5/24"},
+				}},
+			}},
+		}},
+		"rings": &PropertyNode{Children: ChildMap{
+			"standard": &PropertyNode{Children: ChildMap{
+				"vlan":           &PropertyNode{Value: "0"},
+				"vap":            &PropertyNode{Value: "psk"},
+				"lease_duration": &PropertyNode{Value: "1440"},
+			}},
+		}},
+	}}
+}
+
+func TestGettersPresent(t *testing.T) {
+	assert := require.New(t)
+	c := NewHandle(&testExec{root: testGetterTree()})
+
+	rings, err := c.GetRings()
+	assert.NoError(err)
+	assert.Len(rings, 1)
+	assert.Equal([]string{"psk"}, rings["standard"].VirtualAPs)
+	assert.Equal(rings, c.GetRingsLegacy())
+
+	wan, err := c.GetWanInfo()
+	assert.NoError(err)
+	assert.Equal("10.0.0.5/24", wan.CurrentAddress)
+	assert.Equal("8.8.8.8", wan.DNSServer)
+
+	dns, err := c.GetDNSInfo()
+	assert.NoError(err)
+	assert.Equal("7810.brightgate.net", dns.Domain)
+	assert.Equal([]string{"8.8.8.8"}, dns.Servers)
+}
+
+func TestGettersAbsent(t *testing.T) {
+	assert := require.New(t)
+
+	// A site with a config tree, but none of the relevant properties
+	exec := &testExec{root: &PropertyNode{Children: ChildMap{
+		"network": &PropertyNode{Children: ChildMap{}},
+	}}}
+	c := NewHandle(exec)
+
+	rings, err := c.GetRings()
+	assert.Error(err)
+	assert.True(IsConfigAbsent(err))
+	assert.Nil(rings)
+	assert.Nil(c.GetRingsLegacy())
+
+	wan, err := c.GetWanInfo()
+	assert.Equal(ErrNoProp, err)
+	assert.True(IsConfigAbsent(err))
+	assert.Nil(wan)
+	assert.Nil(c.GetWanInfoLegacy())
+
+	// Missing DNS properties are simply left empty
+	dns, err := c.GetDNSInfo()
+	assert.NoError(err)
+	assert.Equal("", dns.Domain)
+	assert.Empty(dns.Servers)
+
+	// A site with no config at all
+	exec.err = ErrNoConfig
+	_, err = c.GetRings()
+	assert.True(IsConfigAbsent(err))
+	_, err = c.GetWanInfo()
+	assert.True(IsConfigAbsent(err))
+	_, err = c.GetDNSInfo()
+	assert.True(IsConfigAbsent(err))
+}
+
+func TestGettersCommFailure(t *testing.T) {
+	assert := require.New(t)
+
+	for _, commErr := range []error{ErrComm, ErrTimeout} {
+		exec := &testExec{root: testGetterTree(), err: commErr}
+		c := NewHandle(exec)
+		timeout := commErr == ErrTimeout
+
+		rings, err := c.GetRings()
+		assert.Error(err)
+		assert.False(IsConfigAbsent(err))
+		assert.Equal(timeout, IsConfigTimeout(err))
+		assert.Nil(rings)
+
+		wan, err := c.GetWanInfo()
+		assert.Error(err)
+		assert.False(IsConfigAbsent(err))
+		assert.Equal(timeout, IsConfigTimeout(err))
+		assert.Nil(wan)
+
+		dns, err := c.GetDNSInfo()
+		assert.Error(err)
+		assert.False(IsConfigAbsent(err))
+		assert.Equal(timeout, IsConfigTimeout(err))
+		assert.Nil(dns)
+
+		// The legacy wrappers paper over the failure
+		assert.Nil(c.GetRingsLegacy())
+		assert.Nil(c.GetWanInfoLegacy())
+		dns = c.GetDNSInfoLegacy()
+		assert.NotNil(dns)
+		assert.Equal("", dns.Domain)
+		assert.Empty(dns.Servers)
+	}
+}
+
+func TestGetWanUplinks(t *testing.T) {
+	assert := require.New(t)
+
+	tree := testGetterTree()
+	wan := tree.Children["network"].Children["wan"]
+	exec := &testExec{root: tree}
+	c := NewHandle(exec)
+
+	// A site without failover has only its primary WAN link
+	_, err := c.GetWanUplinks()
+	assert.Equal(ErrNoProp, err)
+	assert.True(IsConfigAbsent(err))
+
+	wan.Children["uplinks"] = &PropertyNode{Children: ChildMap{
+		"lte0": &PropertyNode{Children: ChildMap{
+			"type":     &PropertyNode{Value: "lte"},
+			"priority": &PropertyNode{Value: "20"},
+			"state":    &PropertyNode{Value: UplinkStandby},
+		}},
+		"wan0": &PropertyNode{Children: ChildMap{
+			"type":     &PropertyNode{Value: "ethernet"},
+			"priority": &PropertyNode{Value: "10"},
+			"state":    &PropertyNode{Value: UplinkActive},
+		}},
+	}}
+	uplinks, err := c.GetWanUplinks()
+	assert.NoError(err)
+	assert.Equal([]WanUplink{
+		{Name: "wan0", Type: "ethernet", Priority: 10, State: UplinkActive},
+		{Name: "lte0", Type: "lte", Priority: 20, State: UplinkStandby},
+	}, uplinks)
+
+	// The primary is still reported by GetWanInfo
+	info, err := c.GetWanInfo()
+	assert.NoError(err)
+	assert.Equal("10.0.0.5/24", info.CurrentAddress)
+
+	// After failover, with no state yet for the restored link
+	up := wan.Children["uplinks"]
+	up.Children["lte0"].Children["state"].Value = UplinkActive
+	delete(up.Children["wan0"].Children, "state")
+	uplinks, err = c.GetWanUplinks()
+	assert.NoError(err)
+	assert.Len(uplinks, 2)
+	assert.Equal("", uplinks[0].State)
+	assert.Equal(UplinkActive, uplinks[1].State)
+
+	exec.err = ErrComm
+	uplinks, err = c.GetWanUplinks()
+	assert.Error(err)
+	assert.False(IsConfigAbsent(err))
+	assert.Nil(uplinks)
+}
+
+func TestFindProps(t *testing.T) {
+	assert := require.New(t)
+	exec := &testExec{root: buildTree(forward(), time.UTC)}
+	c := NewHandle(exec)
+
+	props, err := c.FindProps("@/network/vap/*/ssid")
+	assert.NoError(err)
+	assert.Equal(map[string]string{
+		"@/network/vap/psk/ssid": "setme",
+		"@/network/vap/eap/ssid": "setme-eap",
+	}, props)
+	assert.Equal(1, exec.gets)
+
+	props, err = c.FindProps("@/network/vap/p*/*")
+	assert.NoError(err)
+	assert.Equal(map[string]string{
+		"@/network/vap/psk/ssid":    "setme",
+		"@/network/vap/psk/keymgmt": "wpa-psk",
+	}, props)
+
+	// Wildcards don't span levels, and only leaves match
+	props, err = c.FindProps("@/network/*")
+	assert.NoError(err)
+	assert.Equal(map[string]string{
+		"@/network/base_address": "192.168.0.2/24",
+	}, props)
+
+	// A pattern with no literal prefix searches the whole tree
+	props, err = c.FindProps("@/*_index")
+	assert.NoError(err)
+	assert.Equal(map[string]string{"@/site_index": "0"}, props)
+
+	props, err = c.FindProps("@/site_index")
+	assert.NoError(err)
+	assert.Equal(map[string]string{"@/site_index": "0"}, props)
+
+	// Expired properties are skipped
+	props, err = c.FindProps("@/clients/*/ring")
+	assert.NoError(err)
+	assert.Empty(props)
+
+	props, err = c.FindProps("@/nosuch/*")
+	assert.NoError(err)
+	assert.Empty(props)
+
+	_, err = c.FindProps("@/network/[")
+	assert.Error(err)
+	_, err = c.FindProps("network/*")
+	assert.Error(err)
+
+	exec.err = ErrComm
+	_, err = c.FindProps("@/network/*")
+	assert.True(errors.Is(err, ErrComm))
+}
+
+func TestPingTimed(t *testing.T) {
+	assert := require.New(t)
+
+	exec := &testExec{pingDelay: 50 * time.Millisecond}
+	c := NewHandle(exec)
+
+	rtt, err := c.PingTimed(context.Background())
+	assert.NoError(err)
+	assert.True(rtt >= exec.pingDelay, "rtt %v", rtt)
+	assert.True(rtt < exec.pingDelay+time.Second, "rtt %v", rtt)
+
+	// A ping which times out reports how long we waited
+	exec.pingDelay = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(),
+		20*time.Millisecond)
+	defer cancel()
+	rtt, err = c.PingTimed(ctx)
+	assert.True(errors.Is(err, context.DeadlineExceeded))
+	assert.True(rtt >= 20*time.Millisecond, "rtt %v", rtt)
+	assert.True(rtt < time.Second, "rtt %v", rtt)
+}
+
+func TestHandleChanges(t *testing.T) {
+	assert := require.New(t)
+
+	type event struct {
+		path  string
+		prop  []string
+		value string
+	}
+	var events []event
+	handler := func(path string, prop []string, val string, exp *time.Time) {
+		events = append(events, event{path, prop, val})
+	}
+
+	exec := &testExec{}
+	c := NewHandle(exec)
+
+	// Repeated paths are only registered once
+	paths := []string{`^@/clients/.*/ring$`, `^@/rings/`, `^@/rings/`}
+	assert.NoError(c.HandleChanges(paths, handler))
+	assert.Len(exec.changeHandlers, 2)
+
+	exec.change("@/clients/00:11:22:33:44:55/ring", "guest")
+	exec.change("@/site_index", "0")
+	exec.change("@/rings/guest/vlan", "5")
+	assert.Equal([]event{
+		{paths[0], []string{"clients", "00:11:22:33:44:55", "ring"}, "guest"},
+		{paths[1], []string{"rings", "guest", "vlan"}, "5"},
+	}, events)
+
+	// Once the handle is closed, events are no longer passed on
+	events = nil
+	c.Close()
+	exec.change("@/rings/guest/vlan", "6")
+	assert.Empty(events)
+}
+
+func TestHandleChangesFailure(t *testing.T) {
+	assert := require.New(t)
+
+	var events []string
+	handler := func(path string, prop []string, val string, exp *time.Time) {
+		events = append(events, path)
+	}
+
+	exec := &testExec{badPath: `^@/bad/`}
+	c := NewHandle(exec)
+
+	// The paths registered before the failure stay quiet
+	err := c.HandleChanges([]string{`^@/good/`, `^@/bad/`, `^@/later/`},
+		handler)
+	assert.True(errors.Is(err, ErrNotSupp))
+	assert.Len(exec.changeHandlers, 1)
+	exec.change("@/good/prop", "x")
+	assert.Empty(events)
+
+	// Which doesn't affect a later, successful registration
+	assert.NoError(c.HandleChanges([]string{`^@/good/`}, handler))
+	exec.change("@/good/prop", "y")
+	assert.Equal([]string{`^@/good/`}, events)
+}
@@ -0,0 +1,76 @@
+// +build gofuzz
+
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package cfgfuzz
+
+// Fuzz target for go-fuzz (github.com/dvyukov/go-fuzz), covering the cfgapi
+// tree decoder and the walkers which consume its output.  To run it, seeding
+// the corpus with the golden trees:
+//
+//	go-fuzz-build bg/common/cfgapi/cfgfuzz
+//	mkdir -p /tmp/cfgfuzz/corpus
+//	cp ../testdata/trees/*.json /tmp/cfgfuzz/corpus
+//	go-fuzz -bin cfgfuzz-fuzz.zip -workdir /tmp/cfgfuzz
+//
+// Any crash it finds belongs in cfgapi/tree_test.go as a regression test.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+)
+
+// Fuzz decodes the input as a property tree, and runs the result through the
+// walkers.  A tree which decodes successfully must also survive a round trip
+// through its canonical form unchanged.
+func Fuzz(data []byte) int {
+	log.SetOutput(ioutil.Discard)
+
+	root, err := cfgapi.DecodeTree(data, cfgapi.DefaultTreeLimits)
+	if err != nil {
+		if !errors.Is(err, cfgapi.ErrBadTree) {
+			panic(fmt.Sprintf("unexpected error: %v", err))
+		}
+		return 0
+	}
+
+	root.DumpTree(ioutil.Discard, "@")
+
+	canon, err := root.MarshalCanonical()
+	if err != nil {
+		panic(fmt.Sprintf("MarshalCanonical failed: %v", err))
+	}
+	again, err := cfgapi.DecodeTree(canon, cfgapi.DefaultTreeLimits)
+	if err != nil {
+		panic(fmt.Sprintf("canonical tree didn't decode: %v", err))
+	}
+	canon2, err := again.MarshalCanonical()
+	if err != nil || !bytes.Equal(canon, canon2) {
+		panic(fmt.Sprintf("canonical tree changed: %s -> %s", canon,
+			canon2))
+	}
+
+	exec := mockcfg.NewMockExec()
+	if err := exec.LoadJSON(canon); err != nil {
+		panic(fmt.Sprintf("canonical tree didn't load: %v", err))
+	}
+	c := cfgapi.NewHandle(exec)
+	_, _ = c.GetRings()
+	_ = c.GetClients()
+	_ = c.GetVirtualAPs()
+
+	return 1
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// These tests are intended to be run with -race, to check that a single Handle
+// may be shared between goroutines as its documentation promises.
+package cfgapi_test
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	concurrentWorkers = 8
+	concurrentIters   = 50
+)
+
+func TestConcurrentHandle(t *testing.T) {
+	assert := require.New(t)
+
+	hdl := cfgapi.NewHandle(mockcfg.NewMockExecEmptyTree())
+	rec := &cfgapi.OpRecorder{}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4*concurrentWorkers*concurrentIters)
+	for i := 0; i < concurrentWorkers; i++ {
+		wg.Add(4)
+
+		// Writers, each in their own subtree, so that the final state
+		// of the tree is known.
+		go func(i int) {
+			defer wg.Done()
+			base := fmt.Sprintf("@/test/%d/", i)
+			for j := 0; j < concurrentIters; j++ {
+				prop := base + strconv.Itoa(j)
+				if err := hdl.CreateProp(prop, "new", nil); err != nil {
+					errs <- err
+				}
+				if err := hdl.SetProp(prop, strconv.Itoa(j), nil); err != nil {
+					errs <- err
+				}
+				if j%2 == 1 {
+					if err := hdl.DeleteProp(prop); err != nil {
+						errs <- err
+					}
+				}
+			}
+		}(i)
+
+		// Readers, which may see any intermediate state
+		go func() {
+			defer wg.Done()
+			for j := 0; j < concurrentIters; j++ {
+				_, err := hdl.GetProps("@/test")
+				if err != nil && err != cfgapi.ErrNoProp {
+					errs <- err
+				}
+				_, err = hdl.GetProp("@/test/0/0")
+				if err != nil && err != cfgapi.ErrNoProp {
+					errs <- err
+				}
+			}
+		}()
+
+		// Event handler registrations
+		go func() {
+			defer wg.Done()
+			for j := 0; j < concurrentIters; j++ {
+				err := hdl.HandleChange(`^@/test/.*`,
+					func([]string, string, *time.Time) {})
+				if err != nil {
+					errs <- err
+				}
+				err = hdl.HandleDelExp(`^@/test/.*`,
+					func([]string) {})
+				if err != nil {
+					errs <- err
+				}
+			}
+		}()
+
+		// Interceptor changes, on the shared handle and on derived
+		// handles.
+		go func() {
+			defer wg.Done()
+			hdl.Use(rec.Intercept)
+			for j := 0; j < concurrentIters; j++ {
+				_, err := hdl.With(rec.Intercept).GetProps("@/test")
+				if err != nil && err != cfgapi.ErrNoProp {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(err)
+	}
+
+	for i := 0; i < concurrentWorkers; i++ {
+		children := hdl.GetChildren(fmt.Sprintf("@/test/%d", i))
+		assert.Len(children, concurrentIters/2)
+		for j := 0; j < concurrentIters; j += 2 {
+			assert.Equal(strconv.Itoa(j), children[strconv.Itoa(j)].Value)
+		}
+	}
+	assert.NotEmpty(rec.Ops())
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package cfgapi_test
+
+import (
+	"testing"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+
+	"github.com/stretchr/testify/require"
+)
+
+const dnsFixture = `{
+	"Children": {
+		"clients": {"Children": {
+			"00:11:22:33:44:55": {"Children": {
+				"ring": {"Value": "standard"},
+				"dns_name": {"Value": "printer"}
+			}},
+			"66:77:88:99:aa:bb": {"Children": {
+				"ring": {"Value": "devices"},
+				"friendly_name": {"Value": "Living Room TV"},
+				"friendly_dns": {"Value": "living-room-tv"}
+			}}
+		}},
+		"dns": {"Children": {
+			"cnames": {"Children": {
+				"www": {"Value": "webserver"}
+			}},
+			"custom": {"Children": {
+				"nas": {"Value": "192.168.2.50"},
+				"backup": {"Value": "10.0.0.5"}
+			}}
+		}}
+	}
+}`
+
+func TestCustomDNSEntries(t *testing.T) {
+	assert := require.New(t)
+	me := mockcfg.NewMockExecEmptyTree()
+	assert.NoError(me.LoadJSON([]byte(dnsFixture)))
+	hdl := cfgapi.NewHandle(me)
+
+	entries, err := hdl.GetCustomDNSEntries()
+	assert.NoError(err)
+	assert.Equal([]cfgapi.CustomDNSEntry{
+		{Name: "backup", Address: "10.0.0.5"},
+		{Name: "nas", Address: "192.168.2.50"},
+	}, entries)
+
+	// Adding a new entry, and replacing an existing one.  Names are stored
+	// in lower case.
+	err = hdl.AddCustomDNSEntry(cfgapi.CustomDNSEntry{
+		Name: "Camera", Address: "192.168.2.60"})
+	assert.NoError(err)
+	err = hdl.AddCustomDNSEntry(cfgapi.CustomDNSEntry{
+		Name: "nas", Address: "192.168.2.51"})
+	assert.NoError(err)
+	assert.NoError(me.PropEq(cfgapi.CustomDNSPath+"/camera", "192.168.2.60"))
+
+	entries, err = hdl.GetCustomDNSEntries()
+	assert.NoError(err)
+	assert.Equal([]cfgapi.CustomDNSEntry{
+		{Name: "backup", Address: "10.0.0.5"},
+		{Name: "camera", Address: "192.168.2.60"},
+		{Name: "nas", Address: "192.168.2.51"},
+	}, entries)
+
+	assert.NoError(hdl.DeleteCustomDNSEntry("BACKUP"))
+	assert.Equal(cfgapi.ErrNoProp, hdl.DeleteCustomDNSEntry("backup"))
+	assert.NoError(hdl.DeleteCustomDNSEntry("camera"))
+	assert.NoError(hdl.DeleteCustomDNSEntry("nas"))
+	entries, err = hdl.GetCustomDNSEntries()
+	assert.NoError(err)
+	assert.NotNil(entries)
+	assert.Empty(entries)
+
+	// No DNS configuration at all
+	hdl = cfgapi.NewHandle(mockcfg.NewMockExecEmptyTree())
+	entries, err = hdl.GetCustomDNSEntries()
+	assert.NoError(err)
+	assert.Empty(entries)
+}
+
+func TestDNSNameInUse(t *testing.T) {
+	assert := require.New(t)
+	me := mockcfg.NewMockExecEmptyTree()
+	assert.NoError(me.LoadJSON([]byte(dnsFixture)))
+	hdl := cfgapi.NewHandle(me)
+
+	assert.True(hdl.DNSNameInUse("printer"))
+	assert.True(hdl.DNSNameInUse("Living-Room-TV"))
+	assert.True(hdl.DNSNameInUse("www"))
+	assert.False(hdl.DNSNameInUse("webserver"))
+	assert.False(hdl.DNSNameInUse("nas"))
+	assert.False(hdl.DNSNameInUse("toaster"))
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package cfgapi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ExecFunc submits a set of operations for execution, returning a handle which
+// may be used to check on their status.
+type ExecFunc func(ctx context.Context, ops []PropertyOp) CmdHdl
+
+// Interceptor is invoked around every set of operations submitted through a
+// Handle.  It may inspect or rewrite the operations before passing them to
+// next, or return a CmdHdl of its own without calling next at all.
+type Interceptor func(ctx context.Context, ops []PropertyOp, next ExecFunc) CmdHdl
+
+// ErrDenied is returned when an interceptor refuses to pass along an operation
+type ErrDenied struct {
+	Op     PropertyOp
+	Reason string
+}
+
+func (e ErrDenied) Error() string {
+	return fmt.Sprintf("%s of %s denied: %s", opName[e.Op.Op], e.Op.Name,
+		e.Reason)
+}
+
+// errCmdHdl is returned in place of a real command handle, when an operation
+// fails before being submitted.
+type errCmdHdl struct {
+	err error
+}
+
+func (h *errCmdHdl) Status(ctx context.Context) (string, error) {
+	return "", h.err
+}
+
+func (h *errCmdHdl) Wait(ctx context.Context) (string, error) {
+	return "", h.err
+}
+
+func (h *errCmdHdl) Cancel(ctx context.Context) error {
+	return h.err
+}
+
+// Use appends interceptors to the handle's chain.  Interceptors run in the
+// order in which they were added, with the first outermost.  The chain is
+// replaced rather than modified, so Use may be called while other goroutines
+// are submitting operations through the handle.
+func (c *Handle) Use(ics ...Interceptor) {
+	c.Lock()
+	chain := make([]Interceptor, 0, len(c.interceptors)+len(ics))
+	chain = append(chain, c.interceptors...)
+	c.interceptors = append(chain, ics...)
+	c.Unlock()
+}
+
+// With returns a new Handle which shares this handle's connection, and whose
+// chain consists of this handle's interceptors followed by those provided.
+// The new handle also inherits what this one knows of the remote's version.
+// The original handle is unaffected.  Closing either handle closes the shared
+// connection.
+func (c *Handle) With(ics ...Interceptor) *Handle {
+	n := NewHandle(c.exec)
+	n.Use(c.chain()...)
+	n.Use(ics...)
+
+	c.RLock()
+	n.remoteVersion, n.versionKnown = c.remoteVersion, c.versionKnown
+	n.emulateTestEq = c.emulateTestEq
+	c.RUnlock()
+	return n
+}
+
+func (c *Handle) chain() []Interceptor {
+	c.RLock()
+	chain := c.interceptors
+	c.RUnlock()
+
+	return chain
+}
+
+// Run a set of operations through the interceptor chain, ending with the
+// provided function.
+func (c *Handle) intercept(ctx context.Context, ops []PropertyOp,
+	final ExecFunc) CmdHdl {
+
+	chain := c.chain()
+	next := final
+	for i := len(chain) - 1; i >= 0; i-- {
+		ic, inner := chain[i], next
+		next = func(ctx context.Context, ops []PropertyOp) CmdHdl {
+			return ic(ctx, ops, inner)
+		}
+	}
+	return next(ctx, ops)
+}
+
+func isWriteOp(op int) bool {
+	switch op {
+	case PropSet, PropCreate, PropDelete, AddPropValidation, TreeReplace:
+		return true
+	}
+	return false
+}
+
+// Does the property fall at or below any of the given paths?
+func pathMatch(prop string, paths []string) bool {
+	for _, p := range paths {
+		p = strings.TrimSuffix(p, "/")
+		if prop == p || strings.HasPrefix(prop, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowPaths returns an interceptor which denies any operation that would
+// modify a property outside of the given subtrees.  Reads are unrestricted.
+func AllowPaths(paths ...string) Interceptor {
+	return func(ctx context.Context, ops []PropertyOp, next ExecFunc) CmdHdl {
+		for _, op := range ops {
+			if isWriteOp(op.Op) && !pathMatch(op.Name, paths) {
+				return &errCmdHdl{ErrDenied{op, "outside allowed paths"}}
+			}
+		}
+		return next(ctx, ops)
+	}
+}
+
+// DenyPaths returns an interceptor which denies any operation that would
+// modify a property within the given subtrees.  Reads are unrestricted.
+func DenyPaths(paths ...string) Interceptor {
+	return func(ctx context.Context, ops []PropertyOp, next ExecFunc) CmdHdl {
+		for _, op := range ops {
+			if isWriteOp(op.Op) && pathMatch(op.Name, paths) {
+				return &errCmdHdl{ErrDenied{op, "path is denied"}}
+			}
+		}
+		return next(ctx, ops)
+	}
+}
+
+// OpRecorder keeps a copy of every operation passed through its Intercept
+// method.
+type OpRecorder struct {
+	ops []PropertyOp
+	sync.Mutex
+}
+
+// Intercept records the operations and passes them along unchanged
+func (r *OpRecorder) Intercept(ctx context.Context, ops []PropertyOp,
+	next ExecFunc) CmdHdl {
+
+	r.Lock()
+	r.ops = append(r.ops, ops...)
+	r.Unlock()
+
+	return next(ctx, ops)
+}
+
+// Ops returns the operations recorded so far, oldest first
+func (r *OpRecorder) Ops() []PropertyOp {
+	r.Lock()
+	defer r.Unlock()
+
+	return append([]PropertyOp(nil), r.ops...)
+}
+
+// Reset discards the recorded operations
+func (r *OpRecorder) Reset() {
+	r.Lock()
+	r.ops = nil
+	r.Unlock()
+}
+
+type originKey struct{}
+
+// WithOrigin returns a context which identifies the given origin as the source
+// of any operations submitted with it.  Transports which support it report the
+// origin to configd in place of their default sender name.
+func WithOrigin(ctx context.Context, origin string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, originKey{}, origin)
+}
+
+// OriginFromContext returns the origin attached to a context by WithOrigin, or
+// "" if there is none.
+func OriginFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	origin, _ := ctx.Value(originKey{}).(string)
+	return origin
+}
+
+// StampOrigin returns an interceptor which attaches the given origin to every
+// set of operations that doesn't already carry one.
+func StampOrigin(origin string) Interceptor {
+	return func(ctx context.Context, ops []PropertyOp, next ExecFunc) CmdHdl {
+		if OriginFromContext(ctx) == "" {
+			ctx = WithOrigin(ctx, origin)
+		}
+		return next(ctx, ops)
+	}
+}
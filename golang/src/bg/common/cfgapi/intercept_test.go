@@ -0,0 +1,210 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package cfgapi
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterceptOrder(t *testing.T) {
+	assert := require.New(t)
+	exec := newSinkExec(fmt.Sprint(Version))
+	hdl := NewHandle(exec)
+
+	var trace []string
+	mark := func(name string) Interceptor {
+		return func(ctx context.Context, ops []PropertyOp,
+			next ExecFunc) CmdHdl {
+
+			trace = append(trace, name+" in")
+			rval := next(ctx, ops)
+			trace = append(trace, name+" out")
+			return rval
+		}
+	}
+	hdl.Use(mark("a"), mark("b"))
+	hdl.Use(mark("c"))
+
+	assert.NoError(hdl.SetProp("@/foo", "bar", nil))
+	assert.Equal([]string{
+		"a in", "b in", "c in", "c out", "b out", "a out",
+	}, trace)
+	assert.Len(exec.ops, 1)
+
+	// A derived handle extends the chain without changing the original
+	trace = nil
+	derived := hdl.With(mark("d"))
+	assert.NoError(derived.DeleteProp("@/foo"))
+	assert.Equal([]string{
+		"a in", "b in", "c in", "d in", "d out", "c out", "b out", "a out",
+	}, trace)
+
+	trace = nil
+	assert.NoError(hdl.DeleteProp("@/foo"))
+	assert.Len(trace, 6)
+
+	// Interceptors may rewrite operations on their way through
+	rewrite := func(ctx context.Context, ops []PropertyOp,
+		next ExecFunc) CmdHdl {
+
+		ops = append([]PropertyOp{{Op: PropTest, Name: "@/lock"}}, ops...)
+		return next(ctx, ops)
+	}
+	exec.ops = nil
+	NewHandle(exec).With(rewrite).SetProp("@/foo", "baz", nil)
+	assert.Len(exec.ops, 2)
+	assert.Equal("@/lock", exec.ops[0].Name)
+}
+
+func TestInterceptDenied(t *testing.T) {
+	assert := require.New(t)
+	exec := newSinkExec(fmt.Sprint(Version))
+	rec := &OpRecorder{}
+	hdl := NewHandle(exec)
+	hdl.Use(rec.Intercept, AllowPaths("@/certs/"), DenyPaths("@/certs/locked"))
+
+	assert.NoError(hdl.SetProp("@/certs/abc/state", "available", nil))
+	assert.NoError(hdl.SetProp("@/certs", "", nil))
+	assert.NoError(hdl.SetProp("@/certs/lockedout", "", nil))
+	assert.Len(exec.ops, 3)
+
+	check := func(err error, name, reason string) {
+		denied, ok := err.(ErrDenied)
+		assert.True(ok, "%v", err)
+		assert.Equal(name, denied.Op.Name)
+		assert.Equal(reason, denied.Reason)
+	}
+
+	// Denied operations never reach the exec layer, even when they are
+	// bundled with permitted ones.
+	exec.ops = nil
+	err := hdl.SetProp("@/certsfoo", "x", nil)
+	check(err, "@/certsfoo", "outside allowed paths")
+	err = hdl.CreateProps(map[string]string{
+		"@/certs/def/state": "available",
+		"@/network/wan":     "x",
+	}, nil)
+	check(err, "@/network/wan", "outside allowed paths")
+	err = hdl.DeleteProp("@/certs/locked/key")
+	check(err, "@/certs/locked/key", "path is denied")
+	err = hdl.Replace([]byte("{}"))
+	check(err, "@/", "outside allowed paths")
+	err = hdl.AddPropValidation("@/policy/foo", "string")
+	check(err, "@/policy/foo", "outside allowed paths")
+	assert.Empty(exec.ops)
+
+	// Reads are unaffected
+	gets := exec.gets
+	_, err = hdl.Execute(nil, []PropertyOp{
+		{Op: PropGet, Name: "@/network"},
+	}).Wait(nil)
+	assert.NoError(err)
+	assert.Equal(gets+1, exec.gets)
+
+	// The recorder sits outside the policy, so it saw everything
+	assert.Len(rec.Ops(), 10)
+	rec.Reset()
+	assert.Empty(rec.Ops())
+}
+
+func TestInterceptConvenience(t *testing.T) {
+	assert := require.New(t)
+	exec := newSinkExec(fmt.Sprint(Version))
+	rec := &OpRecorder{}
+	hdl := NewHandle(exec)
+	hdl.Use(rec.Intercept)
+
+	expires := time.Now().Add(time.Hour)
+	assert.NoError(hdl.SetProp("@/a", "1", nil))
+	assert.NoError(hdl.SetProps(map[string]string{"@/b": "2"}, nil))
+	assert.NoError(hdl.CreateProp("@/c", "3", &expires))
+	assert.NoError(hdl.CreateProps(map[string]string{"@/d": "4"}, nil))
+	assert.NoError(hdl.DeleteProp("@/e"))
+	assert.NoError(hdl.Replace([]byte("{}")))
+	assert.NoError(hdl.AddPropValidation("@/f", "int"))
+	hdl.GetProp("@/g")
+
+	expected := []struct {
+		op   int
+		name string
+	}{
+		{PropSet, "@/a"},
+		{PropSet, "@/b"},
+		{PropCreate, "@/c"},
+		{PropCreate, "@/d"},
+		{PropDelete, "@/e"},
+		{TreeReplace, "@/"},
+		{AddPropValidation, "@/f"},
+		{PropGet, "@/g"},
+	}
+	ops := rec.Ops()
+	assert.Len(ops, len(expected))
+	for i, e := range expected {
+		assert.Equal(e.op, ops[i].Op, "op %d", i)
+		assert.Equal(e.name, ops[i].Name, "op %d", i)
+	}
+	assert.Equal(&expires, ops[2].Expires)
+
+	// Explicit access levels are passed through to the exec layer
+	assert.Equal(AccessInternal, exec.levels[6])
+	assert.Equal(AccessUser, exec.levels[0])
+}
+
+func TestInterceptOrigin(t *testing.T) {
+	assert := require.New(t)
+	exec := newSinkExec(fmt.Sprint(Version))
+	hdl := NewHandle(exec)
+
+	assert.NoError(hdl.SetProp("@/a", "1", nil))
+	hdl.Use(StampOrigin("tester"))
+	assert.NoError(hdl.SetProp("@/a", "1", nil))
+
+	// An origin supplied by the caller takes precedence
+	ctx := WithOrigin(context.Background(), "caller")
+	_, err := hdl.Execute(ctx, []PropertyOp{
+		{Op: PropSet, Name: "@/a", Value: "2"},
+	}).Wait(ctx)
+	assert.NoError(err)
+
+	assert.Equal([]string{"", "tester", "caller"}, exec.origins)
+	assert.Equal("", OriginFromContext(nil))
+}
+
+func TestInterceptConcurrent(t *testing.T) {
+	exec := newSinkExec(fmt.Sprint(Version))
+	rec := &OpRecorder{}
+	hdl := NewHandle(exec)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				hdl.SetProp("@/a", "1", nil)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			hdl.Use(rec.Intercept)
+			hdl.With(DenyPaths("@/")).SetProp("@/a", "1", nil)
+		}()
+	}
+	wg.Wait()
+
+	require.Len(t, hdl.chain(), 8)
+	require.Len(t, exec.ops, 400)
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package cfgapi_test
+
+import (
+	"testing"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+
+	"github.com/stretchr/testify/require"
+)
+
+const mtuFixture = `{
+	"Children": {
+		"nodes": {"Children": {
+			"gw": {"Children": {
+				"nics": {"Children": {
+					"wan": {"Children": {
+						"kind": {"Value": "wired"},
+						"mtu": {"Value": "1492"}
+					}},
+					"lan0": {"Children": {
+						"kind": {"Value": "wired"}
+					}}
+				}}
+			}},
+			"sat": {"Children": {
+				"nics": {"Children": {
+					"lan0": {"Children": {
+						"kind": {"Value": "wired"},
+						"mtu": {"Value": "9000"}
+					}}
+				}}
+			}}
+		}}
+	}
+}`
+
+func TestInterfaceMTU(t *testing.T) {
+	assert := require.New(t)
+	me := mockcfg.NewMockExecEmptyTree()
+	hdl := cfgapi.NewHandle(me)
+
+	// No nodes, no MTUs
+	mtus, err := hdl.GetInterfaceMTUs()
+	assert.NoError(err)
+	assert.Empty(mtus)
+
+	assert.NoError(me.LoadJSON([]byte(mtuFixture)))
+	mtus, err = hdl.GetInterfaceMTUs()
+	assert.NoError(err)
+	assert.Equal(map[string]int{
+		"gw/wan":   1492,
+		"sat/lan0": 9000,
+	}, mtus)
+
+	// Round trip, including the ends of the range
+	for _, mtu := range []int{cfgapi.MinInterfaceMTU, 1400,
+		cfgapi.MaxInterfaceMTU} {
+		assert.NoError(hdl.SetInterfaceMTU("gw", "lan0", mtu))
+		mtus, err = hdl.GetInterfaceMTUs()
+		assert.NoError(err)
+		assert.Equal(mtu, mtus["gw/lan0"])
+	}
+	assert.NoError(me.PropEq("@/nodes/gw/nics/lan0/mtu", "9000"))
+	assert.Equal(1492, mtus["gw/wan"])
+
+	// Out of range MTUs are rejected without changing anything
+	for _, mtu := range []int{0, -1, cfgapi.MinInterfaceMTU - 1,
+		cfgapi.MaxInterfaceMTU + 1} {
+		assert.Error(hdl.SetInterfaceMTU("gw", "wan", mtu))
+	}
+	assert.NoError(me.PropEq("@/nodes/gw/nics/wan/mtu", "1492"))
+
+	// The nic must exist
+	err = hdl.SetInterfaceMTU("gw", "wlan9", 1500)
+	assert.Equal(cfgapi.ErrNoProp, err)
+	err = hdl.SetInterfaceMTU("nosuchnode", "lan0", 1500)
+	assert.Equal(cfgapi.ErrNoProp, err)
+	assert.NoError(me.PropAbsent("@/nodes/gw/nics/wlan9"))
+}
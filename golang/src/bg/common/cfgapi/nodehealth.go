@@ -0,0 +1,226 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package cfgapi
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NodeHealth is the state each node periodically reports about itself, in
+// @/metrics/health/<node>.  Fields the node hasn't reported are nil (or empty,
+// for Role).  The properties are:
+//
+//	boot_time          time    when the node last booted
+//	alive              time    when the node last reported itself alive
+//	role               string  "gateway" or "satellite"
+//	loadavg/current    string  the 1, 5 and 15 minute load averages, as the
+//	                           leading fields of /proc/loadavg
+//	mem_free           int     free memory, in kB
+//	sys_temp/current   int     system temperature, in millidegrees Celsius
+//
+// The same subtree holds other per-node metrics, such as ap.tron's
+// connectivity checks and the running min/max/avg of the temperature; those
+// aren't part of NodeHealth, and ReportNodeHealth leaves them alone.
+type NodeHealth struct {
+	BootTime  *time.Time
+	Alive     *time.Time
+	Role      string
+	LoadAvg   []float64 // 1, 5 and 15 minutes
+	MemFreeKB *int64
+	SysTemp   *int
+}
+
+// Names under which older builds reported NodeHealth properties, mapped to
+// the current names.  They are read if the current property is missing, and
+// removed by ReportNodeHealth.
+var legacyNodeHealthProps = map[string]string{
+	"boottime": "boot_time",
+}
+
+// Look for a NodeHealth property under its current name or, if allowed, under
+// one of its legacy names.
+func nodeHealthProp(node *PropertyNode, name string, legacy bool) string {
+	if c, ok := node.Children[name]; ok {
+		return c.Value
+	}
+	if legacy {
+		for old, cur := range legacyNodeHealthProps {
+			if c, ok := node.Children[old]; ok && cur == name {
+				return c.Value
+			}
+		}
+	}
+	return ""
+}
+
+// Build a NodeHealth from a node's @/metrics/health subtree.  Malformed values
+// are treated as missing.
+func parseNodeHealth(node *PropertyNode, legacy bool) *NodeHealth {
+	var h NodeHealth
+
+	prop := func(name string) string {
+		return nodeHealthProp(node, name, legacy)
+	}
+	child := func(dir, name string) string {
+		if d, ok := node.Children[dir]; ok {
+			if c, ok := d.Children[name]; ok {
+				return c.Value
+			}
+		}
+		return ""
+	}
+
+	if t, err := time.Parse(time.RFC3339, prop("boot_time")); err == nil &&
+		!t.IsZero() {
+		h.BootTime = &t
+	}
+	if t, err := time.Parse(time.RFC3339, prop("alive")); err == nil &&
+		!t.IsZero() {
+		h.Alive = &t
+	}
+	h.Role = prop("role")
+
+	if f := strings.Fields(child("loadavg", "current")); len(f) >= 3 {
+		load := make([]float64, 3)
+		for i := range load {
+			var err error
+			if load[i], err = strconv.ParseFloat(f[i], 64); err != nil {
+				load = nil
+				break
+			}
+		}
+		h.LoadAvg = load
+	}
+	if kb, err := strconv.ParseInt(prop("mem_free"), 10, 64); err == nil {
+		h.MemFreeKB = &kb
+	}
+	if temp, err := strconv.Atoi(child("sys_temp", "current")); err == nil {
+		h.SysTemp = &temp
+	}
+
+	return &h
+}
+
+// Render the fields of a NodeHealth which are set as property values, indexed
+// by their paths relative to the node's subtree.
+func (h *NodeHealth) props() map[string]string {
+	props := make(map[string]string)
+
+	if h.BootTime != nil {
+		props["boot_time"] = h.BootTime.UTC().Format(time.RFC3339)
+	}
+	if h.Alive != nil {
+		props["alive"] = h.Alive.UTC().Format(time.RFC3339)
+	}
+	if h.Role != "" {
+		props["role"] = h.Role
+	}
+	if len(h.LoadAvg) == 3 {
+		props["loadavg/current"] = fmt.Sprintf("%.2f %.2f %.2f",
+			h.LoadAvg[0], h.LoadAvg[1], h.LoadAvg[2])
+	}
+	if h.MemFreeKB != nil {
+		props["mem_free"] = strconv.FormatInt(*h.MemFreeKB, 10)
+	}
+	if h.SysTemp != nil {
+		props["sys_temp/current"] = strconv.Itoa(*h.SysTemp)
+	}
+	return props
+}
+
+// GetNodeHealth returns the health most recently reported by a node.
+// ErrNoProp is returned if the node hasn't reported any.
+func (c *Handle) GetNodeHealth(nodeID string) (*NodeHealth, error) {
+	node, err := c.GetProps("@/metrics/health/" + nodeID)
+	if err != nil {
+		return nil, err
+	}
+	return parseNodeHealth(node, true), nil
+}
+
+// GetAllNodeHealth returns the health most recently reported by each node,
+// indexed by node ID.
+func (c *Handle) GetAllNodeHealth() (map[string]*NodeHealth, error) {
+	rval := make(map[string]*NodeHealth)
+
+	props, err := c.GetProps("@/metrics/health")
+	if IsConfigAbsent(err) {
+		return rval, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for nodeID, node := range props.Children {
+		rval[nodeID] = parseNodeHealth(node, true)
+	}
+	return rval, nil
+}
+
+// ReportNodeHealth records a node's health.  Fields which are nil are left as
+// they are.  Only the properties whose values have changed are written, in a
+// single batch, so it is cheap to call periodically with mostly unchanged
+// values.  Properties still reported under a legacy name are moved to the
+// current one.
+func (c *Handle) ReportNodeHealth(nodeID string, h *NodeHealth) error {
+	base := "@/metrics/health/" + nodeID + "/"
+
+	node, err := c.GetProps(base)
+	if IsConfigAbsent(err) {
+		node = &PropertyNode{}
+	} else if err != nil {
+		return err
+	}
+
+	// Compare the values in their canonical forms, so that a value which
+	// was written in a different but equivalent form (e.g., a time in
+	// another time zone) isn't rewritten.
+	old := parseNodeHealth(node, false).props()
+	props := h.props()
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ops := make([]PropertyOp, 0)
+	for _, name := range names {
+		if props[name] != old[name] {
+			ops = append(ops, PropertyOp{
+				Op:    PropCreate,
+				Name:  base + name,
+				Value: props[name],
+			})
+		}
+	}
+	for legacy, cur := range legacyNodeHealthProps {
+		if _, ok := node.Children[legacy]; !ok {
+			continue
+		}
+		if _, ok := old[cur]; !ok {
+			if _, ok := props[cur]; !ok {
+				// Keep the only copy of the value
+				continue
+			}
+		}
+		ops = append(ops, PropertyOp{
+			Op:   PropDelete,
+			Name: base + legacy,
+		})
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+	_, err = c.Execute(nil, ops).Wait(nil)
+	return err
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package cfgapi_test
+
+import (
+	"testing"
+	"time"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+
+	"github.com/stretchr/testify/require"
+)
+
+const healthFixture = `{
+	"Children": {
+		"nodes": {"Children": {
+			"gw0": {"Children": {
+				"name": {"Value": "router"},
+				"platform": {"Value": "rpi3"}
+			}},
+			"sat0": {"Children": {
+				"name": {"Value": "attic"},
+				"platform": {"Value": "mt7623"}
+			}}
+		}},
+		"metrics": {"Children": {
+			"health": {"Children": {
+				"gw0": {"Children": {
+					"role": {"Value": "gateway"},
+					"boot_time": {"Value": "2020-03-01T10:00:00-08:00"},
+					"alive": {"Value": "2020-03-02T10:00:00-08:00"},
+					"loadavg": {"Children": {
+						"current": {"Value": "0.52 0.58 0.59 1/257 2218"}
+					}},
+					"sys_temp": {"Children": {
+						"current": {"Value": "51540"},
+						"max": {"Value": "60000"}
+					}},
+					"wan_carrier": {"Children": {
+						"on": {"Value": "2020-03-01T10:00:05-08:00"}
+					}}
+				}},
+				"sat0": {"Children": {
+					"role": {"Value": "satellite"},
+					"boottime": {"Value": "2020-03-01T12:00:00Z"},
+					"alive": {"Value": "2020-03-02T18:00:00Z"}
+				}}
+			}}
+		}}
+	}
+}`
+
+func healthSetup(t *testing.T) (*mockcfg.MockExec, *cfgapi.Handle) {
+	me := mockcfg.NewMockExecEmptyTree()
+	require.NoError(t, me.LoadJSON([]byte(healthFixture)))
+	return me, cfgapi.NewHandle(me)
+}
+
+func mkTime(t *testing.T, s string) *time.Time {
+	tm, err := time.Parse(time.RFC3339, s)
+	require.NoError(t, err)
+	return &tm
+}
+
+func TestGetNodeHealth(t *testing.T) {
+	assert := require.New(t)
+	_, hdl := healthSetup(t)
+
+	h, err := hdl.GetNodeHealth("gw0")
+	assert.NoError(err)
+	assert.Equal("gateway", h.Role)
+	assert.True(h.BootTime.Equal(*mkTime(t, "2020-03-01T18:00:00Z")))
+	assert.True(h.Alive.Equal(*mkTime(t, "2020-03-02T18:00:00Z")))
+	assert.Equal([]float64{0.52, 0.58, 0.59}, h.LoadAvg)
+	assert.Equal(51540, *h.SysTemp)
+	assert.Nil(h.MemFreeKB)
+
+	// An older build reported its boot time as "boottime"
+	h, err = hdl.GetNodeHealth("sat0")
+	assert.NoError(err)
+	assert.Equal("satellite", h.Role)
+	assert.True(h.BootTime.Equal(*mkTime(t, "2020-03-01T12:00:00Z")))
+	assert.Nil(h.LoadAvg)
+	assert.Nil(h.SysTemp)
+
+	_, err = hdl.GetNodeHealth("nonesuch")
+	assert.Equal(cfgapi.ErrNoProp, err)
+
+	all, err := hdl.GetAllNodeHealth()
+	assert.NoError(err)
+	assert.Len(all, 2)
+	assert.Equal("satellite", all["sat0"].Role)
+
+	all, err = cfgapi.NewHandle(mockcfg.NewMockExecEmptyTree()).GetAllNodeHealth()
+	assert.NoError(err)
+	assert.Len(all, 0)
+}
+
+func TestReportNodeHealth(t *testing.T) {
+	assert := require.New(t)
+	me, hdl := healthSetup(t)
+
+	memFree := int64(123456)
+	temp := 48000
+	in := &cfgapi.NodeHealth{
+		BootTime:  mkTime(t, "2020-04-01T00:00:00Z"),
+		Alive:     mkTime(t, "2020-04-01T00:05:00Z"),
+		Role:      "satellite",
+		LoadAvg:   []float64{1, 0.5, 0.25},
+		MemFreeKB: &memFree,
+		SysTemp:   &temp,
+	}
+	assert.NoError(hdl.ReportNodeHealth("sat1", in))
+
+	out, err := hdl.GetNodeHealth("sat1")
+	assert.NoError(err)
+	assert.Equal(in.Role, out.Role)
+	assert.True(in.BootTime.Equal(*out.BootTime))
+	assert.True(in.Alive.Equal(*out.Alive))
+	assert.Equal(in.LoadAvg, out.LoadAvg)
+	assert.Equal(memFree, *out.MemFreeKB)
+	assert.Equal(temp, *out.SysTemp)
+	assert.NoError(me.PropEq("@/metrics/health/sat1/loadavg/current",
+		"1.00 0.50 0.25"))
+
+	// Fields which aren't set are left alone, as are the metrics which
+	// aren't part of NodeHealth.
+	assert.NoError(hdl.ReportNodeHealth("gw0", &cfgapi.NodeHealth{
+		Alive: mkTime(t, "2020-03-02T18:00:05Z"),
+	}))
+	out, err = hdl.GetNodeHealth("gw0")
+	assert.NoError(err)
+	assert.Equal("gateway", out.Role)
+	assert.Equal(51540, *out.SysTemp)
+	assert.NoError(me.PropEq("@/metrics/health/gw0/sys_temp/max", "60000"))
+	assert.NoError(me.PropExists("@/metrics/health/gw0/wan_carrier/on"))
+
+	// The legacy property is kept until the current one is written
+	assert.NoError(hdl.ReportNodeHealth("sat0", &cfgapi.NodeHealth{
+		Role: "satellite",
+	}))
+	assert.NoError(me.PropExists("@/metrics/health/sat0/boottime"))
+	assert.NoError(hdl.ReportNodeHealth("sat0", &cfgapi.NodeHealth{
+		BootTime: mkTime(t, "2020-03-01T12:00:00Z"),
+	}))
+	assert.NoError(me.PropAbsent("@/metrics/health/sat0/boottime"))
+	assert.NoError(me.PropEq("@/metrics/health/sat0/boot_time",
+		"2020-03-01T12:00:00Z"))
+}
+
+// changes returns the operations seen by the recorder which change the tree
+func changes(rec *cfgapi.OpRecorder) []cfgapi.PropertyOp {
+	var ops []cfgapi.PropertyOp
+	for _, op := range rec.Ops() {
+		if op.Op != cfgapi.PropGet {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+func TestReportNodeHealthUnchanged(t *testing.T) {
+	assert := require.New(t)
+	_, hdl := healthSetup(t)
+	rec := &cfgapi.OpRecorder{}
+	hdl.Use(rec.Intercept)
+
+	// The boot time is the same instant in another time zone, and the
+	// load average is the same to the precision it is recorded at.
+	temp := 51540
+	h := &cfgapi.NodeHealth{
+		BootTime: mkTime(t, "2020-03-01T18:00:00Z"),
+		Alive:    mkTime(t, "2020-03-02T18:00:05Z"),
+		Role:     "gateway",
+		LoadAvg:  []float64{0.521, 0.58, 0.59},
+		SysTemp:  &temp,
+	}
+	assert.NoError(hdl.ReportNodeHealth("gw0", h))
+	assert.Equal([]cfgapi.PropertyOp{{
+		Op:    cfgapi.PropCreate,
+		Name:  "@/metrics/health/gw0/alive",
+		Value: "2020-03-02T18:00:05Z",
+	}}, changes(rec))
+
+	// Nothing at all has changed
+	rec.Reset()
+	assert.NoError(hdl.ReportNodeHealth("gw0", h))
+	assert.Len(changes(rec), 0)
+}
+
+func TestGetNodesHealth(t *testing.T) {
+	assert := require.New(t)
+	_, hdl := healthSetup(t)
+
+	nodes, err := hdl.GetNodes()
+	assert.NoError(err)
+	assert.Len(nodes, 2)
+
+	assert.Equal("gw0", nodes[0].ID)
+	assert.Equal("router", nodes[0].Name)
+	assert.Equal("gateway", nodes[0].Role)
+	assert.True(nodes[0].BootTime.Equal(*mkTime(t, "2020-03-01T18:00:00Z")))
+	assert.True(nodes[0].Alive.Equal(*mkTime(t, "2020-03-02T18:00:00Z")))
+
+	assert.Equal("sat0", nodes[1].ID)
+	assert.Equal("satellite", nodes[1].Role)
+	assert.True(nodes[1].BootTime.Equal(*mkTime(t, "2020-03-01T12:00:00Z")))
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// These tests use mockcfg, which itself depends on cfgapi, so they live in an
+// external test package.
+package cfgapi_test
+
+import (
+	"testing"
+	"time"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPendingActions(t *testing.T) {
+	assert := require.New(t)
+	hdl := cfgapi.NewHandle(mockcfg.NewMockExecEmptyTree())
+
+	// Nothing pending yet
+	actions, err := hdl.GetPendingActions()
+	assert.NoError(err)
+	assert.NotNil(actions)
+	assert.Empty(actions)
+
+	reboot := time.Date(2020, 6, 1, 3, 0, 0, 0, time.UTC)
+	upgrade := time.Date(2020, 5, 31, 2, 0, 0, 0, time.UTC)
+	err = hdl.CreateProps(map[string]string{
+		"@/pending/reboot/scheduled":       reboot.Format(time.RFC3339),
+		"@/pending/upgrade/scheduled":      upgrade.Format(time.RFC3339),
+		"@/pending/config-apply/scheduled": reboot.Format(time.RFC3339),
+		// Neither of these is reported
+		"@/pending/frobnicate/scheduled": reboot.Format(time.RFC3339),
+		"@/pending/reboot/reason":        "kernel update",
+	}, nil)
+	assert.NoError(err)
+
+	// Actions come back in schedule order, with ties broken by name
+	actions, err = hdl.GetPendingActions()
+	assert.NoError(err)
+	assert.Len(actions, 3)
+	assert.Equal(cfgapi.PendingUpgrade, actions[0].Name)
+	assert.True(upgrade.Equal(actions[0].Scheduled))
+	assert.Equal(cfgapi.PendingConfigApply, actions[1].Name)
+	assert.Equal(cfgapi.PendingReboot, actions[2].Name)
+	assert.True(reboot.Equal(actions[2].Scheduled))
+
+	// Clearing removes the whole action, and nothing else
+	assert.NoError(hdl.ClearPendingAction(cfgapi.PendingReboot))
+	_, err = hdl.GetProp("@/pending/reboot/reason")
+	assert.Equal(cfgapi.ErrNoProp, err)
+	actions, err = hdl.GetPendingActions()
+	assert.NoError(err)
+	assert.Len(actions, 2)
+	assert.Equal(cfgapi.PendingUpgrade, actions[0].Name)
+	assert.Equal(cfgapi.PendingConfigApply, actions[1].Name)
+
+	// Clearing is idempotent, but only for known actions
+	assert.NoError(hdl.ClearPendingAction(cfgapi.PendingReboot))
+	assert.Error(hdl.ClearPendingAction("frobnicate"))
+
+	assert.NoError(hdl.ClearPendingAction(cfgapi.PendingUpgrade))
+	assert.NoError(hdl.ClearPendingAction(cfgapi.PendingConfigApply))
+	actions, err = hdl.GetPendingActions()
+	assert.NoError(err)
+	assert.Empty(actions)
+}
+
+func TestPendingActionsMalformed(t *testing.T) {
+	assert := require.New(t)
+	hdl := cfgapi.NewHandle(mockcfg.NewMockExecEmptyTree())
+
+	err := hdl.CreateProps(map[string]string{
+		"@/pending/reboot/scheduled":  "soon",
+		"@/pending/upgrade/scheduled": "2020-05-31T02:00:00Z",
+		"@/pending/config-apply/note": "no schedule",
+	}, nil)
+	assert.NoError(err)
+
+	actions, err := hdl.GetPendingActions()
+	assert.NoError(err)
+	assert.Len(actions, 1)
+	assert.Equal(cfgapi.PendingUpgrade, actions[0].Name)
+
+	// Malformed actions can still be cleared
+	assert.NoError(hdl.ClearPendingAction(cfgapi.PendingReboot))
+	_, err = hdl.GetProp("@/pending/reboot/scheduled")
+	assert.Equal(cfgapi.ErrNoProp, err)
+}
+
+func TestPendingRestarts(t *testing.T) {
+	assert := require.New(t)
+	hdl := cfgapi.NewHandle(mockcfg.NewMockExecEmptyTree())
+
+	restarts, err := hdl.GetPendingRestarts()
+	assert.NoError(err)
+	assert.NotNil(restarts)
+	assert.Empty(restarts)
+	pending, err := hdl.HasPendingChanges()
+	assert.NoError(err)
+	assert.False(pending)
+
+	before := time.Now().Add(-time.Second)
+	assert.NoError(hdl.SetPendingRestart("hostapd", "channel change"))
+	err = hdl.CreateProp(cfgapi.PendingRestartPath+"/dhcp", "ring change",
+		nil)
+	assert.NoError(err)
+
+	restarts, err = hdl.GetPendingRestarts()
+	assert.NoError(err)
+	assert.Len(restarts, 2)
+	assert.Equal("channel change", restarts["hostapd"].Reason)
+	assert.Equal("ring change", restarts["dhcp"].Reason)
+	assert.True(restarts["hostapd"].Since.After(before))
+	pending, err = hdl.HasPendingChanges()
+	assert.NoError(err)
+	assert.True(pending)
+
+	// Clearing is idempotent, and leaves the other services alone
+	assert.NoError(hdl.ClearPendingRestart("hostapd"))
+	assert.NoError(hdl.ClearPendingRestart("hostapd"))
+	restarts, err = hdl.GetPendingRestarts()
+	assert.NoError(err)
+	assert.Len(restarts, 1)
+	assert.Contains(restarts, "dhcp")
+
+	assert.NoError(hdl.ClearPendingRestart("dhcp"))
+	pending, err = hdl.HasPendingChanges()
+	assert.NoError(err)
+	assert.False(pending)
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package cfgapi
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testVuln(active, ignore string) *PropertyNode {
+	return &PropertyNode{Children: ChildMap{
+		"active": &PropertyNode{Value: active},
+		"ignore": &PropertyNode{Value: ignore},
+	}}
+}
+
+func TestGetQuarantinedClients(t *testing.T) {
+	assert := require.New(t)
+
+	ringChanged := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	blocked := ringChanged.Add(time.Hour)
+	expired := time.Now().Add(-time.Hour)
+
+	exec := &testExec{
+		root: &PropertyNode{Children: ChildMap{
+			"clients": &PropertyNode{Children: ChildMap{
+				// Quarantined for its vulnerabilities, and
+				// blocked too
+				"00:11:22:33:44:55": &PropertyNode{Children: ChildMap{
+					"ring": &PropertyNode{
+						Value:    "quarantine",
+						Modified: &ringChanged,
+					},
+					"ipv4": &PropertyNode{Value: "192.168.7.10"},
+					"vulnerabilities": &PropertyNode{Children: ChildMap{
+						"defaultpassword": testVuln("true", "false"),
+						"badssh":          testVuln("true", "false"),
+						"ignored":         testVuln("true", "true"),
+						"fixed":           testVuln("false", "false"),
+					}},
+				}},
+				// Moved to the quarantine ring by hand
+				"22:33:44:55:66:77": &PropertyNode{Children: ChildMap{
+					"ring": &PropertyNode{Value: "quarantine"},
+				}},
+				// Blocked, but otherwise normal
+				"66:77:88:99:aa:bb": &PropertyNode{Children: ChildMap{
+					"ring": &PropertyNode{Value: "standard"},
+					"ipv4": &PropertyNode{Value: "192.168.4.20"},
+				}},
+				// Normal clients
+				"de:ad:be:ef:00:01": &PropertyNode{Children: ChildMap{
+					"ring": &PropertyNode{Value: "standard"},
+					"ipv4": &PropertyNode{Value: "192.168.4.21"},
+					"vulnerabilities": &PropertyNode{Children: ChildMap{
+						"badssh": testVuln("true", "false"),
+					}},
+				}},
+				"de:ad:be:ef:00:02": &PropertyNode{Children: ChildMap{
+					"ring": &PropertyNode{Value: "devices"},
+					"ipv4": &PropertyNode{Value: "192.168.5.22"},
+				}},
+				"de:ad:be:ef:00:03": &PropertyNode{},
+			}},
+			"firewall": &PropertyNode{Children: ChildMap{
+				"blocked": &PropertyNode{Children: ChildMap{
+					"192.168.7.10": &PropertyNode{
+						Value:    "true",
+						Modified: &blocked,
+					},
+					"192.168.4.20": &PropertyNode{
+						Value:    "true",
+						Modified: &blocked,
+					},
+					// The block on this client has lapsed
+					"192.168.5.22": &PropertyNode{
+						Value:    "true",
+						Modified: &blocked,
+						Expires:  &expired,
+					},
+					"8.8.4.4": &PropertyNode{Value: "true"},
+				}},
+			}},
+		}},
+	}
+	c := NewHandle(exec)
+
+	list, err := c.GetQuarantinedClients()
+	assert.NoError(err)
+	assert.Equal([]QuarantineInfo{
+		{
+			MAC:    "00:11:22:33:44:55",
+			Reason: "vulnerable: badssh,defaultpassword; address blocked",
+			Since:  &ringChanged,
+		},
+		{
+			MAC:    "22:33:44:55:66:77",
+			Reason: "quarantined",
+		},
+		{
+			MAC:    "66:77:88:99:aa:bb",
+			Reason: "address blocked",
+			Since:  &blocked,
+		},
+	}, list)
+
+	// Without any blocks, only the quarantine ring matters
+	delete(exec.root.Children, "firewall")
+	list, err = c.GetQuarantinedClients()
+	assert.NoError(err)
+	assert.Len(list, 2)
+	assert.Equal("vulnerable: badssh,defaultpassword", list[0].Reason)
+	assert.Equal("22:33:44:55:66:77", list[1].MAC)
+
+	// No clients at all
+	delete(exec.root.Children, "clients")
+	list, err = c.GetQuarantinedClients()
+	assert.NoError(err)
+	assert.NotNil(list)
+	assert.Empty(list)
+
+	// Failures are passed along
+	exec.err = ErrComm
+	_, err = c.GetQuarantinedClients()
+	assert.True(errors.Is(err, ErrComm))
+}
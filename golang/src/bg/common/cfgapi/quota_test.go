@@ -0,0 +1,96 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package cfgapi_test
+
+import (
+	"math"
+	"testing"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+
+	"github.com/stretchr/testify/require"
+)
+
+const quotaFixture = `{
+	"Children": {
+		"network": {"Children": {
+			"vap": {"Children": {
+				"psk": {"Children": {
+					"ssid": {"Value": "home"}
+				}},
+				"guest": {"Children": {
+					"ssid": {"Value": "home-guest"},
+					"quota": {"Children": {
+						"daily_bytes": {"Value": "1073741824"}
+					}}
+				}}
+			}}
+		}}
+	}
+}`
+
+func TestGuestQuota(t *testing.T) {
+	assert := require.New(t)
+	me := mockcfg.NewMockExecEmptyTree()
+	assert.NoError(me.LoadJSON([]byte(quotaFixture)))
+	hdl := cfgapi.NewHandle(me)
+
+	// A partial quota leaves the rest unlimited, as does no quota at all
+	q, err := hdl.GetGuestQuota("guest")
+	assert.NoError(err)
+	assert.Equal(&cfgapi.GuestQuota{DailyBytes: 1 << 30}, q)
+	q, err = hdl.GetGuestQuota("psk")
+	assert.NoError(err)
+	assert.Equal(&cfgapi.GuestQuota{}, q)
+
+	// Round trip
+	quotas := []cfgapi.GuestQuota{
+		{DailyBytes: 5 << 30, MaxClients: 10},
+		{DailyBytes: 0, MaxClients: 25},
+		{DailyBytes: math.MaxInt64, MaxClients: 0},
+	}
+	for _, quota := range quotas {
+		assert.NoError(hdl.SetGuestQuota("guest", &quota))
+		q, err = hdl.GetGuestQuota("guest")
+		assert.NoError(err)
+		assert.Equal(quota, *q)
+	}
+	assert.NoError(me.PropEq("@/network/vap/guest/quota/max_clients", "0"))
+
+	// Setting one VAP's quota leaves the others alone
+	q, err = hdl.GetGuestQuota("psk")
+	assert.NoError(err)
+	assert.Equal(&cfgapi.GuestQuota{}, q)
+
+	// Bad quotas are rejected without changing anything
+	assert.Error(hdl.SetGuestQuota("guest", nil))
+	assert.Error(hdl.SetGuestQuota("guest",
+		&cfgapi.GuestQuota{MaxClients: -1}))
+	assert.Error(hdl.SetGuestQuota("guest",
+		&cfgapi.GuestQuota{DailyBytes: math.MaxUint64}))
+	q, err = hdl.GetGuestQuota("guest")
+	assert.NoError(err)
+	assert.Equal(quotas[2], *q)
+
+	// Nonexistent VAPs
+	_, err = hdl.GetGuestQuota("bogus")
+	assert.Equal(cfgapi.ErrNoProp, err)
+	err = hdl.SetGuestQuota("bogus", &cfgapi.GuestQuota{MaxClients: 1})
+	assert.Equal(cfgapi.ErrNoProp, err)
+	_, err = hdl.GetProp("@/network/vap/bogus/quota/max_clients")
+	assert.Equal(cfgapi.ErrNoProp, err)
+
+	// A malformed quota is reported, rather than treated as unlimited
+	assert.NoError(hdl.CreateProp("@/network/vap/psk/quota/max_clients",
+		"lots", nil))
+	_, err = hdl.GetGuestQuota("psk")
+	assert.Error(err)
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package cfgapi_test
+
+import (
+	"testing"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+
+	"github.com/stretchr/testify/require"
+)
+
+const ringsFixture = `{
+	"Children": {
+		"site_index": {"Value": "0"},
+		"network": {"Children": {
+			"base_address": {"Value": "192.168.0.0/24"}
+		}},
+		"rings": {"Children": {
+			"core": {"Children": {
+				"vap": {"Value": "eap"},
+				"lease_duration": {"Value": "1440"},
+				"subnet": {"Value": "192.168.2.0/26"},
+				"vlan": {"Value": "3"}
+			}},
+			"standard": {"Children": {
+				"vap": {"Value": "psk"},
+				"lease_duration": {"Value": "1440"},
+				"subnet": {"Value": "192.168.3.0/26"},
+				"vlan": {"Value": "4"}
+			}}
+		}}
+	}
+}`
+
+func TestSetRingConfig(t *testing.T) {
+	assert := require.New(t)
+	me := mockcfg.NewMockExecEmptyTree()
+	assert.NoError(me.LoadJSON([]byte(ringsFixture)))
+	hdl := cfgapi.NewHandle(me)
+
+	before, err := hdl.GetRings()
+	assert.NoError(err)
+
+	lease := 120
+	assert.NoError(hdl.SetRingConfig("standard", &cfgapi.RingConfigUpdate{
+		LeaseDuration: &lease,
+		VirtualAPs:    []string{"eap", "psk"},
+	}))
+	rings, err := hdl.GetRings()
+	assert.NoError(err)
+	assert.Equal(120, rings["standard"].LeaseDuration)
+	assert.Equal([]string{"eap", "psk"}, rings["standard"].VirtualAPs)
+	assert.NoError(me.PropEq("@/rings/standard/vap", "eap,psk"))
+
+	// Nil fields are left alone
+	assert.NoError(hdl.SetRingConfig("standard", &cfgapi.RingConfigUpdate{
+		VirtualAPs: []string{"psk"},
+	}))
+	assert.NoError(me.PropEq("@/rings/standard/lease_duration", "120"))
+	assert.NoError(me.PropEq("@/rings/standard/vap", "psk"))
+
+	// An empty list takes the ring off of every VAP
+	assert.NoError(hdl.SetRingConfig("standard", &cfgapi.RingConfigUpdate{
+		VirtualAPs: []string{},
+	}))
+	assert.NoError(me.PropEq("@/rings/standard/vap", ""))
+
+	// Other rings are untouched
+	rings, err = hdl.GetRings()
+	assert.NoError(err)
+	assert.Equal(before["core"], rings["core"])
+
+	// Bad updates are rejected without changing anything
+	neg := -1
+	bad := []*cfgapi.RingConfigUpdate{
+		{LeaseDuration: &neg},
+		{VirtualAPs: []string{""}},
+		{VirtualAPs: []string{"psk,eap"}},
+		{VirtualAPs: []string{"psk", "psk"}},
+	}
+	for _, u := range bad {
+		assert.Error(hdl.SetRingConfig("core", u))
+	}
+	assert.Error(hdl.SetRingConfig("bogus",
+		&cfgapi.RingConfigUpdate{LeaseDuration: &lease}))
+	rings, err = hdl.GetRings()
+	assert.NoError(err)
+	assert.Equal(before["core"], rings["core"])
+
+	// Valid, but not configured
+	err = hdl.SetRingConfig("wan",
+		&cfgapi.RingConfigUpdate{LeaseDuration: &lease})
+	assert.Equal(cfgapi.ErrNoProp, err)
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package cfgapi_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+
+	"github.com/stretchr/testify/require"
+)
+
+const securityFixture = `{
+	"Children": {
+		"network": {"Children": {
+			"radius_auth_secret": {"Value": "radius-sekrit"},
+			"vap": {"Children": {
+				"psk": {"Children": {
+					"ssid": {"Value": "home"},
+					"keymgmt": {"Value": "wpa-psk"},
+					"passphrase": {"Value": "psk-sekrit"}
+				}},
+				"eap": {"Children": {
+					"ssid": {"Value": "home-eap"},
+					"keymgmt": {"Value": "wpa-eap"}
+				}},
+				"guest": {"Children": {
+					"ssid": {"Value": "home-guest"},
+					"keymgmt": {"Value": "wpa-psk"},
+					"disabled": {"Value": "true"}
+				}},
+				"lobby": {"Children": {
+					"ssid": {"Value": "lobby"}
+				}}
+			}}
+		}}
+	}
+}`
+
+func TestNetworkSecuritySummary(t *testing.T) {
+	assert := require.New(t)
+	me := mockcfg.NewMockExecEmptyTree()
+	hdl := cfgapi.NewHandle(me)
+
+	// No VAPs, nothing to report
+	summary, err := hdl.GetNetworkSecuritySummary()
+	assert.NoError(err)
+	assert.Empty(summary)
+
+	assert.NoError(me.LoadJSON([]byte(securityFixture)))
+	summary, err = hdl.GetNetworkSecuritySummary()
+	assert.NoError(err)
+	assert.Equal([]cfgapi.NetworkSecurity{
+		{
+			VAP:        "eap",
+			SSID:       "home-eap",
+			KeyMgmt:    "wpa-eap",
+			Security:   cfgapi.SecurityEAP,
+			Configured: true,
+		},
+		{
+			VAP:      "guest",
+			SSID:     "home-guest",
+			KeyMgmt:  "wpa-psk",
+			Security: cfgapi.SecurityPSK,
+			Disabled: true,
+		},
+		{
+			VAP:      "lobby",
+			SSID:     "lobby",
+			Security: cfgapi.SecurityOpen,
+			Open:     true,
+		},
+		{
+			VAP:        "psk",
+			SSID:       "home",
+			KeyMgmt:    "wpa-psk",
+			Security:   cfgapi.SecurityPSK,
+			Configured: true,
+		},
+	}, summary)
+
+	// The secrets themselves are never part of the summary
+	b, err := json.Marshal(summary)
+	assert.NoError(err)
+	assert.NotContains(string(b), "sekrit")
+
+	// Without a RADIUS secret, EAP can't work
+	assert.NoError(hdl.DeleteProp("@/network/radius_auth_secret"))
+	summary, err = hdl.GetNetworkSecuritySummary()
+	assert.NoError(err)
+	assert.Equal(cfgapi.SecurityEAP, summary[0].Security)
+	assert.False(summary[0].Configured)
+}
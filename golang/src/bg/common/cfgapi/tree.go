@@ -0,0 +1,285 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package cfgapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// TreeLimits bounds the size of the property trees we are willing to decode.
+// The trees come from a config daemon we don't entirely control, and the
+// walkers which consume them are all recursive.  A zero limit is no limit.
+type TreeLimits struct {
+	// MaxDepth is the deepest a property may be, with the root of the
+	// tree at depth 1.
+	MaxDepth int
+	// MaxNodes is the largest number of properties a tree may contain.
+	MaxNodes int
+}
+
+// DefaultTreeLimits are applied by PropertyNode.UnmarshalJSON, and by any
+// Handle which hasn't been given its own limits with SetTreeLimits.  Real
+// trees are a dozen or so levels deep, and have tens of thousands of nodes
+// at most.
+var DefaultTreeLimits = TreeLimits{
+	MaxDepth: 64,
+	MaxNodes: 250000,
+}
+
+type treeDecoder struct {
+	dec    *json.Decoder
+	limits TreeLimits
+	nodes  int
+}
+
+func (d *treeDecoder) badTree(path, format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s: %s", ErrBadTree, path,
+		fmt.Sprintf(format, a...))
+}
+
+func (d *treeDecoder) token(path string) (json.Token, error) {
+	tok, err := d.dec.Token()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, d.badTree(path, "%v", err)
+	}
+	return tok, nil
+}
+
+func (d *treeDecoder) checkDepth(path string, depth int) error {
+	if d.limits.MaxDepth > 0 && depth > d.limits.MaxDepth {
+		return d.badTree(path, "deeper than %d levels",
+			d.limits.MaxDepth)
+	}
+	return nil
+}
+
+// skipValue consumes the rest of a value we have no use for, given its first
+// token.  Nesting within the value counts against the depth limit, just as
+// nested properties do.
+func (d *treeDecoder) skipValue(path string, tok json.Token, depth int) error {
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return nil
+	}
+	if delim != '{' && delim != '[' {
+		return d.badTree(path, "unexpected %v", delim)
+	}
+	if err := d.checkDepth(path, depth); err != nil {
+		return err
+	}
+
+	for d.dec.More() {
+		tok, err := d.token(path)
+		if err != nil {
+			return err
+		}
+		if delim == '{' {
+			// Skip the key to get to the value
+			if tok, err = d.token(path); err != nil {
+				return err
+			}
+		}
+		if err = d.skipValue(path, tok, depth+1); err != nil {
+			return err
+		}
+	}
+	_, err := d.token(path)
+	return err
+}
+
+// decodeTime decodes a Modified or Expires timestamp.  A timestamp we can't
+// make sense of shouldn't cost us the rest of the tree, so it is dropped with a
+// warning.
+func (d *treeDecoder) decodeTime(path, field string, depth int) (*time.Time, error) {
+	tok, err := d.token(path)
+	if err != nil || tok == nil {
+		return nil, err
+	}
+
+	if s, ok := tok.(string); ok {
+		// A time zone offset can push a time outside the range of years
+		// which can be marshaled again.
+		t, err := time.Parse(time.RFC3339, s)
+		if y := t.UTC().Year(); err == nil && y >= 0 && y <= 9999 {
+			return &t, nil
+		}
+		log.Printf("Ignoring invalid %s time at %s: %q\n", field,
+			path, s)
+		return nil, nil
+	}
+
+	log.Printf("Ignoring invalid %s time at %s: %v\n", field, path, tok)
+	return nil, d.skipValue(path, tok, depth+1)
+}
+
+func (d *treeDecoder) decodeChildren(node *PropertyNode, path string, depth int) error {
+	tok, err := d.token(path)
+	if err != nil || tok == nil {
+		return err
+	}
+	if tok != json.Delim('{') {
+		return d.badTree(path, "Children is not an object")
+	}
+	if node.Children == nil {
+		node.Children = make(ChildMap)
+	}
+
+	for d.dec.More() {
+		if tok, err = d.token(path); err != nil {
+			return err
+		}
+		name := tok.(string)
+		childPath := path + "/" + name
+
+		child, err := d.decodeNode(childPath, depth+1)
+		if err != nil {
+			return err
+		}
+		if child == nil {
+			// The walkers all assume that a child which is
+			// present isn't nil.
+			log.Printf("Ignoring null property %s\n", childPath)
+			delete(node.Children, name)
+		} else {
+			node.Children[name] = child
+		}
+	}
+	_, err = d.token(path)
+	return err
+}
+
+// decodeNode decodes the property at the given path and depth, returning nil
+// if it is null.  As with encoding/json, field names are matched without
+// regard to case, unknown fields are ignored, and if a field appears more than
+// once, the last instance wins.
+func (d *treeDecoder) decodeNode(path string, depth int) (*PropertyNode, error) {
+	tok, err := d.token(path)
+	if err != nil || tok == nil {
+		return nil, err
+	}
+	if tok != json.Delim('{') {
+		return nil, d.badTree(path, "property is not an object")
+	}
+	if err = d.checkDepth(path, depth); err != nil {
+		return nil, err
+	}
+	d.nodes++
+	if d.limits.MaxNodes > 0 && d.nodes > d.limits.MaxNodes {
+		return nil, d.badTree(path, "more than %d properties",
+			d.limits.MaxNodes)
+	}
+
+	node := &PropertyNode{}
+	for d.dec.More() && err == nil {
+		if tok, err = d.token(path); err != nil {
+			break
+		}
+
+		switch field := tok.(string); {
+		case strings.EqualFold(field, "Value"):
+			if tok, err = d.token(path); err != nil {
+				break
+			}
+			if s, ok := tok.(string); ok {
+				node.Value = s
+			} else if tok != nil {
+				err = d.badTree(path, "Value is not a string")
+			}
+
+		case strings.EqualFold(field, "Modified"):
+			node.Modified, err = d.decodeTime(path, field, depth)
+
+		case strings.EqualFold(field, "Expires"):
+			node.Expires, err = d.decodeTime(path, field, depth)
+
+		case strings.EqualFold(field, "Children"):
+			err = d.decodeChildren(node, path, depth)
+
+		default:
+			if tok, err = d.token(path); err == nil {
+				err = d.skipValue(path, tok, depth+1)
+			}
+		}
+	}
+	if err == nil {
+		_, err = d.token(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
+
+// DecodeTree decodes the JSON representation of a property tree, as returned
+// by a config daemon.  If the tree exceeds the given limits, or isn't a
+// property tree at all, the error returned wraps ErrBadTree.
+func DecodeTree(data []byte, limits TreeLimits) (*PropertyNode, error) {
+	d := &treeDecoder{
+		dec:    json.NewDecoder(bytes.NewReader(data)),
+		limits: limits,
+	}
+
+	root, err := d.decodeNode("@", 1)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = d.dec.Token(); err != io.EOF {
+		return nil, d.badTree("@", "unexpected data after tree")
+	}
+	if root == nil {
+		root = &PropertyNode{}
+	}
+
+	return root, nil
+}
+
+// UnmarshalJSON decodes a property tree using DecodeTree, subject to the
+// DefaultTreeLimits.  As usual, a JSON null leaves the node untouched.
+func (n *PropertyNode) UnmarshalJSON(data []byte) error {
+	if string(bytes.TrimSpace(data)) == "null" {
+		return nil
+	}
+
+	root, err := DecodeTree(data, DefaultTreeLimits)
+	if err == nil {
+		*n = *root
+	}
+	return err
+}
+
+// SetTreeLimits replaces the DefaultTreeLimits for the trees retrieved through
+// this handle.  Tools which legitimately handle huge trees may raise or remove
+// the limits.
+func (c *Handle) SetTreeLimits(limits TreeLimits) {
+	c.Lock()
+	c.treeLimits = &limits
+	c.Unlock()
+}
+
+func (c *Handle) decodeTree(tree string) (*PropertyNode, error) {
+	c.RLock()
+	limits := c.treeLimits
+	c.RUnlock()
+
+	if limits == nil {
+		limits = &DefaultTreeLimits
+	}
+	return DecodeTree([]byte(tree), *limits)
+}
@@ -0,0 +1,350 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package cfgapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false,
+	"rewrite the golden files in testdata/trees")
+
+// The trees in testdata/trees are decoded, and their canonical forms compared
+// with the corresponding .golden files.  After an intentional change to the
+// decoder, regenerate the golden files with 'go test -update', and review the
+// differences.
+func TestDecodeTreeGolden(t *testing.T) {
+	files, err := filepath.Glob("testdata/trees/*.json")
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			assert := require.New(t)
+
+			data, err := ioutil.ReadFile(file)
+			assert.NoError(err)
+			root, err := DecodeTree(data, DefaultTreeLimits)
+			assert.NoError(err)
+
+			canon, err := root.MarshalCanonical()
+			assert.NoError(err)
+			var out bytes.Buffer
+			assert.NoError(json.Indent(&out, canon, "", "  "))
+			out.WriteByte('\n')
+
+			golden := strings.TrimSuffix(file, ".json") + ".golden"
+			if *updateGolden {
+				assert.NoError(ioutil.WriteFile(golden,
+					out.Bytes(), 0644))
+			}
+			expected, err := ioutil.ReadFile(golden)
+			assert.NoError(err)
+			assert.Equal(string(expected), out.String())
+
+			// The canonical form decodes to the same tree
+			again, err := DecodeTree(canon, DefaultTreeLimits)
+			assert.NoError(err)
+			canon2, err := again.MarshalCanonical()
+			assert.NoError(err)
+			assert.Equal(string(canon), string(canon2))
+
+			// ... as does the original, via encoding/json
+			var node PropertyNode
+			assert.NoError(json.Unmarshal(data, &node))
+			canon2, err = node.MarshalCanonical()
+			assert.NoError(err)
+			assert.Equal(string(canon), string(canon2))
+		})
+	}
+}
+
+func loadTestTree(t *testing.T, name string) *Handle {
+	data, err := ioutil.ReadFile("testdata/trees/" + name)
+	require.NoError(t, err)
+	root, err := DecodeTree(data, DefaultTreeLimits)
+	require.NoError(t, err)
+	return NewHandle(&testExec{root: root})
+}
+
+func TestDecodeTreeSite(t *testing.T) {
+	assert := require.New(t)
+	c := loadTestTree(t, "site.json")
+
+	rings, err := c.GetRings()
+	assert.NoError(err)
+	assert.Len(rings, 8)
+	assert.Equal(6, rings["guest"].Vlan)
+	assert.Equal("brvlan6", rings["guest"].Bridge)
+	assert.Equal([]string{"psk", "eap", "guest"},
+		rings["quarantine"].VirtualAPs)
+	assert.Equal(-1, rings["vpn"].Vlan)
+
+	clients := c.GetClients()
+	assert.Len(clients, 3)
+
+	client := clients["b8:27:eb:00:00:01"]
+	assert.Equal("standard", client.Ring)
+	assert.Equal("Office Printer", client.FriendlyName)
+	assert.Equal("192.168.4.22", client.IPv4.String())
+	assert.Equal(time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC),
+		client.Expires.UTC())
+	assert.True(client.Wireless)
+	assert.Equal("eap", client.ConnVAP)
+	assert.Equal("5GHz", client.ConnBand)
+	assert.Equal("user@example.com", client.Username)
+	assert.Equal("Raspberry Pi", client.DevID.DeviceGenus)
+	assert.True(client.IsActive())
+
+	client = clients["00:40:54:00:00:07"]
+	assert.Equal("quarantine", client.Ring)
+	assert.False(client.Wireless)
+	assert.Nil(client.DevID)
+
+	// The client's modification time was recorded with a time zone
+	root, err := c.GetProps("@/clients/64:9a:be:da:b1:9a")
+	assert.NoError(err)
+	assert.Equal(time.Date(2020, 9, 19, 13, 3, 12, 123456000, time.UTC),
+		root.Modified.UTC())
+
+	// Expired properties are left out of the dump
+	var dump strings.Builder
+	root, err = c.GetProps("@/clients")
+	assert.NoError(err)
+	root.DumpTree(&dump, "clients")
+	assert.Contains(dump.String(), "friendly_name: Office Printer")
+	assert.Contains(dump.String(), "ipv4: 192.168.4.22  2099-01-01T00:00:00")
+	assert.NotContains(dump.String(), "192.168.7.40")
+}
+
+func TestDecodeTreeBadTimes(t *testing.T) {
+	assert := require.New(t)
+	c := loadTestTree(t, "badtimes.json")
+
+	// Invalid timestamps are dropped, without disturbing anything else
+	root, err := c.GetProps("@/")
+	assert.NoError(err)
+	assert.NotNil(root.Modified)
+	client, err := root.GetChild("clients")
+	assert.NoError(err)
+	client, err = client.GetChild("64:9a:be:da:b1:9a")
+	assert.NoError(err)
+	assert.Nil(client.Modified)
+	assert.Len(client.Children, 4)
+	for name, node := range client.Children {
+		assert.Nil(node.Modified, name)
+		assert.Nil(node.Expires, name)
+	}
+
+	info := c.GetClient("64:9a:be:da:b1:9a")
+	assert.Equal("standard", info.Ring)
+	assert.Equal("192.168.4.8", info.IPv4.String())
+	assert.Nil(info.Expires)
+	assert.Equal("laptop", info.DHCPName)
+	assert.Equal("001-201913ZZ-000039", info.Home)
+
+	idx, err := c.GetProp("@/site_index")
+	assert.NoError(err)
+	assert.Equal("0", idx)
+
+	// A time which is valid, but which can't be represented in UTC, is
+	// dropped too.
+	node, err := DecodeTree([]byte(`{"Value": "x",
+		"Modified": "0000-01-01T00:00:00+01:00",
+		"Expires": "9999-12-31T23:59:59-01:00"}`), DefaultTreeLimits)
+	assert.NoError(err)
+	assert.Equal("x", node.Value)
+	assert.Nil(node.Modified)
+	assert.Nil(node.Expires)
+	_, err = json.Marshal(node)
+	assert.NoError(err)
+}
+
+func TestDecodeTreeQuirks(t *testing.T) {
+	assert := require.New(t)
+	c := loadTestTree(t, "quirks.json")
+
+	// Null properties are dropped; the last of any duplicates wins; and
+	// field names are matched without regard to case.
+	clients := c.GetClients()
+	assert.Len(clients, 1)
+	client := clients["b8:27:eb:00:00:01"]
+	assert.Equal("standard", client.Ring)
+	assert.Equal("printer", client.DHCPName)
+	assert.Equal(&DevIDInfo{}, client.DevID)
+	assert.False(client.Wireless)
+	root, err := c.GetProps("@/clients/b8:27:eb:00:00:01")
+	assert.NoError(err)
+	assert.NotContains(root.Children, "connection")
+
+	// Only the second rings subtree survives, and only one ring in it is
+	// well-formed.
+	rings, err := c.GetRings()
+	assert.NoError(err)
+	assert.Len(rings, 1)
+	assert.Equal(3, rings["core"].Vlan)
+
+	// The walkers are safe in the face of trees built by hand with nil
+	// children.
+	root = &PropertyNode{Children: ChildMap{
+		"a": nil,
+		"b": &PropertyNode{Value: "b", Children: ChildMap{"c": nil}},
+	}}
+	var dump strings.Builder
+	root.DumpTree(&dump, "@")
+	assert.Equal("@: \n  b: b\n", dump.String())
+	assert.Equal(root.Children["b"], root.GetChildByValue("b"))
+	assert.Nil(root.GetChildByValue("c"))
+	getClient(root)
+}
+
+// mkDeepTree returns a tree in which each node has a single child, 'depth'
+// nodes deep.
+func mkDeepTree(depth int) []byte {
+	var b bytes.Buffer
+	for i := 1; i < depth; i++ {
+		b.WriteString(`{"Value":"x","Children":{"c":`)
+	}
+	b.WriteString(`{"Value":"leaf"}`)
+	for i := 1; i < depth; i++ {
+		b.WriteString(`}}`)
+	}
+	return b.Bytes()
+}
+
+// mkWideTree returns a tree in which the root has 'width' children
+func mkWideTree(width int) []byte {
+	var b bytes.Buffer
+	b.WriteString(`{"Children":{`)
+	for i := 0; i < width; i++ {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(`"n` + strconv.Itoa(i) + `":{"Value":"v"}`)
+	}
+	b.WriteString(`}}`)
+	return b.Bytes()
+}
+
+func TestDecodeTreeLimits(t *testing.T) {
+	assert := require.New(t)
+	limits := TreeLimits{MaxDepth: 10, MaxNodes: 20}
+
+	_, err := DecodeTree(mkDeepTree(10), limits)
+	assert.NoError(err)
+	_, err = DecodeTree(mkDeepTree(11), limits)
+	assert.True(errors.Is(err, ErrBadTree))
+	assert.Contains(err.Error(), "deeper than 10 levels")
+
+	// The root counts as a property
+	_, err = DecodeTree(mkWideTree(19), limits)
+	assert.NoError(err)
+	_, err = DecodeTree(mkWideTree(20), limits)
+	assert.True(errors.Is(err, ErrBadTree))
+	assert.Contains(err.Error(), "more than 20 properties")
+
+	// Nesting in fields we don't understand counts too
+	deepJunk := strings.Repeat(`[`, 20) + strings.Repeat(`]`, 20)
+	_, err = DecodeTree([]byte(`{"Junk": `+deepJunk+`}`), limits)
+	assert.True(errors.Is(err, ErrBadTree))
+	_, err = DecodeTree([]byte(`{"Modified": `+deepJunk+`}`), limits)
+	assert.True(errors.Is(err, ErrBadTree))
+
+	// Zero limits are no limits
+	_, err = DecodeTree(mkDeepTree(1000), TreeLimits{})
+	assert.NoError(err)
+	_, err = DecodeTree(mkWideTree(1000), TreeLimits{})
+	assert.NoError(err)
+
+	// The defaults stop absurd trees, including via encoding/json
+	data := mkDeepTree(DefaultTreeLimits.MaxDepth + 1)
+	_, err = DecodeTree(data, DefaultTreeLimits)
+	assert.True(errors.Is(err, ErrBadTree))
+	var node PropertyNode
+	err = json.Unmarshal(data, &node)
+	assert.True(errors.Is(err, ErrBadTree))
+	_, err = DecodeTree(mkDeepTree(100000), DefaultTreeLimits)
+	assert.True(errors.Is(err, ErrBadTree))
+
+	// The limits can be set for each handle
+	root, err := DecodeTree(mkDeepTree(DefaultTreeLimits.MaxDepth+5),
+		TreeLimits{})
+	assert.NoError(err)
+	c := NewHandle(&testExec{root: root})
+	_, err = c.GetProps("@/")
+	assert.True(errors.Is(err, ErrBadTree))
+	_, err = c.GetProps("@/c/c/c/c/c")
+	assert.NoError(err)
+
+	c.SetTreeLimits(TreeLimits{MaxDepth: 100})
+	_, err = c.GetProps("@/")
+	assert.NoError(err)
+	c.SetTreeLimits(TreeLimits{MaxNodes: 3})
+	_, err = c.GetProps("@/")
+	assert.True(errors.Is(err, ErrBadTree))
+}
+
+func TestDecodeTreeMalformed(t *testing.T) {
+	assert := require.New(t)
+
+	bad := []string{
+		``,
+		`   `,
+		`[]`,
+		`"tree"`,
+		`{`,
+		`{"Value": "x"`,
+		`{"Value": 1}`,
+		`{"Value": ["x"]}`,
+		`{"Value": {"x": 1}}`,
+		`{"Children": []}`,
+		`{"Children": "x"}`,
+		`{"Children": {"a": "b"}}`,
+		`{"Children": {"a": [{}]}}`,
+		`{"Children": {"a": {"Children": {"b": 1}}}}`,
+		`{"Junk": [1, 2}`,
+		`{} {}`,
+		`{}x`,
+		`{"Value": "x",}`,
+	}
+	for _, data := range bad {
+		_, err := DecodeTree([]byte(data), DefaultTreeLimits)
+		assert.Error(err, "%q", data)
+		assert.True(errors.Is(err, ErrBadTree), "%q: %v", data, err)
+	}
+
+	// Property paths are included in the errors
+	_, err := DecodeTree([]byte(`{"Children": {"a": {"Children": {"b": 1}}}}`),
+		DefaultTreeLimits)
+	assert.EqualError(err, "unable to parse tree: @/a/b: property is not an object")
+
+	// A null tree is an empty one
+	node, err := DecodeTree([]byte(`null`), DefaultTreeLimits)
+	assert.NoError(err)
+	assert.Equal(&PropertyNode{}, node)
+
+	// GetProps reports a bad tree as such
+	c := NewHandle(&testExec{raw: `{"Children": {"a": 1}}`})
+	_, err = c.GetProps("@/")
+	assert.True(errors.Is(err, ErrBadTree))
+	assert.Contains(err.Error(), "Failed to decode @/")
+}
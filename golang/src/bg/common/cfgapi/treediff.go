@@ -0,0 +1,206 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package cfgapi
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// TreeDiffKind describes how a property differs between two trees
+type TreeDiffKind int
+
+// The ways in which a property may differ between trees A and B
+const (
+	DiffOnlyA TreeDiffKind = iota
+	DiffOnlyB
+	DiffChanged
+)
+
+// VolatileTrees are the subtrees which are expected to differ between two
+// copies of a site's config, even when neither has missed an update: metrics,
+// leases, and the current state of links and connections.  Each entry is a
+// path.Match pattern, which matches the property and everything below it.
+var VolatileTrees = []string{
+	"@/metrics",
+	"@/clients/*/connection",
+	"@/clients/*/ipv4",
+	"@/clients/*/ipv4_observed",
+	"@/network/wan/current",
+	"@/network/wan/dhcp",
+	"@/network/wan/uplinks/*/state",
+	"@/nodes/*/nics/*/active_*",
+	"@/nodes/*/nics/*/state",
+}
+
+// TreeDiff is a single difference between two property trees.  A subtree which
+// is present in only one of the trees is reported once, at its root.
+type TreeDiff struct {
+	Path string
+	Kind TreeDiffKind
+	A    *PropertyNode
+	B    *PropertyNode
+
+	// Volatile is set if the property is in one of the VolatileTrees, or
+	// is due to expire, so the difference is to be expected.
+	Volatile bool
+}
+
+func nodeSummary(n *PropertyNode) string {
+	if len(n.Children) > 0 {
+		return fmt.Sprintf("{%d children}", len(n.Children))
+	}
+	return fmt.Sprintf("%q", n.Value)
+}
+
+func (d TreeDiff) String() string {
+	var s string
+
+	switch d.Kind {
+	case DiffOnlyA:
+		s = fmt.Sprintf("- %s: %s", d.Path, nodeSummary(d.A))
+	case DiffOnlyB:
+		s = fmt.Sprintf("+ %s: %s", d.Path, nodeSummary(d.B))
+	default:
+		s = fmt.Sprintf("~ %s: %s -> %s", d.Path, nodeSummary(d.A),
+			nodeSummary(d.B))
+	}
+	if d.Volatile {
+		s += " (volatile)"
+	}
+	return s
+}
+
+func isVolatile(prop string) bool {
+	levels := strings.Split(prop, "/")
+	for _, pattern := range VolatileTrees {
+		n := strings.Count(pattern, "/") + 1
+		if n > len(levels) {
+			continue
+		}
+		trunk := strings.Join(levels[:n], "/")
+		if ok, _ := path.Match(pattern, trunk); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// liveChild returns the named child of a node, ignoring any which are missing
+// or have already expired.
+func liveChild(n *PropertyNode, name string) *PropertyNode {
+	if n == nil {
+		return nil
+	}
+	child := n.Children[name]
+	if child == nil || child.Expired() {
+		return nil
+	}
+	return child
+}
+
+func diffSubtree(prop string, a, b *PropertyNode, diffs []TreeDiff) []TreeDiff {
+	d := TreeDiff{Path: prop, A: a, B: b}
+
+	switch {
+	case a == nil && b == nil:
+		return diffs
+	case b == nil:
+		d.Kind = DiffOnlyA
+	case a == nil:
+		d.Kind = DiffOnlyB
+	default:
+		if a.Value != b.Value {
+			d.Kind = DiffChanged
+			break
+		}
+
+		names := make(map[string]bool)
+		for name := range a.Children {
+			names[name] = true
+		}
+		for name := range b.Children {
+			names[name] = true
+		}
+		sorted := make([]string, 0, len(names))
+		for name := range names {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+
+		for _, name := range sorted {
+			diffs = diffSubtree(prop+"/"+name, liveChild(a, name),
+				liveChild(b, name), diffs)
+		}
+		return diffs
+	}
+
+	d.Volatile = isVolatile(prop) ||
+		(a != nil && a.Expires != nil) || (b != nil && b.Expires != nil)
+	return append(diffs, d)
+}
+
+// DiffTrees compares two property trees, returning their differences ordered
+// by path.  Expired properties are treated as though they were absent, and
+// modification times are ignored.
+func DiffTrees(a, b *PropertyNode) []TreeDiff {
+	diffs := make([]TreeDiff, 0)
+
+	if a == nil {
+		a = &PropertyNode{}
+	}
+	if b == nil {
+		b = &PropertyNode{}
+	}
+	return diffSubtree("@", a, b, diffs)
+}
+
+// MeaningfulDiffs returns the number of differences which are not Volatile
+func MeaningfulDiffs(diffs []TreeDiff) int {
+	var n int
+
+	for _, d := range diffs {
+		if !d.Volatile {
+			n++
+		}
+	}
+	return n
+}
+
+// DiffTree retrieves the full config tree through this handle (A) and another
+// (B), and returns the differences between them.
+func (c *Handle) DiffTree(other *Handle) ([]TreeDiff, error) {
+	a, err := c.GetProps("@/")
+	if err != nil {
+		return nil, fmt.Errorf("retrieving tree A: %w", err)
+	}
+	b, err := other.GetProps("@/")
+	if err != nil {
+		return nil, fmt.Errorf("retrieving tree B: %w", err)
+	}
+	return DiffTrees(a, b), nil
+}
+
+// DiffSnapshot retrieves the full config tree through this handle (A), and
+// returns its differences from a serialized tree (B), such as the response to
+// a GET of @/ or a config checkpoint.
+func (c *Handle) DiffSnapshot(snapshot []byte) ([]TreeDiff, error) {
+	b, err := c.decodeTree(string(snapshot))
+	if err != nil {
+		return nil, fmt.Errorf("decoding tree B: %w", err)
+	}
+	a, err := c.GetProps("@/")
+	if err != nil {
+		return nil, fmt.Errorf("retrieving tree A: %w", err)
+	}
+	return DiffTrees(a, b), nil
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package cfgapi
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func loadTreePair(t *testing.T, name string) (*PropertyNode, []byte) {
+	a, err := ioutil.ReadFile("testdata/treediff/" + name + ".a.json")
+	require.NoError(t, err)
+	b, err := ioutil.ReadFile("testdata/treediff/" + name + ".b.json")
+	require.NoError(t, err)
+
+	root, err := DecodeTree(a, DefaultTreeLimits)
+	require.NoError(t, err)
+	return root, b
+}
+
+func diffStrings(diffs []TreeDiff) []string {
+	rval := make([]string, len(diffs))
+	for i, d := range diffs {
+		rval[i] = d.String()
+	}
+	return rval
+}
+
+// Each pair of trees in testdata/treediff is compared both directly, and
+// through a Handle.
+func TestDiffTrees(t *testing.T) {
+	testCases := []struct {
+		name       string
+		meaningful int
+		diffs      []string
+	}{
+		{
+			// Only modification times differ, along with a
+			// property which has expired
+			name:  "identical",
+			diffs: []string{},
+		},
+		{
+			name: "volatile",
+			diffs: []string{
+				`~ @/clients/64:9a:be:da:b1:9a/connection/active: "true" -> "false" (volatile)`,
+				`~ @/clients/64:9a:be:da:b1:9a/ipv4: "192.168.4.8" -> "192.168.4.9" (volatile)`,
+				`~ @/metrics/health/lan/heartbeat: "2020-09-20T06:03:12Z" -> "2020-09-20T06:08:12Z" (volatile)`,
+				`- @/network/wan/dhcp: {3 children} (volatile)`,
+			},
+		},
+		{
+			name:       "diverged",
+			meaningful: 3,
+			diffs: []string{
+				`- @/clients/64:9a:be:da:b1:9a: {4 children}`,
+				`+ @/clients/b8:27:eb:00:00:01/friendly_dns: "printer" (volatile)`,
+				`~ @/clients/b8:27:eb:00:00:01/ring: "devices" -> "quarantine"`,
+				`~ @/metrics/health/lan/heartbeat: "2020-09-20T06:03:12Z" -> "2020-09-20T06:08:12Z" (volatile)`,
+				`- @/users/bob: {2 children}`,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			a, snapshot := loadTreePair(t, tc.name)
+			b, err := DecodeTree(snapshot, DefaultTreeLimits)
+			assert.NoError(err)
+
+			diffs := DiffTrees(a, b)
+			assert.Equal(tc.diffs, diffStrings(diffs))
+			assert.Equal(tc.meaningful, MeaningfulDiffs(diffs))
+
+			// Seen from the other side, only the direction of
+			// each difference changes.
+			reverse := DiffTrees(b, a)
+			assert.Len(reverse, len(diffs))
+			for i, d := range reverse {
+				assert.Equal(diffs[i].Path, d.Path)
+				assert.Equal(diffs[i].Volatile, d.Volatile)
+				assert.Equal(diffs[i].A, d.B)
+			}
+
+			hdlA := NewHandle(&testExec{root: a})
+			hdlB := NewHandle(&testExec{root: b})
+			hdlDiffs, err := hdlA.DiffTree(hdlB)
+			assert.NoError(err)
+			assert.Equal(tc.diffs, diffStrings(hdlDiffs))
+
+			snapDiffs, err := hdlA.DiffSnapshot(snapshot)
+			assert.NoError(err)
+			assert.Equal(tc.diffs, diffStrings(snapDiffs))
+		})
+	}
+}
+
+func TestDiffTreesErrors(t *testing.T) {
+	assert := require.New(t)
+
+	good := NewHandle(&testExec{root: &PropertyNode{}})
+	absent := NewHandle(&testExec{err: ErrNoConfig})
+
+	_, err := good.DiffTree(absent)
+	assert.True(errors.Is(err, ErrNoConfig))
+	_, err = absent.DiffTree(good)
+	assert.True(errors.Is(err, ErrNoConfig))
+	_, err = absent.DiffSnapshot([]byte(`{}`))
+	assert.True(errors.Is(err, ErrNoConfig))
+
+	_, err = good.DiffSnapshot([]byte(`{"Children": [`))
+	assert.True(errors.Is(err, ErrBadTree))
+}
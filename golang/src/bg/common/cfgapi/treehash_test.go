@@ -0,0 +1,109 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package cfgapi_test
+
+import (
+	"testing"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+
+	"github.com/stretchr/testify/require"
+)
+
+const hashFixture = `{
+	"Children": {
+		"network": {"Children": {
+			"vap": {"Children": {
+				"psk": {"Children": {
+					"ssid": {"Value": "home"},
+					"keymgmt": {"Value": "wpa-psk"}
+				}},
+				"guest": {"Children": {
+					"ssid": {"Value": "home-guest"},
+					"keymgmt": {"Value": "wpa-psk"}
+				}}
+			}}
+		}},
+		"site_index": {"Value": "0"}
+	}
+}`
+
+// The same tree, with modification times
+const hashFixtureModified = `{
+	"Children": {
+		"network": {"Children": {
+			"vap": {"Children": {
+				"guest": {"Children": {
+					"keymgmt": {"Value": "wpa-psk"},
+					"ssid": {"Value": "home-guest",
+					    "Modified": "2020-03-14T15:09:26Z"}
+				}},
+				"psk": {"Children": {
+					"keymgmt": {"Value": "wpa-psk",
+					    "Modified": "2020-03-15T00:00:00Z"},
+					"ssid": {"Value": "home"}
+				}}
+			}}
+		}},
+		"site_index": {"Value": "0"}
+	}
+}`
+
+func TestTreeHash(t *testing.T) {
+	assert := require.New(t)
+
+	mkHandle := func(fixture string) *cfgapi.Handle {
+		me := mockcfg.NewMockExecEmptyTree()
+		assert.NoError(me.LoadJSON([]byte(fixture)))
+		return cfgapi.NewHandle(me)
+	}
+	mustHash := func(hdl *cfgapi.Handle, root string) string {
+		h, err := hdl.TreeHash(root)
+		assert.NoError(err)
+		assert.Len(h, 64)
+		return h
+	}
+
+	// Identical trees hash equally, whenever their properties were set
+	hdl := mkHandle(hashFixture)
+	base := mustHash(hdl, "@/network/vap")
+	assert.Equal(base, mustHash(hdl, "@/network/vap"))
+	assert.Equal(base, mustHash(mkHandle(hashFixtureModified),
+		"@/network/vap"))
+
+	// Rewriting a property with the same value changes nothing
+	assert.NoError(hdl.SetProp("@/network/vap/psk/ssid", "home", nil))
+	assert.Equal(base, mustHash(hdl, "@/network/vap"))
+
+	// Nor does a change outside of the subtree
+	assert.NoError(hdl.SetProp("@/site_index", "1", nil))
+	assert.Equal(base, mustHash(hdl, "@/network/vap"))
+
+	// But a single change within it does
+	assert.NoError(hdl.SetProp("@/network/vap/psk/ssid", "house", nil))
+	changed := mustHash(hdl, "@/network/vap")
+	assert.NotEqual(base, changed)
+	assert.NoError(hdl.SetProp("@/network/vap/psk/ssid", "home", nil))
+	assert.Equal(base, mustHash(hdl, "@/network/vap"))
+
+	// As does adding or removing a property
+	assert.NoError(hdl.CreateProp("@/network/vap/psk/disabled", "false", nil))
+	assert.NotEqual(base, mustHash(hdl, "@/network/vap"))
+	assert.NoError(hdl.DeleteProp("@/network/vap/psk/disabled"))
+	assert.Equal(base, mustHash(hdl, "@/network/vap"))
+
+	// A single property can be hashed too
+	leaf := mustHash(hdl, "@/network/vap/psk/ssid")
+	assert.NotEqual(base, leaf)
+
+	_, err := hdl.TreeHash("@/network/vap/eap")
+	assert.Equal(cfgapi.ErrNoProp, err)
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package cfgapi_test
+
+import (
+	"testing"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdatePolicy(t *testing.T) {
+	assert := require.New(t)
+	me := mockcfg.NewMockExecEmptyTree()
+	hdl := cfgapi.NewHandle(me)
+
+	// No policy at all
+	p, err := hdl.GetUpdatePolicy()
+	assert.NoError(err)
+	assert.Equal(&cfgapi.UpdatePolicy{Channel: cfgapi.UpdateChannelStable}, p)
+
+	// Round trip
+	policies := []cfgapi.UpdatePolicy{
+		{Auto: true, Channel: cfgapi.UpdateChannelStable},
+		{Auto: true, Channel: cfgapi.UpdateChannelBeta,
+			WindowStart: "02:00", WindowEnd: "04:30"},
+		{Auto: true, Channel: cfgapi.UpdateChannelStable,
+			WindowStart: "23:00", WindowEnd: "01:00"},
+		{Auto: false, Channel: cfgapi.UpdateChannelBeta},
+	}
+	for _, policy := range policies {
+		assert.NoError(hdl.SetUpdatePolicy(&policy))
+		p, err = hdl.GetUpdatePolicy()
+		assert.NoError(err)
+		assert.Equal(policy, *p)
+	}
+	assert.NoError(me.PropEq("@/policy/update/auto", "false"))
+	assert.NoError(me.PropEq("@/policy/update/window/start", ""))
+
+	// Bad policies are rejected without changing anything
+	bad := []*cfgapi.UpdatePolicy{
+		nil,
+		{Auto: true},
+		{Auto: true, Channel: "nightly"},
+		{Auto: true, Channel: cfgapi.UpdateChannelStable,
+			WindowStart: "02:00"},
+		{Auto: true, Channel: cfgapi.UpdateChannelStable,
+			WindowStart: "2am", WindowEnd: "4am"},
+		{Auto: true, Channel: cfgapi.UpdateChannelStable,
+			WindowStart: "25:00", WindowEnd: "04:00"},
+		{Auto: true, Channel: cfgapi.UpdateChannelStable,
+			WindowStart: "03:00", WindowEnd: "03:00"},
+	}
+	for _, b := range bad {
+		assert.Error(hdl.SetUpdatePolicy(b), "%+v", b)
+	}
+	p, err = hdl.GetUpdatePolicy()
+	assert.NoError(err)
+	assert.Equal(policies[3], *p)
+
+	// A partial policy takes the defaults for the rest
+	assert.NoError(hdl.DeleteProp("@/policy/update"))
+	assert.NoError(hdl.CreateProp("@/policy/update/auto", "true", nil))
+	p, err = hdl.GetUpdatePolicy()
+	assert.NoError(err)
+	assert.Equal(&cfgapi.UpdatePolicy{Auto: true,
+		Channel: cfgapi.UpdateChannelStable}, p)
+
+	// A malformed policy is reported, rather than guessed at
+	assert.NoError(hdl.CreateProp("@/policy/update/channel", "nightly", nil))
+	_, err = hdl.GetUpdatePolicy()
+	assert.Error(err)
+	assert.NoError(hdl.CreateProp("@/policy/update/channel", "beta", nil))
+	assert.NoError(hdl.CreateProp("@/policy/update/auto", "sometimes", nil))
+	_, err = hdl.GetUpdatePolicy()
+	assert.Error(err)
+}
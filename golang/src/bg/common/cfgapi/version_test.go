@@ -0,0 +1,251 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package cfgapi
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The hand-maintained thresholds GetFeatures used before the capability
+// matrix existed.
+func legacyFeatures(version int) CfgFeatures {
+	features := make(CfgFeatures)
+	if version >= 25 {
+		features[FeatureClientFriendlyName] = true
+	}
+	if version >= 28 {
+		features[FeatureVPNConfig] = true
+	}
+	if version >= 34 {
+		features[FeatureUserServerKey] = true
+	}
+	return features
+}
+
+func TestVersionMatrix(t *testing.T) {
+	assert := require.New(t)
+
+	testCases := []struct {
+		op      int
+		version int32
+		ok      bool
+	}{
+		{PropGet, baseVersion, true},
+		{PropSet, baseVersion, true},
+		{PropCreate, baseVersion, true},
+		{PropDelete, baseVersion, true},
+		{PropTest, baseVersion, true},
+		{AddPropValidation, 11, false},
+		{AddPropValidation, 12, true},
+		{PropTestEq, 21, false},
+		{PropTestEq, 22, true},
+		{TreeReplace, 26, false},
+		{TreeReplace, 27, true},
+		{TreeReplace, Version, true},
+		// Unknown operations are left for the remote to reject
+		{99, baseVersion, true},
+	}
+	for _, tc := range testCases {
+		assert.Equal(tc.ok, OpSupported(tc.op, tc.version),
+			"%s at %d", opName[tc.op], tc.version)
+	}
+
+	// Every operation we can generate is in the matrix, and is supported
+	// by the current version.
+	for op := range opName {
+		assert.Contains(opVersions, op, opName[op])
+		assert.True(OpSupported(op, Version), opName[op])
+	}
+
+	// Closed ranges are honored at both ends
+	r := versionRange{first: 10, last: 20}
+	assert.False(r.contains(9))
+	assert.True(r.contains(10))
+	assert.True(r.contains(20))
+	assert.False(r.contains(21))
+
+	// The features generated from the matrix match the old thresholds
+	for v := 0; v <= int(Version)+1; v++ {
+		assert.Equal(legacyFeatures(v), FeaturesForVersion(int32(v)),
+			"version %d", v)
+	}
+}
+
+func TestGetFeatures(t *testing.T) {
+	assert := require.New(t)
+
+	features, err := NewHandle(newSinkExec("28")).GetFeatures()
+	assert.NoError(err)
+	assert.Equal(CfgFeatures{
+		FeatureClientFriendlyName: true,
+		FeatureVPNConfig:          true,
+	}, features)
+
+	_, err = NewHandle(newSinkExec("x28")).GetFeatures()
+	assert.EqualError(err, "malformed cfgversion: x28")
+
+	_, err = NewHandle(newSinkExec("")).GetFeatures()
+	assert.Equal(ErrNoProp, err)
+}
+
+func TestRemoteVersion(t *testing.T) {
+	assert := require.New(t)
+	exec := newSinkExec("30")
+	hdl := NewHandle(exec)
+
+	// Operations supported by every version don't need the version
+	assert.NoError(hdl.SetProp("@/network/base_address", "x", nil))
+	assert.Equal(0, exec.gets)
+
+	v, err := hdl.RemoteVersion()
+	assert.NoError(err)
+	assert.Equal(int32(30), v)
+	v, err = hdl.RemoteVersion()
+	assert.NoError(err)
+	assert.Equal(int32(30), v)
+	_, err = hdl.GetFeatures()
+	assert.NoError(err)
+	assert.Equal(1, exec.gets)
+
+	// A derived handle inherits the cached version
+	_, err = hdl.With().RemoteVersion()
+	assert.NoError(err)
+	assert.Equal(1, exec.gets)
+
+	// Failures aren't cached
+	exec = newSinkExec("")
+	hdl = NewHandle(exec)
+	_, err = hdl.RemoteVersion()
+	assert.Equal(ErrNoProp, err)
+	_, err = hdl.RemoteVersion()
+	assert.Equal(ErrNoProp, err)
+	assert.Equal(2, exec.gets)
+}
+
+func TestPreflight(t *testing.T) {
+	assert := require.New(t)
+
+	check := func(err error, op int, min, remote int32) {
+		var unsupp ErrUnsupportedByRemote
+		assert.True(errors.As(err, &unsupp), "%v", err)
+		assert.Equal(op, unsupp.Op.Op)
+		assert.Equal(min, unsupp.MinVersion)
+		assert.Equal(remote, unsupp.Remote)
+		assert.True(errors.Is(err, ErrNotSupp))
+	}
+
+	testEq := []PropertyOp{
+		{Op: PropTestEq, Name: "@/network/base_address",
+			Value: "192.168.0.2/24"},
+		{Op: PropSet, Name: "@/network/base_address",
+			Value: "10.0.0.2/24"},
+	}
+
+	// Just too old
+	exec := newSinkExec("21")
+	hdl := NewHandle(exec)
+	_, err := hdl.Execute(nil, testEq).Wait(nil)
+	check(err, PropTestEq, 22, 21)
+	assert.EqualError(err, "PropTestEq of @/network/base_address "+
+		"requires cfgversion 22 or greater; remote is at 21")
+	_, err = hdl.ExecuteAt(nil, testEq, AccessInternal).Wait(nil)
+	check(err, PropTestEq, 22, 21)
+	check(hdl.Replace([]byte("{}")), TreeReplace, 27, 21)
+	assert.Empty(exec.ops)
+
+	// Operations the remote does support are unaffected
+	assert.NoError(hdl.AddPropValidation("@/network/foo", "int"))
+	assert.Len(exec.ops, 1)
+
+	// Just new enough
+	exec = newSinkExec("22")
+	hdl = NewHandle(exec)
+	_, err = hdl.Execute(nil, testEq).Wait(nil)
+	assert.NoError(err)
+	assert.Equal(testEq, exec.ops)
+	check(hdl.Replace([]byte("{}")), TreeReplace, 27, 22)
+
+	exec = newSinkExec("27")
+	assert.NoError(NewHandle(exec).Replace([]byte("{}")))
+	assert.Len(exec.ops, 1)
+
+	// The check applies to the operations as rewritten by the interceptors
+	exec = newSinkExec("21")
+	hdl = NewHandle(exec)
+	hdl.Use(func(ctx context.Context, ops []PropertyOp,
+		next ExecFunc) CmdHdl {
+
+		return next(ctx, append(ops, PropertyOp{
+			Op: PropTestEq, Name: "@/network/base_address"}))
+	})
+	check(hdl.SetProp("@/network/base_address", "x", nil),
+		PropTestEq, 22, 21)
+	assert.Empty(exec.ops)
+
+	// If the version can't be determined, the remote gets to decide
+	exec = newSinkExec("")
+	_, err = NewHandle(exec).Execute(nil, testEq).Wait(nil)
+	assert.NoError(err)
+	assert.Equal(testEq, exec.ops)
+}
+
+func TestEmulateTestEq(t *testing.T) {
+	assert := require.New(t)
+	exec := newSinkExec("21")
+	hdl := NewHandle(exec)
+	hdl.EmulateTestEq(true)
+
+	ops := []PropertyOp{
+		{Op: PropTestEq, Name: "@/network/base_address",
+			Value: "192.168.0.2/24"},
+		{Op: PropSet, Name: "@/network/base_address",
+			Value: "10.0.0.2/24"},
+	}
+	_, err := hdl.Execute(nil, ops).Wait(nil)
+	assert.NoError(err)
+	assert.Equal([]PropertyOp{
+		{Op: PropTest, Name: "@/network/base_address"},
+		ops[1],
+	}, exec.ops)
+
+	// The caller's operations are left untouched
+	assert.Equal(PropTestEq, ops[0].Op)
+
+	exec.ops = nil
+	ops[0].Value = "10.0.0.2/24"
+	_, err = hdl.Execute(nil, ops).Wait(nil)
+	assert.Equal(ErrNotEqual, err)
+	assert.Empty(exec.ops)
+
+	ops[0].Name = "@/network/missing"
+	_, err = hdl.Execute(nil, ops).Wait(nil)
+	assert.Equal(ErrNoProp, err)
+	assert.Empty(exec.ops)
+
+	// Emulation only kicks in for remotes which need it
+	exec = newSinkExec("22")
+	hdl = NewHandle(exec)
+	hdl.EmulateTestEq(true)
+	ops[0].Name = "@/network/base_address"
+	_, err = hdl.Execute(nil, ops).Wait(nil)
+	assert.NoError(err)
+	assert.Equal(ops, exec.ops)
+
+	// TreeReplace has no fallback
+	exec = newSinkExec("21")
+	hdl = NewHandle(exec)
+	hdl.EmulateTestEq(true)
+	assert.Error(hdl.Replace([]byte("{}")))
+	assert.Empty(exec.ops)
+}
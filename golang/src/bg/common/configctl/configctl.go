@@ -10,7 +10,9 @@
 package configctl
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -102,7 +104,10 @@ func getRings(cmd string, args []string) error {
 		usage(cmd)
 	}
 
-	rings := configd.GetRings()
+	rings, err := configd.GetRings()
+	if err != nil && !cfgapi.IsConfigAbsent(err) {
+		return fmt.Errorf("fetching rings: %v", err)
+	}
 	clients := configd.GetClients()
 
 	// Build a list of ring names, and sort them by the vlan ID of the
@@ -562,12 +567,21 @@ func getProp(cmd string, args []string) error {
 	var err error
 	var root *cfgapi.PropertyNode
 
+	canonical := false
+	if len(args) > 0 && args[0] == "-c" {
+		canonical = true
+		args = args[1:]
+	}
+
 	if len(args) < 1 {
 		usage(cmd)
 	}
 
 	prop := args[0]
 	if !strings.HasPrefix(prop, "@") {
+		if canonical {
+			usage(cmd)
+		}
 		return getFormatted(cmd, args)
 	}
 
@@ -581,7 +595,11 @@ func getProp(cmd string, args []string) error {
 	}
 	nodes := strings.Split(strings.Trim(prop, "/"), "/")
 	label := nodes[len(nodes)-1]
-	root.DumpTree(os.Stdout, label)
+	if canonical {
+		root.DumpTreeCanonical(os.Stdout, label)
+	} else {
+		root.DumpTree(os.Stdout, label)
+	}
 	return nil
 }
 
@@ -637,8 +655,32 @@ func replace(cmd string, args []string) error {
 	return nil
 }
 
+// exportCanonical emits the tree with its children sorted by name and its
+// timestamps normalized, so that exports of the same tree may be diffed.
+func exportCanonical(data string) error {
+	var root cfgapi.PropertyNode
+	var out bytes.Buffer
+
+	if err := json.Unmarshal([]byte(data), &root); err != nil {
+		return fmt.Errorf("parsing tree: %v", err)
+	}
+
+	j, err := root.MarshalCanonical()
+	if err == nil {
+		err = json.Indent(&out, j, "", "  ")
+	}
+	if err != nil {
+		return fmt.Errorf("marshaling tree: %v", err)
+	}
+	fmt.Printf("%s\n", out.String())
+	return nil
+}
+
 func export(cmd string, args []string) error {
-	if len(args) != 0 {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	canonical := flags.Bool("c", false, "canonical ordering")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
 		usage(cmd)
 	}
 
@@ -652,6 +694,8 @@ func export(cmd string, args []string) error {
 
 	if err != nil {
 		err = fmt.Errorf("fetching tree: %v", err)
+	} else if *canonical {
+		err = exportCanonical(data)
 	} else {
 		tree, err := cfgtree.NewPTree("@/", []byte(data))
 		if err != nil {
@@ -779,13 +823,13 @@ var usages = map[string]string{
 	"ping":    "",
 	"set":     "<prop> <value [duration]>",
 	"add":     "<prop> <value [duration]>",
-	"get":     "<prop> | clients [-a] [-v] | rings | vaps",
+	"get":     "[-c] <prop> | clients [-a] [-v] | rings | vaps",
 	"del":     "<prop>",
 	"mon":     "<prop>",
 	"replace": "<file | ->",
 	"stats": "[-a] [-p <period (seconds)] [<mac>]  - " +
 		"either -a or a mac address must be provided",
-	"export": "",
+	"export": "[-c]  - -c emits the tree in canonical order",
 }
 
 func usage(cmd string) {
@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"sync"
 	"time"
 
 	"bg/common/cfgapi"
@@ -50,10 +51,17 @@ func (h *mockCmdHdl) Cancel(ctx context.Context) error {
 	return nil
 }
 
-// MockExec represents an instance of this mock cfgapi implementation.
+// MockExec represents an instance of this mock cfgapi implementation.  Like
+// the real implementations, it is safe for concurrent use; operations on the
+// PTree are serialized.  Tests which manipulate the PTree directly must do so
+// before sharing the MockExec between goroutines.
 type MockExec struct {
 	PTree *cfgtree.PTree
 	Logf  func(format string, args ...interface{})
+
+	err       error
+	pingDelay time.Duration
+	mu        sync.Mutex
 }
 
 // Do-nothing routine satisfying interface for MockExec.Logf
@@ -116,6 +124,9 @@ func NewMockExecFromDefaults() *MockExec {
 
 // LoadJSON loads the PTree indicated by jsonData into the MockExec's PTree.
 func (m *MockExec) LoadJSON(jsonData []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	if m.PTree != nil {
 		return m.PTree.Replace(jsonData)
 	}
@@ -127,9 +138,40 @@ func (m *MockExec) LoadJSON(jsonData []byte) error {
 	return nil
 }
 
-// Ping tests liveness of the server.  For this mock it's a no-op,
-// although this code could be extended to mock Ping failures.
+// SetErr causes every subsequent operation, including pings, to fail with
+// err, as they might if the remote were unreachable or unconfigured.  Passing
+// nil restores normal operation.
+func (m *MockExec) SetErr(err error) {
+	m.mu.Lock()
+	m.err = err
+	m.mu.Unlock()
+}
+
+// SetPingDelay causes subsequent pings to take the given time to complete,
+// unless their context is done first.
+func (m *MockExec) SetPingDelay(delay time.Duration) {
+	m.mu.Lock()
+	m.pingDelay = delay
+	m.mu.Unlock()
+}
+
+// Ping tests liveness of the server.  For this mock it succeeds, after the
+// delay set by SetPingDelay, unless an error has been set with SetErr.
 func (m *MockExec) Ping(ctx context.Context) error {
+	m.mu.Lock()
+	err, delay := m.err, m.pingDelay
+	m.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 	return nil
 }
 
@@ -147,6 +189,12 @@ func xlateError(err error) error {
 
 // Execute takes a slice of PropertyOp structures and executes them.
 func (m *MockExec) Execute(ctx context.Context, ops []cfgapi.PropertyOp) cfgapi.CmdHdl {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return &mockCmdHdl{err: m.err}
+	}
 	if m.PTree == nil {
 		return &mockCmdHdl{err: cfgapi.ErrNoConfig}
 	}
@@ -244,6 +292,9 @@ func (m *MockExec) Close() {
 //
 // This is intended to be used in test development.
 func (m *MockExec) PropExists(pname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	_, err := m.PTree.GetNode(pname)
 	return errors.Wrapf(err, "PropExists: %s", pname)
 }
@@ -252,6 +303,9 @@ func (m *MockExec) PropExists(pname string) error {
 //
 // This is intended to be used in test development.
 func (m *MockExec) PropAbsent(pname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	_, err := m.PTree.GetNode(pname)
 	if err == cfgtree.ErrNoProp {
 		return nil
@@ -266,6 +320,9 @@ func (m *MockExec) PropAbsent(pname string) error {
 //
 // This is intended to be used in test development.
 func (m *MockExec) PropEq(pname, expected string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	value, err := m.PTree.GetProp(pname)
 	if err != nil {
 		return errors.Wrapf(err, "PropEq: unexpected error")
@@ -499,9 +499,9 @@ func (s *Site) RegisterMacIPHandler(cb func(net.HardwareAddr, net.IP)) error {
 func NewSite(config *cfgapi.Handle) (*Site, error) {
 	var vpnRing *cfgapi.RingConfig
 
-	rings := config.GetRings()
-	if rings == nil {
-		return nil, fmt.Errorf("unable to fetch ring configs")
+	rings, err := config.GetRings()
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch ring configs: %w", err)
 	}
 
 	subnets := make(map[string]string)
@@ -26,6 +26,76 @@ var Channels = map[string][]int{
 		157, 161, 165},
 }
 
+// DefaultRegDomain is the regulatory domain assumed when none is configured.
+// WorldRegDomain identifies the conservative set of rules applied to countries
+// we have no specific rules for.
+const (
+	DefaultRegDomain = "US"
+	WorldRegDomain   = "00"
+)
+
+// RegRule describes a contiguous range of 20MHz channels permitted in a
+// regulatory domain, along with the maximum transmit power (EIRP, in dBm)
+// allowed on them and whether radar detection (DFS) is required.
+type RegRule struct {
+	Band     string
+	First    int
+	Last     int
+	MaxPower int
+	DFS      bool
+}
+
+// RegDomains maps a country code to the rules for its regulatory domain.  The
+// rules are a simplified form of those in the kernel's wireless-regdb,
+// restricted to the channels we are able to use.
+var RegDomains = map[string][]RegRule{
+	WorldRegDomain: {
+		{LoBand, 1, 11, 20, false},
+		{HiBand, 36, 48, 20, false},
+	},
+	"US": {
+		{LoBand, 1, 11, 30, false},
+		{HiBand, 36, 48, 23, false},
+		{HiBand, 52, 64, 23, true},
+		{HiBand, 100, 144, 23, true},
+		{HiBand, 149, 165, 30, false},
+	},
+	"CA": {
+		{LoBand, 1, 11, 30, false},
+		{HiBand, 36, 48, 23, false},
+		{HiBand, 52, 64, 23, true},
+		{HiBand, 100, 116, 23, true},
+		{HiBand, 132, 144, 23, true},
+		{HiBand, 149, 165, 30, false},
+	},
+	"GB": {
+		{LoBand, 1, 13, 20, false},
+		{HiBand, 36, 48, 23, false},
+		{HiBand, 52, 64, 20, true},
+		{HiBand, 100, 140, 26, true},
+	},
+	"DE": {
+		{LoBand, 1, 13, 20, false},
+		{HiBand, 36, 48, 23, false},
+		{HiBand, 52, 64, 20, true},
+		{HiBand, 100, 140, 26, true},
+	},
+	"JP": {
+		{LoBand, 1, 13, 20, false},
+		{HiBand, 36, 48, 20, false},
+		{HiBand, 52, 64, 20, true},
+		{HiBand, 100, 144, 23, true},
+	},
+}
+
+// RegChannelStep returns the spacing between adjacent 20MHz channels in a band.
+func RegChannelStep(band string) int {
+	if band == HiBand {
+		return 4
+	}
+	return 1
+}
+
 // The following are all the states a physical NIC may be in.  The first three
 // apply to wired as well as wireless NICs, while the remaining states only
 // apply to wireless NICs.
@@ -36,7 +106,7 @@ const (
 	DevUnsupportedBand = "unsupported_band" // Doesn't support the configured band
 	DevUnsupportedChan = "unsupported_chan" // Doesn't support the configured channel
 	DevIllegalBand     = "illegal_band"     // Configured band doesn't exist
-	DevIllegalChan     = "illegal_chan"     // Configured channel doesn't exist
+	DevIllegalChan     = "illegal_chan"     // Configured channel doesn't exist, or isn't permitted
 	DevBadChan         = "bad_chan"         // Configured channel not in configured band
 	DevNoChan          = "nochannel"        // No legal, supported channels available
 )